@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"github.com/ktsakalozos/runproc/internal/oci"
+)
+
+// execAffinity resolves one list of process.execCPUAffinity. create calls it too, so a
+// malformed list, or one naming CPUs the node does not have online, fails the create
+// instead of the init.
+func execAffinity(field, list string) ([]int, error) {
+	cpus, err := parseCPUList(list)
+	if err != nil {
+		return nil, fmt.Errorf("process.execCPUAffinity.%s: %w", field, err)
+	}
+	online, err := onlineCPUs()
+	if err != nil {
+		return nil, err
+	}
+	if off := subtractCPUs(cpus, online); len(off) > 0 {
+		return nil, fmt.Errorf("process.execCPUAffinity.%s: CPUs %s are not online", field, formatCPUList(off))
+	}
+	return cpus, nil
+}
+
+// validateExecAffinity checks both lists of process.execCPUAffinity.
+func validateExecAffinity(a *oci.CPUAffinity) error {
+	if a.Initial != "" {
+		if _, err := execAffinity("initial", a.Initial); err != nil {
+			return err
+		}
+	}
+	if a.Final != "" {
+		if _, err := execAffinity("final", a.Final); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setInitialAffinity pins the whole init to process.execCPUAffinity.initial while it waits
+// and sets up. The node's CPU pool, pinned at start, takes over from it.
+func setInitialAffinity(a *oci.CPUAffinity) error {
+	cpus, err := execAffinity("initial", a.Initial)
+	if err != nil {
+		return err
+	}
+	if err := setAffinity(os.Getpid(), cpus); err != nil {
+		return fmt.Errorf("set process.execCPUAffinity.initial: %w", err)
+	}
+	return nil
+}
+
+// setFinalAffinity pins the thread that execs, and so the workload, to
+// process.execCPUAffinity.final. pinned is the CPU list start pinned the init to, if any:
+// the final list may narrow it, never leave it, so it cannot reach into another
+// container's reserved CPUs or the node's exclusive pool.
+func setFinalAffinity(a *oci.CPUAffinity, pinned string) error {
+	cpus, err := execAffinity("final", a.Final)
+	if err != nil {
+		return err
+	}
+	if pinned != "" {
+		allowed, err := parseCPUList(pinned)
+		if err != nil {
+			return err
+		}
+		if out := subtractCPUs(cpus, allowed); len(out) > 0 {
+			return fmt.Errorf("process.execCPUAffinity.final: CPUs %s are outside the CPUs %s the node pinned the container to", formatCPUList(out), pinned)
+		}
+	}
+	mask := cpuMask(cpus)
+	// This thread execs; never unlocked
+	runtime.LockOSThread()
+	if _, _, e := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0, uintptr(len(mask)*8), uintptr(unsafe.Pointer(&mask[0]))); e != 0 {
+		return fmt.Errorf("set process.execCPUAffinity.final: %w", e)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/ktsakalozos/runproc/internal/apparmor"
+	"github.com/ktsakalozos/runproc/internal/oci"
+)
+
+// appArmorProfile resolves process.apparmorProfile at create, where /sys is the node's:
+// "" when there is nothing to apply. A profile on a node without AppArmor fails rather
+// than running the workload unconfined; "unconfined" there is already the case.
+func appArmorProfile(p *oci.Process) (string, error) {
+	profile := p.ApparmorProfile
+	if profile == "" {
+		return "", nil
+	}
+	if !apparmor.Enabled() {
+		if profile == apparmor.Unconfined {
+			return "", nil
+		}
+		return "", fmt.Errorf("apparmor profile %q requested but AppArmor is not enabled on this node", profile)
+	}
+	return profile, nil
+}
+
+// applyAppArmor confines the workload with profile from its exec on. It runs before
+// setUser, while init may still change its own confinement, and needs the container's
+// /proc.
+func applyAppArmor(profile string) error {
+	// The attribute is per thread and this one execs; never unlocked
+	runtime.LockOSThread()
+	return apparmor.ChangeOnExec(profile)
+}
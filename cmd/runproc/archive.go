@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ktsakalozos/runproc/internal/config"
+	"github.com/ktsakalozos/runproc/internal/oci"
+	"github.com/ktsakalozos/runproc/internal/state"
+)
+
+// archivedLogs are the per-container log files preserved on delete when configured,
+// together with their rotated <name>.N files, and the exit snapshot.
+var archivedLogs = []string{consoleLogName, stdoutLogName, stderrLogName, auditLogName, snapshotName}
+
+// archiveLogs moves the container's log files out of the state dir into the configured
+// archive (logs.archive_dir), keyed by pod namespace, pod name and date so they survive
+// Kubernetes garbage-collecting the pod. It is a no-op unless an archive dir is set.
+func archiveLogs(stateDir string, st *state.ContainerState) error {
+	cfg, err := config.Load()
+	if err != nil {
+		return err
+	}
+	if cfg.Logs.ArchiveDir == "" {
+		return nil
+	}
+	namespace := archiveKey(st.Annotations[oci.SandboxNamespaceAnnotation])
+	pod := archiveKey(st.Annotations[oci.SandboxNameAnnotation])
+	root := filepath.Clean(cfg.Logs.ArchiveDir)
+	dest := filepath.Join(root, namespace, pod, time.Now().UTC().Format("2006-01-02"), st.ID)
+	if !strings.HasPrefix(dest, root+string(filepath.Separator)) {
+		return fmt.Errorf("archive dir %s for %s is outside %s", dest, st.ID, root)
+	}
+	var errs []error
+	var names []string
+	for _, name := range archivedLogs {
+		rotated, _ := filepath.Glob(filepath.Join(stateDir, st.ID, name+".[0-9]*"))
+		names = append(names, name)
+		for _, p := range rotated {
+			names = append(names, filepath.Base(p))
+		}
+	}
+	for _, name := range names {
+		src := filepath.Join(stateDir, st.ID, name)
+		if _, err := os.Stat(src); err != nil {
+			continue
+		}
+		if err := os.MkdirAll(dest, 0o700); err != nil {
+			return err
+		}
+		if err := moveFile(src, filepath.Join(dest, name)); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// archiveKey is the archive path element for a sandbox annotation value, "_" when it is
+// unset or not a plain name: the workload writes its own annotations, and a value such as
+// "../../etc" must not place files outside the archive.
+func archiveKey(v string) string {
+	if v == "" || state.ValidateID(v) != nil {
+		return "_"
+	}
+	return v
+}
+
+// moveFile renames src to dst, falling back to copy+remove across filesystems.
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|syscall.O_NOFOLLOW, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ktsakalozos/runproc/internal/oci"
+	"github.com/ktsakalozos/runproc/internal/state"
+)
+
+// attachSockName is the unix socket under the container state dir on which the monitor of
+// a detached container serves its stdio.
+const attachSockName = "attach.sock"
+
+// Output is sent to attach clients as frames: one stream byte, a big-endian uint32
+// length, then the payload. Client input is forwarded raw to the container's stdin.
+const (
+	attachStdout byte = 1
+	attachStderr byte = 2
+)
+
+// attachWriteTimeout bounds how long a stuck client may hold up container output before
+// it is dropped.
+const attachWriteTimeout = time.Second
+
+// attachHub fans container output out to connected attach clients and forwards their
+// input to the container's stdin.
+type attachHub struct {
+	mu      sync.Mutex
+	l       net.Listener
+	clients map[net.Conn]struct{}
+	stdin   io.WriteCloser
+	// stdinOnce closes stdin when the first client ends its input (see parseStdinOnce)
+	stdinOnce  bool
+	closeStdin sync.Once
+}
+
+// parseStdinOnce reads the runproc.stdin_once annotation; create calls it so a bad value
+// fails there rather than in the monitor.
+func parseStdinOnce(annotations map[string]string) (bool, error) {
+	v, ok := annotations[oci.StdinOnceAnnotation]
+	if !ok {
+		return false, nil
+	}
+	once, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%s: %q is not a boolean", oci.StdinOnceAnnotation, v)
+	}
+	return once, nil
+}
+
+// listenAttach starts serving attach clients on dir/attach.sock.
+func listenAttach(dir string, stdin io.WriteCloser, stdinOnce bool) (*attachHub, error) {
+	p, dirf, err := unixPath(dir, attachSockName)
+	if err != nil {
+		return nil, err
+	}
+	if dirf != nil {
+		defer dirf.Close()
+	}
+	l, err := net.Listen("unix", p)
+	if err != nil {
+		return nil, fmt.Errorf("listen for attach: %w", err)
+	}
+	h := &attachHub{l: l, clients: map[net.Conn]struct{}{}, stdin: stdin, stdinOnce: stdinOnce}
+	go h.serve()
+	return h, nil
+}
+
+func (h *attachHub) serve() {
+	for {
+		c, err := h.l.Accept()
+		if err != nil {
+			return
+		}
+		h.mu.Lock()
+		h.clients[c] = struct{}{}
+		h.mu.Unlock()
+		go func() {
+			// Input from several clients is interleaved. A client ending its input
+			// (half-close or hang-up) leaves the container's stdin open for others,
+			// unless stdin is once-only
+			if _, err := io.Copy(h.stdin, c); err == nil && h.stdinOnce {
+				h.closeStdin.Do(func() { h.stdin.Close() })
+			}
+			// Keep reading once stdin is gone so the client is never blocked writing
+			_, _ = io.Copy(io.Discard, c)
+		}()
+	}
+}
+
+// broadcast sends a chunk of the given stream to every client, dropping clients that
+// cannot keep up.
+func (h *attachHub) broadcast(stream byte, p []byte) {
+	frame := make([]byte, 5+len(p))
+	frame[0] = stream
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(p)))
+	copy(frame[5:], p)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		_ = c.SetWriteDeadline(time.Now().Add(attachWriteTimeout))
+		if _, err := c.Write(frame); err != nil {
+			c.Close()
+			delete(h.clients, c)
+		}
+	}
+}
+
+// Close stops accepting clients and disconnects the current ones.
+func (h *attachHub) Close() error {
+	err := h.l.Close()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		c.Close()
+		delete(h.clients, c)
+	}
+	return err
+}
+
+// cmdAttach connects the caller's stdio to a detached container until the container exits
+// (or the caller is interrupted, which leaves the container running).
+func cmdAttach(stateDir, id string, stdin io.Reader, stdout, stderr io.Writer) error {
+	st, err := state.Load(stateDir, id)
+	if err != nil {
+		return err
+	}
+	if st.Status != state.Running || !pidRunning(st.Pid) {
+		return state.NotRunning(id)
+	}
+	p, dirf, err := unixPath(filepath.Join(stateDir, id), attachSockName)
+	if err != nil {
+		return err
+	}
+	c, err := net.Dial("unix", p)
+	if dirf != nil {
+		dirf.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("container %s has no attachable stdio (only run --detach containers do): %w", id, err)
+	}
+	defer c.Close()
+	go func() {
+		// Half-close at the end of our input: the container's output keeps coming
+		_, _ = io.Copy(c, stdin)
+		_ = c.(*net.UnixConn).CloseWrite()
+	}()
+
+	hdr := make([]byte, 5)
+	for {
+		if _, err := io.ReadFull(c, hdr); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		w := stdout
+		if hdr[0] == attachStderr {
+			w = stderr
+		}
+		if _, err := io.CopyN(w, c, int64(binary.BigEndian.Uint32(hdr[1:]))); err != nil {
+			return err
+		}
+	}
+}
+
+// unixPath returns a socket path for name in dir that fits in sun_path. Deep state dirs
+// are reached through /proc/self/fd; the returned directory must stay open until the
+// path has been used.
+func unixPath(dir, name string) (string, *os.File, error) {
+	p := filepath.Join(dir, name)
+	if len(p) < 108 {
+		return p, nil, nil
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return "", nil, err
+	}
+	return filepath.Join("/proc/self/fd", strconv.Itoa(int(f.Fd())), name), f, nil
+}
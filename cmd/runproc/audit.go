@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ktsakalozos/runproc/internal/oci"
+	"github.com/ktsakalozos/runproc/internal/state"
+)
+
+// metricsPrefix namespaces the counters in the Prometheus text format.
+const metricsPrefix = "runproc_"
+
+// auditedOps are the lifecycle operations counted by recordOperation, each with an
+// "<op>s_total" counter and an "<op>_errors_total{code=...}" counter per error class.
+var auditedOps = []string{"create", "start", "kill", "delete"}
+
+// recordOperation counts one run of op on the state root, its failure class if err is
+// set, and any extra series. Counting is best effort: it never fails the operation.
+func recordOperation(stateDir, op string, err error, extra ...string) {
+	series := append([]string{op + "s_total"}, extra...)
+	if err != nil {
+		series = append(series, fmt.Sprintf("%s_errors_total{code=%q}", op, errorClass(err)))
+	}
+	_ = state.AddCounters(stateDir, series...)
+}
+
+// errorClass buckets an operation error into a small fixed set, so dashboards can tell
+// caller mistakes (unknown or duplicate ids, bad specs) from runtime trouble.
+func errorClass(err error) string {
+	switch {
+	case errors.Is(err, state.ErrExist):
+		return "exists"
+	case errors.Is(err, state.ErrNotExist):
+		return "not_found"
+	case errors.Is(err, state.ErrNotRunning):
+		return "not_running"
+	case errors.Is(err, state.ErrOpInProgress):
+		return "busy"
+	case errors.Is(err, state.ErrInvalidID):
+		return "invalid_id"
+	case errors.Is(err, state.ErrUnsafe):
+		return "unsafe_state"
+	case errors.Is(err, oci.ErrInvalidSpec):
+		return "invalid_spec"
+	case errors.Is(err, errInjectedFault):
+		return "fault"
+	}
+	return "internal"
+}
+
+// runtimeStats is `stats --runtime` in JSON.
+type runtimeStats struct {
+	Timestamp time.Time      `json:"timestamp"`
+	Counters  state.Counters `json:"counters"`
+}
+
+// cmdRuntimeStats prints the runtime's own counters, as JSON or in the Prometheus text
+// format (for node_exporter's textfile collector; runproc has no daemon to scrape).
+func cmdRuntimeStats(stateDir, format string, w io.Writer) error {
+	c, err := state.LoadCounters(stateDir)
+	if err != nil {
+		return fmt.Errorf("read runtime counters: %w", err)
+	}
+	// Totals read as zero before the first operation rather than missing
+	for _, op := range auditedOps {
+		if _, ok := c[op+"s_total"]; !ok {
+			c[op+"s_total"] = 0
+		}
+	}
+	if _, ok := c["deletes_forced_total"]; !ok {
+		c["deletes_forced_total"] = 0
+	}
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(runtimeStats{Timestamp: time.Now().UTC(), Counters: c})
+	case "prometheus":
+		series := make([]string, 0, len(c))
+		for s := range c {
+			series = append(series, s)
+		}
+		sort.Strings(series)
+		typed := map[string]bool{}
+		for _, s := range series {
+			name, _, _ := strings.Cut(s, "{")
+			if !typed[name] {
+				fmt.Fprintf(w, "# TYPE %s%s counter\n", metricsPrefix, name)
+				typed[name] = true
+			}
+			fmt.Fprintf(w, "%s%s %d\n", metricsPrefix, s, c[s])
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown format %q: use json or prometheus", format)
+}
+
+// auditLogName is the container's event log in its state dir, one JSON object per line.
+// Delete archives it with the container's logs.
+const auditLogName = "audit.log"
+
+// containerEvent is a line of audit.log.
+type containerEvent struct {
+	Time        time.Time `json:"time"`
+	Event       string    `json:"event"`
+	Descendants int       `json:"descendants,omitempty"`
+	Limit       int       `json:"limit,omitempty"`
+	Signal      string    `json:"signal,omitempty"`
+	// Op and Pid are the operation and process whose lock was recovered
+	Op  string `json:"op,omitempty"`
+	Pid int    `json:"pid,omitempty"`
+}
+
+// recordEvent appends ev to the audit.log of container id, stamped with the current time.
+func recordEvent(stateDir, id string, ev containerEvent) error {
+	ev.Time = time.Now().UTC()
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(stateDir, id, auditLogName), os.O_CREATE|os.O_WRONLY|os.O_APPEND|syscall.O_NOFOLLOW, 0o600)
+	if err != nil {
+		return err
+	}
+	// One write, so concurrent writers do not interleave lines
+	_, err = f.Write(append(b, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
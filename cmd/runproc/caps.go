@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/ktsakalozos/runproc/internal/oci"
+)
+
+// prctl options and capset(2) ABI constants the syscall package lacks.
+const (
+	prSetKeepCaps        = 8
+	prSetNoNewPrivs      = 38
+	prCapBSetDrop        = 24
+	prCapAmbient         = 47
+	prCapAmbientRaise    = 2
+	prCapAmbientClearAll = 4
+	capabilityVersion3   = 0x20080522
+)
+
+// capSet is a capability set as a bit mask.
+type capSet uint64
+
+// capSets are process.capabilities resolved against the running kernel.
+type capSets struct {
+	bounding, effective, permitted, inheritable, ambient capSet
+}
+
+// parseCapabilities resolves the spec's capability names. Like runc, names this build or
+// the running kernel does not know are ignored, so specs written for newer kernels run.
+func parseCapabilities(c *oci.LinuxCapabilities) capSets {
+	last := lastCap()
+	set := func(names []string) capSet {
+		var s capSet
+		for _, n := range names {
+			if bit, ok := oci.CapabilityBits[strings.ToUpper(n)]; ok && bit <= last {
+				s |= 1 << bit
+			}
+		}
+		return s
+	}
+	return capSets{
+		bounding:    set(c.Bounding),
+		effective:   set(c.Effective),
+		permitted:   set(c.Permitted),
+		inheritable: set(c.Inheritable),
+		ambient:     set(c.Ambient),
+	}
+}
+
+// lastCap is the highest capability the kernel supports.
+func lastCap() uint {
+	b, err := os.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if err == nil {
+		if n, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 8); err == nil {
+			return uint(n)
+		}
+	}
+	return oci.CapabilityBits["CAP_CHECKPOINT_RESTORE"]
+}
+
+// Capabilities are per thread: the functions below must run on the thread that execs,
+// locked by the caller.
+
+// dropBoundingSet removes every capability outside bounding from the bounding set, so
+// neither the workload nor anything it execs can regain them. It needs CAP_SETPCAP, so
+// it runs before the switch to process.user.
+func dropBoundingSet(bounding capSet) error {
+	for bit := uint(0); bit <= lastCap(); bit++ {
+		if bounding&(1<<bit) != 0 {
+			continue
+		}
+		if err := prctl(prCapBSetDrop, uintptr(bit), 0); err != nil {
+			return fmt.Errorf("drop capability %d from the bounding set: %w", bit, err)
+		}
+	}
+	return nil
+}
+
+// setKeepCaps keeps the permitted set across a setuid away from root while on.
+func setKeepCaps(on bool) error {
+	var v uintptr
+	if on {
+		v = 1
+	}
+	return prctl(prSetKeepCaps, v, 0)
+}
+
+// applyCapabilities sets the effective, permitted and inheritable sets with capset(2),
+// then raises the ambient ones, which the kernel only allows for capabilities that are
+// both permitted and inheritable.
+func applyCapabilities(c capSets) error {
+	hdr := struct {
+		version uint32
+		pid     int32
+	}{version: capabilityVersion3}
+	var data [2]struct{ effective, permitted, inheritable uint32 }
+	for i := range data {
+		shift := 32 * uint(i)
+		data[i].effective = uint32(c.effective >> shift)
+		data[i].permitted = uint32(c.permitted >> shift)
+		data[i].inheritable = uint32(c.inheritable >> shift)
+	}
+	if _, _, e := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0); e != 0 {
+		return fmt.Errorf("capset: %w", e)
+	}
+	if err := prctl(prCapAmbient, prCapAmbientClearAll, 0); err != nil {
+		return fmt.Errorf("clear ambient capabilities: %w", err)
+	}
+	for bit := uint(0); bit < 64; bit++ {
+		if c.ambient&(1<<bit) == 0 {
+			continue
+		}
+		if err := prctl(prCapAmbient, prCapAmbientRaise, uintptr(bit)); err != nil {
+			return fmt.Errorf("raise ambient capability %d: %w", bit, err)
+		}
+	}
+	return nil
+}
+
+// setNoNewPrivs sets no_new_privs, so neither the workload nor anything it execs can gain
+// privileges through setuid/setgid bits or file capabilities. It is inherited and cannot
+// be cleared. Unlike capabilities it needs no privilege, but it is per thread too.
+func setNoNewPrivs() error {
+	// This thread execs; never unlocked
+	runtime.LockOSThread()
+	if err := prctl(prSetNoNewPrivs, 1, 0); err != nil {
+		return fmt.Errorf("set no_new_privs: %w", err)
+	}
+	return nil
+}
+
+func prctl(option, arg2, arg3 uintptr) error {
+	if _, _, e := syscall.RawSyscall6(syscall.SYS_PRCTL, option, arg2, arg3, 0, 0, 0); e != 0 {
+		return e
+	}
+	return nil
+}
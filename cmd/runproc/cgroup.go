@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/ktsakalozos/runproc/internal/cgroups"
+	"github.com/ktsakalozos/runproc/internal/oci"
+)
+
+// containerCgroup returns the cgroup create makes for the container, as a path from the
+// root of each hierarchy, or "" to leave the container in its caller's cgroup (the shim's).
+// runproc only manages cgroups as root, for a spec with a linux.cgroupsPath or
+// linux.resources; without a path the cgroup is /runproc/<id>. With the systemd driver
+// (--systemd-cgroup) it is the cgroup of the scope returned too, which systemd makes.
+func containerCgroup(spec *oci.Spec, id string, systemd bool) (string, *cgroups.Scope, error) {
+	if spec.Linux == nil || (spec.Linux.CgroupsPath == "" && spec.Linux.Resources == nil) {
+		return "", nil, nil
+	}
+	if os.Geteuid() != 0 {
+		return "", nil, nil
+	}
+	if systemd {
+		if !cgroups.SystemdAvailable() {
+			return "", nil, errors.New("--systemd-cgroup: systemd is not running on this node (or busctl is missing)")
+		}
+		scope, err := cgroups.ParseScope(spec.Linux.CgroupsPath, id)
+		if err != nil {
+			return "", nil, err
+		}
+		return scope.Path, scope, nil
+	}
+	if !cgroups.Manageable() {
+		return "", nil, nil
+	}
+	p := spec.Linux.CgroupsPath
+	if p == "" {
+		return "/runproc/" + id, nil, nil
+	}
+	if strings.Contains(p, ":") {
+		return "", nil, fmt.Errorf("linux.cgroupsPath %q is a systemd slice:prefix:name path, which needs --systemd-cgroup", p)
+	}
+	// Relative paths are taken from the root of the hierarchy too
+	if p = path.Clean("/" + p); p == "/" {
+		return "", nil, errors.New("linux.cgroupsPath cannot be the root cgroup")
+	}
+	return p, nil, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/ktsakalozos/runproc/internal/state"
+)
+
+// checkpointOptions mirrors the subset of runc checkpoint flags runproc understands.
+type checkpointOptions struct {
+	imagePath      string
+	workPath       string
+	leaveRunning   bool
+	tcpEstablished bool
+	extUnixSk      bool
+	fileLocks      bool
+}
+
+// cmdCheckpoint dumps the container's process tree to an image directory using CRIU.
+// Unless leaveRunning is set, CRIU kills the tree after a successful dump and the
+// container is recorded as stopped.
+func cmdCheckpoint(stateDir, id string, opts checkpointOptions) error {
+	lock, err := acquireLock(stateDir, id, "checkpoint")
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+	st, err := state.Load(stateDir, id)
+	if err != nil {
+		return err
+	}
+	if st.Status != state.Running || !pidAlive(st.Pid) {
+		return state.NotRunning(id)
+	}
+	criu, err := exec.LookPath("criu")
+	if err != nil {
+		return errors.New("checkpoint requires criu in PATH")
+	}
+
+	imagePath := opts.imagePath
+	if imagePath == "" {
+		imagePath = "checkpoint"
+	}
+	imagePath, err = filepath.Abs(imagePath)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(imagePath, 0o700); err != nil {
+		return fmt.Errorf("create image path: %w", err)
+	}
+	workPath := opts.workPath
+	if workPath == "" {
+		workPath = imagePath
+	}
+	workPath, err = filepath.Abs(workPath)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(workPath, 0o700); err != nil {
+		return fmt.Errorf("create work path: %w", err)
+	}
+
+	// Stdio is inherited from whoever created the container (possibly a terminal), so let
+	// CRIU treat the tree as a shell job.
+	args := []string{
+		"dump",
+		"--tree", strconv.Itoa(st.Pid),
+		"--images-dir", imagePath,
+		"--work-dir", workPath,
+		"--log-file", "dump.log",
+		"--shell-job",
+		"-v4",
+	}
+	if opts.leaveRunning {
+		args = append(args, "--leave-running")
+	}
+	if opts.tcpEstablished {
+		args = append(args, "--tcp-established")
+	}
+	if opts.extUnixSk {
+		args = append(args, "--ext-unix-sk")
+	}
+	if opts.fileLocks {
+		args = append(args, "--file-locks")
+	}
+	cmd := exec.Command(criu, args...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("criu dump failed (see %s): %w", filepath.Join(workPath, "dump.log"), err)
+	}
+
+	if opts.leaveRunning {
+		return nil
+	}
+	now := time.Now()
+	st.Status = state.Stopped
+	st.ExitedAt = &now
+	return state.Save(stateDir, st)
+}
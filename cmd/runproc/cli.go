@@ -1,23 +1,49 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/ktsakalozos/runproc/internal/config"
+	"github.com/ktsakalozos/runproc/internal/state"
 )
 
 func usage() {
 	fmt.Fprintf(os.Stderr, "runproc - a minimal OCI runtime (MVP)\n")
 	fmt.Fprintf(os.Stderr, "Usage:\n")
-	fmt.Fprintf(os.Stderr, "  runproc create [--pid-file <path>] <id> <bundle>\n")
+	fmt.Fprintf(os.Stderr, "  runproc create [--pid-file <path>] [--console-socket <path>] [--stdin <path>] [--stdout <path>] [--stderr <path>] [--preserve-fds <n>] [--no-pivot] <id> <bundle>\n")
 	fmt.Fprintf(os.Stderr, "  runproc start <id>\n")
 	fmt.Fprintf(os.Stderr, "  runproc state <id>\n")
-	fmt.Fprintf(os.Stderr, "  runproc kill <id> <signal>\n")
-	fmt.Fprintf(os.Stderr, "  runproc delete <id>\n")
-	fmt.Fprintf(os.Stderr, "  runproc run <id> <bundle>\n")
+	fmt.Fprintf(os.Stderr, "  runproc kill [--all] [--dry-run] <id> <signal>\n")
+	fmt.Fprintf(os.Stderr, "  runproc delete [--force] <id>\n")
+	fmt.Fprintf(os.Stderr, "  runproc delete --all [--force] [--parallel <n>]\n")
+	fmt.Fprintf(os.Stderr, "  runproc wait <id>\n")
+	fmt.Fprintf(os.Stderr, "  runproc events <id>\n")
+	fmt.Fprintf(os.Stderr, "  runproc migrate-state [<id>...]\n")
+	fmt.Fprintf(os.Stderr, "  runproc attach <id>\n")
+	fmt.Fprintf(os.Stderr, "  runproc console --console-socket <path> <id>\n")
+	fmt.Fprintf(os.Stderr, "  runproc logs [--follow] [--tail <n>] [--timestamps] <id>\n")
+	fmt.Fprintf(os.Stderr, "  runproc stats [--watch] [--interval <duration>] <id>\n")
+	fmt.Fprintf(os.Stderr, "  runproc stats --runtime [--format json|prometheus]\n")
+	fmt.Fprintf(os.Stderr, "  runproc inspect <id>\n")
+	fmt.Fprintf(os.Stderr, "  runproc pods [--format table|json]\n")
+	fmt.Fprintf(os.Stderr, "  runproc top [--interval <duration>] [--iterations <n>] <id>\n")
+	fmt.Fprintf(os.Stderr, "  runproc run [--detach] [--no-console-log] [--preserve-fds <n>] [--no-pivot] [--result] [--result-file <file>] <id> <bundle>\n")
+	fmt.Fprintf(os.Stderr, "  runproc exec [--process <file>] [--detach] [--pid-file <path>] [--console-socket <path>] [--preserve-fds <n>] <id> [<command> [<arg>...]]\n")
+	fmt.Fprintf(os.Stderr, "  runproc run --nomad-compat [--no-pivot] [--result] [--result-file <file>] [--bundle <dir>] [<id>]\n")
+	fmt.Fprintf(os.Stderr, "  runproc time [--count <n>] <bundle>\n")
+	fmt.Fprintf(os.Stderr, "  runproc features\n")
+	fmt.Fprintf(os.Stderr, "  runproc version [--format text|json]\n")
+	fmt.Fprintf(os.Stderr, "  runproc spec [--bundle <dir>] [--host|--rootless]\n")
+	fmt.Fprintf(os.Stderr, "  runproc checkpoint [--image-path <dir>] [--leave-running] <id>\n")
+	fmt.Fprintf(os.Stderr, "  runproc completion bash|zsh|fish\n")
 }
 
 func run() int {
@@ -29,7 +55,7 @@ func run() int {
 	preOut, overrides := preprocessRuncCompat("", os.Args[1:])
 	if len(preOut) == 0 {
 		// No command found; log and exit
-		writeOCIErrorLog(overrides.logPath, "no command specified")
+		writeOCIErrorLog(overrides, "no command specified")
 		usage()
 		return 1
 	}
@@ -38,30 +64,216 @@ func run() int {
 
 	// Special internal command used by create to spawn the init process
 	if cmd == "init" {
+		fs := flag.NewFlagSet("init", flag.ContinueOnError)
+		preserveFds := fs.Int("preserve-fds", 0, "fds from 3 on to keep for the workload")
+		_ = fs.Parse(args)
+		args = fs.Args()
 		if len(args) != 2 {
-			fmt.Fprintln(os.Stderr, "init requires <stateDir> <id>")
+			fmt.Fprintln(os.Stderr, "init requires [--preserve-fds <n>] <stateDir> <id>")
 			return 1
 		}
-		if err := cmdInit(args[0], args[1]); err != nil {
+		if err := cmdInit(args[0], args[1], *preserveFds); err != nil {
+			var killed *errKilledBeforeStart
+			if errors.As(err, &killed) {
+				return 128 + int(killed.sig)
+			}
 			fmt.Fprintln(os.Stderr, err)
 			return 1
 		}
 		return 0
 	}
 
+	// Internal command that execs the process of `exec` in the container; see cmdExecInit
+	if cmd == execInitCommand {
+		fs := flag.NewFlagSet(execInitCommand, flag.ContinueOnError)
+		preserveFds := fs.Int("preserve-fds", 0, "fds from 3 on to keep for the process")
+		_ = fs.Parse(args)
+		if fs.NArg() != 0 {
+			fmt.Fprintln(os.Stderr, "exec-init requires [--preserve-fds <n>]")
+			return 1
+		}
+		if err := cmdExecInit(*preserveFds); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+
+	// Internal command that keeps a user namespace alive for create; see newUserns
+	if cmd == usernsHolderCommand {
+		_, _ = io.Copy(io.Discard, os.Stdin)
+		return 0
+	}
+
+	// Internal command that starts init in a joined user namespace; see startInUserns
+	if cmd == usernsInitCommand {
+		if len(args) != 1 {
+			fmt.Fprintln(os.Stderr, "userns-init requires <spec>")
+			return 1
+		}
+		if err := cmdUsernsInit(args[0]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+
+	// Internal command a wasm workload's init execs; see cmdWasmRun
+	if cmd == wasmRunCommand {
+		if len(args) != 1 {
+			fmt.Fprintln(os.Stderr, "wasm-run requires <module>")
+			return 1
+		}
+		code, err := cmdWasmRun(args[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return code
+	}
+
+	// Internal command that keeps a terminal container's pty master; see cmdConsoleHolder
+	if cmd == consoleHolderCommand {
+		if len(args) != 3 {
+			fmt.Fprintln(os.Stderr, "console-holder requires <stateDir> <id> <pid>")
+			return 1
+		}
+		pid, err := strconv.Atoi(args[2])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "console-holder: invalid pid:", args[2])
+			return 1
+		}
+		if err := cmdConsoleHolder(args[0], args[1], pid); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+
+	// Internal command behind `run --detach`; see cmdMonitor
+	if cmd == "monitor" {
+		fs := flag.NewFlagSet("monitor", flag.ContinueOnError)
+		noPivot := fs.Bool("no-pivot", false, "enter the rootfs without pivot_root")
+		resultFile := fs.String("result-file", "", "write the run result to this file")
+		consoleSocket := fs.String("console-socket", "", "unix socket to receive the pty master (process.terminal)")
+		preserveFds := fs.Int("preserve-fds", 0, "fds from 4 on to pass on to the container as 3 and up")
+		_ = fs.Parse(args)
+		args = fs.Args()
+		if len(args) != 3 && len(args) != 4 {
+			fmt.Fprintln(os.Stderr, "monitor requires [--no-pivot] [--systemd-cgroup] [--result-file <file>] [--console-socket <path>] [--preserve-fds <n>] <stateDir> <id> <bundle> [pid-file]")
+			return 1
+		}
+		// fd 3 is the report pipe, so what `run` preserved follows it
+		preserved, err := inheritedFiles(4, *preserveFds)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		pidFile := ""
+		if len(args) == 4 {
+			pidFile = args[3]
+		}
+		if err := cmdMonitor(args[0], args[1], args[2], pidFile, *consoleSocket, *resultFile, preserved, *noPivot, overrides.systemdCgroup); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+
+	// Internal command behind the runproc.snapshot archive; see takeSnapshot
+	if cmd == "snapshot-paths" {
+		if len(args) < 2 {
+			fmt.Fprintln(os.Stderr, "snapshot-paths requires <root> <path>...")
+			return 1
+		}
+		if err := cmdSnapshotPaths(args[0], args[1:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+
+	// features, version and spec do not need a state dir
+	if cmd == "version" {
+		fs := flag.NewFlagSet("version", flag.ContinueOnError)
+		format := fs.String("format", "text", "output format: text or json")
+		_ = fs.Parse(args)
+		if fs.NArg() != 0 {
+			usage()
+			return 1
+		}
+		if err := cmdVersion(os.Stdout, *format); err != nil {
+			reportError(overrides, err)
+			return 1
+		}
+		return 0
+	}
+	if cmd == "features" {
+		if len(args) != 0 {
+			usage()
+			return 1
+		}
+		if err := cmdFeatures(os.Stdout); err != nil {
+			reportError(overrides, err)
+			return 1
+		}
+		return 0
+	}
+	if cmd == "spec" {
+		fs := flag.NewFlagSet("spec", flag.ContinueOnError)
+		bundle := fs.String("bundle", "", "path to the root of the bundle directory")
+		host := fs.Bool("host", false, "generate a host-mode spec (no rootfs)")
+		rootless := fs.Bool("rootless", false, "generate a spec for runproc without root (a user namespace of your ids)")
+		_ = fs.Parse(args)
+		if fs.NArg() != 0 || *host && *rootless {
+			usage()
+			return 1
+		}
+		if err := cmdSpec(*bundle, *host, *rootless); err != nil {
+			reportError(overrides, err)
+			return 1
+		}
+		return 0
+	}
+
 	// Determine state dir (RUNPROC_STATE_DIR or default), allow override via global --root
 	stateDir := os.Getenv("RUNPROC_STATE_DIR")
 	if stateDir == "" {
 		stateDir = "/run/runproc"
+		if dir := rootlessStateDir(); dir != "" {
+			stateDir = dir
+		}
 	}
 	if overrides.root != "" {
 		stateDir = overrides.root
 		os.Setenv("RUNPROC_STATE_DIR", overrides.root)
 	}
+	// completion only reads the state dir (for container ids), so do not create it
+	if cmd == "completion" {
+		if len(args) != 1 {
+			usage()
+			return 1
+		}
+		var err error
+		if args[0] == "ids" {
+			err = cmdCompletionIDs(os.Stdout, stateDir)
+		} else {
+			err = cmdCompletion(os.Stdout, args[0])
+		}
+		if err != nil {
+			reportError(overrides, err)
+			return 1
+		}
+		return 0
+	}
 	if err := os.MkdirAll(stateDir, 0o700); err != nil {
 		fmt.Fprintf(os.Stderr, "failed to ensure state dir: %v\n", err)
 		return 1
 	}
+	if err := state.CheckRoot(stateDir); err != nil {
+		fmt.Fprintf(os.Stderr, "refusing state dir: %v\n", err)
+		return 1
+	}
 	sd, _ := filepath.Abs(stateDir)
 
 	// Preprocess args to be runc-compatible: accept and ignore common flags
@@ -74,8 +286,15 @@ func run() int {
 	case "create":
 		fs := flag.NewFlagSet("create", flag.ContinueOnError)
 		pidFile := fs.String("pid-file", "", "path to write init pid")
+		consoleSocket := fs.String("console-socket", "", "unix socket to receive the pty master (process.terminal)")
+		noPivot := fs.Bool("no-pivot", false, "enter the rootfs with MS_MOVE and chroot instead of pivot_root")
 		bundleFlag := fs.String("bundle", "", "path to the OCI bundle")
 		fs.StringVar(bundleFlag, "b", "", "path to the OCI bundle (shorthand)")
+		var stdio stdioPaths
+		fs.StringVar(&stdio.stdin, "stdin", "", "FIFO or file to connect the container's stdin to")
+		fs.StringVar(&stdio.stdout, "stdout", "", "FIFO or file to connect the container's stdout to")
+		fs.StringVar(&stdio.stderr, "stderr", "", "FIFO or file to connect the container's stderr to")
+		preserveFds := fs.Int("preserve-fds", 0, "pass this many extra fds, from 3 on, to the container")
 		_ = fs.Parse(updatedArgs)
 		rem := fs.Args()
 		var id, bundle string
@@ -88,9 +307,13 @@ func run() int {
 			usage()
 			return 1
 		}
-		if err := cmdCreate(sd, id, bundle, *pidFile); err != nil {
-			writeOCIErrorLog(overrides.logPath, err.Error())
-			fmt.Fprintln(os.Stderr, err)
+		preserved, err := inheritedFiles(3, *preserveFds)
+		if err != nil {
+			reportError(overrides, err)
+			return 1
+		}
+		if err := cmdCreate(sd, id, bundle, createOptions{pidFile: *pidFile, consoleSocket: *consoleSocket, stdio: stdio, preserved: preserved, noPivot: *noPivot, systemdCgroup: overrides.systemdCgroup}); err != nil {
+			reportError(overrides, err)
 			return 1
 		}
 	case "start":
@@ -100,8 +323,7 @@ func run() int {
 		}
 		id := updatedArgs[0]
 		if err := cmdStart(sd, id); err != nil {
-			writeOCIErrorLog(overrides.logPath, err.Error())
-			fmt.Fprintln(os.Stderr, err)
+			reportError(overrides, err)
 			return 1
 		}
 	case "state":
@@ -111,23 +333,26 @@ func run() int {
 		}
 		id := updatedArgs[0]
 		if err := cmdState(sd, id, os.Stdout); err != nil {
-			writeOCIErrorLog(overrides.logPath, err.Error())
-			fmt.Fprintln(os.Stderr, err)
+			reportError(overrides, err)
 			return 1
 		}
 	case "kill":
-		// accept and drop --all, and support signal-first forms
-		// expected inputs we support:
+		// supported forms (-a/--all signals every process of the container, --dry-run
+		// only lists the processes):
 		//   kill <id>
 		//   kill <id> <signal|number>
 		//   kill <signal|number> <id>
-		// and we ignore -a/--all
+		all, dryRun := false, false
 		args2 := make([]string, 0, len(updatedArgs))
 		for _, a := range updatedArgs {
-			if a == "--all" || a == "-a" {
-				continue
+			switch a {
+			case "--all", "-a":
+				all = true
+			case "--dry-run":
+				dryRun = true
+			default:
+				args2 = append(args2, a)
 			}
-			args2 = append(args2, a)
 		}
 		if len(args2) == 0 || len(args2) > 2 {
 			usage()
@@ -148,37 +373,258 @@ func run() int {
 				sig = strings.TrimPrefix(b, "-")
 			}
 		}
-		if err := cmdKill(sd, id, sig); err != nil {
-			writeOCIErrorLog(overrides.logPath, err.Error())
-			fmt.Fprintln(os.Stderr, err)
+		signal, err := parseSignal(sig)
+		if err != nil {
+			reportError(overrides, err)
+			return 1
+		}
+		if dryRun {
+			if err := cmdKillDryRun(sd, id, signal, all, os.Stdout); err != nil {
+				reportError(overrides, err)
+				return 1
+			}
+			break
+		}
+		if err := cmdKill(sd, id, signal, all); err != nil {
+			reportError(overrides, err)
 			return 1
 		}
 	case "delete":
-		// accept and drop --force
+		force, all := false, false
+		workers := defaultDeleteWorkers
 		cleaned := make([]string, 0, len(updatedArgs))
 		for i := 0; i < len(updatedArgs); i++ {
-			if updatedArgs[i] == "--force" || updatedArgs[i] == "-f" {
-				continue
+			switch a := updatedArgs[i]; a {
+			case "--force", "-f":
+				force = true
+			case "--all", "-a":
+				all = true
+			case "--parallel":
+				if i+1 >= len(updatedArgs) {
+					usage()
+					return 1
+				}
+				n, err := strconv.Atoi(updatedArgs[i+1])
+				if err != nil {
+					usage()
+					return 1
+				}
+				workers = n
+				i++
+			default:
+				cleaned = append(cleaned, a)
+			}
+		}
+		if all {
+			if len(cleaned) != 0 {
+				usage()
+				return 1
 			}
-			cleaned = append(cleaned, updatedArgs[i])
+			if err := cmdDeleteAll(sd, force, workers); err != nil {
+				reportError(overrides, err)
+				return 1
+			}
+			break
 		}
 		if len(cleaned) != 1 {
 			usage()
 			return 1
 		}
 		id := cleaned[0]
-		if err := cmdDelete(sd, id); err != nil {
-			writeOCIErrorLog(overrides.logPath, err.Error())
-			fmt.Fprintln(os.Stderr, err)
+		if err := cmdDelete(sd, id, force); err != nil {
+			reportError(overrides, err)
+			return 1
+		}
+	case "wait":
+		if len(updatedArgs) != 1 {
+			usage()
+			return 1
+		}
+		id := updatedArgs[0]
+		if err := cmdWait(sd, id, os.Stdout); err != nil {
+			reportError(overrides, err)
+			return 1
+		}
+	case "events":
+		if len(updatedArgs) != 1 {
+			usage()
+			return 1
+		}
+		if err := cmdEvents(sd, updatedArgs[0], os.Stdout); err != nil {
+			reportError(overrides, err)
+			return 1
+		}
+	case "migrate-state":
+		if err := cmdMigrateState(sd, updatedArgs, os.Stdout); err != nil {
+			reportError(overrides, err)
+			return 1
+		}
+	case "time":
+		fs := flag.NewFlagSet("time", flag.ContinueOnError)
+		count := fs.Int("count", 10, "number of canary runs")
+		fs.IntVar(count, "n", 10, "number of canary runs (shorthand)")
+		_ = fs.Parse(updatedArgs)
+		if fs.NArg() != 1 {
+			usage()
+			return 1
+		}
+		if err := cmdTime(sd, fs.Arg(0), *count, os.Stdout); err != nil {
+			reportError(overrides, err)
+			return 1
+		}
+	case "attach":
+		if len(updatedArgs) != 1 {
+			usage()
+			return 1
+		}
+		if err := cmdAttach(sd, updatedArgs[0], os.Stdin, os.Stdout, os.Stderr); err != nil {
+			reportError(overrides, err)
+			return 1
+		}
+	case "console":
+		fs := flag.NewFlagSet("console", flag.ContinueOnError)
+		consoleSocket := fs.String("console-socket", "", "unix socket to receive the pty master")
+		_ = fs.Parse(updatedArgs)
+		if fs.NArg() != 1 || *consoleSocket == "" {
+			usage()
+			return 1
+		}
+		if err := cmdConsole(sd, fs.Arg(0), *consoleSocket); err != nil {
+			reportError(overrides, err)
+			return 1
+		}
+	case "logs":
+		fs := flag.NewFlagSet("logs", flag.ContinueOnError)
+		opts := logsOptions{}
+		fs.BoolVar(&opts.follow, "follow", false, "keep printing new output until the container exits")
+		fs.BoolVar(&opts.follow, "f", false, "follow (shorthand)")
+		fs.IntVar(&opts.tail, "tail", -1, "only print the last n lines (-1: all)")
+		fs.BoolVar(&opts.timestamps, "timestamps", false, "prefix each line with its capture time")
+		fs.BoolVar(&opts.timestamps, "t", false, "timestamps (shorthand)")
+		_ = fs.Parse(updatedArgs)
+		if fs.NArg() != 1 {
+			usage()
+			return 1
+		}
+		if err := cmdLogs(sd, fs.Arg(0), opts, os.Stdout, os.Stderr); err != nil {
+			reportError(overrides, err)
+			return 1
+		}
+	case "top":
+		fs := flag.NewFlagSet("top", flag.ContinueOnError)
+		opts := topOptions{}
+		fs.DurationVar(&opts.interval, "interval", 2*time.Second, "refresh interval")
+		fs.IntVar(&opts.iterations, "iterations", 0, "stop after n refreshes (0: until the container exits)")
+		_ = fs.Parse(updatedArgs)
+		if fs.NArg() != 1 || opts.interval <= 0 {
+			usage()
+			return 1
+		}
+		if fi, err := os.Stdout.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+			opts.clear = true
+		}
+		if err := cmdTop(sd, fs.Arg(0), opts, os.Stdout); err != nil {
+			reportError(overrides, err)
+			return 1
+		}
+	case "stats":
+		fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+		watch := fs.Bool("watch", false, "print a sample every interval until the container exits")
+		interval := fs.Duration("interval", time.Second, "sampling interval for --watch")
+		runtimeStats := fs.Bool("runtime", false, "print runproc's own operation counters instead")
+		format := fs.String("format", "json", "output format for --runtime: json or prometheus")
+		_ = fs.Parse(updatedArgs)
+		if *runtimeStats {
+			if fs.NArg() != 0 {
+				usage()
+				return 1
+			}
+			if err := cmdRuntimeStats(sd, *format, os.Stdout); err != nil {
+				reportError(overrides, err)
+				return 1
+			}
+			return 0
+		}
+		if fs.NArg() != 1 || *interval <= 0 {
+			usage()
+			return 1
+		}
+		if err := cmdStats(sd, fs.Arg(0), *watch, *interval, os.Stdout); err != nil {
+			reportError(overrides, err)
+			return 1
+		}
+	case "inspect":
+		if len(updatedArgs) != 1 {
+			usage()
+			return 1
+		}
+		if err := cmdInspect(sd, updatedArgs[0], os.Stdout); err != nil {
+			reportError(overrides, err)
+			return 1
+		}
+	case "pods":
+		fs := flag.NewFlagSet("pods", flag.ContinueOnError)
+		format := fs.String("format", "table", "output format: table or json")
+		_ = fs.Parse(updatedArgs)
+		if fs.NArg() != 0 {
+			usage()
+			return 1
+		}
+		if err := cmdPods(sd, *format, os.Stdout); err != nil {
+			reportError(overrides, err)
 			return 1
 		}
 	case "run":
 		fs := flag.NewFlagSet("run", flag.ContinueOnError)
 		pidFile := fs.String("pid-file", "", "path to write init pid")
+		consoleSocket := fs.String("console-socket", "", "unix socket to receive the pty master (process.terminal)")
+		detach := fs.Bool("detach", false, "return after start, leaving a monitor to record the exit")
+		fs.BoolVar(detach, "d", false, "detach (shorthand)")
+		noLog := fs.Bool("no-console-log", false, "do not copy foreground output to console.log")
+		noPivot := fs.Bool("no-pivot", false, "enter the rootfs with MS_MOVE and chroot instead of pivot_root")
 		bundleFlag := fs.String("bundle", "", "path to the OCI bundle")
 		fs.StringVar(bundleFlag, "b", "", "path to the OCI bundle (shorthand)")
+		nomad := fs.Bool("nomad-compat", false, "run as a Nomad raw_exec task (see README)")
+		var result resultOptions
+		fs.BoolVar(&result.stdout, "result", false, "print a JSON result line to stdout once the container has exited")
+		fs.StringVar(&result.file, "result-file", "", "write the JSON result to this file once the container has exited")
+		preserveFds := fs.Int("preserve-fds", 0, "pass this many extra fds, from 3 on, to the container")
 		_ = fs.Parse(updatedArgs)
 		rem := fs.Args()
+		preserved, err := inheritedFiles(3, *preserveFds)
+		if err != nil {
+			reportError(overrides, err)
+			return 1
+		}
+		if result.file != "" {
+			// The detached monitor writes it after we have returned; pin it to our working directory
+			abs, err := filepath.Abs(result.file)
+			if err != nil {
+				reportError(overrides, err)
+				return 1
+			}
+			result.file = abs
+		}
+		if *nomad {
+			if *detach || len(rem) > 2 {
+				usage()
+				return nomadRuntimeFailure
+			}
+			var id string
+			bundle := *bundleFlag
+			if len(rem) > 0 {
+				id = rem[0]
+			}
+			if len(rem) == 2 {
+				bundle = rem[1]
+			}
+			opts := createOptions{pidFile: *pidFile, consoleSocket: *consoleSocket, preserved: preserved, foreground: true, noPivot: *noPivot, systemdCgroup: overrides.systemdCgroup}
+			code, err := cmdRunNomad(sd, id, bundle, opts, result)
+			if err != nil {
+				reportError(overrides, err)
+			}
+			return code
+		}
 		var id, bundle string
 		if *bundleFlag != "" && len(rem) == 1 {
 			id = rem[0]
@@ -189,24 +635,80 @@ func run() int {
 			usage()
 			return 1
 		}
-		if err := cmdCreate(sd, id, bundle, *pidFile); err != nil {
-			writeOCIErrorLog(overrides.logPath, err.Error())
-			fmt.Fprintln(os.Stderr, err)
+		if *detach {
+			// Nothing is left on our stdout to print a result to once the container exits
+			if result.stdout {
+				usage()
+				return 1
+			}
+			if err := cmdRunDetached(sd, id, bundle, *pidFile, *consoleSocket, result.file, preserved, *noPivot, overrides.systemdCgroup); err != nil {
+				reportError(overrides, err)
+				return 1
+			}
+			return 0
+		}
+		opts := createOptions{pidFile: *pidFile, consoleSocket: *consoleSocket, preserved: preserved, foreground: true, noPivot: *noPivot, systemdCgroup: overrides.systemdCgroup}
+		res, err := cmdRunForeground(sd, id, bundle, opts, !*noLog)
+		if err != nil {
+			reportError(overrides, err)
 			return 1
 		}
-		if err := cmdStart(sd, id); err != nil {
-			writeOCIErrorLog(overrides.logPath, err.Error())
-			fmt.Fprintln(os.Stderr, err)
-			_ = cmdDelete(sd, id)
+		if err := result.report(res); err != nil {
+			reportError(overrides, err)
 			return 1
 		}
-		if _, err := waitProcess(sd, id); err != nil {
-			writeOCIErrorLog(overrides.logPath, err.Error())
-			fmt.Fprintln(os.Stderr, err)
+	case "exec":
+		fs := flag.NewFlagSet("exec", flag.ContinueOnError)
+		var opts execOptions
+		fs.StringVar(&opts.process, "process", "", "path to a process.json to run instead of the container's process")
+		fs.StringVar(&opts.process, "p", "", "process (shorthand)")
+		fs.BoolVar(&opts.detach, "detach", false, "return once the process runs instead of waiting for it")
+		fs.StringVar(&opts.pidFile, "pid-file", "", "path to write the process's pid")
+		fs.StringVar(&opts.consoleSocket, "console-socket", "", "unix socket to receive the pty master (process.terminal)")
+		preserveFds := fs.Int("preserve-fds", 0, "pass this many extra fds, from 3 on, to the process")
+		_ = fs.Parse(updatedArgs)
+		rem := fs.Args()
+		if len(rem) == 0 {
+			usage()
+			return 1
+		}
+		opts.args = rem[1:]
+		if len(opts.args) > 0 && opts.args[0] == "--" {
+			opts.args = opts.args[1:]
+		}
+		preserved, err := inheritedFiles(3, *preserveFds)
+		if err != nil {
+			reportError(overrides, err)
+			return 1
+		}
+		opts.preserved = preserved
+		code, err := cmdExec(sd, rem[0], opts)
+		if err != nil {
+			reportError(overrides, err)
+			return 1
+		}
+		return code
+	case "checkpoint":
+		fs := flag.NewFlagSet("checkpoint", flag.ContinueOnError)
+		var opts checkpointOptions
+		fs.StringVar(&opts.imagePath, "image-path", "", "path for saving criu image files")
+		fs.StringVar(&opts.workPath, "work-path", "", "path for saving work files and logs")
+		fs.BoolVar(&opts.leaveRunning, "leave-running", false, "leave the process running after checkpointing")
+		fs.BoolVar(&opts.tcpEstablished, "tcp-established", false, "allow open tcp connections")
+		fs.BoolVar(&opts.extUnixSk, "ext-unix-sk", false, "allow external unix sockets")
+		fs.BoolVar(&opts.fileLocks, "file-locks", false, "handle file locks")
+		_ = fs.Parse(updatedArgs)
+		if fs.NArg() != 1 {
+			usage()
+			return 1
+		}
+		id := fs.Arg(0)
+		if err := cmdCheckpoint(sd, id, opts); err != nil {
+			reportError(overrides, err)
 			return 1
 		}
 	default:
-		writeOCIErrorLog(overrides.logPath, fmt.Sprintf("unknown command: %s", cmd))
+		writeOCIErrorLog(overrides, fmt.Sprintf("unknown command: %s", cmd))
 		usage()
 		return 1
 	}
@@ -217,6 +719,8 @@ type compatOverrides struct {
 	root      string
 	logPath   string
 	logFormat string
+	// systemdCgroup is --systemd-cgroup, which containerd passes with SystemdCgroup = true
+	systemdCgroup bool
 }
 
 // preprocessRuncCompat strips/normalizes common runc flags containerd passes.
@@ -225,14 +729,22 @@ func preprocessRuncCompat(cmd string, args []string) ([]string, compatOverrides)
 	ov := compatOverrides{}
 	out := make([]string, 0, len(args))
 	skipNext := false
+	// Arguments that are not flags or their values, the command first when cmd is ""
+	positional := 0
 	for i := 0; i < len(args); i++ {
 		if skipNext {
 			skipNext = false
 			continue
 		}
+		// What follows exec's container id is the command to run, flags and all
+		if cmd == "" && positional == 2 && out[0] == "exec" || cmd == "exec" && positional == 1 {
+			out = append(out, args[i:]...)
+			break
+		}
 		a := args[i]
 		if !strings.HasPrefix(a, "-") {
 			out = append(out, a)
+			positional++
 			continue
 		}
 		// Preserve numeric signals like "-9" so subcommands (kill) can parse them
@@ -256,14 +768,24 @@ func preprocessRuncCompat(cmd string, args []string) ([]string, compatOverrides)
 				}
 			}
 			out = append(out, "--bundle", value)
-		case "--pid-file":
+		case "--pid-file", "--console-socket", "--result-file", "--stdin", "--stdout", "--stderr", "--process", "-p":
+			if value == "" {
+				if i+1 < len(args) {
+					value = args[i+1]
+					skipNext = true
+				}
+			}
+			out = append(out, name, value)
+		case "--image-path", "--work-path", "--interval", "--count", "-n", "--format", "--iterations", "--tail", "--parallel", "--preserve-fds":
 			if value == "" {
 				if i+1 < len(args) {
 					value = args[i+1]
 					skipNext = true
 				}
 			}
-			out = append(out, "--pid-file", value)
+			out = append(out, name, value)
+		case "--leave-running", "--tcp-established", "--ext-unix-sk", "--file-locks", "--host", "--all", "-a", "--force", "-f", "--watch", "--no-console-log", "--follow", "--timestamps", "-t", "--no-pivot", "--runtime", "--dry-run", "--nomad-compat", "--result":
+			out = append(out, name)
 		case "--root":
 			if value == "" {
 				if i+1 < len(args) {
@@ -289,8 +811,30 @@ func preprocessRuncCompat(cmd string, args []string) ([]string, compatOverrides)
 				}
 			}
 			ov.logFormat = value
-			// ignore
-		case "--systemd-cgroup", "--no-pivot", "--detach", "--console-socket", "--no-new-keyring", "--rootless", "--no-subreaper":
+		case "--version", "-v":
+			// runc-style `runproc --version`
+			if cmd == "" {
+				out = append(out, "version")
+			}
+		case "--detach", "-d":
+			// Only run and exec implement detach; create is always detached
+			if cmd == "" || cmd == "run" || cmd == "exec" {
+				out = append(out, "--detach")
+			}
+		case "--systemd-cgroup":
+			// A boolean: the next argument is the command, never a value
+			ov.systemdCgroup = value == "" || value == "true"
+		case "--rootless":
+			// runc's global --rootless is ignored: runproc decides it from the spec and its
+			// euid (see rootless). spec --rootless generates a rootless config
+			if len(out) > 0 && out[0] == "spec" {
+				out = append(out, name)
+				break
+			}
+			if value == "" && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				skipNext = true
+			}
+		case "--no-new-keyring", "--no-subreaper":
 			// Swallow optional value if provided separately
 			if value == "" && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
 				skipNext = true
@@ -320,19 +864,43 @@ func isAllDigits(s string) bool {
 	return true
 }
 
-// writeOCIErrorLog writes a minimal OCI runtime error log in JSON format if a log path was provided.
-func writeOCIErrorLog(path, msg string) {
-	if path == "" {
+// reportError records a command failure in the --log file (if any) and on stderr. With a
+// --log file, the stderr copy can be turned off via log.mirror_stderr in the node config
+// for shims that already surface the log file and would otherwise report errors twice.
+func reportError(ov compatOverrides, err error) {
+	writeOCIErrorLog(ov, err.Error())
+	if ov.logPath != "" {
+		cfg, cerr := config.Load()
+		if cerr == nil && !cfg.Log.MirrorStderr {
+			return
+		}
+	}
+	fmt.Fprintln(os.Stderr, err)
+}
+
+// writeOCIErrorLog appends an error entry to the --log file, if one was provided, in the
+// --log-format requested: "json" (default) or logrus-style "text", like runc.
+func writeOCIErrorLog(ov compatOverrides, msg string) {
+	if ov.logPath == "" {
 		return
 	}
 	// Ensure directory exists
-	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+	if err := os.MkdirAll(filepath.Dir(ov.logPath), 0o755); err != nil {
 		return
 	}
-	// Minimal JSON. containerd-shim expects JSON but does not strictly validate schema.
-	// We include msg and timestamp.
 	now := time.Now().Format(time.RFC3339Nano)
-	content := fmt.Sprintf("{\"level\":\"error\",\"msg\":%q,\"time\":%q}\n", msg, now)
+	var content string
+	if ov.logFormat == "text" {
+		content = fmt.Sprintf("time=%q level=error msg=%q\n", now, msg)
+	} else {
+		// containerd-shim expects JSON but does not strictly validate schema
+		content = fmt.Sprintf("{\"level\":\"error\",\"msg\":%q,\"time\":%q}\n", msg, now)
+	}
 	// Best-effort write
-	_ = os.WriteFile(path, []byte(content), 0o644)
+	f, err := os.OpenFile(ov.logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	_, _ = f.WriteString(content)
 }
@@ -7,78 +7,583 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
+	"github.com/ktsakalozos/runproc/internal/cgroups"
+	"github.com/ktsakalozos/runproc/internal/config"
 	"github.com/ktsakalozos/runproc/internal/oci"
+	"github.com/ktsakalozos/runproc/internal/resctrl"
 	"github.com/ktsakalozos/runproc/internal/state"
 )
 
+// lockWait bounds how long a command waits for another in-flight operation on the same
+// container (e.g. a create retried by containerd after a timeout) before giving up.
+const lockWait = 5 * time.Second
+
+// acquireLock takes the container's operation lock for op (see state.AcquireLock). Taking
+// over the lock of a runproc that died holding it is reported: a warning, an event in the
+// container's audit.log and the stale_locks_recovered_total counter.
+func acquireLock(stateDir, id, op string) (*state.Lock, error) {
+	lock, err := state.AcquireLock(stateDir, id, op, lockWait)
+	if err != nil {
+		return nil, err
+	}
+	if r := lock.Recovered; r != nil {
+		owner := r.Op
+		if owner == "" {
+			owner = "unknown"
+		}
+		fmt.Fprintf(os.Stderr, "warning: recovered the lock of %s from pid %d, whose %s ended without releasing it\n", id, r.Pid, owner)
+		_ = recordEvent(stateDir, id, containerEvent{Event: "stale_lock_recovered", Op: owner, Pid: r.Pid})
+		_ = state.AddCounters(stateDir, fmt.Sprintf("stale_locks_recovered_total{op=%q}", owner))
+	}
+	return lock, nil
+}
+
+// initConfig is what create hands to the init process, as a sealed memfd (see handoff.go).
+type initConfig struct {
+	Process *oci.Process `json:"process"`
+	// Mounts to perform inside the container's mount namespace before chroot
+	Mounts []oci.Mount `json:"mounts,omitempty"`
+	// Exec replaces the PATH lookup of argv[0] for strict host-mode containers
+	Exec *stagedExec `json:"exec,omitempty"`
+	// NoPivot enters the rootfs with MS_MOVE and chroot instead of pivot_root
+	NoPivot bool `json:"noPivot,omitempty"`
+	// Wasm replaces the process with its WASI runtime for wasm workloads
+	Wasm *wasmExec `json:"wasm,omitempty"`
+	// AppArmorProfile confines the process; "" applies none
+	AppArmorProfile string `json:"appArmorProfile,omitempty"`
+	// SELinuxLabel is the process's exec label; "" keeps init's
+	SELinuxLabel string `json:"selinuxLabel,omitempty"`
+	// Seccomp is linux.seccomp, compiled; nil installs no filter
+	Seccomp *seccompFilter `json:"seccomp,omitempty"`
+	// StartGate is waited for after the start signal; nil waits for nothing
+	StartGate *startGate `json:"startGate,omitempty"`
+	// StartContainer are the hooks run in the container right before the process
+	StartContainer []oci.Hook `json:"startContainer,omitempty"`
+	// CgroupNS has the init create its cgroup namespace itself once create moved it into
+	// its cgroup, which the namespace is then rooted at
+	CgroupNS bool `json:"cgroupNS,omitempty"`
+	// DefaultEnv are NAME=value entries set unless the process env has NAME
+	DefaultEnv []string `json:"defaultEnv,omitempty"`
+	// HookTimeout is the node's ceiling on the timeout of StartContainer hooks, which
+	// run in the container's cgroup; 0 is none
+	HookTimeout time.Duration `json:"hookTimeout,omitempty"`
+	// IntelRdtGroup is the resctrl group (CLOS id) the process runs in; "" is the default
+	IntelRdtGroup string `json:"intelRdtGroup,omitempty"`
+	// IDMaps are the fds of the idmapped clones of Mounts' sources, by mount index, and
+	// of the rootfs (rootfsIdmap)
+	IDMaps map[int]int `json:"idmaps,omitempty"`
+	// Userns has init, the root of a user namespace and so no owner of the state, read
+	// the state with state.LoadShared
+	Userns bool `json:"userns,omitempty"`
+	// Console is the fd of the console socket the pty master of process.terminal goes to
+	Console int `json:"console,omitempty"`
+	// Chroot is the rootfs exec-init enters, for a container in a joined mount namespace
+	Chroot string `json:"chroot,omitempty"`
+	// Personality is linux.personality, for exec-init, which cannot read the spec
+	Personality *oci.LinuxPersonality `json:"personality,omitempty"`
+	// Pinned is the CPU list the container was pinned to at start, for exec-init
+	Pinned string `json:"pinned,omitempty"`
+}
+
+// createOptions carries the per-invocation knobs of cmdCreate.
+type createOptions struct {
+	pidFile string
+	// stdio for the init process; nil means inherit runproc's own
+	stdin, stdout, stderr *os.File
+	// stdio, when set, is opened into stdin, stdout and stderr right before the fork
+	stdio stdioPaths
+	// preserved are passed on to the workload as fds 3 and up (--preserve-fds)
+	preserved []*os.File
+	// monitorPid is recorded when a detached monitor owns the init process
+	monitorPid int
+	// consoleSocket and foreground feed the process.terminal checks (validateTerminal)
+	consoleSocket string
+	foreground    bool
+	// console is a connected console socket used instead of dialing consoleSocket; a
+	// foreground run keeps the other end (see runTerminal)
+	console *os.File
+	// noPivot is runc's --no-pivot (see enterRootfs)
+	noPivot bool
+	// systemdCgroup is runc's --systemd-cgroup (see containerCgroup)
+	systemdCgroup bool
+}
+
 // cmdCreate reads the bundle's config.json, stores state, and forks an init process
 // that will exec the process specified in the spec when 'start' is called.
-func cmdCreate(stateDir, id, bundle, pidFile string) error {
+func cmdCreate(stateDir, id, bundle string, opts createOptions) (err error) {
+	defer func() { recordOperation(stateDir, "create", err) }()
+	lock, err := acquireLock(stateDir, id, "create")
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+	if st, err := state.Load(stateDir, id); err == nil && st.Status == state.Creating {
+		// Only a create holding the lock has a container creating: this one was abandoned by
+		// a create that died, and its retry replaces it
+		fmt.Fprintf(os.Stderr, "warning: %s was abandoned by a create that died; replacing it\n", id)
+		if err := deleteContainer(stateDir, id, true); err != nil {
+			return err
+		}
+	}
 	if state.Exists(stateDir, id) {
-		return fmt.Errorf("container %s already exists", id)
+		return fmt.Errorf("%w: %s", state.ErrExist, id)
+	}
+	// Record an absolute bundle: init runs with the bundle as its working directory
+	bundle, err = filepath.Abs(bundle)
+	if err != nil {
+		return err
 	}
 	spec, err := oci.LoadSpec(bundle)
 	if err != nil {
 		return err
 	}
-	// Create a pipe: parent blocks until child is ready
-	pr, pw, err := os.Pipe()
+	if err := validateTerminal(spec.Process, !opts.foreground, opts.consoleSocket); err != nil {
+		return err
+	}
+	if opts.stdio.set() && spec.Process != nil && spec.Process.Terminal {
+		return errStdioWithTerminal
+	}
+	nodeCfg, err := config.Load()
+	if err != nil {
+		return err
+	}
+	if _, err := parseLogOptions(spec.Annotations, nodeCfg.Logs); err != nil {
+		return err
+	}
+	if _, err := parseStdinOnce(spec.Annotations); err != nil {
+		return err
+	}
+	if _, err := parseSnapshot(spec.Annotations); err != nil {
+		return err
+	}
+	throttle, err := parseCPUThrottle(spec)
+	if err != nil {
+		return err
+	}
+	if _, err := parseDescendantLimit(spec.Annotations); err != nil {
+		return err
+	}
+	gate, err := parseStartGate(spec.Annotations)
+	if err != nil {
+		return err
+	}
+	var wasm *wasmExec
+	if ok, err := wasmRequested(spec); err != nil {
+		return err
+	} else if ok {
+		if wasm, err = prepareWasm(bundle, spec); err != nil {
+			return err
+		}
+	}
+	profile, err := appArmorProfile(spec.Process)
+	if err != nil {
+		return err
+	}
+	label, err := selinuxLabel(spec.Process)
+	if err != nil {
+		return err
+	}
+	if s := spec.Process.Scheduler; s != nil {
+		if _, err := schedulerAttr(s); err != nil {
+			return err
+		}
+	}
+	if iop := spec.Process.IOPriority; iop != nil {
+		if _, err := ioPriorityValue(iop); err != nil {
+			return err
+		}
+	}
+	if a := spec.Process.ExecCPUAffinity; a != nil {
+		if err := validateExecAffinity(a); err != nil {
+			return err
+		}
+	}
+	if spec.Linux != nil && spec.Linux.Personality != nil {
+		if _, err := personalityValue(spec.Linux.Personality); err != nil {
+			return err
+		}
+	}
+	var seccomp *seccompFilter
+	if spec.Linux != nil {
+		if seccomp, err = compileSeccomp(spec.Linux.Seccomp); err != nil {
+			return err
+		}
+	}
+	if err := validateSysctls(spec); err != nil {
+		return err
+	}
+	loc, err := localize(spec, bundle)
+	if err != nil {
+		return err
+	}
+	var hookCeilings hookLimits
+	if spec.Hooks != nil {
+		hookCeilings = nodeHookLimits()
+	}
+	cgPath, scope, err := containerCgroup(spec, id, opts.systemdCgroup)
 	if err != nil {
 		return err
 	}
-	defer pr.Close()
+	if err := injectFault("create"); err != nil {
+		return err
+	}
+	// Observers see the container as creating until the init has its config; until then a
+	// failure removes it again
+	st := &state.ContainerState{
+		ID:          id,
+		Bundle:      bundle,
+		Annotations: spec.Annotations,
+		MonitorPid:  opts.monitorPid,
+		CreatedBy:   version,
+		Hooks:       &oci.Hooks{},
+	}
+	if spec.Hooks != nil {
+		st.Hooks.Poststart, st.Hooks.Poststop = spec.Hooks.Poststart, spec.Hooks.Poststop
+	}
+	if err := state.Create(stateDir, st); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = state.Delete(stateDir, id)
+		}
+	}()
+	// On v2 the init is cloned straight into its cgroup, so a cgroup namespace it gets is
+	// rooted there. On v1 it joins each controller's before the go-ahead, and systemd moves
+	// it into its scope; either way it creates its cgroup namespace itself once it is there
+	var cg *cgroups.Cgroup
+	var resources *oci.LinuxResources
+	if cgPath != "" {
+		resources = deviceRules(spec.Linux.Resources, spec.Linux.Devices)
+		if throttle != nil && !cgroupQuota(cgPath) {
+			// Without the cpu controller the supervisor throttles instead
+			resources = withoutCPUQuota(resources)
+		}
+		st.Cgroup = cgPath
+		if scope != nil {
+			// systemd makes the scope's cgroup once the init exists to put in it
+			st.CgroupUnit = scope.Unit
+		} else {
+			if cg, err = cgroups.Create(cgPath, resources); err != nil {
+				return fmt.Errorf("cgroup %s: %w", cgPath, err)
+			}
+			defer func() {
+				if err != nil {
+					_ = cgroups.Remove(cgPath)
+				}
+			}()
+		}
+	}
+	closID, rdtCreated, err := intelRdtGroup(spec, id)
+	if err != nil {
+		return err
+	}
+	if rdtCreated {
+		st.IntelRdtGroup = closID
+		defer func() {
+			if err != nil {
+				_ = resctrl.Remove(closID)
+			}
+		}()
+	}
+	// Init in a joined user namespace is started by a child of ours there, which cannot
+	// place it in the cgroup (see startInUserns)
+	joinsUserns := isolated(spec) && joinsNamespace(spec, oci.UserNamespace)
+	userns := joinsUserns || isolated(spec) && createsNamespace(spec, oci.UserNamespace)
+	lateCgroup := cgPath != "" && (cg == nil || cg.Dir() == "" || joinsUserns)
+	// The init waits on this pipe until the state is recorded (see handoff.go)
+	goR, goW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer goR.Close()
+	defer goW.Close()
 
 	// Start a child process that will block until it receives a start signal via state.
 	self, err := os.Executable()
 	if err != nil {
 		return err
 	}
-	cmd := exec.Command(self, "init", stateDir, id)
+	// Through /proc: as the root of a user namespace, init may not reach runproc's dir
+	initArgs := []string{"init"}
+	if len(opts.preserved) > 0 {
+		initArgs = append(initArgs, "--preserve-fds", strconv.Itoa(len(opts.preserved)))
+		defer keepNonblock(opts.preserved)()
+	}
+	cmd := exec.Command("/proc/self/exe", append(initArgs, stateDir, id)...)
+	cmd.Args[0] = self
 	cmd.Env = os.Environ()
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	// Pass pipe fd to child via ExtraFiles; child will get it as fd 3
-	// Child will read from fd 3
-	cmd.ExtraFiles = []*os.File{pr}
+	// The init's copies must be the only ones, or its stdin never reads EOF
+	stdio, err := openStdio(opts.stdio, &opts)
+	if err != nil {
+		return err
+	}
+	for _, f := range stdio {
+		defer f.Close()
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if opts.stdin != nil {
+		cmd.Stdin = opts.stdin
+	}
+	if opts.stdout != nil {
+		cmd.Stdout = opts.stdout
+	}
+	if opts.stderr != nil {
+		cmd.Stderr = opts.stderr
+	}
 	// Working directory is bundle per OCI
 	cmd.Dir = bundle
+	// The init leads its own session so `kill --all` can find the whole process tree
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if cg != nil && cg.Dir() != "" && !joinsUserns {
+		fd, err := syscall.Open(cg.Dir(), syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			return fmt.Errorf("open cgroup: %w", err)
+		}
+		defer syscall.Close(fd)
+		cmd.SysProcAttr.UseCgroupFD, cmd.SysProcAttr.CgroupFD = true, fd
+	}
+	var mounts []oci.Mount
+	var scratchImage string
+	var join []oci.LinuxNamespace
+	var cgroupNS bool
+	var idmaps map[int]int
+	var idmapFiles []*os.File
+	var delegateIDs bool
+	if isolated(spec) {
+		if err := checkUserns(spec); err != nil {
+			return err
+		}
+		idmapRoot, err := parseRootfsIdmap(spec)
+		if err != nil {
+			return err
+		}
+		if rootless(spec) {
+			if err := checkRootless(spec); err != nil {
+				return err
+			}
+		}
+		// The spec's namespaces without a path are created by forking init into them
+		nsFlags, err := namespaceFlags(spec)
+		if err != nil {
+			return err
+		}
+		if nsFlags&syscall.CLONE_NEWUSER != 0 {
+			delegateIDs = setUserMappings(cmd.SysProcAttr, spec.Linux)
+		}
+		if lateCgroup && nsFlags&syscall.CLONE_NEWCGROUP != 0 {
+			nsFlags &^= syscall.CLONE_NEWCGROUP
+			cgroupNS = true
+		}
+		cmd.SysProcAttr.Cloneflags |= nsFlags
+		if join, err = joinedNamespaces(spec); err != nil {
+			return err
+		}
+		if mounts, err = prepareMounts(stateDir, spec); err != nil {
+			return err
+		}
+		var scratch *oci.Mount
+		if scratch, scratchImage, err = prepareScratch(stateDir, id, spec); err != nil {
+			return err
+		}
+		if scratch != nil {
+			mounts = append(mounts, *scratch)
+		}
+		binary, err := exposeBinaryMount(spec)
+		if err != nil {
+			_ = releaseScratch(stateDir, id, scratchImage)
+			return err
+		}
+		if binary != nil {
+			mounts = append(mounts, *binary)
+		}
+		mounts = append(mounts, loc.mounts...)
+		if joinsNamespace(spec, oci.MountNamespace) {
+			// Mounting, like pivot_root, would change the namespace for all its members
+			if len(mounts) > 0 || len(spec.Linux.MaskedPaths) > 0 || len(spec.Linux.ReadonlyPaths) > 0 || idmapRoot {
+				_ = releaseScratch(stateDir, id, scratchImage)
+				return errors.New("mounts, masked and readonly paths and an idmapped rootfs cannot be set up in a joined mount namespace")
+			}
+		} else {
+			// The rootfs and mounts go into a private mount namespace so they never show
+			// up on the node
+			cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNS
+			if idmaps, idmapFiles, err = idmapMounts(bundle, mounts); err != nil {
+				_ = releaseScratch(stateDir, id, scratchImage)
+				return err
+			}
+			if idmapRoot {
+				rootfs := spec.Root.Path
+				if !filepath.IsAbs(rootfs) {
+					rootfs = filepath.Join(bundle, rootfs)
+				}
+				tree, err := idmapRootfs(rootfs, spec.Linux)
+				if err != nil {
+					closeFiles(idmapFiles)
+					_ = releaseScratch(stateDir, id, scratchImage)
+					return err
+				}
+				idmapFiles = append(idmapFiles, tree)
+				if idmaps == nil {
+					idmaps = map[int]int{}
+				}
+				idmaps[rootfsIdmap] = handoffGoFd + len(idmapFiles)
+			}
+			defer closeFiles(idmapFiles)
+		}
+	} else if _, ok := spec.Annotations[oci.ScratchAnnotation]; ok {
+		return errScratchNeedsChroot
+	} else if expose, err := parseExposeBinary(spec.Annotations); err != nil {
+		return err
+	} else if expose {
+		return errExposeBinaryNeedsChroot
+	} else if v, _ := strconv.ParseBool(spec.Annotations[oci.RootfsIdmapAnnotation]); v {
+		return errRootfsIdmapNeedsChroot
+	}
+	var staged *stagedExec
+	if isHostMode(spec, spec.Process) && wasm == nil {
+		strict, err := strictHostExec()
+		if err != nil {
+			return err
+		}
+		if strict {
+			if staged, err = stageHostBinary(stateDir, id, bundle, spec); err != nil {
+				return err
+			}
+		}
+	}
 
-	if err := cmd.Start(); err != nil {
-		pw.Close()
+	// The config is complete before the init exists. The init gets the preserved fds at 3
+	// and up, where the workload keeps them, then the config, the go-ahead pipe, the
+	// idmapped mounts and the console socket
+	for i := range idmaps {
+		idmaps[i] += len(opts.preserved)
+	}
+	extraFiles := idmapFiles
+	var console int
+	// The holder's end of init's console and the caller's console socket (see
+	// startConsoleHolder)
+	var held, caller *os.File
+	if spec.Process.Terminal {
+		conn := opts.console
+		if conn == nil {
+			if opts.consoleSocket == "" {
+				return errTTYWithoutSocket
+			}
+			if caller, err = dialConsole(opts.consoleSocket); err != nil {
+				return err
+			}
+			defer caller.Close()
+			fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+			if err != nil {
+				return fmt.Errorf("console socketpair: %w", err)
+			}
+			conn, held = os.NewFile(uintptr(fds[0]), "console"), os.NewFile(uintptr(fds[1]), "console")
+			defer conn.Close()
+			defer held.Close()
+		}
+		extraFiles = append(extraFiles[:len(extraFiles):len(extraFiles)], conn)
+		console = handoffGoFd + len(opts.preserved) + len(extraFiles)
+	}
+	cfg := initConfig{Process: spec.Process, Mounts: mounts, Exec: staged, NoPivot: opts.noPivot, Wasm: wasm, AppArmorProfile: profile, SELinuxLabel: label, Seccomp: seccomp, StartGate: gate, CgroupNS: cgroupNS, DefaultEnv: loc.env, IntelRdtGroup: closID, IDMaps: idmaps, Userns: userns, Console: console}
+	if spec.Hooks != nil {
+		cfg.StartContainer, cfg.HookTimeout = spec.Hooks.StartContainer, hookCeilings.timeout
+	}
+	cfgFile, err := sealedConfig(cfg)
+	if err == nil {
+		cmd.ExtraFiles = append(append(opts.preserved[:len(opts.preserved):len(opts.preserved)], cfgFile, goR), extraFiles...)
+		err = startInNamespaces(cmd, join, nil)
+		cfgFile.Close()
+	}
+	if err != nil {
+		_ = releaseScratch(stateDir, id, scratchImage)
+		if staged != nil {
+			_ = os.RemoveAll(filepath.Dir(staged.Path))
+		}
 		return fmt.Errorf("start init: %w", err)
 	}
 	// Parent no longer needs its copy of read end
-	pr.Close()
+	goR.Close()
 
-	st := &state.ContainerState{ID: id, Bundle: bundle, Pid: cmd.Process.Pid}
-	if err := state.Create(stateDir, st); err != nil {
-		// try to kill child if state write fails
-		_ = cmd.Process.Kill()
-		_ = cmd.Process.Release()
+	// From here on a failing create needs no kill: an init that never gets the go-ahead
+	// exits by itself
+	st.Pid = cmd.Process.Pid
+	st.ScratchImage = scratchImage
+	defer func() {
+		if err != nil {
+			_ = releaseScratch(stateDir, id, scratchImage)
+		}
+	}()
+	if delegateIDs {
+		if err := delegateIDMaps(st.Pid, spec.Linux); err != nil {
+			return err
+		}
+	}
+	if userns {
+		if err := shareState(stateDir, id, st.Pid); err != nil {
+			return err
+		}
+	}
+	if scope != nil {
+		defer func() {
+			if err != nil {
+				_ = cgroups.StopScope(scope.Unit)
+				_ = cgroups.Remove(cgPath)
+			}
+		}()
+		if err := cgroups.StartScope(scope, st.Pid, resources); err != nil {
+			return err
+		}
+		if cg, err = cgroups.Adopt(cgPath, resources); err != nil {
+			return fmt.Errorf("cgroup %s: %w", cgPath, err)
+		}
+	}
+	if cg != nil && (cg.Dir() == "" || joinsUserns) {
+		if err := cg.Join(st.Pid); err != nil {
+			return err
+		}
+	}
+	if err := state.Save(stateDir, st); err != nil {
 		return err
 	}
-	if pidFile != "" {
-		if err := os.WriteFile(pidFile, []byte(strconv.Itoa(cmd.Process.Pid)), 0o644); err != nil {
+	if err := runCreateHooks(spec, st, hookCeilings); err != nil {
+		return err
+	}
+	if err := injectFault("handoff"); err != nil {
+		return err
+	}
+	if held != nil {
+		if err := startConsoleHolder(stateDir, id, st.Pid, held, caller); err != nil {
+			return err
+		}
+	}
+	if opts.pidFile != "" {
+		if err := state.ReplaceFile(opts.pidFile, []byte(strconv.Itoa(cmd.Process.Pid)), 0o644); err != nil {
 			return fmt.Errorf("write pid-file: %w", err)
 		}
 	}
-	// Send the process spec over the pipe to the child
-	enc := json.NewEncoder(pw)
-	if err := enc.Encode(spec.Process); err != nil {
-		return fmt.Errorf("encode process to child: %w", err)
+	if _, err := io.WriteString(goW, handoffGo); err != nil {
+		return fmt.Errorf("signal init: %w", err)
 	}
-	pw.Close()
-	return nil
+	st.Status = state.Created
+	return state.Save(stateDir, st)
 }
 
-func cmdStart(stateDir, id string) error {
+func cmdStart(stateDir, id string) (err error) {
+	defer func() { recordOperation(stateDir, "start", err) }()
+	lock, err := acquireLock(stateDir, id, "start")
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
 	st, err := state.Load(stateDir, id)
 	if err != nil {
 		return err
@@ -86,15 +591,51 @@ func cmdStart(stateDir, id string) error {
 	if st.Status == state.Running {
 		return nil
 	}
+	if st.Status == state.Creating {
+		return fmt.Errorf("container %s was never fully created: delete it and create it again", id)
+	}
+	if _, killed := killedBeforeStart(stateDir, id); killed {
+		return fmt.Errorf("%w: %s was killed before start", state.ErrNotRunning, id)
+	}
+	if err := injectFault("start"); err != nil {
+		return err
+	}
+	if st.Cpus, err = pinCPUs(id, st.Pid, st.Annotations); err != nil {
+		return err
+	}
+	if st.Cpus != "" {
+		// Recorded before the start signal: the init bounds execCPUAffinity.final by it
+		if err := state.Save(stateDir, st); err != nil {
+			return err
+		}
+	}
 	// Signal the child to start by touching a start file
 	startPath := filepath.Join(stateDir, id, "start")
-	if err := os.WriteFile(startPath, []byte("start"), 0o600); err != nil {
+	if err := state.WriteFile(startPath, []byte("start"), 0o600); err != nil {
 		return err
 	}
 	now := time.Now()
 	st.Status = state.Running
 	st.StartedAt = &now
-	return state.Save(stateDir, st)
+	if err := state.Save(stateDir, st); err != nil {
+		return err
+	}
+	// The process is on its way; a failing poststart hook no longer stops it. Nor does the
+	// lock serve anything now that the container is recorded running, and waiting for a
+	// start gate or a slow init under it would hold up a kill for lockWait
+	lock.Release()
+	if hooks, limits, err := stageHooks(st); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: poststart hooks of %s: %v\n", id, err)
+	} else if hooks != nil && len(hooks.Poststart) > 0 {
+		// Only once the init executed the process (or gave up), as the spec requires
+		for initStarting(st.Pid) && pidRunning(st.Pid) {
+			time.Sleep(20 * time.Millisecond)
+		}
+		if err := runHooks(oci.HookPoststart, hooks.Poststart, newHookState(st, state.Running), nil, limits); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: hooks of %s: %v\n", id, err)
+		}
+	}
+	return nil
 }
 
 func cmdState(stateDir, id string, w io.Writer) error {
@@ -102,11 +643,13 @@ func cmdState(stateDir, id string, w io.Writer) error {
 	if err != nil {
 		return err
 	}
-	// Self-heal: if recorded running but process is gone, mark as stopped
-	if st.Status == state.Running && !pidAlive(st.Pid) {
+	// Self-heal: if recorded running (or created, and then killed) but process is gone,
+	// mark as stopped
+	if (st.Status == state.Running || st.Status == state.Created) && !pidRunning(st.Pid) {
 		now := time.Now()
 		st.Status = state.Stopped
 		st.ExitedAt = &now
+		checkOOM(stateDir, st)
 		_ = state.Save(stateDir, st)
 	}
 	// runc-compatible-ish minimal JSON state
@@ -116,39 +659,49 @@ func cmdState(stateDir, id string, w io.Writer) error {
 		"status": st.Status,
 		"bundle": st.Bundle,
 	}
+	if st.OOMKilled {
+		out["oomKilled"], out["oomKilledAt"] = true, st.OOMKilledAt
+	}
+	if st.CreatedBy != "" {
+		out["createdBy"] = st.CreatedBy
+	}
 	enc := json.NewEncoder(w)
 	enc.SetIndent("", "  ")
 	return enc.Encode(out)
 }
 
-func cmdKill(stateDir, id, signal string) error {
+// cmdKill sends sig to the container's init process, or with all to every process
+// of the container (see killTargets).
+func cmdKill(stateDir, id string, sig syscall.Signal, all bool) (err error) {
+	defer func() { recordOperation(stateDir, "kill", err) }()
+	// Serialized with start, so a container is either killed before start or started
+	// before the kill; never both halfway
+	lock, err := acquireLock(stateDir, id, "kill")
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
 	st, err := state.Load(stateDir, id)
 	if err != nil {
-		if os.IsNotExist(err) {
-			// Already deleted; consider kill a no-op
-			return nil
-		}
 		return err
 	}
-	if st.Pid <= 0 {
-		return errors.New("no pid")
-	}
-	sig := syscall.SIGTERM
-	if signal != "" {
-		// Accept names like SIGTERM or numbers
-		if strings.HasPrefix(signal, "SIG") {
-			m := map[string]syscall.Signal{
-				"SIGTERM": syscall.SIGTERM,
-				"SIGKILL": syscall.SIGKILL,
-				"SIGINT":  syscall.SIGINT,
-				"SIGHUP":  syscall.SIGHUP,
-			}
-			if s, ok := m[signal]; ok {
-				sig = s
-			}
-		} else if n, err := strconv.Atoi(signal); err == nil {
-			sig = syscall.Signal(n)
+	// Never signal a pid recorded as stopped: it may have been reused
+	if st.Pid <= 0 || st.Status == state.Stopped || !pidRunning(st.Pid) {
+		return state.NotRunning(id)
+	}
+	if st.Status == state.Created || st.Status == state.Creating {
+		// The init must not exec the workload even if it survives the signal (or has
+		// not acted on it yet) and start is called later
+		if err := markKilled(stateDir, id, sig); err != nil {
+			return err
+		}
+	}
+	if all {
+		pids, err := killTargets(st)
+		if err != nil {
+			return err
 		}
+		return signalAll(pids, sig)
 	}
 	if err := syscall.Kill(st.Pid, sig); err != nil {
 		return err
@@ -156,35 +709,129 @@ func cmdKill(stateDir, id, signal string) error {
 	return nil
 }
 
-func cmdDelete(stateDir, id string) error {
-	st, err := state.Load(stateDir, id)
+// killedMarkerName is the file, under the container state dir, recording the signal of a
+// kill that came before start.
+const killedMarkerName = "killed"
+
+// errKilledBeforeStart ends an init whose container was killed before start; init exits
+// with 128+signal, like a shell reports a process killed by that signal.
+type errKilledBeforeStart struct {
+	sig syscall.Signal
+}
+
+func (e *errKilledBeforeStart) Error() string {
+	return fmt.Sprintf("killed before start (%s)", e.sig)
+}
+
+// markKilled records that the container was killed with sig before it started.
+func markKilled(stateDir, id string, sig syscall.Signal) error {
+	return state.WriteFile(filepath.Join(stateDir, id, killedMarkerName), []byte(strconv.Itoa(int(sig))), 0o640)
+}
+
+// killedBeforeStart reports whether the container was killed before start, and with
+// which signal.
+func killedBeforeStart(stateDir, id string) (syscall.Signal, bool) {
+	b, err := os.ReadFile(filepath.Join(stateDir, id, killedMarkerName))
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		}
-		return err
+		return 0, false
 	}
-	if st.Status == state.Running {
-		// If process is no longer alive, flip to stopped; otherwise try a best-effort kill
-		alive := pidAlive(st.Pid)
-		if !alive {
-			now := time.Now()
-			st.Status = state.Stopped
-			st.ExitedAt = &now
-			_ = state.Save(stateDir, st)
+	n, _ := strconv.Atoi(string(b))
+	return syscall.Signal(n), true
+}
+
+// cmdDelete removes a container. Created-but-not-started containers are killed first;
+// running ones are refused unless force is set, in which case the whole process tree is
+// SIGKILLed and the state is removed even if the container is wedged.
+func cmdDelete(stateDir, id string, force bool) (err error) {
+	defer func() {
+		if force {
+			recordOperation(stateDir, "delete", err, "deletes_forced_total")
 		} else {
-			// Best-effort SIGKILL then wait briefly for exit
-			_ = syscall.Kill(st.Pid, syscall.SIGKILL)
-			for i := 0; i < 20; i++ { // wait up to ~2s
-				if !pidAlive(st.Pid) {
-					now := time.Now()
-					st.Status = state.Stopped
-					st.ExitedAt = &now
-					_ = state.Save(stateDir, st)
-					break
-				}
-				time.Sleep(100 * time.Millisecond)
+			recordOperation(stateDir, "delete", err)
+		}
+	}()
+	lock, err := acquireLock(stateDir, id, "delete")
+	if err != nil {
+		if !force || !errors.Is(err, state.ErrOpInProgress) {
+			return err
+		}
+		// A wedged operation must not block forced cleanup
+		fmt.Fprintf(os.Stderr, "warning: %v; deleting anyway\n", err)
+	}
+	defer lock.Release()
+	return deleteContainer(stateDir, id, force)
+}
+
+// deleteContainer is cmdDelete once it holds the container's lock (or, forced, gave up on
+// it).
+func deleteContainer(stateDir, id string, force bool) error {
+	st, err := state.Load(stateDir, id)
+	if err != nil {
+		if errors.Is(err, state.ErrNotExist) {
+			if force {
+				// Clean up leftovers of an aborted create that never wrote state.json
+				return state.Delete(stateDir, id)
 			}
+			return err
+		}
+		if !force {
+			return err
+		}
+		// Unreadable state: nothing left to signal, just remove what is there
+		if err := releaseScratch(stateDir, id, ""); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: release scratch of %s: %v\n", id, err)
+		}
+		return state.Delete(stateDir, id)
+	}
+	if st.Status != state.Stopped && pidRunning(st.Pid) {
+		if st.Status == state.Running && !force {
+			return fmt.Errorf("cannot delete container %s that is not stopped: %s", id, st.Status)
+		}
+		if err := killTree(st, 2*time.Second); err != nil && !force {
+			return err
+		}
+		now := time.Now()
+		st.Status = state.Stopped
+		st.ExitedAt = &now
+		_ = state.Save(stateDir, st)
+	}
+	// Last chance to notice an OOM kill: the cgroup goes below, and the audit.log with the
+	// event is archived before that
+	if checkOOM(stateDir, st) {
+		_ = state.Save(stateDir, st)
+	}
+	// A run monitor still records the exit and drains output into the state dir; removing
+	// the dir under it fails with ENOTEMPTY, so give it a moment to finish
+	if st.MonitorPid > 0 {
+		waitPidExit(st.MonitorPid, 2*time.Second)
+	}
+	if err := takeSnapshot(stateDir, st, st.ExitCode); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: snapshot of %s: %v\n", id, err)
+	}
+	if err := archiveLogs(stateDir, st); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: archive logs of %s: %v\n", id, err)
+	}
+	if _, ok := st.Annotations[oci.CPUsAnnotation]; ok {
+		if err := releaseCPUs(id); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: release CPUs of %s: %v\n", id, err)
+		}
+	}
+	if err := releaseScratch(stateDir, id, st.ScratchImage); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: release scratch of %s: %v\n", id, err)
+	}
+	if st.CgroupUnit != "" {
+		if err := cgroups.StopScope(st.CgroupUnit); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+		}
+	}
+	if st.Cgroup != "" {
+		if err := cgroups.Remove(st.Cgroup); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+		}
+	}
+	if st.IntelRdtGroup != "" {
+		if err := resctrl.Remove(st.IntelRdtGroup); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %v\n", err)
 		}
 	}
 	// Best-effort delete; ignore if already gone
@@ -194,9 +841,51 @@ func cmdDelete(stateDir, id string) error {
 		}
 		return err
 	}
+	if hooks, limits, err := stageHooks(st); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: poststop hooks of %s: %v\n", id, err)
+	} else if hooks != nil {
+		if err := runHooks(oci.HookPoststop, hooks.Poststop, newHookState(st, state.Stopped), nil, limits); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: hooks of %s: %v\n", id, err)
+		}
+	}
+	if err := releaseSandboxShm(stateDir, st.Annotations[oci.SandboxIDAnnotation]); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: release sandbox shm: %v\n", err)
+	}
+	return nil
+}
+
+// killTree SIGKILLs every process of the container (see killTargets) and waits up to
+// timeout for the init to be gone (exited or a zombie awaiting its parent). A cgroup with
+// a cgroup.kill is killed through it, which also catches processes forked meanwhile.
+func killTree(st *state.ContainerState, timeout time.Duration) error {
+	if st.Cgroup == "" || cgroups.Kill(st.Cgroup) != nil {
+		pids, err := killTargets(st)
+		if err != nil {
+			return err
+		}
+		if err := signalAll(pids, syscall.SIGKILL); err != nil {
+			return err
+		}
+	}
+	if !waitPidExit(st.Pid, timeout) {
+		return fmt.Errorf("pid %d still running after SIGKILL", st.Pid)
+	}
 	return nil
 }
 
+// waitPidExit polls until pid has exited (or is a zombie) or timeout elapses, and reports
+// whether it exited.
+func waitPidExit(pid int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for pidRunning(pid) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return true
+}
+
 // pidAlive returns whether a PID currently exists. EPERM means alive; ESRCH means not alive.
 func pidAlive(pid int) bool {
 	if pid <= 0 {
@@ -213,27 +902,92 @@ func pidAlive(pid int) bool {
 }
 
 // cmdInit runs in the child process created during 'create'.
-// It reads specs.Process from fd 3, then waits for the 'start' file before execing the program.
-func cmdInit(stateDir, id string) error {
-	// fd 3 is the pipe from parent where specs.Process is sent
-	pipe := os.NewFile(uintptr(3), "parent-pipe")
-	defer pipe.Close()
-	var p oci.Process
-	if err := json.NewDecoder(pipe).Decode(&p); err != nil {
-		return fmt.Errorf("init decode process: %w", err)
+// It reads its initConfig from fd 3 and waits for create to finish on fd 4, both after
+// the preserved fds if there are any, then waits for the 'start' file and any start gate
+// before execing the program.
+func cmdInit(stateDir, id string, preserved int) error {
+	// Neither fd may reach the workload; the preserved ones do, as they are
+	cfg, err := readSealedConfig(handoffConfigFd + preserved)
+	syscall.Close(handoffConfigFd + preserved)
+	if err != nil {
+		return err
+	}
+	for _, fd := range cfg.IDMaps {
+		syscall.CloseOnExec(fd)
+	}
+	if cfg.Console != 0 {
+		syscall.CloseOnExec(cfg.Console)
+	}
+	goPipe := os.NewFile(uintptr(handoffGoFd+preserved), "go-pipe")
+	err = awaitGo(goPipe)
+	goPipe.Close()
+	if err != nil {
+		return err
+	}
+	if cfg.CgroupNS {
+		// The namespace is per thread and this one execs; never unlocked
+		runtime.LockOSThread()
+		if err := syscall.Unshare(syscall.CLONE_NEWCGROUP); err != nil {
+			return fmt.Errorf("unshare cgroup namespace: %w", err)
+		}
+	}
+	if cfg.Process == nil {
+		return errors.New("init: no process in config")
+	}
+	rdtTasks, err := openIntelRdt(cfg.IntelRdtGroup)
+	if err != nil {
+		return err
+	}
+	p := *cfg.Process
+	if p.ExecCPUAffinity != nil && p.ExecCPUAffinity.Initial != "" {
+		if err := setInitialAffinity(p.ExecCPUAffinity); err != nil {
+			return err
+		}
+	}
+	// The mounts init makes ahead, besides create's idmapped clones
+	detached := cfg.IDMaps
+	if cfg.Console != 0 {
+		// During create, where containerd's shim waits for the master
+		pts, err := openTerminal(cfg.Mounts, cfg.Console, p.ConsoleSize, p.User.UID)
+		if err != nil {
+			return err
+		}
+		for i, fd := range pts {
+			if detached == nil {
+				detached = map[int]int{}
+			}
+			detached[i] = fd
+		}
 	}
 
 	// Wait for start signal: file existence
 	startPath := filepath.Join(stateDir, id, "start")
 	for {
-		if _, err := os.Stat(startPath); err == nil {
+		if sig, killed := killedBeforeStart(stateDir, id); killed {
+			return &errKilledBeforeStart{sig}
+		}
+		// Only the file start writes counts, not something planted in its place
+		if fi, err := os.Lstat(startPath); err == nil && fi.Mode().IsRegular() {
 			break
 		}
+		// Deleted before start (e.g. the state root was removed): nothing will ever start us
+		if _, err := os.Stat(filepath.Dir(startPath)); os.IsNotExist(err) {
+			return fmt.Errorf("container %s deleted before start", id)
+		}
 		time.Sleep(100 * time.Millisecond)
 	}
+	if cfg.StartGate != nil {
+		if err := cfg.StartGate.wait(); err != nil {
+			return err
+		}
+	}
 
 	// Load spec and bundle to determine rootfs for a minimal chroot
-	st, err := state.Load(stateDir, id)
+	load := state.Load
+	if cfg.Userns {
+		load = state.LoadShared
+	}
+	st, err := load(stateDir, id)
 	if err != nil {
 		return fmt.Errorf("load state: %w", err)
 	}
@@ -242,99 +996,309 @@ func cmdInit(stateDir, id string) error {
 		return fmt.Errorf("load spec: %w", err)
 	}
 
-	// Determine if host mode is requested via annotation or env var
-	hostMode := false
-	// Allow toggling via the runtime process env (for direct runs)
-	if v := os.Getenv("RUNPROC_HOST"); v == "1" || strings.EqualFold(v, "true") || strings.EqualFold(v, "yes") {
-		hostMode = true
+	if err := injectFault("chroot"); err != nil {
+		return err
 	}
-	// Allow toggling via the container process env in the OCI spec
-	if !hostMode {
-		for _, e := range p.Env {
-			if strings.HasPrefix(e, "RUNPROC_HOST=") {
-				val := strings.TrimPrefix(e, "RUNPROC_HOST=")
-				if val == "1" || strings.EqualFold(val, "true") || strings.EqualFold(val, "yes") {
-					hostMode = true
-					break
-				}
-			}
+	// Perform a minimal chroot into the rootfs if specified, unless host mode is requested
+	if isolated(spec) {
+		if err := setUTSNames(spec); err != nil {
+			return err
 		}
-	}
-	if spec.Annotations != nil {
-		if v, ok := spec.Annotations["runproc.host"]; ok {
-			if v == "1" || strings.EqualFold(v, "true") || strings.EqualFold(v, "yes") {
-				hostMode = true
+		if spec.Linux != nil && len(spec.Linux.Sysctl) > 0 {
+			if err := applySysctls(spec.Linux.Sysctl); err != nil {
+				return err
 			}
 		}
-	}
-
-	// Perform a minimal chroot into the rootfs if specified, unless host mode is requested
-	if !hostMode && spec.Root != nil && spec.Root.Path != "" && os.Geteuid() == 0 {
 		rootfs := spec.Root.Path
 		if !filepath.IsAbs(rootfs) {
 			rootfs = filepath.Join(st.Bundle, rootfs)
 		}
-		if err := syscall.Chroot(rootfs); err != nil {
-			return fmt.Errorf("chroot: %w", err)
-		}
-		if err := os.Chdir("/"); err != nil {
-			return fmt.Errorf("chdir after chroot: %w", err)
+		if joinsNamespace(spec, oci.MountNamespace) {
+			// A shared mount namespace keeps its root; only this process moves into the rootfs
+			if err := syscall.Chroot(rootfs); err != nil {
+				return fmt.Errorf("chroot: %w", err)
+			}
+			if err := os.Chdir("/"); err != nil {
+				return fmt.Errorf("chdir after chroot: %w", err)
+			}
+		} else if err := enterRootfs(rootfs, filepath.Join(stateDir, id, rootfsMountName), cfg.Mounts, detached, spec.Linux, cfg.NoPivot); err != nil {
+			return err
 		}
+		closeDetached(detached)
+	}
+	// In the container's root, so their paths resolve there, and in its cgroup: the
+	// node's cgroups are out of reach, only the timeout ceiling applies
+	if err := runHooks(oci.HookStartContainer, cfg.StartContainer, newHookState(st, state.Created), nil, hookLimits{timeout: cfg.HookTimeout}); err != nil {
+		return err
 	}
 
-	// Setup stdio: use current stdio; containerd will have set FIFOs already
+	// Setup stdio: inherited from create (see openStdio)
 	argv := []string{p.Args[0]}
 	if len(p.Args) > 1 {
 		argv = p.Args
 	}
-	// If Cwd is set, chdir
-	if p.Cwd != "" {
+	// If Cwd is set, chdir (a wasm workload's cwd is inside its WASI sandbox)
+	if p.Cwd != "" && cfg.Wasm == nil {
 		if err := os.Chdir(p.Cwd); err != nil {
 			return fmt.Errorf("chdir: %w", err)
 		}
 	}
-	// Setup env
-	if len(p.Env) > 0 {
+	setProcessEnv(p.Env, cfg.DefaultEnv)
+
+	// Resolve a bare command name against PATH like execvp, as the OCI spec requires
+	var path string
+	if cfg.Wasm != nil {
+		path, argv = cfg.Wasm.Path, cfg.Wasm.Args
+	} else if cfg.Exec != nil {
+		if err := cfg.Exec.verify(); err != nil {
+			return err
+		}
+		path = cfg.Exec.Path
+	} else if path, err = lookPath(argv[0], os.Getenv("PATH")); err != nil {
+		return err
+	}
+	if err := injectFault("exec"); err != nil {
+		return err
+	}
+	// Last check: a kill that got the lock before start left its marker before the start
+	// file could be written
+	if sig, killed := killedBeforeStart(stateDir, id); killed {
+		return &errKilledBeforeStart{sig}
+	}
+	var personality *oci.LinuxPersonality
+	if spec.Linux != nil {
+		personality = spec.Linux.Personality
+	}
+	if err := setProcessAttrs(&p, personality, st.Cpus); err != nil {
+		return err
+	}
+	if err := joinIntelRdt(rdtTasks); err != nil {
+		return err
+	}
+	return confineAndExec(&p, cfg.AppArmorProfile, cfg.SELinuxLabel, cfg.Seccomp, path, argv)
+}
+
+// setProcessEnv makes env, when set, the whole environment, and adds the defaults whose
+// name it lacks.
+func setProcessEnv(env, defaults []string) {
+	if len(env) > 0 {
 		os.Clearenv()
+		// Validate already rejected entries without a name or with NUL bytes
+		for _, e := range env {
+			k, v, _ := strings.Cut(e, "=")
+			os.Setenv(k, v)
+		}
+	}
+	for _, e := range defaults {
+		k, v, _ := strings.Cut(e, "=")
+		if _, ok := os.LookupEnv(k); !ok {
+			os.Setenv(k, v)
+		}
+	}
+}
+
+// setProcessAttrs applies p's resource limits, scheduling, I/O priority and final CPU
+// affinity (within pinned, see setFinalAffinity), and the personality, to the process
+// about to exec.
+func setProcessAttrs(p *oci.Process, personality *oci.LinuxPersonality, pinned string) error {
+	if err := setRlimits(p.Rlimits); err != nil {
+		return err
+	}
+	if p.Scheduler != nil {
+		if err := setScheduler(p.Scheduler); err != nil {
+			return err
+		}
+	}
+	if p.IOPriority != nil {
+		if err := setIOPriority(p.IOPriority); err != nil {
+			return err
+		}
+	}
+	if p.ExecCPUAffinity != nil && p.ExecCPUAffinity.Final != "" {
+		if err := setFinalAffinity(p.ExecCPUAffinity, pinned); err != nil {
+			return err
+		}
+	}
+	if personality != nil {
+		return setPersonality(personality)
+	}
+	return nil
+}
+
+// confineAndExec applies the AppArmor profile, SELinux label and seccomp filter and
+// becomes p's user, in the order each needs of the others, and execs path. Any of them
+// may be unset.
+func confineAndExec(p *oci.Process, profile, label string, seccomp *seccompFilter, path string, argv []string) error {
+	if profile != "" {
+		if err := applyAppArmor(profile); err != nil {
+			return err
+		}
+	}
+	if label != "" {
+		if err := applySELinux(label); err != nil {
+			return err
+		}
+	}
+	// Without no_new_privs, installing a filter takes the privilege setUser may drop
+	if seccomp != nil && !p.NoNewPrivileges {
+		if err := applySeccomp(seccomp); err != nil {
+			return err
+		}
+	}
+	// Only now: the state dir (start file, killed marker, staged exec) is root-only
+	if err := setUser(p.User, p.Capabilities); err != nil {
+		return err
+	}
+	// Kubernetes sets it for allowPrivilegeEscalation: false
+	if p.NoNewPrivileges {
+		if err := setNoNewPrivs(); err != nil {
+			return err
+		}
+		// Last, so the filter need not allow what setUser does
+		if seccomp != nil {
+			if err := applySeccomp(seccomp); err != nil {
+				return err
+			}
+		}
+	}
+	return syscall.Exec(path, argv, os.Environ())
+}
+
+// isHostMode reports whether the container runs on the node filesystem (no chroot, no
+// mounts): requested by RUNPROC_HOST in runproc's or the process's env, or the annotation.
+func isHostMode(spec *oci.Spec, p *oci.Process) bool {
+	truthy := func(v string) bool {
+		return v == "1" || strings.EqualFold(v, "true") || strings.EqualFold(v, "yes")
+	}
+	// Allow toggling via the runtime process env (for direct runs)
+	if truthy(os.Getenv("RUNPROC_HOST")) {
+		return true
+	}
+	// Allow toggling via the container process env in the OCI spec
+	if p != nil {
 		for _, e := range p.Env {
-			kv := strings.SplitN(e, "=", 2)
-			if len(kv) == 2 {
-				os.Setenv(kv[0], kv[1])
+			if v, ok := strings.CutPrefix(e, "RUNPROC_HOST="); ok && truthy(v) {
+				return true
+			}
+		}
+	}
+	return truthy(spec.Annotations[oci.HostAnnotation])
+}
+
+// lookPath resolves name against the colon-separated dirs in pathEnv when it contains no slash.
+func lookPath(name, pathEnv string) (string, error) {
+	if strings.Contains(name, "/") {
+		return name, nil
+	}
+	for _, dir := range filepath.SplitList(pathEnv) {
+		if dir == "" {
+			dir = "."
+		}
+		p := filepath.Join(dir, name)
+		if fi, err := os.Stat(p); err == nil && fi.Mode().IsRegular() && fi.Mode()&0o111 != 0 {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("executable %q not found in $PATH", name)
+}
+
+// forwardSignals relays signals received by a foreground `run` to the container init,
+// which leads its own session and therefore no longer sees terminal-generated signals.
+// The returned func stops forwarding.
+func forwardSignals(pid int) func() {
+	ch := make(chan os.Signal, 16)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-ch:
+				_ = syscall.Kill(pid, sig.(syscall.Signal))
+			case <-done:
+				return
 			}
 		}
+	}()
+	return func() {
+		signal.Stop(ch)
+		close(done)
 	}
+}
 
-	return syscall.Exec(argv[0], argv, os.Environ())
+// cmdWait blocks until the container has exited and writes its exit code to w. The caller
+// does not need to be the parent of the init process: the code is read from state, where
+// the process that does wait for the init (e.g. the `run --detach` monitor) records it.
+func cmdWait(stateDir, id string, w io.Writer) error {
+	for {
+		st, err := state.Load(stateDir, id)
+		if err != nil {
+			return err
+		}
+		if st.ExitCode != nil {
+			_, err := fmt.Fprintln(w, *st.ExitCode)
+			return err
+		}
+		if st.Status == state.Stopped || !pidAlive(st.Pid) {
+			// Give a live monitor the chance to record the code it just reaped
+			if !pidAlive(st.MonitorPid) {
+				return fmt.Errorf("container %s exited but its exit status was not recorded (no monitor)", id)
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
 }
 
-// waitProcess polls the pid and records exit code into state once exited.
-func waitProcess(stateDir, id string) (int, error) {
+// waitProcess polls the pid and records exit code into state once exited. A container
+// killed by a signal exits with 128+signal, as a shell reports it. It returns how the
+// container ended, for `run` to report.
+func waitProcess(stateDir, id string) (*runResult, error) {
 	st, err := state.Load(stateDir, id)
 	if err != nil {
-		return 1, err
+		return nil, err
 	}
 	if st.Pid <= 0 {
-		return 1, errors.New("no pid")
+		return nil, errors.New("no pid")
 	}
+	stopThrottle, err := throttleContainer(st)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: cpu throttle of %s: %v\n", id, err)
+	}
+	stopLimit, err := limitDescendants(stateDir, st)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: descendant limit of %s: %v\n", id, err)
+	}
+	stopOOM := watchOOM(stateDir, st)
 	var ws syscall.WaitStatus
+	var rusage syscall.Rusage
 	for {
-		var rusage syscall.Rusage
 		wpid, err := syscall.Wait4(st.Pid, &ws, 0, &rusage)
 		if err != nil {
 			if err == syscall.EINTR {
 				continue
 			}
-			return 1, err
+			stopThrottle()
+			stopLimit()
+			stopOOM()
+			return nil, err
 		}
 		if wpid == st.Pid {
 			break
 		}
 	}
+	stopThrottle()
+	stopLimit()
+	stopOOM()
 	code := ws.ExitStatus()
+	if ws.Signaled() {
+		code = 128 + int(ws.Signal())
+	}
 	now := time.Now()
 	st.Status = state.Stopped
 	st.ExitedAt = &now
 	st.ExitCode = &code
 	_ = state.Save(stateDir, st)
-	return code, nil
+	if err := takeSnapshot(stateDir, st, &code); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: snapshot of %s: %v\n", id, err)
+	}
+	return newRunResult(st, code, ws, &rusage, now), nil
 }
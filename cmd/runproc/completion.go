@@ -0,0 +1,348 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// completionFlag is a flag offered by the completion scripts. arg is "" for boolean flags,
+// "dir" or "file" for path values, or a space-separated list of the accepted values.
+type completionFlag struct {
+	long, short string
+	arg         string
+}
+
+// completionCommand describes a subcommand for the completion scripts. Keep it in sync
+// with the switch in run() and with usage().
+type completionCommand struct {
+	name  string
+	ids   bool // positional argument is an existing container id
+	dirs  bool // positional argument is a directory (a bundle)
+	flags []completionFlag
+}
+
+var completionGlobalFlags = []completionFlag{
+	{long: "root", arg: "dir"},
+	{long: "log", arg: "file"},
+	{long: "log-format", arg: "text json"},
+	{long: "version", short: "v"},
+}
+
+var completionCommands = []completionCommand{
+	{name: "create", dirs: true, flags: []completionFlag{{long: "bundle", short: "b", arg: "dir"}, {long: "pid-file", arg: "file"}, {long: "console-socket", arg: "file"}, {long: "stdin", arg: "file"}, {long: "stdout", arg: "file"}, {long: "stderr", arg: "file"}, {long: "preserve-fds", arg: "-"}, {long: "no-pivot"}}},
+	{name: "start", ids: true},
+	{name: "state", ids: true},
+	{name: "kill", ids: true, flags: []completionFlag{{long: "all", short: "a"}, {long: "dry-run"}}},
+	{name: "delete", ids: true, flags: []completionFlag{{long: "force", short: "f"}, {long: "all", short: "a"}, {long: "parallel", arg: "-"}}},
+	{name: "wait", ids: true},
+	{name: "events", ids: true},
+	{name: "migrate-state", ids: true},
+	{name: "attach", ids: true},
+	{name: "console", ids: true, flags: []completionFlag{{long: "console-socket", arg: "file"}}},
+	{name: "logs", ids: true, flags: []completionFlag{{long: "follow", short: "f"}, {long: "tail", arg: "-"}, {long: "timestamps", short: "t"}}},
+	{name: "stats", ids: true, flags: []completionFlag{{long: "watch"}, {long: "interval", arg: "-"}, {long: "runtime"}, {long: "format", arg: "json prometheus"}}},
+	{name: "pods", flags: []completionFlag{{long: "format", arg: "table json"}}},
+	{name: "inspect", ids: true},
+	{name: "top", ids: true, flags: []completionFlag{{long: "interval", arg: "-"}, {long: "iterations", arg: "-"}}},
+	{name: "run", dirs: true, flags: []completionFlag{{long: "bundle", short: "b", arg: "dir"}, {long: "detach", short: "d"}, {long: "no-console-log"}, {long: "pid-file", arg: "file"}, {long: "console-socket", arg: "file"}, {long: "preserve-fds", arg: "-"}, {long: "no-pivot"}, {long: "nomad-compat"}, {long: "result"}, {long: "result-file", arg: "file"}}},
+	{name: "exec", ids: true, flags: []completionFlag{{long: "process", short: "p", arg: "file"}, {long: "detach", short: "d"}, {long: "pid-file", arg: "file"}, {long: "console-socket", arg: "file"}, {long: "preserve-fds", arg: "-"}}},
+	{name: "time", dirs: true, flags: []completionFlag{{long: "count", short: "n", arg: "-"}}},
+	{name: "features"},
+	{name: "version", flags: []completionFlag{{long: "format", arg: "text json"}}},
+	{name: "spec", flags: []completionFlag{{long: "bundle", arg: "dir"}, {long: "host"}, {long: "rootless"}}},
+	{name: "checkpoint", ids: true, flags: []completionFlag{{long: "image-path", arg: "dir"}, {long: "work-path", arg: "dir"}, {long: "leave-running"}, {long: "tcp-established"}, {long: "ext-unix-sk"}, {long: "file-locks"}}},
+	{name: "completion"},
+}
+
+// completionShells are the shells cmdCompletion writes scripts for.
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// cmdCompletion writes the completion script for shell. The scripts complete subcommands
+// and flags, and container ids by calling `runproc completion ids`.
+func cmdCompletion(w io.Writer, shell string) error {
+	switch shell {
+	case "bash":
+		return writeBashCompletion(w)
+	case "zsh":
+		return writeZshCompletion(w)
+	case "fish":
+		return writeFishCompletion(w)
+	}
+	return fmt.Errorf("unsupported shell %q (want %s)", shell, strings.Join(completionShells, ", "))
+}
+
+// cmdCompletionIDs prints the ids of the containers in stateDir, one per line. Entries
+// starting with '.' belong to runproc itself (.locks, .sandboxes) and are skipped.
+func cmdCompletionIDs(w io.Writer, stateDir string) error {
+	entries, err := os.ReadDir(stateDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var ids []string
+	for _, e := range entries {
+		if e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+			ids = append(ids, e.Name())
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		fmt.Fprintln(w, id)
+	}
+	return nil
+}
+
+func commandNames() string {
+	names := make([]string, len(completionCommands))
+	for i, c := range completionCommands {
+		names[i] = c.name
+	}
+	return strings.Join(names, " ")
+}
+
+// flagWords returns the flags as typed on the command line, e.g. "--force -f".
+func flagWords(flags []completionFlag) string {
+	var words []string
+	for _, f := range flags {
+		words = append(words, "--"+f.long)
+		if f.short != "" {
+			words = append(words, "-"+f.short)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// flagPatterns returns the flags taking a value of the given kind as a shell case pattern.
+func flagPatterns(kind func(arg string) bool) string {
+	seen := map[string]bool{}
+	var pats []string
+	for _, flags := range append([][]completionFlag{completionGlobalFlags}, commandFlags()...) {
+		for _, f := range flags {
+			if f.arg == "" || !kind(f.arg) {
+				continue
+			}
+			for _, w := range strings.Fields(flagWords([]completionFlag{f})) {
+				if !seen[w] {
+					seen[w] = true
+					pats = append(pats, w)
+				}
+			}
+		}
+	}
+	return strings.Join(pats, "|")
+}
+
+func commandFlags() [][]completionFlag {
+	out := make([][]completionFlag, len(completionCommands))
+	for i, c := range completionCommands {
+		out[i] = c.flags
+	}
+	return out
+}
+
+func isDirArg(arg string) bool  { return arg == "dir" }
+func isFileArg(arg string) bool { return arg == "file" }
+func isFreeArg(arg string) bool { return arg == "-" }
+
+// valueFlags returns flag -> accepted values for flags with a fixed set of values.
+func valueFlags() [][2]string {
+	seen := map[string]bool{}
+	var out [][2]string
+	for _, flags := range append([][]completionFlag{completionGlobalFlags}, commandFlags()...) {
+		for _, f := range flags {
+			if f.arg == "" || isDirArg(f.arg) || isFileArg(f.arg) || isFreeArg(f.arg) || seen[f.long] {
+				continue
+			}
+			seen[f.long] = true
+			out = append(out, [2]string{"--" + f.long, f.arg})
+		}
+	}
+	return out
+}
+
+func commandsWith(pred func(c completionCommand) bool) []string {
+	var names []string
+	for _, c := range completionCommands {
+		if pred(c) {
+			names = append(names, c.name)
+		}
+	}
+	return names
+}
+
+func writeBashCompletion(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString(`# bash completion for runproc; enable with: source <(runproc completion bash)
+
+_runproc_ids() {
+	local root="" i
+	for ((i = 1; i < COMP_CWORD; i++)); do
+		[[ ${COMP_WORDS[i]} == --root ]] && root=${COMP_WORDS[i+1]}
+	done
+	runproc ${root:+--root "$root"} completion ids 2>/dev/null
+}
+
+_runproc() {
+	local cur=${COMP_WORDS[COMP_CWORD]} prev=${COMP_WORDS[COMP_CWORD-1]} cmd="" flags="" i
+	for ((i = 1; i < COMP_CWORD; i++)); do
+		case ${COMP_WORDS[i]} in
+		--root|--log|--log-format) ((i++)) ;;
+		-*) ;;
+		*) cmd=${COMP_WORDS[i]}; break ;;
+		esac
+	done
+	case $prev in
+`)
+	fmt.Fprintf(&b, "\t%s) COMPREPLY=($(compgen -d -- \"$cur\")); return ;;\n", flagPatterns(isDirArg))
+	fmt.Fprintf(&b, "\t%s) COMPREPLY=($(compgen -f -- \"$cur\")); return ;;\n", flagPatterns(isFileArg))
+	for _, v := range valueFlags() {
+		fmt.Fprintf(&b, "\t%s) COMPREPLY=($(compgen -W %q -- \"$cur\")); return ;;\n", v[0], v[1])
+	}
+	fmt.Fprintf(&b, "\t%s) return ;;\n", flagPatterns(isFreeArg))
+	b.WriteString("\tesac\n")
+	fmt.Fprintf(&b, "\tif [[ -z $cmd ]]; then\n\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n\t\treturn\n\tfi\n",
+		commandNames()+" "+flagWords(completionGlobalFlags))
+	b.WriteString("\tcase $cmd in\n")
+	for _, c := range completionCommands {
+		if len(c.flags) > 0 {
+			fmt.Fprintf(&b, "\t%s) flags=%q ;;\n", c.name, flagWords(c.flags))
+		}
+	}
+	b.WriteString("\tesac\n")
+	b.WriteString("\tif [[ $cur == -* ]]; then\n\t\tCOMPREPLY=($(compgen -W \"$flags\" -- \"$cur\"))\n\t\treturn\n\tfi\n")
+	b.WriteString("\tcase $cmd in\n")
+	fmt.Fprintf(&b, "\t%s) COMPREPLY=($(compgen -W \"$(_runproc_ids)\" -- \"$cur\")) ;;\n", strings.Join(commandsWith(func(c completionCommand) bool { return c.ids }), "|"))
+	fmt.Fprintf(&b, "\t%s) COMPREPLY=($(compgen -d -- \"$cur\")) ;;\n", strings.Join(commandsWith(func(c completionCommand) bool { return c.dirs }), "|"))
+	fmt.Fprintf(&b, "\tcompletion) COMPREPLY=($(compgen -W %q -- \"$cur\")) ;;\n", strings.Join(completionShells, " "))
+	b.WriteString("\tesac\n}\n\ncomplete -F _runproc runproc\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeZshCompletion(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString(`#compdef runproc
+# zsh completion for runproc; enable with: source <(runproc completion zsh)
+# (or save as _runproc in a directory on $fpath)
+
+_runproc_ids() {
+	local -a ids
+	local root i=${words[(I)--root]}
+	(( i )) && root=${words[i+1]}
+	ids=(${(f)"$(runproc ${root:+--root $root} completion ids 2>/dev/null)"})
+	compadd -a ids
+}
+
+_runproc() {
+	local cmd="" i
+	for ((i = 2; i < CURRENT; i++)); do
+		case ${words[i]} in
+		--root|--log|--log-format) ((i++)) ;;
+		-*) ;;
+		*) cmd=${words[i]}; break ;;
+		esac
+	done
+	case ${words[CURRENT-1]} in
+`)
+	fmt.Fprintf(&b, "\t%s) _files -/; return ;;\n", flagPatterns(isDirArg))
+	fmt.Fprintf(&b, "\t%s) _files; return ;;\n", flagPatterns(isFileArg))
+	for _, v := range valueFlags() {
+		fmt.Fprintf(&b, "\t%s) compadd %s; return ;;\n", v[0], v[1])
+	}
+	fmt.Fprintf(&b, "\t%s) return ;;\n", flagPatterns(isFreeArg))
+	b.WriteString("\tesac\n")
+	fmt.Fprintf(&b, "\tif [[ -z $cmd ]]; then\n\t\tif [[ $PREFIX == -* ]]; then\n\t\t\tcompadd -- %s\n\t\telse\n\t\t\tcompadd -- %s\n\t\tfi\n\t\treturn\n\tfi\n",
+		flagWords(completionGlobalFlags), commandNames())
+	b.WriteString("\tif [[ $PREFIX == -* ]]; then\n\t\tcase $cmd in\n")
+	for _, c := range completionCommands {
+		if len(c.flags) > 0 {
+			fmt.Fprintf(&b, "\t\t%s) compadd -- %s ;;\n", c.name, flagWords(c.flags))
+		}
+	}
+	b.WriteString("\t\tesac\n\t\treturn\n\tfi\n")
+	b.WriteString("\tcase $cmd in\n")
+	fmt.Fprintf(&b, "\t%s) _runproc_ids ;;\n", strings.Join(commandsWith(func(c completionCommand) bool { return c.ids }), "|"))
+	fmt.Fprintf(&b, "\t%s) _files -/ ;;\n", strings.Join(commandsWith(func(c completionCommand) bool { return c.dirs }), "|"))
+	fmt.Fprintf(&b, "\tcompletion) compadd %s ;;\n", strings.Join(completionShells, " "))
+	b.WriteString("\tesac\n}\n\n")
+	b.WriteString("if [[ $funcstack[1] == _runproc ]]; then\n\t_runproc \"$@\"\nelse\n\tcompdef _runproc runproc\nfi\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeFishCompletion(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString(`# fish completion for runproc; enable with: runproc completion fish | source
+# (or save as ~/.config/fish/completions/runproc.fish)
+
+function __runproc_command
+    set -l tokens (commandline -opc)
+    set -e tokens[1]
+    while set -q tokens[1]
+        switch $tokens[1]
+            case --root --log --log-format
+                set -e tokens[1]
+            case '-*'
+            case '*'
+                echo $tokens[1]
+                return 0
+        end
+        set -e tokens[1]
+    end
+    return 1
+end
+
+function __runproc_ids
+    set -l tokens (commandline -opc)
+    set -l root
+    if set -l i (contains -i -- --root $tokens)
+        set root --root $tokens[(math $i + 1)]
+    end
+    runproc $root completion ids 2>/dev/null
+end
+
+complete -c runproc -f
+`)
+	writeFishFlags(&b, "not __runproc_command", completionGlobalFlags)
+	fmt.Fprintf(&b, "complete -c runproc -n 'not __runproc_command' -a '%s'\n", commandNames())
+	for _, c := range completionCommands {
+		cond := fmt.Sprintf("test (__runproc_command) = %s", c.name)
+		writeFishFlags(&b, cond, c.flags)
+		switch {
+		case c.ids:
+			fmt.Fprintf(&b, "complete -c runproc -n '%s' -a '(__runproc_ids)'\n", cond)
+		case c.dirs:
+			fmt.Fprintf(&b, "complete -c runproc -n '%s' -a '(__fish_complete_directories)'\n", cond)
+		case c.name == "completion":
+			fmt.Fprintf(&b, "complete -c runproc -n '%s' -a '%s'\n", cond, strings.Join(completionShells, " "))
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeFishFlags(b *strings.Builder, cond string, flags []completionFlag) {
+	for _, f := range flags {
+		line := fmt.Sprintf("complete -c runproc -n '%s' -l %s", cond, f.long)
+		if f.short != "" {
+			line += " -s " + f.short
+		}
+		switch {
+		case f.arg == "":
+		case isDirArg(f.arg):
+			line += " -r -a '(__fish_complete_directories)'"
+		case isFileArg(f.arg):
+			line += " -r -F"
+		case isFreeArg(f.arg):
+			line += " -r"
+		default:
+			line += fmt.Sprintf(" -r -a '%s'", f.arg)
+		}
+		b.WriteString(line + "\n")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/ktsakalozos/runproc/internal/state"
+)
+
+// The console store: create hands init one end of a socketpair as its console socket and
+// gives the other, with the caller's console socket, to a holder process of its own. The
+// holder passes the pty master on to the caller and keeps a copy, which it sends to each
+// client of <state dir>/<id>/console.sock, so `runproc console` can give a restarted shim
+// the master again.
+const (
+	consoleSockName      = "console.sock"
+	consoleHolderCommand = "console-holder"
+	// consoleHolderInterval is how often the holder checks that its container still exists
+	consoleHolderInterval = time.Second
+)
+
+// startConsoleHolder starts the holder of the console of container id, whose init is pid:
+// it receives the master on from and sends it to the caller on to.
+func startConsoleHolder(stateDir, id string, pid int, from, to *os.File) error {
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("console holder: %w", err)
+	}
+	cmd := exec.Command(self, consoleHolderCommand, stateDir, id, strconv.Itoa(pid))
+	cmd.Env = os.Environ()
+	// Like the monitor it outlives create, so it leaves our session
+	cmd.ExtraFiles = []*os.File{from, to}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start console holder: %w", err)
+	}
+	return cmd.Process.Release()
+}
+
+// cmdConsoleHolder is the holder startConsoleHolder starts, with the init's end of the
+// socketpair on fd 3 and the caller's console socket on fd 4. It serves the master until
+// the container's init has exited or the container was deleted.
+func cmdConsoleHolder(stateDir, id string, pid int) error {
+	from, to := os.NewFile(3, "console"), os.NewFile(4, "console-socket")
+	master, err := receiveConsole(from)
+	from.Close()
+	if err != nil {
+		to.Close()
+		return err
+	}
+	defer master.Close()
+	err = sendConsole(int(to.Fd()), master)
+	to.Close()
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(stateDir, id)
+	p, dirf, err := unixPath(dir, consoleSockName)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("unix", p)
+	if dirf != nil {
+		dirf.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("listen for console clients: %w", err)
+	}
+	go serveConsole(l, master)
+	for pidRunning(pid) {
+		if _, err := os.Stat(dir); err != nil {
+			break
+		}
+		time.Sleep(consoleHolderInterval)
+	}
+	// Closing a unix listener removes its socket file
+	return l.Close()
+}
+
+// serveConsole sends master to every client of l until l is closed.
+func serveConsole(l net.Listener, master *os.File) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		if f, err := c.(*net.UnixConn).File(); err == nil {
+			_ = sendConsole(int(f.Fd()), master)
+			f.Close()
+		}
+		c.Close()
+	}
+}
+
+// cmdConsole sends the pty master of container id, kept by its console holder, to the
+// console socket at consoleSocket, as create did.
+func cmdConsole(stateDir, id, consoleSocket string) error {
+	if _, err := state.Load(stateDir, id); err != nil {
+		return err
+	}
+	p, dirf, err := unixPath(filepath.Join(stateDir, id), consoleSockName)
+	if err != nil {
+		return err
+	}
+	if dirf != nil {
+		defer dirf.Close()
+	}
+	holder, err := dialConsole(p)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ECONNREFUSED) {
+			return fmt.Errorf("container %s has no stored console (no terminal, or its init has exited)", id)
+		}
+		return err
+	}
+	defer holder.Close()
+	master, err := receiveConsole(holder)
+	if err != nil {
+		return err
+	}
+	defer master.Close()
+	conn, err := dialConsole(consoleSocket)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return sendConsole(int(conn.Fd()), master)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/ktsakalozos/runproc/internal/config"
+	"github.com/ktsakalozos/runproc/internal/oci"
+	"github.com/ktsakalozos/runproc/internal/state"
+)
+
+// cpuLockName serializes reservations in the node-wide reservations dir.
+const cpuLockName = ".lock"
+
+// pinCPUs applies the node's exclusive CPU pool when a container starts. A container with
+// the runproc.cpus annotation gets that many pool CPUs reserved for it and its init pinned
+// to them; any other container is kept off the pool. It returns the CPU list the init was
+// pinned to, or "" when it was left alone (no pool, or no CPU outside it).
+func pinCPUs(id string, pid int, annotations map[string]string) (string, error) {
+	want, requested := annotations[oci.CPUsAnnotation]
+	cfg, err := config.Load()
+	if err != nil {
+		if requested {
+			return "", err
+		}
+		// Unpinned containers must keep starting with a broken config
+		return "", nil
+	}
+	if cfg.CPUs.Pool == "" {
+		if requested {
+			return "", fmt.Errorf("%s requires cpus.pool in the node config", oci.CPUsAnnotation)
+		}
+		return "", nil
+	}
+	pool, err := parseCPUList(cfg.CPUs.Pool)
+	if err != nil {
+		return "", fmt.Errorf("cpus.pool: %w", err)
+	}
+	var cpus []int
+	if requested {
+		n, err := strconv.Atoi(want)
+		if err != nil || n <= 0 {
+			return "", fmt.Errorf("%s: %q is not a positive CPU count", oci.CPUsAnnotation, want)
+		}
+		if cpus, err = reserveCPUs(cfg.CPUs.ReservationsDir, id, pool, n); err != nil {
+			return "", err
+		}
+	} else {
+		online, err := onlineCPUs()
+		if err != nil {
+			return "", err
+		}
+		if cpus = subtractCPUs(online, pool); len(cpus) == 0 {
+			return "", nil
+		}
+	}
+	if err := setAffinity(pid, cpus); err != nil {
+		if requested {
+			_ = releaseCPUs(id)
+		}
+		return "", fmt.Errorf("pin to CPUs %s: %w", formatCPUList(cpus), err)
+	}
+	return formatCPUList(cpus), nil
+}
+
+// reserveCPUs takes n free CPUs of pool for id. Reservations are one file per container,
+// holding its CPU list, in dir; a file lock makes concurrent starts take disjoint CPUs.
+func reserveCPUs(dir, id string, pool []int, n int) ([]int, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	lock, err := os.OpenFile(filepath.Join(dir, cpuLockName), os.O_CREATE|os.O_RDWR|syscall.O_NOFOLLOW, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var used []int
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			continue
+		}
+		held, err := parseCPUList(strings.TrimSpace(string(b)))
+		if err != nil {
+			continue
+		}
+		if e.Name() == id {
+			// Already reserved (a retried start)
+			return held, nil
+		}
+		used = append(used, held...)
+	}
+	free := subtractCPUs(pool, used)
+	if len(free) < n {
+		return nil, fmt.Errorf("CPU pool exhausted: %s needs %d exclusive CPUs, %d of %d are free", id, n, len(free), len(pool))
+	}
+	cpus := free[:n]
+	if err := state.WriteFile(filepath.Join(dir, id), []byte(formatCPUList(cpus)+"\n"), 0o600); err != nil {
+		return nil, err
+	}
+	return cpus, nil
+}
+
+// releaseCPUs returns the pool CPUs reserved for id, if any.
+func releaseCPUs(id string) error {
+	cfg, err := config.Load()
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(cfg.CPUs.ReservationsDir, id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// setAffinity pins every thread of pid. The Go init is multi-threaded and execve keeps
+// the affinity of whichever thread calls it, so the main thread alone is not enough;
+// threads started meanwhile inherit the new mask, which the second pass confirms.
+func setAffinity(pid int, cpus []int) error {
+	mask := cpuMask(cpus)
+	done := map[int]bool{}
+	for {
+		tasks, err := os.ReadDir(filepath.Join("/proc", strconv.Itoa(pid), "task"))
+		if err != nil {
+			return err
+		}
+		pinned := 0
+		for _, t := range tasks {
+			tid, err := strconv.Atoi(t.Name())
+			if err != nil || done[tid] {
+				continue
+			}
+			_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, uintptr(tid), uintptr(len(mask)*8), uintptr(unsafe.Pointer(&mask[0])))
+			if errno != 0 && errno != syscall.ESRCH {
+				return errno
+			}
+			done[tid] = true
+			pinned++
+		}
+		if pinned == 0 {
+			return nil
+		}
+	}
+}
+
+// cpuMask is the sched_setaffinity(2) mask of the sorted CPUs.
+func cpuMask(cpus []int) []uint64 {
+	mask := make([]uint64, cpus[len(cpus)-1]/64+1)
+	for _, c := range cpus {
+		mask[c/64] |= 1 << (uint(c) % 64)
+	}
+	return mask
+}
+
+// onlineCPUs lists the CPUs the kernel has online.
+func onlineCPUs() ([]int, error) {
+	b, err := os.ReadFile("/sys/devices/system/cpu/online")
+	if err != nil {
+		return nil, err
+	}
+	return parseCPUList(strings.TrimSpace(string(b)))
+}
+
+// parseCPUList parses a kernel-style CPU list such as "0-3,8,10-11" into sorted CPUs.
+func parseCPUList(s string) ([]int, error) {
+	set := map[int]bool{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		lo, hi, isRange := strings.Cut(part, "-")
+		first, err := strconv.Atoi(lo)
+		last := first
+		if err == nil && isRange {
+			last, err = strconv.Atoi(hi)
+		}
+		if err != nil || first < 0 || last < first {
+			return nil, fmt.Errorf("invalid CPU list %q", s)
+		}
+		for c := first; c <= last; c++ {
+			set[c] = true
+		}
+	}
+	if len(set) == 0 {
+		return nil, fmt.Errorf("empty CPU list %q", s)
+	}
+	cpus := make([]int, 0, len(set))
+	for c := range set {
+		cpus = append(cpus, c)
+	}
+	sort.Ints(cpus)
+	return cpus, nil
+}
+
+// formatCPUList is the inverse of parseCPUList, collapsing runs into ranges.
+func formatCPUList(cpus []int) string {
+	var parts []string
+	for i := 0; i < len(cpus); {
+		j := i
+		for j+1 < len(cpus) && cpus[j+1] == cpus[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, strconv.Itoa(cpus[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", cpus[i], cpus[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
+
+// subtractCPUs returns the CPUs of a that are not in b, keeping a's order.
+func subtractCPUs(a, b []int) []int {
+	drop := map[int]bool{}
+	for _, c := range b {
+		drop[c] = true
+	}
+	var out []int
+	for _, c := range a {
+		if !drop[c] {
+			out = append(out, c)
+		}
+	}
+	return out
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ktsakalozos/runproc/internal/state"
+)
+
+// defaultDeleteWorkers bounds `delete --all` when --parallel is not given. Deletes mostly
+// wait (monitor exits, process tree kills, unmounts), not compute.
+const defaultDeleteWorkers = 8
+
+// cmdDeleteAll deletes every container of the state root with up to workers deletes at a
+// time, each one exactly as `delete` would. Without force, running containers and ones
+// still being created are skipped rather than reported, so it can clean up a node whose
+// pods are still up. Every failure
+// is reported, in id order, after all deletes finished.
+func cmdDeleteAll(stateDir string, force bool, workers int) error {
+	if workers < 1 {
+		return fmt.Errorf("invalid --parallel %d: must be at least 1", workers)
+	}
+	entries, err := os.ReadDir(stateDir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	var ids []string
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		if !force {
+			st, err := state.Load(stateDir, e.Name())
+			if errors.Is(err, state.ErrNotExist) {
+				// Still being created
+				continue
+			}
+			if err == nil && (st.Status == state.Creating || st.Status == state.Running && pidRunning(st.Pid)) {
+				continue
+			}
+		}
+		ids = append(ids, e.Name())
+	}
+	sort.Strings(ids)
+
+	errs := make([]error, len(ids))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < len(ids); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				if err := cmdDelete(stateDir, ids[i], force); err != nil {
+					errs[i] = fmt.Errorf("delete %s: %w", ids[i], err)
+				}
+			}
+		}()
+	}
+	for i := range ids {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return errors.Join(errs...)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ktsakalozos/runproc/internal/oci"
+	"github.com/ktsakalozos/runproc/internal/state"
+)
+
+// descendantLimit is a container's runproc.max_descendants: how many processes it may have
+// besides its init, and the signal all of them get once it has more.
+type descendantLimit struct {
+	max int
+	sig syscall.Signal
+	// name is the signal as events report it, e.g. "SIGKILL"
+	name string
+}
+
+// descendantsInterval is how often the supervisor counts the container's processes.
+const descendantsInterval = 250 * time.Millisecond
+
+// limitSignals are the signals runproc.max_descendants.signal may name.
+var limitSignals = map[string]syscall.Signal{
+	"SIGKILL": syscall.SIGKILL, "SIGTERM": syscall.SIGTERM, "SIGINT": syscall.SIGINT,
+	"SIGHUP": syscall.SIGHUP, "SIGQUIT": syscall.SIGQUIT, "SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2, "SIGSTOP": syscall.SIGSTOP,
+}
+
+// parseDescendantLimit reads the runproc.max_descendants annotations; create calls it too,
+// so a bad value fails there rather than in the supervisor. It returns nil when no limit
+// is set.
+func parseDescendantLimit(annotations map[string]string) (*descendantLimit, error) {
+	v, ok := annotations[oci.MaxDescendantsAnnotation]
+	name, hasSignal := annotations[oci.MaxDescendantsSignalAnnotation]
+	if !ok {
+		if hasSignal {
+			return nil, fmt.Errorf("%s is set without %s", oci.MaxDescendantsSignalAnnotation, oci.MaxDescendantsAnnotation)
+		}
+		return nil, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("%s: %q is not a positive number", oci.MaxDescendantsAnnotation, v)
+	}
+	l := &descendantLimit{max: n, sig: syscall.SIGKILL, name: "SIGKILL"}
+	if hasSignal {
+		if name = strings.ToUpper(name); !strings.HasPrefix(name, "SIG") {
+			name = "SIG" + name
+		}
+		sig, ok := limitSignals[name]
+		if !ok {
+			return nil, fmt.Errorf("%s: %q is not KILL, TERM, INT, HUP, QUIT, USR1, USR2 or STOP", oci.MaxDescendantsSignalAnnotation, annotations[oci.MaxDescendantsSignalAnnotation])
+		}
+		l.sig, l.name = sig, name
+	}
+	return l, nil
+}
+
+// limitDescendants starts enforcing the container's runproc.max_descendants in the
+// background if it sets one. The returned func stops it; it is safe to call when nothing
+// was started.
+func limitDescendants(stateDir string, st *state.ContainerState) (func(), error) {
+	l, err := parseDescendantLimit(st.Annotations)
+	if l == nil || err != nil {
+		return func() {}, err
+	}
+	done, finished := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(finished)
+		l.run(stateDir, st.ID, st.Pid, done)
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}, nil
+}
+
+// run counts the processes of the container of initPid every descendantsInterval. Once
+// there are more than max besides the init, it signals them all (enforce), appends a
+// max_descendants_exceeded event to the container's audit.log and counts the breach in
+// the runtime counters. A breach is handled once: the limit is only enforced again after
+// the count has been back within it.
+func (l *descendantLimit) run(stateDir, id string, initPid int, done <-chan struct{}) {
+	ticker := time.NewTicker(descendantsInterval)
+	defer ticker.Stop()
+	breached := false
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		pids, err := containerMembers(initPid)
+		if err != nil || len(pids) == 0 {
+			continue
+		}
+		n := len(pids) - 1
+		if n <= l.max {
+			breached = false
+			continue
+		}
+		if breached {
+			continue
+		}
+		breached = true
+		l.enforce(initPid, pids)
+		fmt.Fprintf(os.Stderr, "warning: %s has %d processes besides its init, more than %s %d: sent %s\n", id, n, oci.MaxDescendantsAnnotation, l.max, l.name)
+		_ = recordEvent(stateDir, id, containerEvent{Event: "max_descendants_exceeded", Descendants: n, Limit: l.max, Signal: l.name})
+		_ = state.AddCounters(stateDir, "max_descendants_exceeded_total")
+	}
+}
+
+// enforceRounds bounds how often enforce looks again for processes forked while it was
+// stopping the container.
+const enforceRounds = 5
+
+// enforce delivers the limit's signal to the container's processes, pids, and the init's
+// process group. In a pid namespace of its own, SIGKILL to the init takes the namespace
+// down with it. Otherwise a fork bomb outruns signalling it one process at a time, so
+// SIGKILL is preceded by stopping the processes until no new one shows up; a process
+// that started its own session and left the init's tree by then escapes.
+func (l *descendantLimit) enforce(initPid int, pids []int) {
+	if l.sig == syscall.SIGKILL && ownPidNamespace(initPid) {
+		_ = syscall.Kill(initPid, syscall.SIGKILL)
+		return
+	}
+	signal := func(sig syscall.Signal) {
+		// The init leads its own session, so its process group is its pid
+		_ = syscall.Kill(-initPid, sig)
+		_ = signalAll(pids, sig)
+	}
+	if l.sig == syscall.SIGKILL {
+		for round := 0; round < enforceRounds; round++ {
+			signal(syscall.SIGSTOP)
+			found, err := containerMembers(initPid)
+			if err != nil || !addNew(&pids, found) {
+				break
+			}
+		}
+	}
+	signal(l.sig)
+}
+
+// addNew appends the pids of found that are not in pids yet and reports whether there
+// were any.
+func addNew(pids *[]int, found []int) bool {
+	seen := make(map[int]bool, len(*pids))
+	for _, p := range *pids {
+		seen[p] = true
+	}
+	added := false
+	for _, p := range found {
+		if !seen[p] {
+			*pids = append(*pids, p)
+			added = true
+		}
+	}
+	return added
+}
+
+// containerMembers lists the processes of the container of initPid, the init first. In a
+// pid namespace of its own that is every process of the namespace, wherever it moved in
+// the process tree; otherwise it is what containerPids finds.
+func containerMembers(initPid int) ([]int, error) {
+	if !ownPidNamespace(initPid) {
+		return containerPids(initPid)
+	}
+	ns, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/pid", initPid))
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	pids := []int{initPid}
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil || pid == initPid {
+			continue
+		}
+		if theirs, err := os.Readlink("/proc/" + e.Name() + "/ns/pid"); err == nil && theirs == ns {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+// ownPidNamespace reports whether pid is the first process of a pid namespace, as the
+// init of a container with a pid namespace of its own is; the init of one that joined a
+// pod's shares it.
+func ownPidNamespace(pid int) bool {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if rest, ok := strings.CutPrefix(line, "NSpid:"); ok {
+			f := strings.Fields(rest)
+			return len(f) > 1 && f[len(f)-1] == "1"
+		}
+	}
+	return false
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/ktsakalozos/runproc/internal/oci"
+)
+
+// device is a character device every container gets in /dev.
+type device struct {
+	name         string
+	major, minor uint32
+}
+
+// defaultDevices is runc's default device set. /dev/console is left out: the node's
+// console must not leak in, and a terminal's pty is reached at /dev/pts.
+var defaultDevices = []device{
+	{"null", 1, 3},
+	{"zero", 1, 5},
+	{"full", 1, 7},
+	{"random", 1, 8},
+	{"urandom", 1, 9},
+	{"tty", 5, 0},
+}
+
+// defaultDevLinks are the /dev symlinks images expect next to the devices.
+var defaultDevLinks = map[string]string{
+	"fd":     "/proc/self/fd",
+	"stdin":  "/proc/self/fd/0",
+	"stdout": "/proc/self/fd/1",
+	"stderr": "/proc/self/fd/2",
+	// The private devpts instance's multiplexer (see defaultMounts)
+	"ptmx": "pts/ptmx",
+}
+
+// createDevices populates rootfs/dev with the default devices and links after the spec's
+// mounts (usually a tmpfs on /dev). Entries that are already right are kept. A missing
+// device is created with mknod. Anything else in its place is covered with a bind of the
+// node's device, since the rootfs may be shared and is never modified destructively.
+func createDevices(rootfs string) error {
+	dev, err := resolveInRoot(rootfs, "/dev")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dev, 0o755); err != nil {
+		return err
+	}
+	for _, d := range defaultDevices {
+		if err := createDevice(filepath.Join(dev, d.name), d); err != nil {
+			return fmt.Errorf("create /dev/%s: %w", d.name, err)
+		}
+	}
+	for name, target := range defaultDevLinks {
+		if err := os.Symlink(target, filepath.Join(dev, name)); err != nil && !errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("create /dev/%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func createDevice(path string, d device) error {
+	_, err := createNode(path, syscall.S_IFCHR|0o666, mkdev(d.major, d.minor), filepath.Join("/dev", d.name))
+	return err
+}
+
+// createNode makes path a node of mode (S_IFCHR, S_IFBLK or S_IFIFO, and the permissions)
+// and device number rdev, and reports whether it made one. A node that is already right
+// is kept. Where mknod is not allowed (in a user namespace) or something else is in the
+// way, hostPath, which must be the same node on the node, is bound over path.
+func createNode(path string, mode uint32, rdev uint64, hostPath string) (bool, error) {
+	var st syscall.Stat_t
+	err := syscall.Lstat(path, &st)
+	if err == nil && st.Mode&syscall.S_IFMT == mode&syscall.S_IFMT && st.Rdev == rdev {
+		return false, nil
+	}
+	if errors.Is(err, syscall.ENOENT) {
+		if err := syscall.Mknod(path, mode, int(rdev)); err == nil {
+			// mknod applied the umask
+			return true, os.Chmod(path, os.FileMode(mode&0o777))
+		} else if !errors.Is(err, syscall.EPERM) {
+			return false, err
+		}
+	} else if err != nil {
+		return false, err
+	} else if st.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+		return false, errors.New("a directory is in the way")
+	}
+	if err := syscall.Stat(hostPath, &st); err != nil {
+		return false, err
+	}
+	if st.Mode&syscall.S_IFMT != mode&syscall.S_IFMT || st.Rdev != rdev {
+		return false, fmt.Errorf("cannot create it, and %s on the node is another file", hostPath)
+	}
+	return false, bindMount(hostPath, path, syscall.MS_BIND)
+}
+
+// createSpecDevices creates the linux.devices of the spec in the rootfs, after the
+// default devices: with mknod, or as a bind of the same path on the node (see
+// createNode). The permissions and owner only apply to nodes runproc made.
+func createSpecDevices(rootfs string, devices []oci.LinuxDevice) error {
+	for _, d := range devices {
+		path, err := resolveInRoot(rootfs, d.Path)
+		if err != nil {
+			return fmt.Errorf("create %s: %w", d.Path, err)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return fmt.Errorf("create %s: %w", d.Path, err)
+		}
+		mode := uint32(0o666)
+		if d.FileMode != nil {
+			mode = uint32(d.FileMode.Perm())
+		}
+		rdev := mkdev(uint32(d.Major), uint32(d.Minor))
+		switch d.Type {
+		case "b":
+			mode |= syscall.S_IFBLK
+		case "p":
+			mode, rdev = mode|syscall.S_IFIFO, 0
+		default:
+			mode |= syscall.S_IFCHR
+		}
+		made, err := createNode(path, mode, rdev, d.Path)
+		if err == nil && made && (d.UID != nil || d.GID != nil) {
+			uid, gid := -1, -1
+			if d.UID != nil {
+				uid = int(*d.UID)
+			}
+			if d.GID != nil {
+				gid = int(*d.GID)
+			}
+			err = os.Lchown(path, uid, gid)
+		}
+		if err != nil {
+			return fmt.Errorf("create %s: %w", d.Path, err)
+		}
+	}
+	return nil
+}
+
+// deviceRules completes the device rules of r for the container's cgroup as runc does:
+// the spec's rules, then the default devices, /dev/pts, and mknod of any device (using
+// one still takes a rule), then the linux.devices of the spec. The default devices are
+// only kept out by rules of linux.resources, which runproc applies whole. Without rules
+// nothing is restricted and r is returned as it is.
+func deviceRules(r *oci.LinuxResources, devices []oci.LinuxDevice) *oci.LinuxResources {
+	if r == nil || len(r.Devices) == 0 {
+		return r
+	}
+	num := func(n int64) *int64 { return &n }
+	rules := append([]oci.LinuxDeviceCgroup{}, r.Devices...)
+	rules = append(rules,
+		oci.LinuxDeviceCgroup{Allow: true, Type: "c", Access: "m"},
+		oci.LinuxDeviceCgroup{Allow: true, Type: "b", Access: "m"},
+	)
+	for _, d := range defaultDevices {
+		rules = append(rules, oci.LinuxDeviceCgroup{Allow: true, Type: "c", Major: num(int64(d.major)), Minor: num(int64(d.minor)), Access: "rwm"})
+	}
+	// The ptys of the private devpts instance, and its multiplexer
+	rules = append(rules,
+		oci.LinuxDeviceCgroup{Allow: true, Type: "c", Major: num(136), Access: "rwm"},
+		oci.LinuxDeviceCgroup{Allow: true, Type: "c", Major: num(5), Minor: num(2), Access: "rwm"},
+	)
+	for _, d := range devices {
+		typ := d.Type
+		switch typ {
+		case "p":
+			continue
+		case "u":
+			typ = "c"
+		}
+		rules = append(rules, oci.LinuxDeviceCgroup{Allow: true, Type: typ, Major: num(d.Major), Minor: num(d.Minor), Access: "rwm"})
+	}
+	out := *r
+	out.Devices = rules
+	return &out
+}
+
+// mkdev encodes a device number the way the kernel's new_encode_dev does.
+func mkdev(major, minor uint32) uint64 {
+	return uint64(minor&0xff) | uint64(major&0xfff)<<8 | uint64(minor&^0xff)<<12 | uint64(major&^0xfff)<<32
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/ktsakalozos/runproc/internal/cgroups"
+	"github.com/ktsakalozos/runproc/internal/oci"
+	"github.com/ktsakalozos/runproc/internal/state"
+)
+
+// execInitCommand is the internal command that sets up and execs the process of `exec`
+// inside the container; see cmdExecInit.
+const execInitCommand = "exec-init"
+
+var errExecWithoutProcess = errors.New("exec requires --process <file> or a command")
+
+// execOptions carries the per-invocation knobs of cmdExec.
+type execOptions struct {
+	// process is the path of a process.json (--process) that replaces the container's
+	// process; without it args replace process.args
+	process string
+	args    []string
+	// detach returns once the process runs, leaving it to our parent, as a subreaper,
+	// to wait for
+	detach        bool
+	pidFile       string
+	consoleSocket string
+	// preserved are passed on to the process as fds 3 and up (--preserve-fds)
+	preserved []*os.File
+}
+
+// cmdExec implements `exec`, runc's contract for running another process in a running
+// container: the process is the container's own with opts.args as its args, or the one
+// opts.process describes (what containerd passes). It joins the init's namespaces and
+// cgroup, gets the container's seccomp filter and its own user, capabilities, rlimits
+// and LSM labels, and inherits our stdio unless it asks for a terminal. Without
+// opts.detach we wait for it, relaying signals, and return its exit code (128+signal
+// when a signal killed it).
+func cmdExec(stateDir, id string, opts execOptions) (code int, err error) {
+	defer func() { recordOperation(stateDir, "exec", err) }()
+	st, err := state.Load(stateDir, id)
+	if err != nil {
+		return 0, err
+	}
+	// Before start the init has not entered the rootfs yet, after it exited nothing is left
+	if st.Pid <= 0 || st.Status != state.Running || !pidRunning(st.Pid) {
+		return 0, state.NotRunning(id)
+	}
+	// Right after start the init may still be setting the container up (hostname, mounts,
+	// its own exec), which the process must find done
+	for initStarting(st.Pid) && pidRunning(st.Pid) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !pidRunning(st.Pid) {
+		return 0, state.NotRunning(id)
+	}
+	spec, err := oci.LoadSpec(st.Bundle)
+	if err != nil {
+		return 0, err
+	}
+	var p oci.Process
+	switch {
+	case opts.process != "":
+		if len(opts.args) > 0 {
+			return 0, errors.New("exec takes --process or a command, not both")
+		}
+		pp, err := oci.LoadProcess(opts.process)
+		if err != nil {
+			return 0, err
+		}
+		p = *pp
+	case len(opts.args) > 0:
+		p = *spec.Process
+		p.Args = opts.args
+		p.Terminal, p.ConsoleSize = false, nil
+	default:
+		return 0, errExecWithoutProcess
+	}
+	if err := validateTerminal(&p, opts.detach, opts.consoleSocket); err != nil {
+		return 0, err
+	}
+	profile, err := appArmorProfile(&p)
+	if err != nil {
+		return 0, err
+	}
+	label, err := selinuxLabel(&p)
+	if err != nil {
+		return 0, err
+	}
+	if s := p.Scheduler; s != nil {
+		if _, err := schedulerAttr(s); err != nil {
+			return 0, err
+		}
+	}
+	if iop := p.IOPriority; iop != nil {
+		if _, err := ioPriorityValue(iop); err != nil {
+			return 0, err
+		}
+	}
+	if a := p.ExecCPUAffinity; a != nil {
+		if err := validateExecAffinity(a); err != nil {
+			return 0, err
+		}
+	}
+	cfg := initConfig{Process: &p, AppArmorProfile: profile, SELinuxLabel: label, Pinned: st.Cpus}
+	if spec.Linux != nil {
+		if cfg.Seccomp, err = compileSeccomp(spec.Linux.Seccomp); err != nil {
+			return 0, err
+		}
+		cfg.Personality = spec.Linux.Personality
+	}
+	loc, err := localize(spec, st.Bundle)
+	if err != nil {
+		return 0, err
+	}
+	cfg.DefaultEnv = loc.env
+	if isolated(spec) && joinsNamespace(spec, oci.MountNamespace) {
+		// The namespace's root is not the container's: the init chrooted into it
+		if cfg.Chroot = spec.Root.Path; !filepath.IsAbs(cfg.Chroot) {
+			cfg.Chroot = filepath.Join(st.Bundle, cfg.Chroot)
+		}
+	}
+	join, err := initNamespaces(st.Pid)
+	if err != nil {
+		return 0, err
+	}
+	// Unlike a hook, the process also goes into the container's user namespace
+	userns := fmt.Sprintf("/proc/%d/ns/user", st.Pid)
+	if theirs, err := os.Readlink(userns); err != nil {
+		return 0, err
+	} else if ours, err := os.Readlink("/proc/self/ns/user"); err != nil {
+		return 0, err
+	} else if theirs != ours {
+		join = append(join, oci.LinuxNamespace{Type: oci.UserNamespace, Path: userns})
+	}
+	// The init's cgroup, unless runproc left the init in its caller's, which is ours too
+	var cg *cgroups.Cgroup
+	if st.Cgroup != "" {
+		if cg, err = cgroups.ForPid(st.Pid); err != nil {
+			return 0, fmt.Errorf("cgroup of %s: %w", id, err)
+		}
+	}
+
+	goR, goW, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer goR.Close()
+	defer goW.Close()
+	self, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	// exec-init gets the fds init does (see handoff.go)
+	initArgs := []string{execInitCommand}
+	if len(opts.preserved) > 0 {
+		initArgs = append(initArgs, "--preserve-fds", strconv.Itoa(len(opts.preserved)))
+		defer keepNonblock(opts.preserved)()
+	}
+	cmd := exec.Command("/proc/self/exe", initArgs...)
+	cmd.Args[0] = self
+	cmd.Env = os.Environ()
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	// Its own session, like the init's, which a terminal needs
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	var extraFiles []*os.File
+	// With a terminal and no console socket we keep the master ourselves, as a foreground
+	// run does, and this is our end of the socket pair it comes over
+	var console *os.File
+	if p.Terminal {
+		var conn *os.File
+		if opts.detach {
+			if conn, err = dialConsole(opts.consoleSocket); err != nil {
+				return 0, err
+			}
+		} else {
+			fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+			if err != nil {
+				return 0, err
+			}
+			console = os.NewFile(uintptr(fds[0]), "console-socket")
+			defer console.Close()
+			conn = os.NewFile(uintptr(fds[1]), "console-socket")
+		}
+		extraFiles = append(extraFiles, conn)
+		cfg.Console = handoffGoFd + len(opts.preserved) + len(extraFiles)
+	}
+	cfgFile, err := sealedConfig(cfg)
+	if err == nil {
+		cmd.ExtraFiles = append(append(opts.preserved[:len(opts.preserved):len(opts.preserved)], cfgFile, goR), extraFiles...)
+		err = startInNamespaces(cmd, join, nil)
+		cfgFile.Close()
+	}
+	// Only exec-init may hold the console socket, so a receive fails rather than hangs if
+	// it dies
+	closeFiles(extraFiles)
+	if err != nil {
+		return 0, fmt.Errorf("start exec: %w", err)
+	}
+	goR.Close()
+	pid := cmd.Process.Pid
+	// Until the go-ahead, exec-init exits by itself when we fail
+	if cg != nil {
+		if err := cg.Join(pid); err != nil {
+			return 0, err
+		}
+	}
+	if opts.pidFile != "" {
+		if err := state.ReplaceFile(opts.pidFile, []byte(strconv.Itoa(pid)), 0o644); err != nil {
+			return 0, fmt.Errorf("write pid-file: %w", err)
+		}
+	}
+	if _, err := io.WriteString(goW, handoffGo); err != nil {
+		return 0, fmt.Errorf("signal exec: %w", err)
+	}
+	// exec-init reads the go-ahead up to EOF
+	goW.Close()
+	if opts.detach {
+		return 0, cmd.Process.Release()
+	}
+	if console != nil {
+		master, err := receiveConsole(console)
+		if err != nil {
+			_ = syscall.Kill(pid, syscall.SIGKILL)
+			_, _ = waitChild(pid)
+			return 0, err
+		}
+		defer runTerminal(master)()
+	}
+	stop := forwardSignals(pid)
+	defer stop()
+	return waitChild(pid)
+}
+
+// waitChild waits for the exec'd process pid, our child, and returns its exit code, or
+// 128+signal if a signal killed it, as waitProcess does for the init.
+func waitChild(pid int) (int, error) {
+	var ws syscall.WaitStatus
+	for {
+		_, err := syscall.Wait4(pid, &ws, 0, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		break
+	}
+	if ws.Signaled() {
+		return 128 + int(ws.Signal()), nil
+	}
+	return ws.ExitStatus(), nil
+}
+
+// cmdExecInit runs in the process exec starts in the container's namespaces. Like init,
+// it reads its initConfig from fd 3 and waits for exec to finish on fd 4, both after the
+// preserved fds if there are any; then it sets up the process and execs it.
+func cmdExecInit(preserved int) error {
+	cfg, err := readSealedConfig(handoffConfigFd + preserved)
+	syscall.Close(handoffConfigFd + preserved)
+	if err != nil {
+		return err
+	}
+	if cfg.Console != 0 {
+		syscall.CloseOnExec(cfg.Console)
+	}
+	goPipe := os.NewFile(uintptr(handoffGoFd+preserved), "go-pipe")
+	err = awaitGo(goPipe)
+	goPipe.Close()
+	if err != nil {
+		return err
+	}
+	if cfg.Process == nil {
+		return errors.New("exec-init: no process in config")
+	}
+	p := *cfg.Process
+	if p.ExecCPUAffinity != nil && p.ExecCPUAffinity.Initial != "" {
+		if err := setInitialAffinity(p.ExecCPUAffinity); err != nil {
+			return err
+		}
+	}
+	if cfg.Chroot != "" {
+		if err := syscall.Chroot(cfg.Chroot); err != nil {
+			return fmt.Errorf("chroot: %w", err)
+		}
+	}
+	if cfg.Console != 0 {
+		// In the container's root: its /dev/ptmx is its devpts instance's
+		if _, err := openTerminal(nil, cfg.Console, p.ConsoleSize, p.User.UID); err != nil {
+			return err
+		}
+	}
+	if err := os.Chdir(p.Cwd); err != nil {
+		return fmt.Errorf("chdir: %w", err)
+	}
+	setProcessEnv(p.Env, cfg.DefaultEnv)
+	path, err := lookPath(p.Args[0], os.Getenv("PATH"))
+	if err != nil {
+		return err
+	}
+	if err := setProcessAttrs(&p, cfg.Personality, cfg.Pinned); err != nil {
+		return err
+	}
+	return confineAndExec(&p, cfg.AppArmorProfile, cfg.SELinuxLabel, cfg.Seccomp, path, p.Args)
+}
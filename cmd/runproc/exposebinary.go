@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/ktsakalozos/runproc/internal/oci"
+)
+
+// exposedBinaryPath is where runproc.expose_binary puts the runproc binary.
+const exposedBinaryPath = "/usr/local/bin/runproc"
+
+var errExposeBinaryNeedsChroot = fmt.Errorf("%s requires a chrooted container (runproc running as root, not in host mode)", oci.ExposeBinaryAnnotation)
+
+// parseExposeBinary reports whether the spec asks for the runproc binary in the container.
+func parseExposeBinary(annotations map[string]string) (bool, error) {
+	v, ok := annotations[oci.ExposeBinaryAnnotation]
+	if !ok {
+		return false, nil
+	}
+	expose, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%s: %q is not a boolean", oci.ExposeBinaryAnnotation, v)
+	}
+	return expose, nil
+}
+
+// exposeBinaryMount is the read-only bind of this runproc binary that
+// runproc.expose_binary asks for, or nil. It gives in-container tooling the node's exact
+// runproc (`runproc version`, `runproc features`). Container state stays out of reach
+// unless the spec also mounts the state dir: that mount is the explicit permission.
+func exposeBinaryMount(spec *oci.Spec) (*oci.Mount, error) {
+	expose, err := parseExposeBinary(spec.Annotations)
+	if err != nil || !expose {
+		return nil, err
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	return &oci.Mount{Destination: exposedBinaryPath, Type: "bind", Source: self, Options: []string{"bind", "ro", "nosuid", "nodev"}}, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Fault injection for exercising failure paths, enabled only through RUNPROC_FAULTS:
+//
+//	RUNPROC_FAULTS=<point>[:<action>][,<point>[:<action>]...]
+//
+// Points are create, handoff, start, chroot and exec; actions are fail (the default) and
+// delay=<duration>. The variable is captured at process start because init replaces
+// its environment with the container's before exec. It is inherited by init and the
+// run --detach monitor, so a single setting covers a whole run.
+const faultsEnv = "RUNPROC_FAULTS"
+
+var faultSpec = os.Getenv(faultsEnv)
+
+// errInjectedFault is what a fail action returns, wrapped with the point.
+var errInjectedFault = errors.New("injected fault")
+
+// faultPoints are the places injectFault is called from.
+var faultPoints = map[string]bool{"create": true, "handoff": true, "start": true, "chroot": true, "exec": true}
+
+// injectFault applies the fault configured for point, if any: it returns an error for
+// fail and sleeps for delay. Malformed settings are reported as errors so a typo does
+// not silently turn a failure test into a passing one.
+func injectFault(point string) error {
+	if faultSpec == "" {
+		return nil
+	}
+	for _, entry := range strings.Split(faultSpec, ",") {
+		name, action, _ := strings.Cut(strings.TrimSpace(entry), ":")
+		if !faultPoints[name] {
+			return fmt.Errorf("%s: unknown fault point %q", faultsEnv, name)
+		}
+		if name != point {
+			continue
+		}
+		switch {
+		case action == "" || action == "fail":
+			return fmt.Errorf("%w at %s", errInjectedFault, point)
+		case strings.HasPrefix(action, "delay="):
+			d, err := time.ParseDuration(strings.TrimPrefix(action, "delay="))
+			if err != nil {
+				return fmt.Errorf("%s: %s: %w", faultsEnv, point, err)
+			}
+			time.Sleep(d)
+		default:
+			return fmt.Errorf("%s: unknown fault action %q", faultsEnv, action)
+		}
+	}
+	return nil
+}
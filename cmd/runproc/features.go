@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/ktsakalozos/runproc/pkg/runproc"
+)
+
+// features mirrors the OCI runtime features document (features.md in runtime-spec).
+type features struct {
+	OCIVersionMin                      string            `json:"ociVersionMin"`
+	OCIVersionMax                      string            `json:"ociVersionMax"`
+	Hooks                              []string          `json:"hooks"`
+	MountOptions                       []string          `json:"mountOptions"`
+	Linux                              *linuxFeatures    `json:"linux"`
+	Annotations                        map[string]string `json:"annotations"`
+	PotentiallyUnsafeConfigAnnotations []string          `json:"potentiallyUnsafeConfigAnnotations"`
+}
+
+type linuxFeatures struct {
+	Namespaces   []string       `json:"namespaces"`
+	Capabilities []string       `json:"capabilities"`
+	Cgroup       cgroupFeatures `json:"cgroup"`
+	Seccomp      enabledFeature `json:"seccomp"`
+	Apparmor     enabledFeature `json:"apparmor"`
+	Selinux      enabledFeature `json:"selinux"`
+	IntelRdt     enabledFeature `json:"intelRdt"`
+	// MountExtensions reports idmapped mounts as mountExtensions.idmap
+	MountExtensions *mountExtensions `json:"mountExtensions,omitempty"`
+}
+
+type mountExtensions struct {
+	IDMap enabledFeature `json:"idmap"`
+}
+
+type cgroupFeatures struct {
+	V1          bool `json:"v1"`
+	V2          bool `json:"v2"`
+	Systemd     bool `json:"systemd"`
+	SystemdUser bool `json:"systemdUser"`
+	Rdma        bool `json:"rdma"`
+}
+
+type enabledFeature struct {
+	Enabled bool `json:"enabled"`
+}
+
+// cmdFeatures prints runproc.Features as an OCI features document. Of the Linux sections
+// only the namespaces runproc creates, the capabilities it can set, the cgroup hierarchies
+// and drivers, seccomp, AppArmor, SELinux, Intel RDT and idmapped mounts are reported;
+// the rest is unsupported.
+func cmdFeatures(w io.Writer) error {
+	rf := runproc.Features()
+	f := features{
+		OCIVersionMin: rf.OCIVersionMin,
+		OCIVersionMax: rf.OCIVersionMax,
+		Hooks:         rf.Hooks,
+		MountOptions:  rf.MountOptions,
+		Linux: &linuxFeatures{
+			Namespaces:      rf.Namespaces,
+			Capabilities:    rf.Capabilities,
+			Cgroup:          cgroupFeatures{V1: rf.Cgroup.V1, V2: rf.Cgroup.V2, Systemd: rf.Cgroup.Systemd},
+			Seccomp:         enabledFeature{Enabled: rf.Seccomp},
+			Apparmor:        enabledFeature{Enabled: rf.AppArmor},
+			Selinux:         enabledFeature{Enabled: rf.SELinux},
+			IntelRdt:        enabledFeature{Enabled: rf.IntelRdt},
+			MountExtensions: &mountExtensions{IDMap: enabledFeature{Enabled: rf.IDMappedMounts}},
+		},
+		Annotations: map[string]string{
+			"runproc.checkpoint.enabled": strconv.FormatBool(rf.Checkpoint),
+			"runproc.wasm.enabled":       strconv.FormatBool(rf.Wasm.Enabled),
+			"runproc.annotations":        strings.Join(rf.Annotations, ","),
+		},
+		// containerd only passes pod annotations through to config.json when the runtime
+		// declares them here, which is how runproc.* annotations reach us from Kubernetes.
+		PotentiallyUnsafeConfigAnnotations: []string{"runproc."},
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(f)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// memfd_create(2) and file sealing constants the syscall package lacks.
+const (
+	mfdCloexec      = 0x1
+	mfdAllowSealing = 0x2
+	fAddSeals       = 1033
+	fGetSeals       = 1034
+	fSealSeal       = 0x1
+	fSealShrink     = 0x2
+	fSealGrow       = 0x4
+	fSealWrite      = 0x8
+
+	handoffSeals = fSealSeal | fSealShrink | fSealGrow | fSealWrite
+)
+
+// The init process gets its initConfig as a sealed memfd on fd 3. The payload is complete
+// and immutable before the init is even forked, so the init never sees a partial config
+// and its size is not bounded by a pipe buffer. fd 4 is the go-ahead pipe: create writes
+// handoffGo to it once the container's state is recorded, and closes it without writing
+// when create fails, so the init does not outlive an aborted create. Fds preserved for the
+// workload (--preserve-fds) come first, at 3 and up, and move both up by their number.
+// This is for robustness, not speed.
+const (
+	handoffConfigFd = 3
+	handoffGoFd     = 4
+	handoffGo       = "go"
+)
+
+// sealedConfig writes cfg to a new memfd and seals it against any further change. The
+// file is close-on-exec; ExtraFiles hands it to the init.
+func sealedConfig(cfg initConfig) (*os.File, error) {
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("encode init config: %w", err)
+	}
+	name, err := syscall.BytePtrFromString("runproc-init")
+	if err != nil {
+		return nil, err
+	}
+	fd, _, e := syscall.Syscall(sysMemfdCreate, uintptr(unsafe.Pointer(name)), mfdCloexec|mfdAllowSealing, 0)
+	if e != 0 {
+		return nil, fmt.Errorf("memfd_create: %w", e)
+	}
+	f := os.NewFile(fd, "init-config")
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("write init config: %w", err)
+	}
+	if _, _, e := syscall.Syscall(syscall.SYS_FCNTL, fd, fAddSeals, handoffSeals); e != 0 {
+		f.Close()
+		return nil, fmt.Errorf("seal init config: %w", e)
+	}
+	return f, nil
+}
+
+// readSealedConfig decodes the initConfig from the memfd on fd, mapped read-only rather
+// than read through a buffer. A file without all the seals is refused: anything else
+// could still be changed by whoever holds it.
+func readSealedConfig(fd int) (initConfig, error) {
+	var cfg initConfig
+	seals, _, e := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), fGetSeals, 0)
+	if e != 0 {
+		return cfg, fmt.Errorf("init config: %w", e)
+	}
+	if seals&handoffSeals != handoffSeals {
+		return cfg, errors.New("init config is not sealed")
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return cfg, fmt.Errorf("init config: %w", err)
+	}
+	if st.Size == 0 {
+		return cfg, errors.New("init config is empty")
+	}
+	b, err := syscall.Mmap(fd, 0, int(st.Size), syscall.PROT_READ, syscall.MAP_PRIVATE)
+	if err != nil {
+		return cfg, fmt.Errorf("map init config: %w", err)
+	}
+	defer syscall.Munmap(b)
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, fmt.Errorf("init decode process: %w", err)
+	}
+	return cfg, nil
+}
+
+// awaitGo blocks until create has recorded the container, failing if it gave up instead.
+func awaitGo(r io.Reader) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("init wait for create: %w", err)
+	}
+	if string(b) != handoffGo {
+		return errors.New("init: create was aborted")
+	}
+	return nil
+}
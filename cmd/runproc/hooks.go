@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ktsakalozos/runproc/internal/cgroups"
+	"github.com/ktsakalozos/runproc/internal/config"
+	"github.com/ktsakalozos/runproc/internal/oci"
+	"github.com/ktsakalozos/runproc/internal/state"
+)
+
+// hookState is the container state a hook reads on stdin, as the runtime-spec defines it.
+type hookState struct {
+	OCIVersion  string            `json:"ociVersion"`
+	ID          string            `json:"id"`
+	Status      state.Status      `json:"status"`
+	Pid         int               `json:"pid,omitempty"`
+	Bundle      string            `json:"bundle"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// newHookState is st as hooks see it at a stage where the container is in status.
+func newHookState(st *state.ContainerState, status state.Status) hookState {
+	return hookState{OCIVersion: oci.Version, ID: st.ID, Status: status, Pid: st.Pid, Bundle: st.Bundle, Annotations: st.Annotations}
+}
+
+// hookWaitDelay bounds how long a hook's output is read after it exited: a child it left
+// behind (a daemonizing plugin) may hold it open for good.
+const hookWaitDelay = time.Second
+
+// hookCgroupRoot holds the cgroup of each hook runproc runs, apart from the containers'
+// under /runproc so no container id can collide with it.
+const hookCgroupRoot = "/runproc-hooks"
+
+// hookLimits are the node's ceilings for hooks ([hooks] in the node config).
+type hookLimits struct {
+	// timeout caps each hook's own timeout; 0 leaves it as the spec has it
+	timeout time.Duration
+	// resources are applied to the cgroup of each hook; nil runs hooks without one, as a
+	// process group to kill instead
+	resources *oci.LinuxResources
+}
+
+// nodeHookLimits reads the hook ceilings of the node config; a config that fails to
+// load gives the default ones, not none. Hooks only get cgroups of their own where runproc
+// manages cgroups: as root on a node with a cgroup hierarchy.
+func nodeHookLimits() hookLimits {
+	c, err := config.Load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: hook limits: %v; using the defaults\n", err)
+		c = config.Default()
+	}
+	l := hookLimits{timeout: time.Duration(c.Hooks.Timeout) * time.Second}
+	if os.Geteuid() == 0 && cgroups.Manageable() {
+		l.resources = &oci.LinuxResources{}
+		if c.Hooks.MemoryMax > 0 {
+			l.resources.Memory = &oci.LinuxMemory{Limit: &c.Hooks.MemoryMax}
+		}
+		if c.Hooks.CPUMillicores > 0 {
+			period := uint64(100000)
+			quota := c.Hooks.CPUMillicores * int64(period) / 1000
+			l.resources.CPU = &oci.LinuxCPU{Quota: &quota, Period: &period}
+		}
+	}
+	return l
+}
+
+// runHooks runs the hooks of stage in order, in the namespaces to join (none: runproc's
+// own), under limits, and stops at the first one that fails.
+func runHooks(stage string, hooks []oci.Hook, s hookState, join []oci.LinuxNamespace, limits hookLimits) error {
+	if len(hooks) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	for i, h := range hooks {
+		cgPath := ""
+		if limits.resources != nil {
+			cgPath = fmt.Sprintf("%s/%s.%s.%d", hookCgroupRoot, s.ID, stage, i)
+		}
+		if err := runHook(h, b, join, limits, cgPath); err != nil {
+			return fmt.Errorf("%s hook %d (%s): %w", stage, i, h.Path, err)
+		}
+	}
+	return nil
+}
+
+// runHook runs one hook with the state on stdin and exactly the hook's env, killing it when
+// its timeout or the node's ceiling elapses. The hook runs in the cgroup at cgPath, made
+// for it and removed after it, or without one ("") in a process group of its own; either
+// way, a timeout kills whatever it started too, and so does its end: nothing a hook forks
+// outlives it. A failure carries what the hook printed.
+func runHook(h oci.Hook, stateJSON []byte, join []oci.LinuxNamespace, limits hookLimits, cgPath string) error {
+	var timeout time.Duration
+	if h.Timeout != nil {
+		timeout = time.Duration(*h.Timeout) * time.Second
+	}
+	if limits.timeout > 0 && (timeout == 0 || timeout > limits.timeout) {
+		timeout = limits.timeout
+	}
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, h.Path)
+	if len(h.Args) > 0 {
+		cmd.Args = h.Args
+	}
+	// Never runproc's own environment
+	cmd.Env = append([]string{}, h.Env...)
+	cmd.Stdin = bytes.NewReader(stateJSON)
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	cmd.WaitDelay = hookWaitDelay
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	var cg *cgroups.Cgroup
+	if cgPath != "" {
+		// Left behind by a runproc that died while running the hook
+		_ = cgroups.Remove(cgPath)
+		var err error
+		if cg, err = cgroups.Create(cgPath, limits.resources); err != nil {
+			return fmt.Errorf("hook cgroup: %w", err)
+		}
+		defer func() {
+			if err := cgroups.Remove(cgPath); err != nil {
+				fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+			}
+		}()
+		if cg.Dir() != "" {
+			fd, err := syscall.Open(cg.Dir(), syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+			if err != nil {
+				return fmt.Errorf("open hook cgroup: %w", err)
+			}
+			defer syscall.Close(fd)
+			cmd.SysProcAttr.UseCgroupFD, cmd.SysProcAttr.CgroupFD = true, fd
+		}
+	}
+	cmd.Cancel = func() error {
+		err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		if cgPath != "" {
+			// Also what left the process group
+			err = cgroups.Remove(cgPath)
+		}
+		return err
+	}
+	// v1 has no cloning into a cgroup: the hook is forked by a thread moved into it
+	var v1 *cgroups.Cgroup
+	if cg != nil && cg.Dir() == "" {
+		v1 = cg
+	}
+	err := startInNamespaces(cmd, join, v1)
+	if err == nil {
+		err = cmd.Wait()
+	}
+	if cgPath == "" && cmd.Process != nil {
+		// What the hook left in its process group; a daemon that left the group is
+		// out of reach without a cgroup
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("timed out after %s, killed", timeout)
+	}
+	if errors.Is(err, exec.ErrWaitDelay) {
+		err = nil
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(out.String()); msg != "" {
+			return fmt.Errorf("%w: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// runCreateHooks runs the hooks of create once the init exists, in its namespaces and
+// waiting for the go-ahead: prestart and createRuntime in runproc's namespaces, then
+// createContainer in the container's. The rootfs and mounts are only set up at start,
+// so these hooks see the bundle's root.path, not the container's root.
+func runCreateHooks(spec *oci.Spec, st *state.ContainerState, limits hookLimits) error {
+	if spec.Hooks == nil {
+		return nil
+	}
+	s := newHookState(st, state.Creating)
+	if err := runHooks(oci.HookPrestart, spec.Hooks.Prestart, s, nil, limits); err != nil {
+		return err
+	}
+	if err := runHooks(oci.HookCreateRuntime, spec.Hooks.CreateRuntime, s, nil, limits); err != nil {
+		return err
+	}
+	if len(spec.Hooks.CreateContainer) == 0 {
+		return nil
+	}
+	join, err := initNamespaces(st.Pid)
+	if err != nil {
+		return fmt.Errorf("createContainer hooks: %w", err)
+	}
+	return runHooks(oci.HookCreateContainer, spec.Hooks.CreateContainer, s, join, limits)
+}
+
+// nsFiles are the namespaces of /proc/<pid>/ns runproc can join, mount last like
+// joinedNamespaces: the other paths are resolved in the mount namespace runproc starts in.
+var nsFiles = []struct {
+	name string
+	typ  oci.LinuxNamespaceType
+}{
+	{"ipc", oci.IPCNamespace}, {"uts", oci.UTSNamespace}, {"net", oci.NetworkNamespace},
+	{"pid", oci.PIDNamespace}, {"cgroup", oci.CgroupNamespace}, {"mnt", oci.MountNamespace},
+}
+
+// initNamespaces returns the namespaces the init of pid is in and runproc is not, created
+// or joined, to run hooks and exec'd processes in the container's namespaces.
+func initNamespaces(pid int) ([]oci.LinuxNamespace, error) {
+	var out []oci.LinuxNamespace
+	for _, ns := range nsFiles {
+		path := fmt.Sprintf("/proc/%d/ns/%s", pid, ns.name)
+		theirs, err := os.Readlink(path)
+		if errors.Is(err, os.ErrNotExist) && ns.typ == oci.CgroupNamespace {
+			// Kernels before 4.6 have no cgroup namespaces
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		ours, err := os.Readlink("/proc/self/ns/" + ns.name)
+		if err != nil {
+			return nil, err
+		}
+		if theirs != ours {
+			out = append(out, oci.LinuxNamespace{Type: ns.typ, Path: path})
+		}
+	}
+	return out, nil
+}
+
+// stageHooks returns the hooks of the stages run after create, as recorded at create, and
+// the node's limits for them; nil hooks when there are none. For a container created
+// before hooks were recorded, they are read from its bundle.
+func stageHooks(st *state.ContainerState) (*oci.Hooks, hookLimits, error) {
+	if st.Hooks != nil {
+		return st.Hooks, nodeHookLimits(), nil
+	}
+	spec, err := oci.LoadSpec(st.Bundle)
+	if err != nil || spec.Hooks == nil {
+		return nil, hookLimits{}, err
+	}
+	return spec.Hooks, nodeHookLimits(), nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/ktsakalozos/runproc/internal/config"
+	"github.com/ktsakalozos/runproc/internal/oci"
+)
+
+// hostExecDir is the private staging dir, under the container state dir, holding the
+// image binary a strict host-mode container executes.
+const hostExecDir = "exec"
+
+// defaultImagePath is searched for a bare argv[0] when the process env has no PATH.
+const defaultImagePath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// stagedExec is the binary init executes instead of resolving argv[0] on the node.
+type stagedExec struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+}
+
+// strictHostExec reports whether the node config requires host-mode containers to run
+// their entrypoint from the image (host.strict_exec).
+func strictHostExec() (bool, error) {
+	cfg, err := config.Load()
+	if err != nil {
+		return false, err
+	}
+	return cfg.Host.StrictExec, nil
+}
+
+// stageHostBinary copies argv[0], resolved inside the image rootfs rather than on the
+// node, into the container's private staging dir and returns it with its digest. init
+// checks the digest again right before exec.
+func stageHostBinary(stateDir, id, bundle string, spec *oci.Spec) (*stagedExec, error) {
+	if spec.Root == nil || spec.Root.Path == "" {
+		return nil, errors.New("host.strict_exec: the bundle has no root.path to take the binary from")
+	}
+	rootfs := spec.Root.Path
+	if !filepath.IsAbs(rootfs) {
+		rootfs = filepath.Join(bundle, rootfs)
+	}
+	p := spec.Process
+	src, err := findInImage(rootfs, p.Args[0], p.Cwd, processPath(p.Env))
+	if err != nil {
+		return nil, err
+	}
+	// Start from an empty dir: nothing but runproc may have put files there
+	dir := filepath.Join(stateDir, id, hostExecDir)
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	in, err := os.OpenFile(src, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	dst := filepath.Join(dir, filepath.Base(src))
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o700)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, h), in); err != nil {
+		out.Close()
+		return nil, fmt.Errorf("stage %s: %w", p.Args[0], err)
+	}
+	if err := out.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(dst, 0o500); err != nil {
+		return nil, err
+	}
+	return &stagedExec{Path: dst, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// verify fails unless the staged binary still has the digest it was staged with.
+func (s *stagedExec) verify() error {
+	f, err := os.OpenFile(s.Path, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != s.SHA256 {
+		return fmt.Errorf("staged binary %s was modified after create", s.Path)
+	}
+	return nil
+}
+
+// processPath returns PATH from the process env.
+func processPath(env []string) string {
+	for _, e := range env {
+		if v, ok := strings.CutPrefix(e, "PATH="); ok {
+			return v
+		}
+	}
+	return defaultImagePath
+}
+
+// findInImage resolves name like execvp would inside the rootfs, returning the node path
+// of a regular executable file.
+func findInImage(rootfs, name, cwd, pathEnv string) (string, error) {
+	var candidates []string
+	switch {
+	case filepath.IsAbs(name):
+		candidates = []string{name}
+	case strings.Contains(name, "/"):
+		candidates = []string{filepath.Join("/", cwd, name)}
+	default:
+		for _, dir := range filepath.SplitList(pathEnv) {
+			if filepath.IsAbs(dir) {
+				candidates = append(candidates, filepath.Join(dir, name))
+			}
+		}
+	}
+	for _, c := range candidates {
+		p, err := resolveInRoot(rootfs, c)
+		if err != nil {
+			continue
+		}
+		if fi, err := os.Lstat(p); err == nil && fi.Mode().IsRegular() && fi.Mode()&0o111 != 0 {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("executable %q not found in the image rootfs (host.strict_exec)", name)
+}
+
+// resolveInRoot resolves path as if rootfs were /: symlinks, absolute or relative, and
+// ".." never lead out of it. Components from the first missing one on are appended as
+// they are, so the result can be created.
+func resolveInRoot(rootfs, path string) (string, error) {
+	resolved := "/"
+	rest := strings.Split(filepath.Clean("/"+path), "/")
+	for hops := 0; len(rest) > 0; {
+		part := rest[0]
+		rest = rest[1:]
+		if part == "" || part == "." {
+			continue
+		}
+		next := filepath.Join(resolved, part)
+		fi, err := os.Lstat(filepath.Join(rootfs, next))
+		if errors.Is(err, os.ErrNotExist) {
+			// Nothing below can be a symlink; ".." still stops at the root
+			for _, part := range rest {
+				next = filepath.Join(next, part)
+			}
+			return filepath.Join(rootfs, next), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		if hops++; hops > 40 {
+			return "", fmt.Errorf("%s: too many levels of symbolic links", path)
+		}
+		link, err := os.Readlink(filepath.Join(rootfs, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(link) {
+			resolved = "/"
+		}
+		rest = append(strings.Split(link, "/"), rest...)
+	}
+	return filepath.Join(rootfs, resolved), nil
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	"github.com/ktsakalozos/runproc/internal/oci"
+)
+
+// The mount API flags of idmapped mounts (linux/mount.h, linux/fcntl.h).
+const (
+	atFdcwd             = -100
+	openTreeClone       = 1
+	atEmptyPath         = 0x1000
+	atRecursive         = 0x8000
+	moveMountFEmptyPath = 0x4
+	mountAttrIdmap      = 0x100000
+)
+
+// usernsHolderCommand is the internal command of the process that keeps a user
+// namespace for idmapping alive (see newUserns).
+const usernsHolderCommand = "userns-holder"
+
+// rootfsIdmap is the key of the rootfs's idmapped clone in initConfig.IDMaps and the
+// detached mounts, which are otherwise keyed by mount index.
+const rootfsIdmap = -1
+
+var errRootfsIdmapNeedsChroot = fmt.Errorf("%s requires a chrooted container (runproc running as root, not in host mode)", oci.RootfsIdmapAnnotation)
+
+// parseRootfsIdmap reports whether the spec asks for an idmapped rootfs, which takes the
+// mappings of a user namespace the container creates: a joined one keeps its own.
+func parseRootfsIdmap(spec *oci.Spec) (bool, error) {
+	v, ok := spec.Annotations[oci.RootfsIdmapAnnotation]
+	if !ok {
+		return false, nil
+	}
+	idmap, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%s: %q is not a boolean", oci.RootfsIdmapAnnotation, v)
+	}
+	if idmap && !createsNamespace(spec, oci.UserNamespace) {
+		return false, fmt.Errorf("%s needs a new user namespace in linux.namespaces, whose mappings it applies", oci.RootfsIdmapAnnotation)
+	}
+	return idmap, nil
+}
+
+// idmapRootfs clones rootfs with its submounts and idmaps the clone (not the submounts)
+// with the mappings of the container's user namespace, for init to attach in place of a
+// plain bind. Create does it for the same reason as idmapMounts.
+func idmapRootfs(rootfs string, linux *oci.Linux) (*os.File, error) {
+	userns, err := newUserns(linux.UIDMappings, linux.GIDMappings)
+	if err != nil {
+		return nil, fmt.Errorf("rootfs: %w", err)
+	}
+	defer userns.Close()
+	tree, err := cloneIdmapped(rootfs, true, int(userns.Fd()), false)
+	if err != nil {
+		return nil, fmt.Errorf("rootfs: %w", err)
+	}
+	return tree, nil
+}
+
+// idmapped reports whether mount m is idmapped: it has uidMappings and gidMappings, or
+// the idmap or ridmap option.
+func idmapped(m oci.Mount) bool {
+	return len(m.UIDMappings) > 0 || len(m.GIDMappings) > 0 || slices.Contains(m.Options, oci.IDMapOption) || slices.Contains(m.Options, oci.RIDMapOption)
+}
+
+// checkIdmap checks an idmapped mount at create: runproc idmaps bind mounts, and only by
+// the mount's own mappings, never those of the container's user namespace.
+func checkIdmap(m oci.Mount) error {
+	flags, _ := parseMountOptions(m.Options)
+	switch {
+	case m.Type != "bind" && flags&syscall.MS_BIND == 0:
+		return fmt.Errorf("mount %s: only bind mounts can be idmapped", m.Destination)
+	case len(m.UIDMappings) == 0 || len(m.GIDMappings) == 0:
+		return fmt.Errorf("mount %s: an idmapped mount needs both uidMappings and gidMappings of its own", m.Destination)
+	}
+	for _, ids := range [][]oci.LinuxIDMapping{m.UIDMappings, m.GIDMappings} {
+		for _, id := range ids {
+			if id.Size == 0 {
+				return fmt.Errorf("mount %s: an id mapping of size 0 maps nothing", m.Destination)
+			}
+		}
+	}
+	return nil
+}
+
+// idmapMounts clones the source of each idmapped mount of mounts, a relative one in bundle,
+// and idmaps the clone with a user namespace of the mount's mappings, one per distinct
+// set. Create does it, as the node's root: the kernel only lets that idmap a mount of the
+// node's filesystems, which the container's own root in a user namespace is not. It
+// returns the fd init finds each clone at, by the mount's index, for it to attach, and
+// the files to hand it after fd 4; the caller closes them once init has them.
+func idmapMounts(bundle string, mounts []oci.Mount) (map[int]int, []*os.File, error) {
+	var idmaps map[int]int
+	var files []*os.File
+	namespaces := map[string]*os.File{}
+	defer func() {
+		for _, f := range namespaces {
+			f.Close()
+		}
+	}()
+	for i, m := range mounts {
+		if !idmapped(m) {
+			continue
+		}
+		if err := checkIdmap(m); err != nil {
+			closeFiles(files)
+			return nil, nil, err
+		}
+		key := fmt.Sprint(m.UIDMappings, m.GIDMappings)
+		userns, ok := namespaces[key]
+		if !ok {
+			var err error
+			if userns, err = newUserns(m.UIDMappings, m.GIDMappings); err != nil {
+				closeFiles(files)
+				return nil, nil, fmt.Errorf("mount %s: %w", m.Destination, err)
+			}
+			namespaces[key] = userns
+		}
+		source := m.Source
+		if !filepath.IsAbs(source) {
+			source = filepath.Join(bundle, source)
+		}
+		flags, _ := parseMountOptions(m.Options)
+		tree, err := cloneIdmapped(source, flags&syscall.MS_REC != 0, int(userns.Fd()), slices.Contains(m.Options, oci.RIDMapOption))
+		if err != nil {
+			closeFiles(files)
+			return nil, nil, fmt.Errorf("mount %s: %w", m.Destination, err)
+		}
+		files = append(files, tree)
+		if idmaps == nil {
+			idmaps = map[int]int{}
+		}
+		idmaps[i] = handoffGoFd + len(files)
+	}
+	return idmaps, files, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// newUserns returns a user namespace with the given mappings. A namespace only exists
+// with a process in it: runproc's userns-holder, which lives until the namespace is open.
+func newUserns(uids, gids []oci.LinuxIDMapping) (*os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	// Through /proc: the holder runs as a mapped id, which may not reach runproc's dir
+	holder := exec.Command("/proc/self/exe", usernsHolderCommand)
+	holder.Stdin = r
+	holder.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER,
+		UidMappings: sysIDMaps(uids),
+		GidMappings: sysIDMaps(gids),
+		Pdeathsig:   syscall.SIGKILL,
+	}
+	if err := holder.Start(); err != nil {
+		w.Close()
+		return nil, fmt.Errorf("create user namespace for idmapping: %w", err)
+	}
+	// The mappings are written before the holder execs; closing its stdin lets it go
+	f, err := os.Open(fmt.Sprintf("/proc/%d/ns/user", holder.Process.Pid))
+	w.Close()
+	_ = holder.Wait()
+	if err != nil {
+		return nil, fmt.Errorf("open user namespace for idmapping: %w", err)
+	}
+	return f, nil
+}
+
+// sysIDMaps converts spec id mappings for SysProcAttr.
+func sysIDMaps(ids []oci.LinuxIDMapping) []syscall.SysProcIDMap {
+	var out []syscall.SysProcIDMap
+	for _, id := range ids {
+		out = append(out, syscall.SysProcIDMap{ContainerID: int(id.ContainerID), HostID: int(id.HostID), Size: int(id.Size)})
+	}
+	return out
+}
+
+// closeDetached keeps the detached mounts (see setupMounts) from the workload.
+func closeDetached(detached map[int]int) {
+	for _, fd := range detached {
+		syscall.Close(fd)
+	}
+}
+
+// mountAttr is struct mount_attr.
+type mountAttr struct {
+	attrSet, attrClr, propagation, usernsFd uint64
+}
+
+// cloneIdmapped returns a detached clone of source, recursive for an rbind, whose ids are
+// mapped by the user namespace userns: a file of source owned by the namespace's id n
+// appears owned by the id n maps to. ridmap maps the submounts of an rbind too.
+func cloneIdmapped(source string, recursive bool, userns int, ridmap bool) (*os.File, error) {
+	src, err := syscall.BytePtrFromString(source)
+	if err != nil {
+		return nil, err
+	}
+	empty, _ := syscall.BytePtrFromString("")
+	// A variable: the constant is negative
+	cwd := atFdcwd
+	cloneFlags := uintptr(openTreeClone | syscall.O_CLOEXEC)
+	if recursive {
+		cloneFlags |= atRecursive
+	}
+	fd, _, e := syscall.Syscall(sysOpenTree, uintptr(cwd), uintptr(unsafe.Pointer(src)), cloneFlags)
+	if e != 0 {
+		return nil, fmt.Errorf("clone %s: %w", source, e)
+	}
+	tree := os.NewFile(fd, source)
+	attr := mountAttr{attrSet: mountAttrIdmap, usernsFd: uint64(userns)}
+	setFlags := uintptr(atEmptyPath)
+	if ridmap {
+		setFlags |= atRecursive
+	}
+	if _, _, e := syscall.Syscall6(sysMountSetattr, fd, uintptr(unsafe.Pointer(empty)), setFlags, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0); e != 0 {
+		tree.Close()
+		err := fmt.Errorf("idmap %s: %w", source, e)
+		if errors.Is(e, syscall.EINVAL) || errors.Is(e, syscall.ENOSYS) {
+			err = fmt.Errorf("%w (the kernel, 5.12 or newer, or the filesystem of the source may not support idmapped mounts)", err)
+		}
+		return nil, err
+	}
+	return tree, nil
+}
+
+// attachDetached attaches the detached mount on fd tree (an idmapped clone, see
+// cloneIdmapped, or the terminal's devpts, see openTerminal) to target in init, like
+// bindMount.
+func attachDetached(tree int, target string, flags uintptr) error {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(tree, &st); err != nil {
+		return err
+	}
+	if err := makeTarget(target, st.Mode&syscall.S_IFMT == syscall.S_IFDIR); err != nil {
+		return err
+	}
+	empty, _ := syscall.BytePtrFromString("")
+	dst, err := syscall.BytePtrFromString(target)
+	if err != nil {
+		return err
+	}
+	cwd := atFdcwd
+	if _, _, e := syscall.Syscall6(sysMoveMount, uintptr(tree), uintptr(unsafe.Pointer(empty)), uintptr(cwd), uintptr(unsafe.Pointer(dst)), moveMountFEmptyPath, 0); e != 0 {
+		return fmt.Errorf("attach %s: %w", target, e)
+	}
+	return remountBind(target, flags)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/ktsakalozos/runproc/internal/cgroups"
+	"github.com/ktsakalozos/runproc/internal/oci"
+	"github.com/ktsakalozos/runproc/internal/state"
+)
+
+// containerInspect is the `inspect` report: the limits in force on a running container,
+// next to what its spec asked for, for debugging a limit that is not honored.
+type containerInspect struct {
+	ID     string `json:"id"`
+	Pid    int    `json:"pid"`
+	Bundle string `json:"bundle"`
+	// Starting is set while the init is still runproc, waiting for a start gate or setting
+	// up: the process limits are not applied yet
+	Starting bool            `json:"starting,omitempty"`
+	Rlimits  []rlimitInspect `json:"rlimits"`
+	// Cpus are the CPUs the init may run on (its affinity)
+	Cpus   string         `json:"cpus"`
+	Cgroup *cgroupInspect `json:"cgroup,omitempty"`
+}
+
+// rlimitInspect is one resource limit of the init. Values use RLIM_INFINITY for no limit,
+// like process.rlimits.
+type rlimitInspect struct {
+	Type      string           `json:"type"`
+	Soft      uint64           `json:"soft"`
+	Hard      uint64           `json:"hard"`
+	Requested *oci.POSIXRlimit `json:"requested,omitempty"`
+}
+
+// linux.resources asked for, which runproc only applies in a cgroup it created.
+// linux.resources asked for, which runproc only applies on cgroup v2 nodes.
+type cgroupInspect struct {
+	Path      string              `json:"path"`
+	Version   int                 `json:"version"`
+	Limits    *cgroups.Limits     `json:"limits"`
+	Requested *oci.LinuxResources `json:"requested,omitempty"`
+}
+
+// cmdInspect prints the effective limits of a running container as JSON. The limits are
+// read from the kernel for the init's pid and cgroup, after any clamping, rather than
+// taken from the spec. A container whose cgroup cannot be located is reported without one.
+func cmdInspect(stateDir, id string, w io.Writer) error {
+	st, err := state.Load(stateDir, id)
+	if err != nil {
+		return err
+	}
+	if st.Status != state.Running || !pidRunning(st.Pid) {
+		return state.NotRunning(id)
+	}
+	// The bundle may be gone by now; the effective values are still worth reporting
+	var spec *oci.Spec
+	if s, err := oci.LoadSpec(st.Bundle); err == nil {
+		spec = s
+	}
+	out := containerInspect{ID: id, Pid: st.Pid, Bundle: st.Bundle, Starting: initStarting(st.Pid)}
+	if out.Rlimits, err = inspectRlimits(st.Pid, spec); err != nil {
+		return fmt.Errorf("read rlimits of %s: %w", id, err)
+	}
+	if out.Cpus, err = procStatusField(st.Pid, "Cpus_allowed_list"); err != nil {
+		return fmt.Errorf("read CPU affinity of %s: %w", id, err)
+	}
+	if cg, err := cgroups.ForPid(st.Pid); err == nil {
+		limits, err := cg.Limits()
+		if err != nil {
+			return fmt.Errorf("read cgroup limits of %s: %w", id, err)
+		}
+		out.Cgroup = &cgroupInspect{Path: cg.Path, Version: 1, Limits: limits}
+		if cg.Unified {
+			out.Cgroup.Version = 2
+		}
+		if spec != nil && spec.Linux != nil {
+			out.Cgroup.Requested = spec.Linux.Resources
+		}
+	}
+	// The init exiting meanwhile leaves a partial report
+	if !pidRunning(st.Pid) {
+		return state.NotRunning(id)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+// inspectRlimits reads every resource limit of pid with prlimit(2), in resource order.
+func inspectRlimits(pid int, spec *oci.Spec) ([]rlimitInspect, error) {
+	requested := map[string]oci.POSIXRlimit{}
+	if spec != nil && spec.Process != nil {
+		for _, rl := range spec.Process.Rlimits {
+			requested[rl.Type] = rl
+		}
+	}
+	var out []rlimitInspect
+	for typ, resource := range rlimitResources {
+		var rl syscall.Rlimit
+		if _, _, e := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), uintptr(resource), 0, uintptr(unsafe.Pointer(&rl)), 0, 0); e != 0 {
+			return nil, fmt.Errorf("%s: %w", typ, e)
+		}
+		r := rlimitInspect{Type: typ, Soft: rl.Cur, Hard: rl.Max}
+		if req, ok := requested[typ]; ok {
+			r.Requested = &req
+		}
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool { return rlimitResources[out[i].Type] < rlimitResources[out[j].Type] })
+	return out, nil
+}
+
+// initStarting reports whether the init of pid is still runproc, not yet the process. A
+// wasm workload's process is runproc too, running wasm-run.
+func initStarting(pid int) bool {
+	self, err := os.Executable()
+	if err != nil {
+		return false
+	}
+	exe, _ := os.Readlink(filepath.Join("/proc", strconv.Itoa(pid), "exe"))
+	if exe != self {
+		return false
+	}
+	cmdline, _ := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cmdline"))
+	args := strings.Split(string(cmdline), "\x00")
+	return len(args) < 2 || args[1] != wasmRunCommand
+}
+
+// procStatusField returns the value of one "Key:\tvalue" line of /proc/<pid>/status.
+func procStatusField(pid int, key string) (string, error) {
+	b, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "status"))
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if k, v, ok := strings.Cut(line, ":"); ok && k == key {
+			return strings.TrimSpace(v), nil
+		}
+	}
+	return "", fmt.Errorf("no %s in /proc/%d/status", key, pid)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/ktsakalozos/runproc/internal/oci"
+	"github.com/ktsakalozos/runproc/internal/resctrl"
+)
+
+// intelRdtGroup makes or checks the resctrl group of linux.intelRdt at create, where
+// /sys is the node's: the CLOS id (the container id when unset) and whether create made
+// the group, which delete then removes. A group that exists already may be shared with
+// other containers and is left alone. It returns "" without linux.intelRdt.
+func intelRdtGroup(spec *oci.Spec, id string) (string, bool, error) {
+	if spec.Linux == nil || spec.Linux.IntelRdt == nil {
+		return "", false, nil
+	}
+	rdt := spec.Linux.IntelRdt
+	if !resctrl.Enabled() {
+		return "", false, fmt.Errorf("linux.intelRdt requested but resctrl is not mounted at %s on this node", resctrl.Root)
+	}
+	if os.Geteuid() != 0 {
+		return "", false, errors.New("linux.intelRdt needs runproc to run as root")
+	}
+	if rdt.EnableCMT && !resctrl.Monitoring("llc_occupancy") {
+		return "", false, errors.New("linux.intelRdt.enableCMT requested but the node does not monitor L3 occupancy")
+	}
+	if rdt.EnableMBM && !resctrl.Monitoring("mbm_total_bytes") {
+		return "", false, errors.New("linux.intelRdt.enableMBM requested but the node does not monitor memory bandwidth")
+	}
+	closID := rdt.ClosID
+	if closID == "" {
+		closID = id
+	}
+	var schemata []string
+	for _, schema := range []string{rdt.L3CacheSchema, rdt.MemBwSchema} {
+		for _, line := range strings.Split(schema, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				schemata = append(schemata, line)
+			}
+		}
+	}
+	created, err := resctrl.Apply(closID, schemata)
+	if err != nil {
+		return "", false, fmt.Errorf("linux.intelRdt: %w", err)
+	}
+	return closID, created, nil
+}
+
+// openIntelRdt opens the tasks file of the container's resctrl group while init still
+// sees the node's /sys, before it enters the rootfs.
+func openIntelRdt(closID string) (*resctrl.Tasks, error) {
+	if closID == "" {
+		return nil, nil
+	}
+	return resctrl.OpenTasks(closID)
+}
+
+// joinIntelRdt moves the thread that execs the workload into its resctrl group, so the
+// workload and all it forks run under the group's schemata. Init's other threads stay in
+// the default group.
+func joinIntelRdt(tasks *resctrl.Tasks) error {
+	if tasks == nil {
+		return nil
+	}
+	defer tasks.Close()
+	// The group is per thread and this one execs; never unlocked
+	runtime.LockOSThread()
+	return tasks.JoinThread()
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+
+	"github.com/ktsakalozos/runproc/internal/oci"
+)
+
+// ioPriorityClasses maps the spec's I/O scheduling classes to their numbers
+// (linux/ioprio.h).
+var ioPriorityClasses = map[oci.IOPriorityClass]uintptr{
+	oci.IOPRIO_CLASS_RT: 1, oci.IOPRIO_CLASS_BE: 2, oci.IOPRIO_CLASS_IDLE: 3,
+}
+
+// ioprio_set(2) constants the syscall package lacks.
+const (
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+)
+
+// ioPriorityValue resolves process.ioPriority to an ioprio value. create calls it too, so
+// a bad class or level fails the create instead of the start.
+func ioPriorityValue(p *oci.LinuxIOPriority) (uintptr, error) {
+	class, ok := ioPriorityClasses[p.Class]
+	if !ok {
+		return 0, fmt.Errorf("process.ioPriority.class %q is not supported", p.Class)
+	}
+	if p.Priority < 0 || p.Priority > 7 {
+		return 0, fmt.Errorf("process.ioPriority.priority %d is outside 0..7", p.Priority)
+	}
+	return class<<ioprioClassShift | uintptr(p.Priority), nil
+}
+
+// setIOPriority applies process.ioPriority with ioprio_set(2). Like the scheduling
+// attributes it is per thread and survives exec, and the real-time class needs
+// CAP_SYS_ADMIN, so it runs on the thread that execs, before setUser.
+func setIOPriority(p *oci.LinuxIOPriority) error {
+	v, err := ioPriorityValue(p)
+	if err != nil {
+		return err
+	}
+	// This thread execs; never unlocked
+	runtime.LockOSThread()
+	if _, _, e := syscall.RawSyscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, 0, v); e != 0 {
+		return fmt.Errorf("set process.ioPriority: %w", e)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/ktsakalozos/runproc/internal/state"
+)
+
+// cmdKillDryRun prints what `kill` with the same arguments would signal, without
+// signalling, locking or counting anything. With all this is what `kill --all` signals
+// (killTargets): the container's cgroup, or without one the process tree it walks, which
+// for host-mode containers can reach well beyond the workload. The list is a snapshot,
+// and processes may come and go before the real kill.
+func cmdKillDryRun(stateDir, id string, sig syscall.Signal, all bool, w io.Writer) error {
+	st, err := state.Load(stateDir, id)
+	if err != nil {
+		return err
+	}
+	if st.Pid <= 0 || st.Status == state.Stopped || !pidRunning(st.Pid) {
+		return state.NotRunning(id)
+	}
+	pids := []int{st.Pid}
+	if all {
+		if pids, err = killTargets(st); err != nil {
+			return err
+		}
+	}
+	var procs []*procStat
+	for _, pid := range pids {
+		if ps, err := readProcStat(pid); err == nil {
+			procs = append(procs, ps)
+		}
+	}
+	fmt.Fprintf(w, "would send signal %d (%v) to %d process(es) of %s\n", int(sig), sig, len(procs), id)
+	if st.Status == state.Created || st.Status == state.Creating {
+		fmt.Fprintf(w, "%s was never started: its workload would never run\n", id)
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PID\tPPID\tSESSION\tSTATE\tCOMMAND")
+	for _, ps := range procs {
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%s\t%s\n", ps.pid, ps.ppid, ps.session, ps.state, procCmdline(ps))
+	}
+	return tw.Flush()
+}
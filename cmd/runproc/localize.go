@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ktsakalozos/runproc/internal/oci"
+)
+
+// Where glibc, musl and most language runtimes look for time zones and compiled locales.
+const (
+	zoneinfoDir = "/usr/share/zoneinfo"
+	localeDir   = "/usr/lib/locale"
+)
+
+// localization is what runproc.tz and runproc.locale give a container: read-only binds of
+// the node's zoneinfo and locale dirs over the image's when it lacks the zone or locale,
+// and TZ and LANG for a process env without them.
+type localization struct {
+	mounts []oci.Mount
+	// env are NAME=value entries init sets unless the process env has NAME
+	env []string
+}
+
+// localize reads the localization annotations of spec, whose bundle is bundle. A zone or
+// locale must be in the image or on the node; an isolated container gets the node's files
+// where its image lacks them, any other container runs on the node's files already.
+func localize(spec *oci.Spec, bundle string) (*localization, error) {
+	tz, hasTZ := spec.Annotations[oci.TZAnnotation]
+	locale, hasLocale := spec.Annotations[oci.LocaleAnnotation]
+	loc := &localization{}
+	if !hasTZ && !hasLocale {
+		return loc, nil
+	}
+	rootfs := ""
+	if isolated(spec) {
+		if rootfs = spec.Root.Path; !filepath.IsAbs(rootfs) {
+			rootfs = filepath.Join(bundle, rootfs)
+		}
+	}
+	// bind adds the node's dir unless the image has what is asked for or the spec mounts
+	// something there itself
+	bind := func(dir string, inImage bool) {
+		if rootfs != "" && !inImage && !hasMount(spec.Mounts, dir) {
+			loc.mounts = append(loc.mounts, oci.Mount{Destination: dir, Type: "bind", Source: dir, Options: []string{"bind", "ro", "nosuid", "nodev", "noexec"}})
+		}
+	}
+	if hasTZ {
+		if tz == "" || filepath.IsAbs(tz) || filepath.Clean(tz) != tz || strings.HasPrefix(tz, "..") {
+			return nil, fmt.Errorf("%s: %q is not a time zone name", oci.TZAnnotation, tz)
+		}
+		inImage := rootfs != "" && hasZone(rootfs, tz)
+		if !inImage && !hasZone("/", tz) {
+			return nil, fmt.Errorf("%s: no time zone %q in the image or on the node (%s)", oci.TZAnnotation, tz, zoneinfoDir)
+		}
+		bind(zoneinfoDir, inImage)
+		loc.env = append(loc.env, "TZ="+tz)
+	}
+	if hasLocale {
+		if locale == "" || strings.ContainsAny(locale, "/\x00") || strings.HasPrefix(locale, ".") {
+			return nil, fmt.Errorf("%s: %q is not a locale name", oci.LocaleAnnotation, locale)
+		}
+		// C and POSIX are built into every libc
+		if locale != "C" && locale != "POSIX" {
+			inImage := rootfs != "" && hasLocaleFiles(rootfs, locale)
+			if !inImage && !hasLocaleFiles("/", locale) {
+				return nil, fmt.Errorf("%s: no locale %q in the image or on the node (%s)", oci.LocaleAnnotation, locale, localeDir)
+			}
+			bind(localeDir, inImage)
+		}
+		loc.env = append(loc.env, "LANG="+locale)
+	}
+	return loc, nil
+}
+
+// hasZone reports whether root has the time zone file of tz.
+func hasZone(root, tz string) bool {
+	p, err := resolveInRoot(root, filepath.Join(zoneinfoDir, tz))
+	if err != nil {
+		return false
+	}
+	fi, err := os.Stat(p)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// hasLocaleFiles reports whether root has locale compiled, as a dir of its own or in the
+// locale archive, under its name or the one glibc normalizes it to ("de_DE.utf8").
+func hasLocaleFiles(root, locale string) bool {
+	names := []string{locale, normalizeLocale(locale)}
+	for _, name := range names {
+		if p, err := resolveInRoot(root, filepath.Join(localeDir, name)); err == nil {
+			if fi, err := os.Stat(p); err == nil && fi.IsDir() {
+				return true
+			}
+		}
+	}
+	p, err := resolveInRoot(root, filepath.Join(localeDir, "locale-archive"))
+	if err != nil {
+		return false
+	}
+	archived, err := archiveLocales(p)
+	if err != nil {
+		return false
+	}
+	for _, name := range names {
+		if archived[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeLocale spells the codeset of locale the way glibc names its files: lower case
+// letters and digits only, with "iso" before one that is all digits ("UTF-8" is "utf8").
+func normalizeLocale(locale string) string {
+	name, modifier, hasModifier := strings.Cut(locale, "@")
+	lang, codeset, ok := strings.Cut(name, ".")
+	if !ok {
+		return locale
+	}
+	var b strings.Builder
+	digits := true
+	for _, r := range strings.ToLower(codeset) {
+		switch {
+		case r >= 'a' && r <= 'z':
+			digits = false
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			b.WriteRune(r)
+		}
+	}
+	codeset = b.String()
+	if digits {
+		codeset = "iso" + codeset
+	}
+	name = lang + "." + codeset
+	if hasModifier {
+		name += "@" + modifier
+	}
+	return name
+}
+
+// glibc's locale-archive (locarchive.h) starts with localeArchiveMagic.
+const (
+	localeArchiveMagic = 0xde020109
+	// maxArchiveNames bounds the name table a damaged archive could claim
+	maxArchiveNames = 1 << 16
+)
+
+// localeArchiveHead is the start of the archive's header, up to the name table.
+type localeArchiveHead struct {
+	Magic, Serial                              uint32
+	NamehashOffset, NamehashUsed, NamehashSize uint32
+}
+
+// localeArchiveName is an entry of the archive's name table.
+type localeArchiveName struct {
+	Hashval, NameOffset, LocrecOffset uint32
+}
+
+// archiveLocales returns the names of the locales in the locale archive at path, reading
+// only its name table: archives of full installs run to hundreds of megabytes.
+func archiveLocales(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var head localeArchiveHead
+	if err := binary.Read(f, binary.LittleEndian, &head); err != nil {
+		return nil, err
+	}
+	if head.Magic != localeArchiveMagic || head.NamehashSize > maxArchiveNames {
+		return nil, fmt.Errorf("%s is not a locale archive", path)
+	}
+	table := make([]localeArchiveName, head.NamehashSize)
+	if err := binary.Read(io.NewSectionReader(f, int64(head.NamehashOffset), int64(len(table))*12), binary.LittleEndian, table); err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	buf := make([]byte, 256)
+	for _, e := range table {
+		if e.NameOffset == 0 {
+			continue
+		}
+		n, err := f.ReadAt(buf, int64(e.NameOffset))
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if end := strings.IndexByte(string(buf[:n]), 0); end > 0 {
+			names[string(buf[:end])] = true
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ktsakalozos/runproc/internal/config"
+	"github.com/ktsakalozos/runproc/internal/oci"
+	"github.com/ktsakalozos/runproc/internal/state"
+)
+
+// consoleLogName is the file under the container state dir that holds captured output
+// of detached containers, one JSON object per line (like Docker's json-file driver).
+const consoleLogName = "console.log"
+
+// stdoutLogName and stderrLogName replace console.log when the runproc.logs.split
+// annotation asks for one file per stream.
+const (
+	stdoutLogName = "stdout.log"
+	stderrLogName = "stderr.log"
+)
+
+// logEntry is a single captured line of container output.
+type logEntry struct {
+	Time   time.Time `json:"time"`
+	Stream string    `json:"stream"`
+	Log    string    `json:"log"`
+}
+
+// logOptions is how a container's output is recorded, from its runproc.logs.* annotations
+// and the node's [logs] defaults.
+type logOptions struct {
+	// split records stdout and stderr in separate files
+	split bool
+	// discard names a stream that is not recorded at all ("" records both)
+	discard string
+	// maxSize rotates a log file before it grows past this many bytes; 0 never rotates
+	maxSize int64
+	// maxFiles is how many rotated files (<name>.1 being the newest) are kept per log
+	maxFiles int
+}
+
+// parseLogOptions reads the runproc.logs.* annotations on top of the node's rotation
+// defaults. cmdCreate calls it so that bad values fail the create instead of the capture.
+func parseLogOptions(annotations map[string]string, node config.Logs) (logOptions, error) {
+	opts := logOptions{maxSize: node.MaxSize, maxFiles: int(node.MaxFiles)}
+	if v, ok := annotations[oci.LogsSplitAnnotation]; ok {
+		split, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("%s: %q is not a boolean", oci.LogsSplitAnnotation, v)
+		}
+		opts.split = split
+	}
+	switch v := annotations[oci.LogsDiscardAnnotation]; v {
+	case "", "stdout", "stderr":
+		opts.discard = v
+	default:
+		return opts, fmt.Errorf("%s: %q is neither stdout nor stderr", oci.LogsDiscardAnnotation, v)
+	}
+	if v, ok := annotations[oci.LogsMaxSizeAnnotation]; ok {
+		n, err := parseSize(v)
+		if err != nil {
+			return opts, fmt.Errorf("%s: %w", oci.LogsMaxSizeAnnotation, err)
+		}
+		opts.maxSize = n
+	}
+	if v, ok := annotations[oci.LogsMaxFilesAnnotation]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return opts, fmt.Errorf("%s: %q is not a file count", oci.LogsMaxFilesAnnotation, v)
+		}
+		opts.maxFiles = n
+	}
+	return opts, nil
+}
+
+// logFile is one JSON-lines log file, rotated by size.
+type logFile struct {
+	mu       sync.Mutex
+	path     string
+	f        *os.File
+	size     int64
+	maxSize  int64
+	maxFiles int
+}
+
+func openLogFile(path string, opts logOptions) (*logFile, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND|syscall.O_NOFOLLOW, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &logFile{path: path, f: f, size: fi.Size(), maxSize: opts.maxSize, maxFiles: opts.maxFiles}, nil
+}
+
+func (l *logFile) write(e logEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(b)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.f.Write(b)
+	l.size += int64(n)
+	return err
+}
+
+// rotate shifts <path>.N up by one, dropping what falls past maxFiles, and starts a new
+// file. Only whole lines are written, so readers never see a line split across files.
+func (l *logFile) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	for i := l.maxFiles; i > 1; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", l.path, i-1), fmt.Sprintf("%s.%d", l.path, i))
+	}
+	var err error
+	if l.maxFiles > 0 {
+		err = os.Rename(l.path, l.path+".1")
+	} else {
+		err = os.Remove(l.path)
+	}
+	if err != nil {
+		return err
+	}
+	if l.f, err = os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND|syscall.O_NOFOLLOW, 0o600); err != nil {
+		return err
+	}
+	l.size = 0
+	return nil
+}
+
+func (l *logFile) Close() error {
+	return l.f.Close()
+}
+
+// logSink records lines of several streams into console.log, or into one file per stream.
+type logSink struct {
+	// streams maps a stream to its file; discarded streams have none
+	streams map[string]*logFile
+	files   []*logFile
+}
+
+// openLogSink opens the log files of the container whose state dir is dir.
+func openLogSink(dir string, opts logOptions) (*logSink, error) {
+	names := map[string]string{"stdout": consoleLogName, "stderr": consoleLogName}
+	if opts.split {
+		names = map[string]string{"stdout": stdoutLogName, "stderr": stderrLogName}
+	}
+	s := &logSink{streams: map[string]*logFile{}}
+	opened := map[string]*logFile{}
+	for _, stream := range []string{"stdout", "stderr"} {
+		if stream == opts.discard {
+			continue
+		}
+		name := names[stream]
+		if opened[name] == nil {
+			f, err := openLogFile(filepath.Join(dir, name), opts)
+			if err != nil {
+				s.Close()
+				return nil, err
+			}
+			opened[name] = f
+			s.files = append(s.files, f)
+		}
+		s.streams[stream] = opened[name]
+	}
+	return s, nil
+}
+
+// openContainerLogSink opens the log sink of a created container, as its annotations ask.
+func openContainerLogSink(stateDir, id string) (*logSink, error) {
+	st, err := state.Load(stateDir, id)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := config.Load()
+	if err != nil {
+		return nil, err
+	}
+	opts, err := parseLogOptions(st.Annotations, cfg.Logs)
+	if err != nil {
+		return nil, err
+	}
+	return openLogSink(filepath.Join(stateDir, id), opts)
+}
+
+func (s *logSink) write(stream, line string) error {
+	f := s.streams[stream]
+	if f == nil {
+		return nil
+	}
+	return f.write(logEntry{Time: time.Now(), Stream: stream, Log: line})
+}
+
+// maxLogLine is the longest entry recorded: output that runs longer without a newline is
+// recorded in entries of at most this many bytes, like Docker's partial lines.
+const maxLogLine = 16 * 1024
+
+// copyStream records every line read from r under stream until EOF. If tee is set it
+// also receives the raw chunks as soon as they are read, so attached clients see partial
+// lines such as prompts. Lines that cannot be recorded (a full disk, a failed rotation)
+// are dropped with a warning, but r is still drained: closing it would kill the workload
+// with SIGPIPE on its next write.
+func (s *logSink) copyStream(r io.Reader, stream string, tee func([]byte)) error {
+	buf := make([]byte, 32*1024)
+	var pending []byte
+	failing := false
+	record := func(line []byte) {
+		err := s.write(stream, string(line))
+		if err != nil && !failing {
+			fmt.Fprintf(os.Stderr, "warning: recording %s: %v; dropping lines until it works again\n", stream, err)
+		}
+		failing = err != nil
+	}
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if tee != nil {
+				tee(buf[:n])
+			}
+			pending = append(pending, buf[:n]...)
+			for {
+				i := bytes.IndexByte(pending, '\n') + 1
+				if i == 0 || i > maxLogLine {
+					if len(pending) <= maxLogLine {
+						break
+					}
+					i = cutLogLine(pending)
+				}
+				record(pending[:i])
+				pending = pending[i:]
+			}
+		}
+		if err != nil {
+			if len(pending) > 0 {
+				record(pending)
+			}
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// cutLogLine is where to split output of more than maxLogLine bytes without a newline:
+// at maxLogLine, or before it when that falls inside a UTF-8 character.
+func cutLogLine(p []byte) int {
+	i := maxLogLine
+	for j := i; j > i-utf8.UTFMax && j > 0; j-- {
+		if utf8.RuneStart(p[j]) {
+			return j
+		}
+	}
+	return i
+}
+
+// capture copies the stdout and stderr pipes into the sink in the background, handing raw
+// chunks to tee as well. The returned function waits for both copies, but at most timeout:
+// background children may keep the pipes open after the container itself exited.
+func (s *logSink) capture(stdout, stderr *os.File, tee func(stream string, p []byte)) func(timeout time.Duration) {
+	var wg sync.WaitGroup
+	for stream, r := range map[string]*os.File{"stdout": stdout, "stderr": stderr} {
+		wg.Add(1)
+		go func(stream string, r *os.File) {
+			defer wg.Done()
+			defer r.Close()
+			_ = s.copyStream(r, stream, func(p []byte) { tee(stream, p) })
+		}(stream, r)
+	}
+	return func(timeout time.Duration) {
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(timeout):
+		}
+	}
+}
+
+func (s *logSink) Close() error {
+	var errs []error
+	for _, f := range s.files {
+		errs = append(errs, f.Close())
+	}
+	return errors.Join(errs...)
+}
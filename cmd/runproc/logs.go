@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/ktsakalozos/runproc/internal/state"
+)
+
+// logsOptions controls `runproc logs`.
+type logsOptions struct {
+	follow bool
+	// tail limits the initial output to the last n lines; negative means all
+	tail       int
+	timestamps bool
+}
+
+// logsPollInterval is how often --follow checks console.log for new lines.
+const logsPollInterval = 200 * time.Millisecond
+
+// cmdLogs prints a container's captured output from console.log (or stdout.log and
+// stderr.log), each after what is left of its rotated files, stdout entries to stdout and
+// stderr entries to stderr. With follow set it keeps printing new lines until the
+// container has exited and the log is drained.
+func cmdLogs(stateDir, id string, opts logsOptions, stdout, stderr io.Writer) error {
+	if _, err := state.Load(stateDir, id); err != nil {
+		return err
+	}
+	var readers []*logReader
+	var backlog []logEntry
+	for _, name := range []string{consoleLogName, stdoutLogName, stderrLogName} {
+		r, err := openLogReader(filepath.Join(stateDir, id, name))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return err
+		}
+		defer r.Close()
+		readers = append(readers, r)
+		rotated, err := readRotatedLogs(r.path, r.f)
+		if err != nil {
+			return err
+		}
+		backlog = append(backlog, rotated...)
+	}
+	if len(readers) == 0 {
+		return fmt.Errorf("container %s has no captured output (only containers started with run capture logs)", id)
+	}
+
+	emit := func(e logEntry) error {
+		w := stdout
+		if e.Stream == "stderr" {
+			w = stderr
+		}
+		if opts.timestamps {
+			if _, err := io.WriteString(w, e.Time.UTC().Format(time.RFC3339Nano)+" "); err != nil {
+				return err
+			}
+		}
+		_, err := io.WriteString(w, e.Log)
+		return err
+	}
+
+	for _, r := range readers {
+		for {
+			e, ok, err := r.next()
+			if err != nil {
+				return err
+			}
+			if !ok {
+				break
+			}
+			backlog = append(backlog, e)
+		}
+	}
+	// Interleave split stream files by capture time
+	sort.SliceStable(backlog, func(i, j int) bool { return backlog[i].Time.Before(backlog[j].Time) })
+	if opts.tail >= 0 && len(backlog) > opts.tail {
+		backlog = backlog[len(backlog)-opts.tail:]
+	}
+	for _, e := range backlog {
+		if err := emit(e); err != nil {
+			return err
+		}
+	}
+	if !opts.follow {
+		return nil
+	}
+	// drain prints what the files have now and reports whether there was anything
+	drain := func() (bool, error) {
+		got := false
+		for _, r := range readers {
+			for {
+				e, ok, err := r.next()
+				if err != nil {
+					return got, err
+				}
+				if !ok {
+					break
+				}
+				got = true
+				if err := emit(e); err != nil {
+					return got, err
+				}
+			}
+		}
+		return got, nil
+	}
+	for {
+		got, err := drain()
+		if err != nil {
+			return err
+		}
+		if got {
+			continue
+		}
+		if !containerWriting(stateDir, id) {
+			// One more pass picks up lines written just before the exit was recorded
+			_, err := drain()
+			return err
+		}
+		time.Sleep(logsPollInterval)
+	}
+}
+
+// readRotatedLogs returns the entries of the files the sink rotated the log at path into,
+// <path>.N down to <path>.1, so oldest first. The live file is opened first: a file the
+// sink rotated since then is that same file, which is read as live and skipped here.
+func readRotatedLogs(path string, live *os.File) ([]logEntry, error) {
+	cur, err := live.Stat()
+	if err != nil {
+		return nil, err
+	}
+	n := 0
+	for {
+		if _, err := os.Lstat(fmt.Sprintf("%s.%d", path, n+1)); err != nil {
+			break
+		}
+		n++
+	}
+	var out []logEntry
+	for i := n; i >= 1; i-- {
+		entries, err := readLogFile(fmt.Sprintf("%s.%d", path, i), cur)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, entries...)
+	}
+	return out, nil
+}
+
+// readLogFile returns the entries of the complete log file at path, none when it is gone
+// (rotated past maxFiles meanwhile) or is skip.
+func readLogFile(path string, skip os.FileInfo) ([]logEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err != nil || os.SameFile(fi, skip) {
+		return nil, err
+	}
+	var out []logEntry
+	br := bufio.NewReader(f)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			var e logEntry
+			if err := json.Unmarshal(line, &e); err != nil {
+				return nil, fmt.Errorf("corrupt %s line: %w", filepath.Base(path), err)
+			}
+			out = append(out, e)
+		}
+		if errors.Is(err, io.EOF) {
+			return out, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// logReader reads complete entries from a log file the sink may still be appending to,
+// following it across rotation.
+type logReader struct {
+	path string
+	f    *os.File
+	// buf holds data read past the last complete line
+	buf []byte
+}
+
+func openLogReader(path string) (*logReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &logReader{path: path, f: f}, nil
+}
+
+// next returns the next complete entry, or false when there is none yet.
+func (r *logReader) next() (logEntry, bool, error) {
+	chunk := make([]byte, 32*1024)
+	for {
+		if i := bytes.IndexByte(r.buf, '\n'); i >= 0 {
+			line := r.buf[:i+1]
+			r.buf = r.buf[i+1:]
+			var e logEntry
+			if err := json.Unmarshal(line, &e); err != nil {
+				return e, false, fmt.Errorf("corrupt %s line: %w", filepath.Base(r.path), err)
+			}
+			return e, true, nil
+		}
+		n, err := r.f.Read(chunk)
+		r.buf = append(r.buf, chunk[:n]...)
+		if n > 0 {
+			continue
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return logEntry{}, false, err
+		}
+		if rotated, err := r.reopenIfRotated(); err != nil || !rotated {
+			return logEntry{}, false, err
+		}
+	}
+}
+
+// reopenIfRotated switches to a new file at path once the sink rotated the open one away.
+// The old file is complete by then, and was read to its end.
+func (r *logReader) reopenIfRotated() (bool, error) {
+	fi, err := os.Stat(r.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	cur, err := r.f.Stat()
+	if err != nil {
+		return false, err
+	}
+	if os.SameFile(fi, cur) {
+		return false, nil
+	}
+	// Lines appended between our last read and the rotation
+	rest, err := io.ReadAll(r.f)
+	if err != nil {
+		return false, err
+	}
+	f, err := os.Open(r.path)
+	if err != nil {
+		return false, err
+	}
+	r.f.Close()
+	r.f = f
+	r.buf = append(r.buf, rest...)
+	return true, nil
+}
+
+func (r *logReader) Close() error {
+	return r.f.Close()
+}
+
+// containerWriting reports whether anything may still append to the container's log: the
+// container runs, or its monitor/foreground run is still draining output.
+func containerWriting(stateDir, id string) bool {
+	st, err := state.Load(stateDir, id)
+	if err != nil {
+		return false
+	}
+	if st.Status != state.Stopped && pidRunning(st.Pid) {
+		return true
+	}
+	return st.MonitorPid > 0 && pidRunning(st.MonitorPid)
+}
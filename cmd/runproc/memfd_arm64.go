@@ -0,0 +1,4 @@
+package main
+
+// sysMemfdCreate is memfd_create(2); the frozen syscall package predates it.
+const sysMemfdCreate = 279
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/ktsakalozos/runproc/internal/state"
+)
+
+// cmdMigrateState rewrites the state of each container of ids, or of every container of
+// the state root when there are none, in the state format of this runproc (see
+// state.Migrate), and prints what it did. A container of a newer format is left alone and
+// reported, as are the other failures, after all were tried.
+func cmdMigrateState(stateDir string, ids []string, w io.Writer) error {
+	all := len(ids) == 0
+	if all {
+		entries, err := os.ReadDir(stateDir)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		for _, e := range entries {
+			if e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+				ids = append(ids, e.Name())
+			}
+		}
+		sort.Strings(ids)
+	}
+	var errs []error
+	for _, id := range ids {
+		from, err := migrateState(stateDir, id)
+		switch {
+		case errors.Is(err, state.ErrNotExist) && all:
+			// Still being created, or deleted meanwhile
+		case err != nil:
+			errs = append(errs, err)
+		case from == state.FormatVersion:
+			fmt.Fprintf(w, "%s: state format %d, up to date\n", id, from)
+		default:
+			fmt.Fprintf(w, "%s: migrated from state format %d to %d\n", id, from, state.FormatVersion)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// migrateState migrates the state of id under its lock, so no other operation sees it
+// halfway, and returns the format it was in.
+func migrateState(stateDir, id string) (int, error) {
+	lock, err := acquireLock(stateDir, id, "migrate-state")
+	if err != nil {
+		return 0, err
+	}
+	defer lock.Release()
+	return state.Migrate(stateDir, id)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/ktsakalozos/runproc/internal/oci"
+	"github.com/ktsakalozos/runproc/internal/state"
+)
+
+// monitorReady is what the monitor writes to the report pipe once the container started.
+const monitorReady = "ok"
+
+// cmdRunDetached implements `run --detach`: it starts a monitor in a new session and
+// returns as soon as the monitor reports that the container was created and started.
+func cmdRunDetached(stateDir, id, bundle, pidFile, consoleSocket, resultFile string, preserved []*os.File, noPivot, systemdCgroup bool) error {
+	// Check the terminal rules before there is a monitor to fail in
+	spec, err := oci.LoadSpec(bundle)
+	if err != nil {
+		return err
+	}
+	if err := validateTerminal(spec.Process, true, consoleSocket); err != nil {
+		return err
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer pr.Close()
+	self, err := os.Executable()
+	if err != nil {
+		pw.Close()
+		return err
+	}
+	args := []string{"monitor"}
+	if noPivot {
+		args = append(args, "--no-pivot")
+	}
+	if systemdCgroup {
+		args = append(args, "--systemd-cgroup")
+	}
+	if resultFile != "" {
+		args = append(args, "--result-file", resultFile)
+	}
+	if consoleSocket != "" {
+		args = append(args, "--console-socket", consoleSocket)
+	}
+	if len(preserved) > 0 {
+		args = append(args, "--preserve-fds", strconv.Itoa(len(preserved)))
+		defer keepNonblock(preserved)()
+	}
+	args = append(args, stateDir, id, bundle)
+	if pidFile != "" {
+		args = append(args, pidFile)
+	}
+	cmd := exec.Command(self, args...)
+	cmd.Env = os.Environ()
+	// The monitor reports on fd 3, followed by the preserved fds, and must outlive us, so
+	// detach it from our session
+	cmd.ExtraFiles = append([]*os.File{pw}, preserved...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		pw.Close()
+		return fmt.Errorf("start monitor: %w", err)
+	}
+	pw.Close()
+	msg, err := io.ReadAll(pr)
+	if err != nil {
+		return fmt.Errorf("read monitor report: %w", err)
+	}
+	if string(msg) != monitorReady {
+		_ = cmd.Wait()
+		if len(msg) == 0 {
+			return errors.New("monitor exited before the container started")
+		}
+		return errors.New(string(msg))
+	}
+	return cmd.Process.Release()
+}
+
+// cmdMonitor is the internal command behind `run --detach`. Performing create itself makes
+// it the parent of the init process, so it can wait for the container and record its exit
+// status after the invoking `run` has returned. Container output is captured to console.log
+// and, together with stdin, served to `attach` clients on attach.sock; with process.terminal
+// the pty master goes to consoleSocket instead and there is nothing to capture. With
+// resultFile set it writes the runResult there once the container has exited.
+func cmdMonitor(stateDir, id, bundle, pidFile, consoleSocket, resultFile string, preserved []*os.File, noPivot, systemdCgroup bool) error {
+	// fd 3 is the report pipe to the waiting `run`; keep it away from the init process
+	report := os.NewFile(uintptr(3), "report-pipe")
+	syscall.CloseOnExec(3)
+	fail := func(err error) error {
+		_, _ = io.WriteString(report, err.Error())
+		report.Close()
+		return err
+	}
+
+	// stdin stays open for attach clients (unless runproc.stdin_once); the write end lives
+	// in the attach hub
+	inR, inW, err := os.Pipe()
+	if err != nil {
+		return fail(err)
+	}
+	defer inW.Close()
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		return fail(err)
+	}
+	errR, errW, err := os.Pipe()
+	if err != nil {
+		return fail(err)
+	}
+	err = cmdCreate(stateDir, id, bundle, createOptions{
+		pidFile:       pidFile,
+		consoleSocket: consoleSocket,
+		preserved:     preserved,
+		stdin:         inR,
+		stdout:        outW,
+		stderr:        errW,
+		monitorPid:    os.Getpid(),
+		noPivot:       noPivot,
+		systemdCgroup: systemdCgroup,
+	})
+	inR.Close()
+	outW.Close()
+	errW.Close()
+	if err != nil {
+		return fail(err)
+	}
+
+	st, err := state.Load(stateDir, id)
+	if err != nil {
+		_ = cmdDelete(stateDir, id, true)
+		return fail(err)
+	}
+	stdinOnce, _ := parseStdinOnce(st.Annotations)
+	hub, err := listenAttach(filepath.Join(stateDir, id), inW, stdinOnce)
+	if err != nil {
+		_ = cmdDelete(stateDir, id, true)
+		return fail(err)
+	}
+	defer hub.Close()
+
+	sink, err := openContainerLogSink(stateDir, id)
+	if err != nil {
+		return fail(err)
+	}
+	defer sink.Close()
+	drain := sink.capture(outR, errR, func(stream string, p []byte) {
+		if stream == "stderr" {
+			hub.broadcast(attachStderr, p)
+		} else {
+			hub.broadcast(attachStdout, p)
+		}
+	})
+
+	if err := cmdStart(stateDir, id); err != nil {
+		_ = cmdDelete(stateDir, id, true)
+		return fail(err)
+	}
+	_, _ = io.WriteString(report, monitorReady)
+	report.Close()
+
+	res, err := waitProcess(stateDir, id)
+	drain(time.Second)
+	if err != nil {
+		return err
+	}
+	return resultOptions{file: resultFile}.report(res)
+}
@@ -0,0 +1,12 @@
+package main
+
+// The mount API syscalls (open_tree(2), move_mount(2), fsopen(2), fsconfig(2), fsmount(2),
+// mount_setattr(2)); the frozen syscall package predates them.
+const (
+	sysOpenTree     = 428
+	sysMoveMount    = 429
+	sysFsopen       = 430
+	sysFsconfig     = 431
+	sysFsmount      = 432
+	sysMountSetattr = 442
+)
@@ -0,0 +1,564 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/ktsakalozos/runproc/internal/cgroups"
+	"github.com/ktsakalozos/runproc/internal/oci"
+	"github.com/ktsakalozos/runproc/internal/state"
+)
+
+// isolated reports whether the container gets a chroot (and mounts): it has a rootfs, is
+// not in host mode or a wasm workload (sandboxed by its runtime), and runproc runs as root
+// or rootless, in a user namespace.
+func isolated(spec *oci.Spec) bool {
+	return !isHostMode(spec, spec.Process) && !isWasm(spec) && spec.Root != nil && spec.Root.Path != "" && (os.Geteuid() == 0 || rootless(spec))
+}
+
+// sandboxesDir holds per-sandbox resources shared by the containers of a pod.
+const sandboxesDir = ".sandboxes"
+
+// defaultMounts give every container a private devpts instance (for PTYs) and a
+// /dev/shm, with Docker's defaults, unless the spec mounts something there itself.
+var defaultMounts = []oci.Mount{
+	{Destination: "/dev/pts", Type: "devpts", Source: "devpts", Options: []string{"nosuid", "noexec", "newinstance", "ptmxmode=0666", "mode=0620", "gid=5"}},
+	{Destination: "/dev/shm", Type: "tmpfs", Source: "shm", Options: []string{"nosuid", "noexec", "nodev", "mode=1777", "size=65536k"}},
+}
+
+// prepareMounts returns the mounts init has to perform: the spec's, then any missing
+// default mount (none in a joined mount namespace, which runproc must not change). A
+// tmpfs /dev/shm of a container that belongs to a CRI sandbox is replaced by a bind of
+// the sandbox-owned tmpfs, so all containers of the pod share one /dev/shm like under
+// runc (where containerd provides it).
+func prepareMounts(stateRoot string, spec *oci.Spec) ([]oci.Mount, error) {
+	mounts := spec.Mounts
+	if !joinsNamespace(spec, oci.MountNamespace) {
+		for _, d := range defaultMounts {
+			if !hasMount(spec.Mounts, d.Destination) {
+				mounts = append(mounts[:len(mounts):len(mounts)], d)
+			}
+		}
+	}
+	var out []oci.Mount
+	for _, m := range mounts {
+		if m.Type == "devpts" && !slices.Contains(m.Options, "newinstance") {
+			// Never share the node's ptys
+			m.Options = append(m.Options[:len(m.Options):len(m.Options)], "newinstance")
+		}
+		sandbox := spec.Annotations[oci.SandboxIDAnnotation]
+		if filepath.Clean(m.Destination) == "/dev/shm" && m.Type == "tmpfs" && sandbox != "" {
+			src, err := ensureSandboxShm(stateRoot, sandbox, m.Options)
+			if err != nil {
+				return nil, err
+			}
+			m = oci.Mount{Destination: m.Destination, Type: "bind", Source: src, Options: []string{"rbind", "rw"}}
+		}
+		out = append(out, m)
+	}
+	return out, nil
+}
+
+// hasMount reports whether mounts has one at dest.
+func hasMount(mounts []oci.Mount, dest string) bool {
+	for _, m := range mounts {
+		if filepath.Clean(m.Destination) == dest {
+			return true
+		}
+	}
+	return false
+}
+
+// sandboxShmDir is the mount point of the tmpfs shared by a sandbox's containers.
+func sandboxShmDir(stateRoot, sandbox string) string {
+	return filepath.Join(stateRoot, sandboxesDir, sandbox, "shm")
+}
+
+// ensureSandboxShm mounts the sandbox's shared tmpfs (with the first container's options,
+// e.g. its size) unless it is mounted already.
+func ensureSandboxShm(stateRoot, sandbox string, options []string) (string, error) {
+	if sandbox == "" || strings.ContainsAny(sandbox, "/\x00") || sandbox == "." || sandbox == ".." {
+		return "", fmt.Errorf("invalid sandbox id %q", sandbox)
+	}
+	dir := sandboxShmDir(stateRoot, sandbox)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	if mounted, err := isMountPoint(dir); err != nil || mounted {
+		return dir, err
+	}
+	flags, data := parseMountOptions(options)
+	if err := syscall.Mount("shm", dir, "tmpfs", flags, data); err != nil {
+		return "", fmt.Errorf("mount sandbox shm: %w", err)
+	}
+	return dir, nil
+}
+
+// releaseSandboxShm unmounts a sandbox's shared tmpfs once no container of the sandbox is
+// left in the state dir.
+func releaseSandboxShm(stateRoot, sandbox string) error {
+	if sandbox == "" {
+		return nil
+	}
+	dir := sandboxShmDir(stateRoot, sandbox)
+	if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	entries, err := os.ReadDir(stateRoot)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		if st, err := state.Load(stateRoot, e.Name()); err == nil && st.Annotations[oci.SandboxIDAnnotation] == sandbox {
+			return nil
+		}
+	}
+	if mounted, _ := isMountPoint(dir); mounted {
+		if err := syscall.Unmount(dir, syscall.MNT_DETACH); err != nil {
+			return fmt.Errorf("unmount sandbox shm: %w", err)
+		}
+	}
+	return os.RemoveAll(filepath.Dir(dir))
+}
+
+// isMountPoint compares the device of dir with its parent's.
+func isMountPoint(dir string) (bool, error) {
+	var a, b syscall.Stat_t
+	if err := syscall.Stat(dir, &a); err != nil {
+		return false, err
+	}
+	if err := syscall.Stat(filepath.Dir(dir), &b); err != nil {
+		return false, err
+	}
+	return a.Dev != b.Dev, nil
+}
+
+// parseMountOptions splits options into MS_* flags and the filesystem data string.
+// Propagation options are left to parsePropagation, idmap and ridmap to setupMounts.
+func parseMountOptions(options []string) (uintptr, string) {
+	var flags uintptr
+	var data []string
+	for _, o := range options {
+		if _, ok := oci.PropagationOptions[o]; ok || o == oci.IDMapOption || o == oci.RIDMapOption {
+			continue
+		}
+		if f, ok := oci.MountFlagOptions[o]; ok {
+			if f.Clear {
+				flags &^= f.Flag
+			} else {
+				flags |= f.Flag
+			}
+			continue
+		}
+		data = append(data, o)
+	}
+	return flags, strings.Join(data, ",")
+}
+
+// parsePropagation returns the propagation changes options ask for, in order.
+func parsePropagation(options []string) []uintptr {
+	var out []uintptr
+	for _, o := range options {
+		if f, ok := oci.PropagationOptions[o]; ok {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// setPropagation changes the propagation type of the mount at target.
+func setPropagation(target string, flags uintptr) error {
+	return syscall.Mount("", target, "", flags, "")
+}
+
+// rootfsMountName is the mount point, under the container state dir, that init binds the
+// rootfs to in its mount namespace. A fresh mount point works for every rootfs, including
+// "/", whose overmount path lookups would never reach.
+const rootfsMountName = "rootfs"
+
+// enterRootfs makes rootfs the container's root. It runs in init, in the container's
+// mount namespace: the rootfs is bound to mnt (or create's idmapped clone of it attached
+// there, see idmapRootfs), gets the spec mounts, and is swapped in
+// with pivot_root, after which the node's root is unmounted so nothing in the container
+// can reach it. With noPivot (for rootfs on filesystems pivot_root refuses, such as
+// ramfs) it is moved over / and chrooted into instead, like runc --no-pivot.
+//
+// The namespace's mounts are made rprivate, or get linux.rootfsPropagation (rslave for
+// mounts from the node to show up in the container, rshared for mounts to go both ways),
+// which is set again on the container's / once it is entered, like runc does.
+func enterRootfs(rootfs, mnt string, mounts []oci.Mount, detached map[int]int, linux *oci.Linux, noPivot bool) error {
+	rootPropagation := uintptr(syscall.MS_PRIVATE | syscall.MS_REC)
+	if linux != nil && linux.RootfsPropagation != "" {
+		rootPropagation = oci.PropagationOptions[linux.RootfsPropagation]
+	}
+	if err := setPropagation("/", rootPropagation); err != nil {
+		return fmt.Errorf("set rootfs propagation: %w", err)
+	}
+	if err := os.MkdirAll(mnt, 0o700); err != nil {
+		return err
+	}
+	// Whatever the propagation, the rootfs mount itself must not appear on the node (and
+	// pivot_root refuses a shared parent)
+	if err := privateParentMount(filepath.Dir(mnt)); err != nil {
+		return err
+	}
+	if tree, ok := detached[rootfsIdmap]; ok {
+		if err := attachDetached(tree, mnt, syscall.MS_BIND|syscall.MS_REC); err != nil {
+			return fmt.Errorf("idmapped rootfs: %w", err)
+		}
+	} else if err := syscall.Mount(rootfs, mnt, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind rootfs: %w", err)
+	}
+	if rootPropagation&syscall.MS_SHARED != 0 {
+		// The bind joined the rootfs' peer group; the container's own mounts (proc, ...)
+		// must not show up in the image on the node. rshared bind mounts, peers of their
+		// source, still propagate both ways.
+		if err := setPropagation(mnt, syscall.MS_SLAVE); err != nil {
+			return fmt.Errorf("set rootfs propagation: %w", err)
+		}
+	}
+	if err := setupMounts(mnt, mounts, detached); err != nil {
+		return err
+	}
+	if err := createDevices(mnt); err != nil {
+		return err
+	}
+	if linux != nil {
+		if err := createSpecDevices(mnt, linux.Devices); err != nil {
+			return err
+		}
+		if err := readonlyPaths(mnt, linux.ReadonlyPaths); err != nil {
+			return err
+		}
+		if err := maskPaths(mnt, linux.MaskedPaths); err != nil {
+			return err
+		}
+	}
+	if err := os.Chdir(mnt); err != nil {
+		return err
+	}
+	if noPivot {
+		if err := syscall.Mount(mnt, "/", "", syscall.MS_MOVE, ""); err != nil {
+			return fmt.Errorf("move rootfs: %w", err)
+		}
+		if err := syscall.Chroot("."); err != nil {
+			return fmt.Errorf("chroot: %w", err)
+		}
+		if err := os.Chdir("/"); err != nil {
+			return err
+		}
+	} else if err := pivotRoot(); err != nil {
+		return err
+	}
+	if linux != nil && linux.RootfsPropagation != "" {
+		// Applied to the new / only: before the pivot it would have reached the node's
+		if err := setPropagation("/", rootPropagation); err != nil {
+			return fmt.Errorf("set rootfs propagation: %w", err)
+		}
+	}
+	return nil
+}
+
+// privateParentMount makes the mount dir lives on private (without recursing), so the
+// mounts made under dir do not propagate to its peers on the node.
+func privateParentMount(dir string) error {
+	b, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return err
+	}
+	parent := "/"
+	for _, line := range strings.Split(string(b), "\n") {
+		// id parent major:minor root mount-point options ...
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+		point := unescapeMountPoint(fields[4])
+		if (dir == point || strings.HasPrefix(dir, strings.TrimSuffix(point, "/")+"/")) && len(point) > len(parent) {
+			parent = point
+		}
+	}
+	if err := setPropagation(parent, syscall.MS_PRIVATE); err != nil {
+		return fmt.Errorf("make %s private: %w", parent, err)
+	}
+	return nil
+}
+
+// unescapeMountPoint undoes the octal escapes (\040 for a space, ...) of mountinfo.
+func unescapeMountPoint(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// pivotRoot makes the working directory the root with pivot_root(".", "."), which stacks
+// the old root on top of the new one, and then detaches the old root.
+func pivotRoot() error {
+	oldRoot, err := syscall.Open("/", syscall.O_DIRECTORY|syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(oldRoot)
+	if err := syscall.PivotRoot(".", "."); err != nil {
+		return fmt.Errorf("pivot_root: %w", err)
+	}
+	if err := syscall.Fchdir(oldRoot); err != nil {
+		return err
+	}
+	// Do not let the unmount reach the node's mounts through propagation
+	if err := syscall.Mount("", ".", "", syscall.MS_SLAVE|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("make old root slave: %w", err)
+	}
+	if err := syscall.Unmount(".", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("unmount old root: %w", err)
+	}
+	return os.Chdir("/")
+}
+
+// setupMounts performs mounts inside rootfs, in order. It runs in init (see enterRootfs).
+// A mount detached holds an fd for was made ahead and is only attached: the idmapped clone
+// create made of its source, or the devpts instance of the terminal init allocated.
+func setupMounts(rootfs string, mounts []oci.Mount, detached map[int]int) error {
+	for i, m := range mounts {
+		target, err := resolveInRoot(rootfs, m.Destination)
+		if err != nil {
+			return fmt.Errorf("mount %s: %w", m.Destination, err)
+		}
+		flags, data := parseMountOptions(m.Options)
+		if m.Type == "bind" {
+			flags |= syscall.MS_BIND
+		}
+		if tree, ok := detached[i]; ok {
+			if err := attachDetached(tree, target, flags); err != nil {
+				return fmt.Errorf("mount %s: %w", m.Destination, err)
+			}
+		} else if flags&syscall.MS_BIND != 0 {
+			if err := bindMount(m.Source, target, flags); err != nil {
+				return fmt.Errorf("bind mount %s: %w", m.Destination, err)
+			}
+		} else if err := mountFilesystem(m, target, flags, data); err != nil {
+			return err
+		}
+		for _, p := range parsePropagation(m.Options) {
+			if err := setPropagation(target, p); err != nil {
+				return fmt.Errorf("mount %s: set propagation: %w", m.Destination, err)
+			}
+		}
+	}
+	return nil
+}
+
+// mountFilesystem performs a mount that is not a bind at target inside the rootfs.
+func mountFilesystem(m oci.Mount, target string, flags uintptr, data string) error {
+	if err := os.MkdirAll(target, 0o755); err != nil {
+		return fmt.Errorf("mount %s: %w", m.Destination, err)
+	}
+	if m.Type == "cgroup" || m.Type == "cgroup2" {
+		err := mountCgroups(target, flags)
+		if errors.Is(err, syscall.EPERM) {
+			// The root of a user namespace may only mount the hierarchy in a cgroup
+			// namespace of its own; otherwise it gets the node's bound, like runc rootless
+			err = bindMount("/sys/fs/cgroup", target, flags|syscall.MS_BIND|syscall.MS_REC)
+		}
+		if err != nil {
+			return fmt.Errorf("mount %s (cgroup): %w", m.Destination, err)
+		}
+		return nil
+	}
+	src := m.Source
+	if src == "" {
+		src = m.Type
+	}
+	err := syscall.Mount(src, target, m.Type, flags, data)
+	if m.Type == "sysfs" && (errors.Is(err, syscall.EBUSY) || errors.Is(err, syscall.EPERM)) {
+		// sysfs belongs to the network namespace; sharing the node's, the kernel
+		// refuses a second instance with other flags, so bind the node's like runc
+		err = bindMount("/sys", target, flags|syscall.MS_BIND|syscall.MS_REC)
+	}
+	if m.Type == "devpts" && errors.Is(err, syscall.EINVAL) && strings.Contains(data, "gid=") {
+		// The gid is not mapped in the container's user namespace (a rootless one of the
+		// caller's ids alone); the instance keeps the container root's, like crun
+		err = syscall.Mount(src, target, m.Type, flags, withoutOption(data, "gid"))
+	}
+	if err != nil {
+		return fmt.Errorf("mount %s (%s): %w", m.Destination, m.Type, err)
+	}
+	return nil
+}
+
+// withoutOption drops option key=value from the comma-separated data of a mount.
+func withoutOption(data, key string) string {
+	var kept []string
+	for _, o := range strings.Split(data, ",") {
+		if k, _, _ := strings.Cut(o, "="); k != key {
+			kept = append(kept, o)
+		}
+	}
+	return strings.Join(kept, ",")
+}
+
+// readonlyPaths makes each path inside rootfs read-only with a bind mount onto itself,
+// keeping its nosuid/nodev/noexec. Paths missing from the rootfs are skipped.
+func readonlyPaths(rootfs string, paths []string) error {
+	for _, p := range paths {
+		target, err := resolveInRoot(rootfs, p)
+		if err != nil {
+			return fmt.Errorf("readonly path %s: %w", p, err)
+		}
+		if err := syscall.Mount(target, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			if errors.Is(err, syscall.ENOENT) {
+				continue
+			}
+			return fmt.Errorf("readonly path %s: %w", p, err)
+		}
+		var fs syscall.Statfs_t
+		if err := syscall.Statfs(target, &fs); err != nil {
+			return fmt.Errorf("readonly path %s: %w", p, err)
+		}
+		flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY)
+		flags |= uintptr(fs.Flags) & (syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC)
+		if err := syscall.Mount("", target, "", flags, ""); err != nil {
+			return fmt.Errorf("readonly path %s: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// maskPaths hides each path inside rootfs: files behind a bind of /dev/null, directories
+// behind an empty read-only tmpfs, like runc. Paths missing from the rootfs are skipped.
+func maskPaths(rootfs string, paths []string) error {
+	for _, p := range paths {
+		target, err := resolveInRoot(rootfs, p)
+		if err != nil {
+			return fmt.Errorf("masked path %s: %w", p, err)
+		}
+		fi, err := os.Stat(target)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("masked path %s: %w", p, err)
+		}
+		if fi.IsDir() {
+			err = syscall.Mount("tmpfs", target, "tmpfs", syscall.MS_RDONLY, "size=0")
+		} else {
+			err = syscall.Mount("/dev/null", target, "", syscall.MS_BIND, "")
+		}
+		if err != nil {
+			return fmt.Errorf("masked path %s: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// bindMount binds source to target, creating target as a file or directory to match
+// source (kubelet binds single files such as /etc/hosts and secrets' subPaths).
+func bindMount(source, target string, flags uintptr) error {
+	if err := makeBindTarget(source, target); err != nil {
+		return err
+	}
+	if err := syscall.Mount(source, target, "", flags&(syscall.MS_BIND|syscall.MS_REC), ""); err != nil {
+		return err
+	}
+	return remountBind(target, flags)
+}
+
+// makeBindTarget creates target as a file or directory to match source.
+func makeBindTarget(source, target string) error {
+	fi, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	return makeTarget(target, fi.IsDir())
+}
+
+// makeTarget creates target as a directory, or as a file unless dir.
+func makeTarget(target string, dir bool) error {
+	if dir {
+		return os.MkdirAll(target, 0o755)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_RDONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// remountBind applies the flags of the bind mount at target besides MS_BIND and MS_REC,
+// which a bind ignores until remounted. In a user namespace the kernel locks the nosuid,
+// nodev, noexec and atime flags a bind got from the node's mount, so a remount refused
+// for dropping them is retried with them kept, like runc.
+func remountBind(target string, flags uintptr) error {
+	if rest := flags &^ (syscall.MS_BIND | syscall.MS_REC); rest != 0 {
+		err := syscall.Mount("", target, "", rest|syscall.MS_BIND|syscall.MS_REMOUNT, "")
+		if errors.Is(err, syscall.EPERM) {
+			var fs syscall.Statfs_t
+			if syscall.Statfs(target, &fs) == nil {
+				locked := uintptr(fs.Flags) & (syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC | syscall.MS_NOATIME | syscall.MS_NODIRATIME | syscall.MS_RELATIME)
+				err = syscall.Mount("", target, "", rest|locked|syscall.MS_BIND|syscall.MS_REMOUNT, "")
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("remount: %w", err)
+		}
+	}
+	return nil
+}
+
+// mountCgroups gives the container the node's cgroup layout at target: the cgroup2
+// filesystem on unified hosts, otherwise a tmpfs holding one mount per v1 hierarchy (and
+// the hybrid "unified" one), like runc. In a cgroup namespace they show its root.
+func mountCgroups(target string, flags uintptr) error {
+	hierarchies, err := cgroups.Hierarchies()
+	if err != nil {
+		return err
+	}
+	for _, h := range hierarchies {
+		if h.Type == "cgroup2" && h.Point == "/sys/fs/cgroup" {
+			return syscall.Mount("cgroup2", target, "cgroup2", flags, "")
+		}
+	}
+	if err := syscall.Mount("tmpfs", target, "tmpfs", flags&^syscall.MS_RDONLY, "mode=755"); err != nil {
+		return err
+	}
+	for _, h := range hierarchies {
+		if filepath.Dir(h.Point) != "/sys/fs/cgroup" {
+			continue
+		}
+		dir := filepath.Join(target, filepath.Base(h.Point))
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+		if err := syscall.Mount(h.Type, dir, h.Type, flags, h.Options); err != nil {
+			return fmt.Errorf("%s: %w", filepath.Base(h.Point), err)
+		}
+	}
+	if flags&syscall.MS_RDONLY != 0 {
+		return syscall.Mount("", target, "", flags|syscall.MS_REMOUNT, "mode=755")
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/ktsakalozos/runproc/internal/cgroups"
+	"github.com/ktsakalozos/runproc/internal/oci"
+)
+
+// namespaceFlags returns the clone flags for the spec's namespaces without a path, which
+// init is forked into. Entries with a path name an existing namespace to join (see
+// startInNamespaces).
+func namespaceFlags(spec *oci.Spec) (uintptr, error) {
+	if spec.Linux == nil {
+		return 0, nil
+	}
+	var flags uintptr
+	for _, ns := range spec.Linux.Namespaces {
+		if ns.Path != "" {
+			continue
+		}
+		f, ok := oci.NamespaceCloneFlags[ns.Type]
+		if !ok {
+			return 0, fmt.Errorf("creating a %s namespace is not supported", ns.Type)
+		}
+		flags |= f
+	}
+	return flags, nil
+}
+
+// joinedNamespaces returns the spec's namespaces given by path.
+func joinedNamespaces(spec *oci.Spec) ([]oci.LinuxNamespace, error) {
+	if spec.Linux == nil {
+		return nil, nil
+	}
+	var out, mnt []oci.LinuxNamespace
+	for _, ns := range spec.Linux.Namespaces {
+		if ns.Path == "" {
+			continue
+		}
+		if _, ok := oci.NamespaceCloneFlags[ns.Type]; !ok {
+			return nil, fmt.Errorf("joining a %s namespace is not supported", ns.Type)
+		}
+		if ns.Type == oci.MountNamespace {
+			mnt = append(mnt, ns)
+			continue
+		}
+		out = append(out, ns)
+	}
+	// The other paths are resolved in the node's mount namespace, so it is joined last
+	return append(out, mnt...), nil
+}
+
+// startInNamespaces starts cmd inside the namespaces to join and, with a cg, in that v1
+// cgroup. Go processes are multi-threaded, so the namespaces are entered by a thread of
+// our own that then forks init: the child inherits that thread's namespaces (for pid, the
+// namespace of its children) and v1 cgroups. The thread leaves the cgroup again, but is
+// never unlocked, so it exits instead of returning to the pool. No thread of a Go process
+// can join a user namespace; that is left to the child (see startInUserns).
+func startInNamespaces(cmd *exec.Cmd, join []oci.LinuxNamespace, cg *cgroups.Cgroup) error {
+	if len(join) == 0 && cg == nil {
+		return cmd.Start()
+	}
+	// The pid and user namespace joined, if any
+	var pidns *syscall.Stat_t
+	var userns *os.File
+	errc := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		errc <- func() error {
+			// Before the mount namespace, which hides the node's cgroup files
+			if cg != nil {
+				leave, err := cg.JoinThread()
+				if err != nil {
+					return err
+				}
+				defer func() {
+					if err := leave(); err != nil {
+						fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+					}
+				}()
+			}
+			for _, ns := range join {
+				if ns.Type == oci.UserNamespace {
+					// Now, while the path resolves in the node's mount namespace
+					f, err := os.Open(ns.Path)
+					if err != nil {
+						return fmt.Errorf("join user namespace: %w", err)
+					}
+					defer f.Close()
+					userns = f
+					continue
+				}
+				flag := oci.NamespaceCloneFlags[ns.Type]
+				if flag == syscall.CLONE_NEWNS {
+					// setns refuses a mount namespace while the thread shares its fs
+					// attributes with the rest of the process
+					if err := syscall.Unshare(syscall.CLONE_FS); err != nil {
+						return fmt.Errorf("unshare fs: %w", err)
+					}
+				}
+				f, err := os.Open(ns.Path)
+				if err != nil {
+					return fmt.Errorf("join %s namespace: %w", ns.Type, err)
+				}
+				if flag == syscall.CLONE_NEWPID {
+					pidns = new(syscall.Stat_t)
+					if err := syscall.Fstat(int(f.Fd()), pidns); err != nil {
+						f.Close()
+						return fmt.Errorf("join %s namespace: %w", ns.Type, err)
+					}
+				}
+				_, _, errno := syscall.RawSyscall(sysSetns, f.Fd(), flag, 0)
+				f.Close()
+				if errno != 0 {
+					return fmt.Errorf("join %s namespace %s: %w", ns.Type, ns.Path, errno)
+				}
+			}
+			if userns != nil {
+				return startInUserns(cmd, userns)
+			}
+			return cmd.Start()
+		}()
+	}()
+	if err := <-errc; err != nil {
+		return err
+	}
+	if pidns != nil && userns != nil {
+		// userns-init, in the joined pid namespace, reported the pid it has there
+		pid, err := hostPid(pidns, cmd.Process.Pid)
+		if err != nil {
+			return err
+		}
+		cmd.Process, err = os.FindProcess(pid)
+		return err
+	}
+	return nil
+}
+
+// hostPid returns our pid for the process that is pid in the pid namespace ns (its
+// device and inode): the one there whose status lists pid last among its NSpid.
+func hostPid(ns *syscall.Stat_t, pid int) (int, error) {
+	dirs, err := os.ReadDir("/proc")
+	if err != nil {
+		return 0, err
+	}
+	want := strconv.Itoa(pid)
+	for _, d := range dirs {
+		n, err := strconv.Atoi(d.Name())
+		if err != nil {
+			continue
+		}
+		var st syscall.Stat_t
+		if syscall.Stat(fmt.Sprintf("/proc/%d/ns/pid", n), &st) != nil || st.Dev != ns.Dev || st.Ino != ns.Ino {
+			continue
+		}
+		b, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", n))
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(b), "\n") {
+			if ids, ok := strings.CutPrefix(line, "NSpid:"); ok {
+				if f := strings.Fields(ids); len(f) > 0 && f[len(f)-1] == want {
+					return n, nil
+				}
+			}
+		}
+	}
+	return 0, fmt.Errorf("no process is pid %d in the joined pid namespace", pid)
+}
+
+// createsNamespace reports whether the spec asks for a new namespace of type t.
+func createsNamespace(spec *oci.Spec, t oci.LinuxNamespaceType) bool {
+	if spec.Linux == nil {
+		return false
+	}
+	for _, ns := range spec.Linux.Namespaces {
+		if ns.Type == t && ns.Path == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// joinsNamespace reports whether the spec joins an existing namespace of type t.
+func joinsNamespace(spec *oci.Spec, t oci.LinuxNamespaceType) bool {
+	if spec.Linux == nil {
+		return false
+	}
+	for _, ns := range spec.Linux.Namespaces {
+		if ns.Type == t && ns.Path != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// setUTSNames applies the spec's hostname and domainname in the container's own UTS
+// namespace, so a pod sees its own names; without one they would rename the node.
+func setUTSNames(spec *oci.Spec) error {
+	if !createsNamespace(spec, oci.UTSNamespace) {
+		return nil
+	}
+	if spec.Hostname != "" {
+		if err := syscall.Sethostname([]byte(spec.Hostname)); err != nil {
+			return fmt.Errorf("set hostname: %w", err)
+		}
+	}
+	if spec.Domainname != "" {
+		if err := syscall.Setdomainname([]byte(spec.Domainname)); err != nil {
+			return fmt.Errorf("set domainname: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ktsakalozos/runproc/internal/state"
+)
+
+// nomadRuntimeFailure is the exit status of `run --nomad-compat` when runproc itself fails
+// rather than the container, as with docker run: Nomad restarts and reports the task by its
+// exit status alone.
+const nomadRuntimeFailure = 125
+
+// nomadContainerID names the container of a Nomad task after its allocation and task, so
+// each attempt of the task reuses the id and finds what an earlier attempt left behind.
+func nomadContainerID() (string, error) {
+	alloc, task := os.Getenv("NOMAD_ALLOC_ID"), os.Getenv("NOMAD_TASK_NAME")
+	if alloc == "" || task == "" {
+		return "", errors.New("run --nomad-compat needs a container id, or NOMAD_ALLOC_ID and NOMAD_TASK_NAME to name it after")
+	}
+	id := "nomad-" + alloc + "-" + task
+	// Task names are free-form; map what an id cannot hold to '_'
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '+', r == '-', r == '.':
+			return r
+		}
+		return '_'
+	}, id), nil
+}
+
+// cmdRunNomad implements `run --nomad-compat`, for Nomad's raw_exec task driver to run a
+// bundle as a task: runproc stays in the foreground with the container's stdio as its own,
+// forwards signals, removes the container once it has exited and exits with its status
+// (128+signal when a signal killed it, nomadRuntimeFailure when runproc failed). The id
+// and bundle default to the task's and to the working directory (the task dir). A
+// container of the same id is left over from an earlier attempt of the task that runproc
+// could not clean up (Nomad killed it), so it is force-deleted first. The result is
+// reported as result asks once the container is deleted.
+func cmdRunNomad(stateDir, id, bundle string, opts createOptions, result resultOptions) (int, error) {
+	var err error
+	if id == "" {
+		if id, err = nomadContainerID(); err != nil {
+			return nomadRuntimeFailure, err
+		}
+	}
+	if bundle == "" {
+		if bundle, err = os.Getwd(); err != nil {
+			return nomadRuntimeFailure, err
+		}
+	}
+	if _, err := state.Load(stateDir, id); err == nil {
+		fmt.Fprintf(os.Stderr, "warning: removing container %s left by an earlier attempt\n", id)
+		if err := cmdDelete(stateDir, id, true); err != nil {
+			return nomadRuntimeFailure, err
+		}
+	}
+	res, err := cmdRunForeground(stateDir, id, bundle, opts, false)
+	if err != nil {
+		return nomadRuntimeFailure, err
+	}
+	if err := cmdDelete(stateDir, id, true); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: delete of %s: %v\n", id, err)
+	}
+	if err := result.report(res); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: result of %s: %v\n", id, err)
+	}
+	return res.ExitCode, nil
+}
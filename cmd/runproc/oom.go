@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/ktsakalozos/runproc/internal/cgroups"
+	"github.com/ktsakalozos/runproc/internal/state"
+)
+
+// oomInterval is how often the supervisor and `events` read the container's OOM kills.
+const oomInterval = 250 * time.Millisecond
+
+// oomKills is how many processes the OOM killer killed in the container's own cgroup. A
+// container in a cgroup it inherited (none made by runproc) reports none: the kills there
+// may be anyone's.
+func oomKills(st *state.ContainerState) uint64 {
+	if st.Cgroup == "" {
+		return 0
+	}
+	n, err := cgroups.OOMKills(st.Cgroup)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// markOOMKilled records in st that the OOM killer killed a process of the container,
+// noticed at at: the oomKilled flag and time, an oom_killed event in its audit.log and
+// the oom_killed_total counter. A container marked already is left as it is. The caller
+// saves st; markOOMKilled reports whether it changed it.
+func markOOMKilled(stateDir string, st *state.ContainerState, at time.Time) bool {
+	if st.OOMKilled {
+		return false
+	}
+	at = at.UTC()
+	st.OOMKilled, st.OOMKilledAt = true, &at
+	_ = recordEvent(stateDir, st.ID, containerEvent{Event: "oom_killed"})
+	_ = state.AddCounters(stateDir, "oom_killed_total")
+	return true
+}
+
+// checkOOM marks st as OOM-killed (markOOMKilled) if its cgroup has seen an OOM kill.
+func checkOOM(stateDir string, st *state.ContainerState) bool {
+	return !st.OOMKilled && oomKills(st) > 0 && markOOMKilled(stateDir, st, time.Now())
+}
+
+// recordOOM marks the recorded state of container id as OOM-killed at at.
+func recordOOM(stateDir, id string, at time.Time) error {
+	st, err := state.Load(stateDir, id)
+	if err != nil {
+		return err
+	}
+	if markOOMKilled(stateDir, st, at) {
+		return state.Save(stateDir, st)
+	}
+	return nil
+}
+
+// watchOOM has the supervisor of st record the container's first OOM kill as it happens,
+// even if the init survives it. The returned func stops watching and checks once more, so
+// a kill that took the init down is not missed; it marks st too, so the exit the
+// supervisor records next keeps the flag, without recording the kill a second time.
+func watchOOM(stateDir string, st *state.ContainerState) func() {
+	if st.Cgroup == "" {
+		return func() {}
+	}
+	done, finished := make(chan struct{}), make(chan struct{})
+	var seenAt *time.Time
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(oomInterval)
+		defer ticker.Stop()
+		for seenAt == nil {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				if oomKills(st) > 0 {
+					seenAt = &now
+					_ = recordOOM(stateDir, st.ID, now)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+		if seenAt != nil {
+			// recordOOM logged the event and counted it already; only st lags behind
+			at := seenAt.UTC()
+			st.OOMKilled, st.OOMKilledAt = true, &at
+		} else {
+			checkOOM(stateDir, st)
+		}
+	}
+}
+
+// oomEvent is a line of `events`, in the shape of runc's.
+type oomEvent struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// cmdEvents writes an {"type":"oom"} line to w for each process the OOM killer kills in
+// the container's cgroup from now on, like `runc events`, and records the container as
+// OOM-killed. It returns once the container is no longer running.
+func cmdEvents(stateDir, id string, w io.Writer) error {
+	st, err := state.Load(stateDir, id)
+	if err != nil {
+		return err
+	}
+	if st.Cgroup == "" {
+		return fmt.Errorf("container %s has no cgroup of its own to watch", id)
+	}
+	enc := json.NewEncoder(w)
+	seen := oomKills(st)
+	for {
+		running := st.Status != state.Stopped && pidRunning(st.Pid)
+		if n := oomKills(st); n > seen {
+			if err := recordOOM(stateDir, id, time.Now()); err != nil {
+				return err
+			}
+			for ; seen < n; seen++ {
+				if err := enc.Encode(oomEvent{Type: "oom", ID: id}); err != nil {
+					return err
+				}
+			}
+		}
+		if !running {
+			return nil
+		}
+		time.Sleep(oomInterval)
+		if st, err = state.Load(stateDir, id); errors.Is(err, state.ErrNotExist) {
+			// Deleted, and its cgroup with it
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
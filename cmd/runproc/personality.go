@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+
+	"github.com/ktsakalozos/runproc/internal/oci"
+)
+
+// personalityDomains maps the spec's execution domains to their numbers
+// (linux/personality.h).
+var personalityDomains = map[oci.LinuxPersonalityDomain]uintptr{
+	oci.PerLinux: 0x0000, oci.PerLinux32: 0x0008,
+}
+
+// personalityValue resolves linux.personality to a persona for personality(2). create
+// calls it too, so an unknown domain fails the create instead of the start. The spec
+// defines no flags yet, so any fails too.
+func personalityValue(p *oci.LinuxPersonality) (uintptr, error) {
+	domain, ok := personalityDomains[p.Domain]
+	if !ok {
+		return 0, fmt.Errorf("linux.personality.domain %q is not supported", p.Domain)
+	}
+	if len(p.Flags) > 0 {
+		return 0, fmt.Errorf("linux.personality.flags %q are not supported", p.Flags)
+	}
+	return domain, nil
+}
+
+// setPersonality applies linux.personality with personality(2), so a legacy 32-bit
+// workload sees a 32-bit machine (uname) and address space layout. The persona is per
+// thread and survives exec, so it is set on the thread that execs.
+func setPersonality(p *oci.LinuxPersonality) error {
+	v, err := personalityValue(p)
+	if err != nil {
+		return err
+	}
+	// This thread execs; never unlocked
+	runtime.LockOSThread()
+	if _, _, e := syscall.RawSyscall(syscall.SYS_PERSONALITY, v, 0, 0); e != 0 {
+		return fmt.Errorf("set linux.personality: %w", e)
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ktsakalozos/runproc/internal/cgroups"
+	"github.com/ktsakalozos/runproc/internal/oci"
+	"github.com/ktsakalozos/runproc/internal/state"
+)
+
+// podContainer is one container of a `pods` entry.
+type podContainer struct {
+	ID       string       `json:"id"`
+	Status   state.Status `json:"status"`
+	Pid      int          `json:"pid,omitempty"`
+	ExitCode *int         `json:"exitCode,omitempty"`
+}
+
+// podUsage sums the cgroup usage of a pod's running containers.
+type podUsage struct {
+	CPUUsec     uint64 `json:"cpuUsec"`
+	MemoryBytes uint64 `json:"memoryBytes"`
+	Pids        uint64 `json:"pids"`
+}
+
+// podSummary is one pod in `pods`: its CRI identity, containers and aggregate status.
+type podSummary struct {
+	Namespace  string         `json:"namespace"`
+	Name       string         `json:"name"`
+	UID        string         `json:"uid,omitempty"`
+	SandboxID  string         `json:"sandboxId"`
+	Status     string         `json:"status"`
+	Running    int            `json:"running"`
+	Containers []podContainer `json:"containers"`
+	// Usage is nil when no container runs or no cgroup could be read
+	Usage *podUsage `json:"usage,omitempty"`
+
+	cgroups map[string]bool
+}
+
+// cmdPods groups the containers of the state root by the CRI sandbox annotations, so
+// node-local ids can be matched to what kubectl shows. Containers created outside a
+// pod (no sandbox id) are left out.
+func cmdPods(stateDir, format string, w io.Writer) error {
+	if format != "table" && format != "json" {
+		return fmt.Errorf("unknown format %q: use table or json", format)
+	}
+	entries, err := os.ReadDir(stateDir)
+	if err != nil {
+		return err
+	}
+	pods := map[string]*podSummary{}
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		st, err := state.Load(stateDir, e.Name())
+		if err != nil {
+			// Deleted meanwhile, or not a container
+			continue
+		}
+		sandbox := st.Annotations[oci.SandboxIDAnnotation]
+		if sandbox == "" {
+			continue
+		}
+		pod := pods[sandbox]
+		if pod == nil {
+			pod = &podSummary{SandboxID: sandbox, cgroups: map[string]bool{}}
+			pods[sandbox] = pod
+		}
+		// The sandbox container carries the same annotations; fill in from whichever has them
+		if pod.Namespace == "" {
+			pod.Namespace = st.Annotations[oci.SandboxNamespaceAnnotation]
+		}
+		if pod.Name == "" {
+			pod.Name = st.Annotations[oci.SandboxNameAnnotation]
+		}
+		if pod.UID == "" {
+			pod.UID = st.Annotations[oci.SandboxUIDAnnotation]
+		}
+		status := st.Status
+		// A creating container may not have its init yet
+		if status != state.Stopped && status != state.Creating && !pidRunning(st.Pid) {
+			status = state.Stopped
+		}
+		c := podContainer{ID: st.ID, Status: status, ExitCode: st.ExitCode}
+		if status != state.Stopped {
+			c.Pid = st.Pid
+		}
+		pod.Containers = append(pod.Containers, c)
+		if status == state.Running {
+			pod.Running++
+			pod.addUsage(st.Pid)
+		}
+	}
+	list := make([]*podSummary, 0, len(pods))
+	for _, pod := range pods {
+		pod.Status = podStatus(pod.Containers)
+		list = append(list, pod)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Namespace != list[j].Namespace {
+			return list[i].Namespace < list[j].Namespace
+		}
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].SandboxID < list[j].SandboxID
+	})
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(list)
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "NAMESPACE\tNAME\tREADY\tSTATUS\tCPU\tMEMORY\tPIDS\tSANDBOX\n")
+	for _, pod := range list {
+		cpu, mem, pids := "-", "-", "-"
+		if u := pod.Usage; u != nil {
+			cpu = (time.Duration(u.CPUUsec) * time.Microsecond).Truncate(10 * time.Millisecond).String()
+			mem = formatBytes(int64(u.MemoryBytes))
+			pids = fmt.Sprint(u.Pids)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d/%d\t%s\t%s\t%s\t%s\t%s\n", orDash(pod.Namespace), orDash(pod.Name),
+			pod.Running, len(pod.Containers), pod.Status, cpu, mem, pids, shortID(pod.SandboxID))
+	}
+	return tw.Flush()
+}
+
+// addUsage adds the usage of the cgroup pid is in, once per cgroup: runproc creates no
+// cgroups, so a pod's containers usually share their shim's.
+func (pod *podSummary) addUsage(pid int) {
+	cg, err := cgroups.ForPid(pid)
+	if err != nil || pod.cgroups[cg.Path] {
+		return
+	}
+	s, err := cg.Stats()
+	if err != nil {
+		return
+	}
+	pod.cgroups[cg.Path] = true
+	if pod.Usage == nil {
+		pod.Usage = &podUsage{}
+	}
+	pod.Usage.CPUUsec += s.CPU.UsageUsec
+	pod.Usage.MemoryBytes += s.Memory.Usage
+	pod.Usage.Pids += s.Pids.Current
+}
+
+// podStatus aggregates container states: "failed" if any exited non-zero, else
+// "running", "created" or "stopped" when all agree, "creating" while any container of a
+// pod with none running is, and "partial" for a mix of running and other containers.
+func podStatus(containers []podContainer) string {
+	counts := map[state.Status]int{}
+	for _, c := range containers {
+		if c.Status == state.Stopped && c.ExitCode != nil && *c.ExitCode != 0 {
+			return "failed"
+		}
+		counts[c.Status]++
+	}
+	for _, s := range []state.Status{state.Running, state.Created, state.Stopped} {
+		if counts[s] == len(containers) {
+			return string(s)
+		}
+	}
+	if counts[state.Running] == 0 {
+		if counts[state.Creating] > 0 {
+			return string(state.Creating)
+		}
+		return string(state.Created)
+	}
+	return "partial"
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// shortID abbreviates a sandbox id like crictl does.
+func shortID(id string) string {
+	if len(id) > 13 {
+		return id[:13]
+	}
+	return id
+}
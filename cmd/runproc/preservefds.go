@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// inheritedFiles wraps the n fds runproc inherited from first on, which --preserve-fds
+// passes on to the container at 3 and up. They are marked close-on-exec so only the init
+// gets them (ExtraFiles clears the flag there), not hooks or other children.
+func inheritedFiles(first, n int) ([]*os.File, error) {
+	if n < 0 {
+		return nil, fmt.Errorf("--preserve-fds %d: must not be negative", n)
+	}
+	var files []*os.File
+	for fd := first; fd < first+n; fd++ {
+		_, _, e := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), syscall.F_GETFD, 0)
+		if e != 0 || goRuntimeFd(fd) {
+			return nil, fmt.Errorf("--preserve-fds %d: fd %d is not open", n, fd-first+3)
+		}
+		syscall.CloseOnExec(fd)
+		files = append(files, os.NewFile(uintptr(fd), fmt.Sprintf("preserved-fd-%d", fd)))
+	}
+	return files, nil
+}
+
+// goRuntimeFd reports whether fd is of the kind the Go runtime opens for its poller
+// before main, at the lowest free fds: those the caller did not pass.
+func goRuntimeFd(fd int) bool {
+	link, err := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", fd))
+	return err == nil && (link == "anon_inode:[eventpoll]" || link == "anon_inode:[eventfd]")
+}
+
+// keepNonblock records which of files are non-blocking and returns a func that makes them
+// so again. Handing a file to a child (File.Fd) clears O_NONBLOCK, a flag of the open file
+// the caller, runproc and the container share: a socket-activation caller must find its
+// listener as it left it, and so must the container.
+func keepNonblock(files []*os.File) func() {
+	var nonblock []int
+	for _, f := range files {
+		rc, err := f.SyscallConn()
+		if err != nil {
+			continue
+		}
+		// Through the raw fd: File.Fd would clear the flag
+		_ = rc.Control(func(fd uintptr) {
+			if fl, _, e := syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_GETFL, 0); e == 0 && fl&syscall.O_NONBLOCK != 0 {
+				nonblock = append(nonblock, int(fd))
+			}
+		})
+	}
+	return func() {
+		for _, fd := range nonblock {
+			_ = syscall.SetNonblock(fd, true)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/ktsakalozos/runproc/internal/cgroups"
+	"github.com/ktsakalozos/runproc/internal/state"
+)
+
+// procStat holds the /proc/<pid>/stat fields runproc cares about.
+type procStat struct {
+	pid     int
+	comm    string
+	state   string
+	ppid    int
+	pgrp    int
+	session int
+	// utime and stime are in clock ticks (USER_HZ), rss in pages; cutime and cstime are
+	// those of the children it reaped
+	utime, stime   uint64
+	cutime, cstime uint64
+	rss            int64
+}
+
+// readProcStat parses /proc/<pid>/stat. The comm field may contain spaces and
+// parentheses, so fields are split after its closing ')'.
+func readProcStat(pid int) (*procStat, error) {
+	b, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return nil, err
+	}
+	s := string(b)
+	open, end := strings.IndexByte(s, '('), strings.LastIndexByte(s, ')')
+	if open < 0 || end < open {
+		return nil, fmt.Errorf("malformed stat for pid %d", pid)
+	}
+	fields := strings.Fields(s[end+1:])
+	if len(fields) < 4 {
+		return nil, fmt.Errorf("malformed stat for pid %d", pid)
+	}
+	ps := &procStat{pid: pid, comm: s[open+1 : end], state: fields[0]}
+	if ps.ppid, err = strconv.Atoi(fields[1]); err != nil {
+		return nil, err
+	}
+	if ps.pgrp, err = strconv.Atoi(fields[2]); err != nil {
+		return nil, err
+	}
+	if ps.session, err = strconv.Atoi(fields[3]); err != nil {
+		return nil, err
+	}
+	if len(fields) >= 22 {
+		ps.utime, _ = strconv.ParseUint(fields[11], 10, 64)
+		ps.stime, _ = strconv.ParseUint(fields[12], 10, 64)
+		ps.cutime, _ = strconv.ParseUint(fields[13], 10, 64)
+		ps.cstime, _ = strconv.ParseUint(fields[14], 10, 64)
+		ps.rss, _ = strconv.ParseInt(fields[21], 10, 64)
+	}
+	return ps, nil
+}
+
+// pidRunning is like pidAlive but treats zombies (exited, not yet reaped) as gone.
+func pidRunning(pid int) bool {
+	if !pidAlive(pid) {
+		return false
+	}
+	ps, err := readProcStat(pid)
+	if err != nil {
+		// Not visible in our /proc (e.g. another pid namespace); trust kill(0)
+		return !errors.Is(err, os.ErrNotExist)
+	}
+	return ps.state != "Z"
+}
+
+// listProcs returns the stat of every process currently visible in /proc.
+func listProcs() ([]*procStat, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	var out []*procStat
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		ps, err := readProcStat(pid)
+		if err != nil {
+			// Raced with exit
+			continue
+		}
+		out = append(out, ps)
+	}
+	return out, nil
+}
+
+// containerPids returns the init pid plus every process that belongs to the container:
+// members of the session the init leads, and all descendants of the init (which also
+// covers processes that started their own session). The result is sorted.
+func containerPids(initPid int) ([]int, error) {
+	if !pidAlive(initPid) {
+		return nil, nil
+	}
+	procs, err := containerProcs(initPid)
+	if err != nil {
+		return nil, err
+	}
+	// The init counts even when its stat could not be read
+	pids := []int{initPid}
+	for _, ps := range procs {
+		if ps.pid != initPid {
+			pids = append(pids, ps.pid)
+		}
+	}
+	sort.Ints(pids)
+	return pids, nil
+}
+
+// containerProcs returns the stat of every process containerPids lists, from one pass
+// over /proc; none once the init is gone.
+func containerProcs(initPid int) ([]*procStat, error) {
+	if !pidAlive(initPid) {
+		return nil, nil
+	}
+	procs, err := listProcs()
+	if err != nil {
+		return nil, err
+	}
+	children := map[int][]int{}
+	member := map[int]bool{initPid: true}
+	for _, ps := range procs {
+		children[ps.ppid] = append(children[ps.ppid], ps.pid)
+		if ps.session == initPid {
+			member[ps.pid] = true
+		}
+	}
+	queue := []int{initPid}
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		for _, c := range children[p] {
+			member[c] = true
+			queue = append(queue, c)
+		}
+	}
+	var out []*procStat
+	for _, ps := range procs {
+		if member[ps.pid] {
+			out = append(out, ps)
+		}
+	}
+	return out, nil
+}
+
+// killTargets lists the processes `kill --all` and a forced delete signal, sorted. In a
+// cgroup of its own that is every process of the cgroup, including any that left the
+// init's session and process tree (setsid plus a double fork reparents it away);
+// otherwise it is what containerPids finds, which such a process escapes.
+func killTargets(st *state.ContainerState) ([]int, error) {
+	if st.Cgroup == "" {
+		return containerPids(st.Pid)
+	}
+	if !pidAlive(st.Pid) {
+		return nil, nil
+	}
+	pids, err := cgroups.Procs(st.Cgroup)
+	if err != nil {
+		return nil, fmt.Errorf("cgroup of %s: %w", st.ID, err)
+	}
+	// The init counts even before systemd moved it into its scope
+	if !slices.Contains(pids, st.Pid) {
+		pids = append(pids, st.Pid)
+		sort.Ints(pids)
+	}
+	return pids, nil
+}
+
+// procCmdline is the command line of a process, or its [comm] for kernel threads and
+// zombies, like ps shows them.
+func procCmdline(ps *procStat) string {
+	b, err := os.ReadFile("/proc/" + strconv.Itoa(ps.pid) + "/cmdline")
+	if err != nil || len(b) == 0 {
+		return "[" + ps.comm + "]"
+	}
+	return string(bytes.TrimRight(bytes.ReplaceAll(b, []byte{0}, []byte{' '}), " "))
+}
+
+// signalAll delivers sig to every pid, ignoring processes that already exited.
+func signalAll(pids []int, sig syscall.Signal) error {
+	var errs []error
+	for _, p := range pids {
+		if err := syscall.Kill(p, sig); err != nil && err != syscall.ESRCH {
+			errs = append(errs, fmt.Errorf("signal pid %d: %w", p, err))
+		}
+	}
+	return errors.Join(errs...)
+}
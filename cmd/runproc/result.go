@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/ktsakalozos/runproc/internal/state"
+)
+
+// runResult is how a container of `run` ended, as `run --result` prints it and
+// `--result-file` holds it, so a pipeline learns it without keeping the state dir around.
+type runResult struct {
+	ID       string `json:"id"`
+	ExitCode int    `json:"exitCode"`
+	// Signal is the number of the signal that killed the init, if one did.
+	Signal int `json:"signal,omitempty"`
+	// OOMKilled is set when the OOM killer killed a process of the container's cgroup.
+	OOMKilled       bool         `json:"oomKilled"`
+	StartedAt       *time.Time   `json:"startedAt,omitempty"`
+	ExitedAt        time.Time    `json:"exitedAt"`
+	DurationSeconds float64      `json:"durationSeconds"`
+	Rusage          resultRusage `json:"rusage"`
+}
+
+// resultRusage is the resource usage of the init and the descendants it waited for.
+type resultRusage struct {
+	UserSeconds                float64 `json:"userSeconds"`
+	SystemSeconds              float64 `json:"systemSeconds"`
+	MaxRSSBytes                int64   `json:"maxRssBytes"`
+	MinorFaults                int64   `json:"minorFaults"`
+	MajorFaults                int64   `json:"majorFaults"`
+	InBlocks                   int64   `json:"inBlocks"`
+	OutBlocks                  int64   `json:"outBlocks"`
+	VoluntaryContextSwitches   int64   `json:"voluntaryContextSwitches"`
+	InvoluntaryContextSwitches int64   `json:"involuntaryContextSwitches"`
+}
+
+// newRunResult describes the exit of the init of st, which wait4 reported as ws and ru,
+// at exitedAt.
+func newRunResult(st *state.ContainerState, code int, ws syscall.WaitStatus, ru *syscall.Rusage, exitedAt time.Time) *runResult {
+	seconds := func(tv syscall.Timeval) float64 {
+		return time.Duration(tv.Nano()).Seconds()
+	}
+	res := &runResult{
+		ID:        st.ID,
+		ExitCode:  code,
+		OOMKilled: st.OOMKilled,
+		ExitedAt:  exitedAt.UTC(),
+		Rusage: resultRusage{
+			UserSeconds:   seconds(ru.Utime),
+			SystemSeconds: seconds(ru.Stime),
+			// ru_maxrss is in kilobytes
+			MaxRSSBytes:                ru.Maxrss * 1024,
+			MinorFaults:                ru.Minflt,
+			MajorFaults:                ru.Majflt,
+			InBlocks:                   ru.Inblock,
+			OutBlocks:                  ru.Oublock,
+			VoluntaryContextSwitches:   ru.Nvcsw,
+			InvoluntaryContextSwitches: ru.Nivcsw,
+		},
+	}
+	if ws.Signaled() {
+		res.Signal = int(ws.Signal())
+	}
+	if st.StartedAt != nil {
+		started := st.StartedAt.UTC()
+		res.StartedAt = &started
+		res.DurationSeconds = exitedAt.Sub(started).Seconds()
+	}
+	return res
+}
+
+// resultOptions are where `run` reports the runResult: a line on stdout after the
+// container's output and/or a file, written whole (renamed into place) so a reader never
+// sees half of it.
+type resultOptions struct {
+	stdout bool
+	file   string
+}
+
+// report writes res where o asks for it.
+func (o resultOptions) report(res *runResult) error {
+	if res == nil || (!o.stdout && o.file == "") {
+		return nil
+	}
+	b, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if o.stdout {
+		if _, err := os.Stdout.Write(b); err != nil {
+			return err
+		}
+	}
+	if o.file != "" {
+		if err := state.ReplaceFile(o.file, b, 0o644); err != nil {
+			return fmt.Errorf("write result file: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/ktsakalozos/runproc/internal/oci"
+)
+
+// rlimitResources maps the spec's rlimit types to resource numbers (asm-generic).
+var rlimitResources = map[string]int{
+	"RLIMIT_CPU": 0, "RLIMIT_FSIZE": 1, "RLIMIT_DATA": 2, "RLIMIT_STACK": 3,
+	"RLIMIT_CORE": 4, "RLIMIT_RSS": 5, "RLIMIT_NPROC": 6, "RLIMIT_NOFILE": 7,
+	"RLIMIT_MEMLOCK": 8, "RLIMIT_AS": 9, "RLIMIT_LOCKS": 10, "RLIMIT_SIGPENDING": 11,
+	"RLIMIT_MSGQUEUE": 12, "RLIMIT_NICE": 13, "RLIMIT_RTPRIO": 14, "RLIMIT_RTTIME": 15,
+}
+
+// setRlimits applies process.rlimits to init, from which the workload inherits them
+// across exec. It runs before setUser: raising a hard limit needs CAP_SYS_RESOURCE.
+// Limits not in the spec keep the values init inherited from runproc's caller.
+func setRlimits(rlimits []oci.POSIXRlimit) error {
+	for _, rl := range rlimits {
+		// Validate already rejected unknown types
+		resource := rlimitResources[rl.Type]
+		if err := syscall.Setrlimit(resource, &syscall.Rlimit{Cur: rl.Soft, Max: rl.Hard}); err != nil {
+			return fmt.Errorf("set %s: %w", rl.Type, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ktsakalozos/runproc/internal/oci"
+)
+
+// rootless reports whether runproc runs without root for a container in a user namespace,
+// which gives it the privileges to isolate the container there: the namespace's root has
+// them over the namespaces and mounts it owns, and over nothing on the node.
+func rootless(spec *oci.Spec) bool {
+	return os.Geteuid() != 0 && (createsNamespace(spec, oci.UserNamespace) || joinsNamespace(spec, oci.UserNamespace))
+}
+
+// checkRootless checks a rootless container at create (after checkUserns). Init runs as
+// the container's root and must still own the state, so a new namespace maps that root to
+// the caller's uid and gid. Other mappings need newuidmap and newgidmap, which write
+// those /etc/subuid and /etc/subgid grant the caller. Idmapping a mount or the rootfs
+// takes root on the node.
+func checkRootless(spec *oci.Spec) error {
+	for _, m := range spec.Mounts {
+		if idmapped(m) {
+			return fmt.Errorf("mount %s: idmapped mounts need runproc to run as root", m.Destination)
+		}
+	}
+	if idmap, _ := parseRootfsIdmap(spec); idmap {
+		return fmt.Errorf("%s needs runproc to run as root", oci.RootfsIdmapAnnotation)
+	}
+	if !createsNamespace(spec, oci.UserNamespace) {
+		return nil
+	}
+	l := spec.Linux
+	if id, ok := rootHostID(l.UIDMappings); !ok || id != os.Geteuid() {
+		return fmt.Errorf("without root, linux.uidMappings must map the container's root (id 0) to your uid %d", os.Geteuid())
+	}
+	if id, ok := rootHostID(l.GIDMappings); !ok || id != os.Getegid() {
+		return fmt.Errorf("without root, linux.gidMappings must map the container's root (id 0) to your gid %d", os.Getegid())
+	}
+	if ownIDOnly(l.UIDMappings) && ownIDOnly(l.GIDMappings) {
+		return nil
+	}
+	for _, helper := range []string{"newuidmap", "newgidmap"} {
+		if _, err := exec.LookPath(helper); err != nil {
+			return fmt.Errorf("without root, mapping more than your own uid and gid needs %s (from shadow's uidmap) in PATH", helper)
+		}
+	}
+	return nil
+}
+
+// rootHostID returns the id on the node that ids map the container's root to.
+func rootHostID(ids []oci.LinuxIDMapping) (int, bool) {
+	for _, id := range ids {
+		if id.ContainerID == 0 && id.Size > 0 {
+			return int(id.HostID), true
+		}
+	}
+	return 0, false
+}
+
+// ownIDOnly reports whether ids map nothing but the container's root, which checkRootless
+// made the caller's id: the one mapping the kernel lets a process without root write.
+func ownIDOnly(ids []oci.LinuxIDMapping) bool {
+	return len(ids) == 1 && ids[0].Size == 1
+}
+
+// delegateIDMaps writes the uid_map and gid_map of init at pid, created in its user
+// namespace without mappings, with newuidmap and newgidmap. It runs before init gets the
+// go-ahead, which is when init first needs them.
+func delegateIDMaps(pid int, l *oci.Linux) error {
+	for _, m := range []struct {
+		helper string
+		ids    []oci.LinuxIDMapping
+	}{{"newuidmap", l.UIDMappings}, {"newgidmap", l.GIDMappings}} {
+		args := []string{strconv.Itoa(pid)}
+		for _, id := range m.ids {
+			args = append(args, strconv.FormatUint(uint64(id.ContainerID), 10), strconv.FormatUint(uint64(id.HostID), 10), strconv.FormatUint(uint64(id.Size), 10))
+		}
+		var stderr bytes.Buffer
+		helper := exec.Command(m.helper, args...)
+		helper.Stderr = &stderr
+		if err := helper.Run(); err != nil {
+			if msg := strings.TrimSpace(stderr.String()); msg != "" {
+				err = fmt.Errorf("%w: %s", err, msg)
+			}
+			return fmt.Errorf("%s: %w", m.helper, err)
+		}
+	}
+	return nil
+}
+
+// setgroupsDenied reports whether setgroups is denied in runproc's user namespace, as in
+// one whose gid_map was written without newgidmap.
+func setgroupsDenied() bool {
+	b, err := os.ReadFile("/proc/self/setgroups")
+	return err == nil && strings.TrimSpace(string(b)) == "deny"
+}
+
+// rootlessStateDir is the default state root of runproc without root, in the caller's
+// runtime directory ($XDG_RUNTIME_DIR, as rootless containerd and podman use), or "" to
+// keep the node's.
+func rootlessStateDir() string {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if os.Geteuid() == 0 || dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, "runproc")
+}
+
+// errRootlessSetgroups is returned for process.user.additionalGids in a user namespace
+// whose gid_map was written without newgidmap.
+var errRootlessSetgroups = errors.New("process.user.additionalGids need setgroups, which a user namespace mapping only your own gid denies (map more gids, with newgidmap)")
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/ktsakalozos/runproc/internal/oci"
+	"github.com/ktsakalozos/runproc/internal/state"
+)
+
+// cmdRunForeground implements `run` without --detach: create, start, and wait for the
+// container while relaying signals to it. With tee set the container's output goes to our
+// stdout/stderr and is also recorded in console.log, so scripted runs can be inspected
+// after the terminal scrollback is gone; otherwise the container inherits our stdio. With
+// process.terminal the container gets a pty instead, which we proxy to our stdio (see
+// runTerminal) and do not record. It returns how the container ended once it has exited.
+func cmdRunForeground(stateDir, id, bundle string, opts createOptions, tee bool) (*runResult, error) {
+	spec, err := oci.LoadSpec(bundle)
+	if err != nil {
+		return nil, err
+	}
+	if spec.Process != nil && spec.Process.Terminal {
+		return runForegroundTerminal(stateDir, id, bundle, opts)
+	}
+	var outR, errR *os.File
+	if tee {
+		var outW, errW *os.File
+		var err error
+		if outR, outW, err = os.Pipe(); err != nil {
+			return nil, err
+		}
+		if errR, errW, err = os.Pipe(); err != nil {
+			outR.Close()
+			outW.Close()
+			return nil, err
+		}
+		opts.stdout, opts.stderr = outW, errW
+	}
+	err = cmdCreate(stateDir, id, bundle, opts)
+	if tee {
+		// Only the init may hold the write ends, so the copies end when the container does
+		opts.stdout.Close()
+		opts.stderr.Close()
+	}
+	if err != nil {
+		if tee {
+			outR.Close()
+			errR.Close()
+		}
+		return nil, err
+	}
+	drain := func(time.Duration) {}
+	if tee {
+		sink, err := openContainerLogSink(stateDir, id)
+		if err != nil {
+			outR.Close()
+			errR.Close()
+			_ = cmdDelete(stateDir, id, true)
+			return nil, err
+		}
+		defer sink.Close()
+		drain = sink.capture(outR, errR, func(stream string, p []byte) {
+			if stream == "stderr" {
+				_, _ = os.Stderr.Write(p)
+			} else {
+				_, _ = os.Stdout.Write(p)
+			}
+		})
+	}
+	if err := cmdStart(stateDir, id); err != nil {
+		_ = cmdDelete(stateDir, id, true)
+		return nil, err
+	}
+	stop := func() {}
+	if st, err := state.Load(stateDir, id); err == nil {
+		stop = forwardSignals(st.Pid)
+	}
+	res, err := waitProcess(stateDir, id)
+	stop()
+	drain(time.Second)
+	return res, err
+}
+
+// runForegroundTerminal is cmdRunForeground for a container with process.terminal: init
+// sends the pty master over a socket pair whose other end create passes on as the console
+// socket.
+func runForegroundTerminal(stateDir, id, bundle string, opts createOptions) (*runResult, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	conn := os.NewFile(uintptr(fds[0]), "console-socket")
+	defer conn.Close()
+	opts.console = os.NewFile(uintptr(fds[1]), "console-socket")
+	err = cmdCreate(stateDir, id, bundle, opts)
+	opts.console.Close()
+	if err != nil {
+		return nil, err
+	}
+	master, err := receiveConsole(conn)
+	if err != nil {
+		_ = cmdDelete(stateDir, id, true)
+		return nil, err
+	}
+	restore := runTerminal(master)
+	if err := cmdStart(stateDir, id); err != nil {
+		restore()
+		_ = cmdDelete(stateDir, id, true)
+		return nil, err
+	}
+	stop := func() {}
+	if st, err := state.Load(stateDir, id); err == nil {
+		stop = forwardSignals(st.Pid)
+	}
+	res, err := waitProcess(stateDir, id)
+	stop()
+	restore()
+	return res, err
+}
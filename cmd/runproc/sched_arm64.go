@@ -0,0 +1,4 @@
+package main
+
+// sysSchedSetattr is sched_setattr(2); the frozen syscall package predates it.
+const sysSchedSetattr = 274
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"github.com/ktsakalozos/runproc/internal/oci"
+)
+
+// schedulerPolicies maps the spec's policies to their numbers (linux/sched.h). SCHED_ISO
+// is reserved and no kernel implements it.
+var schedulerPolicies = map[oci.LinuxSchedulerPolicy]uint32{
+	oci.SchedOther: 0, oci.SchedFIFO: 1, oci.SchedRR: 2, oci.SchedBatch: 3,
+	oci.SchedIdle: 5, oci.SchedDeadline: 6,
+}
+
+// schedulerFlags maps the spec's flags to sched_attr.sched_flags bits. The utilization
+// clamp flags are left out: the spec has no clamp values to go with them.
+var schedulerFlags = map[oci.LinuxSchedulerFlag]uint64{
+	oci.SchedFlagResetOnFork: 0x01, oci.SchedFlagReclaim: 0x02, oci.SchedFlagDLOverrun: 0x04,
+	oci.SchedFlagKeepPolicy: 0x08, oci.SchedFlagKeepParams: 0x10,
+}
+
+// schedAttr is struct sched_attr up to the deadline parameters (SCHED_ATTR_SIZE_VER0).
+type schedAttr struct {
+	size     uint32
+	policy   uint32
+	flags    uint64
+	nice     int32
+	priority uint32
+	runtime  uint64
+	deadline uint64
+	period   uint64
+}
+
+// schedulerAttr resolves process.scheduler. create calls it too, so a policy and
+// parameters the kernel would refuse fail the create instead of the start.
+func schedulerAttr(s *oci.Scheduler) (*schedAttr, error) {
+	policy, ok := schedulerPolicies[s.Policy]
+	if !ok {
+		return nil, fmt.Errorf("process.scheduler.policy %q is not supported", s.Policy)
+	}
+	a := &schedAttr{size: uint32(unsafe.Sizeof(schedAttr{})), policy: policy, nice: s.Nice, runtime: s.Runtime, deadline: s.Deadline, period: s.Period}
+	for _, f := range s.Flags {
+		bit, ok := schedulerFlags[f]
+		if !ok {
+			return nil, fmt.Errorf("process.scheduler.flags: %q is not supported", f)
+		}
+		a.flags |= bit
+	}
+	if s.Nice < -20 || s.Nice > 19 {
+		return nil, fmt.Errorf("process.scheduler.nice %d is outside -20..19", s.Nice)
+	}
+	realtime := s.Policy == oci.SchedFIFO || s.Policy == oci.SchedRR
+	switch {
+	case realtime && (s.Priority < 1 || s.Priority > 99):
+		return nil, fmt.Errorf("process.scheduler.priority %d is outside 1..99 for %s", s.Priority, s.Policy)
+	case !realtime && s.Priority != 0:
+		return nil, fmt.Errorf("process.scheduler.priority must be 0 for %s", s.Policy)
+	}
+	a.priority = uint32(s.Priority)
+	if s.Policy == oci.SchedDeadline {
+		// A period of 0 means the deadline, as in the kernel
+		period := s.Period
+		if period == 0 {
+			period = s.Deadline
+		}
+		if s.Runtime == 0 || s.Runtime > s.Deadline || s.Deadline > period {
+			return nil, fmt.Errorf("process.scheduler for %s needs 0 < runtime <= deadline <= period", s.Policy)
+		}
+	}
+	return a, nil
+}
+
+// setScheduler applies process.scheduler with sched_setattr(2). Scheduling attributes
+// are per thread and survive exec, so it runs on the thread that execs. It runs before
+// setUser: real-time policies and raising priority need CAP_SYS_NICE.
+func setScheduler(s *oci.Scheduler) error {
+	a, err := schedulerAttr(s)
+	if err != nil {
+		return err
+	}
+	// This thread execs; never unlocked
+	runtime.LockOSThread()
+	if _, _, e := syscall.RawSyscall(sysSchedSetattr, 0, uintptr(unsafe.Pointer(a)), 0); e != 0 {
+		return fmt.Errorf("set process.scheduler: %w", e)
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/ktsakalozos/runproc/internal/config"
+	"github.com/ktsakalozos/runproc/internal/oci"
+)
+
+// defaultScratchPath is where scratch space is mounted unless runproc.scratch.path says otherwise.
+const defaultScratchPath = "/scratch"
+
+// scratchDirName is the host-side mount point of disk-backed scratch space in the container's
+// state dir; init bind mounts it into the container.
+const scratchDirName = "scratch"
+
+// errScratchNeedsChroot rejects scratch space for containers that get no mounts at all.
+var errScratchNeedsChroot = fmt.Errorf("%s requires a chrooted container (runproc running as root, not in host mode)", oci.ScratchAnnotation)
+
+// prepareScratch turns the runproc.scratch annotations into a mount for init. Memory-backed
+// space is a tmpfs limited to the requested size. Disk-backed space is an ext4 image of that
+// size under the node config's scratch.dir, fully allocated up front (so the space is
+// guaranteed, and a full node disk fails the create rather than the workload) and loop
+// mounted at <state dir>/<id>/scratch. It returns the image path to record for delete.
+func prepareScratch(stateDir, id string, spec *oci.Spec) (*oci.Mount, string, error) {
+	size, ok := spec.Annotations[oci.ScratchAnnotation]
+	if !ok {
+		return nil, "", nil
+	}
+	bytes, err := parseSize(size)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %w", oci.ScratchAnnotation, err)
+	}
+	dest := spec.Annotations[oci.ScratchPathAnnotation]
+	if dest == "" {
+		dest = defaultScratchPath
+	}
+	if !filepath.IsAbs(dest) {
+		return nil, "", fmt.Errorf("%s: %q is not an absolute path", oci.ScratchPathAnnotation, dest)
+	}
+	switch backing := spec.Annotations[oci.ScratchBackingAnnotation]; backing {
+	case "", "tmpfs":
+		return &oci.Mount{
+			Destination: dest,
+			Type:        "tmpfs",
+			Source:      "scratch",
+			Options:     []string{"nosuid", "nodev", "mode=1777", "size=" + strconv.FormatInt(bytes, 10)},
+		}, "", nil
+	case "disk":
+		img, mnt, err := mountScratchImage(stateDir, id, bytes)
+		if err != nil {
+			return nil, "", err
+		}
+		return &oci.Mount{Destination: dest, Type: "bind", Source: mnt, Options: []string{"rbind", "nosuid", "nodev"}}, img, nil
+	default:
+		return nil, "", fmt.Errorf("%s: unknown backing %q (want tmpfs or disk)", oci.ScratchBackingAnnotation, backing)
+	}
+}
+
+// mountScratchImage creates, formats and loop mounts a disk-backed scratch image.
+func mountScratchImage(stateDir, id string, size int64) (string, string, error) {
+	mkfs, err := exec.LookPath("mkfs.ext4")
+	if err != nil {
+		return "", "", errors.New("disk-backed scratch requires mkfs.ext4 in PATH")
+	}
+	cfg, err := config.Load()
+	if err != nil {
+		return "", "", err
+	}
+	if err := os.MkdirAll(cfg.Scratch.Dir, 0o700); err != nil {
+		return "", "", fmt.Errorf("create scratch dir: %w", err)
+	}
+	// Never reuse an image: it may still be mounted for a same-named container of another state dir
+	img := filepath.Join(cfg.Scratch.Dir, id+".img")
+	f, err := os.OpenFile(img, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return "", "", fmt.Errorf("create scratch image: %w", err)
+	}
+	err = syscall.Fallocate(int(f.Fd()), 0, 0, size)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(img)
+		return "", "", fmt.Errorf("allocate %d bytes of scratch: %w", size, err)
+	}
+	// No journal (the data does not outlive the container) and no discard, which would punch
+	// the allocation back out of the image
+	if out, err := exec.Command(mkfs, "-q", "-F", "-m", "0", "-O", "^has_journal", "-E", "nodiscard", img).CombinedOutput(); err != nil {
+		_ = os.Remove(img)
+		return "", "", fmt.Errorf("mkfs.ext4 scratch image: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	mnt := filepath.Join(stateDir, id, scratchDirName)
+	if err := os.MkdirAll(mnt, 0o700); err != nil {
+		_ = os.Remove(img)
+		return "", "", err
+	}
+	if out, err := exec.Command("mount", "-o", "loop,nosuid,nodev", img, mnt).CombinedOutput(); err != nil {
+		_ = os.Remove(img)
+		return "", "", fmt.Errorf("mount scratch image: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	// Like the tmpfs variant: writable by any container user
+	if err := os.Chmod(mnt, 0o777|os.ModeSticky); err != nil {
+		_ = releaseScratch(stateDir, id, img)
+		return "", "", err
+	}
+	return img, mnt, nil
+}
+
+// releaseScratch unmounts disk-backed scratch space (the loop device is freed with the
+// last reference) and removes its image. It must run before the state dir is removed.
+func releaseScratch(stateDir, id, img string) error {
+	mnt := filepath.Join(stateDir, id, scratchDirName)
+	if mounted, _ := isMountPoint(mnt); mounted {
+		if err := syscall.Unmount(mnt, syscall.MNT_DETACH); err != nil {
+			return fmt.Errorf("unmount scratch: %w", err)
+		}
+	}
+	if img == "" {
+		return nil
+	}
+	if err := os.Remove(img); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// parseSize parses a byte count with an optional Kubernetes-style suffix: k, M, G, T
+// (powers of 1000) or Ki, Mi, Gi, Ti (powers of 1024).
+func parseSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		mult   int64
+	}{
+		{"Ki", 1 << 10}, {"Mi", 1 << 20}, {"Gi", 1 << 30}, {"Ti", 1 << 40},
+		{"k", 1e3}, {"M", 1e6}, {"G", 1e9}, {"T", 1e12},
+	}
+	num, mult := strings.TrimSpace(s), int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(num, u.suffix) {
+			num, mult = strings.TrimSuffix(num, u.suffix), u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n <= 0 || n > (1<<62)/mult {
+		return 0, fmt.Errorf("invalid size %q (want e.g. 512Mi or 2G)", s)
+	}
+	return n * mult, nil
+}
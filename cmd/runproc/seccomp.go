@@ -0,0 +1,335 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/ktsakalozos/runproc/internal/oci"
+)
+
+// seccomp(2) and filter return values (linux/seccomp.h) the syscall package lacks.
+const (
+	seccompSetModeFilter = 1
+
+	seccompRetKillProcess = 0x80000000
+	seccompRetKillThread  = 0x00000000
+	seccompRetTrap        = 0x00030000
+	seccompRetErrno       = 0x00050000
+	seccompRetTrace       = 0x7ff00000
+	seccompRetLog         = 0x7ffc0000
+	seccompRetAllow       = 0x7fff0000
+
+	// maxErrno is the largest errno the kernel returns for SECCOMP_RET_ERRNO (MAX_ERRNO)
+	maxErrno = 4095
+	// bpfMaxInsns is the longest filter the kernel loads (BPF_MAXINSNS)
+	bpfMaxInsns = 4096
+)
+
+// seccompFlags are the linux.seccomp.flags runproc passes to seccomp(2).
+var seccompFlags = map[oci.LinuxSeccompFlag]uint{
+	"SECCOMP_FILTER_FLAG_TSYNC":      1,
+	"SECCOMP_FILTER_FLAG_LOG":        2,
+	"SECCOMP_FILTER_FLAG_SPEC_ALLOW": 4,
+}
+
+// The offsets of struct seccomp_data, the input of a filter.
+const (
+	seccompDataNr   = 0
+	seccompDataArch = 4
+	seccompDataArgs = 16
+)
+
+// seccompFilter is linux.seccomp compiled at create; the init only installs it.
+type seccompFilter struct {
+	Filter []syscall.SockFilter `json:"filter"`
+	Flags  uint                 `json:"flags,omitempty"`
+}
+
+// compileSeccomp compiles linux.seccomp to a classic BPF filter for this build's
+// architecture, or returns nil when the spec has none. Rules are tried in spec order and
+// the first match decides; conditions of one rule must all hold, except that, like runc,
+// a rule that tests the same argument twice matches when any of its conditions holds.
+// Syscall names this architecture does not have are ignored, like unknown capabilities,
+// so one profile serves every node. Syscalls of any other ABI (32-bit and x32 calls on
+// amd64) kill the process: runproc filters the native ABI only.
+func compileSeccomp(s *oci.LinuxSeccomp) (*seccompFilter, error) {
+	if s == nil {
+		return nil, nil
+	}
+	def, err := seccompAction(s.DefaultAction, s.DefaultErrnoRet)
+	if err != nil {
+		return nil, fmt.Errorf("linux.seccomp.defaultAction: %w", err)
+	}
+	for _, a := range s.Architectures {
+		if !strings.HasPrefix(string(a), "SCMP_ARCH_") {
+			return nil, fmt.Errorf("linux.seccomp.architectures: unknown architecture %q", a)
+		}
+	}
+	var flags uint
+	for _, f := range s.Flags {
+		bit, ok := seccompFlags[f]
+		if !ok {
+			return nil, fmt.Errorf("linux.seccomp.flags: unsupported flag %q", f)
+		}
+		flags |= bit
+	}
+
+	type rule struct {
+		args   [][]oci.LinuxSeccompArg
+		action uint32
+	}
+	rules := map[uint32][]rule{}
+	for i, sc := range s.Syscalls {
+		action, err := seccompAction(sc.Action, sc.ErrnoRet)
+		if err != nil {
+			return nil, fmt.Errorf("linux.seccomp.syscalls[%d]: %w", i, err)
+		}
+		args, err := seccompArgs(sc.Args)
+		if err != nil {
+			return nil, fmt.Errorf("linux.seccomp.syscalls[%d]: %w", i, err)
+		}
+		for _, name := range sc.Names {
+			if nr, ok := syscallNumbers[name]; ok {
+				rules[nr] = append(rules[nr], rule{args, action})
+			}
+		}
+	}
+	nrs := make([]uint32, 0, len(rules))
+	for nr := range rules {
+		nrs = append(nrs, nr)
+	}
+	sort.Slice(nrs, func(i, j int) bool { return nrs[i] < nrs[j] })
+
+	var p bpfProgram
+	native := p.label()
+	p.load(seccompDataArch)
+	p.jump(syscall.BPF_JEQ, seccompArch, native, bpfNext)
+	p.ret(seccompRetKillProcess)
+	p.place(native)
+	p.load(seccompDataNr)
+	if seccompX32 != 0 {
+		nonX32 := p.label()
+		p.jump(syscall.BPF_JSET, seccompX32, bpfNext, nonX32)
+		p.ret(seccompRetKillProcess)
+		p.place(nonX32)
+	}
+	for _, nr := range nrs {
+		other := p.label()
+		p.jump(syscall.BPF_JEQ, nr, bpfNext, other)
+		for _, r := range rules[nr] {
+			for _, all := range r.args {
+				miss := p.label()
+				for _, a := range all {
+					p.compare(a, miss)
+				}
+				p.ret(r.action)
+				p.place(miss)
+			}
+		}
+		p.ret(def)
+		// The syscall number is still loaded for the next test
+		p.place(other)
+	}
+	p.ret(def)
+
+	filter, err := p.assemble()
+	if err != nil {
+		return nil, fmt.Errorf("linux.seccomp: %w", err)
+	}
+	return &seccompFilter{Filter: filter, Flags: flags}, nil
+}
+
+// seccompAction resolves an action and its errnoRet to a filter return value. ERRNO and
+// TRACE default to EPERM, like runc.
+func seccompAction(action oci.LinuxSeccompAction, errnoRet *uint) (uint32, error) {
+	errno := uint32(syscall.EPERM)
+	if errnoRet != nil {
+		if action != oci.ActErrno && action != oci.ActTrace {
+			return 0, fmt.Errorf("errnoRet is only valid with %s and %s", oci.ActErrno, oci.ActTrace)
+		}
+		if *errnoRet > maxErrno {
+			return 0, fmt.Errorf("errnoRet %d is above %d", *errnoRet, maxErrno)
+		}
+		errno = uint32(*errnoRet)
+	}
+	switch action {
+	case oci.ActKill, oci.ActKillThread:
+		return seccompRetKillThread, nil
+	case oci.ActKillProcess:
+		return seccompRetKillProcess, nil
+	case oci.ActTrap:
+		return seccompRetTrap, nil
+	case oci.ActErrno:
+		return seccompRetErrno | errno, nil
+	case oci.ActTrace:
+		return seccompRetTrace | errno, nil
+	case oci.ActLog:
+		return seccompRetLog, nil
+	case oci.ActAllow:
+		return seccompRetAllow, nil
+	case oci.ActNotify:
+		return 0, fmt.Errorf("action %s is not supported", action)
+	}
+	return 0, fmt.Errorf("unknown action %q", action)
+}
+
+// seccompArgs groups a rule's conditions into alternatives, each of which must hold as a
+// whole: one group, or one per condition when an argument is tested twice.
+func seccompArgs(args []oci.LinuxSeccompArg) ([][]oci.LinuxSeccompArg, error) {
+	var seen [6]bool
+	repeated := false
+	for _, a := range args {
+		if a.Index >= uint(len(seen)) {
+			return nil, fmt.Errorf("argument index %d is out of range", a.Index)
+		}
+		switch a.Op {
+		case oci.OpNotEqual, oci.OpLessThan, oci.OpLessEqual, oci.OpEqualTo,
+			oci.OpGreaterEqual, oci.OpGreaterThan, oci.OpMaskedEqual:
+		default:
+			return nil, fmt.Errorf("unknown operator %q", a.Op)
+		}
+		repeated = repeated || seen[a.Index]
+		seen[a.Index] = true
+	}
+	if !repeated {
+		return [][]oci.LinuxSeccompArg{args}, nil
+	}
+	groups := make([][]oci.LinuxSeccompArg, len(args))
+	for i, a := range args {
+		groups[i] = []oci.LinuxSeccompArg{a}
+	}
+	return groups, nil
+}
+
+// bpfLabel names a not yet emitted instruction that jumps target. bpfNext is the
+// instruction right after the jump.
+type bpfLabel int
+
+const bpfNext bpfLabel = -1
+
+// bpfProgram assembles a classic BPF program whose jumps are all forward to labels.
+type bpfProgram struct {
+	insns  []syscall.SockFilter
+	labels []int
+	// jumps[i] are the targets (true, false) of insns[i], if it is a conditional jump
+	jumps map[int][2]bpfLabel
+}
+
+func (p *bpfProgram) label() bpfLabel {
+	p.labels = append(p.labels, -1)
+	return bpfLabel(len(p.labels) - 1)
+}
+
+func (p *bpfProgram) place(l bpfLabel) { p.labels[l] = len(p.insns) }
+
+func (p *bpfProgram) load(offset uint32) {
+	p.insns = append(p.insns, syscall.SockFilter{Code: syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS, K: offset})
+}
+
+func (p *bpfProgram) and(k uint32) {
+	p.insns = append(p.insns, syscall.SockFilter{Code: syscall.BPF_ALU | syscall.BPF_AND | syscall.BPF_K, K: k})
+}
+
+func (p *bpfProgram) ret(k uint32) {
+	p.insns = append(p.insns, syscall.SockFilter{Code: syscall.BPF_RET | syscall.BPF_K, K: k})
+}
+
+func (p *bpfProgram) jump(op uint16, k uint32, yes, no bpfLabel) {
+	if p.jumps == nil {
+		p.jumps = map[int][2]bpfLabel{}
+	}
+	p.jumps[len(p.insns)] = [2]bpfLabel{yes, no}
+	p.insns = append(p.insns, syscall.SockFilter{Code: syscall.BPF_JMP | op | syscall.BPF_K, K: k})
+}
+
+// compare falls through when the 64-bit argument a tests holds and jumps to miss when it
+// does not, testing the high word first (both supported ABIs are little-endian).
+func (p *bpfProgram) compare(a oci.LinuxSeccompArg, miss bpfLabel) {
+	hit := p.label()
+	lo, hi := seccompDataArgs+8*uint32(a.Index), seccompDataArgs+8*uint32(a.Index)+4
+	v := a.Value
+	if a.Op == oci.OpMaskedEqual {
+		v = a.ValueTwo
+	}
+	vlo, vhi := uint32(v), uint32(v>>32)
+	p.load(hi)
+	switch a.Op {
+	case oci.OpEqualTo, oci.OpNotEqual, oci.OpMaskedEqual:
+		yes, no := bpfNext, miss
+		if a.Op == oci.OpNotEqual {
+			yes, no = bpfNext, hit
+		}
+		if a.Op == oci.OpMaskedEqual {
+			p.and(uint32(a.Value >> 32))
+		}
+		p.jump(syscall.BPF_JEQ, vhi, yes, no)
+		p.load(lo)
+		if a.Op == oci.OpMaskedEqual {
+			p.and(uint32(a.Value))
+		}
+		if a.Op == oci.OpNotEqual {
+			p.jump(syscall.BPF_JEQ, vlo, miss, hit)
+		} else {
+			p.jump(syscall.BPF_JEQ, vlo, hit, miss)
+		}
+	case oci.OpGreaterThan, oci.OpGreaterEqual:
+		p.jump(syscall.BPF_JGT, vhi, hit, bpfNext)
+		p.jump(syscall.BPF_JEQ, vhi, bpfNext, miss)
+		p.load(lo)
+		op := uint16(syscall.BPF_JGT)
+		if a.Op == oci.OpGreaterEqual {
+			op = syscall.BPF_JGE
+		}
+		p.jump(op, vlo, hit, miss)
+	case oci.OpLessThan, oci.OpLessEqual:
+		p.jump(syscall.BPF_JGT, vhi, miss, bpfNext)
+		p.jump(syscall.BPF_JEQ, vhi, bpfNext, hit)
+		p.load(lo)
+		op := uint16(syscall.BPF_JGE)
+		if a.Op == oci.OpLessEqual {
+			op = syscall.BPF_JGT
+		}
+		p.jump(op, vlo, miss, hit)
+	}
+	p.place(hit)
+}
+
+// assemble resolves the labels. Conditional jumps only reach 255 instructions ahead, which
+// bounds the conditions of one syscall, not the size of the profile.
+func (p *bpfProgram) assemble() ([]syscall.SockFilter, error) {
+	if len(p.insns) > bpfMaxInsns {
+		return nil, fmt.Errorf("filter has %d instructions, above the kernel's %d", len(p.insns), bpfMaxInsns)
+	}
+	for i, targets := range p.jumps {
+		var off [2]uint8
+		for j, l := range targets {
+			if l == bpfNext {
+				continue
+			}
+			d := p.labels[l] - (i + 1)
+			if d < 0 || d > 255 {
+				return nil, fmt.Errorf("too many conditions for one syscall")
+			}
+			off[j] = uint8(d)
+		}
+		p.insns[i].Jt, p.insns[i].Jf = off[0], off[1]
+	}
+	return p.insns, nil
+}
+
+// applySeccomp installs the filter on the calling thread, which then execs: the filter
+// is inherited by the workload and everything it starts. Without no_new_privs the kernel
+// requires CAP_SYS_ADMIN, so it runs before setUser; with it, right before the exec.
+func applySeccomp(f *seccompFilter) error {
+	// Filters are per thread and this one execs; never unlocked
+	runtime.LockOSThread()
+	prog := syscall.SockFprog{Len: uint16(len(f.Filter)), Filter: &f.Filter[0]}
+	if _, _, e := syscall.RawSyscall(sysSeccomp, seccompSetModeFilter, uintptr(f.Flags), uintptr(unsafe.Pointer(&prog))); e != 0 {
+		return fmt.Errorf("install seccomp filter: %w", e)
+	}
+	return nil
+}
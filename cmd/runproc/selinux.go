@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/ktsakalozos/runproc/internal/oci"
+	"github.com/ktsakalozos/runproc/internal/selinux"
+)
+
+// selinuxLabel resolves process.selinuxLabel at create, where /sys is the node's. A label
+// on a node without SELinux fails rather than running the workload unlabeled.
+func selinuxLabel(p *oci.Process) (string, error) {
+	if p.SelinuxLabel != "" && !selinux.Enabled() {
+		return "", fmt.Errorf("selinux label %q requested but SELinux is not enabled on this node", p.SelinuxLabel)
+	}
+	return p.SelinuxLabel, nil
+}
+
+// applySELinux runs the workload with label from its exec on. Like applyAppArmor it runs
+// before setUser and needs the container's /proc.
+func applySELinux(label string) error {
+	// The attribute is per thread and this one execs; never unlocked
+	runtime.LockOSThread()
+	return selinux.SetExecLabel(label)
+}
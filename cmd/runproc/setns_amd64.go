@@ -0,0 +1,4 @@
+package main
+
+// sysSetns is setns(2); the frozen syscall package predates it.
+const sysSetns = 308
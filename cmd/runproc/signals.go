@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// signalNames are the signals kill accepts by name: every one the syscall package has on
+// Linux, aliases included.
+var signalNames = map[string]syscall.Signal{
+	"SIGABRT": syscall.SIGABRT, "SIGALRM": syscall.SIGALRM, "SIGBUS": syscall.SIGBUS,
+	"SIGCHLD": syscall.SIGCHLD, "SIGCLD": syscall.SIGCLD, "SIGCONT": syscall.SIGCONT,
+	"SIGFPE": syscall.SIGFPE, "SIGHUP": syscall.SIGHUP, "SIGILL": syscall.SIGILL,
+	"SIGINT": syscall.SIGINT, "SIGIO": syscall.SIGIO, "SIGIOT": syscall.SIGIOT,
+	"SIGKILL": syscall.SIGKILL, "SIGPIPE": syscall.SIGPIPE, "SIGPOLL": syscall.SIGPOLL,
+	"SIGPROF": syscall.SIGPROF, "SIGPWR": syscall.SIGPWR, "SIGQUIT": syscall.SIGQUIT,
+	"SIGSEGV": syscall.SIGSEGV, "SIGSTKFLT": syscall.SIGSTKFLT, "SIGSTOP": syscall.SIGSTOP,
+	"SIGSYS": syscall.SIGSYS, "SIGTERM": syscall.SIGTERM, "SIGTRAP": syscall.SIGTRAP,
+	"SIGTSTP": syscall.SIGTSTP, "SIGTTIN": syscall.SIGTTIN, "SIGTTOU": syscall.SIGTTOU,
+	"SIGUNUSED": syscall.SIGUNUSED, "SIGURG": syscall.SIGURG, "SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2, "SIGVTALRM": syscall.SIGVTALRM, "SIGWINCH": syscall.SIGWINCH,
+	"SIGXCPU": syscall.SIGXCPU, "SIGXFSZ": syscall.SIGXFSZ,
+}
+
+// sigRTMax is the highest signal number of Linux, the last real-time signal.
+const sigRTMax = 64
+
+// parseSignal resolves kill's signal argument, SIGTERM when it is empty: a name from
+// signalNames, in any case and with or without its SIG prefix (KILL, sigkill), or a
+// number from 1 to sigRTMax, which also reaches the real-time signals.
+func parseSignal(signal string) (syscall.Signal, error) {
+	if signal == "" {
+		return syscall.SIGTERM, nil
+	}
+	if n, err := strconv.Atoi(signal); err == nil {
+		if n < 1 || n > sigRTMax {
+			return 0, fmt.Errorf("invalid signal %d: not between 1 and %d", n, sigRTMax)
+		}
+		return syscall.Signal(n), nil
+	}
+	name := strings.ToUpper(signal)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	if sig, ok := signalNames[name]; ok {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("unknown signal %q", signal)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/ktsakalozos/runproc/internal/oci"
+	"github.com/ktsakalozos/runproc/internal/state"
+)
+
+// snapshotName is the archive of the runproc.snapshot paths in the container state dir;
+// delete moves it to logs.archive_dir along with the logs.
+const snapshotName = "snapshot.tar.zst"
+
+// snapshotRequest is a container's runproc.snapshot annotations.
+type snapshotRequest struct {
+	paths []string
+	// when is "always", "success" or "failure"
+	when string
+}
+
+// parseSnapshot reads the snapshot annotations; create calls it too, so a bad value fails
+// the create instead of losing the snapshot at exit. It returns nil when none is asked for.
+func parseSnapshot(annotations map[string]string) (*snapshotRequest, error) {
+	list, ok := annotations[oci.SnapshotAnnotation]
+	when, hasWhen := annotations[oci.SnapshotWhenAnnotation]
+	if !ok {
+		if hasWhen {
+			return nil, fmt.Errorf("%s is set without %s", oci.SnapshotWhenAnnotation, oci.SnapshotAnnotation)
+		}
+		return nil, nil
+	}
+	req := &snapshotRequest{when: "always"}
+	if hasWhen {
+		if when != "always" && when != "success" && when != "failure" {
+			return nil, fmt.Errorf("%s: %q is not always, success or failure", oci.SnapshotWhenAnnotation, when)
+		}
+		req.when = when
+	}
+	for _, p := range strings.Split(list, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !filepath.IsAbs(p) {
+			return nil, fmt.Errorf("%s: %q is not an absolute path", oci.SnapshotAnnotation, p)
+		}
+		req.paths = append(req.paths, filepath.Clean(p))
+	}
+	if len(req.paths) == 0 {
+		return nil, fmt.Errorf("%s lists no paths", oci.SnapshotAnnotation)
+	}
+	return req, nil
+}
+
+// takeSnapshot archives the container's runproc.snapshot paths into the state dir once it
+// has exited. code is its exit status, or nil when runproc did not see the exit (a shim
+// reaped it), in which case only an "always" snapshot is taken. A container that never
+// started, or already has a snapshot, is left alone.
+func takeSnapshot(stateDir string, st *state.ContainerState, code *int) error {
+	req, err := parseSnapshot(st.Annotations)
+	if req == nil || err != nil || st.StartedAt == nil {
+		return err
+	}
+	switch {
+	case req.when == "success" && (code == nil || *code != 0),
+		req.when == "failure" && (code == nil || *code == 0):
+		return nil
+	}
+	dest := filepath.Join(stateDir, st.ID, snapshotName)
+	if _, err := os.Stat(dest); err == nil {
+		return nil
+	}
+	// The container's mount namespace is gone with it: paths resolve in its rootfs
+	root := "/"
+	spec, err := oci.LoadSpec(st.Bundle)
+	if err != nil {
+		return err
+	}
+	if isolated(spec) {
+		if root = spec.Root.Path; !filepath.IsAbs(root) {
+			root = filepath.Join(st.Bundle, root)
+		}
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	tmp := dest + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_EXCL|syscall.O_NOFOLLOW, 0o600)
+	if err != nil {
+		if errors.Is(err, os.ErrExist) {
+			// A run monitor is still taking it; delete must not take a second one
+			return nil
+		}
+		return err
+	}
+	defer os.Remove(tmp)
+	defer out.Close()
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	archive := exec.Command(self, append([]string{"snapshot-paths", root}, req.paths...)...)
+	archive.Stdout, archive.Stderr = pw, os.Stderr
+	compress := exec.Command("zstd", "-q", "-c")
+	compress.Stdin, compress.Stdout, compress.Stderr = pr, out, os.Stderr
+	if err := compress.Start(); err != nil {
+		pr.Close()
+		pw.Close()
+		return fmt.Errorf("start zstd: %w", err)
+	}
+	pr.Close()
+	err = archive.Run()
+	pw.Close()
+	if werr := compress.Wait(); err == nil && werr != nil {
+		err = fmt.Errorf("zstd: %w", werr)
+	}
+	if err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
+
+// cmdSnapshotPaths is the internal command behind takeSnapshot: it writes a tar of paths
+// to w from inside root. Chrooting first makes every symlink of the exited container
+// resolve within its own rootfs, never to node files. Paths that do not exist (a failed
+// job may not have written its results) are skipped with a warning.
+func cmdSnapshotPaths(root string, paths []string, w io.Writer) error {
+	if root != "/" {
+		if err := syscall.Chroot(root); err != nil {
+			return fmt.Errorf("chroot: %w", err)
+		}
+		if err := os.Chdir("/"); err != nil {
+			return fmt.Errorf("chdir after chroot: %w", err)
+		}
+	}
+	tw := tar.NewWriter(w)
+	for _, p := range paths {
+		err := filepath.WalkDir(p, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if path == p && errors.Is(err, fs.ErrNotExist) {
+					fmt.Fprintf(os.Stderr, "warning: snapshot: %s does not exist\n", p)
+					return nil
+				}
+				return err
+			}
+			return addToTar(tw, path, d)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// addToTar writes one entry, named by its path without the leading slash. Symlinks are
+// archived as links, never followed; sockets cannot be archived and are skipped.
+func addToTar(tw *tar.Writer, path string, d fs.DirEntry) error {
+	info, err := d.Info()
+	if err != nil {
+		return err
+	}
+	var link string
+	if info.Mode()&fs.ModeSymlink != 0 {
+		if link, err = os.Readlink(path); err != nil {
+			return err
+		}
+	}
+	if info.Mode()&fs.ModeSocket != 0 {
+		return nil
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = strings.TrimPrefix(path, "/")
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ktsakalozos/runproc/internal/oci"
+)
+
+// cmdSpec writes a default config.json into bundle, refusing to overwrite an existing one.
+func cmdSpec(bundle string, host, rootless bool) error {
+	if bundle == "" {
+		bundle = "."
+	}
+	p := filepath.Join(bundle, "config.json")
+	if _, err := os.Stat(p); err == nil {
+		return fmt.Errorf("file %s exists, remove it first", p)
+	}
+	spec := oci.Example(host)
+	if rootless {
+		// The namespaces runproc needs to isolate the container without root, the
+		// container's root mapped to the caller (see checkRootless)
+		spec.Linux = &oci.Linux{
+			Namespaces:  []oci.LinuxNamespace{{Type: oci.UserNamespace}, {Type: oci.MountNamespace}, {Type: oci.PIDNamespace}, {Type: oci.IPCNamespace}, {Type: oci.UTSNamespace}},
+			UIDMappings: []oci.LinuxIDMapping{{ContainerID: 0, HostID: uint32(os.Geteuid()), Size: 1}},
+			GIDMappings: []oci.LinuxIDMapping{{ContainerID: 0, HostID: uint32(os.Getegid()), Size: 1}},
+		}
+	}
+	b, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if err := os.WriteFile(p, b, 0o644); err != nil {
+		return fmt.Errorf("write spec: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ktsakalozos/runproc/internal/oci"
+)
+
+// defaultStartGateTimeout bounds the wait on runproc.start_gate when
+// runproc.start_gate_timeout is not set.
+const defaultStartGateTimeout = time.Minute
+
+// startGate is a node-level prerequisite (time sync, a VPN, a device) the init waits for
+// between the start signal and entering the rootfs, so node agents can sequence
+// workloads without wrapper scripts.
+type startGate struct {
+	Path    string        `json:"path"`
+	Timeout time.Duration `json:"timeout"`
+}
+
+// parseStartGate resolves the start gate annotations at create, so a bad value fails the
+// create rather than the start. It returns nil when the container has no gate.
+func parseStartGate(annotations map[string]string) (*startGate, error) {
+	path, ok := annotations[oci.StartGateAnnotation]
+	v, hasTimeout := annotations[oci.StartGateTimeoutAnnotation]
+	if !ok {
+		if hasTimeout {
+			return nil, fmt.Errorf("%s is set without %s", oci.StartGateTimeoutAnnotation, oci.StartGateAnnotation)
+		}
+		return nil, nil
+	}
+	if !filepath.IsAbs(path) {
+		return nil, fmt.Errorf("%s: %q is not an absolute path", oci.StartGateAnnotation, path)
+	}
+	g := &startGate{Path: filepath.Clean(path), Timeout: defaultStartGateTimeout}
+	if hasTimeout {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("%s: %q is not a positive duration", oci.StartGateTimeoutAnnotation, v)
+		}
+		g.Timeout = d
+	}
+	return g, nil
+}
+
+// open reports whether the gate lets the workload proceed: a unix socket must accept a
+// connection (a stale socket file left by a dead agent does not count), any other file
+// must exist.
+func (g *startGate) open() bool {
+	fi, err := os.Stat(g.Path)
+	if err != nil {
+		return false
+	}
+	if fi.Mode().Type() != os.ModeSocket {
+		return true
+	}
+	c, err := net.DialTimeout("unix", g.Path, time.Second)
+	if err != nil {
+		return false
+	}
+	c.Close()
+	return true
+}
+
+// wait polls the gate until it opens or its timeout passes. The init still sees the
+// node's filesystem here, as it has not entered the rootfs yet; a kill or a forced
+// delete meanwhile ends the init like any started container.
+func (g *startGate) wait() error {
+	deadline := time.Now().Add(g.Timeout)
+	for !g.open() {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("start gate %s not open after %s", g.Path, g.Timeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/ktsakalozos/runproc/internal/cgroups"
+	"github.com/ktsakalozos/runproc/internal/state"
+)
+
+// containerStats is one `stats` sample; the cgroups.Stats fields are inlined.
+type containerStats struct {
+	ID            string    `json:"id"`
+	Timestamp     time.Time `json:"timestamp"`
+	Cgroup        string    `json:"cgroup"`
+	CgroupVersion int       `json:"cgroupVersion"`
+	*cgroups.Stats
+}
+
+// cmdStats prints the usage of the cgroup the container init is in as JSON. With watch set
+// it prints one JSON line per interval until the container exits.
+func cmdStats(stateDir, id string, watch bool, interval time.Duration, w io.Writer) error {
+	st, err := state.Load(stateDir, id)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	if !watch {
+		enc.SetIndent("", "  ")
+	}
+	for {
+		if st.Status == state.Stopped || !pidRunning(st.Pid) {
+			if watch {
+				return nil
+			}
+			return state.NotRunning(id)
+		}
+		cg, err := cgroups.ForPid(st.Pid)
+		if err != nil {
+			return fmt.Errorf("locate cgroup of %s: %w", id, err)
+		}
+		s, err := cg.Stats()
+		if err != nil {
+			return fmt.Errorf("read cgroup stats of %s: %w", id, err)
+		}
+		version := 1
+		if cg.Unified {
+			version = 2
+		}
+		if err := enc.Encode(containerStats{ID: id, Timestamp: time.Now().UTC(), Cgroup: cg.Path, CgroupVersion: version, Stats: s}); err != nil {
+			return err
+		}
+		if !watch {
+			return nil
+		}
+		time.Sleep(interval)
+		if st, err = state.Load(stateDir, id); err != nil {
+			// Deleted while watching
+			return nil
+		}
+	}
+}
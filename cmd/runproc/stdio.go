@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// stdioOpenTimeout bounds how long create waits for the other end of a stdio FIFO.
+const stdioOpenTimeout = 10 * time.Second
+
+// stdioPaths are the files create connects the init's stdio to (create's --stdin,
+// --stdout and --stderr), usually the FIFOs containerd makes for each task. "" keeps
+// the stdio runproc was given.
+type stdioPaths struct {
+	stdin, stdout, stderr string
+}
+
+func (p stdioPaths) set() bool {
+	return p.stdin != "" || p.stdout != "" || p.stderr != ""
+}
+
+var errStdioWithTerminal = errors.New("--stdin, --stdout and --stderr cannot be used with process.terminal")
+
+// openStdio opens the files of p into opts for the init to inherit and returns them. The
+// caller closes them once the init has them, so the container holds the only copies: its
+// stdin reads EOF when the writer on the other side closes.
+func openStdio(p stdioPaths, opts *createOptions) ([]*os.File, error) {
+	var opened []*os.File
+	for _, s := range []struct {
+		path  string
+		write bool
+		f     **os.File
+	}{{p.stdin, false, &opts.stdin}, {p.stdout, true, &opts.stdout}, {p.stderr, true, &opts.stderr}} {
+		if s.path == "" {
+			continue
+		}
+		f, err := openStdioFile(s.path, s.write)
+		if err != nil {
+			for _, f := range opened {
+				f.Close()
+			}
+			return nil, err
+		}
+		*s.f = f
+		opened = append(opened, f)
+	}
+	return opened, nil
+}
+
+// openStdioFile opens path for reading or writing. A FIFO is opened blocking, as the
+// container expects its stdio to be, which waits for the other end to be opened too
+// (see openFifo). Anything else is opened as a file, created and appended to for output.
+func openStdioFile(path string, write bool) (*os.File, error) {
+	fi, err := os.Stat(path)
+	if err == nil && fi.Mode()&os.ModeNamedPipe != 0 {
+		return openFifo(path, write)
+	}
+	if write {
+		return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	}
+	return os.Open(path)
+}
+
+// openFifo opens the FIFO at path, which blocks until it has a reader and a writer. If
+// the other end is not opened within stdioOpenTimeout, it stands in for that end for a
+// moment to let the open return, and fails.
+func openFifo(path string, write bool) (*os.File, error) {
+	flag, peer := os.O_RDONLY, os.O_WRONLY
+	if write {
+		flag, peer = os.O_WRONLY, os.O_RDONLY
+	}
+	type opened struct {
+		f   *os.File
+		err error
+	}
+	done := make(chan opened, 1)
+	go func() {
+		f, err := os.OpenFile(path, flag, 0)
+		done <- opened{f, err}
+	}()
+	select {
+	case o := <-done:
+		if o.err != nil {
+			return nil, fmt.Errorf("stdio fifo: %w", o.err)
+		}
+		return o.f, nil
+	case <-time.After(stdioOpenTimeout):
+	}
+	// Our open waits as the FIFO's reader or writer, so the other end opens without blocking
+	if f, err := os.OpenFile(path, peer|syscall.O_NONBLOCK, 0); err == nil {
+		f.Close()
+	}
+	if o := <-done; o.f != nil {
+		o.f.Close()
+	}
+	return nil, fmt.Errorf("stdio fifo %s: nothing opened its other end within %s", path, stdioOpenTimeout)
+}
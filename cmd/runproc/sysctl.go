@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ktsakalozos/runproc/internal/oci"
+)
+
+// ipcSysctls are the kernel.* sysctls the IPC namespace scopes (fs.mqueue.* is too).
+var ipcSysctls = map[string]bool{
+	"kernel.msgmax": true, "kernel.msgmnb": true, "kernel.msgmni": true, "kernel.sem": true,
+	"kernel.shmall": true, "kernel.shmmax": true, "kernel.shmmni": true, "kernel.shm_rmid_forced": true,
+}
+
+// sysctlNamespace returns the namespace that scopes a sysctl, or "" for a node-wide one.
+func sysctlNamespace(key string) oci.LinuxNamespaceType {
+	switch {
+	case ipcSysctls[key] || strings.HasPrefix(key, "fs.mqueue."):
+		return oci.IPCNamespace
+	case strings.HasPrefix(key, "net."):
+		return oci.NetworkNamespace
+	case key == "kernel.domainname":
+		return oci.UTSNamespace
+	}
+	return ""
+}
+
+// validateSysctls checks linux.sysctl at create. Only sysctls scoped to a namespace the
+// container has, created or joined, are accepted: anything else would change the node.
+func validateSysctls(spec *oci.Spec) error {
+	if spec.Linux == nil || len(spec.Linux.Sysctl) == 0 {
+		return nil
+	}
+	if !isolated(spec) {
+		return errors.New("linux.sysctl needs the container's own namespaces, which host mode, wasm and non-root containers share with the node")
+	}
+	for _, key := range sortedKeys(spec.Linux.Sysctl) {
+		if key == "" || strings.Contains(key, "/") || strings.Contains(key, "..") || strings.HasPrefix(key, ".") || strings.HasSuffix(key, ".") {
+			return fmt.Errorf("linux.sysctl: %q is not a sysctl name", key)
+		}
+		if key == "kernel.hostname" {
+			return errors.New("linux.sysctl: kernel.hostname conflicts with hostname; set that instead")
+		}
+		ns := sysctlNamespace(key)
+		if ns == "" {
+			return fmt.Errorf("linux.sysctl: %s is not namespaced; setting it would change the node", key)
+		}
+		if !createsNamespace(spec, ns) && !joinsNamespace(spec, ns) {
+			return fmt.Errorf("linux.sysctl: %s needs a %s namespace in linux.namespaces", key, ns)
+		}
+	}
+	return nil
+}
+
+// applySysctls writes linux.sysctl through /proc/sys. The kernel resolves namespaced
+// sysctls against the writer's namespaces, so init sets them in its own before it enters
+// the rootfs, whose /proc may be read-only.
+func applySysctls(sysctls map[string]string) error {
+	for _, key := range sortedKeys(sysctls) {
+		path := filepath.Join("/proc/sys", strings.ReplaceAll(key, ".", "/"))
+		if err := os.WriteFile(path, []byte(sysctls[key]), 0); err != nil {
+			return fmt.Errorf("set sysctl %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of m in order, so sysctls are checked and set predictably.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/ktsakalozos/runproc/internal/oci"
+)
+
+// The terminal/detach/console-socket rules follow runc: a detached container that wants a
+// terminal needs a console socket to hand the pty master to, and a console socket makes no
+// sense without a terminal or without detaching. A foreground run keeps the master itself
+// (see runTerminal).
+var (
+	errTTYWithoutSocket = errors.New("cannot allocate tty if runproc will detach without setting console socket")
+	errSocketWithoutTTY = errors.New("cannot use console socket if runproc will not detach or allocate tty")
+)
+
+// validateTerminal checks p.Terminal against how the container is being run. detached is
+// true for create and run --detach, false for a foreground run.
+func validateTerminal(p *oci.Process, detached bool, consoleSocket string) error {
+	terminal := p != nil && p.Terminal
+	switch {
+	case consoleSocket != "" && (!detached || !terminal):
+		return errSocketWithoutTTY
+	case terminal && detached && consoleSocket == "":
+		return errTTYWithoutSocket
+	}
+	return nil
+}
+
+// The pty ioctls and mount API pieces the syscall package lacks (asm-generic/ioctls.h,
+// linux/mount.h).
+const (
+	tiocgptpeer       = 0x5441
+	fsopenCloexec     = 0x1
+	fsconfigSetFlag   = 0
+	fsconfigSetString = 1
+	fsconfigCmdCreate = 6
+	fsmountCloexec    = 0x1
+	mountAttrRdonly   = 0x1
+	mountAttrNosuid   = 0x2
+	mountAttrNodev    = 0x4
+	mountAttrNoexec   = 0x8
+)
+
+// dialConsole connects to the console socket at path, in create, for init to send the pty
+// master over (see sendConsole).
+func dialConsole(path string) (*os.File, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("console socket: %w", err)
+	}
+	defer conn.Close()
+	f, err := conn.(*net.UnixConn).File()
+	if err != nil {
+		return nil, fmt.Errorf("console socket: %w", err)
+	}
+	return f, nil
+}
+
+// openTerminal allocates the container's pty in init, makes its slave init's stdio and
+// controlling terminal (init leads its session), and sends the master over the console
+// socket on fd console. The pty comes from the devpts instance of the container's
+// /dev/pts, made here ahead of the other mounts: it is returned, detached, by its index in
+// mounts for setupMounts to attach (see attachDetached). Without such a mount (host mode, a
+// joined mount namespace) the pty is one of the node's /dev/ptmx. The slave is given to
+// uid, process.user, so the workload can reopen /dev/tty.
+func openTerminal(mounts []oci.Mount, console int, size *oci.Box, uid uint32) (map[int]int, error) {
+	defer syscall.Close(console)
+	var detached map[int]int
+	ptmx := "/dev/ptmx"
+	dirfd := atFdcwd
+	for i, m := range mounts {
+		if m.Type == "devpts" && filepath.Clean(m.Destination) == "/dev/pts" {
+			fd, err := mountDetached(m)
+			if err != nil {
+				return nil, fmt.Errorf("mount %s: %w", m.Destination, err)
+			}
+			detached = map[int]int{i: fd}
+			ptmx, dirfd = "ptmx", fd
+			break
+		}
+	}
+	master, err := openPtmx(dirfd, ptmx)
+	if err != nil {
+		closeDetached(detached)
+		return nil, err
+	}
+	defer master.Close()
+	if err := setupSlave(master, size, uid); err != nil {
+		closeDetached(detached)
+		return nil, err
+	}
+	if err := sendConsole(console, master); err != nil {
+		closeDetached(detached)
+		return nil, err
+	}
+	return detached, nil
+}
+
+// openPtmx opens the pty multiplexer at path, relative to dirfd, and unlocks the slave of
+// the master it returns.
+func openPtmx(dirfd int, path string) (*os.File, error) {
+	fd, err := syscall.Openat(dirfd, path, syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	master := os.NewFile(uintptr(fd), "/dev/ptmx")
+	unlock := int32(0)
+	if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); e != 0 {
+		master.Close()
+		return nil, fmt.Errorf("unlock pty: %w", e)
+	}
+	return master, nil
+}
+
+// setupSlave opens the slave of master as init's fds 0-2 and controlling terminal, sized
+// to size and without the CRLF translation of output (like runc, so logs keep plain
+// newlines).
+func setupSlave(master *os.File, size *oci.Box, uid uint32) error {
+	fd, _, e := syscall.Syscall(syscall.SYS_IOCTL, master.Fd(), tiocgptpeer, syscall.O_RDWR|syscall.O_NOCTTY)
+	if e != 0 {
+		return fmt.Errorf("open pty slave: %w", e)
+	}
+	slave := int(fd)
+	defer syscall.Close(slave)
+	var t syscall.Termios
+	if err := ioctlTermios(slave, syscall.TCGETS, &t); err != nil {
+		return fmt.Errorf("pty termios: %w", err)
+	}
+	t.Oflag &^= syscall.ONLCR
+	if err := ioctlTermios(slave, syscall.TCSETS, &t); err != nil {
+		return fmt.Errorf("pty termios: %w", err)
+	}
+	if size != nil {
+		if err := setWinsize(slave, uint16(size.Height), uint16(size.Width)); err != nil {
+			return fmt.Errorf("process.consoleSize: %w", err)
+		}
+	}
+	// As in chownStdio, a user namespace may not map the user
+	if err := syscall.Fchown(slave, int(uid), -1); err != nil && !errors.Is(err, syscall.EPERM) && !errors.Is(err, syscall.EINVAL) {
+		return fmt.Errorf("chown pty: %w", err)
+	}
+	for std := 0; std <= 2; std++ {
+		if err := syscall.Dup3(slave, std, 0); err != nil {
+			return fmt.Errorf("pty stdio: %w", err)
+		}
+	}
+	if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, 0, syscall.TIOCSCTTY, 0); e != 0 {
+		return fmt.Errorf("set controlling terminal: %w", e)
+	}
+	return nil
+}
+
+func ioctlTermios(fd int, req uintptr, t *syscall.Termios) error {
+	if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, uintptr(unsafe.Pointer(t))); e != 0 {
+		return e
+	}
+	return nil
+}
+
+// winsize is struct winsize.
+type winsize struct {
+	rows, cols, xpixel, ypixel uint16
+}
+
+func setWinsize(fd int, rows, cols uint16) error {
+	ws := winsize{rows: rows, cols: cols}
+	if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(&ws))); e != 0 {
+		return e
+	}
+	return nil
+}
+
+// sendConsole sends master over the socket on fd console with runc's protocol: one
+// message carrying the master as SCM_RIGHTS and its name as data, as containerd's shim
+// receives it.
+func sendConsole(console int, master *os.File) error {
+	rights := syscall.UnixRights(int(master.Fd()))
+	if err := syscall.Sendmsg(console, []byte(master.Name()), rights, nil, 0); err != nil {
+		return fmt.Errorf("send pty master to the console socket: %w", err)
+	}
+	return nil
+}
+
+// receiveConsole reads the pty master init sends over conn (see sendConsole).
+func receiveConsole(conn *os.File) (*os.File, error) {
+	name := make([]byte, 4096)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := syscall.Recvmsg(int(conn.Fd()), name, oob, 0)
+	if err != nil {
+		return nil, fmt.Errorf("receive pty master: %w", err)
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) != 1 {
+		return nil, errors.New("receive pty master: init sent none")
+	}
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil || len(fds) != 1 {
+		return nil, errors.New("receive pty master: init sent none")
+	}
+	syscall.CloseOnExec(fds[0])
+	return os.NewFile(uintptr(fds[0]), string(name[:n])), nil
+}
+
+// mountDetached makes the devpts instance of mount m as a mount attached nowhere yet
+// (fsopen, fsmount), with its options. A gid= the container's user namespace does not map
+// is dropped, as in mountFilesystem.
+func mountDetached(m oci.Mount) (int, error) {
+	flags, data := parseMountOptions(m.Options)
+	fd, err := fsmountDevpts(data, flags)
+	if errors.Is(err, syscall.EINVAL) && strings.Contains(data, "gid=") {
+		fd, err = fsmountDevpts(withoutOption(data, "gid"), flags)
+	}
+	return fd, err
+}
+
+func fsmountDevpts(data string, flags uintptr) (int, error) {
+	fstype, _ := syscall.BytePtrFromString("devpts")
+	r, _, e := syscall.Syscall(sysFsopen, uintptr(unsafe.Pointer(fstype)), fsopenCloexec, 0)
+	if e != 0 {
+		if errors.Is(e, syscall.ENOSYS) {
+			return -1, fmt.Errorf("fsopen: %w (a terminal needs kernel 5.2 or newer)", e)
+		}
+		return -1, fmt.Errorf("fsopen: %w", e)
+	}
+	fsfd := int(r)
+	defer syscall.Close(fsfd)
+	for _, o := range strings.Split(data, ",") {
+		if o == "" {
+			continue
+		}
+		key, value, hasValue := strings.Cut(o, "=")
+		k, _ := syscall.BytePtrFromString(key)
+		cmd, v := uintptr(fsconfigSetFlag), uintptr(0)
+		if hasValue {
+			p, _ := syscall.BytePtrFromString(value)
+			cmd, v = fsconfigSetString, uintptr(unsafe.Pointer(p))
+		}
+		if _, _, e := syscall.Syscall6(sysFsconfig, uintptr(fsfd), cmd, uintptr(unsafe.Pointer(k)), v, 0, 0); e != 0 {
+			return -1, fmt.Errorf("option %s: %w", o, e)
+		}
+	}
+	if _, _, e := syscall.Syscall6(sysFsconfig, uintptr(fsfd), fsconfigCmdCreate, 0, 0, 0, 0); e != 0 {
+		return -1, e
+	}
+	var attrs uintptr
+	for flag, attr := range map[uintptr]uintptr{syscall.MS_RDONLY: mountAttrRdonly, syscall.MS_NOSUID: mountAttrNosuid, syscall.MS_NODEV: mountAttrNodev, syscall.MS_NOEXEC: mountAttrNoexec} {
+		if flags&flag != 0 {
+			attrs |= attr
+		}
+	}
+	r, _, e = syscall.Syscall(sysFsmount, uintptr(fsfd), fsmountCloexec, attrs)
+	if e != 0 {
+		return -1, fmt.Errorf("fsmount: %w", e)
+	}
+	return int(r), nil
+}
+
+// runTerminal connects a foreground run's own stdio to the container's pty master, as
+// runc does without a console socket: stdin goes to the container, its output to our
+// stdout, our terminal (if stdin is one) is put in raw mode, and its size follows ours.
+// The returned func restores our terminal once the container has exited.
+func runTerminal(master *os.File) func() {
+	stdin := int(os.Stdin.Fd())
+	var saved syscall.Termios
+	raw := ioctlTermios(stdin, syscall.TCGETS, &saved) == nil
+	if raw {
+		t := saved
+		// cfmakeraw
+		t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+		t.Oflag &^= syscall.OPOST
+		t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+		t.Cflag &^= syscall.CSIZE | syscall.PARENB
+		t.Cflag |= syscall.CS8
+		t.Cc[syscall.VMIN], t.Cc[syscall.VTIME] = 1, 0
+		_ = ioctlTermios(stdin, syscall.TCSETS, &t)
+	}
+	resize := func() {
+		var ws winsize
+		if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, uintptr(stdin), syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&ws))); e == 0 {
+			_ = setWinsize(int(master.Fd()), ws.rows, ws.cols)
+		}
+	}
+	resize()
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	go func() {
+		for range winch {
+			resize()
+		}
+	}()
+	go func() { _, _ = io.Copy(master, os.Stdin) }()
+	done := make(chan struct{})
+	go func() {
+		// Ends with EIO once the container's last process has closed the slave
+		_, _ = io.Copy(os.Stdout, master)
+		close(done)
+	}()
+	return func() {
+		// Like the pipes of a foreground run, output still buffered gets a second to drain
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+		}
+		signal.Stop(winch)
+		close(winch)
+		if raw {
+			_ = ioctlTermios(stdin, syscall.TCSETS, &saved)
+		}
+		master.Close()
+	}
+}
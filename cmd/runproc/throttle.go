@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/ktsakalozos/runproc/internal/cgroups"
+	"github.com/ktsakalozos/runproc/internal/oci"
+	"github.com/ktsakalozos/runproc/internal/state"
+)
+
+// cpuThrottle is a CPU quota the supervisor enforces itself, for runproc.cpu_throttle: the
+// container's processes together may use quota of CPU time in each period.
+type cpuThrottle struct {
+	quota, period time.Duration
+}
+
+// minThrottlePeriod is one clock tick, the resolution CPU time is metered at.
+const minThrottlePeriod = time.Second / clockTicks
+
+// throttleWalk is how often the throttle walks /proc for the container's processes.
+const throttleWalk = time.Second
+
+// parseCPUThrottle reads the runproc.cpu_throttle annotation and the quota it applies;
+// create calls it too, so a bad value fails there rather than in the supervisor. It
+// returns nil when no throttling is asked for.
+func parseCPUThrottle(spec *oci.Spec) (*cpuThrottle, error) {
+	v, ok := spec.Annotations[oci.CPUThrottleAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	on, err := strconv.ParseBool(v)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %q is not a boolean", oci.CPUThrottleAnnotation, v)
+	}
+	if !on {
+		return nil, nil
+	}
+	var c *oci.LinuxCPU
+	if spec.Linux != nil && spec.Linux.Resources != nil {
+		c = spec.Linux.Resources.CPU
+	}
+	if c == nil || c.Quota == nil || *c.Quota <= 0 {
+		return nil, fmt.Errorf("%s needs linux.resources.cpu.quota", oci.CPUThrottleAnnotation)
+	}
+	period := uint64(100000)
+	if c.Period != nil && *c.Period != 0 {
+		period = *c.Period
+	}
+	t := &cpuThrottle{quota: time.Duration(*c.Quota) * time.Microsecond, period: time.Duration(period) * time.Microsecond}
+	if t.period < minThrottlePeriod {
+		return nil, fmt.Errorf("%s: linux.resources.cpu.period %d is shorter than the %s CPU time is metered in", oci.CPUThrottleAnnotation, period, minThrottlePeriod)
+	}
+	return t, nil
+}
+
+// cgroupQuota reports whether the kernel enforces the CPU quota of a container in the
+// cgroup runproc made for it at cgPath, which makes throttling it redundant.
+func cgroupQuota(cgPath string) bool {
+	return cgPath != "" && cgroups.HasController("cpu")
+}
+
+// withoutCPUQuota returns a copy of r without the CPU quota and period, for a cgroup
+// that cannot hold them: cpu.max is only there with the cpu controller.
+func withoutCPUQuota(r *oci.LinuxResources) *oci.LinuxResources {
+	if r == nil || r.CPU == nil {
+		return r
+	}
+	cpu, out := *r.CPU, *r
+	cpu.Quota, cpu.Period = nil, nil
+	out.CPU = &cpu
+	return &out
+}
+
+// throttleContainer starts throttling the container in the background if it asks for it
+// and its quota is not in a cgroup. The returned func stops throttling and continues
+// whatever it stopped; it is safe to call when nothing was started.
+func throttleContainer(st *state.ContainerState) (func(), error) {
+	spec, err := oci.LoadSpec(st.Bundle)
+	if err != nil {
+		return func() {}, err
+	}
+	t, err := parseCPUThrottle(spec)
+	if t == nil || err != nil || cgroupQuota(st.Cgroup) {
+		return func() {}, err
+	}
+	done, finished := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(finished)
+		t.run(st.Pid, done)
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}, nil
+}
+
+// run meters the CPU time of the container of initPid every tenth of a period (at least
+// one clock tick) and stops its processes once the period's quota is used up, continuing
+// them when the next period begins. Time used past the quota, up to a tick's worth per
+// CPU, is taken from the next period, so the quota holds on average; unused quota is not
+// carried over, as with the kernel's. Anything still stopped is continued when done is
+// closed.
+//
+// Walking /proc for the container's processes costs as much as reading the stat of every
+// process of the node, so it is done once every throttleWalk and ticks only read the
+// processes it found. A process started since is still stopped with the init's process
+// group, which it inherits; its time is metered from the next walk, or through its
+// parent's reaped-children times once it exits, and charged then.
+func (t *cpuThrottle) run(initPid int, done <-chan struct{}) {
+	var stopped []int
+	signal := func(sig syscall.Signal) {
+		// The init leads its own session, so its process group is its pid
+		_ = syscall.Kill(-initPid, sig)
+		_ = signalAll(stopped, sig)
+	}
+	resume := func() {
+		if stopped != nil {
+			signal(syscall.SIGCONT)
+			stopped = nil
+		}
+	}
+	defer resume()
+	ticker := time.NewTicker(max(t.period/10, minThrottlePeriod))
+	defer ticker.Stop()
+	pids, last, _ := containerCPU(initPid)
+	budget, periodEnd := t.quota, time.Now().Add(t.period)
+	nextWalk := time.Now().Add(throttleWalk)
+	for {
+		var now time.Time
+		select {
+		case <-done:
+			return
+		case now = <-ticker.C:
+		}
+		var used time.Duration
+		if now.Before(nextWalk) {
+			used = cpuTime(pids)
+		} else {
+			found, all, err := containerCPU(initPid)
+			if err != nil {
+				continue
+			}
+			pids, used, nextWalk = found, all, now.Add(throttleWalk)
+		}
+		// The time of a process reaped outside the container goes with it
+		budget -= max(used-last, 0)
+		last = used
+		if !now.Before(periodEnd) {
+			resume()
+			budget = min(budget, 0) + t.quota
+			if periodEnd = periodEnd.Add(t.period); periodEnd.Before(now) {
+				periodEnd = now.Add(t.period)
+			}
+		}
+		if budget <= 0 && stopped == nil && len(pids) > 0 {
+			stopped = pids
+			signal(syscall.SIGSTOP)
+		}
+	}
+}
+
+// containerCPU walks /proc for the processes of the container of initPid and returns them
+// with the CPU time they used (see cpuTime).
+func containerCPU(initPid int) ([]int, time.Duration, error) {
+	procs, err := containerProcs(initPid)
+	if err != nil {
+		return nil, 0, err
+	}
+	pids := make([]int, 0, len(procs))
+	var ticks uint64
+	for _, ps := range procs {
+		pids = append(pids, ps.pid)
+		ticks += ps.utime + ps.stime + ps.cutime + ps.cstime
+	}
+	return pids, time.Duration(ticks) * (time.Second / clockTicks), nil
+}
+
+// cpuTime is the CPU time pids and the children they reaped used, so the time of exited
+// processes stays counted. Processes that are gone count for nothing.
+func cpuTime(pids []int) time.Duration {
+	var ticks uint64
+	for _, pid := range pids {
+		if ps, err := readProcStat(pid); err == nil {
+			ticks += ps.utime + ps.stime + ps.cutime + ps.cstime
+		}
+	}
+	return time.Duration(ticks) * (time.Second / clockTicks)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/ktsakalozos/runproc/internal/state"
+)
+
+// latencySummary summarizes one lifecycle phase over all runs, in milliseconds.
+type latencySummary struct {
+	P50 float64 `json:"p50Ms"`
+	P95 float64 `json:"p95Ms"`
+	Min float64 `json:"minMs"`
+	Max float64 `json:"maxMs"`
+}
+
+// timingReport is the JSON printed by `runproc time`.
+type timingReport struct {
+	Version string         `json:"version"`
+	Bundle  string         `json:"bundle"`
+	Runs    int            `json:"runs"`
+	Create  latencySummary `json:"create"`
+	Start   latencySummary `json:"start"`
+	Exec    latencySummary `json:"exec"`
+}
+
+// cmdTime runs the bundle's process count times and reports create, start and exec
+// latency percentiles. create and start are the durations of those operations; exec is
+// the time from start returning until the init has exec'd the container process.
+// Each canary is force-deleted as soon as it has exec'd, so long-running bundles work too.
+func cmdTime(stateDir, bundle string, count int, w io.Writer) error {
+	if count < 1 {
+		return errors.New("count must be at least 1")
+	}
+	bundle, err := filepath.Abs(bundle)
+	if err != nil {
+		return err
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	devNull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer devNull.Close()
+
+	var creates, starts, execs []time.Duration
+	for i := 0; i < count; i++ {
+		id := fmt.Sprintf("runproc-time-%d-%d", os.Getpid(), i)
+		t0 := time.Now()
+		if err := cmdCreate(stateDir, id, bundle, createOptions{stdin: devNull, stdout: devNull, stderr: devNull}); err != nil {
+			return fmt.Errorf("run %d: %w", i, err)
+		}
+		t1 := time.Now()
+		if err := cmdStart(stateDir, id); err != nil {
+			_ = cmdDelete(stateDir, id, true)
+			return fmt.Errorf("run %d: %w", i, err)
+		}
+		t2 := time.Now()
+		pid := 0
+		if st, err := state.Load(stateDir, id); err == nil {
+			pid = st.Pid
+			waitExec(pid, self)
+		}
+		t3 := time.Now()
+		if err := cmdDelete(stateDir, id, true); err != nil {
+			return fmt.Errorf("run %d: cleanup: %w", i, err)
+		}
+		if pid > 0 {
+			// The init is our child; reap it so canaries do not pile up as zombies
+			_, _ = syscall.Wait4(pid, nil, 0, nil)
+		}
+		creates = append(creates, t1.Sub(t0))
+		starts = append(starts, t2.Sub(t1))
+		execs = append(execs, t3.Sub(t2))
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(timingReport{
+		Version: version,
+		Bundle:  bundle,
+		Runs:    count,
+		Create:  summarize(creates),
+		Start:   summarize(starts),
+		Exec:    summarize(execs),
+	})
+}
+
+// waitExec polls until pid no longer runs the runproc binary, i.e. the init has exec'd
+// the container process, or has already exited.
+func waitExec(pid int, self string) {
+	exe := filepath.Join("/proc", strconv.Itoa(pid), "exe")
+	for {
+		p, err := os.Readlink(exe)
+		if err != nil || p != self || !pidRunning(pid) {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// summarize computes nearest-rank percentiles.
+func summarize(ds []time.Duration) latencySummary {
+	sorted := append([]time.Duration(nil), ds...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	rank := func(p float64) time.Duration {
+		i := int(math.Ceil(p*float64(len(sorted)))) - 1
+		return sorted[max(i, 0)]
+	}
+	ms := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+	return latencySummary{
+		P50: ms(rank(0.50)),
+		P95: ms(rank(0.95)),
+		Min: ms(sorted[0]),
+		Max: ms(sorted[len(sorted)-1]),
+	}
+}
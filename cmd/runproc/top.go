@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ktsakalozos/runproc/internal/cgroups"
+	"github.com/ktsakalozos/runproc/internal/state"
+)
+
+// clockTicks is USER_HZ, the unit of utime/stime in /proc/<pid>/stat on every Linux ABI.
+const clockTicks = 100
+
+// topOptions controls `runproc top`.
+type topOptions struct {
+	interval time.Duration
+	// iterations stops after that many refreshes; 0 refreshes until the container exits
+	iterations int
+	// clear redraws in place (when writing to a terminal) instead of appending frames
+	clear bool
+}
+
+// topSample is one process as seen at one refresh.
+type topSample struct {
+	stat    *procStat
+	cmdline string
+}
+
+// cmdTop periodically prints the container's processes with their CPU and memory use,
+// preceded by a container summary. CPU percentages cover the last interval, so the first
+// frame appears after one interval.
+func cmdTop(stateDir, id string, opts topOptions, w io.Writer) error {
+	st, err := state.Load(stateDir, id)
+	if err != nil {
+		return err
+	}
+	if st.Status == state.Stopped || !pidRunning(st.Pid) {
+		return state.NotRunning(id)
+	}
+	prev, prevAt := sampleProcs(st), time.Now()
+	for n := 1; ; n++ {
+		time.Sleep(opts.interval)
+		if st, err = state.Load(stateDir, id); err != nil || st.Status == state.Stopped || !pidRunning(st.Pid) {
+			fmt.Fprintf(w, "container %s exited\n", id)
+			return nil
+		}
+		cur, now := sampleProcs(st), time.Now()
+		var frame bytes.Buffer
+		if opts.clear {
+			frame.WriteString("\033[H\033[2J")
+		}
+		writeTopFrame(&frame, st, prev, cur, now.Sub(prevAt))
+		if _, err := w.Write(frame.Bytes()); err != nil {
+			return err
+		}
+		if opts.iterations > 0 && n >= opts.iterations {
+			return nil
+		}
+		prev, prevAt = cur, now
+	}
+}
+
+// sampleProcs reads the stat and command line of every container process, those `kill
+// --all` signals.
+func sampleProcs(st *state.ContainerState) map[int]topSample {
+	out := map[int]topSample{}
+	pids, _ := killTargets(st)
+	for _, pid := range pids {
+		ps, err := readProcStat(pid)
+		if err != nil {
+			continue
+		}
+		out[pid] = topSample{stat: ps, cmdline: procCmdline(ps)}
+	}
+	return out
+}
+
+func writeTopFrame(w io.Writer, st *state.ContainerState, prev, cur map[int]topSample, elapsed time.Duration) {
+	pids := make([]int, 0, len(cur))
+	for pid := range cur {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	cpu := func(pid int) float64 {
+		c, p := cur[pid].stat, prev[pid].stat
+		if p == nil || elapsed <= 0 {
+			return 0
+		}
+		ticks := float64(c.utime + c.stime - p.utime - p.stime)
+		return ticks / clockTicks / elapsed.Seconds() * 100
+	}
+	var totalCPU float64
+	var totalRSS int64
+	for _, pid := range pids {
+		totalCPU += cpu(pid)
+		totalRSS += cur[pid].stat.rss * int64(os.Getpagesize())
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "CONTAINER\tSTATUS\tPIDS\tCPU%%\tRSS\tCGROUP MEM\n")
+	cgMem := "-"
+	if cg, err := cgroups.ForPid(st.Pid); err == nil {
+		if s, err := cg.Stats(); err == nil {
+			cgMem = formatBytes(int64(s.Memory.Usage))
+			if s.Memory.Limit > 0 {
+				cgMem += " / " + formatBytes(int64(s.Memory.Limit))
+			}
+		}
+	}
+	fmt.Fprintf(tw, "%s\t%s\t%d\t%.1f\t%s\t%s\n", st.ID, st.Status, len(pids), totalCPU, formatBytes(totalRSS), cgMem)
+	tw.Flush()
+	fmt.Fprintln(w)
+	tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "PID\tPPID\tS\tCPU%%\tRSS\tTIME\tCOMMAND\n")
+	for _, pid := range pids {
+		s := cur[pid]
+		cpuTime := time.Duration(s.stat.utime+s.stat.stime) * time.Second / clockTicks
+		fmt.Fprintf(tw, "%d\t%d\t%s\t%.1f\t%s\t%s\t%s\n", pid, s.stat.ppid, s.stat.state, cpu(pid),
+			formatBytes(s.stat.rss*int64(os.Getpagesize())), cpuTime.Truncate(10*time.Millisecond), s.cmdline)
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+}
+
+// formatBytes renders n in binary units, e.g. 12.3MiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return strconv.FormatInt(n, 10) + "B"
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+
+	"github.com/ktsakalozos/runproc/internal/oci"
+)
+
+// setUser switches init to process.user right before exec: supplementary groups first,
+// then the gid, then the uid, since each step needs the privileges the next one drops.
+// Go applies these to every thread of the process. Without root, and not the root of a
+// user namespace, there is nothing to switch to, so the workload keeps runproc's user.
+//
+// With process.capabilities set, the bounding set is reduced before the switch and the
+// other sets are applied after it, with the permitted set kept across setuid, like runc.
+// Without them the capabilities are left to the kernel: root keeps all, others get none.
+func setUser(u oci.User, capabilities *oci.LinuxCapabilities) error {
+	if os.Geteuid() != 0 {
+		return nil
+	}
+	var caps capSets
+	if capabilities != nil {
+		// Capabilities are per thread and this one execs; never unlocked
+		runtime.LockOSThread()
+		caps = parseCapabilities(capabilities)
+		if err := dropBoundingSet(caps.bounding); err != nil {
+			return err
+		}
+		if err := setKeepCaps(true); err != nil {
+			return fmt.Errorf("keep capabilities: %w", err)
+		}
+	}
+	if err := chownStdio(u); err != nil {
+		return err
+	}
+	groups := make([]int, len(u.AdditionalGids))
+	for i, g := range u.AdditionalGids {
+		groups[i] = int(g)
+	}
+	// An empty list drops root's own supplementary groups. A user namespace that denies
+	// setgroups (see setUserMappings) has none to drop
+	if !setgroupsDenied() {
+		if err := syscall.Setgroups(groups); err != nil {
+			return fmt.Errorf("setgroups: %w", err)
+		}
+	} else if len(groups) > 0 {
+		return errRootlessSetgroups
+	}
+	if err := syscall.Setgid(int(u.GID)); err != nil {
+		return fmt.Errorf("setgid %d: %w", u.GID, err)
+	}
+	if err := syscall.Setuid(int(u.UID)); err != nil {
+		return fmt.Errorf("setuid %d: %w", u.UID, err)
+	}
+	if u.Umask != nil {
+		syscall.Umask(int(*u.Umask))
+	}
+	if capabilities != nil {
+		if err := setKeepCaps(false); err != nil {
+			return fmt.Errorf("keep capabilities: %w", err)
+		}
+		return applyCapabilities(caps)
+	}
+	return nil
+}
+
+// chownStdio gives the pipes and sockets on fds 0-2 to process.user, so a non-root
+// workload can reopen its own stdio (/dev/stdout, /proc/self/fd/1), like runc does. They
+// are created by runproc or its caller for this container; terminals, /dev/null and
+// files the caller redirected to are left alone. runproc allocates no PTYs or FIFOs, and
+// its log files are written by the monitor, never opened by the workload.
+func chownStdio(u oci.User) error {
+	for fd := 0; fd <= 2; fd++ {
+		var st syscall.Stat_t
+		if err := syscall.Fstat(fd, &st); err != nil {
+			// Closed
+			continue
+		}
+		if t := st.Mode & syscall.S_IFMT; t != syscall.S_IFIFO && t != syscall.S_IFSOCK {
+			continue
+		}
+		if st.Uid == u.UID && st.Gid == u.GID {
+			continue
+		}
+		if err := syscall.Fchown(fd, int(u.UID), int(u.GID)); err != nil {
+			if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EINVAL) {
+				// In a user namespace: the node's pipe is not its root's to give away, or
+				// the user is not mapped
+				continue
+			}
+			return fmt.Errorf("chown stdio fd %d: %w", fd, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/ktsakalozos/runproc/internal/oci"
+	"github.com/ktsakalozos/runproc/internal/state"
+)
+
+// usernsInitCommand is the internal command that starts init from inside a user namespace
+// joined by path (see startInUserns).
+const usernsInitCommand = "userns-init"
+
+// The fork hooks of the runtime, which package syscall brackets its own forks with.
+//
+//go:linkname beforeFork syscall.runtime_BeforeFork
+func beforeFork()
+
+//go:linkname afterFork syscall.runtime_AfterFork
+func afterFork()
+
+//go:linkname afterForkInChild syscall.runtime_AfterForkInChild
+func afterForkInChild()
+
+// checkUserns checks the spec's user namespace at create. A new one needs uidMappings and
+// gidMappings that map the container's root, which init runs as; a joined one keeps its
+// own mappings. Mappings without a user namespace would map nothing.
+func checkUserns(spec *oci.Spec) error {
+	if spec.Linux == nil {
+		return nil
+	}
+	l := spec.Linux
+	switch {
+	case !createsNamespace(spec, oci.UserNamespace) && !joinsNamespace(spec, oci.UserNamespace):
+		if len(l.UIDMappings) > 0 || len(l.GIDMappings) > 0 {
+			return errors.New("linux.uidMappings and linux.gidMappings need a user namespace in linux.namespaces")
+		}
+		return nil
+	case l.IntelRdt != nil:
+		// The resctrl files are the node root's
+		return errors.New("linux.intelRdt cannot be combined with a user namespace")
+	case joinsNamespace(spec, oci.UserNamespace):
+		return nil
+	case len(l.UIDMappings) == 0 || len(l.GIDMappings) == 0:
+		return errors.New("a new user namespace needs linux.uidMappings and linux.gidMappings")
+	}
+	for name, ids := range map[string][]oci.LinuxIDMapping{"linux.uidMappings": l.UIDMappings, "linux.gidMappings": l.GIDMappings} {
+		root := false
+		for _, id := range ids {
+			if id.Size == 0 {
+				return fmt.Errorf("%s: an id mapping of size 0 maps nothing", name)
+			}
+			root = root || id.ContainerID == 0
+		}
+		if !root {
+			return fmt.Errorf("%s must map the container's root (id 0), which init runs as", name)
+		}
+	}
+	return nil
+}
+
+// setUserMappings has init forked into a new user namespace with the spec's mappings
+// become the namespace's root, with the full capabilities there. setgroups stays allowed
+// in it, for process.user.additionalGids.
+//
+// Without root (see checkRootless) init already is that root, the caller's ids mapped. The
+// kernel lets runproc write a mapping of its own ids alone, with setgroups denied; any
+// other is left for delegateIDMaps, which setUserMappings reports.
+func setUserMappings(attr *syscall.SysProcAttr, l *oci.Linux) (delegate bool) {
+	root := os.Geteuid() == 0
+	if !root && (!ownIDOnly(l.UIDMappings) || !ownIDOnly(l.GIDMappings)) {
+		return true
+	}
+	attr.UidMappings = sysIDMaps(l.UIDMappings)
+	attr.GidMappings = sysIDMaps(l.GIDMappings)
+	if root {
+		attr.GidMappingsEnableSetgroups = true
+		attr.Credential = &syscall.Credential{}
+	}
+	return false
+}
+
+// shareState opens the container's state to its init, which runs as the container's root
+// in a user namespace and so as an unprivileged id on the node: the host gid of that root
+// (from the gid_map of init at pid) gets to read it (see state.Share). The rootfs mount
+// point is made here, as init can no longer create it.
+func shareState(stateDir, id string, pid int) error {
+	gid, err := hostID(fmt.Sprintf("/proc/%d/gid_map", pid), 0)
+	if err != nil {
+		return err
+	}
+	if err := os.Mkdir(filepath.Join(stateDir, id, rootfsMountName), 0o700); err != nil && !errors.Is(err, os.ErrExist) {
+		return err
+	}
+	if err := state.Share(stateDir, id, gid); err != nil {
+		return fmt.Errorf("open state to the user namespace: %w", err)
+	}
+	return nil
+}
+
+// hostID maps id through a uid_map or gid_map file.
+func hostID(path string, id int) (int, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		var inside, outside, size int
+		if n, _ := fmt.Sscan(line, &inside, &outside, &size); n == 3 && id >= inside && id-inside < size {
+			return outside + id - inside, nil
+		}
+	}
+	return 0, fmt.Errorf("%s does not map %d", path, id)
+}
+
+// usernsInit is what the userns-init command needs to start init as create would have.
+type usernsInit struct {
+	Args       []string `json:"args"`
+	Dir        string   `json:"dir"`
+	Cloneflags uintptr  `json:"cloneflags"`
+	Setsid     bool     `json:"setsid"`
+	// Stdio and Files are the fds of init's stdio and extra files, kept open across the
+	// exec; Report is the pipe the pid of init goes to.
+	Stdio  [3]int `json:"stdio"`
+	Files  []int  `json:"files"`
+	Report int    `json:"report"`
+}
+
+// startInUserns starts cmd as the child of a process in the user namespace ns, so
+// the namespaces cmd is cloned into belong to it. A multi-threaded Go process cannot setns
+// into a user namespace, but a fork of it is a single thread: runproc forks without
+// exec.Cmd, joins the namespace in the child (as its root) and execs runproc userns-init
+// there, which starts cmd as our child (CLONE_PARENT) and exits, so `run` can wait for it.
+// An orphan would not come back to a subreaper of ours from a joined pid namespace: its
+// init would get it. The thread calling it has joined the namespaces to join already; its
+// child inherits them.
+func startInUserns(cmd *exec.Cmd, ns *os.File) error {
+	path := ns.Name()
+	spec := usernsInit{Args: cmd.Args, Dir: cmd.Dir, Cloneflags: cmd.SysProcAttr.Cloneflags, Setsid: cmd.SysProcAttr.Setsid}
+	var keep []int
+	for i, s := range []any{cmd.Stdin, cmd.Stdout, cmd.Stderr} {
+		f, ok := s.(*os.File)
+		if !ok {
+			return errors.New("init in a joined user namespace needs files for stdio")
+		}
+		spec.Stdio[i] = int(f.Fd())
+		keep = append(keep, spec.Stdio[i])
+	}
+	for _, f := range cmd.ExtraFiles {
+		spec.Files = append(spec.Files, int(f.Fd()))
+		keep = append(keep, int(f.Fd()))
+	}
+	reportR, reportW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer reportR.Close()
+	defer reportW.Close()
+	spec.Report = int(reportW.Fd())
+	keep = append(keep, spec.Report)
+	errR, errW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer errR.Close()
+	defer errW.Close()
+	b, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	// Everything the child uses is prepared here: it must not allocate
+	argv0, err := syscall.BytePtrFromString("/proc/self/exe")
+	if err != nil {
+		return err
+	}
+	argv, err := syscall.SlicePtrFromStrings([]string{cmd.Args[0], usernsInitCommand, string(b)})
+	if err != nil {
+		return err
+	}
+	env := cmd.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	envv, err := syscall.SlicePtrFromStrings(env)
+	if err != nil {
+		return err
+	}
+	pid, errno := forkIntoUserns(int(ns.Fd()), keep, int(errW.Fd()), argv0, &argv[0], &envv[0])
+	// Our copies: only the child's may keep the pipes open
+	reportW.Close()
+	errW.Close()
+	if errno != 0 {
+		return fmt.Errorf("fork into user namespace: %w", errno)
+	}
+	// The child reports a failed step before exec
+	var failure [16]byte
+	if n, _ := io.ReadFull(errR, failure[:]); n == len(failure) {
+		_, _ = syscall.Wait4(pid, nil, 0, nil)
+		step, errno := binary.NativeEndian.Uint64(failure[:8]), syscall.Errno(binary.NativeEndian.Uint64(failure[8:]))
+		return fmt.Errorf("join user namespace %s: %s: %w", path, usernsSteps[step], errno)
+	}
+	line, _ := bufio.NewReader(reportR).ReadString('\n')
+	var ws syscall.WaitStatus
+	_, _ = syscall.Wait4(pid, &ws, 0, nil)
+	initPid, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil || ws.ExitStatus() != 0 {
+		return fmt.Errorf("start init in user namespace %s: userns-init %v", path, ws)
+	}
+	// create only needs the pid; init is no child of cmd's to wait for
+	cmd.Process, err = os.FindProcess(initPid)
+	return err
+}
+
+// The steps of the child of forkIntoUserns, as it reports a failed one.
+var usernsSteps = []string{"keep fds", "setns", "setresgid", "setresuid", "exec"}
+
+// forkIntoUserns forks a child that keeps the fds keep open across exec, joins the user
+// namespace userns as its root and execs argv0. A failed step is written to errFd as the
+// step and the errno, each a uint64. The child runs as a copy of this process with a
+// single thread: between the fork and the exec it must only make raw system calls, as
+// syscall.forkAndExecInChild does.
+//
+//go:norace
+//go:noinline
+func forkIntoUserns(userns int, keep []int, errFd int, argv0 *byte, argv, envv **byte) (int, syscall.Errno) {
+	beforeFork()
+	r1, _, e := syscall.RawSyscall6(syscall.SYS_CLONE, uintptr(syscall.SIGCHLD), 0, 0, 0, 0, 0)
+	if e != 0 || r1 != 0 {
+		afterFork()
+		return int(r1), e
+	}
+	afterForkInChild()
+	var failure [2]uint64
+	for _, fd := range keep {
+		if _, _, e = syscall.RawSyscall(syscall.SYS_FCNTL, uintptr(fd), syscall.F_SETFD, 0); e != 0 {
+			goto fail
+		}
+	}
+	failure[0]++
+	if _, _, e = syscall.RawSyscall(sysSetns, uintptr(userns), syscall.CLONE_NEWUSER, 0); e != 0 {
+		goto fail
+	}
+	// The node's groups mean nothing in the namespace; it may refuse setgroups altogether
+	syscall.RawSyscall(syscall.SYS_SETGROUPS, 0, 0, 0)
+	failure[0]++
+	if _, _, e = syscall.RawSyscall(syscall.SYS_SETRESGID, 0, 0, 0); e != 0 {
+		goto fail
+	}
+	failure[0]++
+	if _, _, e = syscall.RawSyscall(syscall.SYS_SETRESUID, 0, 0, 0); e != 0 {
+		goto fail
+	}
+	failure[0]++
+	_, _, e = syscall.RawSyscall(syscall.SYS_EXECVE, uintptr(unsafe.Pointer(argv0)), uintptr(unsafe.Pointer(argv)), uintptr(unsafe.Pointer(envv)))
+fail:
+	failure[1] = uint64(e)
+	syscall.RawSyscall(syscall.SYS_WRITE, uintptr(errFd), uintptr(unsafe.Pointer(&failure)), unsafe.Sizeof(failure))
+	for {
+		syscall.RawSyscall(syscall.SYS_EXIT_GROUP, 253, 0, 0)
+	}
+}
+
+// cmdUsernsInit is the userns-init command: it starts init as described by arg, a
+// usernsInit, as a child of runproc rather than its own, reports its pid and exits.
+func cmdUsernsInit(arg string) error {
+	var spec usernsInit
+	if err := json.Unmarshal([]byte(arg), &spec); err != nil {
+		return err
+	}
+	report := os.NewFile(uintptr(spec.Report), "report")
+	defer report.Close()
+	// Through /proc: as the namespace's root, runproc's dir may be out of reach
+	cmd := exec.Command("/proc/self/exe", spec.Args[1:]...)
+	cmd.Args[0] = spec.Args[0]
+	cmd.Dir = spec.Dir
+	cmd.Stdin = os.NewFile(uintptr(spec.Stdio[0]), "stdin")
+	cmd.Stdout = os.NewFile(uintptr(spec.Stdio[1]), "stdout")
+	cmd.Stderr = os.NewFile(uintptr(spec.Stdio[2]), "stderr")
+	for _, fd := range spec.Files {
+		cmd.ExtraFiles = append(cmd.ExtraFiles, os.NewFile(uintptr(fd), "init-file"))
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: spec.Setsid, Cloneflags: spec.Cloneflags | syscall.CLONE_PARENT}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start init: %w", err)
+	}
+	_, err := fmt.Fprintln(report, cmd.Process.Pid)
+	return err
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"debug/elf"
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/ktsakalozos/runproc/internal/oci"
+)
+
+// Set at link time, e.g. -ldflags "-X main.version=v0.3.0 -X main.buildVariant=static".
+// The Makefile build targets fill all of them in; plain `go build` falls back to the
+// VCS stamp in the build info for the commit and date.
+var (
+	version      = "dev"
+	gitCommit    = ""
+	buildDate    = ""
+	buildVariant = "default"
+)
+
+// buildVariants describes the variants the Makefile knows how to produce.
+var buildVariants = map[string]string{
+	"default":    "regular go build; may link libc when cgo is available",
+	"static":     "pure Go (CGO_ENABLED=0, netgo/osusergo), stripped; no runtime dependencies",
+	"static-pie": "cgo linked with -static-pie, stripped; no runtime dependencies",
+	"wasmtime":   "cgo build with wasmtime-go embedded for WASM workloads (-tags wasmtime)",
+}
+
+// versionInfo is what `runproc version` reports; it is also the --format json output.
+type versionInfo struct {
+	Version    string `json:"version"`
+	Commit     string `json:"commit"`
+	BuildDate  string `json:"buildDate"`
+	GoVersion  string `json:"goVersion"`
+	Platform   string `json:"platform"`
+	OCIVersion string `json:"ociVersion"`
+	Variant    string `json:"buildVariant"`
+	Cgo        string `json:"cgo"`
+	BuildMode  string `json:"buildMode"`
+	Linkage    string `json:"linkage"`
+}
+
+func currentVersion() versionInfo {
+	v := versionInfo{
+		Version:    version,
+		Commit:     gitCommit,
+		BuildDate:  buildDate,
+		GoVersion:  runtime.Version(),
+		Platform:   runtime.GOOS + "/" + runtime.GOARCH,
+		OCIVersion: oci.Version,
+		Variant:    buildVariant,
+		Cgo:        "unknown",
+		BuildMode:  "exe",
+		Linkage:    linkage(),
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "CGO_ENABLED":
+				v.Cgo = map[string]string{"0": "disabled", "1": "enabled"}[s.Value]
+			case "-buildmode":
+				v.BuildMode = s.Value
+			case "vcs.revision":
+				if v.Commit == "" {
+					v.Commit = s.Value
+				}
+			case "vcs.time":
+				if v.BuildDate == "" {
+					v.BuildDate = s.Value
+				}
+			}
+		}
+	}
+	if v.Commit == "" {
+		v.Commit = "unknown"
+	}
+	if v.BuildDate == "" {
+		v.BuildDate = "unknown"
+	}
+	return v
+}
+
+// cmdVersion prints the runproc version, the OCI spec version it implements and how the
+// binary was built, as text or (format "json") a single JSON object.
+func cmdVersion(w io.Writer, format string) error {
+	v := currentVersion()
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case "", "text":
+	default:
+		return fmt.Errorf("unknown format %q (want text or json)", format)
+	}
+	desc, ok := buildVariants[v.Variant]
+	if !ok {
+		desc = "unknown variant"
+	}
+	fmt.Fprintf(w, "runproc version %s\n", v.Version)
+	fmt.Fprintf(w, "commit: %s\n", v.Commit)
+	fmt.Fprintf(w, "built: %s\n", v.BuildDate)
+	fmt.Fprintf(w, "spec: %s\n", v.OCIVersion)
+	fmt.Fprintf(w, "go: %s %s\n", v.GoVersion, v.Platform)
+	fmt.Fprintf(w, "build: %s (%s)\n", v.Variant, desc)
+	fmt.Fprintf(w, "cgo: %s\nbuildmode: %s\nlinkage: %s\n", v.Cgo, v.BuildMode, v.Linkage)
+	return nil
+}
+
+// linkage inspects our own executable: a PT_INTERP header means the dynamic loader (and
+// thus libc) must be present wherever the binary is copied to.
+func linkage() string {
+	f, err := elf.Open("/proc/self/exe")
+	if err != nil {
+		return "unknown"
+	}
+	defer f.Close()
+	for _, p := range f.Progs {
+		if p.Type == elf.PT_INTERP {
+			return "dynamic"
+		}
+	}
+	return "static"
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/ktsakalozos/runproc/internal/oci"
+	"github.com/ktsakalozos/runproc/internal/wasm"
+)
+
+// wasmRunCommand is the internal command init execs for a wasm workload: runproc itself,
+// running the module under the embedded runtime (see cmdWasmRun).
+const wasmRunCommand = "wasm-run"
+
+// wasmExec is what init executes for a wasm workload: runproc's wasm-run and its argv.
+type wasmExec struct {
+	Path string   `json:"path"`
+	Args []string `json:"args"`
+}
+
+// wasmRequested reports whether the workload is a WASM module: runproc.wasm is true, or
+// runproc.wasm is unset and argv[0] ends in .wasm.
+func wasmRequested(spec *oci.Spec) (bool, error) {
+	if v, ok := spec.Annotations[oci.WasmAnnotation]; ok {
+		wasm, err := strconv.ParseBool(v)
+		if err != nil {
+			return false, fmt.Errorf("%s: %q is not a boolean", oci.WasmAnnotation, v)
+		}
+		return wasm, nil
+	}
+	return spec.Process != nil && len(spec.Process.Args) > 0 && strings.HasSuffix(spec.Process.Args[0], ".wasm"), nil
+}
+
+// isWasm is wasmRequested for callers after create, which has rejected bad values.
+func isWasm(spec *oci.Spec) bool {
+	wasm, _ := wasmRequested(spec)
+	return wasm
+}
+
+// prepareWasm builds the wasm-run command for a wasm workload. The module is argv[0]
+// resolved inside the rootfs. The WASI sandbox gets the rootfs as /, the spec's bind
+// mounts as extra directories, and the process env and args; nothing else of the node.
+func prepareWasm(bundle string, spec *oci.Spec) (*wasmExec, error) {
+	if !wasm.Embedded {
+		return nil, fmt.Errorf("wasm workloads: %w", wasm.ErrNotEmbedded)
+	}
+	if spec.Root == nil || spec.Root.Path == "" {
+		return nil, errors.New("wasm workloads need a root.path holding the module")
+	}
+	rootfs := spec.Root.Path
+	if !filepath.IsAbs(rootfs) {
+		rootfs = filepath.Join(bundle, rootfs)
+	}
+	p := spec.Process
+	name := p.Args[0]
+	if !filepath.IsAbs(name) {
+		name = filepath.Join("/", p.Cwd, name)
+	}
+	path, err := resolveInRoot(rootfs, name)
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := os.Stat(path); err != nil || !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("wasm module %q not found in the rootfs", p.Args[0])
+	}
+	m := wasm.Module{Path: path, Args: p.Args, Env: p.Env, Dirs: []wasm.Dir{{Host: rootfs, Guest: "/"}}}
+	for _, mnt := range spec.Mounts {
+		flags, _ := parseMountOptions(mnt.Options)
+		if mnt.Type != "bind" && flags&syscall.MS_BIND == 0 {
+			// proc, sysfs, tmpfs, ... have no WASI equivalent
+			continue
+		}
+		m.Dirs = append(m.Dirs, wasm.Dir{Host: mnt.Source, Guest: mnt.Destination})
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	// Not isolated: init sees the node's filesystem, and with it this binary
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	return &wasmExec{Path: self, Args: []string{self, wasmRunCommand, string(b)}}, nil
+}
+
+// cmdWasmRun runs the module that spec, a JSON wasm.Module, describes and returns its exit
+// status. Init execs it in place of the workload, confined like any process.
+func cmdWasmRun(spec string) (int, error) {
+	var m wasm.Module
+	if err := json.Unmarshal([]byte(spec), &m); err != nil {
+		return 0, fmt.Errorf("wasm-run: %w", err)
+	}
+	return wasm.Run(m)
+}
@@ -1,3 +1,8 @@
 module github.com/ktsakalozos/runproc
 
 go 1.21
+
+require (
+	github.com/bytecodealliance/wasmtime-go/v20 v20.0.0
+	github.com/opencontainers/runtime-spec v1.2.1
+)
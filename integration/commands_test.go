@@ -0,0 +1,7130 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ktsakalozos/runproc/pkg/runproc"
+)
+
+func TestSpec_HostModeBundleRuns(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+
+	bundle := t.TempDir()
+	cmd := exec.Command(binPath, "spec", "--bundle", bundle, "--host")
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("spec failed: %v", err)
+	}
+	b, err := os.ReadFile(filepath.Join(bundle, "config.json"))
+	if err != nil {
+		t.Fatalf("read generated config: %v", err)
+	}
+	var cfg struct {
+		OCIVersion  string            `json:"ociVersion"`
+		Annotations map[string]string `json:"annotations"`
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		t.Fatalf("decode generated config: %v", err)
+	}
+	if cfg.OCIVersion == "" || cfg.Annotations["runproc.host"] != "1" {
+		t.Fatalf("unexpected generated config: %s", string(b))
+	}
+
+	// A second spec into the same bundle must not overwrite the file
+	cmd = exec.Command(binPath, "spec", "--bundle", bundle)
+	if err := cmd.Run(); err == nil {
+		t.Fatalf("expected spec to refuse overwriting an existing config.json")
+	}
+
+	// The default process is "sh", so feed it a script on stdin
+	stateDir := t.TempDir()
+	id := "itest-spec-" + time.Now().Format("150405.000000000")
+	var out bytes.Buffer
+	cmd = exec.Command(binPath, "run", "--bundle", bundle, id)
+	cmd.Env = append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+	cmd.Stdin = strings.NewReader("echo itest_spec_ok\n")
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "itest_spec_ok") {
+		t.Fatalf("expected output to contain itest_spec_ok, got: %q", out.String())
+	}
+}
+
+func TestCreate_WaitsForInFlightOperation(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+
+	bundle := t.TempDir()
+	cfg := `{
+	  "ociVersion": "1.1.0",
+	  "process": {"args": ["/bin/true"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"]},
+	  "root": {"path": "/"}
+	}`
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	stateDir := t.TempDir()
+	id := "itest-lock-" + time.Now().Format("150405.000000000")
+
+	// Simulate a create that is still in flight in another runproc process
+	lockPath := filepath.Join(stateDir, ".locks", id)
+	if err := os.MkdirAll(filepath.Dir(lockPath), 0o700); err != nil {
+		t.Fatalf("mkdir locks: %v", err)
+	}
+	owner := `{"pid": ` + fmtInt(os.Getpid()) + `, "op": "create"}`
+	if err := os.WriteFile(lockPath, []byte(owner), 0o600); err != nil {
+		t.Fatalf("write lock: %v", err)
+	}
+
+	cmd := exec.Command(binPath, "create", "--bundle", bundle, id)
+	cmd.Env = append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start create: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	// create only opens .locks/.reclaim after finding the lock held, to judge whether its
+	// owner is alive; ours is, so from then on it can only poll
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		if _, err := os.Stat(filepath.Join(filepath.Dir(lockPath), ".reclaim")); err == nil {
+			break
+		}
+		select {
+		case err := <-done:
+			t.Fatalf("create finished while the lock was held: %v", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("create did not contend for the lock within 5s")
+		}
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("create finished while the lock was held: %v", err)
+	default:
+	}
+	if b, err := os.ReadFile(lockPath); err != nil || string(b) != owner {
+		t.Fatalf("the lock is no longer ours: %q, %v", b, err)
+	}
+	if _, err := os.Stat(filepath.Join(stateDir, id, "state.json")); err == nil {
+		t.Fatalf("create did not wait for the in-flight operation")
+	}
+	// Finish the simulated operation; the waiting create must now proceed
+	if err := os.Remove(lockPath); err != nil {
+		t.Fatalf("remove lock: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("create failed after lock release: %v", err)
+	}
+	if st := readState(t, stateDir, id); st.Status != "created" {
+		t.Fatalf("expected status=created, got %q", st.Status)
+	}
+	// Let the init exec /bin/true so nothing lingers after the test
+	start := exec.Command(binPath, "start", id)
+	start.Env = append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+	if err := start.Run(); err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+}
+
+func TestStateFormat_RefusesNewerAndMigratesOlder(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+
+	bundle := t.TempDir()
+	cfg := `{
+	  "ociVersion": "1.1.0",
+	  "process": {"args": ["/bin/true"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"]},
+	  "root": {"path": "/"},
+	  "annotations": {"runproc.host": "1"}
+	}`
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	stateDir := t.TempDir()
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+	id := "itest-state-format"
+	runproc := func(args ...string) (string, error) {
+		cmd := exec.Command(binPath, args...)
+		cmd.Env = env
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+	t.Cleanup(func() { _, _ = runproc("delete", "--force", id) })
+	statePath := filepath.Join(stateDir, id, "state.json")
+	fields := func() map[string]any {
+		t.Helper()
+		b, err := os.ReadFile(statePath)
+		if err != nil {
+			t.Fatalf("read state: %v", err)
+		}
+		var f map[string]any
+		if err := json.Unmarshal(b, &f); err != nil {
+			t.Fatalf("decode state: %v", err)
+		}
+		return f
+	}
+	// edit rewrites state.json the way another runproc version would have written it
+	edit := func(change func(map[string]any)) {
+		t.Helper()
+		f := fields()
+		change(f)
+		b, err := json.Marshal(f)
+		if err != nil {
+			t.Fatalf("encode state: %v", err)
+		}
+		if err := os.WriteFile(statePath, b, 0o600); err != nil {
+			t.Fatalf("write state: %v", err)
+		}
+	}
+
+	// The init inherits create's output, so create must not be waited on through a pipe
+	create := exec.Command(binPath, "create", "--bundle", bundle, id)
+	create.Env = env
+	if err := create.Run(); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	f := fields()
+	createdBy, _ := f["createdBy"].(string)
+	if f["format"] != float64(1) || createdBy == "" {
+		t.Fatalf("expected state format 1 and the creating version recorded, got %v", f)
+	}
+	if out, err := runproc("state", id); err != nil || !strings.Contains(out, `"createdBy": "`+createdBy+`"`) {
+		t.Fatalf("expected state to print createdBy, got %v: %s", err, out)
+	}
+
+	// A newer format is refused by every operation, leaving the state alone
+	edit(func(f map[string]any) { f["format"] = 99 })
+	for _, op := range [][]string{{"state", id}, {"start", id}, {"delete", id}} {
+		out, err := runproc(op...)
+		if err == nil || !strings.Contains(out, "container "+id+" was created by runproc "+createdBy+" and its state is in format 99") {
+			t.Fatalf("expected %s to refuse a newer state format, got %v: %s", op[0], err, out)
+		}
+	}
+
+	// A state from before formats were recorded is read as it is and migrated on request
+	edit(func(f map[string]any) { delete(f, "format"); delete(f, "createdBy") })
+	if out, err := runproc("state", id); err != nil || !strings.Contains(out, `"status": "created"`) {
+		t.Fatalf("expected state of an unversioned container, got %v: %s", err, out)
+	}
+	if _, ok := fields()["format"]; ok {
+		t.Fatalf("expected state not to rewrite the state")
+	}
+	if out, err := runproc("migrate-state"); err != nil || out != id+": migrated from state format 0 to 1\n" {
+		t.Fatalf("expected migrate-state to migrate the container, got %v: %q", err, out)
+	}
+	if f := fields(); f["format"] != float64(1) {
+		t.Fatalf("expected the migrated state in format 1, got %v", f)
+	}
+	if out, err := runproc("migrate-state", id); err != nil || out != id+": state format 1, up to date\n" {
+		t.Fatalf("expected the migrated container up to date, got %v: %q", err, out)
+	}
+
+	// Fields of a newer runproc that this one does not know survive its saves
+	edit(func(f map[string]any) { f["futureField"] = map[string]any{"kept": true} })
+	if out, err := runproc("start", id); err != nil {
+		t.Fatalf("start failed: %v: %s", err, out)
+	}
+	f = fields()
+	if f["status"] != "running" && f["status"] != "stopped" {
+		t.Fatalf("expected start to save the state, got %v", f)
+	}
+	if kept, _ := f["futureField"].(map[string]any); kept["kept"] != true {
+		t.Fatalf("expected the unknown field kept through the save, got %v", f)
+	}
+}
+
+func TestLocks_RecoveredFromDeadOwner(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+
+	bundle := t.TempDir()
+	cfg := `{
+	  "ociVersion": "1.1.0",
+	  "process": {"args": ["/bin/true"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"]},
+	  "root": {"path": "/"},
+	  "annotations": {"runproc.host": "1"}
+	}`
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	stateDir := t.TempDir()
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+	id := "itest-stale-lock"
+	t.Cleanup(func() {
+		del := exec.Command(binPath, "delete", "--force", id)
+		del.Env = env
+		_ = del.Run()
+	})
+
+	// A create killed after recording the container leaves it creating, with its lock
+	crashed := exec.Command(binPath, "create", "--bundle", bundle, id)
+	crashed.Env = append(env, "RUNPROC_FAULTS=handoff:delay=10s")
+	if err := crashed.Start(); err != nil {
+		t.Fatalf("start create: %v", err)
+	}
+	var abandoned minimalContainerState
+	deadline := time.Now().Add(5 * time.Second)
+	for abandoned.Pid == 0 {
+		if time.Now().After(deadline) {
+			_ = crashed.Process.Kill()
+			t.Fatalf("create never recorded its init")
+		}
+		time.Sleep(20 * time.Millisecond)
+		if b, err := os.ReadFile(filepath.Join(stateDir, id, "state.json")); err == nil {
+			_ = json.Unmarshal(b, &abandoned)
+		}
+	}
+	_ = crashed.Process.Kill()
+	_ = crashed.Wait()
+	if abandoned.Status != "creating" {
+		t.Fatalf("expected the abandoned container creating, got %q", abandoned.Status)
+	}
+
+	// The retried create takes the dead create's lock over at once and replaces the container
+	// A file, not a pipe: the new init keeps create's stderr open
+	stderrFile, err := os.Create(filepath.Join(t.TempDir(), "stderr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stderrFile.Close()
+	retry := exec.Command(binPath, "create", "--bundle", bundle, id)
+	retry.Env = env
+	retry.Stderr = stderrFile
+	began := time.Now()
+	err = retry.Run()
+	stderr, _ := os.ReadFile(stderrFile.Name())
+	if err != nil {
+		t.Fatalf("retried create failed: %v\n%s", err, stderr)
+	}
+	if waited := time.Since(began); waited > 3*time.Second {
+		t.Fatalf("retried create waited %s for a dead owner", waited)
+	}
+	want := "recovered the lock of " + id + " from pid " + strconv.Itoa(crashed.Process.Pid) + ", whose create ended"
+	if !strings.Contains(string(stderr), want) || !strings.Contains(string(stderr), "abandoned by a create that died") {
+		t.Fatalf("expected the recovery reported, got:\n%s", stderr)
+	}
+	st := readState(t, stateDir, id)
+	if st.Status != "created" || st.Pid == abandoned.Pid {
+		t.Fatalf("expected a new created container, got %+v", st)
+	}
+	if procRunning(abandoned.Pid) {
+		t.Fatalf("the abandoned init %d is still running", abandoned.Pid)
+	}
+
+	// A lock left by a dead kill does not hold up start; the container's audit.log has it
+	gone := exec.Command("/bin/true")
+	if err := gone.Run(); err != nil {
+		t.Fatalf("run true: %v", err)
+	}
+	owner := `{"pid": ` + strconv.Itoa(gone.Process.Pid) + `, "op": "kill", "since": "2026-01-01T00:00:00Z"}`
+	if err := os.WriteFile(filepath.Join(stateDir, ".locks", id), []byte(owner), 0o600); err != nil {
+		t.Fatalf("write lock: %v", err)
+	}
+	start := exec.Command(binPath, "start", id)
+	start.Env = env
+	if out, err := start.CombinedOutput(); err != nil {
+		t.Fatalf("start failed: %v\n%s", err, out)
+	}
+	b, err := os.ReadFile(filepath.Join(stateDir, id, "audit.log"))
+	if err != nil {
+		t.Fatalf("read audit.log: %v", err)
+	}
+	var ev struct {
+		Event string `json:"event"`
+		Op    string `json:"op"`
+		Pid   int    `json:"pid"`
+	}
+	if err := json.Unmarshal(b, &ev); err != nil {
+		t.Fatalf("parse audit.log %q: %v", b, err)
+	}
+	if ev.Event != "stale_lock_recovered" || ev.Op != "kill" || ev.Pid != gone.Process.Pid {
+		t.Fatalf("unexpected audit event: %+v", ev)
+	}
+	stats := exec.Command(binPath, "stats", "--runtime", "--format", "prometheus")
+	stats.Env = env
+	out, err := stats.Output()
+	if err != nil {
+		t.Fatalf("stats --runtime failed: %v", err)
+	}
+	for _, series := range []string{`runproc_stale_locks_recovered_total{op="create"} 1`, `runproc_stale_locks_recovered_total{op="kill"} 1`} {
+		if !strings.Contains(string(out), series+"\n") {
+			t.Fatalf("expected %s, got:\n%s", series, out)
+		}
+	}
+}
+
+func TestFeatures_JSON(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+
+	out, err := exec.Command(binPath, "features").Output()
+	if err != nil {
+		t.Fatalf("features failed: %v", err)
+	}
+	var f struct {
+		OCIVersionMin string `json:"ociVersionMin"`
+		OCIVersionMax string `json:"ociVersionMax"`
+		Linux         *struct {
+			Namespaces []string `json:"namespaces"`
+		} `json:"linux"`
+		Annotations map[string]string `json:"annotations"`
+	}
+	if err := json.Unmarshal(out, &f); err != nil {
+		t.Fatalf("decode features: %v\n%s", err, out)
+	}
+	if f.OCIVersionMin == "" || f.OCIVersionMax == "" || f.Linux == nil {
+		t.Fatalf("incomplete features document: %s", out)
+	}
+	if !strings.Contains(f.Annotations["runproc.annotations"], "runproc.host") {
+		t.Fatalf("expected runproc.host among understood annotations, got %q", f.Annotations["runproc.annotations"])
+	}
+}
+
+func TestAnnotations_EnvInterpolation(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("requires root: host mode only changes behavior when runproc would chroot")
+	}
+	binPath := buildRunproc(t)
+
+	// The rootfs does not exist, so the run only succeeds if the interpolated
+	// annotation turns host mode on and the chroot is skipped.
+	bundle := t.TempDir()
+	cfg := `{
+	  "ociVersion": "1.1.0",
+	  "process": {
+	    "args": ["/bin/sh", "-c", "echo itest_interp_ok"],
+	    "cwd": "/",
+	    "env": ["PATH=/usr/bin:/bin", "ITEST_HOST_MODE=1"]
+	  },
+	  "root": {"path": "does-not-exist"},
+	  "annotations": {"runproc.host": "${ITEST_HOST_MODE}"}
+	}`
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	stateDir := t.TempDir()
+	id := "itest-interp-" + time.Now().Format("150405.000000000")
+	var out bytes.Buffer
+	cmd := exec.Command(binPath, "run", "--bundle", bundle, id)
+	cmd.Env = append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "itest_interp_ok") {
+		t.Fatalf("expected host-mode run via interpolated annotation, got: %q", out.String())
+	}
+}
+
+func TestRunDetached_MonitorRecordsExit(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+
+	bundle := t.TempDir()
+	cfg := `{
+	  "ociVersion": "1.1.0",
+	  "process": {
+	    "args": ["/bin/sh", "-c", "sleep 0.5; echo itest_detached_ok; exit 3"],
+	    "cwd": "/",
+	    "env": ["PATH=/usr/bin:/bin"]
+	  },
+	  "root": {"path": "/"}
+	}`
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	stateDir := t.TempDir()
+	id := "itest-detach-" + time.Now().Format("150405.000000000")
+
+	cmd := exec.Command(binPath, "run", "-d", "--bundle", bundle, id)
+	cmd.Env = append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("run -d failed: %v", err)
+	}
+	if st := readState(t, stateDir, id); st.Status != "running" {
+		t.Fatalf("expected status=running right after run -d, got %q", st.Status)
+	}
+
+	// The monitor, not us, records the exit status; wait reads it back
+	var out bytes.Buffer
+	wait := exec.Command(binPath, "wait", id)
+	wait.Env = append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+	wait.Stdout = &out
+	wait.Stderr = os.Stderr
+	if err := wait.Run(); err != nil {
+		t.Fatalf("wait failed: %v", err)
+	}
+	if strings.TrimSpace(out.String()) != "3" {
+		t.Fatalf("expected wait to print exit code 3, got %q", out.String())
+	}
+	if st := readState(t, stateDir, id); st.Status != "stopped" || st.ExitCode == nil || *st.ExitCode != 3 {
+		t.Fatalf("expected stopped with exitCode=3, got %q %v", st.Status, st.ExitCode)
+	}
+	b, err := os.ReadFile(filepath.Join(stateDir, id, "console.log"))
+	if err != nil {
+		t.Fatalf("read console.log: %v", err)
+	}
+	if !strings.Contains(string(b), `"log":"itest_detached_ok\n"`) {
+		t.Fatalf("expected captured output in console.log, got: %s", b)
+	}
+}
+
+func TestKill_DryRunListsTargetsWithoutSignalling(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+
+	bundle := t.TempDir()
+	cfg := `{"ociVersion": "1.1.0", "process": {"args": ["/bin/sh", "-c", "sleep 300 & setsid sleep 301 & wait"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"]}, "root": {"path": "/"}}`
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	stateDir := t.TempDir()
+	id := "itest-killdry"
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+	runproc := func(args ...string) (string, error) {
+		cmd := exec.Command(binPath, args...)
+		cmd.Env = env
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		return string(out), err
+	}
+	if _, err := runproc("run", "-d", "--bundle", bundle, id); err != nil {
+		t.Fatalf("run -d failed: %v", err)
+	}
+	t.Cleanup(func() { _, _ = runproc("delete", "--force", id) })
+	initPid := readState(t, stateDir, id).Pid
+
+	// Wait for both sleeps, then preview a kill --all
+	var out string
+	deadline := time.Now().Add(3 * time.Second)
+	for strings.Count(out, "sleep 30") < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("dry run did not list both sleeps:\n%s", out)
+		}
+		time.Sleep(50 * time.Millisecond)
+		var err error
+		if out, err = runproc("kill", "--all", "--dry-run", id, "SIGKILL"); err != nil {
+			t.Fatalf("kill --dry-run failed: %v", err)
+		}
+	}
+	if !strings.HasPrefix(out, "would send signal 9 (killed) to 3 process(es) of "+id) || !strings.Contains(out, "\n"+fmtInt(initPid)+" ") {
+		t.Fatalf("unexpected dry run output:\n%s", out)
+	}
+	// Without --all only the init is targeted
+	out, err := runproc("kill", "--dry-run", id)
+	if err != nil {
+		t.Fatalf("kill --dry-run failed: %v", err)
+	}
+	if lines := strings.Split(strings.TrimSpace(out), "\n"); len(lines) != 3 || !strings.HasPrefix(lines[2], fmtInt(initPid)+" ") || !strings.Contains(lines[0], "signal 15") {
+		t.Fatalf("unexpected dry run output for the init only:\n%s", out)
+	}
+	// Any signal by name, in any case and with or without SIG, or by number up to SIGRTMAX
+	for sig, want := range map[string]string{"KILL": "9", "usr1": "10", "SIGWINCH": "28", "SigPwr": "30", "34": "34", "64": "64"} {
+		out, err := runproc("kill", "--dry-run", id, sig)
+		if err != nil || !strings.HasPrefix(out, "would send signal "+want+" ") {
+			t.Fatalf("kill --dry-run %s: expected signal %s, got %v:\n%s", sig, want, err, out)
+		}
+	}
+	// Unknown ones fail instead of falling back to SIGTERM
+	for _, sig := range []string{"SIGBOGUS", "TERMINATE", "0", "65"} {
+		cmd := exec.Command(binPath, "kill", id, sig)
+		cmd.Env = env
+		if out, err := cmd.CombinedOutput(); err == nil || !strings.Contains(string(out), "signal") {
+			t.Fatalf("kill %s: expected an invalid signal error, got %v:\n%s", sig, err, out)
+		}
+	}
+	if !procRunning(initPid) || readState(t, stateDir, id).Status != "running" {
+		t.Fatalf("dry run signalled the container")
+	}
+}
+
+func TestDelete_ArchivesConsoleLog(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+
+	writeBundle := func(namespace, pod string) string {
+		bundle := t.TempDir()
+		cfg := `{
+		  "ociVersion": "1.1.0",
+		  "process": {"args": ["/bin/sh", "-c", "echo itest_archive_ok"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"]},
+		  "root": {"path": "/"},
+		  "annotations": {
+		    "io.kubernetes.cri.sandbox-namespace": "` + namespace + `",
+		    "io.kubernetes.cri.sandbox-name": "` + pod + `"
+		  }
+		}`
+		if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		return bundle
+	}
+	top := t.TempDir()
+	archive := filepath.Join(top, "logs", "archive")
+	nodeCfg := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(nodeCfg, []byte("[logs]\narchive_dir = \""+archive+"\"\n"), 0o644); err != nil {
+		t.Fatalf("write node config: %v", err)
+	}
+	stateDir := t.TempDir()
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir, "RUNPROC_CONFIG="+nodeCfg)
+	runAndDelete := func(bundle, id string) {
+		t.Helper()
+		for _, args := range [][]string{
+			{"run", "-d", "--bundle", bundle, id},
+			{"wait", id},
+			{"delete", id},
+		} {
+			cmd := exec.Command(binPath, args...)
+			cmd.Env = env
+			cmd.Stderr = os.Stderr
+			if err := cmd.Run(); err != nil {
+				t.Fatalf("%s failed: %v", args[0], err)
+			}
+		}
+	}
+	readArchived := func(namespace, pod, id string) {
+		t.Helper()
+		archived := filepath.Join(archive, namespace, pod, time.Now().UTC().Format("2006-01-02"), id, "console.log")
+		b, err := os.ReadFile(archived)
+		if err != nil {
+			t.Fatalf("read archived log: %v", err)
+		}
+		if !strings.Contains(string(b), "itest_archive_ok") {
+			t.Fatalf("archived log lacks container output: %s", b)
+		}
+	}
+
+	id := "itest-archive-" + time.Now().Format("150405.000000000")
+	runAndDelete(writeBundle("itest-ns", "itest-pod"), id)
+	readArchived("itest-ns", "itest-pod", id)
+
+	// Sandbox names that would climb out of the archive are replaced, not followed
+	id = "itest-archive-escape"
+	runAndDelete(writeBundle("../../escape", ".."), id)
+	readArchived("_", "_", id)
+	if _, err := os.Stat(filepath.Join(top, "escape")); !os.IsNotExist(err) {
+		t.Fatalf("expected nothing archived outside the archive dir, stat err=%v", err)
+	}
+}
+
+func TestLogFormat_TextAndStderrMirroring(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+	logPath := filepath.Join(t.TempDir(), "runtime.log")
+
+	// Errors go to the --log file in logrus text format and, by default, to stderr too
+	var stderr bytes.Buffer
+	cmd := exec.Command(binPath, "--log", logPath, "--log-format", "text", "state", "missing")
+	cmd.Env = append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err == nil {
+		t.Fatalf("expected state of a missing container to fail")
+	}
+	b, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("read log: %v", err)
+	}
+	if !strings.HasPrefix(string(b), "time=") || !strings.Contains(string(b), "level=error msg=") {
+		t.Fatalf("expected a logrus-style text entry, got: %q", b)
+	}
+	if stderr.Len() == 0 {
+		t.Fatalf("expected the error on stderr by default")
+	}
+
+	// With mirroring disabled the error only lands in the (appended, JSON) log
+	nodeCfg := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(nodeCfg, []byte("[log]\nmirror_stderr = false\n"), 0o644); err != nil {
+		t.Fatalf("write node config: %v", err)
+	}
+	stderr.Reset()
+	cmd = exec.Command(binPath, "--log", logPath, "--log-format", "json", "state", "missing")
+	cmd.Env = append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir, "RUNPROC_CONFIG="+nodeCfg)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err == nil {
+		t.Fatalf("expected state of a missing container to fail")
+	}
+	if stderr.Len() != 0 {
+		t.Fatalf("expected no stderr output with mirror_stderr=false, got %q", stderr.String())
+	}
+	b, _ = os.ReadFile(logPath)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[1], `{"level":"error"`) {
+		t.Fatalf("expected the JSON entry appended after the text one, got: %q", b)
+	}
+}
+
+func TestKillAll_SignalsWholeProcessTree(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+
+	// The init shell forks two background sleeps; one even escapes into its own session
+	bundle := t.TempDir()
+	cfg := `{
+	  "ociVersion": "1.1.0",
+	  "process": {
+	    "args": ["/bin/sh", "-c", "sleep 300 & setsid sleep 301 & wait"],
+	    "cwd": "/",
+	    "env": ["PATH=/usr/bin:/bin"]
+	  },
+	  "root": {"path": "/"}
+	}`
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	stateDir := t.TempDir()
+	id := "itest-killall-" + time.Now().Format("150405.000000000")
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+
+	cmd := exec.Command(binPath, "run", "-d", "--bundle", bundle, id)
+	cmd.Env = env
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("run -d failed: %v", err)
+	}
+	initPid := readState(t, stateDir, id).Pid
+
+	// Wait for both sleeps to show up as children of the init shell
+	var sleeps []int
+	deadline := time.Now().Add(3 * time.Second)
+	for len(sleeps) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("background sleeps did not start; found %v", sleeps)
+		}
+		time.Sleep(50 * time.Millisecond)
+		b, _ := os.ReadFile(filepath.Join("/proc", fmtInt(initPid), "task", fmtInt(initPid), "children"))
+		sleeps = sleeps[:0]
+		for _, f := range strings.Fields(string(b)) {
+			if n, err := strconv.Atoi(f); err == nil {
+				sleeps = append(sleeps, n)
+			}
+		}
+	}
+
+	kill := exec.Command(binPath, "kill", "--all", id, "KILL")
+	kill.Env = env
+	kill.Stderr = os.Stderr
+	if err := kill.Run(); err != nil {
+		t.Fatalf("kill --all failed: %v", err)
+	}
+	deadline = time.Now().Add(3 * time.Second)
+	for _, pid := range append(sleeps, initPid) {
+		for procRunning(pid) {
+			if time.Now().After(deadline) {
+				t.Fatalf("pid %d survived kill --all", pid)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+}
+
+// procRunning reports whether pid exists and is not a zombie.
+func procRunning(pid int) bool {
+	b, err := os.ReadFile(filepath.Join("/proc", fmtInt(pid), "stat"))
+	if err != nil {
+		return false
+	}
+	s := string(b)
+	fields := strings.Fields(s[strings.LastIndexByte(s, ')')+1:])
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+func TestKillAll_ReachesProcessesThatLeftTheTree(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	if os.Geteuid() != 0 || runproc.Features().Cgroup.Driver != "cgroupfs" {
+		t.Skip("needs root and cgroupfs to give the container a cgroup")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+	cli := func(args ...string) *exec.Cmd {
+		cmd := exec.Command(binPath, args...)
+		cmd.Env = env
+		cmd.Stderr = os.Stderr
+		return cmd
+	}
+
+	// start runs a container whose shell double-forks a sleep into a session of its own:
+	// neither in the init's session nor below it in the process tree, only in its cgroup
+	start := func(id string) (initPid, escaped int) {
+		bundle := t.TempDir()
+		pidFile := filepath.Join(bundle, "escaped")
+		cfg := `{
+		  "ociVersion": "1.1.0",
+		  "process": {
+		    "args": ["/bin/sh", "-c", "(setsid sh -c 'echo $$ > ` + pidFile + `; exec sleep 302' &); exec sleep 300"],
+		    "cwd": "/",
+		    "env": ["PATH=/usr/bin:/bin"]
+		  },
+		  "root": {"path": "/"},
+		  "linux": {"cgroupsPath": "/itest-runproc-` + id + `", "resources": {"pids": {"limit": 32}}}
+		}`
+		if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		if err := cli("run", "-d", "--bundle", bundle, id).Run(); err != nil {
+			t.Fatalf("run -d failed: %v", err)
+		}
+		t.Cleanup(func() { _ = cli("delete", "--force", id).Run() })
+		initPid = readState(t, stateDir, id).Pid
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+			b, _ := os.ReadFile(pidFile)
+			if n, err := strconv.Atoi(strings.TrimSpace(string(b))); err == nil && procRunning(n) {
+				escaped = n
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("the escaping sleep did not start")
+			}
+		}
+		b, err := os.ReadFile(filepath.Join("/proc", fmtInt(escaped), "stat"))
+		if err != nil {
+			t.Fatalf("stat of the escaping sleep: %v", err)
+		}
+		s := string(b)
+		if f := strings.Fields(s[strings.LastIndexByte(s, ')')+1:]); f[1] == fmtInt(initPid) || f[3] == fmtInt(initPid) {
+			t.Fatalf("the sleep did not leave the init's tree and session: %s", s)
+		}
+		return initPid, escaped
+	}
+	waitGone := func(what string, pids ...int) {
+		deadline := time.Now().Add(3 * time.Second)
+		for _, pid := range pids {
+			for procRunning(pid) {
+				if time.Now().After(deadline) {
+					t.Fatalf("pid %d survived %s", pid, what)
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+		}
+	}
+
+	id := "killall-cg-" + time.Now().Format("150405.000000000")
+	initPid, escaped := start(id)
+	out, err := cli("kill", "--all", "--dry-run", id, "KILL").Output()
+	if err != nil {
+		t.Fatalf("kill --dry-run failed: %v", err)
+	}
+	if !strings.Contains(string(out), "\n"+fmtInt(escaped)+" ") {
+		t.Fatalf("dry run does not list pid %d of the cgroup:\n%s", escaped, out)
+	}
+	if err := cli("kill", "--all", id, "KILL").Run(); err != nil {
+		t.Fatalf("kill --all failed: %v", err)
+	}
+	waitGone("kill --all", initPid, escaped)
+
+	// A forced delete kills it as well
+	id = "delete-cg-" + time.Now().Format("150405.000000000")
+	initPid, escaped = start(id)
+	if err := cli("delete", "--force", id).Run(); err != nil {
+		t.Fatalf("delete --force failed: %v", err)
+	}
+	waitGone("delete --force", initPid, escaped)
+}
+
+func TestCheckpoint_DumpsIntoImagePath(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+	bundle := t.TempDir()
+	cfg := `{"ociVersion": "1.1.0", "process": {"args": ["/bin/sleep", "300"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"]}, "root": {"path": "/"}}`
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	cli := func(args ...string) *exec.Cmd {
+		return exec.Command(binPath, append([]string{"--root", stateDir}, args...)...)
+	}
+	id := "itest-checkpoint"
+	if out, err := cli("run", "-d", "--bundle", bundle, id).CombinedOutput(); err != nil {
+		t.Fatalf("run -d failed: %v\n%s", err, out)
+	}
+	t.Cleanup(func() { _ = cli("delete", "--force", id).Run() })
+	initPid := readState(t, stateDir, id).Pid
+	work := t.TempDir()
+
+	// Without criu nothing is written and the container keeps running
+	images := filepath.Join(work, "images")
+	cmd := cli("checkpoint", "--image-path", images, "--leave-running", id)
+	cmd.Env = append(os.Environ(), "PATH="+t.TempDir())
+	if out, err := cmd.CombinedOutput(); err == nil || !strings.Contains(string(out), "checkpoint requires criu in PATH") {
+		t.Fatalf("expected checkpoint to fail without criu, got %v:\n%s", err, out)
+	}
+	if _, err := os.Stat(images); !os.IsNotExist(err) {
+		t.Fatalf("checkpoint without criu made the image path: %v", err)
+	}
+	if st := readState(t, stateDir, id); st.Status != "running" || !procRunning(initPid) {
+		t.Fatalf("container not left running after a failed checkpoint: %s", st.Status)
+	}
+
+	if _, err := exec.LookPath("criu"); err != nil || os.Geteuid() != 0 {
+		t.Skip("criu dump needs criu in PATH and root")
+	}
+	// --leave-running dumps the tree into the image path, with dump.log next to the images
+	if out, err := cli("checkpoint", "--image-path", images, "--leave-running", id).CombinedOutput(); err != nil {
+		t.Fatalf("checkpoint --leave-running failed: %v\n%s", err, out)
+	}
+	for _, f := range []string{"inventory.img", "pstree.img", "core-" + fmtInt(initPid) + ".img", "dump.log"} {
+		if _, err := os.Stat(filepath.Join(images, f)); err != nil {
+			t.Fatalf("checkpoint did not write %s: %v", f, err)
+		}
+	}
+	if st := readState(t, stateDir, id); st.Status != "running" || !procRunning(initPid) {
+		t.Fatalf("container not left running by --leave-running: %s", st.Status)
+	}
+
+	// Without it CRIU kills the tree, and the container is recorded as stopped; the log
+	// goes to --work-path instead
+	images, logs := filepath.Join(work, "images2"), filepath.Join(work, "logs")
+	if out, err := cli("checkpoint", "--image-path", images, "--work-path", logs, id).CombinedOutput(); err != nil {
+		t.Fatalf("checkpoint failed: %v\n%s", err, out)
+	}
+	if _, err := os.Stat(filepath.Join(images, "inventory.img")); err != nil {
+		t.Fatalf("checkpoint did not write its images: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(logs, "dump.log")); err != nil {
+		t.Fatalf("checkpoint did not write dump.log to the work path: %v", err)
+	}
+	if st := readState(t, stateDir, id); st.Status != "stopped" {
+		t.Fatalf("expected status=stopped after checkpoint, got %q", st.Status)
+	}
+	for deadline := time.Now().Add(3 * time.Second); procRunning(initPid); time.Sleep(20 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("init %d still running after checkpoint", initPid)
+		}
+	}
+}
+
+func TestDelete_ForceKillsRunningContainer(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+
+	bundle := t.TempDir()
+	cfg := `{
+	  "ociVersion": "1.1.0",
+	  "process": {"args": ["/bin/sleep", "300"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"]},
+	  "root": {"path": "/"}
+	}`
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	stateDir := t.TempDir()
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+	runproc := func(args ...string) error {
+		cmd := exec.Command(binPath, args...)
+		cmd.Env = env
+		return cmd.Run()
+	}
+
+	// A created-but-never-started init is killed by a plain delete
+	created := "itest-delcreated-" + time.Now().Format("150405.000000000")
+	if err := runproc("create", "--bundle", bundle, created); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	createdPid := readState(t, stateDir, created).Pid
+	if err := runproc("delete", created); err != nil {
+		t.Fatalf("delete of created container failed: %v", err)
+	}
+	if procRunning(createdPid) {
+		t.Fatalf("created init %d survived delete", createdPid)
+	}
+	if _, err := os.Stat(filepath.Join(stateDir, created)); !os.IsNotExist(err) {
+		t.Fatalf("state of %s not removed: %v", created, err)
+	}
+
+	// A running container is only deleted with --force
+	running := "itest-delforce-" + time.Now().Format("150405.000000000")
+	if err := runproc("run", "-d", "--bundle", bundle, running); err != nil {
+		t.Fatalf("run -d failed: %v", err)
+	}
+	pid := readState(t, stateDir, running).Pid
+	if err := runproc("delete", running); err == nil {
+		t.Fatalf("delete of running container succeeded without --force")
+	}
+	if !procRunning(pid) {
+		t.Fatalf("plain delete killed running pid %d", pid)
+	}
+	if err := runproc("delete", "--force", running); err != nil {
+		t.Fatalf("delete --force failed: %v", err)
+	}
+	if procRunning(pid) {
+		t.Fatalf("pid %d survived delete --force", pid)
+	}
+	if _, err := os.Stat(filepath.Join(stateDir, running)); !os.IsNotExist(err) {
+		t.Fatalf("state of %s not removed: %v", running, err)
+	}
+}
+
+func TestInit_ConfigHandOff(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+
+	// More than a pipe buffer (one env string is capped at 128KiB); the hand-off fds must
+	// not reach the workload
+	big := strings.Repeat("x", 100<<10)
+	script := `test ${#BIG} = ` + strconv.Itoa(len(big)) + ` && ls /proc/$$/fd`
+	cfg := `{"ociVersion": "1.1.0", "process": {"args": ["/bin/sh", "-c", "` + script + `"], "cwd": "/", "env": ["PATH=/usr/bin:/bin", "BIG=` + big + `"]}, "root": {"path": "/"}}`
+	bundle := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	var out bytes.Buffer
+	cmd := exec.Command(binPath, "--root", stateDir, "run", "--bundle", bundle, "itest-handoff")
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	if got := strings.Fields(out.String()); !slices.Equal(got, []string{"0", "1", "2"}) {
+		t.Fatalf("workload fds: got %q, want 0 1 2", out.String())
+	}
+}
+
+func TestDelete_AllInParallel(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+	runproc := func(args ...string) error {
+		cmd := exec.Command(binPath, args...)
+		cmd.Env = env
+		cmd.Stderr = os.Stderr
+		return cmd.Run()
+	}
+	bundleFor := func(args string) string {
+		bundle := t.TempDir()
+		cfg := `{"ociVersion": "1.1.0", "process": {"args": ` + args + `, "cwd": "/", "env": ["PATH=/usr/bin:/bin"]}, "root": {"path": "/"}}`
+		if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		return bundle
+	}
+
+	exited := bundleFor(`["/bin/true"]`)
+	for i := 0; i < 6; i++ {
+		if err := runproc("run", "--bundle", exited, "itest-delall-"+strconv.Itoa(i)); err != nil {
+			t.Fatalf("run failed: %v", err)
+		}
+	}
+	running := "itest-delall-running"
+	if err := runproc("run", "-d", "--bundle", bundleFor(`["/bin/sleep", "300"]`), running); err != nil {
+		t.Fatalf("run -d failed: %v", err)
+	}
+	pid := readState(t, stateDir, running).Pid
+
+	// Stopped containers go; the running one is skipped, not an error
+	if err := runproc("delete", "--all", "--parallel", "3"); err != nil {
+		t.Fatalf("delete --all failed: %v", err)
+	}
+	entries, err := os.ReadDir(stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var left []string
+	for _, e := range entries {
+		if e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+			left = append(left, e.Name())
+		}
+	}
+	if len(left) != 1 || left[0] != running || !procRunning(pid) {
+		t.Fatalf("after delete --all: containers %v, pid %d running %v", left, pid, procRunning(pid))
+	}
+
+	if err := runproc("delete", "--all", "--force"); err != nil {
+		t.Fatalf("delete --all --force failed: %v", err)
+	}
+	if procRunning(pid) {
+		t.Fatalf("pid %d survived delete --all --force", pid)
+	}
+	if _, err := os.Stat(filepath.Join(stateDir, running)); !os.IsNotExist(err) {
+		t.Fatalf("state of %s not removed: %v", running, err)
+	}
+	if err := runproc("delete", "--all", "--parallel", "0"); err == nil {
+		t.Fatalf("delete --all --parallel 0 succeeded")
+	}
+}
+
+func TestVersion_ReportsStaticBuildVariant(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+	out, err := exec.Command(binPath, "--version").Output()
+	if err != nil {
+		t.Fatalf("--version failed: %v", err)
+	}
+	if !strings.Contains(string(out), "build: default") {
+		t.Fatalf("unexpected version output for a plain build:\n%s", out)
+	}
+	out, err = exec.Command(binPath, "version", "--format", "json").Output()
+	if err != nil {
+		t.Fatalf("version --format json failed: %v", err)
+	}
+	var v map[string]string
+	if err := json.Unmarshal(out, &v); err != nil {
+		t.Fatalf("version JSON: %v\n%s", err, out)
+	}
+	if v["ociVersion"] != "1.1.0" || v["goVersion"] == "" || v["commit"] == "" || v["buildDate"] == "" {
+		t.Fatalf("version JSON misses build metadata: %v", v)
+	}
+
+	static := filepath.Join(t.TempDir(), "runproc-static")
+	build := exec.Command("make", "build-static", "OUT="+static)
+	build.Dir = projectRoot(t)
+	build.Stdout = os.Stdout
+	build.Stderr = os.Stderr
+	if err := build.Run(); err != nil {
+		t.Fatalf("make build-static failed: %v", err)
+	}
+	out, err = exec.Command(static, "version").Output()
+	if err != nil {
+		t.Fatalf("version failed: %v", err)
+	}
+	for _, want := range []string{"build: static ", "cgo: disabled", "linkage: static"} {
+		if !strings.Contains(string(out), want) {
+			t.Fatalf("version output missing %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestStats_OneShotAndWatch(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	if _, err := os.Stat("/proc/self/cgroup"); err != nil {
+		t.Skip("no cgroups")
+	}
+	binPath := buildRunproc(t)
+
+	bundle := t.TempDir()
+	cfg := `{
+	  "ociVersion": "1.1.0",
+	  "process": {"args": ["/bin/sleep", "1"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"]},
+	  "root": {"path": "/"}
+	}`
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	stateDir := t.TempDir()
+	id := "itest-stats-" + time.Now().Format("150405.000000000")
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+
+	run := exec.Command(binPath, "run", "-d", "--bundle", bundle, id)
+	run.Env = env
+	run.Stderr = os.Stderr
+	if err := run.Run(); err != nil {
+		t.Fatalf("run -d failed: %v", err)
+	}
+
+	stats := exec.Command(binPath, "stats", id)
+	stats.Env = env
+	stats.Stderr = os.Stderr
+	out, err := stats.Output()
+	if err != nil {
+		t.Fatalf("stats failed: %v", err)
+	}
+	var s struct {
+		ID            string          `json:"id"`
+		Cgroup        string          `json:"cgroup"`
+		CgroupVersion int             `json:"cgroupVersion"`
+		CPU           json.RawMessage `json:"cpu"`
+		Memory        json.RawMessage `json:"memory"`
+		Pids          json.RawMessage `json:"pids"`
+		Blkio         json.RawMessage `json:"blkio"`
+	}
+	if err := json.Unmarshal(out, &s); err != nil {
+		t.Fatalf("stats output is not JSON: %v\n%s", err, out)
+	}
+	if s.ID != id || s.Cgroup == "" || (s.CgroupVersion != 1 && s.CgroupVersion != 2) {
+		t.Fatalf("unexpected stats header: %+v", s)
+	}
+	if s.CPU == nil || s.Memory == nil || s.Pids == nil || s.Blkio == nil {
+		t.Fatalf("stats output misses a section:\n%s", out)
+	}
+
+	// --watch streams JSON lines and returns once the container exits
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	watch := exec.CommandContext(ctx, binPath, "stats", "--watch", "--interval", "200ms", id)
+	watch.Env = env
+	watch.Stderr = os.Stderr
+	out, err = watch.Output()
+	if err != nil {
+		t.Fatalf("stats --watch failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) < 1 {
+		t.Fatalf("stats --watch printed nothing")
+	}
+	for _, l := range lines {
+		if !json.Valid([]byte(l)) {
+			t.Fatalf("stats --watch line is not JSON: %q", l)
+		}
+	}
+}
+
+func TestInspect_EffectiveLimits(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+
+	bundle := t.TempDir()
+	cfg := `{
+	  "ociVersion": "1.1.0",
+	  "process": {"args": ["/bin/sleep", "30"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"],
+	    "rlimits": [{"type": "RLIMIT_NOFILE", "soft": 512, "hard": 1024}]},
+	  "root": {"path": "/"},
+	  "linux": {"resources": {"pids": {"limit": 100}}}
+	}`
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	id := "itest-inspect"
+	if out, err := exec.Command(binPath, "--root", stateDir, "run", "-d", "--bundle", bundle, id).CombinedOutput(); err != nil {
+		t.Fatalf("run -d failed: %v\n%s", err, out)
+	}
+	defer exec.Command(binPath, "--root", stateDir, "delete", "--force", id).Run()
+
+	type rlimit struct {
+		Type      string `json:"type"`
+		Soft      uint64 `json:"soft"`
+		Hard      uint64 `json:"hard"`
+		Requested *struct {
+			Soft uint64 `json:"soft"`
+		} `json:"requested"`
+	}
+	var got struct {
+		ID       string   `json:"id"`
+		Starting bool     `json:"starting"`
+		Rlimits  []rlimit `json:"rlimits"`
+		Cpus     string   `json:"cpus"`
+		Cgroup   *struct {
+			Path   string `json:"path"`
+			Limits *struct {
+				Memory json.RawMessage `json:"memory"`
+				Pids   json.RawMessage `json:"pids"`
+				CPU    json.RawMessage `json:"cpu"`
+			} `json:"limits"`
+			Requested struct {
+				Pids struct {
+					Limit int64 `json:"limit"`
+				} `json:"pids"`
+			} `json:"requested"`
+		} `json:"cgroup"`
+	}
+	// Right after start the init may not have exec'd the workload yet
+	var out []byte
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		var err error
+		if out, err = exec.Command(binPath, "--root", stateDir, "inspect", id).Output(); err != nil {
+			t.Fatalf("inspect failed: %v", err)
+		}
+		got.Starting = false
+		if err := json.Unmarshal(out, &got); err != nil {
+			t.Fatalf("inspect output is not JSON: %v\n%s", err, out)
+		}
+		if !got.Starting {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the container is still starting after 5s:\n%s", out)
+		}
+	}
+	if got.ID != id || got.Cpus == "" || len(got.Rlimits) != 16 {
+		t.Fatalf("unexpected inspect report:\n%s", out)
+	}
+	for _, rl := range got.Rlimits {
+		if rl.Type == "RLIMIT_NOFILE" && (rl.Soft != 512 || rl.Hard != 1024 || rl.Requested == nil || rl.Requested.Soft != 512) {
+			t.Fatalf("RLIMIT_NOFILE is reported as %+v, want 512/1024 as requested", rl)
+		}
+		if rl.Type == "RLIMIT_CPU" && rl.Requested != nil {
+			t.Fatalf("RLIMIT_CPU was not requested, got %+v", rl)
+		}
+	}
+	if _, err := os.Stat("/proc/self/cgroup"); err == nil {
+		if got.Cgroup == nil || got.Cgroup.Limits == nil || got.Cgroup.Limits.Memory == nil || got.Cgroup.Limits.Pids == nil || got.Cgroup.Limits.CPU == nil {
+			t.Fatalf("inspect misses the cgroup limits:\n%s", out)
+		}
+		if got.Cgroup.Requested.Pids.Limit != 100 {
+			t.Fatalf("inspect does not show the requested linux.resources:\n%s", out)
+		}
+	}
+
+	if err := exec.Command(binPath, "--root", stateDir, "inspect", "itest-inspect-missing").Run(); err == nil {
+		t.Fatalf("inspect of an unknown container succeeded")
+	}
+}
+
+func TestSnapshot_ArchivesPathsAtExit(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	if _, err := exec.LookPath("zstd"); err != nil {
+		t.Skip("zstd not available")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+	work := t.TempDir()
+
+	runWith := func(id, script, when string) error {
+		cfg := `{"ociVersion": "1.1.0", "process": {"args": ["/bin/sh", "-c", "` + script + `"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"]},
+		  "root": {"path": "/"}, "annotations": {"runproc.host": "1", "runproc.snapshot": "` + work + `/out, ` + work + `/missing",
+		  "runproc.snapshot.when": "` + when + `"}}`
+		bundle := t.TempDir()
+		if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		return exec.Command(binPath, "--root", stateDir, "run", "--bundle", bundle, id).Run()
+	}
+	list := func(id string) string {
+		out, err := exec.Command("sh", "-c", "zstd -dc "+filepath.Join(stateDir, id, "snapshot.tar.zst")+" | tar -t").Output()
+		if err != nil {
+			t.Fatalf("%s: read snapshot: %v", id, err)
+		}
+		return string(out)
+	}
+
+	script := "mkdir -p " + work + "/out && echo 42 > " + work + "/out/result && ln -s /etc/shadow " + work + "/out/link"
+	if err := runWith("itest-snapshot", script, "success"); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	got := list("itest-snapshot")
+	rel := strings.TrimPrefix(work, "/")
+	for _, want := range []string{rel + "/out/\n", rel + "/out/result\n", rel + "/out/link\n"} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("snapshot misses %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "shadow") {
+		t.Fatalf("snapshot followed a symlink:\n%s", got)
+	}
+
+	// A failed job does not take a success-only snapshot, but does take a failure one
+	_ = runWith("itest-snapshot-fail", "exit 3", "success")
+	if _, err := os.Stat(filepath.Join(stateDir, "itest-snapshot-fail", "snapshot.tar.zst")); !os.IsNotExist(err) {
+		t.Fatalf("a success-only snapshot was taken of a failed job: %v", err)
+	}
+	_ = runWith("itest-snapshot-onfail", "exit 3", "failure")
+	if got := list("itest-snapshot-onfail"); !strings.Contains(got, rel+"/out/result\n") {
+		t.Fatalf("failure snapshot misses the result:\n%s", got)
+	}
+
+	if err := runWith("itest-snapshot-bad", "true", "sometimes"); err == nil {
+		t.Fatalf("expected an unknown runproc.snapshot.when to fail the create")
+	}
+}
+
+func TestTime_ReportsLifecycleLatencies(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+
+	// A long-running canary: time must not wait for it to exit
+	bundle := t.TempDir()
+	cfg := `{
+	  "ociVersion": "1.1.0",
+	  "process": {"args": ["/bin/sleep", "300"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"]},
+	  "root": {"path": "/"}
+	}`
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	stateDir := t.TempDir()
+	cmd := exec.Command(binPath, "time", "--count", "3", bundle)
+	cmd.Env = append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("time failed: %v", err)
+	}
+	type summary struct {
+		P50 float64 `json:"p50Ms"`
+		P95 float64 `json:"p95Ms"`
+	}
+	var r struct {
+		Runs   int     `json:"runs"`
+		Create summary `json:"create"`
+		Start  summary `json:"start"`
+		Exec   summary `json:"exec"`
+	}
+	if err := json.Unmarshal(out, &r); err != nil {
+		t.Fatalf("time output is not JSON: %v\n%s", err, out)
+	}
+	if r.Runs != 3 {
+		t.Fatalf("runs = %d, want 3", r.Runs)
+	}
+	for name, s := range map[string]summary{"create": r.Create, "start": r.Start, "exec": r.Exec} {
+		if s.P50 <= 0 || s.P95 < s.P50 {
+			t.Fatalf("bad %s summary: %+v", name, s)
+		}
+	}
+	entries, _ := os.ReadDir(stateDir)
+	for _, e := range entries {
+		// Dot entries are the runtime's own (locks, counters); ids cannot start with '.'
+		if !strings.HasPrefix(e.Name(), ".") {
+			t.Fatalf("canary %s left behind in the state dir", e.Name())
+		}
+	}
+}
+
+func TestFaultInjection_FailurePaths(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+
+	bundle := t.TempDir()
+	cfg := `{
+	  "ociVersion": "1.1.0",
+	  "process": {"args": ["/bin/true"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"]},
+	  "root": {"path": "/"}
+	}`
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	stateDir := t.TempDir()
+	// Output goes through a file: a pipe would keep us waiting on a created init holding it
+	runproc := func(faults string, args ...string) (string, error) {
+		out, err := os.CreateTemp(t.TempDir(), "out")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer out.Close()
+		cmd := exec.Command(binPath, args...)
+		cmd.Env = append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir, "RUNPROC_FAULTS="+faults)
+		cmd.Stdout = out
+		cmd.Stderr = out
+		err = cmd.Run()
+		b, _ := os.ReadFile(out.Name())
+		return string(b), err
+	}
+	newID := func(name string) string { return "itest-fault-" + name + "-" + time.Now().Format("150405.000000000") }
+
+	// A failing create leaves nothing behind
+	for faults, want := range map[string]string{
+		"create":      "injected fault at create",
+		"create:fail": "injected fault at create",
+		"handoff":     "injected fault at handoff",
+		"bogus":       `unknown fault point "bogus"`,
+	} {
+		id := newID("create")
+		out, err := runproc(faults, "create", "--bundle", bundle, id)
+		if err == nil || !strings.Contains(out, want) {
+			t.Fatalf("RUNPROC_FAULTS=%s: expected create to fail with %q, got err=%v out=%q", faults, want, err, out)
+		}
+		if _, err := os.Stat(filepath.Join(stateDir, id)); !os.IsNotExist(err) {
+			t.Fatalf("RUNPROC_FAULTS=%s: state left behind for %s", faults, id)
+		}
+	}
+
+	// Init-stage faults surface as a container exit status of 1 with the reason on stderr
+	for _, point := range []string{"chroot", "exec"} {
+		id := newID(point)
+		if out, err := runproc(point+":fail", "run", "-d", "--bundle", bundle, id); err != nil {
+			t.Fatalf("run -d with %s fault failed: %v: %s", point, err, out)
+		}
+		out, err := runproc("", "wait", id)
+		if err != nil || strings.TrimSpace(out) != "1" {
+			t.Fatalf("%s fault: expected exit code 1, got %q (%v)", point, out, err)
+		}
+		b, _ := os.ReadFile(filepath.Join(stateDir, id, "console.log"))
+		if !strings.Contains(string(b), "injected fault at "+point) {
+			t.Fatalf("%s fault: reason missing from console.log: %s", point, b)
+		}
+	}
+
+	// Delays slow the operation down without failing it
+	id := newID("delay")
+	if out, err := runproc("", "create", "--bundle", bundle, id); err != nil {
+		t.Fatalf("create failed: %v: %s", err, out)
+	}
+	began := time.Now()
+	if out, err := runproc("start:delay=300ms", "start", id); err != nil {
+		t.Fatalf("delayed start failed: %v: %s", err, out)
+	}
+	if d := time.Since(began); d < 300*time.Millisecond {
+		t.Fatalf("start:delay=300ms returned after %v", d)
+	}
+}
+
+func TestCreate_CreatingUntilHandOff(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+
+	bundle := t.TempDir()
+	cfg := `{"ociVersion": "1.1.0", "process": {"args": ["/bin/true"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"]}, "root": {"path": "/"}}`
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	// create holds before the hand-off; output goes to a file, as a created init holds it
+	create := func(id string) *exec.Cmd {
+		out, err := os.Create(filepath.Join(t.TempDir(), "out"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer out.Close()
+		cmd := exec.Command(binPath, "--root", stateDir, "create", "--bundle", bundle, id)
+		cmd.Env = append(os.Environ(), "RUNPROC_FAULTS=handoff:delay=2s")
+		cmd.Stdout, cmd.Stderr = out, out
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		return cmd
+	}
+	status := func(id string) string {
+		b, _ := os.ReadFile(filepath.Join(stateDir, id, "status"))
+		return string(b)
+	}
+	awaitCreating := func(id string) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+			if s := status(id); strings.HasPrefix(s, "status=creating\npid=") && !strings.Contains(s, "pid=0\n") {
+				return
+			}
+		}
+		t.Fatalf("%s never showed as creating with its init pid: %q", id, status(id))
+	}
+
+	cmd := create("itest-creating")
+	awaitCreating("itest-creating")
+	if st := readState(t, stateDir, "itest-creating"); st.Status != "creating" {
+		t.Fatalf("state during the hand-off: %+v", st)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	if st := readState(t, stateDir, "itest-creating"); st.Status != "created" {
+		t.Fatalf("state after create: %+v", st)
+	}
+
+	// A create that dies midway leaves a container that stays creating, which only the
+	// forced delete past its abandoned lock removes
+	cmd = create("itest-abandoned")
+	awaitCreating("itest-abandoned")
+	cmd.Process.Kill()
+	cmd.Wait()
+	time.Sleep(300 * time.Millisecond)
+	if out, _ := exec.Command(binPath, "--root", stateDir, "state", "itest-abandoned").Output(); !strings.Contains(string(out), `"status": "creating"`) {
+		t.Fatalf("state of an abandoned create: %s", out)
+	}
+	if out, err := exec.Command(binPath, "--root", stateDir, "delete", "--force", "itest-abandoned").CombinedOutput(); err != nil {
+		t.Fatalf("delete --force of an abandoned create failed: %v: %s", err, out)
+	}
+	if _, err := os.Stat(filepath.Join(stateDir, "itest-abandoned")); !os.IsNotExist(err) {
+		t.Fatalf("abandoned create left state behind: %v", err)
+	}
+}
+
+func TestAttach_DetachedContainerStdio(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+
+	bundle := t.TempDir()
+	cfg := `{
+	  "ociVersion": "1.1.0",
+	  "process": {
+	    "args": ["/bin/sh", "-c", "while read l; do echo out $l; echo err $l >&2; [ \"$l\" = quit ] && exit 4; done"],
+	    "cwd": "/",
+	    "env": ["PATH=/usr/bin:/bin"]
+	  },
+	  "root": {"path": "/"}
+	}`
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	// A deep state dir exercises the sun_path fallback
+	stateDir := filepath.Join(t.TempDir(), strings.Repeat("d", 60))
+	id := "itest-attach-" + time.Now().Format("150405.000000000")
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+
+	run := exec.Command(binPath, "run", "-d", "--bundle", bundle, id)
+	run.Env = env
+	run.Stderr = os.Stderr
+	if err := run.Run(); err != nil {
+		t.Fatalf("run -d failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	attach := exec.CommandContext(ctx, binPath, "attach", id)
+	attach.Env = env
+	stdin, err := attach.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stdout, stderr bytes.Buffer
+	attach.Stdout = &stdout
+	attach.Stderr = &stderr
+	if err := attach.Start(); err != nil {
+		t.Fatalf("start attach: %v", err)
+	}
+	if _, err := io.WriteString(stdin, "hello\nquit\n"); err != nil {
+		t.Fatalf("write stdin: %v", err)
+	}
+	// attach returns once the container exits
+	if err := attach.Wait(); err != nil {
+		t.Fatalf("attach failed: %v (stderr %q)", err, stderr.String())
+	}
+	if stdout.String() != "out hello\nout quit\n" {
+		t.Fatalf("unexpected attached stdout %q", stdout.String())
+	}
+	if stderr.String() != "err hello\nerr quit\n" {
+		t.Fatalf("unexpected attached stderr %q", stderr.String())
+	}
+	if st := readState(t, stateDir, id); st.ExitCode == nil || *st.ExitCode != 4 {
+		t.Fatalf("expected exit code 4 recorded, got %v", st.ExitCode)
+	}
+}
+
+func TestAttach_StdinOnceAndHalfClose(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+
+	runDetached := func(name, annotations string) string {
+		bundle := t.TempDir()
+		cfg := `{
+		  "ociVersion": "1.1.0",
+		  "process": {
+		    "args": ["/bin/sh", "-c", "while read l; do echo out $l; [ \"$l\" = quit ] && exit 4; done; echo eof; exit 3"],
+		    "cwd": "/",
+		    "env": ["PATH=/usr/bin:/bin"]
+		  },
+		  "root": {"path": "/"},
+		  "annotations": {` + annotations + `}
+		}`
+		if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		id := "itest-stdin-" + name + "-" + time.Now().Format("150405.000000000")
+		run := exec.Command(binPath, "run", "-d", "--bundle", bundle, id)
+		run.Env = env
+		if out, err := run.CombinedOutput(); err != nil {
+			t.Fatalf("run -d failed: %v: %s", err, out)
+		}
+		return id
+	}
+	// attach feeds input and then closes its stdin, returning when the container exits
+	attach := func(id, input string) *exec.Cmd {
+		cmd := exec.Command(binPath, "attach", id)
+		cmd.Env = env
+		cmd.Stdin = strings.NewReader(input)
+		out, err := os.Create(filepath.Join(t.TempDir(), "out"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd.Stdout = out
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("start attach: %v", err)
+		}
+		return cmd
+	}
+	wait := func(cmd *exec.Cmd) string {
+		done := make(chan error, 1)
+		go func() { done <- cmd.Wait() }()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("attach failed: %v", err)
+			}
+		case <-time.After(10 * time.Second):
+			_ = cmd.Process.Kill()
+			t.Fatal("attach did not return after the container exited")
+		}
+		b, _ := os.ReadFile(cmd.Stdout.(*os.File).Name())
+		return string(b)
+	}
+
+	// stdin_once: the first session's EOF reaches the workload, which finishes while
+	// the half-closed session still receives its output
+	id := runDetached("once", `"runproc.stdin_once": "true"`)
+	if out := wait(attach(id, "hello\n")); out != "out hello\neof\n" {
+		t.Fatalf("stdin_once: unexpected attached output %q", out)
+	}
+	if st := readState(t, stateDir, id); st.ExitCode == nil || *st.ExitCode != 3 {
+		t.Fatalf("stdin_once: expected exit code 3 after stdin EOF, got %v", st.ExitCode)
+	}
+
+	// Default: a session ending its input leaves stdin open for the next one
+	id = runDetached("open", "")
+	first := attach(id, "a\n")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b, _ := os.ReadFile(filepath.Join(stateDir, id, "console.log"))
+		if strings.Contains(string(b), "out a") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("first session's input never reached the container: %s", b)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if st := readState(t, stateDir, id); st.Status != "running" {
+		t.Fatalf("expected the container to keep running after the first session's EOF, got %q", st.Status)
+	}
+	second := attach(id, "quit\n")
+	if out := wait(second); out != "out quit\n" {
+		t.Fatalf("second session: unexpected attached output %q", out)
+	}
+	if out := wait(first); out != "out a\nout quit\n" {
+		t.Fatalf("first session: unexpected attached output %q", out)
+	}
+	if st := readState(t, stateDir, id); st.ExitCode == nil || *st.ExitCode != 4 {
+		t.Fatalf("expected exit code 4 from the second session's input, got %v", st.ExitCode)
+	}
+
+	// A malformed value fails the create
+	bundle := t.TempDir()
+	cfg := `{"ociVersion": "1.1.0", "process": {"args": ["/bin/true"], "cwd": "/"}, "root": {"path": "/"}, "annotations": {"runproc.stdin_once": "sometimes"}}`
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	create := exec.Command(binPath, "create", "--bundle", bundle, "itest-stdin-bad")
+	create.Env = env
+	if out, err := create.CombinedOutput(); err == nil || !strings.Contains(string(out), "runproc.stdin_once") {
+		t.Fatalf("expected create to reject runproc.stdin_once=sometimes, got err=%v out=%s", err, out)
+	}
+}
+
+func TestTerminalDetachConsoleSocketRules(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+
+	const (
+		ttyNeedsSocket = "cannot allocate tty if runproc will detach without setting console socket"
+		socketNeedsTTY = "cannot use console socket if runproc will not detach or allocate tty"
+		// Nothing listens on the socket; the rules let it through to the dial
+		noListener = "console socket: dial unix"
+	)
+	bundles := map[bool]string{}
+	for _, terminal := range []bool{false, true} {
+		bundle := t.TempDir()
+		cfg := `{
+		  "ociVersion": "1.1.0",
+		  "process": {"terminal": ` + strconv.FormatBool(terminal) + `, "args": ["/bin/true"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"]},
+		  "root": {"path": "/"}
+		}`
+		if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		bundles[terminal] = bundle
+	}
+	socket := filepath.Join(t.TempDir(), "console.sock")
+	stateDir := t.TempDir()
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+
+	cases := []struct {
+		mode     []string // command and mode flags
+		terminal bool
+		socket   bool
+		want     string // expected error, "" for success
+	}{
+		{[]string{"create"}, false, false, ""},
+		{[]string{"create"}, false, true, socketNeedsTTY},
+		{[]string{"create"}, true, false, ttyNeedsSocket},
+		{[]string{"create"}, true, true, noListener},
+		{[]string{"run", "-d"}, false, false, ""},
+		{[]string{"run", "-d"}, false, true, socketNeedsTTY},
+		{[]string{"run", "-d"}, true, false, ttyNeedsSocket},
+		{[]string{"run", "-d"}, true, true, noListener},
+		{[]string{"run"}, false, false, ""},
+		{[]string{"run"}, false, true, socketNeedsTTY},
+		{[]string{"run"}, true, false, ""},
+		{[]string{"run"}, true, true, socketNeedsTTY},
+	}
+	for i, c := range cases {
+		id := "itest-tty-" + strconv.Itoa(i) + "-" + time.Now().Format("150405.000000000")
+		args := append(append([]string{}, c.mode...), "--bundle", bundles[c.terminal])
+		if c.socket {
+			args = append(args, "--console-socket", socket)
+		}
+		args = append(args, id)
+		// Output goes through a file: a created init would hold a pipe open
+		out, err := os.CreateTemp(t.TempDir(), "out")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd := exec.Command(binPath, args...)
+		cmd.Env = env
+		cmd.Stdout = out
+		cmd.Stderr = out
+		runErr := cmd.Run()
+		out.Close()
+		b, _ := os.ReadFile(out.Name())
+
+		name := strings.Join(c.mode, " ") + " terminal=" + strconv.FormatBool(c.terminal) + " socket=" + strconv.FormatBool(c.socket)
+		if c.want == "" {
+			if runErr != nil {
+				t.Fatalf("%s: expected success, got %v: %s", name, runErr, b)
+			}
+		} else {
+			if runErr == nil || !strings.Contains(string(b), c.want) {
+				t.Fatalf("%s: expected error %q, got err=%v output=%q", name, c.want, runErr, b)
+			}
+			if _, err := os.Stat(filepath.Join(stateDir, id)); !os.IsNotExist(err) {
+				t.Fatalf("%s: rejected container left state behind", name)
+			}
+		}
+		del := exec.Command(binPath, "delete", "--force", id)
+		del.Env = env
+		_ = del.Run()
+	}
+}
+
+func TestTerminal_ConsoleSocketGetsPtyMaster(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("mounts need root")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+
+	bundle := t.TempDir()
+	cfg := `{
+	  "ociVersion": "1.1.0",
+	  "process": {
+	    "terminal": true,
+	    "consoleSize": {"height": 30, "width": 100},
+	    "args": ["/bin/sh", "-c", "tty; stty size; test -t 0 && echo stdin=tty; echo /dev/pts/*"],
+	    "cwd": "/",
+	    "env": ["PATH=/usr/bin:/bin"]
+	  },
+	  "root": {"path": "/"},
+	  "linux": {"namespaces": [{"type": "pid"}, {"type": "mount"}]}
+	}`
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	socket := filepath.Join(t.TempDir(), "console.sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: socket, Net: "unix"})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	masters := make(chan *os.File, 1)
+	go func() {
+		defer close(masters)
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		oob := make([]byte, syscall.CmsgSpace(4))
+		_, oobn, _, _, err := conn.ReadMsgUnix(make([]byte, 4096), oob)
+		if err != nil {
+			return
+		}
+		msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil || len(msgs) != 1 {
+			return
+		}
+		if fds, err := syscall.ParseUnixRights(&msgs[0]); err == nil && len(fds) == 1 {
+			masters <- os.NewFile(uintptr(fds[0]), "pty-master")
+		}
+	}()
+
+	id := "itest-console-socket"
+	runCmd := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command(binPath, args...)
+		cmd.Env = env
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%s failed: %v: %s", args[0], err, out)
+		}
+	}
+	runCmd("create", "--bundle", bundle, "--console-socket", socket, id)
+	defer func() { _ = exec.Command(binPath, "delete", "--force", id).Run() }()
+	master := <-masters
+	if master == nil {
+		t.Fatal("no pty master received on the console socket")
+	}
+	defer master.Close()
+	runCmd("start", id)
+
+	// The pty is the first of the container's own devpts instance. The container holds the
+	// only slave, so reading ends with EIO once it has exited
+	var out bytes.Buffer
+	_, _ = io.Copy(&out, master)
+	if got, want := out.String(), "/dev/pts/0\n30 100\nstdin=tty\n/dev/pts/0 /dev/pts/ptmx\n"; got != want {
+		t.Fatalf("unexpected terminal output %q, want %q", got, want)
+	}
+}
+
+func TestConsole_HandsOutStoredPtyMaster(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("mounts need root")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+
+	bundle := t.TempDir()
+	cfg := `{
+	  "ociVersion": "1.1.0",
+	  "process": {
+	    "terminal": true,
+	    "args": ["/bin/sh", "-c", "read line; echo \"got:$line\""],
+	    "cwd": "/",
+	    "env": ["PATH=/usr/bin:/bin"]
+	  },
+	  "root": {"path": "/"},
+	  "linux": {"namespaces": [{"type": "pid"}, {"type": "mount"}]}
+	}`
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	// listen makes a console socket like a shim's and returns the master sent to it
+	listen := func() (string, <-chan *os.File) {
+		t.Helper()
+		socket := filepath.Join(t.TempDir(), "console.sock")
+		l, err := net.ListenUnix("unix", &net.UnixAddr{Name: socket, Net: "unix"})
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		t.Cleanup(func() { l.Close() })
+		masters := make(chan *os.File, 1)
+		go func() {
+			defer close(masters)
+			conn, err := l.AcceptUnix()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			oob := make([]byte, syscall.CmsgSpace(4))
+			_, oobn, _, _, err := conn.ReadMsgUnix(make([]byte, 4096), oob)
+			if err != nil {
+				return
+			}
+			msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+			if err != nil || len(msgs) != 1 {
+				return
+			}
+			if fds, err := syscall.ParseUnixRights(&msgs[0]); err == nil && len(fds) == 1 {
+				masters <- os.NewFile(uintptr(fds[0]), "pty-master")
+			}
+		}()
+		return socket, masters
+	}
+	receive := func(masters <-chan *os.File) *os.File {
+		t.Helper()
+		select {
+		case m := <-masters:
+			if m == nil {
+				t.Fatal("no pty master received on the console socket")
+			}
+			return m
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for the pty master")
+		}
+		return nil
+	}
+	runCmd := func(args ...string) ([]byte, error) {
+		cmd := exec.Command(binPath, args...)
+		cmd.Env = env
+		return cmd.CombinedOutput()
+	}
+
+	id := "itest-console-store"
+	socket, masters := listen()
+	if out, err := runCmd("create", "--bundle", bundle, "--console-socket", socket, id); err != nil {
+		t.Fatalf("create failed: %v: %s", err, out)
+	}
+	defer func() { _, _ = runCmd("delete", "--force", id) }()
+	// The shim goes away with its master, as in a restart
+	receive(masters).Close()
+
+	socket, masters = listen()
+	if out, err := runCmd("console", "--console-socket", socket, id); err != nil {
+		t.Fatalf("console failed: %v: %s", err, out)
+	}
+	master := receive(masters)
+	defer master.Close()
+	if out, err := runCmd("start", id); err != nil {
+		t.Fatalf("start failed: %v: %s", err, out)
+	}
+	if _, err := io.WriteString(master, "hello\n"); err != nil {
+		t.Fatalf("write to the pty: %v", err)
+	}
+	var out bytes.Buffer
+	_, _ = io.Copy(&out, master)
+	if !strings.Contains(out.String(), "got:hello") {
+		t.Fatalf("terminal output %q lacks the reply to our input", out.String())
+	}
+
+	// Once the init has exited the holder lets go of the master
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		out, err := runCmd("console", "--console-socket", socket, id)
+		if err != nil {
+			if !strings.Contains(string(out), "no stored console") {
+				t.Fatalf("unexpected console error: %v: %s", err, out)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("console still handed out the master after the container exited")
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+func TestCreate_StdioFifos(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+
+	bundle := t.TempDir()
+	cfg := `{
+	  "ociVersion": "1.1.0",
+	  "process": {"args": ["/bin/sh", "-c", "cat; echo eof; echo oops >&2"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"]},
+	  "root": {"path": "/"}
+	}`
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	// Like containerd's, opened by the client and the runtime each from its side
+	dir := t.TempDir()
+	fifos := map[string]string{}
+	for _, name := range []string{"stdin", "stdout", "stderr"} {
+		fifos[name] = filepath.Join(dir, name)
+		if err := syscall.Mkfifo(fifos[name], 0o600); err != nil {
+			t.Fatalf("mkfifo: %v", err)
+		}
+	}
+	type read struct {
+		name string
+		out  []byte
+	}
+	reads := make(chan read, 2)
+	for _, name := range []string{"stdout", "stderr"} {
+		go func(name string) {
+			f, err := os.Open(fifos[name])
+			if err != nil {
+				reads <- read{name, nil}
+				return
+			}
+			defer f.Close()
+			b, _ := io.ReadAll(f)
+			reads <- read{name, b}
+		}(name)
+	}
+	go func() {
+		f, err := os.OpenFile(fifos["stdin"], os.O_WRONLY, 0)
+		if err != nil {
+			return
+		}
+		_, _ = io.WriteString(f, "hello\n")
+		// The container's cat sees EOF once we close: nobody else holds a writer
+		f.Close()
+	}()
+
+	id := "itest-stdio-fifos"
+	create := exec.Command(binPath, "create", "--bundle", bundle, "--stdin", fifos["stdin"], "--stdout", fifos["stdout"], "--stderr", fifos["stderr"], id)
+	create.Env = env
+	if out, err := create.CombinedOutput(); err != nil {
+		t.Fatalf("create failed: %v: %s", err, out)
+	}
+	defer func() { _ = exec.Command(binPath, "delete", "--force", id).Run() }()
+	start := exec.Command(binPath, "start", id)
+	start.Env = env
+	if out, err := start.CombinedOutput(); err != nil {
+		t.Fatalf("start failed: %v: %s", err, out)
+	}
+	got := map[string]string{}
+	for range []int{0, 1} {
+		select {
+		case r := <-reads:
+			got[r.name] = string(r.out)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("container output did not end; got %q", got)
+		}
+	}
+	if got["stdout"] != "hello\neof\n" || got["stderr"] != "oops\n" {
+		t.Fatalf("unexpected output through the FIFOs: %q", got)
+	}
+
+	// A terminal has its own stdio
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(strings.Replace(cfg, `"process": {`, `"process": {"terminal": true, `, 1)), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	create = exec.Command(binPath, "create", "--bundle", bundle, "--console-socket", filepath.Join(dir, "console.sock"), "--stdout", fifos["stdout"], id+"-tty")
+	create.Env = env
+	if out, err := create.CombinedOutput(); err == nil || !strings.Contains(string(out), "cannot be used with process.terminal") {
+		t.Fatalf("expected the stdio flags refused with a terminal, got err=%v output=%q", err, out)
+	}
+}
+
+func TestRun_PreserveFds(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+
+	// fd 3 is a pipe back to us, fd 4 a listener left non-blocking as socket activation
+	// does; nothing of runproc's own may follow them
+	bundle := t.TempDir()
+	cfg := `{
+	  "ociVersion": "1.1.0",
+	  "process": {"args": ["/bin/sh", "-c", "echo via-fd3 >&3; grep -q '^flags:.*4...$' /proc/self/fdinfo/4 && echo nonblock >&3; test -e /proc/$$/fd/5 || echo no-fd5 >&3"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"]},
+	  "root": {"path": "/"}
+	}`
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: filepath.Join(t.TempDir(), "activated.sock"), Net: "unix"})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	lf, err := l.File()
+	if err != nil {
+		t.Fatalf("listener file: %v", err)
+	}
+	defer lf.Close()
+	// Wrapped while blocking, so handing it to runproc (File.Fd) leaves the flag alone
+	lfd, err := syscall.Dup(int(lf.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := os.NewFile(uintptr(lfd), "listener")
+	defer listener.Close()
+	if err := syscall.SetNonblock(lfd, true); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mode := range [][]string{{"run"}, {"run", "-d"}} {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := "itest-preserve-fds-" + strconv.Itoa(len(mode))
+		cmd := exec.Command(binPath, append(mode, "--preserve-fds", "2", "--bundle", bundle, id)...)
+		cmd.Env = env
+		cmd.ExtraFiles = []*os.File{w, listener}
+		out, runErr := cmd.CombinedOutput()
+		w.Close()
+		if runErr != nil {
+			r.Close()
+			t.Fatalf("%v failed: %v: %s", mode, runErr, out)
+		}
+		// Ends once the container and, for -d, its monitor have closed their copies
+		got, _ := io.ReadAll(r)
+		r.Close()
+		if string(got) != "via-fd3\nnonblock\nno-fd5\n" {
+			t.Fatalf("%v: unexpected output through the preserved fds: %q", mode, got)
+		}
+		if fl, _, _ := syscall.Syscall(syscall.SYS_FCNTL, uintptr(lfd), syscall.F_GETFL, 0); fl&syscall.O_NONBLOCK == 0 {
+			t.Fatalf("%v: the preserved listener was left blocking", mode)
+		}
+		del := exec.Command(binPath, "delete", "--force", id)
+		del.Env = env
+		_ = del.Run()
+	}
+
+	// Only what the caller passed can be preserved
+	cmd := exec.Command(binPath, "create", "--preserve-fds", "1", "--bundle", bundle, "itest-preserve-fds-missing")
+	cmd.Env = env
+	if out, err := cmd.CombinedOutput(); err == nil || !strings.Contains(string(out), "--preserve-fds 1: fd 3 is not open") {
+		t.Fatalf("expected a missing fd refused, got err=%v output=%q", err, out)
+	}
+}
+
+func TestExec_ProcessFileDetachAndPidFile(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("namespaces need root")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+	runproc := func(args ...string) (string, error) {
+		cmd := exec.Command(binPath, args...)
+		cmd.Env = env
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+
+	bundle := t.TempDir()
+	cfg := `{
+	  "ociVersion": "1.1.0",
+	  "process": {"args": ["/bin/sleep", "30"], "cwd": "/", "env": ["PATH=/usr/bin:/bin", "FROM_SPEC=1"]},
+	  "root": {"path": "/"},
+	  "hostname": "itest-exec",
+	  "linux": {"namespaces": [{"type": "pid"}, {"type": "mount"}, {"type": "uts"}]}
+	}`
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	// Output to a file, not a pipe: the init and a detached process keep the stdio they
+	// inherit
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "runproc.log")
+	logFile, err := os.Create(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logFile.Close()
+	detached := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command(binPath, args...)
+		cmd.Env = env
+		cmd.Stdout, cmd.Stderr = logFile, logFile
+		if err := cmd.Run(); err != nil {
+			out, _ := os.ReadFile(logPath)
+			t.Fatalf("%s failed: %v: %s", args[0], err, out)
+		}
+	}
+	detached("create", "--bundle", bundle, "itest-exec")
+	defer runproc("delete", "--force", "itest-exec")
+	if out, err := runproc("exec", "itest-exec", "true"); err == nil || !strings.Contains(out, "container not running: itest-exec") {
+		t.Fatalf("expected exec before start refused, got err=%v output=%q", err, out)
+	}
+	if out, err := runproc("start", "itest-exec"); err != nil {
+		t.Fatalf("start failed: %v: %s", err, out)
+	}
+
+	// The command form runs the spec's process with other args, in the container's
+	// namespaces, and exits with its status; its flags are its own
+	out, err := runproc("exec", "itest-exec", "/bin/sh", "-c", `echo $$ $(cat /proc/sys/kernel/hostname) $FROM_SPEC; exit 3`)
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+		t.Fatalf("expected exec to exit with the process's status 3, got err=%v output=%q", err, out)
+	}
+	if f := strings.Fields(out); len(f) != 3 || f[0] == "1" || f[1] != "itest-exec" || f[2] != "1" {
+		t.Fatalf("expected a process of the container's pid and uts namespaces with its env, got %q", out)
+	}
+
+	// A process.json replaces the process; --detach returns while it runs and --pid-file
+	// has its pid
+	marker := filepath.Join(dir, "marker")
+	proc := `{"args": ["/bin/sh", "-c", "echo $FROM_FILE $FROM_SPEC $(pwd) > ` + marker + `; exec sleep 30"], "cwd": "/tmp", "env": ["PATH=/usr/bin:/bin", "FROM_FILE=1"]}`
+	procFile := filepath.Join(dir, "process.json")
+	if err := os.WriteFile(procFile, []byte(proc), 0o644); err != nil {
+		t.Fatalf("write process: %v", err)
+	}
+	pidFile := filepath.Join(dir, "exec.pid")
+	detached("exec", "--process", procFile, "--detach", "--pid-file", pidFile, "itest-exec")
+	b, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatalf("read pid-file: %v", err)
+	}
+	pid, err := strconv.Atoi(string(b))
+	if err != nil || !procRunning(pid) {
+		t.Fatalf("expected the pid-file to name the running process, got %q", b)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, _ := os.ReadFile(marker)
+		if string(got) == "1 /tmp\n" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the process.json's env and cwd only, got %q", got)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	st, err := runproc("state", "itest-exec")
+	if err != nil {
+		t.Fatalf("state failed: %v: %s", err, st)
+	}
+	var state struct {
+		Pid int `json:"pid"`
+	}
+	if err := json.Unmarshal([]byte(st), &state); err != nil {
+		t.Fatalf("decode state: %v", err)
+	}
+	initNs, _ := os.Readlink(fmt.Sprintf("/proc/%d/ns/pid", state.Pid))
+	execNs, _ := os.Readlink(fmt.Sprintf("/proc/%d/ns/pid", pid))
+	if initNs == "" || execNs != initNs {
+		t.Fatalf("expected the detached process in the init's pid namespace %s, got %s", initNs, execNs)
+	}
+
+	// An invalid process.json fails before anything runs
+	if err := os.WriteFile(procFile, []byte(`{"args": [], "cwd": "tmp"}`), 0o644); err != nil {
+		t.Fatalf("write process: %v", err)
+	}
+	if out, err := runproc("exec", "--process", procFile, "itest-exec"); err == nil || !strings.Contains(out, "process.args must have at least one entry") || !strings.Contains(out, `process.cwd "tmp" must be an absolute path`) {
+		t.Fatalf("expected the invalid process refused, got err=%v output=%q", err, out)
+	}
+}
+
+func TestTop_ListsContainerProcesses(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+
+	bundle := t.TempDir()
+	cfg := `{
+	  "ociVersion": "1.1.0",
+	  "process": {"args": ["/bin/sh", "-c", "sleep 2 & wait"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"]},
+	  "root": {"path": "/"}
+	}`
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	stateDir := t.TempDir()
+	id := "itest-top-" + time.Now().Format("150405.000000000")
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+
+	run := exec.Command(binPath, "run", "-d", "--bundle", bundle, id)
+	run.Env = env
+	run.Stderr = os.Stderr
+	if err := run.Run(); err != nil {
+		t.Fatalf("run -d failed: %v", err)
+	}
+
+	top := exec.Command(binPath, "top", "--interval", "200ms", "--iterations", "1", id)
+	top.Env = env
+	top.Stderr = os.Stderr
+	out, err := top.Output()
+	if err != nil {
+		t.Fatalf("top failed: %v", err)
+	}
+	for _, want := range []string{"CONTAINER", id, "running", "COMMAND", "/bin/sh -c sleep 2 & wait", "sleep 2"} {
+		if !strings.Contains(string(out), want) {
+			t.Fatalf("top output missing %q:\n%s", want, out)
+		}
+	}
+
+	// Without --iterations, top keeps refreshing until the container exits
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	follow := exec.CommandContext(ctx, binPath, "top", "--interval", "200ms", id)
+	follow.Env = env
+	out, err = follow.Output()
+	if err != nil {
+		t.Fatalf("top until exit failed: %v", err)
+	}
+	if !strings.Contains(string(out), "container "+id+" exited") {
+		t.Fatalf("top did not report the exit:\n%s", out)
+	}
+}
+
+func TestRunForeground_TeesOutputToConsoleLog(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+
+	bundle := t.TempDir()
+	cfg := `{
+	  "ociVersion": "1.1.0",
+	  "process": {"args": ["/bin/sh", "-c", "echo to_stdout; echo to_stderr >&2"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"]},
+	  "root": {"path": "/"}
+	}`
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	stateDir := t.TempDir()
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+
+	for _, noLog := range []bool{false, true} {
+		id := "itest-tee-" + strconv.FormatBool(noLog) + "-" + time.Now().Format("150405.000000000")
+		args := []string{"run", "--bundle", bundle, id}
+		if noLog {
+			args = []string{"run", "--no-console-log", "--bundle", bundle, id}
+		}
+		var stdout, stderr bytes.Buffer
+		cmd := exec.Command(binPath, args...)
+		cmd.Env = env
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("run failed: %v (stderr %q)", err, stderr.String())
+		}
+		if stdout.String() != "to_stdout\n" || stderr.String() != "to_stderr\n" {
+			t.Fatalf("caller stdio: stdout=%q stderr=%q", stdout.String(), stderr.String())
+		}
+		b, err := os.ReadFile(filepath.Join(stateDir, id, "console.log"))
+		if noLog {
+			if !os.IsNotExist(err) {
+				t.Fatalf("--no-console-log still wrote console.log (%v): %s", err, b)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("read console.log: %v", err)
+		}
+		for _, want := range []string{`"stream":"stdout","log":"to_stdout\n"`, `"stream":"stderr","log":"to_stderr\n"`} {
+			if !strings.Contains(string(b), want) {
+				t.Fatalf("console.log missing %s:\n%s", want, b)
+			}
+		}
+	}
+}
+
+func TestRunNomadCompat_ExitStatusAndCleanup(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+
+	writeBundle := func(args string) string {
+		bundle := t.TempDir()
+		cfg := `{
+		  "ociVersion": "1.1.0",
+		  "process": {"args": ` + args + `, "cwd": "/", "env": ["PATH=/usr/bin:/bin"]},
+		  "root": {"path": "/"}
+		}`
+		if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		return bundle
+	}
+	stateDir := t.TempDir()
+	alloc := "5f1e2a3b-" + time.Now().Format("150405000000000")
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir, "NOMAD_ALLOC_ID="+alloc, "NOMAD_TASK_NAME=web server")
+	id := "nomad-" + alloc + "-web_server"
+
+	// A container left by an earlier attempt of the task
+	stale := exec.Command(binPath, "create", "--bundle", writeBundle(`["/bin/sleep", "60"]`), id)
+	stale.Env = env
+	if err := stale.Run(); err != nil {
+		t.Fatalf("create leftover container: %v", err)
+	}
+	stalePid := readState(t, stateDir, id).Pid
+
+	nomadRun := func(bundle string) (int, string, string) {
+		var stdout, stderr bytes.Buffer
+		cmd := exec.Command(binPath, "run", "--nomad-compat")
+		cmd.Env = env
+		// Nomad starts the task in its task dir, which holds the bundle
+		cmd.Dir = bundle
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		err := cmd.Run()
+		if _, ok := err.(*exec.ExitError); err != nil && !ok {
+			t.Fatalf("run --nomad-compat: %v", err)
+		}
+		return cmd.ProcessState.ExitCode(), stdout.String(), stderr.String()
+	}
+
+	code, stdout, stderr := nomadRun(writeBundle(`["/bin/sh", "-c", "echo task_out; exit 7"]`))
+	if code != 7 || stdout != "task_out\n" {
+		t.Fatalf("expected exit 7 with the task's output, got %d stdout=%q stderr=%q", code, stdout, stderr)
+	}
+	if !strings.Contains(stderr, "left by an earlier attempt") {
+		t.Fatalf("expected a warning about the leftover container, got %q", stderr)
+	}
+	if procRunning(stalePid) {
+		t.Fatalf("leftover container init %d still runs", stalePid)
+	}
+	if _, err := os.Stat(filepath.Join(stateDir, id)); !os.IsNotExist(err) {
+		t.Fatalf("expected the container to be deleted after it exited, stat: %v", err)
+	}
+
+	// Killed by a signal: 128+signal, as a shell reports it
+	if code, _, stderr := nomadRun(writeBundle(`["/bin/sh", "-c", "kill -TERM $$"]`)); code != 128+int(syscall.SIGTERM) {
+		t.Fatalf("expected exit %d for a container killed by SIGTERM, got %d (stderr %q)", 128+int(syscall.SIGTERM), code, stderr)
+	}
+
+	// runproc's own failures are 125
+	if code, _, stderr := nomadRun(t.TempDir()); code != 125 {
+		t.Fatalf("expected exit 125 for a task dir without a bundle, got %d (stderr %q)", code, stderr)
+	}
+}
+
+func TestLogs_TailAndFollow(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+
+	bundle := t.TempDir()
+	cfg := `{
+	  "ociVersion": "1.1.0",
+	  "process": {
+	    "args": ["/bin/sh", "-c", "echo one; echo two >&2; sleep 1; echo three"],
+	    "cwd": "/",
+	    "env": ["PATH=/usr/bin:/bin"]
+	  },
+	  "root": {"path": "/"}
+	}`
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	stateDir := t.TempDir()
+	id := "itest-logs-" + time.Now().Format("150405.000000000")
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+	logs := func(args ...string) (string, string) {
+		var stdout, stderr bytes.Buffer
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, binPath, append([]string{"logs"}, args...)...)
+		cmd.Env = env
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("logs %v failed: %v (stderr %q)", args, err, stderr.String())
+		}
+		return stdout.String(), stderr.String()
+	}
+
+	run := exec.Command(binPath, "run", "-d", "--bundle", bundle, id)
+	run.Env = env
+	run.Stderr = os.Stderr
+	if err := run.Run(); err != nil {
+		t.Fatalf("run -d failed: %v", err)
+	}
+
+	// --follow streams until the container exits, keeping streams apart
+	stdout, stderr := logs("--follow", id)
+	if stdout != "one\nthree\n" || stderr != "two\n" {
+		t.Fatalf("logs --follow: stdout=%q stderr=%q", stdout, stderr)
+	}
+	if stdout, stderr = logs("--tail", "1", id); stdout != "three\n" || stderr != "" {
+		t.Fatalf("logs --tail 1: stdout=%q stderr=%q", stdout, stderr)
+	}
+	if stdout, _ = logs("--timestamps", "--tail", "1", id); !strings.HasSuffix(stdout, "Z three\n") {
+		t.Fatalf("logs --timestamps: %q", stdout)
+	}
+}
+
+func TestMounts_SandboxSharedShm(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("requires root: mounts are only performed for chrooted containers")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+	marker := "itest-shm-" + strconv.Itoa(os.Getpid())
+
+	run := func(name, sandbox, script string) string {
+		t.Helper()
+		bundle := t.TempDir()
+		cfg := `{
+		  "ociVersion": "1.1.0",
+		  "process": {"args": ["/bin/sh", "-c", "` + script + `"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"]},
+		  "root": {"path": "/"},
+		  "mounts": [
+		    {"destination": "/dev/shm", "type": "tmpfs", "source": "shm", "options": ["nosuid", "noexec", "nodev", "mode=1777", "size=65536k"]},
+		    {"destination": "/dev/mqueue", "type": "mqueue", "source": "mqueue", "options": ["nosuid", "noexec", "nodev"]}
+		  ],
+		  "annotations": {"io.kubernetes.cri.sandbox-id": "` + sandbox + `"}
+		}`
+		if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		var out bytes.Buffer
+		cmd := exec.Command(binPath, "run", "--bundle", bundle, name)
+		cmd.Env = append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+		cmd.Stdout = &out
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("run %s failed: %v", name, err)
+		}
+		return out.String()
+	}
+
+	run("shm-a", "sandbox-1", "echo shared > /dev/shm/"+marker)
+	if out := run("shm-b", "sandbox-1", "cat /dev/shm/"+marker+"; grep -q ' /dev/mqueue mqueue ' /proc/self/mounts && echo mqueue_ok"); !strings.Contains(out, "shared") || !strings.Contains(out, "mqueue_ok") {
+		t.Fatalf("expected the sandbox's containers to share /dev/shm and see /dev/mqueue, got: %q", out)
+	}
+	if out := run("shm-c", "sandbox-2", "test -e /dev/shm/"+marker+" && echo leaked || echo isolated"); !strings.Contains(out, "isolated") {
+		t.Fatalf("expected another sandbox to get its own /dev/shm, got: %q", out)
+	}
+	if _, err := os.Stat(filepath.Join("/dev/shm", marker)); err == nil {
+		t.Fatalf("container shm write leaked to the host /dev/shm")
+	}
+
+	sandboxDir := func(sandbox string) string { return filepath.Join(stateDir, ".sandboxes", sandbox) }
+	del := func(id string) {
+		t.Helper()
+		cmd := exec.Command(binPath, "delete", id)
+		cmd.Env = append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("delete %s failed: %v", id, err)
+		}
+	}
+	del("shm-a")
+	if _, err := os.Stat(sandboxDir("sandbox-1")); err != nil {
+		t.Fatalf("sandbox shm released while a container of the sandbox remains: %v", err)
+	}
+	del("shm-b")
+	del("shm-c")
+	for _, sandbox := range []string{"sandbox-1", "sandbox-2"} {
+		if _, err := os.Stat(sandboxDir(sandbox)); !os.IsNotExist(err) {
+			t.Fatalf("expected %s shm removed after its last container, stat err: %v", sandbox, err)
+		}
+	}
+}
+
+func TestContainerIDs_ValidationAndTypedErrors(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+
+	bundle := t.TempDir()
+	cfg := `{
+	  "ociVersion": "1.1.0",
+	  "process": {"args": ["/bin/true"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"]},
+	  "root": {"path": "/"}
+	}`
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	parent := t.TempDir()
+	stateDir := filepath.Join(parent, "state")
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+
+	// runproc fails with a message containing want (on stderr and in the --log file)
+	expectError := func(want string, args ...string) {
+		t.Helper()
+		logPath := filepath.Join(t.TempDir(), "log.json")
+		var stderr bytes.Buffer
+		cmd := exec.Command(binPath, append([]string{"--log", logPath}, args...)...)
+		cmd.Env = env
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err == nil {
+			t.Fatalf("%v: expected failure", args)
+		}
+		logged, _ := os.ReadFile(logPath)
+		if !strings.Contains(stderr.String(), want) || !strings.Contains(string(logged), want) {
+			t.Fatalf("%v: expected %q in stderr and log, got stderr %q, log %q", args, want, stderr.String(), logged)
+		}
+	}
+
+	for _, id := range []string{"../escape", "a/b", "a;b", "$(id)", "a b", ".hidden", "+x", strings.Repeat("x", 256)} {
+		expectError("invalid container id", "create", "--bundle", bundle, id)
+	}
+	if _, err := os.Stat(filepath.Join(parent, "escape")); !os.IsNotExist(err) {
+		t.Fatalf("create with ../ id touched the state dir's parent: %v", err)
+	}
+
+	for _, args := range [][]string{{"state", "missing"}, {"kill", "missing", "KILL"}, {"delete", "missing"}, {"start", "missing"}, {"state", "../state"}} {
+		expectError("container does not exist", args...)
+	}
+
+	// A container whose process exited: created again -> exists, killed -> not running
+	id := "itest-ids-" + time.Now().Format("150405.000000000")
+	run := exec.Command(binPath, "run", "--bundle", bundle, id)
+	run.Env = env
+	run.Stderr = os.Stderr
+	if err := run.Run(); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	expectError("container with given ID already exists", "create", "--bundle", bundle, id)
+	expectError("container not running", "kill", id, "TERM")
+
+	del := exec.Command(binPath, "delete", id)
+	del.Env = env
+	del.Stderr = os.Stderr
+	if err := del.Run(); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	// Forced delete of what is already gone stays idempotent
+	del = exec.Command(binPath, "delete", "--force", id)
+	del.Env = env
+	del.Stderr = os.Stderr
+	if err := del.Run(); err != nil {
+		t.Fatalf("delete --force of a deleted container failed: %v", err)
+	}
+}
+
+func TestScratch_SizeLimitedMounts(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("requires root: scratch space is mounted into chrooted containers only")
+	}
+	binPath := buildRunproc(t)
+
+	imageDir := t.TempDir()
+	cfgPath := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(cfgPath, []byte("[scratch]\ndir = \""+imageDir+"\"\n"), 0o644); err != nil {
+		t.Fatalf("write node config: %v", err)
+	}
+	stateDir := t.TempDir()
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir, "RUNPROC_CONFIG="+cfgPath)
+
+	for _, backing := range []string{"tmpfs", "disk"} {
+		t.Run(backing, func(t *testing.T) {
+			if _, err := exec.LookPath("mkfs.ext4"); err != nil && backing == "disk" {
+				t.Skip("mkfs.ext4 not available")
+			}
+			scratch := filepath.Join(t.TempDir(), "scratch")
+			script := "dd if=/dev/zero of=" + scratch + "/small bs=1024 count=1024 2>/dev/null && echo small_ok; " +
+				"dd if=/dev/zero of=" + scratch + "/big bs=1024 count=8192 2>/dev/null || echo big_refused"
+			bundle := t.TempDir()
+			cfg := `{
+			  "ociVersion": "1.1.0",
+			  "process": {"args": ["/bin/sh", "-c", "` + script + `"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"]},
+			  "root": {"path": "/"},
+			  "annotations": {"runproc.scratch": "4Mi", "runproc.scratch.path": "` + scratch + `", "runproc.scratch.backing": "` + backing + `"}
+			}`
+			if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+				t.Fatalf("write config: %v", err)
+			}
+			id := "itest-scratch-" + backing
+			var out bytes.Buffer
+			cmd := exec.Command(binPath, "run", "--bundle", bundle, id)
+			cmd.Env = env
+			cmd.Stdout = &out
+			cmd.Stderr = os.Stderr
+			if err := cmd.Run(); err != nil {
+				t.Fatalf("run failed: %v", err)
+			}
+			if !strings.Contains(out.String(), "small_ok") || !strings.Contains(out.String(), "big_refused") {
+				t.Fatalf("expected 1MiB to fit and 8MiB to be refused in 4Mi of scratch, got: %q", out.String())
+			}
+			if entries, _ := os.ReadDir(scratch); len(entries) != 0 {
+				t.Fatalf("scratch writes leaked to the node path: %v", entries)
+			}
+
+			del := exec.Command(binPath, "delete", id)
+			del.Env = env
+			del.Stderr = os.Stderr
+			if err := del.Run(); err != nil {
+				t.Fatalf("delete failed: %v", err)
+			}
+			if entries, _ := os.ReadDir(imageDir); len(entries) != 0 {
+				t.Fatalf("scratch image left behind after delete: %v", entries)
+			}
+			if mounts, _ := os.ReadFile("/proc/self/mounts"); strings.Contains(string(mounts), filepath.Join(stateDir, id)) {
+				t.Fatalf("scratch still mounted after delete")
+			}
+		})
+	}
+
+	// Without a chroot there is nowhere private to mount scratch space
+	bundle := t.TempDir()
+	cfg := `{
+	  "ociVersion": "1.1.0",
+	  "process": {"args": ["/bin/true"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"]},
+	  "root": {"path": "/"},
+	  "annotations": {"runproc.host": "1", "runproc.scratch": "4Mi"}
+	}`
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command(binPath, "create", "--bundle", bundle, "itest-scratch-host")
+	cmd.Env = env
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err == nil || !strings.Contains(stderr.String(), "requires a chrooted container") {
+		t.Fatalf("expected host-mode scratch to be refused, err %v, stderr %q", err, stderr.String())
+	}
+}
+
+func TestCompletion_ScriptsCompleteContainerIDs(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+
+	bundle := t.TempDir()
+	cfg := `{
+	  "ociVersion": "1.1.0",
+	  "process": {"args": ["/bin/true"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"]},
+	  "root": {"path": "/"}
+	}`
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	stateDir := t.TempDir()
+	id := "itest-complete-" + time.Now().Format("150405.000000000")
+	run := exec.Command(binPath, "--root", stateDir, "run", "--bundle", bundle, id)
+	run.Stderr = os.Stderr
+	if err := run.Run(); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+
+	out, err := exec.Command(binPath, "--root", stateDir, "completion", "ids").Output()
+	if err != nil {
+		t.Fatalf("completion ids failed: %v", err)
+	}
+	if strings.TrimSpace(string(out)) != id {
+		t.Fatalf("expected only %s (no .locks), got %q", id, out)
+	}
+
+	for _, shell := range []string{"bash", "zsh", "fish"} {
+		script, err := exec.Command(binPath, "completion", shell).Output()
+		if err != nil {
+			t.Fatalf("completion %s failed: %v", shell, err)
+		}
+		path := filepath.Join(t.TempDir(), "runproc."+shell)
+		if err := os.WriteFile(path, script, 0o644); err != nil {
+			t.Fatalf("write script: %v", err)
+		}
+		// Syntax-check with the shell itself where it is installed
+		if sh, err := exec.LookPath(shell); err == nil {
+			if out, err := exec.Command(sh, "-n", path).CombinedOutput(); err != nil {
+				t.Fatalf("%s script does not parse: %v\n%s", shell, err, out)
+			}
+		}
+	}
+	if exec.Command(binPath, "completion", "tcsh").Run() == nil {
+		t.Fatalf("expected completion for an unsupported shell to fail")
+	}
+
+	// Drive the bash completion function as bash would for `runproc --root <dir> delete <TAB>`
+	// and `runproc lo<TAB>`
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not available")
+	}
+	script, _ := exec.Command(binPath, "completion", "bash").Output()
+	complete := func(words ...string) string {
+		t.Helper()
+		quoted := make([]string, len(words))
+		for i, w := range words {
+			quoted[i] = strconv.Quote(w)
+		}
+		prog := string(script) + "\nCOMP_WORDS=(" + strings.Join(quoted, " ") + "); COMP_CWORD=" + strconv.Itoa(len(words)-1) +
+			"; _runproc; printf '%s\\n' \"${COMPREPLY[@]}\"\n"
+		cmd := exec.Command("bash", "-c", prog)
+		cmd.Env = append(os.Environ(), "PATH="+filepath.Dir(binPath)+":"+os.Getenv("PATH"))
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("bash completion failed: %v", err)
+		}
+		return string(out)
+	}
+	if got := complete("runproc", "--root", stateDir, "delete", ""); strings.TrimSpace(got) != id {
+		t.Fatalf("expected delete to complete %s, got %q", id, got)
+	}
+	if got := complete("runproc", "lo"); !strings.Contains(got, "logs") {
+		t.Fatalf("expected subcommand completion to offer logs, got %q", got)
+	}
+	if got := complete("runproc", "delete", "--f"); strings.TrimSpace(got) != "--force" {
+		t.Fatalf("expected delete flags to complete --force, got %q", got)
+	}
+}
+
+func TestSpec_FullConfigParsesAndInvalidConfigsFail(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+
+	// A config shaped like the ones containerd generates, using sections runproc does not
+	// act on yet; it must decode and run. Its seccomp profile only denies reboot.
+	full := `{
+	  "ociVersion": "1.1.0",
+	  "process": {
+	    "user": {"uid": 0, "gid": 0, "additionalGids": [0]},
+	    "args": ["/bin/sh", "-c", "echo itest_fullspec_ok"],
+	    "env": ["PATH=/usr/bin:/bin"],
+	    "cwd": "/",
+	    "capabilities": {"bounding": ["CAP_CHOWN"], "effective": ["CAP_CHOWN"], "permitted": ["CAP_CHOWN"]},
+	    "rlimits": [{"type": "RLIMIT_NOFILE", "hard": 1024, "soft": 1024}],
+	    "noNewPrivileges": true,
+	    "oomScoreAdj": 0
+	  },
+	  "root": {"path": "/"},
+	  "hostname": "itest",
+	  "mounts": [{"destination": "/proc", "type": "proc", "source": "proc"}],
+	  "hooks": {"createRuntime": [{"path": "/bin/true"}]},
+	  "linux": {
+	    "resources": {"devices": [{"allow": false, "access": "rwm"}], "memory": {"limit": 1073741824}, "cpu": {"shares": 512}, "pids": {"limit": 100}},
+	    "cgroupsPath": "/itest",
+	    "namespaces": [{"type": "pid"}, {"type": "ipc"}, {"type": "uts"}, {"type": "mount"}, {"type": "network", "path": "/proc/self/ns/net"}],
+	    "maskedPaths": ["/proc/kcore"],
+	    "readonlyPaths": ["/proc/sys"],
+	    "seccomp": {"defaultAction": "SCMP_ACT_ALLOW", "architectures": ["SCMP_ARCH_X86_64"], "syscalls": [{"names": ["reboot"], "action": "SCMP_ACT_ERRNO"}]}
+	  }
+	}`
+	write := func(cfg string) string {
+		t.Helper()
+		bundle := t.TempDir()
+		if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		return bundle
+	}
+	var out bytes.Buffer
+	cmd := exec.Command(binPath, "run", "--bundle", write(full), "itest-fullspec")
+	cmd.Env = env
+	t.Cleanup(func() {
+		// As root the container has a cgroup of its own, which outlives the state dir
+		del := exec.Command(binPath, "delete", "--force", "itest-fullspec")
+		del.Env = env
+		_ = del.Run()
+	})
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("run of a full runtime-spec config failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "itest_fullspec_ok") {
+		t.Fatalf("unexpected output: %q", out.String())
+	}
+
+	invalid := []struct{ name, cfg, want string }{
+		{"relative cwd", `{"ociVersion": "1.1.0", "process": {"args": ["/bin/true"], "cwd": "tmp"}}`, "process.cwd"},
+		{"no args", `{"ociVersion": "1.1.0", "process": {"cwd": "/"}}`, "process.args"},
+		{"bad version", `{"ociVersion": "2.0.0", "process": {"args": ["/bin/true"], "cwd": "/"}}`, "ociVersion"},
+		{"duplicate namespace", `{"ociVersion": "1.1.0", "process": {"args": ["/bin/true"], "cwd": "/"}, "linux": {"namespaces": [{"type": "pid"}, {"type": "pid"}]}}`, "linux.namespaces"},
+		{"unknown rlimit", `{"ociVersion": "1.1.0", "process": {"args": ["/bin/true"], "cwd": "/", "rlimits": [{"type": "RLIMIT_BOGUS", "hard": 1, "soft": 1}]}}`, "process.rlimits"},
+		{"relative hook", `{"ociVersion": "1.1.0", "process": {"args": ["/bin/true"], "cwd": "/"}, "hooks": {"poststop": [{"path": "true"}]}}`, "hooks.poststop[0].path"},
+		{"env without =", `{"ociVersion": "1.1.0", "process": {"args": ["/bin/true"], "cwd": "/", "env": ["PATH=/bin", "DEBUG"]}}`, "process.env[1]"},
+		{"env without name", `{"ociVersion": "1.1.0", "process": {"args": ["/bin/true"], "cwd": "/", "env": ["=1"]}}`, "process.env[0]"},
+		{"env with NUL", `{"ociVersion": "1.1.0", "process": {"args": ["/bin/true"], "cwd": "/", "env": ["A=x\u0000y"]}}`, "NUL byte"},
+	}
+	for _, tc := range invalid {
+		var stderr bytes.Buffer
+		cmd := exec.Command(binPath, "create", "--bundle", write(tc.cfg), "itest-badspec")
+		cmd.Env = env
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err == nil {
+			t.Fatalf("%s: expected create to fail", tc.name)
+		}
+		if !strings.Contains(stderr.String(), "invalid spec") || !strings.Contains(stderr.String(), tc.want) {
+			t.Fatalf("%s: expected an invalid spec error naming %s, got %q", tc.name, tc.want, stderr.String())
+		}
+	}
+}
+
+func TestEnv_DuplicatesLastValueWins(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+
+	cfg := `{"ociVersion": "1.1.0", "process": {"args": ["env"], "cwd": "/",
+	  "env": ["PATH=/usr/bin:/bin", "MODE=debug", "EMPTY=", "MODE=release"]}, "root": {"path": "/"}, "annotations": {"runproc.host": "1"}}`
+	bundle := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	var out bytes.Buffer
+	cmd := exec.Command(binPath, "--root", stateDir, "run", "--bundle", bundle, "itest-env")
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	got := strings.Fields(out.String())
+	slices.Sort(got)
+	if want := []string{"EMPTY=", "MODE=release", "PATH=/usr/bin:/bin"}; !slices.Equal(got, want) {
+		t.Fatalf("workload env: got %q, want %q", got, want)
+	}
+}
+
+func TestCPUs_ExclusivePoolPinning(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+
+	b, err := os.ReadFile("/sys/devices/system/cpu/online")
+	if err != nil {
+		t.Skipf("cannot read online CPUs: %v", err)
+	}
+	online := strings.TrimSpace(string(b))
+	// Use the highest online CPU as a one-CPU pool
+	last := online[strings.LastIndexAny(online, ",-")+1:]
+	reservations := t.TempDir()
+	cfgPath := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(cfgPath, []byte("[cpus]\npool = \""+last+"\"\nreservations_dir = \""+reservations+"\"\n"), 0o644); err != nil {
+		t.Fatalf("write node config: %v", err)
+	}
+	stateDir := t.TempDir()
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir, "RUNPROC_CONFIG="+cfgPath)
+
+	bundle := func(annotations string) string {
+		dir := t.TempDir()
+		cfg := `{
+		  "ociVersion": "1.1.0",
+		  "process": {"args": ["/bin/sleep", "30"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"]},
+		  "root": {"path": "/"},
+		  "annotations": {` + annotations + `}
+		}`
+		if err := os.WriteFile(filepath.Join(dir, "config.json"), []byte(cfg), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		return dir
+	}
+	pinned := bundle(`"runproc.cpus": "1"`)
+	runDetached := func(id, bundle string) (string, error) {
+		var stderr bytes.Buffer
+		cmd := exec.Command(binPath, "run", "-d", "--bundle", bundle, id)
+		cmd.Env = env
+		cmd.Stderr = &stderr
+		err := cmd.Run()
+		if err == nil {
+			t.Cleanup(func() {
+				del := exec.Command(binPath, "delete", "--force", id)
+				del.Env = env
+				_ = del.Run()
+			})
+		}
+		return stderr.String(), err
+	}
+	allowed := func(id string) string {
+		t.Helper()
+		status, err := os.ReadFile(filepath.Join("/proc", fmtInt(readState(t, stateDir, id).Pid), "status"))
+		if err != nil {
+			t.Fatalf("read status of %s: %v", id, err)
+		}
+		for _, line := range strings.Split(string(status), "\n") {
+			if v, ok := strings.CutPrefix(line, "Cpus_allowed_list:"); ok {
+				return strings.TrimSpace(v)
+			}
+		}
+		t.Fatalf("no Cpus_allowed_list for %s", id)
+		return ""
+	}
+
+	if out, err := runDetached("itest-cpus-a", pinned); err != nil {
+		t.Fatalf("pinned run failed: %v\n%s", err, out)
+	}
+	if got := allowed("itest-cpus-a"); got != last {
+		t.Fatalf("expected itest-cpus-a pinned to CPU %s, got %s", last, got)
+	}
+	if out, err := runDetached("itest-cpus-b", pinned); err == nil || !strings.Contains(out, "CPU pool exhausted") {
+		t.Fatalf("expected a second pinned container to find the pool exhausted, err %v, stderr %q", err, out)
+	}
+	if online != last {
+		// Other containers are kept off the pool
+		if out, err := runDetached("itest-cpus-shared", bundle("")); err != nil {
+			t.Fatalf("unpinned run failed: %v\n%s", err, out)
+		}
+		for _, c := range strings.Split(allowed("itest-cpus-shared"), ",") {
+			if c == last || strings.HasSuffix(c, "-"+last) {
+				t.Fatalf("unpinned container may run on pool CPU %s: %s", last, allowed("itest-cpus-shared"))
+			}
+		}
+	}
+
+	del := exec.Command(binPath, "delete", "--force", "itest-cpus-a")
+	del.Env = env
+	del.Stderr = os.Stderr
+	if err := del.Run(); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(reservations, "itest-cpus-a")); !os.IsNotExist(err) {
+		t.Fatalf("reservation of itest-cpus-a not returned on delete: %v", err)
+	}
+	if out, err := runDetached("itest-cpus-b", pinned); err != nil {
+		t.Fatalf("pinned run after the pool was freed failed: %v\n%s", err, out)
+	}
+}
+
+func TestNamespaces_CreatedFromSpec(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("namespaces need root")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+
+	kinds := []string{"pid", "mnt", "uts", "ipc", "net", "cgroup"}
+	script := `echo pid1=$$; cat /proc/sys/kernel/hostname /proc/sys/kernel/domainname`
+	for _, k := range kinds {
+		script += "; echo " + k + "=$(readlink /proc/self/ns/" + k + ")"
+	}
+	cfg := `{
+	  "ociVersion": "1.1.0",
+	  "process": {"args": ["/bin/sh", "-c", "` + script + `"], "env": ["PATH=/usr/bin:/bin"], "cwd": "/"},
+	  "root": {"path": "/"},
+	  "hostname": "itest-ns",
+	  "domainname": "itest.example",
+	  "linux": {"namespaces": [{"type": "pid"}, {"type": "mount"}, {"type": "uts"}, {"type": "ipc"}, {"type": "network"}, {"type": "cgroup"}]}
+	}`
+	bundle := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	var out bytes.Buffer
+	cmd := exec.Command(binPath, "run", "--bundle", bundle, "itest-ns")
+	cmd.Env = env
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	got := out.String()
+	if !strings.Contains(got, "pid1=1\n") {
+		t.Fatalf("expected the process to be pid 1 of its own pid namespace, got %q", got)
+	}
+	if !strings.Contains(got, "itest-ns\nitest.example\n") {
+		t.Fatalf("expected the spec hostname and domainname inside the container, got %q", got)
+	}
+	host, _ := os.Hostname()
+	domain, _ := os.ReadFile("/proc/sys/kernel/domainname")
+	if host == "itest-ns" || strings.TrimSpace(string(domain)) == "itest.example" {
+		t.Fatalf("container hostname or domainname leaked to the node")
+	}
+	for _, k := range kinds {
+		hostNs, err := os.Readlink("/proc/self/ns/" + k)
+		if err != nil {
+			t.Fatalf("read node %s namespace: %v", k, err)
+		}
+		if !strings.Contains(got, k+"=") || strings.Contains(got, k+"="+hostNs+"\n") {
+			t.Fatalf("expected a new %s namespace (node has %s), got %q", k, hostNs, got)
+		}
+	}
+
+	// Explicit host mode keeps the node's names
+	hostCfg := strings.Replace(cfg, `"root": {"path": "/"},`, `"root": {"path": "/"}, "annotations": {"runproc.host": "1"},`, 1)
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(hostCfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	out.Reset()
+	cmd = exec.Command(binPath, "run", "--bundle", bundle, "itest-ns-host")
+	cmd.Env = env
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("host-mode run failed: %v", err)
+	}
+	if got := out.String(); strings.Contains(got, "itest-ns\n") || !strings.Contains(got, host+"\n") {
+		t.Fatalf("expected a host-mode container to see the node hostname %q, got %q", host, got)
+	}
+
+	// A namespace type runproc cannot create fails the create
+	cfg = strings.Replace(cfg, `{"type": "cgroup"}`, `{"type": "time"}`, 1)
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	var stderr bytes.Buffer
+	cmd = exec.Command(binPath, "create", "--bundle", bundle, "itest-ns-time")
+	cmd.Env = env
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err == nil || !strings.Contains(stderr.String(), "time namespace is not supported") {
+		t.Fatalf("expected create to refuse a time namespace, got err=%v stderr=%q", err, stderr.String())
+	}
+}
+
+func TestLogs_SplitStreamsDiscardAndRotation(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+	bundle := func(script string, annotations string) string {
+		t.Helper()
+		dir := t.TempDir()
+		cfg := `{
+		  "ociVersion": "1.1.0",
+		  "process": {"args": ["/bin/sh", "-c", "` + script + `"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"]},
+		  "root": {"path": "/"},
+		  "annotations": {` + annotations + `}
+		}`
+		if err := os.WriteFile(filepath.Join(dir, "config.json"), []byte(cfg), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		return dir
+	}
+	runproc := func(stdout, stderr io.Writer, args ...string) error {
+		cmd := exec.Command(binPath, args...)
+		cmd.Env = env
+		cmd.Stdout, cmd.Stderr = stdout, stderr
+		return cmd.Run()
+	}
+
+	// Split files rotate independently: chatty stdout rotates, stderr does not
+	split := bundle(`for i in 1 2 3; do echo err-$i >&2; done; sleep 0.5; for i in $(seq 1 40); do echo out-$i; done`,
+		`"runproc.logs.split": "true", "runproc.logs.max_size": "1Ki", "runproc.logs.max_files": "2"`)
+	if err := runproc(io.Discard, os.Stderr, "run", "-d", "--bundle", split, "itest-split"); err != nil {
+		t.Fatalf("run -d failed: %v", err)
+	}
+	if err := runproc(io.Discard, os.Stderr, "wait", "itest-split"); err != nil {
+		t.Fatalf("wait failed: %v", err)
+	}
+	dir := filepath.Join(stateDir, "itest-split")
+	if _, err := os.Stat(filepath.Join(dir, "console.log")); !os.IsNotExist(err) {
+		t.Fatalf("expected no console.log with split streams, stat err=%v", err)
+	}
+	for _, name := range []string{"stdout.log", "stdout.log.1", "stdout.log.2", "stderr.log"} {
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("expected %s: %v", name, err)
+		}
+		if fi.Size() > 1024 {
+			t.Fatalf("%s is %d bytes, over the 1Ki rotation size", name, fi.Size())
+		}
+	}
+	for _, name := range []string{"stdout.log.3", "stderr.log.1"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Fatalf("expected no %s, stat err=%v", name, err)
+		}
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "stdout.log"))
+	if err != nil || strings.Contains(string(b), `"stderr"`) || !strings.Contains(string(b), "out-40") {
+		t.Fatalf("unexpected stdout.log (err=%v): %s", err, b)
+	}
+	var stdout, stderr bytes.Buffer
+	if err := runproc(&stdout, &stderr, "logs", "itest-split"); err != nil {
+		t.Fatalf("logs failed: %v", err)
+	}
+	// The rotated files are read oldest first, so only what fell past max_files is gone
+	lines := strings.Split(strings.TrimSuffix(stdout.String(), "\n"), "\n")
+	live := strings.Count(string(b), "\n")
+	if len(lines) <= live || stderr.String() != "err-1\nerr-2\nerr-3\n" {
+		t.Fatalf("logs of split streams: stdout=%q stderr=%q", stdout.String(), stderr.String())
+	}
+	for i, line := range lines {
+		if want := fmt.Sprintf("out-%d", 40-len(lines)+1+i); line != want {
+			t.Fatalf("logs of split streams: line %d is %q, want %q: stdout=%q", i, line, want, stdout.String())
+		}
+	}
+	// --tail counts across the rotation; stderr came first
+	stdout.Reset()
+	stderr.Reset()
+	if err := runproc(&stdout, &stderr, "logs", "--tail", "20", "itest-split"); err != nil {
+		t.Fatalf("logs --tail failed: %v", err)
+	}
+	var tail strings.Builder
+	for i := 21; i <= 40; i++ {
+		fmt.Fprintf(&tail, "out-%d\n", i)
+	}
+	if stdout.String() != tail.String() || stderr.String() != "" {
+		t.Fatalf("logs --tail of split streams: stdout=%q stderr=%q", stdout.String(), stderr.String())
+	}
+
+	// A discarded stream is still shown by a foreground run but never recorded
+	discard := bundle(`echo kept; echo noisy >&2`, `"runproc.logs.discard": "stderr"`)
+	stdout.Reset()
+	stderr.Reset()
+	if err := runproc(&stdout, &stderr, "run", "--bundle", discard, "itest-discard"); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	if stdout.String() != "kept\n" || !strings.Contains(stderr.String(), "noisy") {
+		t.Fatalf("foreground run output: stdout=%q stderr=%q", stdout.String(), stderr.String())
+	}
+	b, err = os.ReadFile(filepath.Join(stateDir, "itest-discard", "console.log"))
+	if err != nil || !strings.Contains(string(b), "kept") || strings.Contains(string(b), "noisy") {
+		t.Fatalf("expected console.log without stderr (err=%v): %s", err, b)
+	}
+
+	// Node defaults rotate containers without annotations; an annotation overrides them
+	nodeCfg := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(nodeCfg, []byte("[logs]\nmax_size = 1024\nmax_files = 1\n"), 0o644); err != nil {
+		t.Fatalf("write node config: %v", err)
+	}
+	env = append(env, "RUNPROC_CONFIG="+nodeCfg)
+	chatty := `for i in $(seq 1 40); do echo out-$i; done`
+	if err := runproc(io.Discard, os.Stderr, "run", "--bundle", bundle(chatty, ``), "itest-nodelogs"); err != nil {
+		t.Fatalf("run with node log defaults failed: %v", err)
+	}
+	dir = filepath.Join(stateDir, "itest-nodelogs")
+	if _, err := os.Stat(filepath.Join(dir, "console.log.1")); err != nil {
+		t.Fatalf("expected console.log.1 from the node's max_size: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "console.log.2")); !os.IsNotExist(err) {
+		t.Fatalf("expected the node's max_files to keep one rotated file, stat err=%v", err)
+	}
+	if err := runproc(io.Discard, os.Stderr, "run", "--bundle", bundle(chatty, `"runproc.logs.max_files": "0"`), "itest-nodelogs-override"); err != nil {
+		t.Fatalf("run overriding node log defaults failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(stateDir, "itest-nodelogs-override", "console.log.1")); !os.IsNotExist(err) {
+		t.Fatalf("expected runproc.logs.max_files to override the node default, stat err=%v", err)
+	}
+
+	stderr.Reset()
+	bad := bundle(`true`, `"runproc.logs.discard": "both"`)
+	if err := runproc(io.Discard, &stderr, "create", "--bundle", bad, "itest-baddiscard"); err == nil || !strings.Contains(stderr.String(), "runproc.logs.discard") {
+		t.Fatalf("expected create to reject the discard value, got err=%v stderr=%q", err, stderr.String())
+	}
+}
+
+func TestLogs_LongLinesSplitAndFailedWritesDropped(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+	bundle := func(script string) string {
+		t.Helper()
+		dir := t.TempDir()
+		cfg := `{
+		  "ociVersion": "1.1.0",
+		  "process": {"args": ["/bin/sh", "-c", "` + script + `"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"]},
+		  "root": {"path": "/"}
+		}`
+		if err := os.WriteFile(filepath.Join(dir, "config.json"), []byte(cfg), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		return dir
+	}
+
+	// Output without a newline is recorded in 16KiB entries, which logs joins back up
+	long := bundle(`printf %040000d 0 | tr 0 x; echo`)
+	if out, err := exec.Command(binPath, "--root", stateDir, "run", "--bundle", long, "itest-longline").CombinedOutput(); err != nil {
+		t.Fatalf("run failed: %v\n%s", err, out)
+	}
+	b, err := os.ReadFile(filepath.Join(stateDir, "itest-longline", "console.log"))
+	if err != nil {
+		t.Fatalf("read console.log: %v", err)
+	}
+	var sizes []int
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var e struct {
+			Log string `json:"log"`
+		}
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("bad console.log line %q: %v", line, err)
+		}
+		sizes = append(sizes, len(e.Log))
+	}
+	if want := []int{16384, 16384, 40000 - 2*16384 + 1}; !reflect.DeepEqual(sizes, want) {
+		t.Fatalf("expected entries of %v bytes, got %v", want, sizes)
+	}
+	out, err := exec.Command(binPath, "--root", stateDir, "logs", "itest-longline").Output()
+	if err != nil || string(out) != strings.Repeat("x", 40000)+"\n" {
+		t.Fatalf("expected logs to print the line whole, got %d bytes (%v)", len(out), err)
+	}
+
+	// A log that cannot be written (here past RLIMIT_FSIZE, 8KiB in dash's 512-byte
+	// blocks) loses lines, but the workload keeps writing instead of dying of SIGPIPE
+	chatty := bundle(`seq 1 5000 | sed s/^/padding-padding-padding-padding-/; echo last`)
+	cmd := exec.Command("/bin/sh", "-c", `ulimit -f 16; exec "$0" "$@"`, binPath, "--root", stateDir, "run", "--bundle", chatty, "itest-logfull")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("expected the workload to exit 0 with its log full, got %v (stderr %q)", err, stderr.String())
+	}
+	if lines := strings.Count(stdout.String(), "\n"); lines != 5001 || !strings.HasSuffix(stdout.String(), "\nlast\n") {
+		t.Fatalf("expected all 5001 lines on the caller's stdout, got %d", lines)
+	}
+	if !strings.Contains(stderr.String(), "warning: recording stdout") {
+		t.Fatalf("expected a warning about the dropped lines, got %q", stderr.String())
+	}
+	if fi, err := os.Stat(filepath.Join(stateDir, "itest-logfull", "console.log")); err != nil || fi.Size() > 8192 {
+		t.Fatalf("expected console.log cut at the file size limit, got %v (%v)", fi, err)
+	}
+}
+
+func TestSysctl_AppliedInContainerNamespaces(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("namespaces need root")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+
+	runWith := func(id, sysctl, namespaces, annotations string) (string, error) {
+		cfg := `{
+		  "ociVersion": "1.1.0",
+		  "process": {"args": ["/bin/sh", "-c", "cat /proc/sys/net/ipv4/ip_unprivileged_port_start /proc/sys/kernel/shmmni"],
+		    "env": ["PATH=/usr/bin:/bin"], "cwd": "/"},
+		  "root": {"path": "/"},
+		  "annotations": {` + annotations + `},
+		  "linux": {"sysctl": ` + sysctl + `, "namespaces": ` + namespaces + `}
+		}`
+		bundle := t.TempDir()
+		if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		out, err := exec.Command(binPath, "--root", stateDir, "run", "--bundle", bundle, id).CombinedOutput()
+		return string(out), err
+	}
+	nodePort, _ := os.ReadFile("/proc/sys/net/ipv4/ip_unprivileged_port_start")
+	nodeShm, _ := os.ReadFile("/proc/sys/kernel/shmmni")
+
+	out, err := runWith("itest-sysctl", `{"net.ipv4.ip_unprivileged_port_start": "80", "kernel.shmmni": "1024"}`,
+		`[{"type": "mount"}, {"type": "network"}, {"type": "ipc"}]`, "")
+	if err != nil {
+		t.Fatalf("run failed: %v\n%s", err, out)
+	}
+	if out != "80\n1024\n" {
+		t.Fatalf("expected the sysctls inside the container, got %q", out)
+	}
+	if b, _ := os.ReadFile("/proc/sys/net/ipv4/ip_unprivileged_port_start"); string(b) != string(nodePort) {
+		t.Fatalf("net sysctl leaked to the node: %q, was %q", b, nodePort)
+	}
+	if b, _ := os.ReadFile("/proc/sys/kernel/shmmni"); string(b) != string(nodeShm) {
+		t.Fatalf("ipc sysctl leaked to the node: %q, was %q", b, nodeShm)
+	}
+
+	// Sysctls that would change the node fail the create
+	for i, tc := range []struct{ sysctl, namespaces, annotations, want string }{
+		{`{"kernel.pid_max": "65536"}`, `[{"type": "ipc"}]`, "", "not namespaced"},
+		{`{"net.ipv4.ip_forward": "1"}`, `[{"type": "ipc"}]`, "", "needs a network namespace"},
+		{`{"kernel.shmmni": "1024"}`, `[{"type": "ipc"}]`, `"runproc.host": "1"`, "host mode"},
+	} {
+		out, err := runWith("itest-sysctl-bad-"+strconv.Itoa(i), tc.sysctl, tc.namespaces, tc.annotations)
+		if err == nil || !strings.Contains(out, tc.want) {
+			t.Fatalf("%s: expected the create to fail with %q, got %v: %q", tc.sysctl, tc.want, err, out)
+		}
+	}
+}
+
+func TestNamespaces_JoinedByPath(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("namespaces need root")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+	write := func(cfg string) string {
+		t.Helper()
+		bundle := t.TempDir()
+		if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		return bundle
+	}
+
+	// A sandbox-like container owning its namespaces
+	sandbox := write(`{
+	  "ociVersion": "1.1.0",
+	  "process": {"args": ["sleep", "30"], "env": ["PATH=/usr/bin:/bin"], "cwd": "/"},
+	  "root": {"path": "/"},
+	  "hostname": "itest-pod",
+	  "linux": {"namespaces": [{"type": "pid"}, {"type": "mount"}, {"type": "uts"}, {"type": "ipc"}, {"type": "network"}]}
+	}`)
+	run := exec.Command(binPath, "run", "-d", "--bundle", sandbox, "itest-pod")
+	run.Env = env
+	run.Stderr = os.Stderr
+	if err := run.Run(); err != nil {
+		t.Fatalf("run -d failed: %v", err)
+	}
+	t.Cleanup(func() {
+		del := exec.Command(binPath, "delete", "--force", "itest-pod")
+		del.Env = env
+		_ = del.Run()
+	})
+	pid := readState(t, stateDir, "itest-pod").Pid
+	// run -d returns once the sandbox is started, maybe before its init set the hostname
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		if exe, _ := os.Readlink("/proc/" + strconv.Itoa(pid) + "/exe"); exe != binPath || time.Now().After(deadline) {
+			break
+		}
+	}
+
+	kinds := map[string]string{"pid": "pid", "mnt": "mount", "uts": "uts", "ipc": "ipc", "net": "network"}
+	script := `echo pid=$$; cat /proc/sys/kernel/hostname`
+	var nss []string
+	for k, typ := range kinds {
+		script += "; echo " + k + "=$(readlink /proc/self/ns/" + k + ")"
+		nss = append(nss, `{"type": "`+typ+`", "path": "/proc/`+strconv.Itoa(pid)+`/ns/`+k+`"}`)
+	}
+	member := write(`{
+	  "ociVersion": "1.1.0",
+	  "process": {"args": ["/bin/sh", "-c", "` + script + `"], "env": ["PATH=/usr/bin:/bin"], "cwd": "/"},
+	  "root": {"path": "/"},
+	  "linux": {"namespaces": [` + strings.Join(nss, ", ") + `]}
+	}`)
+	var out bytes.Buffer
+	cmd := exec.Command(binPath, "run", "--bundle", member, "itest-member")
+	cmd.Env = env
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("run of the joining container failed: %v", err)
+	}
+	got := out.String()
+	if !strings.Contains(got, "itest-pod\n") {
+		t.Fatalf("expected the sandbox hostname through its uts namespace, got %q", got)
+	}
+	if strings.Contains(got, "pid=1\n") {
+		t.Fatalf("expected to join the sandbox pid namespace, not to be its pid 1: %q", got)
+	}
+	for k := range kinds {
+		want, err := os.Readlink(filepath.Join("/proc", strconv.Itoa(pid), "ns", k))
+		if err != nil {
+			t.Fatalf("read sandbox %s namespace: %v", k, err)
+		}
+		if !strings.Contains(got, k+"="+want+"\n") {
+			t.Fatalf("expected the sandbox %s namespace %s, got %q", k, want, got)
+		}
+	}
+
+	bad := write(`{"ociVersion": "1.1.0", "process": {"args": ["true"], "cwd": "/"}, "root": {"path": "/"},
+	  "linux": {"namespaces": [{"type": "network", "path": "/proc/` + strconv.Itoa(pid) + `/ns/uts"}]}}`)
+	var stderr bytes.Buffer
+	cmd = exec.Command(binPath, "create", "--bundle", bad, "itest-badns")
+	cmd.Env = env
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err == nil || !strings.Contains(stderr.String(), "join network namespace") {
+		t.Fatalf("expected joining a namespace of the wrong type to fail, got err=%v stderr=%q", err, stderr.String())
+	}
+}
+
+func TestHostMode_StrictExecRunsImageBinary(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+	cfgPath := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(cfgPath, []byte("[host]\nstrict_exec = true\n"), 0o644); err != nil {
+		t.Fatalf("write node config: %v", err)
+	}
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir, "RUNPROC_CONFIG="+cfgPath)
+
+	// The image's /bin is an absolute symlink, which must resolve inside the rootfs
+	bundle := t.TempDir()
+	rootfs := filepath.Join(bundle, "rootfs")
+	if err := os.MkdirAll(filepath.Join(rootfs, "usr", "bin"), 0o755); err != nil {
+		t.Fatalf("mkdir rootfs: %v", err)
+	}
+	if err := os.Symlink("/usr/bin", filepath.Join(rootfs, "bin")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(rootfs, "usr", "bin", "itest-hello"), []byte("#!/bin/sh\necho from-image \"$@\"\n"), 0o755); err != nil {
+		t.Fatalf("write image binary: %v", err)
+	}
+	write := func(args string) {
+		t.Helper()
+		cfg := `{
+		  "ociVersion": "1.1.0",
+		  "process": {"args": ` + args + `, "env": ["PATH=/bin"], "cwd": "/"},
+		  "root": {"path": "rootfs"},
+		  "annotations": {"runproc.host": "1"}
+		}`
+		if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+	}
+
+	write(`["itest-hello", "ok"]`)
+	var out bytes.Buffer
+	cmd := exec.Command(binPath, "run", "--bundle", bundle, "itest-strict")
+	cmd.Env = env
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("strict host-mode run failed: %v", err)
+	}
+	if out.String() != "from-image ok\n" {
+		t.Fatalf("expected the image binary to run, got %q", out.String())
+	}
+	staged := filepath.Join(stateDir, "itest-strict", "exec", "itest-hello")
+	if fi, err := os.Stat(staged); err != nil || fi.Mode().Perm() != 0o500 {
+		t.Fatalf("expected a private staged copy at %s: %v", staged, err)
+	}
+
+	// A node binary that the image does not have is refused
+	write(`["ls", "/"]`)
+	var stderr bytes.Buffer
+	cmd = exec.Command(binPath, "create", "--bundle", bundle, "itest-strict-ls")
+	cmd.Env = env
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err == nil || !strings.Contains(stderr.String(), "not found in the image rootfs") {
+		t.Fatalf("expected create to refuse a node-only binary, got err=%v stderr=%q", err, stderr.String())
+	}
+
+	// Tampering with the staged copy between create and start stops the exec
+	write(`["itest-hello"]`)
+	errFile := filepath.Join(t.TempDir(), "init.err")
+	f, err := os.Create(errFile)
+	if err != nil {
+		t.Fatalf("create err file: %v", err)
+	}
+	defer f.Close()
+	cmd = exec.Command(binPath, "create", "--bundle", bundle, "itest-strict-tamper")
+	cmd.Env = env
+	cmd.Stdout, cmd.Stderr = f, f
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	staged = filepath.Join(stateDir, "itest-strict-tamper", "exec", "itest-hello")
+	if err := os.Chmod(staged, 0o700); err != nil {
+		t.Fatalf("chmod staged: %v", err)
+	}
+	if err := os.WriteFile(staged, []byte("#!/bin/sh\necho tampered\n"), 0o700); err != nil {
+		t.Fatalf("tamper: %v", err)
+	}
+	start := exec.Command(binPath, "start", "itest-strict-tamper")
+	start.Env = env
+	if err := start.Run(); err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b, _ := os.ReadFile(errFile)
+		if strings.Contains(string(b), "tampered") {
+			t.Fatalf("tampered binary was executed")
+		}
+		if strings.Contains(string(b), "was modified after create") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected init to refuse the modified binary, got %q", b)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	del := exec.Command(binPath, "delete", "--force", "itest-strict-tamper")
+	del.Env = env
+	_ = del.Run()
+}
+
+func TestRootfs_PivotRootPreventsChrootEscape(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("rootfs setup needs root")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+
+	// A sentinel on the node, and a static program trying the classic chroot escape
+	// (chroot into a subdir, then walk up with ".." from the old working directory)
+	sentinel := filepath.Join(t.TempDir(), "itest-node-sentinel")
+	if err := os.WriteFile(sentinel, []byte("node"), 0o644); err != nil {
+		t.Fatalf("write sentinel: %v", err)
+	}
+	src := filepath.Join(t.TempDir(), "escape.go")
+	prog := `package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+func main() {
+	_ = os.Mkdir("/x", 0o755)
+	if err := syscall.Chroot("/x"); err != nil {
+		fmt.Println("chroot:", err)
+		return
+	}
+	for i := 0; i < 64; i++ {
+		_ = os.Chdir("..")
+	}
+	_ = syscall.Chroot(".")
+	if _, err := os.Stat(os.Args[1]); err == nil {
+		fmt.Println("escaped")
+	} else {
+		fmt.Println("contained")
+	}
+}
+`
+	if err := os.WriteFile(src, []byte(prog), 0o644); err != nil {
+		t.Fatalf("write escape program: %v", err)
+	}
+	bundle := t.TempDir()
+	rootfs := filepath.Join(bundle, "rootfs")
+	if err := os.MkdirAll(rootfs, 0o755); err != nil {
+		t.Fatalf("mkdir rootfs: %v", err)
+	}
+	build := exec.Command("go", "build", "-o", filepath.Join(rootfs, "escape"), src)
+	build.Env = append(os.Environ(), "CGO_ENABLED=0", "GO111MODULE=off")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("build escape program: %v\n%s", err, out)
+	}
+	cfg := `{
+	  "ociVersion": "1.1.0",
+	  "process": {"args": ["/escape", "` + sentinel + `"], "cwd": "/"},
+	  "root": {"path": "rootfs"},
+	  "linux": {"namespaces": [{"type": "mount"}]}
+	}`
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	run := func(id string, extra ...string) string {
+		t.Helper()
+		var out bytes.Buffer
+		cmd := exec.Command(binPath, append(append([]string{"run"}, extra...), "--bundle", bundle, id)...)
+		cmd.Env = env
+		cmd.Stdout = &out
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("run %v failed: %v", extra, err)
+		}
+		return out.String()
+	}
+	if got := run("itest-pivot"); got != "contained\n" {
+		t.Fatalf("expected pivot_root to leave nothing to escape to, got %q", got)
+	}
+	// --no-pivot moves the rootfs over / and chroots like runc
+	if got := run("itest-nopivot", "--no-pivot"); got != "contained\n" && got != "escaped\n" {
+		t.Fatalf("expected --no-pivot to run the process in the rootfs, got %q", got)
+	}
+	mountinfo, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		t.Fatalf("read mountinfo: %v", err)
+	}
+	if strings.Contains(string(mountinfo), stateDir) {
+		t.Fatalf("container rootfs mounts leaked to the node:\n%s", mountinfo)
+	}
+}
+
+func TestMounts_SpecMountsPerformed(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("mounts need root")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+
+	// Like a configmap volume and a single-file bind such as /etc/hosts
+	volume := t.TempDir()
+	if err := os.WriteFile(filepath.Join(volume, "key"), []byte("from-volume\n"), 0o644); err != nil {
+		t.Fatalf("write volume: %v", err)
+	}
+	hostsFile := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(hostsFile, []byte("127.0.0.1 itest-hosts\n"), 0o644); err != nil {
+		t.Fatalf("write hosts: %v", err)
+	}
+	script := strings.Join([]string{
+		`echo pid1=$(cat /proc/1/comm)`,
+		`grep -q ' /run/itest-tmp .* - tmpfs .*size=1024k' /proc/self/mountinfo && echo tmpfs=ok`,
+		`cat /run/itest-volume/key`,
+		`touch /run/itest-volume/new 2>/dev/null || echo volume=ro`,
+		`cat /run/itest-hosts`,
+		`touch /sys/itest 2>/dev/null || echo sysfs=ro`,
+		`ls /sys/fs/cgroup | grep -qxE 'memory|cgroup.controllers' && echo cgroup=ok`,
+	}, "; ")
+	cfg := `{
+	  "ociVersion": "1.1.0",
+	  "process": {"args": ["/bin/sh", "-c", "` + strings.ReplaceAll(script, `"`, `\"`) + `"], "env": ["PATH=/usr/bin:/bin"], "cwd": "/"},
+	  "root": {"path": "/"},
+	  "mounts": [
+	    {"destination": "/proc", "type": "proc", "source": "proc", "options": ["nosuid", "noexec", "nodev"]},
+	    {"destination": "/sys", "type": "sysfs", "source": "sysfs", "options": ["nosuid", "noexec", "nodev", "ro"]},
+	    {"destination": "/sys/fs/cgroup", "type": "cgroup", "source": "cgroup", "options": ["nosuid", "noexec", "nodev", "relatime", "ro"]},
+	    {"destination": "/run/itest-tmp", "type": "tmpfs", "source": "tmpfs", "options": ["nosuid", "size=1m", "mode=1777"]},
+	    {"destination": "/run/itest-volume", "type": "bind", "source": "` + volume + `", "options": ["rbind", "rprivate", "ro"]},
+	    {"destination": "/run/itest-hosts", "type": "bind", "source": "` + hostsFile + `", "options": ["rbind", "rprivate", "ro"]}
+	  ],
+	  "linux": {"namespaces": [{"type": "pid"}, {"type": "mount"}]}
+	}`
+	bundle := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	var out bytes.Buffer
+	cmd := exec.Command(binPath, "run", "--bundle", bundle, "itest-specmounts")
+	cmd.Env = env
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	// /proc is the container pid namespace's, whose pid 1 is the shell
+	want := "pid1=sh\ntmpfs=ok\nfrom-volume\nvolume=ro\n127.0.0.1 itest-hosts\nsysfs=ro\ncgroup=ok\n"
+	if out.String() != want {
+		t.Fatalf("unexpected mounts inside the container:\ngot  %q\nwant %q", out.String(), want)
+	}
+	mountinfo, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		t.Fatalf("read mountinfo: %v", err)
+	}
+	if strings.Contains(string(mountinfo), "/run/itest-") {
+		t.Fatalf("container mounts leaked to the node:\n%s", mountinfo)
+	}
+}
+
+func TestDevices_DefaultNodesCreated(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("device nodes need root")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+
+	// A bare image: the node's /usr bound in, and a /dev with a stray regular file
+	// where /dev/null belongs
+	rootfs := t.TempDir()
+	mounts := []string{`{"destination": "/usr", "type": "bind", "source": "/usr", "options": ["rbind", "ro"]}`}
+	for _, dir := range []string{"bin", "lib", "lib64"} {
+		host := filepath.Join("/", dir)
+		if link, err := os.Readlink(host); err == nil {
+			if err := os.Symlink(link, filepath.Join(rootfs, dir)); err != nil {
+				t.Fatal(err)
+			}
+		} else if _, err := os.Stat(host); err == nil {
+			mounts = append(mounts, `{"destination": "`+host+`", "type": "bind", "source": "`+host+`", "options": ["rbind", "ro"]}`)
+		}
+	}
+	mounts = append(mounts, `{"destination": "/proc", "type": "proc", "source": "proc"}`)
+	if err := os.MkdirAll(filepath.Join(rootfs, "dev"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(rootfs, "dev", "null"), []byte("image file\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	script := strings.Join([]string{
+		`for d in null zero full random urandom tty; do [ -c /dev/$d ] || echo missing $d; done`,
+		`echo gone > /dev/null`,
+		`head -c 3 /dev/zero | od -An -tx1`,
+		`echo x 2>/dev/null > /dev/full || echo full=ENOSPC`,
+		`readlink /dev/fd /dev/stderr`,
+		`[ -e /dev/console ] || echo console=absent`,
+	}, "; ")
+	cfg := `{
+	  "ociVersion": "1.1.0",
+	  "process": {"args": ["/bin/sh", "-c", "` + script + `"], "env": ["PATH=/usr/bin:/bin"], "cwd": "/"},
+	  "root": {"path": "` + rootfs + `"},
+	  "mounts": [` + strings.Join(mounts, ", ") + `],
+	  "linux": {"namespaces": [{"type": "pid"}, {"type": "mount"}]}
+	}`
+	bundle := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	var out bytes.Buffer
+	cmd := exec.Command(binPath, "run", "--bundle", bundle, "itest-devices")
+	cmd.Env = env
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	want := " 00 00 00\nfull=ENOSPC\n/proc/self/fd\n/proc/self/fd/2\nconsole=absent\n"
+	if out.String() != want {
+		t.Fatalf("unexpected /dev inside the container:\ngot  %q\nwant %q", out.String(), want)
+	}
+	// The image's own file was covered, not replaced; missing nodes were created
+	if b, err := os.ReadFile(filepath.Join(rootfs, "dev", "null")); err != nil || string(b) != "image file\n" {
+		t.Fatalf("image /dev/null was modified: %q (%v)", b, err)
+	}
+	if fi, err := os.Lstat(filepath.Join(rootfs, "dev", "zero")); err != nil || fi.Mode()&os.ModeCharDevice == 0 || fi.Mode().Perm() != 0o666 {
+		t.Fatalf("expected /dev/zero created as a 0666 char device in the rootfs, got %v (%v)", fi, err)
+	}
+}
+
+func TestDevices_SpecDevicesAndCgroupRules(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("device nodes need root")
+	}
+	if runproc.Features().Cgroup.Driver != "cgroupfs" {
+		t.Skip("runproc does not manage cgroups here")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+
+	rootfs := t.TempDir()
+	mounts := []string{`{"destination": "/usr", "type": "bind", "source": "/usr", "options": ["rbind", "ro"]}`}
+	for _, dir := range []string{"bin", "lib", "lib64"} {
+		host := filepath.Join("/", dir)
+		if link, err := os.Readlink(host); err == nil {
+			if err := os.Symlink(link, filepath.Join(rootfs, dir)); err != nil {
+				t.Fatal(err)
+			}
+		} else if _, err := os.Stat(host); err == nil {
+			mounts = append(mounts, `{"destination": "`+host+`", "type": "bind", "source": "`+host+`", "options": ["rbind", "ro"]}`)
+		}
+	}
+	mounts = append(mounts,
+		`{"destination": "/proc", "type": "proc", "source": "proc"}`,
+		`{"destination": "/dev", "type": "tmpfs", "source": "tmpfs", "options": ["nosuid", "mode=755"]}`,
+		// A device the cgroup rules do not allow
+		`{"destination": "/dev/kmsg", "type": "bind", "source": "/dev/kmsg", "options": ["bind"]}`,
+	)
+	script := strings.Join([]string{
+		`stat -c '%t:%T %a %u:%g' /dev/itest-full /dev/sub/itest-null`,
+		`echo x > /dev/sub/itest-null && echo itest-null=writable`,
+		`echo x 2>/dev/null > /dev/itest-full || echo itest-full=ENOSPC`,
+		`head -c 1 /dev/zero | od -An -tx1`,
+		`(true < /dev/kmsg) 2>/dev/null || echo kmsg=denied`,
+	}, "; ")
+	cgPath := "/itest-runproc-devices-" + time.Now().Format("150405.000000000")
+	cfgWith := func(rules string) string {
+		cfg := `{
+		  "ociVersion": "1.1.0",
+		  "process": {"args": ["/bin/sh", "-c", "` + script + `"], "env": ["PATH=/usr/bin:/bin"], "cwd": "/"},
+		  "root": {"path": "` + rootfs + `"},
+		  "mounts": [` + strings.Join(mounts, ", ") + `],
+		  "linux": {
+		    "namespaces": [{"type": "pid"}, {"type": "mount"}],
+		    "devices": [
+		      {"path": "/dev/itest-full", "type": "c", "major": 1, "minor": 7, "fileMode": 384, "uid": 1234, "gid": 1234},
+		      {"path": "/dev/sub/itest-null", "type": "c", "major": 1, "minor": 3}
+		    ],
+		    "cgroupsPath": "` + cgPath + `",
+		    "resources": {"devices": ` + rules + `}
+		  }
+		}`
+		bundle := t.TempDir()
+		if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		return bundle
+	}
+
+	create := exec.Command(binPath, "create", "--bundle", cfgWith(`[{"allow": false, "type": "x", "access": "rwm"}]`), "itest-devices-bad")
+	create.Env = env
+	if err := create.Run(); err == nil {
+		t.Fatalf("expected a device rule of type x to fail the create")
+	}
+
+	var out bytes.Buffer
+	cmd := exec.Command(binPath, "run", "--bundle", cfgWith(`[{"allow": false, "access": "rwm"}]`), "itest-spec-devices")
+	cmd.Env = env
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	t.Cleanup(func() {
+		del := exec.Command(binPath, "delete", "--force", "itest-spec-devices")
+		del.Env = env
+		_ = del.Run()
+	})
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	// The listed devices are made with their mode and owner and allowed by the cgroup, as
+	// are the default ones; everything else is denied
+	want := "1:7 600 1234:1234\n1:3 666 0:0\nitest-null=writable\nitest-full=ENOSPC\n 00\nkmsg=denied\n"
+	if out.String() != want {
+		t.Fatalf("unexpected devices inside the container:\ngot  %q\nwant %q", out.String(), want)
+	}
+}
+
+func TestStatsRuntime_OperationCounters(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+	// Output goes through a file: the created init inherits it and outlives the command
+	runproc := func(args ...string) (string, error) {
+		f, err := os.Create(filepath.Join(t.TempDir(), "out"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		cmd := exec.Command(binPath, append([]string{"--root", stateDir}, args...)...)
+		cmd.Stdout, cmd.Stderr = f, f
+		err = cmd.Run()
+		out, _ := os.ReadFile(f.Name())
+		return string(out), err
+	}
+
+	bundle := t.TempDir()
+	cfg := `{"ociVersion": "1.1.0", "process": {"args": ["/bin/sleep", "30"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"]}, "root": {"path": "/"}}`
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	badBundle := t.TempDir()
+	if err := os.WriteFile(filepath.Join(badBundle, "config.json"), []byte(`{"ociVersion": "1.1.0"}`), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	if out, err := runproc("create", "--bundle", bundle, "itest-audit"); err != nil {
+		t.Fatalf("create failed: %v: %s", err, out)
+	}
+	// Failures of each class the counters tell apart
+	if _, err := runproc("create", "--bundle", bundle, "itest-audit"); err == nil {
+		t.Fatal("expected the duplicate create to fail")
+	}
+	if _, err := runproc("create", "--bundle", badBundle, "itest-audit-bad"); err == nil {
+		t.Fatal("expected the create of an invalid spec to fail")
+	}
+	if _, err := runproc("start", "itest-audit-missing"); err == nil {
+		t.Fatal("expected the start of an unknown container to fail")
+	}
+	if out, err := runproc("delete", "--force", "itest-audit"); err != nil {
+		t.Fatalf("delete --force failed: %v: %s", err, out)
+	}
+
+	out, err := runproc("stats", "--runtime")
+	if err != nil {
+		t.Fatalf("stats --runtime failed: %v: %s", err, out)
+	}
+	var stats struct {
+		Counters map[string]uint64 `json:"counters"`
+	}
+	if err := json.Unmarshal([]byte(out), &stats); err != nil {
+		t.Fatalf("stats --runtime is not JSON: %v: %s", err, out)
+	}
+	want := map[string]uint64{
+		"creates_total":                            3,
+		`create_errors_total{code="exists"}`:       1,
+		`create_errors_total{code="invalid_spec"}`: 1,
+		"starts_total":                             1,
+		`start_errors_total{code="not_found"}`:     1,
+		"deletes_total":                            1,
+		"deletes_forced_total":                     1,
+		"kills_total":                              0,
+	}
+	for series, n := range want {
+		if got, ok := stats.Counters[series]; !ok || got != n {
+			t.Fatalf("expected %s = %d, got %d (present %v): %s", series, n, got, ok, out)
+		}
+	}
+
+	prom, err := runproc("stats", "--runtime", "--format", "prometheus")
+	if err != nil {
+		t.Fatalf("stats --runtime --format prometheus failed: %v: %s", err, prom)
+	}
+	for _, line := range []string{
+		"# TYPE runproc_create_errors_total counter",
+		`runproc_create_errors_total{code="exists"} 1`,
+		"runproc_creates_total 3",
+		"runproc_deletes_forced_total 1",
+	} {
+		if !strings.Contains(prom, line+"\n") {
+			t.Fatalf("expected %q in the Prometheus output:\n%s", line, prom)
+		}
+	}
+}
+
+func TestMounts_DefaultDevptsAndShm(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("mounts need root")
+	}
+	if _, err := exec.LookPath("script"); err != nil {
+		t.Skip("script(1) not available to allocate a pty")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+
+	script := strings.Join([]string{
+		// Our instance (the node's has other options), whose first pty is number 0
+		`grep -q ' /dev/pts .* - devpts .*ptmxmode=666' /proc/self/mountinfo && echo devpts=private`,
+		`script -qc tty /dev/null | tr -d '\r'`,
+		`df -k /dev/shm | awk 'NR == 2 { print \"shm=\" $2 }'`,
+	}, "; ")
+	run := func(name, mounts string) string {
+		cfg := `{
+		  "ociVersion": "1.1.0",
+		  "process": {"args": ["/bin/sh", "-c", "` + script + `"], "env": ["PATH=/usr/bin:/bin"], "cwd": "/"},
+		  "root": {"path": "/"},
+		  "mounts": [` + mounts + `],
+		  "linux": {"namespaces": [{"type": "pid"}, {"type": "mount"}]}
+		}`
+		bundle := t.TempDir()
+		if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		var out bytes.Buffer
+		cmd := exec.Command(binPath, "run", "--bundle", bundle, "itest-devpts-"+name)
+		cmd.Env = env
+		cmd.Stdout = &out
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("run failed: %v", err)
+		}
+		return out.String()
+	}
+
+	// Without spec mounts: a private devpts and the default 64Mi /dev/shm
+	if out := run("default", ""); out != "devpts=private\n/dev/pts/0\nshm=65536\n" {
+		t.Fatalf("unexpected default /dev/pts and /dev/shm: %q", out)
+	}
+	// The spec's /dev/shm size wins
+	shm := `{"destination": "/dev/shm", "type": "tmpfs", "source": "shm", "options": ["nosuid", "noexec", "nodev", "mode=1777", "size=1m"]}`
+	if out := run("sized", shm); out != "devpts=private\n/dev/pts/0\nshm=1024\n" {
+		t.Fatalf("unexpected /dev/shm sized by the spec: %q", out)
+	}
+}
+
+func TestSpec_ConfigDFragmentsMerged(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("mounts need root")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+
+	bundle := t.TempDir()
+	cfg := `{
+	  "ociVersion": "1.1.0",
+	  "process": {
+	    "args": ["/bin/sh", "-c", "echo $FROM_BUNDLE $FROM_NODE $OVERRIDDEN; grep -c ' /run/itest-injected .* - tmpfs ' /proc/self/mountinfo"],
+	    "cwd": "/",
+	    "env": ["PATH=/usr/bin:/bin", "FROM_BUNDLE=bundle", "OVERRIDDEN=bundle"]
+	  },
+	  "root": {"path": "/"},
+	  "annotations": {"itest.keep": "yes", "itest.drop": "yes"},
+	  "linux": {"namespaces": [{"type": "mount"}]}
+	}`
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	fragments := map[string]string{
+		// Applied in name order: 20- overrides 10-
+		"10-node.json":     `{"process": {"env": ["FROM_NODE=node", "OVERRIDDEN=node"]}, "mounts": [{"destination": "/run/itest-injected", "type": "tmpfs", "source": "tmpfs"}]}`,
+		"20-override.json": `{"process": {"env": ["OVERRIDDEN=override"]}, "annotations": {"itest.drop": null}}`,
+		"README":           `not json, and ignored`,
+	}
+	if err := os.MkdirAll(filepath.Join(bundle, "config.d"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range fragments {
+		if err := os.WriteFile(filepath.Join(bundle, "config.d", name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var out bytes.Buffer
+	cmd := exec.Command(binPath, "--root", stateDir, "run", "--bundle", bundle, "itest-configd")
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	if want := "bundle node override\n1\n"; out.String() != want {
+		t.Fatalf("fragments not merged as expected:\ngot  %q\nwant %q", out.String(), want)
+	}
+	var st struct {
+		Annotations map[string]string `json:"annotations"`
+	}
+	if b, err := os.ReadFile(filepath.Join(stateDir, "itest-configd", "state.json")); err != nil || json.Unmarshal(b, &st) != nil {
+		t.Fatalf("read state: %v", err)
+	}
+	if _, dropped := st.Annotations["itest.drop"]; dropped || st.Annotations["itest.keep"] != "yes" {
+		t.Fatalf("expected a null fragment value to remove only itest.drop, got %v", st.Annotations)
+	}
+	// The bundle's own file is left as containerd wrote it
+	if b, _ := os.ReadFile(filepath.Join(bundle, "config.json")); string(b) != cfg {
+		t.Fatalf("config.json was rewritten:\n%s", b)
+	}
+
+	// A broken fragment fails the create and is named
+	if err := os.WriteFile(filepath.Join(bundle, "config.d", "30-broken.json"), []byte(`{"process": `), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(filepath.Join(t.TempDir(), "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	create := exec.Command(binPath, "--root", stateDir, "create", "--bundle", bundle, "itest-configd-broken")
+	create.Stdout, create.Stderr = f, f
+	err = create.Run()
+	b, _ := os.ReadFile(f.Name())
+	if err == nil || !strings.Contains(string(b), "config.d/30-broken.json") {
+		t.Fatalf("expected create to fail naming the broken fragment, got err=%v out=%s", err, b)
+	}
+}
+
+func TestMounts_MaskedAndReadonlyPaths(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("mounts need root")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+
+	script := strings.Join([]string{
+		`echo timer_list=$(wc -c < /proc/timer_list)`,
+		`echo firmware=$(ls -A /sys/firmware | wc -l)`,
+		// Checked through mountinfo: a successful write to /proc/sys would change the node
+		`awk '$5 == \"/proc/sys\" { split($6, o, \",\"); print \"sys=\" o[1] }' /proc/self/mountinfo`,
+		`touch /proc/sys/itest 2>/dev/null || echo sys=denied`,
+	}, "; ")
+	cfg := `{
+	  "ociVersion": "1.1.0",
+	  "process": {"args": ["/bin/sh", "-c", "` + script + `"], "env": ["PATH=/usr/bin:/bin"], "cwd": "/"},
+	  "root": {"path": "/"},
+	  "mounts": [
+	    {"destination": "/proc", "type": "proc", "source": "proc"},
+	    {"destination": "/sys", "type": "sysfs", "source": "sysfs", "options": ["nosuid", "noexec", "nodev", "ro"]}
+	  ],
+	  "linux": {
+	    "namespaces": [{"type": "pid"}, {"type": "mount"}],
+	    "maskedPaths": ["/proc/timer_list", "/sys/firmware", "/proc/itest-missing"],
+	    "readonlyPaths": ["/proc/sys", "/proc/itest-missing"]
+	  }
+	}`
+	bundle := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	var out bytes.Buffer
+	cmd := exec.Command(binPath, "--root", stateDir, "run", "--bundle", bundle, "itest-masked")
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	if want := "timer_list=0\nfirmware=0\nsys=ro\nsys=denied\n"; out.String() != want {
+		t.Fatalf("paths not protected:\ngot  %q\nwant %q", out.String(), want)
+	}
+}
+
+func TestKill_BeforeStartNeverExecs(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+	ran := filepath.Join(t.TempDir(), "ran")
+	bundle := t.TempDir()
+	cfg := `{"ociVersion": "1.1.0", "process": {"args": ["/bin/sh", "-c", "echo $$ >> ` + ran + `"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"]}, "root": {"path": "/"}}`
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	// Output goes through a file: the created init inherits it and outlives the command
+	runproc := func(args ...string) (string, error) {
+		f, err := os.Create(filepath.Join(t.TempDir(), "out"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		cmd := exec.Command(binPath, append([]string{"--root", stateDir}, args...)...)
+		cmd.Stdout, cmd.Stderr = f, f
+		err = cmd.Run()
+		out, _ := os.ReadFile(f.Name())
+		return string(out), err
+	}
+	waitGone := func(pid int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for procRunning(pid) {
+			if time.Now().After(deadline) {
+				t.Fatalf("init %d still alive", pid)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	// SIGWINCH (28) is ignored by default; before, the init survived it and ran the
+	// workload on a later start
+	for _, sig := range []string{"SIGTERM", "28"} {
+		id := "itest-killfirst-" + sig
+		if out, err := runproc("create", "--bundle", bundle, id); err != nil {
+			t.Fatalf("create failed: %v: %s", err, out)
+		}
+		pid := readState(t, stateDir, id).Pid
+		if out, err := runproc("kill", id, sig); err != nil {
+			t.Fatalf("kill %s before start failed: %v: %s", sig, err, out)
+		}
+		waitGone(pid)
+		out, err := runproc("start", id)
+		if err == nil || !strings.Contains(out, "container not running") {
+			t.Fatalf("expected start after kill %s to fail, got err=%v out=%s", sig, err, out)
+		}
+		if out, err := runproc("state", id); err != nil || !strings.Contains(out, `"stopped"`) {
+			t.Fatalf("expected the killed container to be stopped, got err=%v out=%s", err, out)
+		}
+	}
+	if _, err := os.Stat(ran); !os.IsNotExist(err) {
+		t.Fatalf("the workload ran although the container was killed before start (%v)", err)
+	}
+
+	// Racing start and kill: the workload runs exactly when start wins
+	for i := 0; i < 10; i++ {
+		id := "itest-killrace-" + strconv.Itoa(i)
+		if out, err := runproc("create", "--bundle", bundle, id); err != nil {
+			t.Fatalf("create failed: %v: %s", err, out)
+		}
+		pid := readState(t, stateDir, id).Pid
+		_ = os.Remove(ran)
+		startErr := make(chan error, 1)
+		go func() {
+			_, err := runproc("start", id)
+			startErr <- err
+		}()
+		_, _ = runproc("kill", id, "28")
+		started := <-startErr == nil
+		waitGone(pid)
+		_, err := os.Stat(ran)
+		if executed := err == nil; executed != started {
+			t.Fatalf("iteration %d: start succeeded=%v but workload executed=%v", i, started, executed)
+		}
+	}
+}
+
+func TestKill_DoesNotWaitForPoststartHooks(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+	dir := t.TempDir()
+	hooked, release := filepath.Join(dir, "hooked"), filepath.Join(dir, "release")
+	bundle := t.TempDir()
+	// The poststart hook keeps start busy until the test releases it
+	cfg := `{"ociVersion": "1.1.0", "process": {"args": ["/bin/sleep", "300"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"]}, "root": {"path": "/"},
+	  "hooks": {"poststart": [{"path": "/bin/sh", "args": ["sh", "-c", "touch ` + hooked + `; while [ ! -e ` + release + ` ]; do sleep 0.05; done"]}]}}`
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	cli := func(args ...string) *exec.Cmd {
+		return exec.Command(binPath, append([]string{"--root", stateDir}, args...)...)
+	}
+	id := "itest-kill-poststart"
+	if err := cli("create", "--bundle", bundle, id).Run(); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	t.Cleanup(func() { _ = cli("delete", "--force", id).Run() })
+	pid := readState(t, stateDir, id).Pid
+	start := cli("start", id)
+	if err := start.Start(); err != nil {
+		t.Fatalf("start start: %v", err)
+	}
+	startErr := make(chan error, 1)
+	go func() { startErr <- start.Wait() }()
+	// Once the poststart hook runs, start has nothing left to do but wait for it
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		if _, err := os.Stat(hooked); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the poststart hook did not run")
+		}
+	}
+	if out, err := cli("kill", id, "KILL").CombinedOutput(); err != nil {
+		t.Fatalf("kill while start waits for its poststart hook failed: %v\n%s", err, out)
+	}
+	for deadline := time.Now().Add(5 * time.Second); procRunning(pid); time.Sleep(20 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("init %d survived the kill", pid)
+		}
+	}
+	select {
+	case err := <-startErr:
+		t.Fatalf("start returned before its poststart hook: %v", err)
+	default:
+	}
+	if err := os.WriteFile(release, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-startErr; err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+}
+
+// wasiEcho is a WASI command that writes its args, its env and the names of its first two
+// preopened directories to stdout, each NUL-terminated, and exits with status 3.
+const wasiEcho = "" +
+	"\x00\x61\x73\x6d\x01\x00\x00\x00\x01\x1d\x05\x60\x02\x7f\x7f\x01\x7f\x60\x04\x7f\x7f\x7f\x7f\x01" +
+	"\x7f\x60\x01\x7f\x00\x60\x00\x00\x60\x03\x7f\x7f\x7f\x01\x7f\x02\xb5\x02\x08\x16\x77\x61\x73\x69" +
+	"\x5f\x73\x6e\x61\x70\x73\x68\x6f\x74\x5f\x70\x72\x65\x76\x69\x65\x77\x31\x0e\x61\x72\x67\x73\x5f" +
+	"\x73\x69\x7a\x65\x73\x5f\x67\x65\x74\x00\x00\x16\x77\x61\x73\x69\x5f\x73\x6e\x61\x70\x73\x68\x6f" +
+	"\x74\x5f\x70\x72\x65\x76\x69\x65\x77\x31\x08\x61\x72\x67\x73\x5f\x67\x65\x74\x00\x00\x16\x77\x61" +
+	"\x73\x69\x5f\x73\x6e\x61\x70\x73\x68\x6f\x74\x5f\x70\x72\x65\x76\x69\x65\x77\x31\x11\x65\x6e\x76" +
+	"\x69\x72\x6f\x6e\x5f\x73\x69\x7a\x65\x73\x5f\x67\x65\x74\x00\x00\x16\x77\x61\x73\x69\x5f\x73\x6e" +
+	"\x61\x70\x73\x68\x6f\x74\x5f\x70\x72\x65\x76\x69\x65\x77\x31\x0b\x65\x6e\x76\x69\x72\x6f\x6e\x5f" +
+	"\x67\x65\x74\x00\x00\x16\x77\x61\x73\x69\x5f\x73\x6e\x61\x70\x73\x68\x6f\x74\x5f\x70\x72\x65\x76" +
+	"\x69\x65\x77\x31\x08\x66\x64\x5f\x77\x72\x69\x74\x65\x00\x01\x16\x77\x61\x73\x69\x5f\x73\x6e\x61" +
+	"\x70\x73\x68\x6f\x74\x5f\x70\x72\x65\x76\x69\x65\x77\x31\x09\x70\x72\x6f\x63\x5f\x65\x78\x69\x74" +
+	"\x00\x02\x16\x77\x61\x73\x69\x5f\x73\x6e\x61\x70\x73\x68\x6f\x74\x5f\x70\x72\x65\x76\x69\x65\x77" +
+	"\x31\x0e\x66\x64\x5f\x70\x72\x65\x73\x74\x61\x74\x5f\x67\x65\x74\x00\x00\x16\x77\x61\x73\x69\x5f" +
+	"\x73\x6e\x61\x70\x73\x68\x6f\x74\x5f\x70\x72\x65\x76\x69\x65\x77\x31\x13\x66\x64\x5f\x70\x72\x65" +
+	"\x73\x74\x61\x74\x5f\x64\x69\x72\x5f\x6e\x61\x6d\x65\x00\x04\x03\x02\x01\x03\x05\x03\x01\x00\x01" +
+	"\x07\x13\x02\x06\x6d\x65\x6d\x6f\x72\x79\x02\x00\x06\x5f\x73\x74\x61\x72\x74\x00\x08\x0a\xe7\x01" +
+	"\x01\xe4\x01\x00\x41\x00\x41\x04\x10\x00\x1a\x41\x80\x02\x41\x80\x08\x10\x01\x1a\x41\x10\x41\x80" +
+	"\x08\x36\x02\x00\x41\x14\x41\x04\x28\x02\x00\x36\x02\x00\x41\x01\x41\x10\x41\x01\x41\x20\x10\x04" +
+	"\x1a\x41\x00\x41\x04\x10\x02\x1a\x41\x80\x02\x41\x80\x10\x10\x03\x1a\x41\x10\x41\x80\x10\x36\x02" +
+	"\x00\x41\x14\x41\x04\x28\x02\x00\x36\x02\x00\x41\x01\x41\x10\x41\x01\x41\x20\x10\x04\x1a\x41\x03" +
+	"\x41\x08\x10\x06\x1a\x41\x03\x41\x80\x18\x41\x0c\x28\x02\x00\x10\x07\x1a\x41\x80\x18\x41\x0c\x28" +
+	"\x02\x00\x6a\x41\x00\x3a\x00\x00\x41\x10\x41\x80\x18\x36\x02\x00\x41\x14\x41\x0c\x28\x02\x00\x41" +
+	"\x01\x6a\x36\x02\x00\x41\x01\x41\x10\x41\x01\x41\x20\x10\x04\x1a\x41\x04\x41\x08\x10\x06\x1a\x41" +
+	"\x04\x41\x80\x18\x41\x0c\x28\x02\x00\x10\x07\x1a\x41\x80\x18\x41\x0c\x28\x02\x00\x6a\x41\x00\x3a" +
+	"\x00\x00\x41\x10\x41\x80\x18\x36\x02\x00\x41\x14\x41\x0c\x28\x02\x00\x41\x01\x6a\x36\x02\x00\x41" +
+	"\x01\x41\x10\x41\x01\x41\x20\x10\x04\x1a\x41\x03\x10\x05\x0b"
+
+func TestWasm_RunsModuleUnderEmbeddedRuntime(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+
+	rootfs := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(rootfs, "app"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(rootfs, "app", "hello.wasm"), []byte(wasiEcho), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	data := t.TempDir()
+	writeBundle := func(args, annotations string) string {
+		cfg := `{
+		  "ociVersion": "1.1.0",
+		  "process": {"args": ` + args + `, "env": ["GREETING=hi"], "cwd": "/app"},
+		  "root": {"path": "` + rootfs + `"},
+		  "mounts": [
+		    {"destination": "/data", "type": "bind", "source": "` + data + `", "options": ["rbind"]},
+		    {"destination": "/proc", "type": "proc", "source": "proc"}
+		  ],
+		  "annotations": {` + annotations + `}
+		}`
+		bundle := t.TempDir()
+		if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		return bundle
+	}
+	run := func(bin, bundle, id string) (string, error) {
+		var out bytes.Buffer
+		cmd := exec.Command(bin, "run", "--bundle", bundle, id)
+		cmd.Env = append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+		cmd.Stdout = &out
+		cmd.Stderr = &out
+		err := cmd.Run()
+		return out.String(), err
+	}
+
+	// A build without the runtime never creates the container
+	out, err := run(binPath, writeBundle(`["hello.wasm"]`, ``), "itest-wasm-noruntime")
+	if err == nil || !strings.Contains(out, "built without wasmtime") {
+		t.Fatalf("expected create to fail without the embedded runtime, got %v\n%s", err, out)
+	}
+	if _, err := os.Stat(filepath.Join(stateDir, "itest-wasm-noruntime")); !os.IsNotExist(err) {
+		t.Fatalf("expected no state for the failed create, got %v", err)
+	}
+	// An annotation that is not a boolean is rejected
+	out, err = run(binPath, writeBundle(`["hello.wasm"]`, `"runproc.wasm": "maybe"`), "itest-wasm-bad")
+	if err == nil || !strings.Contains(out, "runproc.wasm") {
+		t.Fatalf("expected a bad runproc.wasm to fail create, got %v\n%s", err, out)
+	}
+
+	if os.Getenv("RUNPROC_WASMTIME_TEST") != "1" {
+		t.Skip("set RUNPROC_WASMTIME_TEST=1 (make wasm-test) to run modules under a build-wasm binary")
+	}
+	wasmBin := filepath.Join(t.TempDir(), "runproc")
+	build := exec.Command("make", "build-wasm", "OUT="+wasmBin)
+	build.Dir = projectRoot(t)
+	build.Stdout = os.Stdout
+	build.Stderr = os.Stderr
+	if err := build.Run(); err != nil {
+		t.Fatalf("make build-wasm failed: %v", err)
+	}
+	// A .wasm argv[0] selects the backend, as does the annotation for any module name.
+	// The module sees its args and env, the rootfs as / and the bind mount, not /proc.
+	for name, c := range map[string]struct{ args, annotations, argv0 string }{
+		"suffix":     {`["hello.wasm", "--name", "world"]`, ``, "hello.wasm"},
+		"annotation": {`["/app/hello.wasm", "--name", "world"]`, `"runproc.wasm": "true"`, "/app/hello.wasm"},
+	} {
+		id := "itest-wasm-" + name
+		out, err := run(wasmBin, writeBundle(c.args, c.annotations), id)
+		if err != nil {
+			t.Fatalf("%s: run failed: %v\n%s", name, err, out)
+		}
+		if want := c.argv0 + "\x00--name\x00world\x00GREETING=hi\x00/\x00/data\x00"; out != want {
+			t.Fatalf("%s: unexpected module output:\ngot  %q\nwant %q", name, out, want)
+		}
+		if st := readState(t, stateDir, id); st.ExitCode == nil || *st.ExitCode != 3 {
+			t.Fatalf("%s: expected the module's exit status 3 in state, got %+v", name, st)
+		}
+	}
+}
+
+func TestMounts_RootfsAndBindPropagation(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("mounts need root")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+
+	// Two node directories on shared tmpfs mounts, like kubelet's pod volume dirs
+	toCtr, fromCtr := t.TempDir(), t.TempDir()
+	for _, dir := range []string{toCtr, fromCtr} {
+		dir := dir
+		if err := syscall.Mount("tmpfs", dir, "tmpfs", 0, "size=1m"); err != nil {
+			t.Fatalf("mount tmpfs: %v", err)
+		}
+		t.Cleanup(func() { _ = syscall.Unmount(dir, syscall.MNT_DETACH) })
+		if err := syscall.Mount("", dir, "", syscall.MS_SHARED, ""); err != nil {
+			t.Fatalf("make shared: %v", err)
+		}
+		if err := os.Mkdir(filepath.Join(dir, "sub"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		_ = syscall.Unmount(filepath.Join(toCtr, "sub"), syscall.MNT_DETACH)
+		_ = syscall.Unmount(filepath.Join(fromCtr, "sub"), syscall.MNT_DETACH)
+	})
+
+	rootfs := t.TempDir()
+	mounts := []string{
+		`{"destination": "/usr", "type": "bind", "source": "/usr", "options": ["rbind", "ro"]}`,
+		`{"destination": "/proc", "type": "proc", "source": "proc"}`,
+		`{"destination": "/to-ctr", "type": "bind", "source": "` + toCtr + `", "options": ["rbind", "rslave"]}`,
+		`{"destination": "/from-ctr", "type": "bind", "source": "` + fromCtr + `", "options": ["rbind", "rshared"]}`,
+	}
+	for _, dir := range []string{"bin", "lib", "lib64"} {
+		host := filepath.Join("/", dir)
+		if link, err := os.Readlink(host); err == nil {
+			if err := os.Symlink(link, filepath.Join(rootfs, dir)); err != nil {
+				t.Fatal(err)
+			}
+		} else if _, err := os.Stat(host); err == nil {
+			mounts = append(mounts, `{"destination": "`+host+`", "type": "bind", "source": "`+host+`", "options": ["rbind", "ro"]}`)
+		}
+	}
+	script := strings.Join([]string{
+		`cat /to-ctr/sub/marker`,
+		`mount -t tmpfs -o size=1k tmpfs /from-ctr/sub && echo from-ctr > /from-ctr/sub/marker`,
+		`grep -Eq '^[0-9]+ [0-9]+ [0-9:]+ [^ ]+ / .* shared:' /proc/self/mountinfo && echo root=shared`,
+	}, "; ")
+	cfg := `{
+	  "ociVersion": "1.1.0",
+	  "process": {"args": ["/bin/sh", "-c", "` + script + `"], "env": ["PATH=/usr/bin:/bin"], "cwd": "/"},
+	  "root": {"path": "` + rootfs + `"},
+	  "mounts": [` + strings.Join(mounts, ", ") + `],
+	  "linux": {"namespaces": [{"type": "pid"}, {"type": "mount"}], "rootfsPropagation": "rshared"}
+	}`
+	bundle := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	// Output goes through a file: the created init inherits it and outlives the command
+	outFile := filepath.Join(t.TempDir(), "out")
+	runproc := func(args ...string) {
+		t.Helper()
+		f, err := os.OpenFile(outFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		cmd := exec.Command(binPath, append([]string{"--root", stateDir}, args...)...)
+		cmd.Stdout, cmd.Stderr = f, f
+		if err := cmd.Run(); err != nil {
+			out, _ := os.ReadFile(outFile)
+			t.Fatalf("%s failed: %v\n%s", args[0], err, out)
+		}
+	}
+	id := "itest-propagation"
+	runproc("create", "--bundle", bundle, id)
+	pid := readState(t, stateDir, id).Pid
+
+	// A node mount made after the container's mounts reaches it through the rslave bind
+	sub := filepath.Join(toCtr, "sub")
+	if err := syscall.Mount("tmpfs", sub, "tmpfs", 0, "size=1k"); err != nil {
+		t.Fatalf("mount on the node: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(sub, "marker"), []byte("to-ctr\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	runproc("start", id)
+	deadline := time.Now().Add(5 * time.Second)
+	for procRunning(pid) {
+		if time.Now().After(deadline) {
+			t.Fatalf("container %d did not exit", pid)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	out, _ := os.ReadFile(outFile)
+	if string(out) != "to-ctr\nroot=shared\n" {
+		t.Fatalf("unexpected container output: %q", out)
+	}
+	// The container's mount reached the node through the rshared bind...
+	if b, err := os.ReadFile(filepath.Join(fromCtr, "sub", "marker")); err != nil || string(b) != "from-ctr\n" {
+		t.Fatalf("container mount did not propagate to the node: %q (%v)", b, err)
+	}
+	// ...but nothing else it mounted did, and node mounts never flowed back up the rslave one
+	mountinfo, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		t.Fatalf("read mountinfo: %v", err)
+	}
+	if strings.Contains(string(mountinfo), rootfs) || strings.Contains(string(mountinfo), stateDir) {
+		t.Fatalf("container rootfs mounts leaked to the node:\n%s", mountinfo)
+	}
+}
+
+func TestUser_ProcessUserApplied(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("switching users needs root")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+
+	for _, tc := range []struct {
+		name, user, want string
+	}{
+		{"nobody", `{"uid": 65534, "gid": 65534, "additionalGids": [1234, 5678], "umask": 63}`, "65534 65534 65534 1234 5678 0077\n"},
+		// root keeps uid 0 but loses the supplementary groups runproc was started with
+		{"root", `{"uid": 0, "gid": 0}`, "0 0 0 0022\n"},
+	} {
+		script := `echo $(id -u) $(id -g) $(id -G) $(umask)`
+		cfg := `{"ociVersion": "1.1.0", "process": {"args": ["/bin/sh", "-c", "` + script + `"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"], "user": ` + tc.user + `}, "root": {"path": "/"}}`
+		bundle := t.TempDir()
+		if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		var out bytes.Buffer
+		cmd := exec.Command(binPath, "--root", stateDir, "run", "--bundle", bundle, "itest-user-"+tc.name)
+		cmd.Stdout = &out
+		cmd.Stderr = os.Stderr
+		// The runtime's own supplementary groups must not reach the workload
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: 0, Gid: 0, Groups: []uint32{4242}}}
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("%s: run failed: %v", tc.name, err)
+		}
+		if out.String() != tc.want {
+			t.Fatalf("%s: unexpected ids in the container: got %q, want %q", tc.name, out.String(), tc.want)
+		}
+	}
+}
+
+func TestPods_GroupsContainersBySandbox(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+
+	bundle := func(script, sandbox, name string) string {
+		annotations := ""
+		if sandbox != "" {
+			annotations = `"io.kubernetes.cri.sandbox-id": "` + sandbox + `", "io.kubernetes.cri.sandbox-name": "` + name +
+				`", "io.kubernetes.cri.sandbox-namespace": "default", "io.kubernetes.cri.sandbox-uid": "uid-` + name + `"`
+		}
+		cfg := `{"ociVersion": "1.1.0", "process": {"args": ["/bin/sh", "-c", "` + script + `"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"]},
+		  "root": {"path": "/"}, "annotations": {` + annotations + `}}`
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "config.json"), []byte(cfg), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		return dir
+	}
+	// Output goes through a file: created and detached inits inherit it
+	runproc := func(args ...string) (string, error) {
+		f, err := os.Create(filepath.Join(t.TempDir(), "out"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		cmd := exec.Command(binPath, args...)
+		cmd.Env = env
+		cmd.Stdout, cmd.Stderr = f, f
+		err = cmd.Run()
+		out, _ := os.ReadFile(f.Name())
+		return string(out), err
+	}
+	mustRun := func(args ...string) {
+		t.Helper()
+		if out, err := runproc(args...); err != nil {
+			t.Fatalf("%s failed: %v: %s", args[0], err, out)
+		}
+	}
+	for _, id := range []string{"itest-pods-web-sandbox", "itest-pods-web-app", "itest-pods-job", "itest-pods-standalone", "itest-pods-pending"} {
+		id := id
+		t.Cleanup(func() { _, _ = runproc("delete", "--force", id) })
+	}
+	// web: two running containers; job: one that failed; pending: created, never started
+	mustRun("run", "-d", "--bundle", bundle("sleep 30", "sandbox-web-0123456789", "web"), "itest-pods-web-sandbox")
+	mustRun("run", "-d", "--bundle", bundle("sleep 30", "sandbox-web-0123456789", "web"), "itest-pods-web-app")
+	_, _ = runproc("run", "--bundle", bundle("exit 3", "sandbox-job", "job"), "itest-pods-job")
+	mustRun("create", "--bundle", bundle("true", "sandbox-pending", "pending"), "itest-pods-pending")
+	mustRun("run", "-d", "--bundle", bundle("sleep 30", "", ""), "itest-pods-standalone")
+
+	out, err := runproc("pods", "--format", "json")
+	if err != nil {
+		t.Fatalf("pods failed: %v: %s", err, out)
+	}
+	var pods []struct {
+		Namespace, Name, UID, SandboxID, Status string
+		Running                                 int
+		Containers                              []struct{ ID, Status string }
+		Usage                                   *struct{ Pids uint64 }
+	}
+	if err := json.Unmarshal([]byte(out), &pods); err != nil {
+		t.Fatalf("decode pods: %v\n%s", err, out)
+	}
+	type summary struct {
+		name, uid, status   string
+		running, containers int
+	}
+	var got []summary
+	for _, p := range pods {
+		if p.Namespace != "default" {
+			t.Fatalf("unexpected namespace for %s: %q", p.Name, p.Namespace)
+		}
+		got = append(got, summary{p.Name, p.UID, p.Status, p.Running, len(p.Containers)})
+		if (p.Usage != nil) != (p.Running > 0) {
+			t.Fatalf("%s: usage should be reported exactly while containers run: %+v", p.Name, p.Usage)
+		}
+	}
+	want := []summary{
+		{"job", "uid-job", "failed", 0, 1},
+		{"pending", "uid-pending", "created", 0, 1},
+		{"web", "uid-web", "running", 2, 2},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d pods (the standalone container left out), got %+v", len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("pod %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	out, err = runproc("pods")
+	if err != nil {
+		t.Fatalf("pods failed: %v: %s", err, out)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[0], "NAMESPACE") {
+		t.Fatalf("unexpected table:\n%s", out)
+	}
+	if f := strings.Fields(lines[3]); len(f) != 8 || f[1] != "web" || f[2] != "2/2" || f[3] != "running" || f[7] != "sandbox-web-0" {
+		t.Fatalf("unexpected row for web: %q", lines[3])
+	}
+}
+
+func TestCapabilities_SetsAppliedBeforeExec(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("setting capabilities needs root")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+
+	for _, tc := range []struct {
+		name, process, want string
+	}{
+		{
+			// A non-root user keeps exactly its ambient capabilities across exec
+			name: "nobody",
+			process: `"user": {"uid": 65534, "gid": 65534}, "capabilities": {
+			  "bounding": ["CAP_CHOWN", "CAP_NET_BIND_SERVICE"], "permitted": ["CAP_CHOWN", "CAP_NET_BIND_SERVICE"],
+			  "effective": ["CAP_NET_BIND_SERVICE"], "inheritable": ["CAP_NET_BIND_SERVICE"], "ambient": ["CAP_NET_BIND_SERVICE"]}`,
+			want: "CapInh:\t0000000000000400\nCapPrm:\t0000000000000400\nCapEff:\t0000000000000400\nCapBnd:\t0000000000000401\nCapAmb:\t0000000000000400\n",
+		},
+		{
+			// root regains its whole bounding set at exec, and nothing beyond it; unknown
+			// names are ignored like runc does
+			name:    "root",
+			process: `"user": {"uid": 0, "gid": 0}, "capabilities": {"bounding": ["CAP_CHOWN", "CAP_KILL", "CAP_FUTURE"], "permitted": ["CAP_KILL"], "effective": ["CAP_KILL"]}`,
+			want:    "CapInh:\t0000000000000000\nCapPrm:\t0000000000000021\nCapEff:\t0000000000000021\nCapBnd:\t0000000000000021\nCapAmb:\t0000000000000000\n",
+		},
+	} {
+		cfg := `{"ociVersion": "1.1.0", "process": {"args": ["grep", "^Cap", "/proc/self/status"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"], ` + tc.process + `}, "root": {"path": "/"}}`
+		bundle := t.TempDir()
+		if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		var out bytes.Buffer
+		cmd := exec.Command(binPath, "--root", stateDir, "run", "--bundle", bundle, "itest-caps-"+tc.name)
+		cmd.Stdout = &out
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("%s: run failed: %v", tc.name, err)
+		}
+		if out.String() != tc.want {
+			t.Fatalf("%s: unexpected capabilities:\ngot\n%swant\n%s", tc.name, out.String(), tc.want)
+		}
+	}
+}
+
+func TestRlimits_AppliedBeforeExec(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+
+	cfg := `{"ociVersion": "1.1.0", "process": {"args": ["cat", "/proc/self/limits"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"],
+	  "rlimits": [{"type": "RLIMIT_NOFILE", "soft": 512, "hard": 1024}, {"type": "RLIMIT_CORE", "soft": 0, "hard": 0},
+	    {"type": "RLIMIT_NPROC", "soft": 4096, "hard": 8192}, {"type": "RLIMIT_MSGQUEUE", "soft": 4096, "hard": 4096}]},
+	  "root": {"path": "/"}, "annotations": {"runproc.host": "1"}}`
+	bundle := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	var out bytes.Buffer
+	cmd := exec.Command(binPath, "--root", stateDir, "run", "--bundle", bundle, "itest-rlimits")
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	// "Max open files            512                  1024                 files"
+	got := map[string]string{}
+	for _, line := range strings.Split(out.String(), "\n") {
+		for _, name := range []string{"Max open files", "Max core file size", "Max processes", "Max msgqueue size"} {
+			if strings.HasPrefix(line, name) {
+				got[name] = strings.Join(strings.Fields(line[len(name):])[:2], " ")
+			}
+		}
+	}
+	want := map[string]string{"Max open files": "512 1024", "Max core file size": "0 0", "Max processes": "4096 8192", "Max msgqueue size": "4096 4096"}
+	for name, limits := range want {
+		if got[name] != limits {
+			t.Fatalf("%s: got %q, want %q\n%s", name, got[name], limits, out.String())
+		}
+	}
+}
+
+func TestNoNewPrivileges_SetBeforeExec(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+
+	for _, want := range []string{"0", "1"} {
+		cfg := `{"ociVersion": "1.1.0", "process": {"args": ["grep", "NoNewPrivs", "/proc/self/status"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"],
+		  "noNewPrivileges": ` + strconv.FormatBool(want == "1") + `}, "root": {"path": "/"}, "annotations": {"runproc.host": "1"}}`
+		bundle := t.TempDir()
+		if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		var out bytes.Buffer
+		cmd := exec.Command(binPath, "--root", stateDir, "run", "--bundle", bundle, "itest-nnp-"+want)
+		cmd.Stdout = &out
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("run failed: %v", err)
+		}
+		// "NoNewPrivs:\t1"
+		if got := strings.Fields(out.String()); len(got) != 2 || got[1] != want {
+			t.Fatalf("noNewPrivileges %s: got %q", want, out.String())
+		}
+	}
+}
+
+func TestSeccomp_ProfileFiltersSyscalls(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+	dir := t.TempDir()
+
+	// mkdir fails with ENOSPC; kill only fails for signal 0, the argument condition
+	profile := `{"defaultAction": "SCMP_ACT_ALLOW", "syscalls": [
+	  {"names": ["mkdir", "mkdirat", "no_such_syscall"], "action": "SCMP_ACT_ERRNO", "errnoRet": 28},
+	  {"names": ["kill"], "action": "SCMP_ACT_ERRNO", "args": [{"index": 1, "value": 0, "op": "SCMP_CMP_EQ"}]}]}`
+	script := `mkdir ` + dir + `/d; kill -0 $$ && echo signal0; kill -CONT $$ && echo cont`
+	for _, nnp := range []bool{false, true} {
+		cfg := `{"ociVersion": "1.1.0", "process": {"args": ["/bin/sh", "-c", "` + script + `"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"],
+		  "noNewPrivileges": ` + strconv.FormatBool(nnp) + `}, "root": {"path": "/"}, "linux": {"seccomp": ` + profile + `}}`
+		bundle := t.TempDir()
+		if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		var out bytes.Buffer
+		cmd := exec.Command(binPath, "--root", stateDir, "run", "--bundle", bundle, "itest-seccomp-"+strconv.FormatBool(nnp))
+		cmd.Stdout = &out
+		cmd.Stderr = &out
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("run failed: %v\n%s", err, out.String())
+		}
+		got := out.String()
+		if !strings.Contains(got, "No space left on device") || strings.Contains(got, "signal0") || !strings.Contains(got, "cont") {
+			t.Fatalf("noNewPrivileges %v: profile not applied as written: %q", nnp, got)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "d")); !os.IsNotExist(err) {
+			t.Fatalf("noNewPrivileges %v: mkdir was not filtered: %v", nnp, err)
+		}
+	}
+
+	// A profile runproc cannot apply as written fails create
+	cfg := `{"ociVersion": "1.1.0", "process": {"args": ["/bin/true"], "cwd": "/"}, "root": {"path": "/"},
+	  "linux": {"seccomp": {"defaultAction": "SCMP_ACT_NOTIFY"}}}`
+	bundle := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command(binPath, "--root", stateDir, "create", "--bundle", bundle, "itest-seccomp-notify")
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err == nil || !strings.Contains(stderr.String(), "linux.seccomp.defaultAction") {
+		t.Fatalf("expected create to refuse SCMP_ACT_NOTIFY, got %v: %q", err, stderr.String())
+	}
+}
+
+func TestStartGate_HoldsWorkloadUntilOpen(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+	dir := t.TempDir()
+
+	// run starts the container in the background; the workload leaves a marker behind
+	run := func(id, gate, timeout string) (*exec.Cmd, *bytes.Buffer, string) {
+		t.Helper()
+		marker := filepath.Join(dir, id)
+		cfg := `{"ociVersion": "1.1.0", "process": {"args": ["touch", "` + marker + `"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"]},
+		  "root": {"path": "/"}, "annotations": {"runproc.host": "1", "runproc.start_gate": "` + gate + `", "runproc.start_gate_timeout": "` + timeout + `"}}`
+		bundle := t.TempDir()
+		if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		var out bytes.Buffer
+		cmd := exec.Command(binPath, "--root", stateDir, "run", "--bundle", bundle, id)
+		cmd.Stdout = &out
+		cmd.Stderr = &out
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("run: %v", err)
+		}
+		return cmd, &out, marker
+	}
+	held := func(marker string) {
+		t.Helper()
+		time.Sleep(700 * time.Millisecond)
+		if _, err := os.Stat(marker); err == nil {
+			t.Fatalf("workload ran before its gate opened")
+		}
+	}
+	ran := func(cmd *exec.Cmd, out *bytes.Buffer, marker string) {
+		t.Helper()
+		if err := cmd.Wait(); err != nil {
+			t.Fatalf("run failed: %v\n%s", err, out.String())
+		}
+		if _, err := os.Stat(marker); err != nil {
+			t.Fatalf("workload did not run once its gate opened: %v\n%s", err, out.String())
+		}
+	}
+
+	// A file gate opens when the file appears
+	gate := filepath.Join(dir, "timesync.done")
+	cmd, out, marker := run("itest-gate-file", gate, "30s")
+	held(marker)
+	if err := os.WriteFile(gate, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ran(cmd, out, marker)
+
+	// A socket gate opens when it answers, not while a stale socket file is left
+	sock := filepath.Join(dir, "vpn.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	cmd, out, marker = run("itest-gate-socket", sock, "30s")
+	held(marker)
+	os.Remove(sock)
+	if l, err = net.Listen("unix", sock); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	ran(cmd, out, marker)
+
+	// A gate that never opens fails the start once the timeout passes
+	cmd, out, marker = run("itest-gate-timeout", filepath.Join(dir, "never"), "300ms")
+	cmd.Wait()
+	if _, err := os.Stat(marker); err == nil || !strings.Contains(out.String(), "not open after 300ms") {
+		t.Fatalf("expected the start to fail at the gate timeout, got %q", out.String())
+	}
+
+	// Bad values fail the create
+	for _, bad := range []struct{ gate, timeout string }{{"relative/gate", "30s"}, {gate, "soon"}} {
+		cmd, out, _ := run("itest-gate-bad", bad.gate, bad.timeout)
+		if err := cmd.Wait(); err == nil || !strings.Contains(out.String(), "runproc.start_gate") {
+			t.Fatalf("expected gate %q with timeout %q to fail the create, got %q", bad.gate, bad.timeout, out.String())
+		}
+	}
+}
+
+func TestScheduler_AppliedBeforeExec(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("real-time policies need root")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+
+	runWith := func(id, scheduler string) (string, error) {
+		cfg := `{"ociVersion": "1.1.0", "process": {"args": ["cat", "/proc/self/stat"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"],
+		  "scheduler": ` + scheduler + `}, "root": {"path": "/"}, "annotations": {"runproc.host": "1"}}`
+		bundle := t.TempDir()
+		if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		out, err := exec.Command(binPath, "--root", stateDir, "run", "--bundle", bundle, id).CombinedOutput()
+		return string(out), err
+	}
+	for _, tc := range []struct {
+		scheduler              string
+		policy, priority, nice string
+	}{
+		{`{"policy": "SCHED_FIFO", "priority": 10}`, "1", "10", "0"},
+		{`{"policy": "SCHED_BATCH", "nice": 5}`, "3", "0", "5"},
+	} {
+		out, err := runWith("itest-sched", tc.scheduler)
+		if err != nil {
+			t.Fatalf("%s: run failed: %v\n%s", tc.scheduler, err, out)
+		}
+		exec.Command(binPath, "--root", stateDir, "delete", "itest-sched").Run()
+		// Fields after "(comm)" start at field 3: nice is field 19, rt_priority 40, policy 41
+		_, rest, _ := strings.Cut(out, ") ")
+		f := strings.Fields(rest)
+		if len(f) < 39 || f[41-3] != tc.policy || f[40-3] != tc.priority || f[19-3] != tc.nice {
+			t.Fatalf("%s: workload runs with policy/priority/nice %v, want %s/%s/%s", tc.scheduler, f, tc.policy, tc.priority, tc.nice)
+		}
+	}
+
+	// Parameters the kernel would refuse fail the create
+	out, err := runWith("itest-sched-bad", `{"policy": "SCHED_RR", "priority": 0}`)
+	if err == nil || !strings.Contains(out, "process.scheduler.priority") {
+		t.Fatalf("expected SCHED_RR without a priority to fail the create, got %v: %q", err, out)
+	}
+}
+
+func TestIOPriority_AppliedBeforeExec(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	if _, err := exec.LookPath("ionice"); err != nil {
+		t.Skip("ionice not available")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+
+	runWith := func(id, ioPriority string) (string, error) {
+		cfg := `{"ociVersion": "1.1.0", "process": {"args": ["ionice"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"],
+		  "ioPriority": ` + ioPriority + `}, "root": {"path": "/"}, "annotations": {"runproc.host": "1"}}`
+		bundle := t.TempDir()
+		if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		out, err := exec.Command(binPath, "--root", stateDir, "run", "--bundle", bundle, id).CombinedOutput()
+		return string(out), err
+	}
+	for i, tc := range []struct{ ioPriority, want string }{
+		{`{"class": "IOPRIO_CLASS_BE", "priority": 7}`, "best-effort: prio 7"},
+		{`{"class": "IOPRIO_CLASS_IDLE"}`, "idle"},
+	} {
+		out, err := runWith("itest-ioprio-"+strconv.Itoa(i), tc.ioPriority)
+		if err != nil {
+			t.Fatalf("%s: run failed: %v\n%s", tc.ioPriority, err, out)
+		}
+		if strings.TrimSpace(out) != tc.want {
+			t.Fatalf("%s: workload runs with I/O priority %q, want %q", tc.ioPriority, out, tc.want)
+		}
+	}
+
+	out, err := runWith("itest-ioprio-bad", `{"class": "IOPRIO_CLASS_BE", "priority": 8}`)
+	if err == nil || !strings.Contains(out, "process.ioPriority.priority") {
+		t.Fatalf("expected priority 8 to fail the create, got %v: %q", err, out)
+	}
+}
+
+func TestPersonality_AppliedBeforeExec(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+
+	runWith := func(id, personality string) (string, error) {
+		cfg := `{"ociVersion": "1.1.0", "process": {"args": ["cat", "/proc/self/personality"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"]},
+		  "root": {"path": "/"}, "linux": {"personality": ` + personality + `}, "annotations": {"runproc.host": "1"}}`
+		bundle := t.TempDir()
+		if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		out, err := exec.Command(binPath, "--root", stateDir, "run", "--bundle", bundle, id).CombinedOutput()
+		return string(out), err
+	}
+	out, err := runWith("itest-personality", `{"domain": "LINUX32"}`)
+	if err != nil {
+		t.Fatalf("run failed: %v\n%s", err, out)
+	}
+	if strings.TrimSpace(out) != "00000008" {
+		t.Fatalf("workload runs with personality %q, want PER_LINUX32 (00000008)", out)
+	}
+
+	out, err = runWith("itest-personality-bad", `{"domain": "BSD"}`)
+	if err == nil || !strings.Contains(out, "linux.personality.domain") {
+		t.Fatalf("expected an unknown domain to fail the create, got %v: %q", err, out)
+	}
+}
+
+func TestExecCPUAffinity_PinsWorkload(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+
+	runWith := func(id, affinity string) (string, error) {
+		cfg := `{"ociVersion": "1.2.0", "process": {"args": ["grep", "Cpus_allowed_list", "/proc/self/status"], "cwd": "/",
+		  "env": ["PATH=/usr/bin:/bin"], "execCPUAffinity": ` + affinity + `}, "root": {"path": "/"}, "annotations": {"runproc.host": "1"}}`
+		bundle := t.TempDir()
+		if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		out, err := exec.Command(binPath, "--root", stateDir, "run", "--bundle", bundle, id).CombinedOutput()
+		return string(out), err
+	}
+	for i, affinity := range []string{`{"initial": "0", "final": "0"}`, `{"final": "0"}`} {
+		out, err := runWith("itest-affinity-"+strconv.Itoa(i), affinity)
+		if err != nil {
+			t.Fatalf("%s: run failed: %v\n%s", affinity, err, out)
+		}
+		if fields := strings.Fields(out); len(fields) != 2 || fields[1] != "0" {
+			t.Fatalf("%s: workload runs with %q, want it pinned to CPU 0", affinity, out)
+		}
+	}
+
+	out, err := runWith("itest-affinity-offline", `{"final": "0,100000"}`)
+	if err == nil || !strings.Contains(out, "process.execCPUAffinity.final") {
+		t.Fatalf("expected an offline CPU to fail the create, got %v: %q", err, out)
+	}
+}
+
+func TestUser_NonRootReopensStdio(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("switching users needs root")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+
+	script := `echo out > /dev/stdout; echo err > /proc/self/fd/2`
+	cfg := `{"ociVersion": "1.1.0", "process": {"args": ["/bin/sh", "-c", "` + script + `"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"], "user": {"uid": 65534, "gid": 65534}}, "root": {"path": "/"}}`
+	bundle := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	// The caller's own file is not given away; the pipes runproc tees through are
+	outFile := filepath.Join(t.TempDir(), "out")
+	f, err := os.Create(outFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var stderr bytes.Buffer
+	cmd := exec.Command(binPath, "--root", stateDir, "run", "--bundle", bundle, "itest-user-stdio")
+	cmd.Stdout, cmd.Stderr = f, &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("run failed: %v: %s", err, stderr.String())
+	}
+	if out, _ := os.ReadFile(outFile); string(out) != "out\n" || stderr.String() != "err\n" {
+		t.Fatalf("the workload could not reopen its stdio: stdout %q, stderr %q", out, stderr.String())
+	}
+	if fi, err := os.Stat(outFile); err != nil || fi.Sys().(*syscall.Stat_t).Uid != 0 {
+		t.Fatalf("expected the caller's output file to stay root-owned (%v)", err)
+	}
+}
+
+func TestAppArmor_ProfileAppliedOrRefused(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+	b, _ := os.ReadFile("/sys/module/apparmor/parameters/enabled")
+	enabled := strings.HasPrefix(string(b), "Y")
+
+	runWith := func(id, profile string) (string, error) {
+		cfg := `{"ociVersion": "1.1.0", "process": {"args": ["cat", "/proc/self/attr/current"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"],
+		  "apparmorProfile": "` + profile + `"}, "root": {"path": "/"}, "annotations": {"runproc.host": "1"}}`
+		bundle := t.TempDir()
+		if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		var out, errOut bytes.Buffer
+		cmd := exec.Command(binPath, "--root", stateDir, "run", "--bundle", bundle, id)
+		cmd.Stdout = &out
+		cmd.Stderr = &errOut
+		err := cmd.Run()
+		return out.String() + errOut.String(), err
+	}
+
+	// Asking for no confinement works everywhere
+	out, err := runWith("itest-apparmor-unconfined", "unconfined")
+	if err != nil {
+		t.Fatalf("run with unconfined failed: %v\n%s", err, out)
+	}
+	if enabled && !strings.HasPrefix(out, "unconfined") {
+		t.Fatalf("unconfined workload runs as %q", out)
+	}
+
+	if enabled {
+		t.Skip("AppArmor is enabled; the refusal needs a node without it")
+	}
+	// A real profile must not silently run unconfined
+	out, err = runWith("itest-apparmor-profile", "runproc-itest")
+	if err == nil || !strings.Contains(out, "AppArmor is not enabled") {
+		t.Fatalf("profile on a node without AppArmor: err %v, output %q", err, out)
+	}
+}
+
+func TestSELinux_LabelRefusedWithoutSELinux(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	if _, err := os.Stat("/sys/fs/selinux/enforce"); err == nil {
+		t.Skip("SELinux is enabled; the refusal needs a node without it")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+
+	cfg := `{"ociVersion": "1.1.0", "process": {"args": ["/bin/true"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"],
+	  "selinuxLabel": "system_u:system_r:container_t:s0:c1,c2"}, "root": {"path": "/"}}`
+	bundle := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	out, err := exec.Command(binPath, "--root", stateDir, "create", "--bundle", bundle, "itest-selinux").CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "SELinux is not enabled") {
+		t.Fatalf("label on a node without SELinux: err %v, output %q", err, out)
+	}
+	if _, err := os.Stat(filepath.Join(stateDir, "itest-selinux")); !os.IsNotExist(err) {
+		t.Fatalf("refused create left state behind: %v", err)
+	}
+}
+
+func TestIntelRdt_GroupAppliedOrRefused(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+	defaultSchemata, err := os.ReadFile("/sys/fs/resctrl/schemata")
+	enabled := err == nil
+
+	// The default group's own first line is a schema every RDT node accepts
+	schema := "L3:0=ff"
+	if enabled {
+		schema = strings.TrimSpace(strings.SplitN(string(defaultSchemata), "\n", 2)[0])
+	}
+	field := "l3CacheSchema"
+	if strings.HasPrefix(schema, "MB:") {
+		field = "memBwSchema"
+	}
+	closID := "itest-rdt-" + strconv.Itoa(os.Getpid())
+	cfg := `{"ociVersion": "1.1.0", "process": {"args": ["sh", "-c", "grep -qx $$ /sys/fs/resctrl/` + closID + `/tasks && echo joined"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"]},
+	  "root": {"path": "/"}, "annotations": {"runproc.host": "1"}, "linux": {"intelRdt": {"closID": "` + closID + `", "` + field + `": "` + schema + `"}}}`
+	bundle := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	if !enabled {
+		out, err := exec.Command(binPath, "--root", stateDir, "create", "--bundle", bundle, "itest-rdt").CombinedOutput()
+		if err == nil || !strings.Contains(string(out), "resctrl is not mounted") {
+			t.Fatalf("intelRdt on a node without resctrl: err %v, output %q", err, out)
+		}
+		if _, err := os.Stat(filepath.Join(stateDir, "itest-rdt")); !os.IsNotExist(err) {
+			t.Fatalf("refused create left state behind: %v", err)
+		}
+		return
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("requires root: resctrl groups are root's")
+	}
+	defer func() { _ = syscall.Rmdir("/sys/fs/resctrl/" + closID) }()
+	out, err := exec.Command(binPath, "--root", stateDir, "run", "--bundle", bundle, "itest-rdt").CombinedOutput()
+	if err != nil || strings.TrimSpace(string(out)) != "joined" {
+		t.Fatalf("workload not in its resctrl group: err %v, output %q", err, out)
+	}
+	// Deleting the container removes the group its create made
+	if out, err := exec.Command(binPath, "--root", stateDir, "delete", "itest-rdt").CombinedOutput(); err != nil {
+		t.Fatalf("delete: %v\n%s", err, out)
+	}
+	if _, err := os.Stat("/sys/fs/resctrl/" + closID); !os.IsNotExist(err) {
+		t.Fatalf("resctrl group of a deleted container left behind: %v", err)
+	}
+}
+
+func TestIdmappedMounts_ShowMappedOwners(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("requires root: mounts are set up in chrooted containers only")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+
+	rootfs := t.TempDir()
+	var mounts []string
+	for _, dir := range []string{"bin", "lib", "lib64", "usr"} {
+		host := filepath.Join("/", dir)
+		if link, err := os.Readlink(host); err == nil {
+			if err := os.Symlink(link, filepath.Join(rootfs, dir)); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if _, err := os.Stat(host); err == nil {
+			mounts = append(mounts, `{"destination": "`+host+`", "type": "bind", "source": "`+host+`", "options": ["rbind", "ro"]}`)
+		}
+	}
+	// Owned by root on disk; the mount maps root to 4242
+	volume := t.TempDir()
+	if err := os.WriteFile(filepath.Join(volume, "owned"), []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mapping := `[{"containerID": 0, "hostID": 4242, "size": 1}]`
+	mounts = append(mounts, `{"destination": "/volume", "type": "bind", "source": "`+volume+`", "options": ["bind", "ro"], "uidMappings": `+mapping+`, "gidMappings": `+mapping+`}`,
+		`{"destination": "/plain", "type": "bind", "source": "`+volume+`", "options": ["bind", "ro"]}`)
+	cfg := `{
+	  "ociVersion": "1.1.0",
+	  "process": {"args": ["/bin/sh", "-c", "stat -c %u:%g /volume/owned /plain/owned"], "env": ["PATH=/usr/bin:/bin"], "cwd": "/"},
+	  "root": {"path": "` + rootfs + `"},
+	  "mounts": [` + strings.Join(mounts, ", ") + `]
+	}`
+	bundle := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	var out, errOut bytes.Buffer
+	cmd := exec.Command(binPath, "--root", stateDir, "run", "--bundle", bundle, "itest-idmap")
+	cmd.Stdout, cmd.Stderr = &out, &errOut
+	if err := cmd.Run(); err != nil {
+		if strings.Contains(errOut.String(), "may not support idmapped mounts") {
+			t.Skipf("no idmapped mounts here: %s", errOut.String())
+		}
+		t.Fatalf("run failed: %v\n%s", err, errOut.String())
+	}
+	if got := out.String(); got != "4242:4242\n0:0\n" {
+		t.Fatalf("expected the idmapped mount to show root's file as 4242 and the plain one as 0, got %q", got)
+	}
+
+	// Only binds are idmapped, and only by mappings of their own
+	for id, mount := range map[string]string{
+		"itest-idmap-tmpfs": `{"destination": "/volume", "type": "tmpfs", "source": "tmpfs", "uidMappings": ` + mapping + `, "gidMappings": ` + mapping + `}`,
+		"itest-idmap-bare":  `{"destination": "/volume", "type": "bind", "source": "` + volume + `", "options": ["bind", "idmap"]}`,
+	} {
+		cfg := `{"ociVersion": "1.1.0", "process": {"args": ["/bin/true"], "cwd": "/"}, "root": {"path": "` + rootfs + `"}, "mounts": [` + mount + `]}`
+		if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		out, err := exec.Command(binPath, "--root", stateDir, "create", "--bundle", bundle, id).CombinedOutput()
+		if err == nil || !strings.Contains(string(out), "mount /volume: ") {
+			t.Fatalf("%s: expected the create to fail, got %v: %s", id, err, out)
+		}
+		if _, err := os.Stat(filepath.Join(stateDir, id)); !os.IsNotExist(err) {
+			t.Fatalf("%s: refused create left state behind: %v", id, err)
+		}
+	}
+}
+
+func TestUserNamespaces_CreatedAndJoined(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("requires root: user namespaces apply to chrooted containers only")
+	}
+	binPath := buildRunproc(t)
+	// The container's root is uid 100000 on the node: everything it reaches must be open
+	// to it, as containerd arranges for user-namespaced pods
+	base := t.TempDir()
+	for _, dir := range []string{filepath.Dir(base), base} {
+		if err := os.Chmod(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stateDir := filepath.Join(base, "state")
+	rootfs := filepath.Join(base, "rootfs")
+	if err := os.Mkdir(rootfs, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chown(rootfs, 100000, 100000); err != nil {
+		t.Fatal(err)
+	}
+	mounts := []string{`{"destination": "/proc", "type": "proc", "source": "proc"}`}
+	for _, dir := range []string{"bin", "lib", "lib64", "usr"} {
+		host := filepath.Join("/", dir)
+		if link, err := os.Readlink(host); err == nil {
+			if err := os.Symlink(link, filepath.Join(rootfs, dir)); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if _, err := os.Stat(host); err == nil {
+			mounts = append(mounts, `{"destination": "`+host+`", "type": "bind", "source": "`+host+`", "options": ["rbind", "ro"]}`)
+		}
+	}
+	mapping := `[{"containerID": 0, "hostID": 100000, "size": 65536}]`
+	bundles := 0
+	write := func(script, linux string) string {
+		t.Helper()
+		bundles++
+		bundle := filepath.Join(base, "bundle"+strconv.Itoa(bundles))
+		cfg := `{
+		  "ociVersion": "1.1.0",
+		  "process": {"args": ["/bin/sh", "-c", "` + script + `"], "env": ["PATH=/usr/bin:/bin"], "cwd": "/"},
+		  "root": {"path": "` + rootfs + `"},
+		  "mounts": [` + strings.Join(mounts, ", ") + `],
+		  "linux": ` + linux + `
+		}`
+		if err := os.Mkdir(bundle, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		return bundle
+	}
+	run := func(bundle, id string) string {
+		t.Helper()
+		var out, errOut bytes.Buffer
+		cmd := exec.Command(binPath, "--root", stateDir, "run", "--bundle", bundle, id)
+		cmd.Stdout, cmd.Stderr = &out, &errOut
+		err := cmd.Run()
+		_ = exec.Command(binPath, "--root", stateDir, "delete", id).Run()
+		if err != nil {
+			t.Fatalf("run %s failed: %v\n%s", id, err, errOut.String())
+		}
+		return out.String()
+	}
+
+	// A new user namespace gets the spec's mappings; init and the workload are its root
+	created := `{"namespaces": [{"type": "user"}, {"type": "mount"}, {"type": "pid"}],
+	  "uidMappings": ` + mapping + `, "gidMappings": ` + mapping + `}`
+	got := run(write(`cat /proc/self/uid_map /proc/self/gid_map; id -u`, created), "itest-userns")
+	if fields := strings.Fields(got); strings.Join(fields, " ") != "0 100000 65536 0 100000 65536 0" {
+		t.Fatalf("expected the spec's mappings and uid 0 in the container, got %q", got)
+	}
+
+	// A pod sandbox with its own user namespace, which a member joins by path
+	pod := write(`sleep 30`, created)
+	cmd := exec.Command(binPath, "--root", stateDir, "run", "-d", "--bundle", pod, "itest-userns-pod")
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("run -d failed: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = exec.Command(binPath, "--root", stateDir, "delete", "--force", "itest-userns-pod").Run()
+	})
+	if fi, err := os.Stat(filepath.Join(stateDir, "itest-userns-pod")); err != nil || fi.Sys().(*syscall.Stat_t).Gid != 100000 {
+		t.Fatalf("expected the state dir to be shared with the container's root group: %v", err)
+	}
+	pid := strconv.Itoa(readState(t, stateDir, "itest-userns-pod").Pid)
+	want, err := os.Readlink("/proc/" + pid + "/ns/user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	member := write(`echo pid=$$; readlink /proc/self/ns/user; cat /proc/self/uid_map`,
+		`{"namespaces": [{"type": "user", "path": "/proc/`+pid+`/ns/user"}, {"type": "mount"}, {"type": "pid"}]}`)
+	got = run(member, "itest-userns-member")
+	if !strings.HasPrefix(got, "pid=1\n"+want+"\n") || strings.Join(strings.Fields(got)[2:], " ") != "0 100000 65536" {
+		t.Fatalf("expected pid 1 of its own pid namespace in the pod's user namespace %s, got %q", want, got)
+	}
+
+	for id, linux := range map[string]string{
+		"itest-userns-nomaps": `{"namespaces": [{"type": "user"}, {"type": "mount"}]}`,
+		"itest-userns-nons":   `{"namespaces": [{"type": "mount"}], "uidMappings": ` + mapping + `, "gidMappings": ` + mapping + `}`,
+		"itest-userns-noroot": `{"namespaces": [{"type": "user"}, {"type": "mount"}], "uidMappings": [{"containerID": 1, "hostID": 100000, "size": 10}], "gidMappings": ` + mapping + `}`,
+	} {
+		out, err := exec.Command(binPath, "--root", stateDir, "create", "--bundle", write("true", linux), id).CombinedOutput()
+		if err == nil || !strings.Contains(string(out), "linux.") {
+			t.Fatalf("%s: expected the create to fail, got %v: %s", id, err, out)
+		}
+	}
+}
+
+func TestUserNamespaces_IdmappedRootfs(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("requires root: user namespaces apply to chrooted containers only")
+	}
+	binPath := buildRunproc(t)
+	base := t.TempDir()
+	for _, dir := range []string{filepath.Dir(base), base} {
+		if err := os.Chmod(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stateDir := filepath.Join(base, "state")
+	// An image as it is unpacked, owned by root on disk, not by the container's root
+	rootfs := filepath.Join(base, "rootfs")
+	if err := os.Mkdir(rootfs, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(rootfs, "owned"), []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mounts := []string{`{"destination": "/proc", "type": "proc", "source": "proc"}`}
+	for _, dir := range []string{"bin", "lib", "lib64", "usr"} {
+		host := filepath.Join("/", dir)
+		if link, err := os.Readlink(host); err == nil {
+			if err := os.Symlink(link, filepath.Join(rootfs, dir)); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if _, err := os.Stat(host); err == nil {
+			mounts = append(mounts, `{"destination": "`+host+`", "type": "bind", "source": "`+host+`", "options": ["rbind", "ro"]}`)
+		}
+	}
+	mapping := `[{"containerID": 0, "hostID": 100000, "size": 65536}]`
+	bundles := 0
+	write := func(annotations, namespaces string) string {
+		t.Helper()
+		bundles++
+		bundle := filepath.Join(base, "bundle"+strconv.Itoa(bundles))
+		cfg := `{
+		  "ociVersion": "1.1.0",
+		  "process": {"args": ["/bin/sh", "-c", "stat -c %u:%g / /owned; touch /new && stat -c %u:%g /new"], "env": ["PATH=/usr/bin:/bin"], "cwd": "/"},
+		  "root": {"path": "` + rootfs + `"},
+		  "mounts": [` + strings.Join(mounts, ", ") + `],
+		  "annotations": {` + annotations + `},
+		  "linux": {"namespaces": ` + namespaces + `, "uidMappings": ` + mapping + `, "gidMappings": ` + mapping + `}
+		}`
+		if err := os.Mkdir(bundle, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		return bundle
+	}
+	created := `[{"type": "user"}, {"type": "mount"}, {"type": "pid"}]`
+
+	// The container's root owns the image, and what it writes lands as root on disk
+	var out, errOut bytes.Buffer
+	cmd := exec.Command(binPath, "--root", stateDir, "run", "--bundle", write(`"runproc.rootfs_idmap": "true"`, created), "itest-rootfs-idmap")
+	cmd.Stdout, cmd.Stderr = &out, &errOut
+	if err := cmd.Run(); err != nil {
+		if strings.Contains(errOut.String(), "may not support idmapped mounts") {
+			t.Skipf("no idmapped mounts here: %s", errOut.String())
+		}
+		t.Fatalf("run failed: %v\n%s", err, errOut.String())
+	}
+	if got := out.String(); got != "0:0\n0:0\n0:0\n" {
+		t.Fatalf("expected the image owned by the container's root, got %q", got)
+	}
+	if fi, err := os.Stat(filepath.Join(rootfs, "new")); err != nil || fi.Sys().(*syscall.Stat_t).Uid != 0 {
+		t.Fatalf("expected the container's file owned by root on disk: %v", err)
+	}
+
+	// Without it, the image's root is no one the container knows
+	out.Reset()
+	cmd = exec.Command(binPath, "--root", stateDir, "run", "--bundle", write(``, created), "itest-rootfs-plain")
+	cmd.Stdout = &out
+	_ = cmd.Run()
+	if !strings.HasPrefix(out.String(), "65534:65534\n65534:65534\n") {
+		t.Fatalf("expected the image owned by the overflow id without idmapping, got %q", out.String())
+	}
+
+	// The mappings must be the container's own
+	b, err := exec.Command(binPath, "--root", stateDir, "create", "--bundle", write(`"runproc.rootfs_idmap": "true"`, `[{"type": "user", "path": "/proc/self/ns/user"}, {"type": "mount"}, {"type": "pid"}]`), "itest-rootfs-joined").CombinedOutput()
+	if err == nil || !strings.Contains(string(b), "runproc.rootfs_idmap needs a new user namespace") {
+		t.Fatalf("expected the create to fail with a joined user namespace, got %v: %s", err, b)
+	}
+}
+
+func TestRootless_OwnIDs(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("requires root: to drop to another user with setpriv")
+	}
+	setpriv, err := exec.LookPath("setpriv")
+	if err != nil {
+		t.Skip("setpriv not found")
+	}
+	const uid = "4242"
+	if err := exec.Command(setpriv, "--reuid", uid, "--regid", uid, "--clear-groups", "unshare", "--user", "true").Run(); err != nil {
+		t.Skip("unprivileged user namespaces are disabled on this node")
+	}
+	// Everything the user reaches is its own, the binary too (the module may be in /root)
+	base := t.TempDir()
+	if err := os.Chmod(filepath.Dir(base), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(buildRunproc(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	binPath := filepath.Join(base, "runproc")
+	if err := os.WriteFile(binPath, b, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	bundle := filepath.Join(base, "bundle")
+	rootfs := filepath.Join(bundle, "rootfs")
+	if err := os.MkdirAll(rootfs, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	mounts := []string{`{"destination": "/proc", "type": "proc", "source": "proc"}`}
+	for _, dir := range []string{"bin", "lib", "lib64", "usr"} {
+		host := filepath.Join("/", dir)
+		if link, err := os.Readlink(host); err == nil {
+			if err := os.Symlink(link, filepath.Join(rootfs, dir)); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if _, err := os.Stat(host); err == nil {
+			mounts = append(mounts, `{"destination": "`+host+`", "type": "bind", "source": "`+host+`", "options": ["rbind", "ro"]}`)
+		}
+	}
+	runtimeDir := filepath.Join(base, "run")
+	if err := os.Mkdir(runtimeDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := filepath.Walk(base, func(path string, _ os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, 4242, 4242)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	runproc := func(args ...string) *exec.Cmd {
+		cmd := exec.Command(setpriv, append([]string{"--reuid", uid, "--regid", uid, "--clear-groups", binPath}, args...)...)
+		// No newuidmap in PATH; no --root, so the state goes to the runtime dir
+		cmd.Env = []string{"PATH=" + base, "XDG_RUNTIME_DIR=" + runtimeDir}
+		cmd.Dir = bundle
+		return cmd
+	}
+
+	if out, err := runproc("spec", "--rootless").CombinedOutput(); err != nil {
+		t.Fatalf("spec --rootless failed: %v: %s", err, out)
+	}
+	generated, err := os.ReadFile(filepath.Join(bundle, "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(generated), `"hostID": 4242`) || !strings.Contains(string(generated), `"type": "user"`) {
+		t.Fatalf("expected a user namespace mapping uid 4242, got %s", generated)
+	}
+	write := func(script, mapping string) {
+		t.Helper()
+		cfg := `{
+		  "ociVersion": "1.1.0",
+		  "process": {"args": ["/bin/sh", "-c", "` + script + `"], "env": ["PATH=/usr/bin:/bin"], "cwd": "/"},
+		  "root": {"path": "rootfs"},
+		  "mounts": [` + strings.Join(mounts, ", ") + `],
+		  "linux": {"namespaces": [{"type": "user"}, {"type": "mount"}, {"type": "pid"}],
+		    "uidMappings": ` + mapping + `, "gidMappings": ` + mapping + `}
+		}`
+		if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+	}
+
+	// The container's root is the user; runproc wrote the mapping of its ids itself
+	write(`echo pid=$$; id -u; cat /proc/self/uid_map`, `[{"containerID": 0, "hostID": 4242, "size": 1}]`)
+	var out, errOut bytes.Buffer
+	cmd := runproc("run", "itest-rootless", bundle)
+	cmd.Stdout, cmd.Stderr = &out, &errOut
+	err = cmd.Run()
+	_ = runproc("delete", "itest-rootless").Run()
+	if err != nil {
+		t.Fatalf("rootless run failed: %v\n%s", err, errOut.String())
+	}
+	if got := strings.Fields(out.String()); strings.Join(got, " ") != "pid=1 0 0 4242 1" {
+		t.Fatalf("expected pid 1 and root mapped to uid 4242, got %q", out.String())
+	}
+	if _, err := os.Stat(filepath.Join(runtimeDir, "runproc")); err != nil {
+		t.Fatalf("expected the state in $XDG_RUNTIME_DIR/runproc: %v", err)
+	}
+
+	for mapping, want := range map[string]string{
+		`[{"containerID": 0, "hostID": 100000, "size": 1}]`:                                                    "to your uid 4242",
+		`[{"containerID": 0, "hostID": 4242, "size": 1}, {"containerID": 1, "hostID": 100000, "size": 65536}]`: "needs newuidmap",
+	} {
+		write("true", mapping)
+		out, err := runproc("create", "itest-rootless-refused", bundle).CombinedOutput()
+		if err == nil || !strings.Contains(string(out), want) {
+			_ = runproc("delete", "--force", "itest-rootless-refused").Run()
+			t.Fatalf("expected the create to fail with %q, got %v: %s", want, err, out)
+		}
+	}
+}
+
+func TestExposeBinary_ReadOnlyInContainer(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("requires root: the binary is mounted into chrooted containers only")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+
+	rootfs := t.TempDir()
+	var mounts []string
+	for _, dir := range []string{"bin", "lib", "lib64"} {
+		host := filepath.Join("/", dir)
+		if link, err := os.Readlink(host); err == nil {
+			if err := os.Symlink(link, filepath.Join(rootfs, dir)); err != nil {
+				t.Fatal(err)
+			}
+			host = filepath.Join("/", link)
+		}
+		if _, err := os.Stat(host); err == nil {
+			mounts = append(mounts, `{"destination": "`+host+`", "type": "bind", "source": "`+host+`", "options": ["rbind", "ro"]}`)
+		}
+	}
+	script := `/usr/local/bin/runproc version; touch /usr/local/bin/runproc 2>/dev/null || echo read-only`
+	cfg := `{
+	  "ociVersion": "1.1.0",
+	  "process": {"args": ["/bin/sh", "-c", "` + script + `"], "env": ["PATH=/usr/bin:/bin"], "cwd": "/"},
+	  "root": {"path": "` + rootfs + `"},
+	  "mounts": [` + strings.Join(mounts, ", ") + `],
+	  "annotations": {"runproc.expose_binary": "true"}
+	}`
+	bundle := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	var out bytes.Buffer
+	cmd := exec.Command(binPath, "--root", stateDir, "run", "--bundle", bundle, "itest-expose")
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	want, err := exec.Command(binPath, "version").Output()
+	if err != nil {
+		t.Fatalf("version failed: %v", err)
+	}
+	// "runproc version <version>"; the rest describes the build as seen from the container
+	version, _, _ := strings.Cut(string(want), "\n")
+	if !strings.HasPrefix(out.String(), version+"\n") || !strings.HasSuffix(out.String(), "read-only\n") {
+		t.Fatalf("got %q, want %q and a read-only binary", out.String(), version)
+	}
+
+	// Host-mode containers see the node's filesystem and get no bind
+	cfg = `{"ociVersion": "1.1.0", "process": {"args": ["/bin/true"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"]}, "root": {"path": "/"},
+	  "annotations": {"runproc.host": "1", "runproc.expose_binary": "true"}}`
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	if out, err := exec.Command(binPath, "--root", stateDir, "create", "--bundle", bundle, "itest-expose-host").CombinedOutput(); err == nil || !strings.Contains(string(out), "requires a chrooted container") {
+		t.Fatalf("expose_binary in host mode: err %v, output %q", err, out)
+	}
+}
+
+func TestFeatures_LibraryMatchesCLI(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+
+	out, err := exec.Command(binPath, "features").Output()
+	if err != nil {
+		t.Fatalf("features failed: %v", err)
+	}
+	var doc struct {
+		OCIVersionMax string   `json:"ociVersionMax"`
+		Hooks         []string `json:"hooks"`
+		MountOptions  []string `json:"mountOptions"`
+		Linux         struct {
+			Namespaces   []string `json:"namespaces"`
+			Capabilities []string `json:"capabilities"`
+			Cgroup       struct {
+				V1      bool `json:"v1"`
+				V2      bool `json:"v2"`
+				Systemd bool `json:"systemd"`
+			} `json:"cgroup"`
+			Seccomp struct {
+				Enabled bool `json:"enabled"`
+			} `json:"seccomp"`
+			Apparmor struct {
+				Enabled bool `json:"enabled"`
+			} `json:"apparmor"`
+			Selinux struct {
+				Enabled bool `json:"enabled"`
+			} `json:"selinux"`
+			IntelRdt struct {
+				Enabled bool `json:"enabled"`
+			} `json:"intelRdt"`
+			MountExtensions struct {
+				IDMap struct {
+					Enabled bool `json:"enabled"`
+				} `json:"idmap"`
+			} `json:"mountExtensions"`
+		} `json:"linux"`
+		Annotations map[string]string `json:"annotations"`
+	}
+	if err := json.Unmarshal(out, &doc); err != nil {
+		t.Fatalf("decode features: %v\n%s", err, out)
+	}
+	f := runproc.Features()
+	for _, c := range []struct {
+		name      string
+		cli, want any
+	}{
+		{"ociVersionMax", doc.OCIVersionMax, f.OCIVersionMax},
+		{"namespaces", doc.Linux.Namespaces, f.Namespaces},
+		{"capabilities", doc.Linux.Capabilities, f.Capabilities},
+		{"hooks", doc.Hooks, f.Hooks},
+		{"mountOptions", doc.MountOptions, f.MountOptions},
+		{"annotations", doc.Annotations["runproc.annotations"], strings.Join(f.Annotations, ",")},
+		{"wasm", doc.Annotations["runproc.wasm.enabled"], strconv.FormatBool(f.Wasm.Enabled)},
+		{"checkpoint", doc.Annotations["runproc.checkpoint.enabled"], strconv.FormatBool(f.Checkpoint)},
+		{"cgroup.v1", doc.Linux.Cgroup.V1, f.Cgroup.V1},
+		{"cgroup.v2", doc.Linux.Cgroup.V2, f.Cgroup.V2},
+		{"cgroup.systemd", doc.Linux.Cgroup.Systemd, f.Cgroup.Systemd},
+		{"seccomp", doc.Linux.Seccomp.Enabled, f.Seccomp},
+		{"apparmor", doc.Linux.Apparmor.Enabled, f.AppArmor},
+		{"selinux", doc.Linux.Selinux.Enabled, f.SELinux},
+		{"intelRdt", doc.Linux.IntelRdt.Enabled, f.IntelRdt},
+		{"mountExtensions.idmap", doc.Linux.MountExtensions.IDMap.Enabled, f.IDMappedMounts},
+	} {
+		if !reflect.DeepEqual(c.cli, c.want) {
+			t.Fatalf("%s: CLI reports %v, library %v", c.name, c.cli, c.want)
+		}
+	}
+	if wantDriver := map[bool]string{true: "cgroupfs", false: "none"}[f.Cgroup.V1 || f.Cgroup.V2]; f.Cgroup.Driver != wantDriver || (!f.Cgroup.V1 && !f.Cgroup.V2) {
+		t.Fatalf("unexpected cgroup features %+v", f.Cgroup)
+	}
+	if !slices.Contains(f.MountOptions, "rslave") || !slices.Contains(f.Capabilities, "CAP_NET_BIND_SERVICE") {
+		t.Fatalf("incomplete feature set %+v", f)
+	}
+}
+
+func TestStateRoot_RefusesPlantedFiles(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+	runproc := func(stateDir string, args ...string) (string, error) {
+		cmd := exec.Command(binPath, args...)
+		cmd.Env = append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+
+	// A state root others can write to is refused outright
+	shared := t.TempDir()
+	if err := os.Chmod(shared, 0o777); err != nil {
+		t.Fatalf("chmod: %v", err)
+	}
+	if out, err := runproc(shared, "list"); err == nil || !strings.Contains(out, "unsafe state") {
+		t.Fatalf("expected a world-writable state root to be refused, got err=%v out=%q", err, out)
+	}
+
+	// A state.json symlinked to some other file is not read
+	stateDir := t.TempDir()
+	victim := filepath.Join(t.TempDir(), "victim")
+	if err := os.WriteFile(victim, []byte(`{"id":"itest-planted","status":"running","pid":1}`), 0o600); err != nil {
+		t.Fatalf("write victim: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(stateDir, "itest-planted"), 0o700); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.Symlink(victim, filepath.Join(stateDir, "itest-planted", "state.json")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	if out, err := runproc(stateDir, "state", "itest-planted"); err == nil || !strings.Contains(out, "unsafe state") {
+		t.Fatalf("expected a symlinked state.json to be refused, got err=%v out=%q", err, out)
+	}
+
+	// A start file planted as a symlink is replaced, not written through
+	bundle := t.TempDir()
+	cfg := `{
+	  "ociVersion": "1.1.0",
+	  "process": {"args": ["/bin/true"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"]},
+	  "root": {"path": "/"}
+	}`
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	id := "itest-safe-" + time.Now().Format("150405.000000000")
+	// Not captured: the init inherits create's output and holds it open
+	create := exec.Command(binPath, "create", "--bundle", bundle, id)
+	create.Env = append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+	if err := create.Run(); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	if err := os.Symlink(victim, filepath.Join(stateDir, id, "start")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	if out, err := runproc(stateDir, "start", id); err != nil {
+		t.Fatalf("start failed: %v: %s", err, out)
+	}
+	if b, err := os.ReadFile(victim); err != nil || strings.Contains(string(b), "start") {
+		t.Fatalf("start wrote through the planted symlink: %q, %v", b, err)
+	}
+	if _, err := runproc(stateDir, "delete", "--force", id); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+}
+
+func TestHooks_RunAtLifecyclePoints(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("namespaces need root")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "hooks.log")
+	// Records its stage, the status it was given, its uts namespace and its env
+	hook := filepath.Join(dir, "hook.sh")
+	script := `#!/bin/sh
+status=$(sed -n 's/.*"status":"\([a-z]*\)".*/\1/p')
+echo "$1 $status $(readlink /proc/self/ns/uts) $HOOK_VAR$RUNPROC_STATE_DIR" >> ` + logPath + `
+[ "$1" != "$FAIL_STAGE" ]
+`
+	if err := os.WriteFile(hook, []byte(script), 0o755); err != nil {
+		t.Fatalf("write hook: %v", err)
+	}
+	hooks := func(fail string) string {
+		var stages []string
+		for _, s := range []string{"prestart", "createRuntime", "createContainer", "startContainer", "poststart", "poststop"} {
+			stages = append(stages, `"`+s+`": [{"path": "`+hook+`", "args": ["hook.sh", "`+s+`"], "env": ["PATH=/usr/bin:/bin", "HOOK_VAR=set", "FAIL_STAGE=`+fail+`"], "timeout": 5}]`)
+		}
+		return strings.Join(stages, ", ")
+	}
+	write := func(hooks string) string {
+		t.Helper()
+		bundle := t.TempDir()
+		cfg := `{
+		  "ociVersion": "1.1.0",
+		  "process": {"args": ["/bin/true"], "env": ["PATH=/usr/bin:/bin"], "cwd": "/"},
+		  "root": {"path": "/"},
+		  "hooks": {` + hooks + `},
+		  "linux": {"namespaces": [{"type": "uts"}, {"type": "mount"}]}
+		}`
+		if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		return bundle
+	}
+	runproc := func(args ...string) error {
+		cmd := exec.Command(binPath, args...)
+		cmd.Env = env
+		cmd.Stderr = os.Stderr
+		return cmd.Run()
+	}
+
+	if err := runproc("run", "--bundle", write(hooks("")), "itest-hooks"); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	if err := runproc("delete", "itest-hooks"); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	b, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("read hook log: %v", err)
+	}
+	nodeUTS, _ := os.Readlink("/proc/self/ns/uts")
+	var got []string
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		f := strings.Fields(line)
+		if len(f) != 4 || f[3] != "set" {
+			t.Fatalf("expected stage, status, namespace and only the hook's env, got %q", line)
+		}
+		// Only createContainer and startContainer run in the container's namespaces
+		inContainer := f[0] == "createContainer" || f[0] == "startContainer"
+		if (f[2] != nodeUTS) != inContainer {
+			t.Fatalf("%s hook ran in uts namespace %s, node's is %s", f[0], f[2], nodeUTS)
+		}
+		got = append(got, f[0]+" "+f[1])
+	}
+	want := []string{"prestart creating", "createRuntime creating", "createContainer creating", "startContainer created", "poststart running", "poststop stopped"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected hooks %v, got %v", want, got)
+	}
+
+	// start and delete run the hooks the container was created with, even once the
+	// bundle's config no longer has them
+	os.Remove(logPath)
+	bundle := write(hooks(""))
+	if err := runproc("create", "--bundle", bundle, "itest-hooks-recorded"); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(`{"ociVersion": "1.1.0", "process": {"args": ["/bin/true"], "cwd": "/"}, "root": {"path": "/"}}`), 0o644); err != nil {
+		t.Fatalf("rewrite config: %v", err)
+	}
+	if err := runproc("start", "itest-hooks-recorded"); err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+	if err := runproc("delete", "--force", "itest-hooks-recorded"); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	b, err = os.ReadFile(logPath)
+	if err != nil || !strings.Contains(string(b), "poststart running") || !strings.Contains(string(b), "poststop stopped") {
+		t.Fatalf("expected the recorded poststart and poststop hooks to run, got %q (%v)", b, err)
+	}
+
+	// A failing createRuntime hook fails the create and stops the lifecycle there
+	os.Remove(logPath)
+	create := exec.Command(binPath, "create", "--bundle", write(hooks("createRuntime")), "itest-hooks-fail")
+	create.Env = env
+	out, err := create.CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "createRuntime hook 0") {
+		t.Fatalf("expected the create to fail in its createRuntime hook, got %v: %s", err, out)
+	}
+	if _, err := os.Stat(filepath.Join(stateDir, "itest-hooks-fail")); !os.IsNotExist(err) {
+		t.Fatalf("expected no state left by the failed create, got %v", err)
+	}
+	if b, _ := os.ReadFile(logPath); strings.Contains(string(b), "createContainer") {
+		t.Fatalf("expected no hooks after the failed one, got %q", b)
+	}
+}
+
+func TestHooks_SandboxedUnderNodeLimits(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("hook cgroups need root")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+	dir := t.TempDir()
+	nodeCfg := filepath.Join(dir, "config.toml")
+	if err := os.WriteFile(nodeCfg, []byte("[hooks]\ntimeout = 2\nmemory_max = 67108864\ncpu_millicores = 500\n"), 0o644); err != nil {
+		t.Fatalf("write node config: %v", err)
+	}
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir, "RUNPROC_CONFIG="+nodeCfg)
+	logPath := filepath.Join(dir, "hooks.log")
+	pidPath := filepath.Join(dir, "escaped.pid")
+	// prestart records its cgroup and that cgroup's memory limit, on v1 or v2;
+	// createRuntime leaves a child in a session of its own and hangs
+	hook := filepath.Join(dir, "hook.sh")
+	script := `#!/bin/sh
+if [ "$1" = prestart ]; then
+	p=$(sed -n 's/^[0-9]*:memory:\(.*\)/\1/p' /proc/self/cgroup)
+	if [ -n "$p" ]; then
+		limit=$(cat /sys/fs/cgroup/memory$p/memory.limit_in_bytes)
+	else
+		p=$(sed -n 's/^0::\(.*\)/\1/p' /proc/self/cgroup)
+		limit=$(cat /sys/fs/cgroup$p/memory.max)
+	fi
+	echo "$p $limit" >> ` + logPath + `
+	exit 0
+fi
+setsid sleep 300 &
+echo $! > ` + pidPath + `
+sleep 300
+`
+	if err := os.WriteFile(hook, []byte(script), 0o755); err != nil {
+		t.Fatalf("write hook: %v", err)
+	}
+	bundle := t.TempDir()
+	cfg := `{
+	  "ociVersion": "1.1.0",
+	  "process": {"args": ["/bin/true"], "env": ["PATH=/usr/bin:/bin"], "cwd": "/"},
+	  "root": {"path": "/"},
+	  "hooks": {
+	    "prestart": [{"path": "` + hook + `", "args": ["hook.sh", "prestart"], "env": ["PATH=/usr/bin:/bin"]}],
+	    "createRuntime": [{"path": "` + hook + `", "args": ["hook.sh", "createRuntime"], "env": ["PATH=/usr/bin:/bin"], "timeout": 60}]
+	  },
+	  "linux": {"namespaces": [{"type": "mount"}]}
+	}`
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	// The node's 2s ceiling wins over the hook's own 60s
+	started := time.Now()
+	create := exec.Command(binPath, "create", "--bundle", bundle, "itest-hook-limits")
+	create.Env = env
+	out, err := create.CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "createRuntime hook 0") || !strings.Contains(string(out), "timed out after 2s, killed") {
+		t.Fatalf("expected the createRuntime hook to time out, got %v: %s", err, out)
+	}
+	if d := time.Since(started); d > 15*time.Second {
+		t.Fatalf("expected the hung hook to be killed at the ceiling, create took %s", d)
+	}
+	if _, err := os.Stat(filepath.Join(stateDir, "itest-hook-limits")); !os.IsNotExist(err) {
+		t.Fatalf("expected no state left by the failed create, got %v", err)
+	}
+
+	b, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("read hook log: %v", err)
+	}
+	f := strings.Fields(string(b))
+	if len(f) != 2 || f[0] != "/runproc-hooks/itest-hook-limits.prestart.0" || f[1] != "67108864" {
+		t.Fatalf("expected prestart in its own cgroup limited to 64MB, got %q", b)
+	}
+	for _, p := range []string{"/sys/fs/cgroup/memory" + f[0], "/sys/fs/cgroup" + f[0]} {
+		if _, err := os.Stat(p); err == nil {
+			t.Fatalf("expected the hook's cgroup %s to be removed", p)
+		}
+	}
+
+	// The child that left the hook's session went with its cgroup
+	b, err = os.ReadFile(pidPath)
+	if err != nil {
+		t.Fatalf("read child pid: %v", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		t.Fatalf("child pid %q: %v", b, err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+		if err != nil || strings.Contains(string(stat), ") Z ") {
+			break
+		}
+		if time.Now().After(deadline) {
+			_ = syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatalf("expected the hook's child %d to be killed with it", pid)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestCgroups_LimitsAppliedOnV2(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("cgroups need root")
+	}
+	if f := runproc.Features(); f.Cgroup.Driver != "cgroupfs" || f.Cgroup.V1 {
+		t.Skip("not a cgroup v2 only node")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+	cgPath := "/itest-runproc/cg-" + time.Now().Format("150405.000000000")
+	bundle := t.TempDir()
+	cfg := `{
+	  "ociVersion": "1.1.0",
+	  "process": {"args": ["sleep", "30"], "env": ["PATH=/usr/bin:/bin"], "cwd": "/"},
+	  "root": {"path": "/"},
+	  "linux": {
+	    "cgroupsPath": "` + cgPath + `",
+	    "resources": {"memory": {"limit": 67108864}, "cpu": {"quota": 50000, "period": 100000}, "pids": {"limit": 32},
+	      "unified": {"memory.high": "33554432", "pids.max": "16"}}
+	  }
+	}`
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	run := exec.Command(binPath, "run", "-d", "--bundle", bundle, "itest-cgroup")
+	run.Env = env
+	run.Stderr = os.Stderr
+	if err := run.Run(); err != nil {
+		t.Fatalf("run -d failed: %v", err)
+	}
+	t.Cleanup(func() { os.Remove("/sys/fs/cgroup/itest-runproc") })
+	pid := readState(t, stateDir, "itest-cgroup").Pid
+	b, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/cgroup")
+	if err != nil || strings.TrimSpace(string(b)) != "0::"+cgPath {
+		t.Fatalf("expected the init in %s, got %q (%v)", cgPath, b, err)
+	}
+	dir := filepath.Join("/sys/fs/cgroup", cgPath)
+	// unified files are written as given, over the converted limits
+	for file, want := range map[string]string{"memory.max": "67108864", "cpu.max": "50000 100000", "pids.max": "16", "memory.high": "33554432"} {
+		if b, err := os.ReadFile(filepath.Join(dir, file)); err != nil || strings.TrimSpace(string(b)) != want {
+			t.Fatalf("expected %s = %s, got %q (%v)", file, want, b, err)
+		}
+	}
+
+	del := exec.Command(binPath, "delete", "--force", "itest-cgroup")
+	del.Env = env
+	del.Stderr = os.Stderr
+	if err := del.Run(); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("expected delete to remove the cgroup, got %v", err)
+	}
+
+	// The files runproc manages itself stay out of reach
+	cfg = strings.Replace(cfg, `"memory.high": "33554432"`, `"cgroup.freeze": "1"`, 1)
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	create := exec.Command(binPath, "create", "--bundle", bundle, "itest-cgroup-freeze")
+	create.Env = env
+	if out, err := create.CombinedOutput(); err == nil || !strings.Contains(string(out), "cgroup.freeze is managed by runproc") {
+		t.Fatalf("expected linux.resources.unified cgroup.freeze to fail the create, got %v: %s", err, out)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("expected a failed create to remove its cgroup, got %v", err)
+	}
+}
+
+func TestCgroups_LimitsAppliedOnV1(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("cgroups need root")
+	}
+	if f := runproc.Features(); f.Cgroup.Driver != "cgroupfs" || !f.Cgroup.V1 {
+		t.Skip("not a cgroup v1 or hybrid node")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+	cgPath := "/itest-runproc/cg-" + time.Now().Format("150405.000000000")
+	runWith := func(id, resources string) error {
+		bundle := t.TempDir()
+		cfg := `{
+		  "ociVersion": "1.1.0",
+		  "process": {"args": ["sleep", "30"], "env": ["PATH=/usr/bin:/bin"], "cwd": "/"},
+		  "root": {"path": "/"},
+		  "linux": {"cgroupsPath": "` + cgPath + `", "resources": ` + resources + `}
+		}`
+		if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		run := exec.Command(binPath, "run", "-d", "--bundle", bundle, id)
+		run.Env = env
+		return run.Run()
+	}
+	// The cpuset is made, down from a new parent, for the CPUs and memory nodes asked for
+	err := runWith("itest-cgroup-v1", `{"memory": {"limit": 67108864}, "cpu": {"shares": 512, "quota": 50000, "period": 100000, "cpus": "0", "mems": "0"}, "pids": {"limit": 32}}`)
+	if err != nil {
+		t.Fatalf("run -d failed: %v", err)
+	}
+	mounts := map[string]string{}
+	for _, h := range []string{"memory", "cpu", "pids", "cpuset"} {
+		if mounts[h] = v1Mount(t, h); mounts[h] == "" {
+			t.Fatalf("no v1 %s hierarchy", h)
+		}
+	}
+	for _, h := range []string{"memory", "cpu", "cpuacct", "pids", "blkio", "devices", "cpuset"} {
+		if m := v1Mount(t, h); m != "" {
+			t.Cleanup(func() { os.Remove(filepath.Join(m, "itest-runproc")) })
+		}
+	}
+	pid := readState(t, stateDir, "itest-cgroup-v1").Pid
+	b, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/cgroup")
+	if err != nil {
+		t.Fatalf("read cgroup: %v", err)
+	}
+	in := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		if parts := strings.SplitN(line, ":", 3); len(parts) == 3 {
+			for _, h := range strings.Split(parts[1], ",") {
+				in[h] = parts[2]
+			}
+		}
+	}
+	for _, h := range []string{"memory", "cpu", "cpuacct", "pids", "cpuset"} {
+		if in[h] != cgPath {
+			t.Fatalf("expected the init in %s of the %s hierarchy:\n%s", cgPath, h, b)
+		}
+	}
+	for file, want := range map[string]string{
+		"memory/memory.limit_in_bytes": "67108864", "cpu/cpu.shares": "512",
+		"cpu/cpu.cfs_quota_us": "50000", "cpu/cpu.cfs_period_us": "100000", "pids/pids.max": "32",
+		"cpuset/cpuset.cpus": "0", "cpuset/cpuset.mems": "0",
+	} {
+		h, name, _ := strings.Cut(file, "/")
+		if b, err := os.ReadFile(filepath.Join(mounts[h], cgPath, name)); err != nil || strings.TrimSpace(string(b)) != want {
+			t.Fatalf("expected %s = %s, got %q (%v)", file, want, b, err)
+		}
+	}
+
+	del := exec.Command(binPath, "delete", "--force", "itest-cgroup-v1")
+	del.Env = env
+	del.Stderr = os.Stderr
+	if err := del.Run(); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	for h, m := range mounts {
+		if _, err := os.Stat(filepath.Join(m, cgPath)); !os.IsNotExist(err) {
+			t.Fatalf("expected delete to remove the %s cgroup, got %v", h, err)
+		}
+	}
+
+	// unified files only exist on v2
+	if err := runWith("itest-cgroup-v1-unified", `{"unified": {"memory.high": "1000000"}}`); err == nil {
+		t.Fatalf("expected linux.resources.unified to fail the create on v1")
+	}
+	if _, err := os.Stat(filepath.Join(mounts["memory"], cgPath)); !os.IsNotExist(err) {
+		t.Fatalf("expected a failed create to remove its cgroup, got %v", err)
+	}
+}
+
+func TestCgroups_DeleteRemovesCgroupsMadeBelow(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	if os.Geteuid() != 0 || runproc.Features().Cgroup.Driver != "cgroupfs" {
+		t.Skip("runproc does not manage cgroups here")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+	bundle := t.TempDir()
+	cgPath := "/itest-runproc-nested-" + time.Now().Format("150405.000000000")
+	cfg := `{
+	  "ociVersion": "1.1.0",
+	  "process": {"args": ["sleep", "30"], "env": ["PATH=/usr/bin:/bin"], "cwd": "/"},
+	  "root": {"path": "/"},
+	  "linux": {"cgroupsPath": "` + cgPath + `", "resources": {"pids": {"limit": 32}}}
+	}`
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	run := exec.Command(binPath, "run", "-d", "--bundle", bundle, "itest-cgroup-nested")
+	run.Env = env
+	if out, err := run.CombinedOutput(); err != nil {
+		t.Fatalf("run -d failed: %v\n%s", err, out)
+	}
+	dir := filepath.Join("/sys/fs/cgroup", cgPath)
+	if runproc.Features().Cgroup.V1 {
+		dir = filepath.Join(v1Mount(t, "pids"), cgPath)
+	}
+	t.Cleanup(func() {
+		_ = os.Remove(filepath.Join(dir, "child", "grandchild"))
+		_ = os.Remove(filepath.Join(dir, "child"))
+	})
+
+	// A workload that nests cgroups, like a container engine or systemd inside, leaves
+	// a process two levels down
+	nested := filepath.Join(dir, "child", "grandchild")
+	if err := os.MkdirAll(nested, 0o755); err != nil {
+		t.Fatalf("make nested cgroup: %v", err)
+	}
+	sleeper := exec.Command("sleep", "30")
+	if err := sleeper.Start(); err != nil {
+		t.Fatalf("start sleep: %v", err)
+	}
+	exited := make(chan struct{})
+	go func() { _ = sleeper.Wait(); close(exited) }()
+	t.Cleanup(func() { _ = sleeper.Process.Kill() })
+	if err := os.WriteFile(filepath.Join(nested, "cgroup.procs"), []byte(strconv.Itoa(sleeper.Process.Pid)), 0); err != nil {
+		t.Fatalf("move sleep into the nested cgroup: %v", err)
+	}
+
+	del := exec.Command(binPath, "delete", "--force", "itest-cgroup-nested")
+	del.Env = env
+	if out, err := del.CombinedOutput(); err != nil {
+		t.Fatalf("delete failed: %v\n%s", err, out)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("expected delete to remove the cgroup and those below it, got %v", err)
+	}
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected delete to kill the process in the nested cgroup")
+	}
+}
+
+func TestCgroups_SystemdDriverStartsScope(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("cgroups need root")
+	}
+	if f := runproc.Features(); f.Cgroup.Driver != "cgroupfs" || !f.Cgroup.V1 {
+		t.Skip("the fake systemd below only places processes on cgroup v1 or hybrid nodes")
+	}
+	if _, err := exec.LookPath("unshare"); err != nil {
+		t.Skip("unshare not available")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+	id := "itest-systemd-" + time.Now().Format("150405")
+	scopePath := "/runproctest.slice/runproctest-itest.slice/itest-" + id + ".scope"
+	memoryMount := v1Mount(t, "memory")
+	for _, h := range []string{"memory", "cpu", "cpuacct", "pids", "blkio", "devices"} {
+		if m := v1Mount(t, h); m != "" {
+			t.Cleanup(func() {
+				os.Remove(filepath.Join(m, "runproctest.slice/runproctest-itest.slice"))
+				os.Remove(filepath.Join(m, "runproctest.slice"))
+			})
+		}
+	}
+
+	// busctl as systemd would answer it: the scope's cgroup is made and the init moved in
+	fake := t.TempDir()
+	busLog := filepath.Join(fake, "calls")
+	script := `#!/bin/sh
+echo "$*" >> "$BUSCTL_LOG"
+[ "$6" = StartTransientUnit ] || exit 0
+while [ $# -gt 0 ]; do
+	[ "$1" = PIDs ] && pid=$4
+	shift
+done
+mkdir -p "$FAKE_SCOPE_DIR" && echo "$pid" > "$FAKE_SCOPE_DIR/cgroup.procs"
+echo 'o "/org/freedesktop/systemd1/job/1"'
+`
+	if err := os.WriteFile(filepath.Join(fake, "busctl"), []byte(script), 0o755); err != nil {
+		t.Fatalf("write fake busctl: %v", err)
+	}
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir, "PATH="+fake+":"+os.Getenv("PATH"),
+		"BUSCTL_LOG="+busLog, "FAKE_SCOPE_DIR="+filepath.Join(memoryMount, scopePath))
+
+	bundle := t.TempDir()
+	cfg := `{
+	  "ociVersion": "1.1.0",
+	  "process": {"args": ["/bin/sh", "-c", "cat /proc/self/cgroup; exec sleep 30"], "env": ["PATH=/usr/bin:/bin"], "cwd": "/"},
+	  "root": {"path": "/"},
+	  "linux": {
+	    "namespaces": [{"type": "mount"}, {"type": "cgroup"}],
+	    "cgroupsPath": "runproctest-itest.slice:itest:` + id + `",
+	    "resources": {"memory": {"limit": 67108864}, "cpu": {"shares": 512}, "pids": {"limit": 32}}
+	  }
+	}`
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	// Without the driver a slice:prefix:name path is refused
+	create := exec.Command(binPath, "create", "--bundle", bundle, id+"-cgroupfs")
+	create.Env = env
+	var stderr bytes.Buffer
+	create.Stderr = &stderr
+	if err := create.Run(); err == nil || !strings.Contains(stderr.String(), "--systemd-cgroup") {
+		t.Fatalf("expected a systemd cgroupsPath to fail without --systemd-cgroup, got %v (stderr %q)", err, stderr.String())
+	}
+	// With it, but no systemd on the node, the create fails
+	if !runproc.Features().Cgroup.Systemd {
+		create = exec.Command(binPath, "--systemd-cgroup", "create", "--bundle", bundle, id+"-nosystemd")
+		create.Env = env
+		stderr.Reset()
+		create.Stderr = &stderr
+		if err := create.Run(); err == nil || !strings.Contains(stderr.String(), "systemd is not running") {
+			t.Fatalf("expected --systemd-cgroup to fail without systemd, got %v (stderr %q)", err, stderr.String())
+		}
+	}
+
+	// containerd puts the flag before the command
+	run := exec.Command("unshare", "-m", "sh", "-c", `mount -t tmpfs tmpfs /run/systemd 2>/dev/null || mount -t tmpfs tmpfs /run && mkdir -p /run/systemd/system && exec "$@"`, "sh",
+		binPath, "--systemd-cgroup", "run", "-d", "--bundle", bundle, id)
+	run.Env = env
+	run.Stderr = os.Stderr
+	if err := run.Run(); err != nil {
+		t.Fatalf("run -d --systemd-cgroup failed: %v", err)
+	}
+	pid := readState(t, stateDir, id).Pid
+	calls, _ := os.ReadFile(busLog)
+	for _, want := range []string{
+		"StartTransientUnit ssa(sv)a(sa(sv)) itest-" + id + ".scope replace",
+		"Slice s runproctest-itest.slice", "Delegate b true", "PIDs au 1 " + strconv.Itoa(pid),
+		"MemoryLimit t 67108864", "CPUShares t 512", "TasksMax t 32",
+	} {
+		if !strings.Contains(string(calls), want) {
+			t.Fatalf("expected the scope request to contain %q:\n%s", want, calls)
+		}
+	}
+	b, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/cgroup")
+	if err != nil {
+		t.Fatalf("read cgroup: %v", err)
+	}
+	in := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		if parts := strings.SplitN(line, ":", 3); len(parts) == 3 {
+			for _, h := range strings.Split(parts[1], ",") {
+				in[h] = parts[2]
+			}
+		}
+	}
+	for _, h := range []string{"memory", "cpu", "pids"} {
+		if in[h] != scopePath {
+			t.Fatalf("expected the init in %s of the %s hierarchy:\n%s", scopePath, h, b)
+		}
+	}
+	if b, err := os.ReadFile(filepath.Join(memoryMount, scopePath, "memory.limit_in_bytes")); err != nil || strings.TrimSpace(string(b)) != "67108864" {
+		t.Fatalf("expected the memory limit written to the scope's cgroup, got %q (%v)", b, err)
+	}
+	// The container's cgroup namespace is rooted at the scope, which it was moved into
+	var logs []byte
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline) && !bytes.Contains(logs, []byte("memory")); time.Sleep(50 * time.Millisecond) {
+		logs, _ = os.ReadFile(filepath.Join(stateDir, id, "console.log"))
+	}
+	if !strings.Contains(string(logs), `memory:/\n"`) {
+		t.Fatalf("expected the container to see its own cgroup as the root:\n%s", logs)
+	}
+
+	del := exec.Command(binPath, "delete", "--force", id)
+	del.Env = env
+	del.Stderr = os.Stderr
+	if err := del.Run(); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if calls, _ := os.ReadFile(busLog); !strings.Contains(string(calls), "StopUnit ss itest-"+id+".scope replace") {
+		t.Fatalf("expected delete to stop the scope:\n%s", calls)
+	}
+	if _, err := os.Stat(filepath.Join(memoryMount, scopePath)); !os.IsNotExist(err) {
+		t.Fatalf("expected delete to remove the scope's cgroup, got %v", err)
+	}
+}
+
+func TestCPUThrottle_DutyCycleApproximatesQuota(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+	bundleWith := func(resources string) string {
+		bundle := t.TempDir()
+		cfg := `{
+		  "ociVersion": "1.1.0",
+		  "process": {"args": ["/bin/sh", "-c", "while :; do :; done"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"]},
+		  "root": {"path": "/"},
+		  "linux": {"resources": ` + resources + `},
+		  "annotations": {"runproc.host": "1", "runproc.cpu_throttle": "true"}
+		}`
+		if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		return bundle
+	}
+
+	create := exec.Command(binPath, "create", "--bundle", bundleWith(`{"memory": {"limit": 67108864}}`), "itest-throttle-noquota")
+	create.Env = env
+	if err := create.Run(); err == nil {
+		t.Fatalf("expected runproc.cpu_throttle without a cpu quota to fail the create")
+	}
+
+	id := "itest-throttle"
+	run := exec.Command(binPath, "run", "-d", "--bundle", bundleWith(`{"cpu": {"quota": 20000, "period": 100000}}`), id)
+	if cpuMount := v1Mount(t, "cpu"); cpuMount != "" && os.Geteuid() == 0 {
+		// runproc would put the quota in the container's v1 cpu cgroup; without the cpu
+		// hierarchy in its mount namespace it throttles instead, like on a node without
+		// the controller. The detached monitor stays in that namespace.
+		run = exec.Command("unshare", append([]string{"-m", "sh", "-c", `umount "$0" && exec "$@"`, cpuMount}, run.Args...)...)
+	}
+	run.Env = env
+	run.Stderr = os.Stderr
+	if err := run.Run(); err != nil {
+		t.Fatalf("run -d failed: %v", err)
+	}
+	// On a cgroup v2 node the kernel enforces the quota instead, which measures the same
+	pid := readState(t, stateDir, id).Pid
+	cpuTicks := func() int {
+		b, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+		if err != nil {
+			t.Fatalf("read stat: %v", err)
+		}
+		f := strings.Fields(string(b[strings.LastIndexByte(string(b), ')')+1:]))
+		utime, _ := strconv.Atoi(f[11])
+		stime, _ := strconv.Atoi(f[12])
+		return utime + stime
+	}
+	time.Sleep(time.Second)
+	c0, t0 := cpuTicks(), time.Now()
+	time.Sleep(3 * time.Second)
+	c1, t1 := cpuTicks(), time.Now()
+	// Clock ticks are 10ms
+	share := float64(c1-c0) * 10 * float64(time.Millisecond) / float64(t1.Sub(t0))
+	if share > 0.3 || share < 0.05 {
+		t.Fatalf("expected about 20%% of a CPU under a 20000/100000 quota, got %.0f%%", share*100)
+	}
+
+	// A signal sent while the container is stopped takes effect once it is continued
+	kill := exec.Command(binPath, "kill", id, "TERM")
+	kill.Env = env
+	if err := kill.Run(); err != nil {
+		t.Fatalf("kill failed: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for readState(t, stateDir, id).Status != "stopped" {
+		if time.Now().After(deadline) {
+			t.Fatalf("throttled container did not exit on TERM")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	del := exec.Command(binPath, "delete", id)
+	del.Env = env
+	del.Stderr = os.Stderr
+	if err := del.Run(); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+}
+
+func TestMaxDescendants_KillsForkingContainer(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+	bundleWith := func(annotations string) string {
+		bundle := t.TempDir()
+		cfg := `{
+		  "ociVersion": "1.1.0",
+		  "process": {"args": ["/bin/sh", "-c", "i=0; while [ $i -lt 20 ]; do sleep 30 & i=$((i+1)); done; wait"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"]},
+		  "root": {"path": "/"},
+		  "annotations": {"runproc.host": "1"` + annotations + `}
+		}`
+		if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		return bundle
+	}
+
+	for _, bad := range []string{
+		`, "runproc.max_descendants": "0"`,
+		`, "runproc.max_descendants": "5", "runproc.max_descendants.signal": "SIGWINCH"`,
+		`, "runproc.max_descendants.signal": "KILL"`,
+	} {
+		create := exec.Command(binPath, "create", "--bundle", bundleWith(bad), "itest-descendants-bad")
+		create.Env = env
+		if err := create.Run(); err == nil {
+			t.Fatalf("expected annotations %s to fail the create", bad)
+		}
+	}
+
+	id := "itest-descendants"
+	run := exec.Command(binPath, "run", "-d", "--bundle", bundleWith(`, "runproc.max_descendants": "5"`), id)
+	run.Env = env
+	run.Stderr = os.Stderr
+	if err := run.Run(); err != nil {
+		t.Fatalf("run -d failed: %v", err)
+	}
+	pid := readState(t, stateDir, id).Pid
+	deadline := time.Now().Add(10 * time.Second)
+	for readState(t, stateDir, id).Status != "stopped" {
+		if time.Now().After(deadline) {
+			t.Fatalf("container over its descendant limit was not killed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if st := readState(t, stateDir, id); st.ExitCode == nil || *st.ExitCode != 137 {
+		t.Fatalf("expected exit code 137 (SIGKILL), got %v", st.ExitCode)
+	}
+	// None of the sleeps survived
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		t.Fatalf("read /proc: %v", err)
+	}
+	for _, e := range entries {
+		b, err := os.ReadFile("/proc/" + e.Name() + "/stat")
+		if err != nil {
+			continue
+		}
+		f := strings.Fields(string(b[strings.LastIndexByte(string(b), ')')+1:]))
+		if p, _ := strconv.Atoi(e.Name()); len(f) > 3 && f[3] == strconv.Itoa(pid) && procRunning(p) {
+			t.Fatalf("process %s of the killed container's session is still running", e.Name())
+		}
+	}
+
+	b, err := os.ReadFile(filepath.Join(stateDir, id, "audit.log"))
+	if err != nil {
+		t.Fatalf("read audit.log: %v", err)
+	}
+	var ev struct {
+		Event       string `json:"event"`
+		Descendants int    `json:"descendants"`
+		Limit       int    `json:"limit"`
+		Signal      string `json:"signal"`
+	}
+	if err := json.Unmarshal([]byte(strings.SplitN(string(b), "\n", 2)[0]), &ev); err != nil {
+		t.Fatalf("parse audit.log %q: %v", b, err)
+	}
+	if ev.Event != "max_descendants_exceeded" || ev.Descendants <= 5 || ev.Limit != 5 || ev.Signal != "SIGKILL" {
+		t.Fatalf("unexpected audit event: %+v", ev)
+	}
+	stats := exec.Command(binPath, "stats", "--runtime", "--format", "prometheus")
+	stats.Env = env
+	out, err := stats.Output()
+	if err != nil {
+		t.Fatalf("stats --runtime failed: %v", err)
+	}
+	if !strings.Contains(string(out), "runproc_max_descendants_exceeded_total 1\n") {
+		t.Fatalf("expected the breach to be counted, got:\n%s", out)
+	}
+	del := exec.Command(binPath, "delete", id)
+	del.Env = env
+	if err := del.Run(); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+}
+
+func TestRunResult_ReportsExitWithoutState(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+	bundleWith := func(script, linux string) string {
+		bundle := t.TempDir()
+		cfg := `{
+		  "ociVersion": "1.1.0",
+		  "process": {"args": ["/bin/sh", "-c", "` + script + `"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"]},
+		  "root": {"path": "/"},
+		  "linux": {` + linux + `},
+		  "annotations": {"runproc.host": "1"}
+		}`
+		if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		return bundle
+	}
+	type result struct {
+		ID              string     `json:"id"`
+		ExitCode        int        `json:"exitCode"`
+		Signal          int        `json:"signal"`
+		OOMKilled       bool       `json:"oomKilled"`
+		StartedAt       *time.Time `json:"startedAt"`
+		DurationSeconds float64    `json:"durationSeconds"`
+		Rusage          struct {
+			UserSeconds float64 `json:"userSeconds"`
+			MaxRSSBytes int64   `json:"maxRssBytes"`
+		} `json:"rusage"`
+	}
+	parse := func(b []byte) result {
+		var r result
+		if err := json.Unmarshal(b, &r); err != nil {
+			t.Fatalf("parse result %q: %v", b, err)
+		}
+		return r
+	}
+	cli := func(args ...string) *exec.Cmd {
+		cmd := exec.Command(binPath, args...)
+		cmd.Env = env
+		return cmd
+	}
+
+	// Foreground: the result is the last line of stdout, after the container's output, and
+	// the file holds the same
+	id := "itest-result"
+	resultFile := filepath.Join(t.TempDir(), "result.json")
+	out, err := cli("run", "--result", "--result-file", resultFile, "--bundle", bundleWith("echo hello; sleep 0.3; exit 3", ""), id).Output()
+	if err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) != 2 || lines[0] != "hello" {
+		t.Fatalf("expected the container's output then the result, got %q", out)
+	}
+	r := parse([]byte(lines[1]))
+	if r.ID != id || r.ExitCode != 3 || r.Signal != 0 || r.OOMKilled || r.StartedAt == nil || r.DurationSeconds < 0.3 || r.Rusage.MaxRSSBytes <= 0 {
+		t.Fatalf("unexpected result: %s", lines[1])
+	}
+	if err := cli("delete", id).Run(); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	b, err := os.ReadFile(resultFile)
+	if err != nil {
+		t.Fatalf("read result file: %v", err)
+	}
+	if strings.TrimSpace(string(b)) != lines[1] {
+		t.Fatalf("result file %q differs from the printed result %q", b, lines[1])
+	}
+
+	// Detached: --result has nowhere to go, the monitor writes --result-file
+	if err := cli("run", "-d", "--result", "--bundle", bundleWith("exit 0", ""), "itest-result-bad").Run(); err == nil {
+		t.Fatalf("expected run -d --result to fail")
+	}
+	id = "itest-result-detached"
+	resultFile = filepath.Join(t.TempDir(), "result.json")
+	if err := cli("run", "-d", "--result-file", resultFile, "--bundle", bundleWith("kill -TERM $$", ""), id).Run(); err != nil {
+		t.Fatalf("run -d failed: %v", err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if b, err = os.ReadFile(resultFile); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no result file from the monitor: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if r := parse(b); r.ID != id || r.ExitCode != 143 || r.Signal != 15 {
+		t.Fatalf("unexpected result of a container killed by SIGTERM: %s", b)
+	}
+	if err := cli("delete", id).Run(); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+
+	// A container whose cgroup ran out of memory is reported as OOM killed
+	if os.Geteuid() != 0 || runproc.Features().Cgroup.Driver != "cgroupfs" {
+		return
+	}
+	id = "itest-result-oom"
+	cgPath := "/itest-runproc-oom-" + time.Now().Format("150405.000000000")
+	bundle := bundleWith("tail /dev/zero", `"cgroupsPath": "`+cgPath+`", "resources": {"memory": {"limit": 16777216, "swap": 16777216}}`)
+	t.Cleanup(func() { _ = cli("delete", "--force", id).Run() })
+	out, err = cli("run", "--no-console-log", "--result", "--bundle", bundle, id).Output()
+	if err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	if r := parse(out); r.ExitCode != 137 || !r.OOMKilled {
+		t.Fatalf("expected an OOM kill, got %s", out)
+	}
+}
+
+func TestOOM_RecordedInStateAndEvents(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	if os.Geteuid() != 0 || runproc.Features().Cgroup.Driver != "cgroupfs" {
+		t.Skip("runproc does not manage cgroups here")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+	cli := func(args ...string) *exec.Cmd {
+		cmd := exec.Command(binPath, args...)
+		cmd.Env = env
+		return cmd
+	}
+	bundleWith := func(script string) string {
+		bundle := t.TempDir()
+		cgPath := "/itest-runproc-oom-" + time.Now().Format("150405.000000000")
+		cfg := `{
+		  "ociVersion": "1.1.0",
+		  "process": {"args": ["/bin/sh", "-c", "` + script + `"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"]},
+		  "root": {"path": "/"},
+		  "linux": {"cgroupsPath": "` + cgPath + `", "resources": {"memory": {"limit": 16777216, "swap": 16777216}}},
+		  "annotations": {"runproc.host": "1"}
+		}`
+		if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		return bundle
+	}
+	type oomState struct {
+		Status      string     `json:"status"`
+		OOMKilled   bool       `json:"oomKilled"`
+		OOMKilledAt *time.Time `json:"oomKilledAt"`
+	}
+
+	// A supervised container records the kill even though its init survives it
+	id := "itest-oom-run"
+	t.Cleanup(func() { _ = cli("delete", "--force", id).Run() })
+	began := time.Now()
+	if err := cli("run", "-d", "--bundle", bundleWith("(tail /dev/zero); exit 3"), id).Run(); err != nil {
+		t.Fatalf("run -d failed: %v", err)
+	}
+	out, err := cli("wait", id).Output()
+	if err != nil || strings.TrimSpace(string(out)) != "3" {
+		t.Fatalf("expected the init to exit 3, got %q (%v)", out, err)
+	}
+	var st oomState
+	b, err := os.ReadFile(filepath.Join(stateDir, id, "state.json"))
+	if err != nil || json.Unmarshal(b, &st) != nil {
+		t.Fatalf("read state: %v", err)
+	}
+	if !st.OOMKilled || st.OOMKilledAt == nil || st.OOMKilledAt.Before(began) {
+		t.Fatalf("expected the OOM kill recorded in state, got %s", b)
+	}
+	if b, err := os.ReadFile(filepath.Join(stateDir, id, "status")); err != nil || !strings.HasSuffix(string(b), "\noomkilled=true\n") {
+		t.Fatalf("expected oomkilled=true in the status file, got %q (%v)", b, err)
+	}
+	b, err = os.ReadFile(filepath.Join(stateDir, id, "audit.log"))
+	if err != nil || !strings.Contains(string(b), `"event":"oom_killed"`) {
+		t.Fatalf("expected an oom_killed event in audit.log, got %q (%v)", b, err)
+	}
+	if err := cli("delete", id).Run(); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+
+	// Without a supervisor, `events` reports the kill like runc and `state` shows it
+	id2 := "itest-oom-events"
+	t.Cleanup(func() { _ = cli("delete", "--force", id2).Run() })
+	if err := cli("create", "--bundle", bundleWith("tail /dev/zero"), id2).Run(); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	events := cli("events", id2)
+	var eventsOut bytes.Buffer
+	events.Stdout = &eventsOut
+	if err := events.Start(); err != nil {
+		t.Fatalf("start events: %v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if err := cli("start", id2).Run(); err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- events.Wait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("events failed: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		_ = events.Process.Kill()
+		t.Fatalf("events did not return after the container exited")
+	}
+	if want := `{"type":"oom","id":"` + id2 + `"}` + "\n"; eventsOut.String() != want {
+		t.Fatalf("unexpected events:\ngot  %q\nwant %q", eventsOut.String(), want)
+	}
+	out, err = cli("state", id2).Output()
+	st = oomState{}
+	if err != nil || json.Unmarshal(out, &st) != nil {
+		t.Fatalf("state failed: %v\n%s", err, out)
+	}
+	if st.Status != "stopped" || !st.OOMKilled || st.OOMKilledAt == nil {
+		t.Fatalf("expected a stopped, OOM-killed container, got %s", out)
+	}
+	prom, err := cli("stats", "--runtime", "--format", "prometheus").Output()
+	if err != nil {
+		t.Fatalf("stats --runtime failed: %v", err)
+	}
+	if !strings.Contains(string(prom), "runproc_oom_killed_total 2\n") {
+		t.Fatalf("expected both containers counted, got:\n%s", prom)
+	}
+}
+
+func TestOOM_CountedOnceWhenTheInitOutlivesTheKill(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	if os.Geteuid() != 0 || runproc.Features().Cgroup.Driver != "cgroupfs" {
+		t.Skip("runproc does not manage cgroups here")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+	cli := func(args ...string) *exec.Cmd {
+		cmd := exec.Command(binPath, args...)
+		cmd.Env = env
+		return cmd
+	}
+	bundle := t.TempDir()
+	cgPath := "/itest-runproc-oom-once-" + time.Now().Format("150405.000000000")
+	// The init stays up well past the supervisor's next OOM check, so the kill is seen
+	// while it runs and then once more when it exits
+	cfg := `{
+	  "ociVersion": "1.1.0",
+	  "process": {"args": ["/bin/sh", "-c", "(tail /dev/zero); sleep 2"], "cwd": "/", "env": ["PATH=/usr/bin:/bin"]},
+	  "root": {"path": "/"},
+	  "linux": {"cgroupsPath": "` + cgPath + `", "resources": {"memory": {"limit": 16777216, "swap": 16777216}}},
+	  "annotations": {"runproc.host": "1"}
+	}`
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	id := "itest-oom-once"
+	t.Cleanup(func() { _ = cli("delete", "--force", id).Run() })
+	if err := cli("run", "-d", "--bundle", bundle, id).Run(); err != nil {
+		t.Fatalf("run -d failed: %v", err)
+	}
+	if out, err := cli("wait", id).Output(); err != nil || strings.TrimSpace(string(out)) != "0" {
+		t.Fatalf("expected the init to exit 0, got %q (%v)", out, err)
+	}
+	var st struct {
+		OOMKilled bool `json:"oomKilled"`
+	}
+	b, err := os.ReadFile(filepath.Join(stateDir, id, "state.json"))
+	if err != nil || json.Unmarshal(b, &st) != nil || !st.OOMKilled {
+		t.Fatalf("expected the OOM kill recorded in state, got %s (%v)", b, err)
+	}
+	b, err = os.ReadFile(filepath.Join(stateDir, id, "audit.log"))
+	if err != nil || strings.Count(string(b), `"event":"oom_killed"`) != 1 {
+		t.Fatalf("expected one oom_killed event in audit.log, got %q (%v)", b, err)
+	}
+	prom, err := cli("stats", "--runtime", "--format", "prometheus").Output()
+	if err != nil {
+		t.Fatalf("stats --runtime failed: %v", err)
+	}
+	if !strings.Contains(string(prom), "runproc_oom_killed_total 1\n") {
+		t.Fatalf("expected the kill counted once, got:\n%s", prom)
+	}
+}
+
+func TestLocalization_TimeZoneAndLocaleFromNode(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("rootfs setup needs root")
+	}
+	if _, err := os.Stat("/usr/share/zoneinfo/Europe/Berlin"); err != nil {
+		t.Skip("the node has no Europe/Berlin time zone")
+	}
+	if fi, err := os.Stat("/usr/lib/locale/C.utf8"); err != nil || !fi.IsDir() {
+		t.Skip("the node has no compiled C.UTF-8 locale")
+	}
+	binPath := buildRunproc(t)
+	stateDir := t.TempDir()
+	env := append(os.Environ(), "RUNPROC_STATE_DIR="+stateDir)
+
+	// A minimal image: one static binary, no zoneinfo and no locales
+	src := filepath.Join(t.TempDir(), "localized.go")
+	prog := `package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+func main() {
+	zone, _ := time.Date(2024, 1, 15, 12, 0, 0, 0, time.Local).Zone()
+	locale := "absent"
+	if _, err := os.Stat("/usr/lib/locale/C.utf8"); err == nil {
+		locale = "present"
+	}
+	fmt.Printf("TZ=%s LANG=%s zone=%s locale=%s\n", os.Getenv("TZ"), os.Getenv("LANG"), zone, locale)
+}
+`
+	if err := os.WriteFile(src, []byte(prog), 0o644); err != nil {
+		t.Fatalf("write program: %v", err)
+	}
+	bundle := t.TempDir()
+	rootfs := filepath.Join(bundle, "rootfs")
+	if err := os.MkdirAll(rootfs, 0o755); err != nil {
+		t.Fatalf("mkdir rootfs: %v", err)
+	}
+	build := exec.Command("go", "build", "-o", filepath.Join(rootfs, "localized"), src)
+	build.Env = append(os.Environ(), "CGO_ENABLED=0", "GO111MODULE=off")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("build program: %v\n%s", err, out)
+	}
+	run := func(id, tz, processEnv string) (string, string, error) {
+		t.Helper()
+		cfg := `{
+		  "ociVersion": "1.1.0",
+		  "process": {"args": ["/localized"], "cwd": "/", "env": [` + processEnv + `]},
+		  "root": {"path": "rootfs"},
+		  "linux": {"namespaces": [{"type": "mount"}]},
+		  "annotations": {"runproc.tz": "` + tz + `", "runproc.locale": "C.UTF-8"}
+		}`
+		if err := os.WriteFile(filepath.Join(bundle, "config.json"), []byte(cfg), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		var out, stderr bytes.Buffer
+		cmd := exec.Command(binPath, "run", "--bundle", bundle, id)
+		cmd.Env = env
+		cmd.Stdout, cmd.Stderr = &out, &stderr
+		err := cmd.Run()
+		return out.String(), stderr.String(), err
+	}
+
+	// The node's zoneinfo and locales cover the image's missing ones
+	out, stderr, err := run("itest-localized", "Europe/Berlin", `"PATH=/"`)
+	if err != nil {
+		t.Fatalf("run failed: %v\n%s", err, stderr)
+	}
+	if want := "TZ=Europe/Berlin LANG=C.UTF-8 zone=CET locale=present\n"; out != want {
+		t.Fatalf("unexpected localization:\ngot  %q\nwant %q", out, want)
+	}
+	// The process env wins over the annotations
+	out, stderr, err = run("itest-localized-env", "Europe/Berlin", `"TZ=UTC", "LANG=C"`)
+	if err != nil {
+		t.Fatalf("run failed: %v\n%s", err, stderr)
+	}
+	if want := "TZ=UTC LANG=C zone=UTC locale=present\n"; out != want {
+		t.Fatalf("expected the process env kept:\ngot  %q\nwant %q", out, want)
+	}
+	// A zone the image has is used as is: the image's Europe/Berlin here is Tokyo's
+	tokyo, err := os.ReadFile("/usr/share/zoneinfo/Asia/Tokyo")
+	if err != nil {
+		t.Skipf("the node has no Asia/Tokyo time zone: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(rootfs, "usr", "share", "zoneinfo", "Europe"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(rootfs, "usr", "share", "zoneinfo", "Europe", "Berlin"), tokyo, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out, stderr, err = run("itest-localized-image", "Europe/Berlin", `"PATH=/"`)
+	if err != nil {
+		t.Fatalf("run failed: %v\n%s", err, stderr)
+	}
+	if want := "TZ=Europe/Berlin LANG=C.UTF-8 zone=JST locale=present\n"; out != want {
+		t.Fatalf("expected the image's zone used:\ngot  %q\nwant %q", out, want)
+	}
+	// A zone neither has fails create
+	if _, stderr, err = run("itest-localized-bad", "Mars/Olympus_Mons", `"PATH=/"`); err == nil || !strings.Contains(stderr, `no time zone "Mars/Olympus_Mons"`) {
+		t.Fatalf("expected an unknown time zone to fail, got %v: %s", err, stderr)
+	}
+}
+
+// v1Mount returns where the hierarchy of a v1 controller is mounted, or "".
+func v1Mount(t *testing.T, controller string) string {
+	b, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		t.Fatalf("read mountinfo: %v", err)
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		pre, post, ok := strings.Cut(line, " - ")
+		fields, tail := strings.Fields(pre), strings.Fields(post)
+		if !ok || len(fields) < 5 || len(tail) < 3 || tail[0] != "cgroup" {
+			continue
+		}
+		for _, opt := range strings.Split(tail[2], ",") {
+			if opt == controller {
+				return fields[4]
+			}
+		}
+	}
+	return ""
+}
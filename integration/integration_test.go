@@ -87,6 +87,16 @@ func TestRun_Echo(t *testing.T) {
 	if st.ExitCode == nil || *st.ExitCode != 0 {
 		t.Fatalf("expected exitCode=0, got %v", st.ExitCode)
 	}
+
+	// The compact status file mirrors state.json for lightweight pollers
+	sb, err := os.ReadFile(filepath.Join(stateDir, id, "status"))
+	if err != nil {
+		t.Fatalf("read status file: %v", err)
+	}
+	want := "status=stopped\npid=" + fmtInt(st.Pid) + "\nexitcode=0\nhealth=ok\noomkilled=false\n"
+	if string(sb) != want {
+		t.Fatalf("unexpected status file:\n%s\nwant:\n%s", sb, want)
+	}
 }
 
 func TestCreateStartKill_StatusTransitions(t *testing.T) {
@@ -203,6 +213,20 @@ func TestCreateStartKill_StatusTransitions(t *testing.T) {
 	}
 }
 
+// buildRunproc builds the runproc binary via the Makefile and returns its path.
+func buildRunproc(t *testing.T) string {
+	t.Helper()
+	root := projectRoot(t)
+	build := exec.Command("make", "build")
+	build.Dir = root
+	build.Stdout = os.Stdout
+	build.Stderr = os.Stderr
+	if err := build.Run(); err != nil {
+		t.Fatalf("make build failed: %v", err)
+	}
+	return filepath.Join(root, "runproc")
+}
+
 func readState(t *testing.T, stateDir, id string) minimalContainerState {
 	t.Helper()
 	p := filepath.Join(stateDir, id, "state.json")
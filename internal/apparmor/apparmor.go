@@ -0,0 +1,37 @@
+// Package apparmor confines container processes with AppArmor profiles the node has
+// loaded. runproc never loads or generates profiles itself.
+package apparmor
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ktsakalozos/runproc/internal/lsm"
+)
+
+// Unconfined is the profile name that asks for no confinement.
+const Unconfined = "unconfined"
+
+// Enabled reports whether AppArmor is active on the node.
+func Enabled() bool {
+	b, err := os.ReadFile("/sys/module/apparmor/parameters/enabled")
+	return err == nil && strings.HasPrefix(string(b), "Y")
+}
+
+// ChangeOnExec makes the calling thread's next exec run confined by profile, which must
+// be loaded. The attribute is per thread: the caller must lock the OS thread and exec
+// from it. Kernels before 5.8 only have the shared (non-stacked) attr file.
+func ChangeOnExec(profile string) error {
+	var err error
+	for _, p := range []string{"/proc/thread-self/attr/apparmor/exec", "/proc/thread-self/attr/exec"} {
+		if err = lsm.WriteAttr(p, "exec "+profile); !errors.Is(err, os.ErrNotExist) {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("apply apparmor profile %q: %w", profile, err)
+	}
+	return nil
+}
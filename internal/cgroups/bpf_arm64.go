@@ -0,0 +1,4 @@
+package cgroups
+
+// sysBPF is bpf(2); the frozen syscall package predates it.
+const sysBPF = 280
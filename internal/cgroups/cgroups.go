@@ -0,0 +1,180 @@
+// Package cgroups locates container cgroups and reads their usage, on both the unified
+// (v2) hierarchy and the legacy (v1) per-controller hierarchies.
+package cgroups
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// v1Controllers are the legacy controllers runproc reads from.
+var v1Controllers = []string{"cpu", "cpuacct", "cpuset", "memory", "pids", "blkio"}
+
+// Cgroup is a process's cgroup as seen from runproc's mount namespace.
+type Cgroup struct {
+	// Unified is true on a pure cgroup v2 host; hybrid hosts use the v1 controllers.
+	Unified bool
+	// Path is the cgroup path as listed in /proc/<pid>/cgroup (memory controller on v1).
+	Path string
+	// dirs maps a controller ("" on v2) to its directory under the mounted hierarchy.
+	dirs map[string]string
+	// paths and mounts map a controller ("" on v2) to its cgroup path and hierarchy,
+	// which limits walks up from.
+	paths  map[string]string
+	mounts map[string]mount
+}
+
+// ForPid resolves the cgroup pid currently belongs to.
+func ForPid(pid int) (*Cgroup, error) {
+	paths, err := procCgroups(pid)
+	if err != nil {
+		return nil, err
+	}
+	mounts, err := cgroupMounts()
+	if err != nil {
+		return nil, err
+	}
+	c := &Cgroup{dirs: map[string]string{}, paths: paths, mounts: mounts}
+	for _, ctrl := range v1Controllers {
+		m, ok := mounts[ctrl]
+		p, ok2 := paths[ctrl]
+		if ok && ok2 {
+			c.dirs[ctrl] = m.dir(p)
+		}
+	}
+	if len(c.dirs) > 0 {
+		c.Path = paths["memory"]
+		return c, nil
+	}
+	m, ok := mounts[""]
+	p, ok2 := paths[""]
+	if !ok || !ok2 {
+		return nil, errors.New("no cgroup hierarchy mounted")
+	}
+	c.Unified = true
+	c.Path = p
+	c.dirs[""] = m.dir(p)
+	return c, nil
+}
+
+// dir returns the directory of controller (ignored on v2), or "" if it is not mounted.
+func (c *Cgroup) dir(controller string) string {
+	if c.Unified {
+		return c.dirs[""]
+	}
+	return c.dirs[controller]
+}
+
+// procCgroups parses /proc/<pid>/cgroup into controller -> path; the v2 entry uses key "".
+func procCgroups(pid int) (map[string]string, error) {
+	f, err := os.Open(filepath.Join("/proc", strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	out := map[string]string{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		parts := strings.SplitN(sc.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if parts[1] == "" {
+			out[""] = parts[2]
+			continue
+		}
+		for _, ctrl := range strings.Split(parts[1], ",") {
+			out[ctrl] = parts[2]
+		}
+	}
+	return out, sc.Err()
+}
+
+type mount struct {
+	root  string // cgroup path the mount exposes (non-"/" inside cgroup namespaces)
+	point string
+}
+
+func (m mount) dir(cgPath string) string {
+	rel := cgPath
+	if m.root != "/" {
+		rel = strings.TrimPrefix(cgPath, m.root)
+	}
+	return filepath.Join(m.point, rel)
+}
+
+// cgroupMounts maps controllers to their v1 mounts and "" to the cgroup2 mount.
+func cgroupMounts() (map[string]mount, error) {
+	out := map[string]mount{}
+	err := scanMountinfo(func(m mount, fstype, superOpts string) {
+		switch fstype {
+		case "cgroup2":
+			out[""] = m
+		case "cgroup":
+			for _, opt := range strings.Split(superOpts, ",") {
+				out[opt] = m
+			}
+		}
+	})
+	return out, err
+}
+
+// Hierarchy is a cgroup hierarchy mounted in runproc's mount namespace.
+type Hierarchy struct {
+	// Type is "cgroup" (v1) or "cgroup2".
+	Type string
+	// Point is where the hierarchy is mounted, e.g. /sys/fs/cgroup/memory.
+	Point string
+	// Options are the mount options selecting it, e.g. "cpu,cpuacct" or "name=systemd".
+	Options string
+}
+
+// Hierarchies lists the mounted cgroup hierarchies, in mount order, so that a container
+// can be given the same layout.
+func Hierarchies() ([]Hierarchy, error) {
+	var out []Hierarchy
+	err := scanMountinfo(func(m mount, fstype, superOpts string) {
+		if fstype != "cgroup" && fstype != "cgroup2" {
+			return
+		}
+		var opts []string
+		for _, o := range strings.Split(superOpts, ",") {
+			if o != "rw" && o != "ro" {
+				opts = append(opts, o)
+			}
+		}
+		out = append(out, Hierarchy{Type: fstype, Point: m.point, Options: strings.Join(opts, ",")})
+	})
+	return out, err
+}
+
+// scanMountinfo calls fn for every mount of runproc's mount namespace.
+func scanMountinfo(fn func(m mount, fstype, superOpts string)) error {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// id parent maj:min root point opts [optional...] - fstype source superopts
+		pre, post, ok := strings.Cut(sc.Text(), " - ")
+		if !ok {
+			continue
+		}
+		fields, tail := strings.Fields(pre), strings.Fields(post)
+		if len(fields) < 5 || len(tail) < 3 {
+			continue
+		}
+		fn(mount{root: fields[3], point: fields[4]}, tail[0], tail[2])
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("read mountinfo: %w", err)
+	}
+	return nil
+}
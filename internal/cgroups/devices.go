@@ -0,0 +1,237 @@
+package cgroups
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/ktsakalozos/runproc/internal/oci"
+)
+
+// checkDeviceRule checks a rule of linux.resources.devices: a type of a, b or c (all when
+// empty) and an access of r, w and m (all when empty).
+func checkDeviceRule(d oci.LinuxDeviceCgroup) error {
+	switch d.Type {
+	case "", "a", "b", "c":
+	default:
+		return fmt.Errorf("device rule type %q is not a, b or c", d.Type)
+	}
+	if strings.Trim(d.Access, "rwm") != "" {
+		return fmt.Errorf("device rule access %q is not made of r, w and m", d.Access)
+	}
+	return nil
+}
+
+// deviceRuleV1 is the line of devices.allow or devices.deny for d, e.g. "c 1:3 rwm".
+func deviceRuleV1(d oci.LinuxDeviceCgroup) string {
+	typ, access := d.Type, d.Access
+	if typ == "" {
+		typ = "a"
+	}
+	if access == "" {
+		access = "rwm"
+	}
+	num := func(n *int64) string {
+		if n == nil || *n < 0 {
+			return "*"
+		}
+		return strconv.FormatInt(*n, 10)
+	}
+	return fmt.Sprintf("%s %s:%s %s", typ, num(d.Major), num(d.Minor), access)
+}
+
+// The eBPF ABI of cgroup device programs (linux/bpf.h).
+const (
+	bpfProgLoad                = 5
+	bpfProgAttach              = 8
+	bpfProgTypeCgroupDevice    = 15
+	bpfCgroupDevice            = 6
+	bpfFAllowMulti             = 2
+	bpfDevcgDevBlock           = 1
+	bpfDevcgDevChar            = 2
+	bpfDevcgAccMknod           = 1
+	bpfDevcgAccRead            = 2
+	bpfDevcgAccWrite           = 4
+	bpfLogSize                 = 64 << 10
+	bpfRegCtx, bpfRegRet       = 1, 0
+	bpfRegType, bpfRegAccess   = 2, 3
+	bpfRegMajor, bpfRegMinor   = 4, 5
+	bpfRegScratch              = 6
+	ebpfLdxMemW                = 0x61 // BPF_LDX | BPF_MEM | BPF_W
+	ebpfMovX, ebpfMovK         = 0xbf, 0xb7
+	ebpfAndK, ebpfRshK         = 0x57, 0x77
+	ebpfJa, ebpfJeqK, ebpfJneK = 0x05, 0x15, 0x55
+	ebpfExit                   = 0x95
+)
+
+// ebpfInsn is struct bpf_insn: the destination register is the low nibble of regs, the
+// source the high one (both supported ABIs are little-endian).
+type ebpfInsn struct {
+	code uint8
+	regs uint8
+	off  int16
+	imm  int32
+}
+
+// deviceProgram assembles an eBPF program whose jumps are all forward to labels.
+type deviceProgram struct {
+	insns []ebpfInsn
+	// jumps[i] is the label insns[i] jumps to; labels[l] is where label l is placed
+	jumps  map[int]int
+	labels []int
+}
+
+func (p *deviceProgram) emit(code uint8, dst, src uint8, off int16, imm int32) {
+	p.insns = append(p.insns, ebpfInsn{code: code, regs: dst | src<<4, off: off, imm: imm})
+}
+
+func (p *deviceProgram) label() int {
+	p.labels = append(p.labels, -1)
+	return len(p.labels) - 1
+}
+
+func (p *deviceProgram) place(l int) { p.labels[l] = len(p.insns) }
+
+// jump emits a jump to l: unconditional for ebpfJa, else when dst compares to imm.
+func (p *deviceProgram) jump(code uint8, dst uint8, imm int32, l int) {
+	if p.jumps == nil {
+		p.jumps = map[int]int{}
+	}
+	p.jumps[len(p.insns)] = l
+	p.emit(code, dst, 0, 0, imm)
+}
+
+func (p *deviceProgram) ret(v int32) {
+	p.emit(ebpfMovK, bpfRegRet, 0, 0, v)
+	p.emit(ebpfExit, 0, 0, 0, 0)
+}
+
+// deviceFilter compiles rules to a cgroup device program with the semantics of the v1
+// devices controller: for each access asked for, the last rule that matches the device
+// and names the access decides, and an access no rule names is allowed (a v1 cgroup
+// starts out allowing everything).
+func deviceFilter(rules []oci.LinuxDeviceCgroup) []ebpfInsn {
+	p := &deviceProgram{}
+	// access_type is the device type in the low 16 bits and the access in the high ones
+	p.emit(ebpfLdxMemW, bpfRegType, bpfRegCtx, 0, 0)
+	p.emit(ebpfMovX, bpfRegAccess, bpfRegType, 0, 0)
+	p.emit(ebpfAndK, bpfRegType, 0, 0, 0xffff)
+	p.emit(ebpfRshK, bpfRegAccess, 0, 0, 16)
+	p.emit(ebpfLdxMemW, bpfRegMajor, bpfRegCtx, 4, 0)
+	p.emit(ebpfLdxMemW, bpfRegMinor, bpfRegCtx, 8, 0)
+	for _, acc := range []struct {
+		bit  int32
+		char string
+	}{{bpfDevcgAccMknod, "m"}, {bpfDevcgAccRead, "r"}, {bpfDevcgAccWrite, "w"}} {
+		decided := p.label()
+		p.emit(ebpfMovX, bpfRegScratch, bpfRegAccess, 0, 0)
+		p.emit(ebpfAndK, bpfRegScratch, 0, 0, acc.bit)
+		p.jump(ebpfJeqK, bpfRegScratch, 0, decided)
+		for i := len(rules) - 1; i >= 0; i-- {
+			r := rules[i]
+			if r.Access != "" && !strings.Contains(r.Access, acc.char) {
+				continue
+			}
+			miss := p.label()
+			all := true
+			switch r.Type {
+			case "b", "c":
+				typ := int32(bpfDevcgDevChar)
+				if r.Type == "b" {
+					typ = bpfDevcgDevBlock
+				}
+				p.jump(ebpfJneK, bpfRegType, typ, miss)
+				if r.Major != nil && *r.Major >= 0 {
+					p.jump(ebpfJneK, bpfRegMajor, int32(*r.Major), miss)
+				}
+				if r.Minor != nil && *r.Minor >= 0 {
+					p.jump(ebpfJneK, bpfRegMinor, int32(*r.Minor), miss)
+				}
+				all = false
+			}
+			if r.Allow {
+				p.jump(ebpfJa, 0, 0, decided)
+			} else {
+				p.ret(0)
+			}
+			p.place(miss)
+			// Rules before one that matches every device are never reached, and the
+			// verifier refuses unreachable instructions
+			if all {
+				break
+			}
+		}
+		p.place(decided)
+	}
+	p.ret(1)
+	for i, l := range p.jumps {
+		p.insns[i].off = int16(p.labels[l] - (i + 1))
+	}
+	return p.insns
+}
+
+// attachDeviceFilter loads the device program for rules and attaches it to the cgroup in
+// dir. Other programs attached there (by systemd) stay in force; a device must pass all
+// of them. The cgroup keeps the program for as long as it exists.
+func attachDeviceFilter(dir string, rules []oci.LinuxDeviceCgroup) error {
+	insns := deviceFilter(rules)
+	license := []byte("Apache-2.0\x00")
+	load := func(logBuf []byte) (int, error) {
+		attr := struct {
+			progType, insnCnt  uint32
+			insns, license     uint64
+			logLevel, logSize  uint32
+			logBuf             uint64
+			kernVersion, flags uint32
+		}{
+			progType: bpfProgTypeCgroupDevice,
+			insnCnt:  uint32(len(insns)),
+			insns:    uint64(uintptr(unsafe.Pointer(&insns[0]))),
+			license:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+		}
+		if logBuf != nil {
+			attr.logLevel, attr.logSize = 1, uint32(len(logBuf))
+			attr.logBuf = uint64(uintptr(unsafe.Pointer(&logBuf[0])))
+		}
+		fd, _, errno := syscall.Syscall(sysBPF, bpfProgLoad, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+		runtime.KeepAlive(insns)
+		runtime.KeepAlive(license)
+		runtime.KeepAlive(logBuf)
+		if errno != 0 {
+			return -1, errno
+		}
+		return int(fd), nil
+	}
+	prog, err := load(nil)
+	if errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.EACCES) {
+		// Ask again for the verifier's reasons
+		logBuf := make([]byte, bpfLogSize)
+		if _, lerr := load(logBuf); lerr != nil {
+			if n := bytes.IndexByte(logBuf, 0); n > 0 {
+				err = fmt.Errorf("%w: %s", err, strings.TrimSpace(string(logBuf[:n])))
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("load device program: %w", err)
+	}
+	defer syscall.Close(prog)
+	cg, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer cg.Close()
+	attr := struct {
+		targetFd, attachBpfFd, attachType, attachFlags uint32
+	}{uint32(cg.Fd()), uint32(prog), bpfCgroupDevice, bpfFAllowMulti}
+	if _, _, errno := syscall.Syscall(sysBPF, bpfProgAttach, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr)); errno != 0 {
+		return fmt.Errorf("attach device program to %s: %w", dir, errno)
+	}
+	return nil
+}
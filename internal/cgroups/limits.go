@@ -0,0 +1,161 @@
+package cgroups
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Limits are the limits the kernel enforces on a cgroup. A cgroup never gets more than any
+// of its ancestors allows, whatever it sets itself, so each effective limit is the tightest
+// one along the hierarchy, as far up as runproc's mount namespace shows it.
+type Limits struct {
+	Memory Limit    `json:"memory"`
+	Pids   Limit    `json:"pids"`
+	CPU    CPULimit `json:"cpu"`
+}
+
+// Limit is one limit of a cgroup. 0 means unlimited, as in Stats.
+type Limit struct {
+	// Effective is the tightest limit of the cgroup and its ancestors.
+	Effective uint64 `json:"effective"`
+	// Own is what the cgroup sets itself.
+	Own uint64 `json:"own"`
+	// SetBy is the cgroup Effective comes from; "" when unlimited.
+	SetBy string `json:"setBy,omitempty"`
+}
+
+// CPULimit is the CPU bandwidth and the CPUs a cgroup gets.
+type CPULimit struct {
+	// QuotaUsec per PeriodUsec is the tightest bandwidth of the cgroup and its ancestors;
+	// a QuotaUsec of 0 means unlimited.
+	QuotaUsec  uint64 `json:"quotaUsec"`
+	PeriodUsec uint64 `json:"periodUsec"`
+	// SetBy is the cgroup the bandwidth comes from; "" when unlimited.
+	SetBy string `json:"setBy,omitempty"`
+	// Cpus are the CPUs the cgroup may run on once the kernel clamped its cpuset to its
+	// ancestors' and the CPUs online; "" when the cpuset controller is not available.
+	Cpus string `json:"cpus,omitempty"`
+}
+
+// Limits reads the cgroup's memory, pids and CPU limits.
+func (c *Cgroup) Limits() (*Limits, error) {
+	memFile, cpusFile := "memory.max", "cpuset.cpus.effective"
+	if !c.Unified {
+		memFile, cpusFile = "memory.limit_in_bytes", "cpuset.effective_cpus"
+	}
+	l := &Limits{}
+	var err error
+	if l.Memory, err = c.limit("memory", memFile); err != nil {
+		return nil, err
+	}
+	if l.Pids, err = c.limit("pids", "pids.max"); err != nil {
+		return nil, err
+	}
+	if l.CPU, err = c.cpuLimit(); err != nil {
+		return nil, err
+	}
+	if d := c.dir("cpuset"); d != "" {
+		b, err := os.ReadFile(filepath.Join(d, cpusFile))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		l.CPU.Cpus = strings.TrimSpace(string(b))
+	}
+	return l, nil
+}
+
+// limit reads a single-value limit file of controller along the hierarchy.
+func (c *Cgroup) limit(controller, file string) (Limit, error) {
+	var l Limit
+	first := true
+	err := c.ancestry(controller, func(cgPath, dir string) error {
+		v, err := readUint(filepath.Join(dir, file))
+		if err != nil {
+			return err
+		}
+		if v >= v1Unlimited {
+			v = 0
+		}
+		if first {
+			l.Own, first = v, false
+		}
+		if v != 0 && (l.Effective == 0 || v < l.Effective) {
+			l.Effective, l.SetBy = v, cgPath
+		}
+		return nil
+	})
+	return l, err
+}
+
+// cpuLimit finds the tightest CPU bandwidth along the hierarchy.
+func (c *Cgroup) cpuLimit() (CPULimit, error) {
+	var l CPULimit
+	err := c.ancestry("cpu", func(cgPath, dir string) error {
+		quota, period, err := c.bandwidth(dir)
+		if err != nil {
+			return err
+		}
+		// quota/period < l.QuotaUsec/l.PeriodUsec, without dividing
+		if quota != 0 && period != 0 && (l.QuotaUsec == 0 || quota*l.PeriodUsec < l.QuotaUsec*period) {
+			l.QuotaUsec, l.PeriodUsec, l.SetBy = quota, period, cgPath
+		}
+		return nil
+	})
+	return l, err
+}
+
+// bandwidth reads the CPU quota and period of the cgroup in dir; a quota of 0 is no limit.
+func (c *Cgroup) bandwidth(dir string) (quota, period uint64, err error) {
+	if c.Unified {
+		var fields []string
+		if err := readLines(filepath.Join(dir, "cpu.max"), func(f []string) { fields = f }); err != nil {
+			return 0, 0, err
+		}
+		if len(fields) != 2 || fields[0] == "max" {
+			return 0, 0, nil
+		}
+		quota, _ = strconv.ParseUint(fields[0], 10, 64)
+		period, _ = strconv.ParseUint(fields[1], 10, 64)
+		return quota, period, nil
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "cpu.cfs_quota_us"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, 0, nil
+		}
+		return 0, 0, err
+	}
+	// -1 is no limit
+	q, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil || q <= 0 {
+		return 0, 0, err
+	}
+	period, err = readUint(filepath.Join(dir, "cpu.cfs_period_us"))
+	return uint64(q), period, err
+}
+
+// ancestry calls fn with the path and directory of controller's cgroup and then of each
+// ancestor up to the root of its hierarchy (of the cgroup namespace, if runproc is in one).
+func (c *Cgroup) ancestry(controller string, fn func(cgPath, dir string) error) error {
+	key := controller
+	if c.Unified {
+		key = ""
+	}
+	m, ok := c.mounts[key]
+	p, ok2 := c.paths[key]
+	if !ok || !ok2 {
+		return nil
+	}
+	for {
+		if err := fn(p, m.dir(p)); err != nil {
+			return err
+		}
+		if p == "/" || p == m.root {
+			return nil
+		}
+		p = path.Dir(p)
+	}
+}
@@ -0,0 +1,776 @@
+package cgroups
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ktsakalozos/runproc/internal/oci"
+)
+
+// managedV1 are the legacy controllers runproc creates container cgroups in. cpuset is
+// only used for a container that asks for CPUs or memory nodes (makeCpuset): a new v1
+// cpuset has none, and takes no processes, until both are set.
+var managedV1 = []string{"memory", "cpu", "cpuacct", "pids", "blkio", "devices", "cpuset"}
+
+// Manageable reports whether runproc can create container cgroups here: in the unified
+// hierarchy on a cgroup v2 node, or in the legacy controllers' hierarchies on v1 and
+// hybrid nodes.
+func Manageable() bool {
+	mounts, err := cgroupMounts()
+	if err != nil {
+		return false
+	}
+	_, unified := mounts[""]
+	return unified || legacy(mounts)
+}
+
+// legacy reports whether the node uses the v1 hierarchies: any of them is mounted. Hybrid
+// nodes also mount an unified hierarchy, without controllers.
+func legacy(mounts map[string]mount) bool {
+	for _, ctrl := range v1Controllers {
+		if _, ok := mounts[ctrl]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// HasController reports whether container cgroups get ctrl (e.g. "cpu"): on v1, whether
+// its hierarchy is mounted; on v2, whether the root offers it, as Create enables every
+// controller of the root on the way down.
+func HasController(ctrl string) bool {
+	mounts, err := cgroupMounts()
+	if err != nil {
+		return false
+	}
+	if legacy(mounts) {
+		_, ok := mounts[ctrl]
+		return ok
+	}
+	root, err := unifiedDir("/")
+	if err != nil {
+		return false
+	}
+	b, err := os.ReadFile(filepath.Join(root, "cgroup.controllers"))
+	if err != nil {
+		return false
+	}
+	for _, c := range strings.Fields(string(b)) {
+		if c == ctrl {
+			return true
+		}
+	}
+	return false
+}
+
+// unifiedDir returns the directory of cgPath, a path from the root of the unified
+// hierarchy such as linux.cgroupsPath.
+func unifiedDir(cgPath string) (string, error) {
+	mounts, err := cgroupMounts()
+	if err != nil {
+		return "", err
+	}
+	m, ok := mounts[""]
+	if !ok {
+		return "", errors.New("no cgroup2 hierarchy mounted")
+	}
+	return filepath.Join(m.point, path.Clean("/"+cgPath)), nil
+}
+
+// managed returns the cgroup at cgPath, a path from the root of each hierarchy such as
+// linux.cgroupsPath, as runproc manages it: in the unified hierarchy, or in each of the
+// managedV1 controllers that is mounted, cpuset only where the cgroup has one.
+func managed(cgPath string) (*Cgroup, error) {
+	mounts, err := cgroupMounts()
+	if err != nil {
+		return nil, err
+	}
+	cgPath = path.Clean("/" + cgPath)
+	c := &Cgroup{Path: cgPath, dirs: map[string]string{}, paths: map[string]string{}, mounts: mounts}
+	if legacy(mounts) {
+		for _, ctrl := range managedV1 {
+			if m, ok := mounts[ctrl]; ok {
+				d := filepath.Join(m.point, cgPath)
+				// The cpuset of a cgroup that has one (made by makeCpuset or the caller)
+				if _, err := os.Stat(d); ctrl == "cpuset" && err != nil {
+					continue
+				}
+				c.dirs[ctrl], c.paths[ctrl] = d, cgPath
+			}
+		}
+		return c, nil
+	}
+	m, ok := mounts[""]
+	if !ok {
+		return nil, errors.New("no cgroup hierarchy mounted")
+	}
+	c.Unified = true
+	c.dirs[""], c.paths[""] = filepath.Join(m.point, cgPath), cgPath
+	return c, nil
+}
+
+// distinctDirs lists the directories of the cgroup once each: v1 controllers mounted
+// together (cpu,cpuacct) share one.
+func (c *Cgroup) distinctDirs() []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, ctrl := range managedV1 {
+		if d := c.dirs[ctrl]; d != "" && !seen[d] {
+			seen[d] = true
+			out = append(out, d)
+		}
+	}
+	if d := c.dirs[""]; d != "" {
+		out = append(out, d)
+	}
+	return out
+}
+
+// Create makes the cgroup at cgPath and applies r to it. On v2 the controllers of each
+// ancestor are enabled for its children on the way down, so the cgroup can be limited and
+// its usage read; on v1 the cgroup is made in each managed controller's hierarchy. A
+// cgroup that already exists is reused, as the caller may have set it up.
+func Create(cgPath string, r *oci.LinuxResources) (*Cgroup, error) {
+	c, err := managed(cgPath)
+	if err != nil {
+		return nil, err
+	}
+	if c.Unified {
+		root, err := unifiedDir("/")
+		if err != nil {
+			return nil, err
+		}
+		parent := root
+		for _, name := range strings.Split(strings.TrimPrefix(c.Path, "/"), "/") {
+			if err := enableControllers(parent); err != nil {
+				return nil, err
+			}
+			parent = filepath.Join(parent, name)
+			if err := os.Mkdir(parent, 0o755); err != nil && !errors.Is(err, os.ErrExist) {
+				return nil, err
+			}
+		}
+	}
+	if err := c.setUp(r); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Adopt applies r to the cgroup at cgPath that systemd made for a scope (see StartScope).
+// On v1, systemd may not have made it in every managed controller's hierarchy; Adopt makes
+// the rest.
+func Adopt(cgPath string, r *oci.LinuxResources) (*Cgroup, error) {
+	c, err := managed(cgPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.setUp(r); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// setUp makes the cgroup in each v1 hierarchy, the unified one being ready, and applies r
+// to it, removing it again on failure.
+func (c *Cgroup) setUp(r *oci.LinuxResources) error {
+	if !c.Unified {
+		for _, d := range c.distinctDirs() {
+			if err := os.MkdirAll(d, 0o755); err != nil {
+				_ = Remove(c.Path)
+				return err
+			}
+		}
+		if r != nil && r.CPU != nil && (r.CPU.Cpus != "" || r.CPU.Mems != "") && c.dirs["cpuset"] == "" {
+			if err := c.makeCpuset(); err != nil {
+				_ = Remove(c.Path)
+				return err
+			}
+		}
+	}
+	if err := c.apply(r); err != nil {
+		_ = Remove(c.Path)
+		return err
+	}
+	return nil
+}
+
+// makeCpuset makes the cgroup in the v1 cpuset hierarchy. Each cgroup made on the way
+// down gets the CPUs and memory nodes of its parent, like runc does, so it takes
+// processes; apply narrows the container's own afterwards.
+func (c *Cgroup) makeCpuset() error {
+	m, ok := c.mounts["cpuset"]
+	if !ok {
+		return errors.New("linux.resources.cpu.cpus and mems need the cpuset controller, which is not mounted")
+	}
+	dir := m.point
+	for _, name := range strings.Split(strings.TrimPrefix(c.Path, "/"), "/") {
+		parent := dir
+		dir = filepath.Join(dir, name)
+		if err := os.Mkdir(dir, 0o755); err != nil && !errors.Is(err, os.ErrExist) {
+			return err
+		}
+		for _, file := range []string{"cpuset.cpus", "cpuset.mems"} {
+			if b, err := os.ReadFile(filepath.Join(dir, file)); err != nil || strings.TrimSpace(string(b)) != "" {
+				continue
+			}
+			b, err := os.ReadFile(filepath.Join(parent, file))
+			if err != nil {
+				return err
+			}
+			if err := os.WriteFile(filepath.Join(dir, file), b, 0); err != nil {
+				return fmt.Errorf("set %s of %s: %w", file, dir, err)
+			}
+		}
+	}
+	c.dirs["cpuset"], c.paths["cpuset"] = dir, c.Path
+	return nil
+}
+
+// Dir is the directory to clone a process straight into: the cgroup's on v2, "" on v1,
+// where a process has to Join the cgroup of each controller.
+func (c *Cgroup) Dir() string {
+	if !c.Unified {
+		return ""
+	}
+	return c.dirs[""]
+}
+
+// Join moves pid into the cgroup, in every hierarchy it was made in.
+func (c *Cgroup) Join(pid int) error {
+	for _, d := range c.distinctDirs() {
+		if err := os.WriteFile(filepath.Join(d, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0); err != nil {
+			return fmt.Errorf("join cgroup %s: %w", d, err)
+		}
+	}
+	return nil
+}
+
+// JoinThread moves the calling thread alone into the v1 cgroup, in every hierarchy it was
+// made in, so the processes it forks start there. The returned func moves the thread back,
+// so the cgroup can be removed; it works from any mount namespace the thread enters
+// meanwhile, as the files it writes are open already. The caller keeps the thread locked
+// to its goroutine until then.
+func (c *Cgroup) JoinThread() (func() error, error) {
+	tid := syscall.Gettid()
+	paths, err := procCgroups(tid)
+	if err != nil {
+		return nil, err
+	}
+	var back []*os.File
+	restore := func() error {
+		var errs []error
+		for _, f := range back {
+			if _, err := f.WriteString(strconv.Itoa(tid)); err != nil {
+				errs = append(errs, fmt.Errorf("leave cgroup: %w", err))
+			}
+			f.Close()
+		}
+		return errors.Join(errs...)
+	}
+	seen := map[string]bool{}
+	for _, ctrl := range managedV1 {
+		d, p := c.dirs[ctrl], paths[ctrl]
+		if d == "" || p == "" || seen[d] {
+			continue
+		}
+		seen[d] = true
+		f, err := os.OpenFile(filepath.Join(c.mounts[ctrl].dir(p), "tasks"), os.O_WRONLY, 0)
+		if err == nil {
+			back = append(back, f)
+			err = os.WriteFile(filepath.Join(d, "tasks"), []byte(strconv.Itoa(tid)), 0)
+		}
+		if err != nil {
+			_ = restore()
+			return nil, fmt.Errorf("join cgroup %s: %w", d, err)
+		}
+	}
+	return restore, nil
+}
+
+// enableControllers enables every controller of the cgroup in dir for its children. The
+// kernel refuses that for a cgroup with processes of its own (other than the root).
+func enableControllers(dir string) error {
+	b, err := os.ReadFile(filepath.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		return err
+	}
+	enabled, err := os.ReadFile(filepath.Join(dir, "cgroup.subtree_control"))
+	if err != nil {
+		return err
+	}
+	have := map[string]bool{}
+	for _, c := range strings.Fields(string(enabled)) {
+		have[c] = true
+	}
+	var add []string
+	for _, c := range strings.Fields(string(b)) {
+		if !have[c] {
+			add = append(add, "+"+c)
+		}
+	}
+	if len(add) == 0 {
+		return nil
+	}
+	if err := os.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte(strings.Join(add, " ")), 0); err != nil {
+		return fmt.Errorf("enable controllers in %s: %w", dir, err)
+	}
+	return nil
+}
+
+// setter records that file of controller's cgroup ("" on v2) is set to value.
+type setter func(controller, file, value string)
+
+// apply writes the limits of r to the cgroup, converted to their v2 or v1 form like runc
+// does, and on v2 attaches the device program for its device rules. Hugepages, network,
+// RDMA and the kernel memory limits are not applied.
+func (c *Cgroup) apply(r *oci.LinuxResources) error {
+	if r == nil {
+		return nil
+	}
+	type write struct{ controller, file, value string }
+	var writes []write
+	set := func(controller, file, value string) { writes = append(writes, write{controller, file, value}) }
+	var err error
+	if c.Unified {
+		err = c.resourcesV2(r, set)
+	} else {
+		err = c.resourcesV1(r, set)
+	}
+	if err != nil {
+		return err
+	}
+	for _, w := range writes {
+		d := c.dir(w.controller)
+		if d == "" {
+			return fmt.Errorf("set %s: the %s controller is not mounted", w.file, w.controller)
+		}
+		if err := os.WriteFile(filepath.Join(d, w.file), []byte(w.value), 0); err != nil {
+			return fmt.Errorf("set %s to %q: %w", w.file, w.value, err)
+		}
+	}
+	if c.Unified && len(r.Devices) > 0 {
+		return attachDeviceFilter(c.dir(""), r.Devices)
+	}
+	return nil
+}
+
+// has reports whether controller's cgroup has file; some only exist with a kernel option
+// or I/O scheduler.
+func (c *Cgroup) has(controller, file string) bool {
+	d := c.dir(controller)
+	if d == "" {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(d, file))
+	return err == nil
+}
+
+// resourcesV2 converts r to the files of the unified hierarchy.
+func (c *Cgroup) resourcesV2(r *oci.LinuxResources, set setter) error {
+	if cpu := r.CPU; cpu != nil {
+		if cpu.Cpus != "" {
+			set("", "cpuset.cpus", cpu.Cpus)
+		}
+		if cpu.Mems != "" {
+			set("", "cpuset.mems", cpu.Mems)
+		}
+		if cpu.Shares != nil && *cpu.Shares != 0 {
+			set("", "cpu.weight", strconv.FormatUint(cpuWeight(*cpu.Shares), 10))
+		}
+		if cpu.Quota != nil || cpu.Period != nil {
+			quota, period := "max", uint64(100000)
+			if cpu.Quota != nil && *cpu.Quota > 0 {
+				quota = strconv.FormatInt(*cpu.Quota, 10)
+			}
+			if cpu.Period != nil && *cpu.Period != 0 {
+				period = *cpu.Period
+			}
+			set("", "cpu.max", quota+" "+strconv.FormatUint(period, 10))
+		}
+	}
+	if m := r.Memory; m != nil {
+		// 0 leaves the kernel's default; -1 is no limit
+		if m.Limit != nil && *m.Limit != 0 {
+			set("", "memory.max", maxOr(*m.Limit))
+		}
+		if m.Reservation != nil && *m.Reservation != 0 {
+			set("", "memory.low", maxOr(*m.Reservation))
+		}
+		if m.Swap != nil && *m.Swap != 0 {
+			if err := checkSwap(m); err != nil {
+				return err
+			}
+			// The spec's swap is memory plus swap; the v2 limit is swap alone
+			swap := "max"
+			if *m.Swap >= 0 {
+				swap = strconv.FormatInt(*m.Swap-*m.Limit, 10)
+			}
+			// Without swap accounting there is no file, and no swap to allow or deny
+			if c.has("", "memory.swap.max") || (swap != "0" && swap != "max") {
+				set("", "memory.swap.max", swap)
+			}
+		}
+	}
+	if p := r.Pids; p != nil {
+		set("", "pids.max", maxOr(p.Limit))
+	}
+	if b := r.BlockIO; b != nil {
+		// BFQ takes the spec's weights as they are; the io controller's range is wider
+		weightFile, weight := "io.weight", ioWeight
+		if c.has("", "io.bfq.weight") {
+			weightFile, weight = "io.bfq.weight", func(w uint16) uint64 { return uint64(w) }
+		}
+		if b.Weight != nil && *b.Weight != 0 {
+			set("", weightFile, strconv.FormatUint(weight(*b.Weight), 10))
+		}
+		for _, d := range b.WeightDevice {
+			if d.Weight != nil {
+				set("", weightFile, fmt.Sprintf("%d:%d %d", d.Major, d.Minor, weight(*d.Weight)))
+			}
+		}
+		for _, t := range []struct {
+			key     string
+			devices []oci.LinuxThrottleDevice
+		}{
+			{"rbps", b.ThrottleReadBpsDevice}, {"wbps", b.ThrottleWriteBpsDevice},
+			{"riops", b.ThrottleReadIOPSDevice}, {"wiops", b.ThrottleWriteIOPSDevice},
+		} {
+			for _, d := range t.devices {
+				set("", "io.max", fmt.Sprintf("%d:%d %s=%d", d.Major, d.Minor, t.key, d.Rate))
+			}
+		}
+	}
+	// The device rules go to a device program rather than a file (see apply)
+	for _, d := range r.Devices {
+		if err := checkDeviceRule(d); err != nil {
+			return err
+		}
+	}
+	// Last, so a file given there overrides what runproc converted for it
+	for _, key := range sortedKeys(r.Unified) {
+		if err := c.checkUnified(key); err != nil {
+			return fmt.Errorf("linux.resources.unified: %w", err)
+		}
+		set("", key, r.Unified[key])
+	}
+	return nil
+}
+
+// runprocUnified are the core files of a v2 cgroup that runproc manages itself: written
+// through linux.resources.unified they would move or kill processes, freeze the init
+// before it execs, or change the cgroup's place in the tree.
+var runprocUnified = map[string]bool{
+	"cgroup.procs": true, "cgroup.threads": true, "cgroup.kill": true, "cgroup.freeze": true,
+	"cgroup.subtree_control": true, "cgroup.type": true,
+}
+
+// checkUnified checks that key of linux.resources.unified is a file the cgroup has and
+// runproc leaves to the spec, telling a controller the cgroup lacks from a tunable the
+// kernel lacks (cpu.idle before 5.15, io.latency without blk-iolatency).
+func (c *Cgroup) checkUnified(key string) error {
+	if key == "" || strings.Contains(key, "/") || key == "." || key == ".." {
+		return fmt.Errorf("%q is not a cgroup file", key)
+	}
+	if runprocUnified[key] {
+		return fmt.Errorf("%s is managed by runproc", key)
+	}
+	if c.has("", key) {
+		return nil
+	}
+	controller, _, _ := strings.Cut(key, ".")
+	if controller != "cgroup" {
+		b, err := os.ReadFile(filepath.Join(c.dir(""), "cgroup.controllers"))
+		if err == nil && !slices.Contains(strings.Fields(string(b)), controller) {
+			return fmt.Errorf("%s needs the %s controller, which the cgroup does not have", key, controller)
+		}
+	}
+	return fmt.Errorf("the cgroup has no %s on this kernel", key)
+}
+
+// resourcesV1 converts r to the files of the legacy controllers.
+func (c *Cgroup) resourcesV1(r *oci.LinuxResources, set setter) error {
+	if cpu := r.CPU; cpu != nil {
+		if cpu.Cpus != "" {
+			set("cpuset", "cpuset.cpus", cpu.Cpus)
+		}
+		if cpu.Mems != "" {
+			set("cpuset", "cpuset.mems", cpu.Mems)
+		}
+		if cpu.Shares != nil && *cpu.Shares != 0 {
+			set("cpu", "cpu.shares", strconv.FormatUint(*cpu.Shares, 10))
+		}
+		// The period first: the kernel checks the quota against it
+		if cpu.Period != nil && *cpu.Period != 0 {
+			set("cpu", "cpu.cfs_period_us", strconv.FormatUint(*cpu.Period, 10))
+		}
+		if cpu.Quota != nil {
+			set("cpu", "cpu.cfs_quota_us", strconv.FormatInt(max(*cpu.Quota, -1), 10))
+		}
+	}
+	if m := r.Memory; m != nil {
+		// 0 leaves the kernel's default; -1 is no limit, as in the v1 files
+		if m.Limit != nil && *m.Limit != 0 {
+			set("memory", "memory.limit_in_bytes", strconv.FormatInt(max(*m.Limit, -1), 10))
+		}
+		if m.Reservation != nil && *m.Reservation != 0 {
+			set("memory", "memory.soft_limit_in_bytes", strconv.FormatInt(max(*m.Reservation, -1), 10))
+		}
+		if m.Swap != nil && *m.Swap != 0 {
+			if err := checkSwap(m); err != nil {
+				return err
+			}
+			// Memory plus swap, like the spec's; without swap accounting there is no file,
+			// and no swap to allow or deny
+			if c.has("memory", "memory.memsw.limit_in_bytes") || (*m.Swap >= 0 && *m.Swap != *m.Limit) {
+				set("memory", "memory.memsw.limit_in_bytes", strconv.FormatInt(max(*m.Swap, -1), 10))
+			}
+		}
+	}
+	if p := r.Pids; p != nil {
+		set("pids", "pids.max", maxOr(p.Limit))
+	}
+	if b := r.BlockIO; b != nil {
+		// Both take the spec's weights as they are
+		prefix := "blkio."
+		if c.has("blkio", "blkio.bfq.weight") {
+			prefix = "blkio.bfq."
+		}
+		if b.Weight != nil && *b.Weight != 0 {
+			set("blkio", prefix+"weight", strconv.FormatUint(uint64(*b.Weight), 10))
+		}
+		for _, d := range b.WeightDevice {
+			if d.Weight != nil {
+				set("blkio", prefix+"weight_device", fmt.Sprintf("%d:%d %d", d.Major, d.Minor, *d.Weight))
+			}
+		}
+		for _, t := range []struct {
+			file    string
+			devices []oci.LinuxThrottleDevice
+		}{
+			{"read_bps_device", b.ThrottleReadBpsDevice}, {"write_bps_device", b.ThrottleWriteBpsDevice},
+			{"read_iops_device", b.ThrottleReadIOPSDevice}, {"write_iops_device", b.ThrottleWriteIOPSDevice},
+		} {
+			for _, d := range t.devices {
+				set("blkio", "blkio.throttle."+t.file, fmt.Sprintf("%d:%d %d", d.Major, d.Minor, d.Rate))
+			}
+		}
+	}
+	// In order: a later rule overrides what an earlier one allowed or denied
+	for _, d := range r.Devices {
+		if err := checkDeviceRule(d); err != nil {
+			return err
+		}
+		file := "devices.deny"
+		if d.Allow {
+			file = "devices.allow"
+		}
+		set("devices", file, deviceRuleV1(d))
+	}
+	if len(r.Unified) > 0 {
+		return errors.New("linux.resources.unified needs a cgroup v2 node")
+	}
+	return nil
+}
+
+// checkSwap checks the memory.swap of m, which is memory plus swap: it needs a limit it
+// is not below, unless it is -1 (no limit).
+func checkSwap(m *oci.LinuxMemory) error {
+	if *m.Swap < 0 {
+		return nil
+	}
+	if m.Limit == nil || *m.Limit <= 0 {
+		return errors.New("linux.resources.memory.swap needs a memory limit")
+	}
+	if *m.Swap < *m.Limit {
+		return fmt.Errorf("linux.resources.memory.swap %d is less than the memory limit %d", *m.Swap, *m.Limit)
+	}
+	return nil
+}
+
+// cpuWeight converts cpu shares (2..262144) to cpu.weight (1..10000).
+func cpuWeight(shares uint64) uint64 {
+	shares = min(max(shares, 2), 262144)
+	return 1 + (shares-2)*9999/262142
+}
+
+// ioWeight converts a blkio weight (10..1000) to io.weight (1..10000).
+func ioWeight(w uint16) uint64 {
+	v := uint64(min(max(w, 10), 1000))
+	return 1 + (v-10)*9999/990
+}
+
+// maxOr formats a limit where a value below 1 means none.
+func maxOr(v int64) string {
+	if v <= 0 {
+		return "max"
+	}
+	return strconv.FormatInt(v, 10)
+}
+
+// sortedKeys returns the keys of m in order, so unified files are written predictably.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Remove kills whatever is left in the cgroup at cgPath and removes it with any cgroups
+// the workload made below it, in every hierarchy it was made in, leaving its parents,
+// which other containers of the pod may share. A cgroup already gone is fine.
+func Remove(cgPath string) error {
+	c, err := managed(cgPath)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, d := range c.distinctDirs() {
+		if err := removeDir(d, c.Unified); err != nil {
+			errs = append(errs, fmt.Errorf("remove cgroup %s: %w", d, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Procs lists the processes in the cgroup at cgPath and the cgroups below it, in any
+// hierarchy it was made in, sorted: wherever they moved in the process tree and whichever
+// session they lead. A hierarchy the cgroup is missing from (systemd had not made it
+// there yet) is skipped, as are cgroups removed during the walk.
+func Procs(cgPath string) ([]int, error) {
+	c, err := managed(cgPath)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[int]bool{}
+	var pids []int
+	for _, d := range c.distinctDirs() {
+		err := filepath.WalkDir(d, func(p string, e fs.DirEntry, err error) error {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			if err != nil || !e.IsDir() {
+				return err
+			}
+			b, err := os.ReadFile(filepath.Join(p, "cgroup.procs"))
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			for _, f := range strings.Fields(string(b)) {
+				if pid, err := strconv.Atoi(f); err == nil && pid > 0 && !seen[pid] {
+					seen[pid] = true
+					pids = append(pids, pid)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Ints(pids)
+	return pids, nil
+}
+
+// Kill SIGKILLs every process in the cgroup at cgPath through its cgroup.kill, which also
+// catches processes forked meanwhile. It fails with errors.ErrUnsupported on v1 and
+// before Linux 5.14, which have no cgroup.kill; signal what Procs lists instead.
+func Kill(cgPath string) error {
+	c, err := managed(cgPath)
+	if err != nil {
+		return err
+	}
+	if !c.Unified {
+		return errors.ErrUnsupported
+	}
+	err = os.WriteFile(filepath.Join(c.dirs[""], "cgroup.kill"), []byte("1"), 0)
+	if errors.Is(err, os.ErrNotExist) {
+		if _, serr := os.Stat(c.dirs[""]); serr == nil {
+			return errors.ErrUnsupported
+		}
+	}
+	return err
+}
+
+// removeDir kills the processes of the cgroup in dir and the cgroups below it, and removes
+// them all.
+func removeDir(dir string, unified bool) error {
+	if unified {
+		// cgroup.kill is there from Linux 5.14
+		_ = os.WriteFile(filepath.Join(dir, "cgroup.kill"), []byte("1"), 0)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if !unified {
+			killProcs(dir)
+		}
+		err := rmdirAll(dir)
+		if err == nil {
+			return nil
+		}
+		// Killed processes leave the cgroup once they are reaped
+		if !errors.Is(err, syscall.EBUSY) || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// rmdirAll removes the cgroup in dir after the cgroups below it, deepest first, like
+// runc's RemovePath: rmdir refuses a cgroup that has children. A cgroup already gone is
+// fine.
+func rmdirAll(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			if err := rmdirAll(filepath.Join(dir, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	if err := syscall.Rmdir(dir); err != nil && !errors.Is(err, syscall.ENOENT) {
+		return err
+	}
+	return nil
+}
+
+// killProcs sends SIGKILL to every process of the v1 cgroup in dir and the cgroups below
+// it, which have no cgroup.kill. Processes forked meanwhile are found on the next call.
+func killProcs(dir string) {
+	_ = filepath.WalkDir(dir, func(p string, e fs.DirEntry, err error) error {
+		if err != nil || !e.IsDir() {
+			return nil
+		}
+		b, err := os.ReadFile(filepath.Join(p, "cgroup.procs"))
+		if err != nil {
+			return nil
+		}
+		for _, f := range strings.Fields(string(b)) {
+			if pid, err := strconv.Atoi(f); err == nil && pid > 0 {
+				_ = syscall.Kill(pid, syscall.SIGKILL)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,288 @@
+package cgroups
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Stats is a point-in-time usage sample of a cgroup. Limits of 0 mean unlimited, and
+// counters whose files are missing (e.g. the root cgroup) are reported as 0.
+type Stats struct {
+	CPU    CPUStats    `json:"cpu"`
+	Memory MemoryStats `json:"memory"`
+	Pids   PidsStats   `json:"pids"`
+	Blkio  BlkioStats  `json:"blkio"`
+}
+
+type CPUStats struct {
+	UsageUsec     uint64 `json:"usageUsec"`
+	UserUsec      uint64 `json:"userUsec"`
+	SystemUsec    uint64 `json:"systemUsec"`
+	NrThrottled   uint64 `json:"nrThrottled"`
+	ThrottledUsec uint64 `json:"throttledUsec"`
+}
+
+type MemoryStats struct {
+	Usage    uint64 `json:"usage"`
+	MaxUsage uint64 `json:"maxUsage"`
+	Limit    uint64 `json:"limit"`
+}
+
+type PidsStats struct {
+	Current uint64 `json:"current"`
+	Limit   uint64 `json:"limit"`
+}
+
+type BlkioStats struct {
+	Devices []BlkioDevice `json:"devices"`
+}
+
+type BlkioDevice struct {
+	Major      uint64 `json:"major"`
+	Minor      uint64 `json:"minor"`
+	ReadBytes  uint64 `json:"readBytes"`
+	WriteBytes uint64 `json:"writeBytes"`
+	ReadIOs    uint64 `json:"readIOs"`
+	WriteIOs   uint64 `json:"writeIOs"`
+}
+
+// v1Unlimited is the smallest value v1 reports as "no limit" (PAGE_COUNTER_MAX pages).
+const v1Unlimited = 1 << 62
+
+// Stats samples the cgroup's CPU, memory, pids and block I/O usage.
+func (c *Cgroup) Stats() (*Stats, error) {
+	s := &Stats{Blkio: BlkioStats{Devices: []BlkioDevice{}}}
+	var err error
+	if c.Unified {
+		err = c.statsV2(s)
+	} else {
+		err = c.statsV1(s)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// OOMKills reports how many processes the kernel's OOM killer killed in the cgroup runproc
+// made at cgPath: oom_kill of memory.events, or of memory.oom_control on v1 (Linux 4.13
+// and later). Without the memory controller there are none to count.
+func OOMKills(cgPath string) (uint64, error) {
+	c, err := managed(cgPath)
+	if err != nil {
+		return 0, err
+	}
+	d, file := c.dir("memory"), "memory.oom_control"
+	if c.Unified {
+		file = "memory.events"
+	}
+	if d == "" {
+		return 0, nil
+	}
+	kv, err := readKeyValues(filepath.Join(d, file))
+	return kv["oom_kill"], err
+}
+
+func (c *Cgroup) statsV2(s *Stats) error {
+	d := c.dir("")
+	kv, err := readKeyValues(filepath.Join(d, "cpu.stat"))
+	if err != nil {
+		return err
+	}
+	s.CPU = CPUStats{
+		UsageUsec:     kv["usage_usec"],
+		UserUsec:      kv["user_usec"],
+		SystemUsec:    kv["system_usec"],
+		NrThrottled:   kv["nr_throttled"],
+		ThrottledUsec: kv["throttled_usec"],
+	}
+	if s.Memory.Usage, err = readUint(filepath.Join(d, "memory.current")); err != nil {
+		return err
+	}
+	if s.Memory.MaxUsage, err = readUint(filepath.Join(d, "memory.peak")); err != nil {
+		return err
+	}
+	if s.Memory.Limit, err = readUint(filepath.Join(d, "memory.max")); err != nil {
+		return err
+	}
+	if s.Pids.Current, err = readUint(filepath.Join(d, "pids.current")); err != nil {
+		return err
+	}
+	if s.Pids.Limit, err = readUint(filepath.Join(d, "pids.max")); err != nil {
+		return err
+	}
+	return readLines(filepath.Join(d, "io.stat"), func(fields []string) {
+		dev, ok := parseDevice(fields[0])
+		if !ok {
+			return
+		}
+		for _, f := range fields[1:] {
+			k, v, _ := strings.Cut(f, "=")
+			n, _ := strconv.ParseUint(v, 10, 64)
+			switch k {
+			case "rbytes":
+				dev.ReadBytes = n
+			case "wbytes":
+				dev.WriteBytes = n
+			case "rios":
+				dev.ReadIOs = n
+			case "wios":
+				dev.WriteIOs = n
+			}
+		}
+		s.Blkio.Devices = append(s.Blkio.Devices, dev)
+	})
+}
+
+func (c *Cgroup) statsV1(s *Stats) error {
+	if d := c.dir("cpuacct"); d != "" {
+		ns, err := readUint(filepath.Join(d, "cpuacct.usage"))
+		if err != nil {
+			return err
+		}
+		s.CPU.UsageUsec = ns / 1000
+		// cpuacct.stat is in USER_HZ, which is 100 on every Linux ABI
+		ticks, err := readKeyValues(filepath.Join(d, "cpuacct.stat"))
+		if err != nil {
+			return err
+		}
+		s.CPU.UserUsec = ticks["user"] * 10000
+		s.CPU.SystemUsec = ticks["system"] * 10000
+	}
+	if d := c.dir("cpu"); d != "" {
+		kv, err := readKeyValues(filepath.Join(d, "cpu.stat"))
+		if err != nil {
+			return err
+		}
+		s.CPU.NrThrottled = kv["nr_throttled"]
+		s.CPU.ThrottledUsec = kv["throttled_time"] / 1000
+	}
+	var err error
+	if d := c.dir("memory"); d != "" {
+		if s.Memory.Usage, err = readUint(filepath.Join(d, "memory.usage_in_bytes")); err != nil {
+			return err
+		}
+		if s.Memory.MaxUsage, err = readUint(filepath.Join(d, "memory.max_usage_in_bytes")); err != nil {
+			return err
+		}
+		if s.Memory.Limit, err = readUint(filepath.Join(d, "memory.limit_in_bytes")); err != nil {
+			return err
+		}
+		if s.Memory.Limit >= v1Unlimited {
+			s.Memory.Limit = 0
+		}
+	}
+	if d := c.dir("pids"); d != "" {
+		if s.Pids.Current, err = readUint(filepath.Join(d, "pids.current")); err != nil {
+			return err
+		}
+		if s.Pids.Limit, err = readUint(filepath.Join(d, "pids.max")); err != nil {
+			return err
+		}
+	}
+	d := c.dir("blkio")
+	if d == "" {
+		return nil
+	}
+	devs := map[[2]uint64]*BlkioDevice{}
+	var order [][2]uint64
+	collect := func(file string, read, write func(*BlkioDevice, uint64)) error {
+		return readLines(filepath.Join(d, file), func(fields []string) {
+			if len(fields) != 3 {
+				return // "Total N"
+			}
+			dev, ok := parseDevice(fields[0])
+			if !ok {
+				return
+			}
+			key := [2]uint64{dev.Major, dev.Minor}
+			p := devs[key]
+			if p == nil {
+				p = &dev
+				devs[key] = p
+				order = append(order, key)
+			}
+			n, _ := strconv.ParseUint(fields[2], 10, 64)
+			switch fields[1] {
+			case "Read":
+				read(p, n)
+			case "Write":
+				write(p, n)
+			}
+		})
+	}
+	if err := collect("blkio.throttle.io_service_bytes",
+		func(d *BlkioDevice, n uint64) { d.ReadBytes = n },
+		func(d *BlkioDevice, n uint64) { d.WriteBytes = n }); err != nil {
+		return err
+	}
+	if err := collect("blkio.throttle.io_serviced",
+		func(d *BlkioDevice, n uint64) { d.ReadIOs = n },
+		func(d *BlkioDevice, n uint64) { d.WriteIOs = n }); err != nil {
+		return err
+	}
+	for _, k := range order {
+		s.Blkio.Devices = append(s.Blkio.Devices, *devs[k])
+	}
+	return nil
+}
+
+// readUint reads a single-value file; "max" maps to 0 (unlimited) and a missing file to 0.
+func readUint(path string) (uint64, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	v := strings.TrimSpace(string(b))
+	if v == "max" {
+		return 0, nil
+	}
+	return strconv.ParseUint(v, 10, 64)
+}
+
+// readKeyValues reads "key value" lines such as cpu.stat; a missing file yields no keys.
+func readKeyValues(path string) (map[string]uint64, error) {
+	out := map[string]uint64{}
+	err := readLines(path, func(fields []string) {
+		if len(fields) == 2 {
+			out[fields[0]], _ = strconv.ParseUint(fields[1], 10, 64)
+		}
+	})
+	return out, err
+}
+
+// readLines calls fn with the fields of each non-empty line; a missing file is skipped.
+func readLines(path string, fn func(fields []string)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if fields := strings.Fields(sc.Text()); len(fields) > 0 {
+			fn(fields)
+		}
+	}
+	return sc.Err()
+}
+
+func parseDevice(s string) (BlkioDevice, bool) {
+	maj, min, ok := strings.Cut(s, ":")
+	if !ok {
+		return BlkioDevice{}, false
+	}
+	a, err1 := strconv.ParseUint(maj, 10, 64)
+	b, err2 := strconv.ParseUint(min, 10, 64)
+	return BlkioDevice{Major: a, Minor: b}, err1 == nil && err2 == nil
+}
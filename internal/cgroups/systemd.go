@@ -0,0 +1,260 @@
+package cgroups
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ktsakalozos/runproc/internal/oci"
+)
+
+// Scope is the transient systemd scope unit that holds a container's cgroup with the
+// systemd cgroup driver, as kubelet's systemd driver expects it.
+type Scope struct {
+	// Slice is the slice unit the scope is in, e.g. "kubepods-besteffort-pod1.slice".
+	Slice string
+	// Unit is the scope's unit name, e.g. "cri-containerd-<id>.scope".
+	Unit string
+	// Path is the cgroup systemd makes for the scope, from the root of each hierarchy.
+	Path string
+}
+
+// defaultSlice holds scopes of containers whose cgroupsPath names no slice, as with runc.
+const defaultSlice = "system.slice"
+
+// scopeStartTimeout bounds how long StartScope waits for systemd to move the init.
+const scopeStartTimeout = 10 * time.Second
+
+// SystemdAvailable reports whether the systemd cgroup driver can work here: systemd is
+// the init system (the check of sd_booted) and busctl, which runproc calls it through, is
+// in PATH.
+func SystemdAvailable() bool {
+	if fi, err := os.Stat("/run/systemd/system"); err != nil || !fi.IsDir() {
+		return false
+	}
+	_, err := exec.LookPath("busctl")
+	return err == nil
+}
+
+// ParseScope reads a linux.cgroupsPath in systemd's "slice:prefix:name" form, the one
+// containerd passes with SystemdCgroup. The scope is "<prefix>-<name>.scope" ("<name>.scope"
+// without a prefix) in the slice, system.slice when it is empty; an empty cgroupsPath is
+// "system.slice:runproc:<id>".
+func ParseScope(cgroupsPath, id string) (*Scope, error) {
+	if cgroupsPath == "" {
+		cgroupsPath = defaultSlice + ":runproc:" + id
+	}
+	parts := strings.Split(cgroupsPath, ":")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("linux.cgroupsPath %q is not slice:prefix:name, which the systemd cgroup driver needs", cgroupsPath)
+	}
+	slice, prefix, name := parts[0], parts[1], parts[2]
+	if slice == "" {
+		slice = defaultSlice
+	}
+	if name == "" || strings.HasSuffix(name, ".slice") {
+		return nil, fmt.Errorf("linux.cgroupsPath %q names no scope", cgroupsPath)
+	}
+	dir, err := expandSlice(slice)
+	if err != nil {
+		return nil, err
+	}
+	unit := name + ".scope"
+	if prefix != "" {
+		unit = prefix + "-" + unit
+	}
+	if strings.Contains(unit, "/") {
+		return nil, fmt.Errorf("linux.cgroupsPath %q: %q is not a unit name", cgroupsPath, unit)
+	}
+	return &Scope{Slice: slice, Unit: unit, Path: path.Join(dir, unit)}, nil
+}
+
+// expandSlice returns the cgroup of a slice unit: each '-' of its name is a level, so
+// "kubepods-besteffort.slice" is /kubepods.slice/kubepods-besteffort.slice. "-.slice" is
+// the root.
+func expandSlice(slice string) (string, error) {
+	name, ok := strings.CutSuffix(slice, ".slice")
+	if !ok || strings.Contains(name, "/") {
+		return "", fmt.Errorf("%q is not a slice unit name", slice)
+	}
+	if name == "-" {
+		return "/", nil
+	}
+	dir, prefix := "/", ""
+	for _, part := range strings.Split(name, "-") {
+		if part == "" {
+			return "", fmt.Errorf("%q is not a slice unit name", slice)
+		}
+		prefix += part
+		dir = path.Join(dir, prefix+".slice")
+		prefix += "-"
+	}
+	return dir, nil
+}
+
+// StartScope asks systemd for the transient scope s holding pid, with the limits of r
+// that systemd has properties for, and waits until pid is in its cgroup. systemd then
+// owns those limits: it writes them again on every daemon-reload. The scope is delegated,
+// so runproc can write the other limits to the cgroup itself (Adopt).
+func StartScope(s *Scope, pid int, r *oci.LinuxResources) error {
+	unified, err := unifiedNode()
+	if err != nil {
+		return err
+	}
+	props := [][]string{
+		{"Description", "s", "runproc container " + strings.TrimSuffix(s.Unit, ".scope")},
+		{"Slice", "s", s.Slice},
+		{"Delegate", "b", "true"},
+		{"DefaultDependencies", "b", "false"},
+		// Scopes of killed containers end up failed; they go away all the same
+		{"CollectMode", "s", "inactive-or-failed"},
+		{"PIDs", "au", "1", strconv.Itoa(pid)},
+		{"CPUAccounting", "b", "true"},
+		{"MemoryAccounting", "b", "true"},
+		{"TasksAccounting", "b", "true"},
+	}
+	if unified {
+		props = append(props, []string{"IOAccounting", "b", "true"})
+	} else {
+		props = append(props, []string{"BlockIOAccounting", "b", "true"})
+	}
+	props = append(props, scopeProperties(r, unified)...)
+	args := []string{"StartTransientUnit", "ssa(sv)a(sa(sv))", s.Unit, "replace", strconv.Itoa(len(props))}
+	for _, p := range props {
+		args = append(args, p...)
+	}
+	if _, err := systemdCall(append(args, "0")...); err != nil {
+		return fmt.Errorf("start scope %s: %w", s.Unit, err)
+	}
+	deadline := time.Now().Add(scopeStartTimeout)
+	for {
+		paths, err := procCgroups(pid)
+		if err != nil {
+			return fmt.Errorf("start scope %s: %w", s.Unit, err)
+		}
+		for _, p := range paths {
+			if p == s.Path {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("start scope %s: pid %d is not in %s after %s", s.Unit, pid, s.Path, scopeStartTimeout)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// scopeProperties converts r to the systemd properties runc's systemd driver sets: CPU
+// weight and quota, memory, swap and pids limits, and the block I/O weight.
+func scopeProperties(r *oci.LinuxResources, unified bool) [][]string {
+	if r == nil {
+		return nil
+	}
+	var props [][]string
+	set := func(name string, v uint64) {
+		props = append(props, []string{name, "t", strconv.FormatUint(v, 10)})
+	}
+	// "infinity" is the largest value
+	limit := func(v int64) uint64 {
+		if v <= 0 {
+			return math.MaxUint64
+		}
+		return uint64(v)
+	}
+	if cpu := r.CPU; cpu != nil {
+		if cpu.Shares != nil && *cpu.Shares != 0 {
+			if unified {
+				set("CPUWeight", cpuWeight(*cpu.Shares))
+			} else {
+				set("CPUShares", *cpu.Shares)
+			}
+		}
+		period := uint64(100000)
+		if cpu.Period != nil && *cpu.Period != 0 {
+			period = *cpu.Period
+			set("CPUQuotaPeriodUSec", period)
+		}
+		if cpu.Quota != nil {
+			// systemd keeps the quota per second, and only to the 10ms
+			perSec := uint64(math.MaxUint64)
+			if *cpu.Quota > 0 {
+				perSec = (uint64(*cpu.Quota)*1000000/period + 9999) / 10000 * 10000
+			}
+			set("CPUQuotaPerSecUSec", perSec)
+		}
+	}
+	if m := r.Memory; m != nil {
+		if m.Limit != nil && *m.Limit != 0 {
+			if unified {
+				set("MemoryMax", limit(*m.Limit))
+			} else {
+				set("MemoryLimit", limit(*m.Limit))
+			}
+		}
+		if unified && m.Reservation != nil && *m.Reservation != 0 {
+			set("MemoryLow", limit(*m.Reservation))
+		}
+		if unified && m.Swap != nil && *m.Swap != 0 && checkSwap(m) == nil {
+			swap := uint64(math.MaxUint64)
+			if *m.Swap > 0 {
+				swap = uint64(*m.Swap - *m.Limit)
+			}
+			set("MemorySwapMax", swap)
+		}
+	}
+	if p := r.Pids; p != nil {
+		set("TasksMax", limit(p.Limit))
+	}
+	if b := r.BlockIO; b != nil && b.Weight != nil && *b.Weight != 0 {
+		if unified {
+			set("IOWeight", ioWeight(*b.Weight))
+		} else {
+			set("BlockIOWeight", uint64(*b.Weight))
+		}
+	}
+	return props
+}
+
+// StopScope stops the scope unit, which kills what is left in it; systemd then removes
+// its cgroup. A scope that is gone already (systemd collects it once empty) is fine.
+func StopScope(unit string) error {
+	_, err := systemdCall("StopUnit", "ss", unit, "replace")
+	if err != nil && strings.Contains(err.Error(), "not loaded") {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("stop scope %s: %w", unit, err)
+	}
+	return nil
+}
+
+// systemdCall calls a method of systemd's manager on the system bus with busctl's
+// argument syntax and returns its reply.
+func systemdCall(method ...string) (string, error) {
+	args := append([]string{"call", "--system", "org.freedesktop.systemd1", "/org/freedesktop/systemd1", "org.freedesktop.systemd1.Manager"}, method...)
+	out, err := exec.Command("busctl", args...).CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return "", errors.New(msg)
+		}
+		return "", err
+	}
+	return string(out), nil
+}
+
+// unifiedNode reports whether container cgroups are made in the unified hierarchy, the
+// way managed lays them out.
+func unifiedNode() (bool, error) {
+	mounts, err := cgroupMounts()
+	if err != nil {
+		return false, err
+	}
+	_, ok := mounts[""]
+	return ok && !legacy(mounts), nil
+}
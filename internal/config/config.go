@@ -0,0 +1,294 @@
+// Package config loads the optional node-level runproc configuration file.
+//
+// The file uses a small TOML subset: [section] headers, comments starting with '#',
+// and key = value pairs whose values are double-quoted strings, integers, booleans,
+// or single-line arrays of those. Unknown keys are rejected so typos do not go unnoticed.
+package config
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// DefaultPath is read when RUNPROC_CONFIG is not set. A missing file is not an error.
+const DefaultPath = "/etc/runproc/config.toml"
+
+// Config is the node configuration; see Default for the built-in values.
+type Config struct {
+	Log     Log
+	Logs    Logs
+	Scratch Scratch
+	CPUs    CPUs
+	Host    Host
+	Hooks   Hooks
+}
+
+// Log configures runproc's own error reporting.
+type Log struct {
+	// MirrorStderr duplicates errors written to the --log file on stderr.
+	MirrorStderr bool
+}
+
+// Logs configures what happens to captured container logs.
+type Logs struct {
+	// ArchiveDir, when set, receives console.log/audit.log on delete, laid out as
+	// <ArchiveDir>/<namespace>/<pod>/<YYYY-MM-DD>/<container id>/.
+	ArchiveDir string
+	// MaxSize rotates each log file of a container before it grows past this many bytes,
+	// unless its runproc.logs.max_size annotation says otherwise; 0 never rotates.
+	MaxSize int64
+	// MaxFiles is how many rotated files are kept per log file, unless the container's
+	// runproc.logs.max_files annotation says otherwise.
+	MaxFiles int64
+}
+
+// Scratch configures per-container scratch space (the runproc.scratch annotation).
+type Scratch struct {
+	// Dir holds the image files of disk-backed scratch space, one <container id>.img each.
+	Dir string
+}
+
+// CPUs configures the exclusive CPU pool handed out by the runproc.cpus annotation.
+type CPUs struct {
+	// Pool is a kernel-style CPU list ("2-5,8") reserved for pinned containers. Empty
+	// disables pinning.
+	Pool string
+	// ReservationsDir records which pool CPUs each container holds. It is node-wide, so
+	// containers of every state dir share one pool.
+	ReservationsDir string
+}
+
+// Host configures host-mode containers.
+type Host struct {
+	// StrictExec makes host-mode containers execute argv[0] from their image rootfs,
+	// staged into a private copy, instead of resolving it on the node.
+	StrictExec bool
+}
+
+// Hooks configures the ceilings every OCI lifecycle hook runs under, whatever its spec
+// asks for, so one hung hook cannot wedge create or delete.
+type Hooks struct {
+	// Timeout is the most seconds a hook may run before it and everything it started are
+	// killed; a hook with a shorter timeout of its own keeps it. 0 is no ceiling.
+	Timeout int64
+	// MemoryMax is the memory limit in bytes of the cgroup each hook runs in; 0 is none.
+	MemoryMax int64
+	// CPUMillicores caps the CPU time of each hook's cgroup, in thousandths of a CPU
+	// (500 is half a CPU); 0 is no cap.
+	CPUMillicores int64
+}
+
+// Default returns the configuration used when no config file exists.
+func Default() *Config {
+	return &Config{
+		Log:     Log{MirrorStderr: true},
+		Logs:    Logs{MaxFiles: 1},
+		Scratch: Scratch{Dir: "/var/lib/runproc/scratch"},
+		CPUs:    CPUs{ReservationsDir: "/run/runproc-cpus"},
+		Hooks:   Hooks{Timeout: 120},
+	}
+}
+
+// Path returns the config file location, honoring RUNPROC_CONFIG.
+func Path() string {
+	if p := os.Getenv("RUNPROC_CONFIG"); p != "" {
+		return p
+	}
+	return DefaultPath
+}
+
+// Load reads the config file at Path. A missing file yields the default config.
+func Load() (*Config, error) {
+	p := Path()
+	f, err := os.Open(p)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return Default(), nil
+		}
+		return nil, fmt.Errorf("open config: %w", err)
+	}
+	defer f.Close()
+	c, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("config %s: %w", p, err)
+	}
+	return c, nil
+}
+
+// Parse decodes a config file on top of the defaults.
+func Parse(r io.Reader) (*Config, error) {
+	c := Default()
+	section := ""
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(stripComment(sc.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: malformed section header", n)
+			}
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		k, raw, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", n)
+		}
+		key := strings.TrimSpace(k)
+		if section != "" {
+			key = section + "." + key
+		}
+		v, err := parseValue(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %w", n, key, err)
+		}
+		if err := c.set(key, v); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// set assigns a parsed value to the field named by its dotted key.
+func (c *Config) set(key string, v any) error {
+	switch key {
+	case "log.mirror_stderr":
+		return assign(key, v, &c.Log.MirrorStderr)
+	case "logs.archive_dir":
+		return assign(key, v, &c.Logs.ArchiveDir)
+	case "logs.max_size":
+		return assignNonNegative(key, v, &c.Logs.MaxSize)
+	case "logs.max_files":
+		return assignNonNegative(key, v, &c.Logs.MaxFiles)
+	case "scratch.dir":
+		return assign(key, v, &c.Scratch.Dir)
+	case "cpus.pool":
+		return assign(key, v, &c.CPUs.Pool)
+	case "cpus.reservations_dir":
+		return assign(key, v, &c.CPUs.ReservationsDir)
+	case "host.strict_exec":
+		return assign(key, v, &c.Host.StrictExec)
+	case "hooks.timeout":
+		return assignNonNegative(key, v, &c.Hooks.Timeout)
+	case "hooks.memory_max":
+		return assignNonNegative(key, v, &c.Hooks.MemoryMax)
+	case "hooks.cpu_millicores":
+		return assignNonNegative(key, v, &c.Hooks.CPUMillicores)
+	default:
+		return fmt.Errorf("unknown key %q", key)
+	}
+}
+
+func assign[T any](key string, v any, dst *T) error {
+	t, ok := v.(T)
+	if !ok {
+		return fmt.Errorf("%s: unexpected value type %T", key, v)
+	}
+	*dst = t
+	return nil
+}
+
+// assignNonNegative is assign for an integer that cannot be below 0.
+func assignNonNegative(key string, v any, dst *int64) error {
+	if n, ok := v.(int64); ok && n < 0 {
+		return fmt.Errorf("%s: %d is negative", key, n)
+	}
+	return assign(key, v, dst)
+}
+
+// stripComment drops a trailing '#' comment that is not inside a quoted string.
+func stripComment(line string) string {
+	inStr := false
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			if inStr {
+				i++
+			}
+		case '"':
+			inStr = !inStr
+		case '#':
+			if !inStr {
+				return line[:i]
+			}
+		}
+	}
+	return line
+}
+
+func parseValue(s string) (any, error) {
+	switch {
+	case s == "":
+		return nil, errors.New("missing value")
+	case strings.HasPrefix(s, "\""):
+		return strconv.Unquote(s)
+	case s == "true" || s == "false":
+		return s == "true", nil
+	case strings.HasPrefix(s, "["):
+		if !strings.HasSuffix(s, "]") {
+			return nil, errors.New("unterminated array")
+		}
+		return parseArray(strings.TrimSpace(s[1 : len(s)-1]))
+	default:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported value %q", s)
+		}
+		return n, nil
+	}
+}
+
+// parseArray parses the inside of a single-line array. Elements must share one type;
+// string and integer arrays are returned as []string and []int64.
+func parseArray(s string) (any, error) {
+	var strs []string
+	var ints []int64
+	for s != "" {
+		var elem string
+		if strings.HasPrefix(s, "\"") {
+			end := 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(s) {
+				return nil, errors.New("unterminated string in array")
+			}
+			elem, s = s[:end+1], s[end+1:]
+		} else {
+			elem, s, _ = strings.Cut(s, ",")
+		}
+		v, err := parseValue(strings.TrimSpace(elem))
+		if err != nil {
+			return nil, err
+		}
+		switch t := v.(type) {
+		case string:
+			strs = append(strs, t)
+		case int64:
+			ints = append(ints, t)
+		default:
+			return nil, fmt.Errorf("unsupported array element %q", elem)
+		}
+		s = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(s), ","))
+	}
+	if len(strs) > 0 && len(ints) > 0 {
+		return nil, errors.New("mixed array element types")
+	}
+	if len(ints) > 0 {
+		return ints, nil
+	}
+	return strs, nil
+}
@@ -0,0 +1,18 @@
+// Package lsm holds what the Linux security module packages (apparmor, selinux) share.
+package lsm
+
+import "os"
+
+// WriteAttr writes an LSM attribute (a file under /proc/thread-self/attr) in a single
+// write, as the kernel requires.
+func WriteAttr(path, value string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(value)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,99 @@
+package oci
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// FragmentsDir is the directory next to config.json whose *.json files are merged into
+// the spec, so node tooling can add mounts, env or annotations to a bundle without
+// rewriting the file containerd generated.
+const FragmentsDir = "config.d"
+
+// mergeFragments deep-merges the bundle's config.d/*.json fragments, in file name order,
+// into the config.json document base. It returns base unchanged when there are none.
+func mergeFragments(bundle string, base []byte) (doc []byte, err error) {
+	dir := filepath.Join(bundle, FragmentsDir)
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return base, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", FragmentsDir, err)
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.Type().IsRegular() || strings.HasPrefix(e.Name(), ".") || filepath.Ext(e.Name()) != ".json" {
+			continue
+		}
+		names = append(names, e.Name())
+	}
+	if len(names) == 0 {
+		return base, nil
+	}
+	sort.Strings(names)
+	var v any
+	if v, err = decodeDocument(base); err != nil {
+		return nil, fmt.Errorf("decode spec: %w", err)
+	}
+	for _, name := range names {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		frag, err := decodeDocument(b)
+		if err != nil {
+			return nil, fmt.Errorf("decode %s/%s: %w", FragmentsDir, name, err)
+		}
+		if _, ok := frag.(map[string]any); !ok {
+			return nil, fmt.Errorf("%s/%s: a fragment must be a JSON object", FragmentsDir, name)
+		}
+		v = mergeJSON(v, frag)
+	}
+	if doc, err = json.Marshal(v); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// decodeDocument decodes JSON keeping numbers exact (uid/gid and limits are 64-bit).
+func decodeDocument(b []byte) (any, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var v any
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// mergeJSON merges src into dst: objects key by key, recursively; arrays by appending
+// src's elements; anything else is replaced by src. A null in src removes the key.
+func mergeJSON(dst, src any) any {
+	switch s := src.(type) {
+	case map[string]any:
+		d, ok := dst.(map[string]any)
+		if !ok {
+			d = map[string]any{}
+		}
+		for k, v := range s {
+			if v == nil {
+				delete(d, k)
+				continue
+			}
+			d[k] = mergeJSON(d[k], v)
+		}
+		return d
+	case []any:
+		if d, ok := dst.([]any); ok {
+			return append(d, s...)
+		}
+	}
+	return src
+}
@@ -0,0 +1,105 @@
+package oci
+
+import (
+	"sort"
+	"syscall"
+)
+
+// The parts of config.json runproc implements, by their spec names, with the kernel
+// values it implements them with. cmd/runproc applies these tables, and runproc.Features
+// reports their names, so neither can claim what the other lacks.
+
+// NamespaceCloneFlags are the namespaces runproc creates, by their spec type.
+var NamespaceCloneFlags = map[LinuxNamespaceType]uintptr{
+	PIDNamespace:     syscall.CLONE_NEWPID,
+	MountNamespace:   syscall.CLONE_NEWNS,
+	UTSNamespace:     syscall.CLONE_NEWUTS,
+	IPCNamespace:     syscall.CLONE_NEWIPC,
+	NetworkNamespace: syscall.CLONE_NEWNET,
+	CgroupNamespace:  syscall.CLONE_NEWCGROUP,
+	UserNamespace:    syscall.CLONE_NEWUSER,
+}
+
+// CapabilityBits are the capabilities runproc knows, by their spec name (linux/capability.h).
+var CapabilityBits = map[string]uint{
+	"CAP_CHOWN": 0, "CAP_DAC_OVERRIDE": 1, "CAP_DAC_READ_SEARCH": 2, "CAP_FOWNER": 3,
+	"CAP_FSETID": 4, "CAP_KILL": 5, "CAP_SETGID": 6, "CAP_SETUID": 7,
+	"CAP_SETPCAP": 8, "CAP_LINUX_IMMUTABLE": 9, "CAP_NET_BIND_SERVICE": 10, "CAP_NET_BROADCAST": 11,
+	"CAP_NET_ADMIN": 12, "CAP_NET_RAW": 13, "CAP_IPC_LOCK": 14, "CAP_IPC_OWNER": 15,
+	"CAP_SYS_MODULE": 16, "CAP_SYS_RAWIO": 17, "CAP_SYS_CHROOT": 18, "CAP_SYS_PTRACE": 19,
+	"CAP_SYS_PACCT": 20, "CAP_SYS_ADMIN": 21, "CAP_SYS_BOOT": 22, "CAP_SYS_NICE": 23,
+	"CAP_SYS_RESOURCE": 24, "CAP_SYS_TIME": 25, "CAP_SYS_TTY_CONFIG": 26, "CAP_MKNOD": 27,
+	"CAP_LEASE": 28, "CAP_AUDIT_WRITE": 29, "CAP_AUDIT_CONTROL": 30, "CAP_SETFCAP": 31,
+	"CAP_MAC_OVERRIDE": 32, "CAP_MAC_ADMIN": 33, "CAP_SYSLOG": 34, "CAP_WAKE_ALARM": 35,
+	"CAP_BLOCK_SUSPEND": 36, "CAP_AUDIT_READ": 37, "CAP_PERFMON": 38, "CAP_BPF": 39,
+	"CAP_CHECKPOINT_RESTORE": 40,
+}
+
+// MountFlag is what a mount(8) option does to a mount's MS_* flags: set Flag, or with
+// Clear remove it.
+type MountFlag struct {
+	Clear bool
+	Flag  uintptr
+}
+
+// MountFlagOptions map mount(8) options to MS_* flags.
+var MountFlagOptions = map[string]MountFlag{
+	"ro":          {false, syscall.MS_RDONLY},
+	"rw":          {true, syscall.MS_RDONLY},
+	"nosuid":      {false, syscall.MS_NOSUID},
+	"suid":        {true, syscall.MS_NOSUID},
+	"nodev":       {false, syscall.MS_NODEV},
+	"dev":         {true, syscall.MS_NODEV},
+	"noexec":      {false, syscall.MS_NOEXEC},
+	"exec":        {true, syscall.MS_NOEXEC},
+	"noatime":     {false, syscall.MS_NOATIME},
+	"nodiratime":  {false, syscall.MS_NODIRATIME},
+	"relatime":    {false, syscall.MS_RELATIME},
+	"strictatime": {false, syscall.MS_STRICTATIME},
+	"sync":        {false, syscall.MS_SYNCHRONOUS},
+	"bind":        {false, syscall.MS_BIND},
+	"rbind":       {false, syscall.MS_BIND | syscall.MS_REC},
+}
+
+// PropagationOptions map the propagation options (and linux.rootfsPropagation values) to
+// the flags of the separate mount(2) call that changes a mount's propagation type.
+var PropagationOptions = map[string]uintptr{
+	"private": syscall.MS_PRIVATE, "rprivate": syscall.MS_PRIVATE | syscall.MS_REC,
+	"shared": syscall.MS_SHARED, "rshared": syscall.MS_SHARED | syscall.MS_REC,
+	"slave": syscall.MS_SLAVE, "rslave": syscall.MS_SLAVE | syscall.MS_REC,
+	"unbindable": syscall.MS_UNBINDABLE, "runbindable": syscall.MS_UNBINDABLE | syscall.MS_REC,
+}
+
+// The mount options that idmap a bind mount, with the mount's own uidMappings and
+// gidMappings; ridmap does its submounts too.
+const (
+	IDMapOption  = "idmap"
+	RIDMapOption = "ridmap"
+)
+
+// The hook stages runproc runs, by their config.json name.
+const (
+	HookPrestart        = "prestart"
+	HookCreateRuntime   = "createRuntime"
+	HookCreateContainer = "createContainer"
+	HookStartContainer  = "startContainer"
+	HookPoststart       = "poststart"
+	HookPoststop        = "poststop"
+)
+
+// HookStages lists the hook stages runproc runs, in the order of the lifecycle.
+var HookStages = []string{HookPrestart, HookCreateRuntime, HookCreateContainer, HookStartContainer, HookPoststart, HookPoststop}
+
+// MountOptions lists the mount options runproc applies, sorted: flags, propagation and
+// idmapping.
+func MountOptions() []string {
+	out := []string{IDMapOption, RIDMapOption}
+	for o := range MountFlagOptions {
+		out = append(out, o)
+	}
+	for o := range PropagationOptions {
+		out = append(out, o)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -1,41 +1,233 @@
 package oci
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
-type Spec struct {
-	OCIVersion  string            `json:"ociVersion"`
-	Process     *Process          `json:"process"`
-	Root        *Root             `json:"root"`
-	Annotations map[string]string `json:"annotations,omitempty"`
-}
+// Version is the OCI runtime spec version runproc targets.
+const Version = "1.1.0"
 
-type Process struct {
-	Terminal bool     `json:"terminal"`
-	Args     []string `json:"args"`
-	Env      []string `json:"env"`
-	Cwd      string   `json:"cwd"`
-}
+// HostAnnotation toggles host mode (no chroot) when set to a truthy value.
+const HostAnnotation = "runproc.host"
+
+// Annotations containerd's CRI plugin sets on pod containers, used to group and
+// key per-container artifacts by pod.
+const (
+	SandboxIDAnnotation        = "io.kubernetes.cri.sandbox-id"
+	SandboxNameAnnotation      = "io.kubernetes.cri.sandbox-name"
+	SandboxNamespaceAnnotation = "io.kubernetes.cri.sandbox-namespace"
+	SandboxUIDAnnotation       = "io.kubernetes.cri.sandbox-uid"
+)
+
+// Scratch annotations request size-limited ephemeral space for the container:
+// runproc.scratch is the size (e.g. "512Mi"), runproc.scratch.path where it is mounted
+// (default /scratch), and runproc.scratch.backing "tmpfs" (default, memory) or "disk"
+// (a loopback ext4 image).
+const (
+	ScratchAnnotation        = "runproc.scratch"
+	ScratchPathAnnotation    = "runproc.scratch.path"
+	ScratchBackingAnnotation = "runproc.scratch.backing"
+)
+
+// CPUsAnnotation asks for that many exclusive CPUs from the node's pool (cpus.pool in
+// the node config); the container is pinned to them from start until delete.
+const CPUsAnnotation = "runproc.cpus"
+
+// Log annotations control how run captures output: runproc.logs.split "true" writes
+// stdout.log and stderr.log instead of console.log, runproc.logs.discard ("stdout" or
+// "stderr") drops one stream, and runproc.logs.max_size / runproc.logs.max_files rotate
+// each file by size, keeping that many old files.
+const (
+	LogsSplitAnnotation    = "runproc.logs.split"
+	LogsDiscardAnnotation  = "runproc.logs.discard"
+	LogsMaxSizeAnnotation  = "runproc.logs.max_size"
+	LogsMaxFilesAnnotation = "runproc.logs.max_files"
+)
+
+// StdinOnceAnnotation "true" closes a detached container's stdin once the first attach
+// session ends its input, like CRI's stdinOnce; by default stdin stays open across
+// attach sessions.
+const StdinOnceAnnotation = "runproc.stdin_once"
+
+// WasmAnnotation "true" runs argv[0] as a WASM module under a WASI runtime instead of as
+// a Linux executable ("false" opts a *.wasm argv[0] out).
+const WasmAnnotation = "runproc.wasm"
+
+// ExposeBinaryAnnotation "true" binds the runproc binary read-only into the container at
+// /usr/local/bin/runproc, for in-container tooling.
+const ExposeBinaryAnnotation = "runproc.expose_binary"
+
+// RootfsIdmapAnnotation "true" idmaps the rootfs with the mappings of the container's new
+// user namespace, so an image owned by the ids it was built with (root being 0) appears
+// owned by the container's.
+const RootfsIdmapAnnotation = "runproc.rootfs_idmap"
+
+// Start gate annotations hold the workload after start until a node-level prerequisite
+// is met: runproc.start_gate is an absolute node path that must exist or, for a unix
+// socket, accept a connection, and runproc.start_gate_timeout how long to wait for it
+// (a duration, e.g. "90s"; default one minute).
+const (
+	StartGateAnnotation        = "runproc.start_gate"
+	StartGateTimeoutAnnotation = "runproc.start_gate_timeout"
+)
+
+// Snapshot annotations archive container paths when the container exits, for batch jobs
+// to hand back small results without a volume: runproc.snapshot is a comma-separated list
+// of absolute container paths and runproc.snapshot.when selects the exits that take one
+// ("always", the default, "success" or "failure").
+const (
+	SnapshotAnnotation     = "runproc.snapshot"
+	SnapshotWhenAnnotation = "runproc.snapshot.when"
+)
+
+// CPUThrottleAnnotation "true" has the supervisor of `run` approximate
+// linux.resources.cpu.quota by stopping and continuing the container's processes, on
+// nodes where runproc cannot set the quota in a cgroup.
+const CPUThrottleAnnotation = "runproc.cpu_throttle"
+
+// Descendant limit annotations have the supervisor of `run` cap the processes a container
+// may have besides its init, on nodes where the pids controller is not available:
+// runproc.max_descendants is the limit and runproc.max_descendants.signal what the
+// container's processes get once it is exceeded (default SIGKILL).
+const (
+	MaxDescendantsAnnotation       = "runproc.max_descendants"
+	MaxDescendantsSignalAnnotation = "runproc.max_descendants.signal"
+)
+
+// Localization annotations give a container the node's time zone (runproc.tz, e.g.
+// "Europe/Berlin") or locale (runproc.locale, e.g. "de_DE.UTF-8") when its image lacks the
+// files, and set TZ or LANG unless the process env does.
+const (
+	TZAnnotation     = "runproc.tz"
+	LocaleAnnotation = "runproc.locale"
+)
 
-type Root struct {
-	Path     string `json:"path"`
-	Readonly bool   `json:"readonly"`
+// Annotations lists the config.json annotations runproc interprets.
+var Annotations = []string{
+	HostAnnotation, ScratchAnnotation, ScratchPathAnnotation, ScratchBackingAnnotation, CPUsAnnotation,
+	LogsSplitAnnotation, LogsDiscardAnnotation, LogsMaxSizeAnnotation, LogsMaxFilesAnnotation,
+	StdinOnceAnnotation, WasmAnnotation, ExposeBinaryAnnotation, RootfsIdmapAnnotation, StartGateAnnotation, StartGateTimeoutAnnotation,
+	SnapshotAnnotation, SnapshotWhenAnnotation, CPUThrottleAnnotation, MaxDescendantsAnnotation,
+	MaxDescendantsSignalAnnotation, TZAnnotation, LocaleAnnotation,
 }
 
+// LoadSpec reads the bundle's config.json, with any config.d fragments merged in,
+// validates the result and normalizes process.env (see dedupeEnv).
 func LoadSpec(bundle string) (*Spec, error) {
 	p := filepath.Join(bundle, "config.json")
-	f, err := os.Open(p)
+	b, err := os.ReadFile(p)
 	if err != nil {
 		return nil, fmt.Errorf("open spec: %w", err)
 	}
-	defer f.Close()
+	b, err = mergeFragments(bundle, b)
+	if err != nil {
+		return nil, err
+	}
 	var s Spec
-	if err := json.NewDecoder(f).Decode(&s); err != nil {
+	if err := json.NewDecoder(bytes.NewReader(b)).Decode(&s); err != nil {
 		return nil, fmt.Errorf("decode spec: %w", err)
 	}
+	if err := Validate(&s); err != nil {
+		return nil, err
+	}
+	s.Process.Env = dedupeEnv(s.Process.Env)
+	expandAnnotations(&s)
 	return &s, nil
 }
+
+// LoadProcess reads a process.json, the process alone as exec is given it, and validates
+// and normalizes it as LoadSpec does config.json's.
+func LoadProcess(path string) (*Process, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("open process: %w", err)
+	}
+	var p Process
+	if err := json.NewDecoder(bytes.NewReader(b)).Decode(&p); err != nil {
+		return nil, fmt.Errorf("decode process: %w", err)
+	}
+	if errs := validateProcess(&p); len(errs) > 0 {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidSpec, errors.Join(errs...))
+	}
+	p.Env = dedupeEnv(p.Env)
+	return &p, nil
+}
+
+// expandAnnotations interpolates ${VAR} and $VAR references in runproc.* annotation
+// values so one manifest can carry node- or pod-specific paths. Variables resolve from
+// the container process env (e.g. downward API values) first, then the runtime's env.
+// Unknown variables are left as written so mistakes stay visible.
+func expandAnnotations(s *Spec) {
+	var procEnv []string
+	if s.Process != nil {
+		procEnv = s.Process.Env
+	}
+	lookup := func(name string) (string, bool) {
+		for i := len(procEnv) - 1; i >= 0; i-- {
+			if k, v, ok := strings.Cut(procEnv[i], "="); ok && k == name {
+				return v, true
+			}
+		}
+		return os.LookupEnv(name)
+	}
+	for k, v := range s.Annotations {
+		if !strings.HasPrefix(k, "runproc.") || !strings.Contains(v, "$") {
+			continue
+		}
+		s.Annotations[k] = os.Expand(v, func(name string) string {
+			if val, ok := lookup(name); ok {
+				return val
+			}
+			return "${" + name + "}"
+		})
+	}
+}
+
+// Example returns a minimal spec suitable for `runproc spec`. When host is true the
+// spec runs on the node filesystem via the host-mode annotation instead of a rootfs.
+func Example(host bool) *Spec {
+	s := &Spec{
+		Version: Version,
+		Process: &Process{
+			Terminal: false,
+			Args:     []string{"sh"},
+			Env: []string{
+				"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+				"TERM=xterm",
+			},
+			Cwd: "/",
+		},
+		Root: &Root{Path: "rootfs", Readonly: true},
+	}
+	if host {
+		s.Root = &Root{Path: "/", Readonly: false}
+		s.Annotations = map[string]string{HostAnnotation: "1"}
+	}
+	return s
+}
+
+// dedupeEnv keeps one entry per variable: the last value, at the first entry's position.
+// Fragments append to process.env, and the last setting must be the one that applies;
+// without this the workload would see whichever one its libc's getenv finds first.
+func dedupeEnv(env []string) []string {
+	last := map[string]string{}
+	for _, e := range env {
+		k, _, _ := strings.Cut(e, "=")
+		last[k] = e
+	}
+	out := env[:0:0]
+	for _, e := range env {
+		k, _, _ := strings.Cut(e, "=")
+		if v, ok := last[k]; ok {
+			out = append(out, v)
+			delete(last, k)
+		}
+	}
+	return out
+}
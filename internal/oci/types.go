@@ -0,0 +1,111 @@
+package oci
+
+import specs "github.com/opencontainers/runtime-spec/specs-go"
+
+// The spec types are those of the runtime-spec module, under the names runproc has always
+// used, so callers need not import specs-go themselves. Methods cannot be declared on
+// them here: validation and normalization are functions in spec.go and validate.go.
+type (
+	Spec            = specs.Spec
+	Process         = specs.Process
+	Root            = specs.Root
+	Mount           = specs.Mount
+	Hooks           = specs.Hooks
+	Hook            = specs.Hook
+	User            = specs.User
+	Box             = specs.Box
+	POSIXRlimit     = specs.POSIXRlimit
+	Scheduler       = specs.Scheduler
+	IOPriorityClass = specs.IOPriorityClass
+	CPUAffinity     = specs.CPUAffinity
+
+	Linux                  = specs.Linux
+	LinuxNamespace         = specs.LinuxNamespace
+	LinuxNamespaceType     = specs.LinuxNamespaceType
+	LinuxIDMapping         = specs.LinuxIDMapping
+	LinuxCapabilities      = specs.LinuxCapabilities
+	LinuxDevice            = specs.LinuxDevice
+	LinuxTimeOffset        = specs.LinuxTimeOffset
+	LinuxPersonality       = specs.LinuxPersonality
+	LinuxPersonalityDomain = specs.LinuxPersonalityDomain
+	LinuxPersonalityFlag   = specs.LinuxPersonalityFlag
+	LinuxIntelRdt          = specs.LinuxIntelRdt
+	LinuxIOPriority        = specs.LinuxIOPriority
+	LinuxSchedulerPolicy   = specs.LinuxSchedulerPolicy
+	LinuxSchedulerFlag     = specs.LinuxSchedulerFlag
+
+	LinuxResources         = specs.LinuxResources
+	LinuxDeviceCgroup      = specs.LinuxDeviceCgroup
+	LinuxMemory            = specs.LinuxMemory
+	LinuxCPU               = specs.LinuxCPU
+	LinuxPids              = specs.LinuxPids
+	LinuxBlockIO           = specs.LinuxBlockIO
+	LinuxBlockIODevice     = specs.LinuxBlockIODevice
+	LinuxWeightDevice      = specs.LinuxWeightDevice
+	LinuxThrottleDevice    = specs.LinuxThrottleDevice
+	LinuxHugepageLimit     = specs.LinuxHugepageLimit
+	LinuxNetwork           = specs.LinuxNetwork
+	LinuxInterfacePriority = specs.LinuxInterfacePriority
+	LinuxRdma              = specs.LinuxRdma
+
+	LinuxSeccomp         = specs.LinuxSeccomp
+	LinuxSeccompAction   = specs.LinuxSeccompAction
+	LinuxSeccompArg      = specs.LinuxSeccompArg
+	LinuxSeccompFlag     = specs.LinuxSeccompFlag
+	LinuxSeccompOperator = specs.LinuxSeccompOperator
+	LinuxSyscall         = specs.LinuxSyscall
+	Arch                 = specs.Arch
+)
+
+// Values of the enumerated spec fields runproc interprets.
+const (
+	PIDNamespace     = specs.PIDNamespace
+	NetworkNamespace = specs.NetworkNamespace
+	MountNamespace   = specs.MountNamespace
+	IPCNamespace     = specs.IPCNamespace
+	UTSNamespace     = specs.UTSNamespace
+	UserNamespace    = specs.UserNamespace
+	CgroupNamespace  = specs.CgroupNamespace
+	TimeNamespace    = specs.TimeNamespace
+
+	IOPRIO_CLASS_RT   = specs.IOPRIO_CLASS_RT
+	IOPRIO_CLASS_BE   = specs.IOPRIO_CLASS_BE
+	IOPRIO_CLASS_IDLE = specs.IOPRIO_CLASS_IDLE
+
+	PerLinux   = specs.PerLinux
+	PerLinux32 = specs.PerLinux32
+
+	SchedOther    = specs.SchedOther
+	SchedFIFO     = specs.SchedFIFO
+	SchedRR       = specs.SchedRR
+	SchedBatch    = specs.SchedBatch
+	SchedISO      = specs.SchedISO
+	SchedIdle     = specs.SchedIdle
+	SchedDeadline = specs.SchedDeadline
+
+	SchedFlagResetOnFork  = specs.SchedFlagResetOnFork
+	SchedFlagReclaim      = specs.SchedFlagReclaim
+	SchedFlagDLOverrun    = specs.SchedFlagDLOverrun
+	SchedFlagKeepPolicy   = specs.SchedFlagKeepPolicy
+	SchedFlagKeepParams   = specs.SchedFlagKeepParams
+	SchedFlagUtilClampMin = specs.SchedFlagUtilClampMin
+	SchedFlagUtilClampMax = specs.SchedFlagUtilClampMax
+
+	ActKill        = specs.ActKill
+	ActKillProcess = specs.ActKillProcess
+	ActKillThread  = specs.ActKillThread
+	ActTrap        = specs.ActTrap
+	ActErrno       = specs.ActErrno
+	ActTrace       = specs.ActTrace
+	ActAllow       = specs.ActAllow
+	ActLog         = specs.ActLog
+	ActNotify      = specs.ActNotify
+
+	OpNotEqual     = specs.OpNotEqual
+	OpLessThan     = specs.OpLessThan
+	OpLessEqual    = specs.OpLessEqual
+	OpEqualTo      = specs.OpEqualTo
+	OpGreaterEqual = specs.OpGreaterEqual
+	OpGreaterThan  = specs.OpGreaterThan
+	OpMaskedEqual  = specs.OpMaskedEqual
+)
@@ -0,0 +1,171 @@
+package oci
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// semver matches the MAJOR.MINOR.PATCH[-pre][+build] versions ociVersion must use.
+var semver = regexp.MustCompile(`^\d+\.\d+\.\d+(-[0-9A-Za-z.-]+)?(\+[0-9A-Za-z.-]+)?$`)
+
+// rlimitTypes are the POSIX/Linux resource limits a spec may set.
+var rlimitTypes = map[string]bool{
+	"RLIMIT_AS": true, "RLIMIT_CORE": true, "RLIMIT_CPU": true, "RLIMIT_DATA": true,
+	"RLIMIT_FSIZE": true, "RLIMIT_LOCKS": true, "RLIMIT_MEMLOCK": true, "RLIMIT_MSGQUEUE": true,
+	"RLIMIT_NICE": true, "RLIMIT_NOFILE": true, "RLIMIT_NPROC": true, "RLIMIT_RSS": true,
+	"RLIMIT_RTPRIO": true, "RLIMIT_RTTIME": true, "RLIMIT_SIGPENDING": true, "RLIMIT_STACK": true,
+}
+
+// namespaceTypes are the linux.namespaces types the spec defines.
+var namespaceTypes = map[LinuxNamespaceType]bool{
+	PIDNamespace: true, NetworkNamespace: true, MountNamespace: true, IPCNamespace: true,
+	UTSNamespace: true, UserNamespace: true, CgroupNamespace: true, TimeNamespace: true,
+}
+
+// propagationModes are the values linux.rootfsPropagation may take.
+var propagationModes = map[string]bool{
+	"private": true, "rprivate": true, "shared": true, "rshared": true,
+	"slave": true, "rslave": true, "unbindable": true, "runbindable": true,
+}
+
+// ErrInvalidSpec wraps every violation Validate reports.
+var ErrInvalidSpec = errors.New("invalid spec")
+
+// Validate checks the requirements the runtime spec places on a config runproc is asked
+// to run (the MUST-level rules for the fields it decodes), so a malformed bundle fails at
+// create with the offending field named instead of being half-applied.
+func Validate(s *Spec) error {
+	var errs []error
+	add := func(format string, a ...any) { errs = append(errs, fmt.Errorf(format, a...)) }
+
+	if s.Version == "" {
+		add("ociVersion is required")
+	} else if !semver.MatchString(s.Version) {
+		add("ociVersion %q is not a semantic version", s.Version)
+	} else if !strings.HasPrefix(s.Version, "1.") {
+		add("ociVersion %q is not supported (runproc implements %s)", s.Version, Version)
+	}
+	if s.Root != nil && s.Root.Path == "" {
+		add("root.path is required when root is set")
+	}
+	// The kernel's UTS names hold at most 64 bytes
+	if len(s.Hostname) > 64 {
+		add("hostname %q is longer than 64 bytes", s.Hostname)
+	}
+	if len(s.Domainname) > 64 {
+		add("domainname %q is longer than 64 bytes", s.Domainname)
+	}
+	if s.Process == nil {
+		add("process is required")
+	} else {
+		errs = append(errs, validateProcess(s.Process)...)
+	}
+	for i, m := range s.Mounts {
+		if m.Destination == "" {
+			add("mounts[%d].destination is required", i)
+		}
+	}
+	for k := range s.Annotations {
+		if k == "" {
+			add("annotations: keys must not be empty")
+		}
+	}
+	if s.Hooks != nil {
+		for _, stage := range []struct {
+			name  string
+			hooks []Hook
+		}{
+			{"prestart", s.Hooks.Prestart}, {"createRuntime", s.Hooks.CreateRuntime}, {"createContainer", s.Hooks.CreateContainer},
+			{"startContainer", s.Hooks.StartContainer}, {"poststart", s.Hooks.Poststart}, {"poststop", s.Hooks.Poststop},
+		} {
+			name := stage.name
+			for i, h := range stage.hooks {
+				if !filepath.IsAbs(h.Path) {
+					add("hooks.%s[%d].path %q must be an absolute path", name, i, h.Path)
+				}
+				if h.Timeout != nil && *h.Timeout <= 0 {
+					add("hooks.%s[%d].timeout must be greater than zero", name, i)
+				}
+			}
+		}
+	}
+	if l := s.Linux; l != nil {
+		seen := map[LinuxNamespaceType]bool{}
+		for _, ns := range l.Namespaces {
+			if !namespaceTypes[ns.Type] {
+				add("linux.namespaces: unknown type %q", ns.Type)
+			} else if seen[ns.Type] {
+				add("linux.namespaces: %s is listed more than once", ns.Type)
+			}
+			seen[ns.Type] = true
+		}
+		if l.RootfsPropagation != "" && !propagationModes[l.RootfsPropagation] {
+			add("linux.rootfsPropagation %q is not a propagation mode", l.RootfsPropagation)
+		}
+		for i, d := range l.Devices {
+			if !filepath.IsAbs(d.Path) {
+				add("linux.devices[%d].path %q must be an absolute path", i, d.Path)
+			}
+			switch d.Type {
+			case "c", "b", "u", "p":
+			default:
+				add("linux.devices[%d].type %q must be one of c, b, u, p", i, d.Type)
+			}
+		}
+		if l.Resources != nil {
+			for i, d := range l.Resources.Devices {
+				switch d.Type {
+				case "", "a", "b", "c":
+				default:
+					add("linux.resources.devices[%d].type %q must be one of a, b, c", i, d.Type)
+				}
+				if strings.Trim(d.Access, "rwm") != "" {
+					add("linux.resources.devices[%d].access %q must be made of r, w, m", i, d.Access)
+				}
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%w: %w", ErrInvalidSpec, errors.Join(errs...))
+	}
+	return nil
+}
+
+// validateProcess returns the violations of p.
+func validateProcess(p *Process) []error {
+	var errs []error
+	add := func(format string, a ...any) { errs = append(errs, fmt.Errorf(format, a...)) }
+
+	if len(p.Args) == 0 {
+		add("process.args must have at least one entry")
+	}
+	if !filepath.IsAbs(p.Cwd) {
+		add("process.cwd %q must be an absolute path", p.Cwd)
+	}
+	for i, e := range p.Env {
+		if name, _, ok := strings.Cut(e, "="); !ok {
+			add("process.env[%d] %q is not in NAME=value form", i, e)
+		} else if name == "" {
+			add("process.env[%d] %q has an empty name", i, e)
+		}
+		if strings.IndexByte(e, 0) >= 0 {
+			add("process.env[%d] %q contains a NUL byte", i, e)
+		}
+	}
+	seen := map[string]bool{}
+	for _, rl := range p.Rlimits {
+		if !rlimitTypes[rl.Type] {
+			add("process.rlimits: unknown type %q", rl.Type)
+		} else if seen[rl.Type] {
+			add("process.rlimits: %s is set more than once", rl.Type)
+		}
+		seen[rl.Type] = true
+		if rl.Soft > rl.Hard {
+			add("process.rlimits: %s soft limit exceeds hard limit", rl.Type)
+		}
+	}
+	return errs
+}
@@ -0,0 +1,185 @@
+// Package resctrl places container processes in Intel RDT (CAT/MBA) resource groups of
+// the kernel's resctrl filesystem, as linux.intelRdt asks. runproc never mounts resctrl
+// or changes the default group.
+package resctrl
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Root is where resctrl is mounted, as the runtime-spec expects it.
+const Root = "/sys/fs/resctrl"
+
+// reserved are the entries of Root that are not resource groups.
+var reserved = map[string]bool{"info": true, "mon_groups": true, "mon_data": true, "tasks": true, "cpus": true, "cpus_list": true, "mode": true, "schemata": true, "size": true}
+
+// Enabled reports whether resctrl is mounted: only then does the default group have its
+// schemata.
+func Enabled() bool {
+	_, err := os.Stat(filepath.Join(Root, "schemata"))
+	return err == nil
+}
+
+// CheckClosID rejects a CLOS id that is not a group name of its own under Root.
+func CheckClosID(closID string) error {
+	if closID == "" || closID == "." || closID == ".." || strings.ContainsAny(closID, "/\x00") || reserved[closID] {
+		return fmt.Errorf("%q is not a resctrl group name", closID)
+	}
+	return nil
+}
+
+// Monitoring reports whether the node's resctrl monitors feature (llc_occupancy for CMT,
+// mbm_total_bytes for MBM), which every group then reports in its mon_data.
+func Monitoring(feature string) bool {
+	b, err := os.ReadFile(filepath.Join(Root, "info", "L3_MON", "mon_features"))
+	if err != nil {
+		return false
+	}
+	for _, f := range strings.Fields(string(b)) {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply makes the resource group closID with the schemata lines (such as "L3:0=ff;1=ff"
+// or "MB:0=50") and reports whether it made it, as the runtime-spec has it: a group that
+// exists already is shared, and must have what schemata ask for; without schemata the
+// group must exist.
+func Apply(closID string, schemata []string) (bool, error) {
+	if err := CheckClosID(closID); err != nil {
+		return false, err
+	}
+	dir := filepath.Join(Root, closID)
+	if len(schemata) == 0 {
+		if _, err := os.Stat(filepath.Join(dir, "schemata")); err != nil {
+			return false, fmt.Errorf("no resctrl group %s: %w", closID, err)
+		}
+		return false, nil
+	}
+	err := os.Mkdir(dir, 0o755)
+	if errors.Is(err, os.ErrExist) {
+		return false, matches(dir, schemata)
+	}
+	if err != nil {
+		return false, fmt.Errorf("create resctrl group %s: %w", closID, err)
+	}
+	for _, line := range schemata {
+		if err := writeSchema(dir, line); err != nil {
+			_ = syscall.Rmdir(dir)
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// writeSchema writes one schemata line of the group in dir. The kernel says what it
+// rejected in info/last_cmd_status, not in the write's error.
+func writeSchema(dir, line string) error {
+	err := os.WriteFile(filepath.Join(dir, "schemata"), []byte(line+"\n"), 0)
+	if err == nil {
+		return nil
+	}
+	if b, serr := os.ReadFile(filepath.Join(Root, "info", "last_cmd_status")); serr == nil && strings.TrimSpace(string(b)) != "ok" {
+		err = fmt.Errorf("%w: %s", err, strings.TrimSpace(string(b)))
+	}
+	return fmt.Errorf("set resctrl schema %q of %s: %w", line, filepath.Base(dir), err)
+}
+
+// matches checks that the group in dir has every domain of schemata as they ask.
+func matches(dir string, schemata []string) error {
+	b, err := os.ReadFile(filepath.Join(dir, "schemata"))
+	if err != nil {
+		return fmt.Errorf("read resctrl group %s: %w", filepath.Base(dir), err)
+	}
+	have := map[string]map[string]uint64{}
+	for _, line := range strings.Split(string(b), "\n") {
+		if res, domains, err := parseSchema(line); err == nil {
+			have[res] = domains
+		}
+	}
+	for _, line := range schemata {
+		res, domains, err := parseSchema(line)
+		if err != nil {
+			return err
+		}
+		for id, v := range domains {
+			if got, ok := have[res][id]; !ok || got != v {
+				return fmt.Errorf("resctrl group %s exists with a different %s schema than %q", filepath.Base(dir), res, line)
+			}
+		}
+	}
+	return nil
+}
+
+// parseSchema splits a schemata line into its resource and the value of each domain id:
+// bandwidth percentages (or MBps) for MB, capacity bitmasks in hex for the caches.
+func parseSchema(line string) (string, map[string]uint64, error) {
+	res, list, ok := strings.Cut(strings.TrimSpace(line), ":")
+	if !ok || res == "" || list == "" {
+		return "", nil, fmt.Errorf("resctrl schema %q is not <resource>:<id>=<value>;...", line)
+	}
+	base := 16
+	if res == "MB" {
+		base = 10
+	}
+	domains := map[string]uint64{}
+	for _, d := range strings.Split(list, ";") {
+		id, value, ok := strings.Cut(strings.TrimSpace(d), "=")
+		v, err := strconv.ParseUint(value, base, 64)
+		if !ok || id == "" || err != nil {
+			return "", nil, fmt.Errorf("resctrl schema %q: %q is not <id>=<value>", line, d)
+		}
+		domains[id] = v
+	}
+	return res, domains, nil
+}
+
+// Remove removes the resource group closID; the kernel moves what is left in it to the
+// default group. A group already gone is fine.
+func Remove(closID string) error {
+	if err := CheckClosID(closID); err != nil {
+		return err
+	}
+	if err := syscall.Rmdir(filepath.Join(Root, closID)); err != nil && !errors.Is(err, syscall.ENOENT) {
+		return fmt.Errorf("remove resctrl group %s: %w", closID, err)
+	}
+	return nil
+}
+
+// Tasks is the tasks file of a resource group, opened while Root is in reach so a thread
+// can join the group after entering a container's mount namespace.
+type Tasks struct {
+	f *os.File
+}
+
+// OpenTasks opens the tasks file of the resource group closID.
+func OpenTasks(closID string) (*Tasks, error) {
+	if err := CheckClosID(closID); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(Root, closID, "tasks"), os.O_WRONLY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open resctrl group %s: %w", closID, err)
+	}
+	return &Tasks{f: f}, nil
+}
+
+// JoinThread moves the calling thread alone into the group; what it forks or execs from
+// then on is in the group too. The caller locks the thread.
+func (t *Tasks) JoinThread() error {
+	if _, err := t.f.WriteString(strconv.Itoa(syscall.Gettid())); err != nil {
+		return fmt.Errorf("join resctrl group: %w", err)
+	}
+	return nil
+}
+
+// Close closes the tasks file.
+func (t *Tasks) Close() error { return t.f.Close() }
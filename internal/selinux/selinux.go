@@ -0,0 +1,26 @@
+// Package selinux runs container processes under SELinux labels given by the caller.
+// runproc never loads policy or picks labels itself.
+package selinux
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/ktsakalozos/runproc/internal/lsm"
+)
+
+// Enabled reports whether SELinux is active on the node: selinuxfs is mounted where
+// the userspace tools expect it.
+func Enabled() bool {
+	_, err := os.Stat("/sys/fs/selinux/enforce")
+	return err == nil
+}
+
+// SetExecLabel makes the calling thread's next exec run with label. The attribute is per
+// thread: the caller must lock the OS thread and exec from it.
+func SetExecLabel(label string) error {
+	if err := lsm.WriteAttr("/proc/thread-self/attr/exec", label); err != nil {
+		return fmt.Errorf("set selinux label %q: %w", label, err)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// FormatVersion is the state format this runproc reads and writes. It goes up only when
+// what state.json means changes in a way an older runproc would get wrong; fields an
+// older runproc can ignore are added without it, and kept by one that saves the state
+// (see ContainerState.unknown).
+const FormatVersion = 1
+
+// formatChange is what bringing a state up to format to takes. Load applies it on the
+// fly, unless it has a migrate reason: then it changes more than the state can be trusted
+// to change unattended, and only `runproc migrate-state` (Migrate) applies it.
+type formatChange struct {
+	to      int
+	migrate string
+	upgrade func(st *ContainerState) error
+}
+
+// formatChanges are in order of format.
+var formatChanges = []formatChange{
+	// 1 records the format and the runproc that created the container; older states
+	// mean the same otherwise
+	{to: 1, upgrade: func(*ContainerState) error { return nil }},
+}
+
+// FormatError is why this runproc must not operate on a container: its state is in a
+// newer format than it knows, or in an older one that needs `runproc migrate-state`.
+type FormatError struct {
+	ID string
+	// CreatedBy is the version of the runproc that created the container, "" before
+	// versions were recorded
+	CreatedBy string
+	Format    int
+	// Migrate is what migrate-state changes, for an older format
+	Migrate string
+}
+
+func (e *FormatError) Error() string {
+	by := e.CreatedBy
+	if by == "" {
+		by = "an unrecorded version"
+	}
+	if e.Migrate != "" {
+		return fmt.Sprintf("container %s was created by runproc %s (state format %d) and requires migrate-state: %s", e.ID, by, e.Format, e.Migrate)
+	}
+	return fmt.Sprintf("container %s was created by runproc %s and its state is in format %d; this runproc knows formats up to %d, so operate on it with a newer runproc", e.ID, by, e.Format, FormatVersion)
+}
+
+// upgrade brings st to FormatVersion, with the changes migrate-state applies too if
+// migrate is set.
+func upgrade(st *ContainerState, migrate bool) error {
+	if st.Format > FormatVersion {
+		return &FormatError{ID: st.ID, CreatedBy: st.CreatedBy, Format: st.Format}
+	}
+	for _, c := range formatChanges {
+		if c.to <= st.Format {
+			continue
+		}
+		if c.migrate != "" && !migrate {
+			return &FormatError{ID: st.ID, CreatedBy: st.CreatedBy, Format: st.Format, Migrate: c.migrate}
+		}
+		if err := c.upgrade(st); err != nil {
+			return fmt.Errorf("upgrade the state of %s to format %d: %w", st.ID, c.to, err)
+		}
+		st.Format = c.to
+	}
+	return nil
+}
+
+// Migrate rewrites the state of id in FormatVersion, applying the changes Load leaves to
+// it too. It returns the format the state was in.
+func Migrate(stateRoot, id string) (int, error) {
+	st, err := load(stateRoot, id, false)
+	if err != nil {
+		return 0, err
+	}
+	from := st.Format
+	if err := upgrade(st, true); err != nil {
+		return from, err
+	}
+	if from == st.Format {
+		return from, nil
+	}
+	return from, Save(stateRoot, st)
+}
+
+// knownFields are the state.json keys of ContainerState.
+var knownFields = func() map[string]bool {
+	known := map[string]bool{}
+	t := reflect.TypeOf(ContainerState{})
+	for i := 0; i < t.NumField(); i++ {
+		if name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ","); name != "" && name != "-" {
+			known[name] = true
+		}
+	}
+	return known
+}()
+
+// decode parses a state.json, keeping the fields this runproc does not know in unknown.
+func decode(b []byte) (*ContainerState, error) {
+	var st ContainerState
+	if err := json.Unmarshal(b, &st); err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	for k, v := range fields {
+		if !knownFields[k] {
+			if st.unknown == nil {
+				st.unknown = map[string]json.RawMessage{}
+			}
+			st.unknown[k] = v
+		}
+	}
+	return &st, nil
+}
@@ -0,0 +1,200 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrOpInProgress is returned when another runproc process holds the operation lock
+// for a container ID past the wait deadline.
+var ErrOpInProgress = errors.New("operation already in progress")
+
+// LockInfo is the content of an in-flight operation lock file.
+type LockInfo struct {
+	Pid   int       `json:"pid"`
+	Op    string    `json:"op"`
+	Since time.Time `json:"since"`
+	// StartTime is when the owner started, in clock ticks after boot (/proc/<pid>/stat),
+	// so a process that later got the same pid is not taken for it
+	StartTime uint64 `json:"startTime,omitempty"`
+}
+
+// Lock is a held in-flight operation lock for a single container ID.
+type Lock struct {
+	path string
+	// Recovered is the lock of a dead owner this one took over, or nil
+	Recovered *LockInfo
+}
+
+// reclaimLockFile serializes the removal of stale locks in the .locks dir; an id cannot
+// start with '.'.
+const reclaimLockFile = ".reclaim"
+
+// lockWriteGrace is how long a lock file may stay unreadable: its owner creates it and
+// then writes it, and one that died in between leaves it empty for good.
+const lockWriteGrace = 10 * time.Second
+
+func lockPathFor(stateRoot, id string) string {
+	return filepath.Join(stateRoot, ".locks", id)
+}
+
+// AcquireLock records that op is in flight for id. If another process already holds the
+// lock it polls until the lock is released or wait elapses, then fails with ErrOpInProgress.
+// A lock whose owner died without releasing it (a crashed or killed runproc) is taken
+// over at once; the returned Lock's Recovered then says whose it was.
+func AcquireLock(stateRoot, id, op string, wait time.Duration) (*Lock, error) {
+	if err := ValidateID(id); err != nil {
+		return nil, err
+	}
+	p := lockPathFor(stateRoot, id)
+	if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+		return nil, err
+	}
+	info := LockInfo{Pid: os.Getpid(), Op: op, Since: time.Now()}
+	if _, start, err := procState(info.Pid); err == nil {
+		info.StartTime = start
+	}
+	b, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(wait)
+	var recovered *LockInfo
+	for {
+		f, err := os.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY|syscall.O_NOFOLLOW, 0o600)
+		if err == nil {
+			_, werr := f.Write(b)
+			cerr := f.Close()
+			if werr != nil || cerr != nil {
+				_ = os.Remove(p)
+				return nil, errors.Join(werr, cerr)
+			}
+			return &Lock{path: p, Recovered: recovered}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		stale, err := reclaimStale(p)
+		if err != nil {
+			return nil, err
+		}
+		if stale != nil {
+			recovered = stale
+			continue
+		}
+		if time.Now().After(deadline) {
+			owner, _ := ReadLock(stateRoot, id)
+			if owner != nil {
+				return nil, fmt.Errorf("%w: %s (pid %d) on container %s", ErrOpInProgress, owner.Op, owner.Pid, id)
+			}
+			return nil, fmt.Errorf("%w on container %s", ErrOpInProgress, id)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// ReadLock returns the current holder of the lock for id, or an error if it is not held.
+func ReadLock(stateRoot, id string) (*LockInfo, error) {
+	b, err := os.ReadFile(lockPathFor(stateRoot, id))
+	if err != nil {
+		return nil, err
+	}
+	var info LockInfo
+	if err := json.Unmarshal(b, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// Alive reports whether the owner of the lock may still be running: its pid exists, is
+// not a zombie and, where the lock records it, started when the owner did. An owner in
+// another pid namespace, whose pid this /proc does not show, counts as alive.
+func (i *LockInfo) Alive() bool {
+	if i.Pid <= 0 {
+		return false
+	}
+	if err := syscall.Kill(i.Pid, 0); errors.Is(err, syscall.ESRCH) {
+		return false
+	}
+	state, start, err := procState(i.Pid)
+	if err != nil {
+		return !errors.Is(err, os.ErrNotExist)
+	}
+	return state != "Z" && (i.StartTime == 0 || start == i.StartTime)
+}
+
+// reclaimStale removes the lock at p if its owner is dead and returns what it held; it
+// returns nil when the lock is gone or alive. Reclaimers serialize on a flock and judge
+// the lock under it, so none removes a lock that another has just taken over.
+func reclaimStale(p string) (*LockInfo, error) {
+	g, err := os.OpenFile(filepath.Join(filepath.Dir(p), reclaimLockFile), os.O_CREATE|os.O_RDWR|syscall.O_NOFOLLOW, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	defer g.Close()
+	if err := syscall.Flock(int(g.Fd()), syscall.LOCK_EX); err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var info LockInfo
+	if err := json.Unmarshal(b, &info); err != nil {
+		fi, serr := os.Stat(p)
+		if serr != nil || time.Since(fi.ModTime()) < lockWriteGrace {
+			return nil, nil
+		}
+		info = LockInfo{Since: fi.ModTime()}
+	} else if info.Alive() {
+		return nil, nil
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// procState returns the state and start time of pid from /proc/<pid>/stat. The comm
+// field may contain spaces and parentheses, so fields are split after its closing ')'.
+func procState(pid int) (string, uint64, error) {
+	b, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return "", 0, err
+	}
+	s := string(b)
+	fields := strings.Fields(s[strings.LastIndexByte(s, ')')+1:])
+	// starttime is field 22, the 20th after comm
+	if len(fields) < 20 {
+		return "", 0, fmt.Errorf("malformed stat for pid %d", pid)
+	}
+	start, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return "", 0, err
+	}
+	return fields[0], start, nil
+}
+
+// Release drops the lock. It is safe to call on a nil Lock, and again after a release,
+// which must not remove the lock another process took since.
+func (l *Lock) Release() error {
+	if l == nil || l.path == "" {
+		return nil
+	}
+	p := l.path
+	l.path = ""
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
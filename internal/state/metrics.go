@@ -0,0 +1,65 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Runtime-wide counters live next to the containers, in files an id cannot collide with.
+const (
+	countersFile     = ".metrics.json"
+	countersLockFile = ".metrics.lock"
+)
+
+// Counters maps a series, in Prometheus notation (`start_errors_total{code="busy"}`), to
+// its value. Values only grow, across every runproc invocation on the state root.
+type Counters map[string]uint64
+
+// AddCounters increments each series by one. Concurrent invocations serialize on a file
+// lock; the file is replaced atomically so readers never see a partial write.
+func AddCounters(stateRoot string, series ...string) error {
+	if err := os.MkdirAll(stateRoot, 0o700); err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(filepath.Join(stateRoot, countersLockFile), os.O_CREATE|os.O_RDWR|syscall.O_NOFOLLOW, 0o600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	c, err := LoadCounters(stateRoot)
+	if err != nil {
+		// Start over rather than stop counting
+		c = Counters{}
+	}
+	for _, s := range series {
+		c[s]++
+	}
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ReplaceFile(filepath.Join(stateRoot, countersFile), append(b, '\n'), 0o600)
+}
+
+// LoadCounters reads the state root's counters; none have been recorded yet if the file
+// does not exist.
+func LoadCounters(stateRoot string) (Counters, error) {
+	b, err := os.ReadFile(filepath.Join(stateRoot, countersFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return Counters{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := Counters{}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,161 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// ErrUnsafe is returned for a state root or container state that another user could have
+// planted or can still change. runproc (often root) would otherwise write through their
+// symlinks or act on their records.
+var ErrUnsafe = errors.New("unsafe state")
+
+// CheckRoot refuses a state root that is not a directory owned by the caller or that
+// group or others can write to: anyone who can add entries to it can plant symlinks in
+// place of the files runproc writes. The root itself may be a symlink the operator chose.
+func CheckRoot(stateRoot string) error {
+	fi, err := os.Stat(stateRoot)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%w: state root %s is not a directory", ErrUnsafe, stateRoot)
+	}
+	return checkOwner(stateRoot, fi)
+}
+
+// checkOwner refuses path unless the caller owns it and only the owner can write it.
+func checkOwner(path string, fi os.FileInfo) error {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	if euid := os.Geteuid(); int(st.Uid) != euid {
+		return fmt.Errorf("%w: %s is owned by uid %d, not %d", ErrUnsafe, path, st.Uid, euid)
+	}
+	return checkWritable(path, fi)
+}
+
+// checkWritable refuses path if group or others can write it.
+func checkWritable(path string, fi os.FileInfo) error {
+	if fi.Mode().Perm()&0o022 != 0 {
+		return fmt.Errorf("%w: %s is writable by group or others (mode %#o)", ErrUnsafe, path, fi.Mode().Perm())
+	}
+	return nil
+}
+
+// checkCaller is checkOwner, or only checkWritable for a shared read (see LoadShared).
+func checkCaller(path string, fi os.FileInfo, shared bool) error {
+	if shared {
+		return checkWritable(path, fi)
+	}
+	return checkOwner(path, fi)
+}
+
+// checkDir refuses a container dir that is a symlink or not the caller's own.
+func checkDir(dir string, shared bool) error {
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%w: %s is not a directory", ErrUnsafe, dir)
+	}
+	return checkCaller(dir, fi, shared)
+}
+
+// readOwned reads a file of the state root without following a symlink, refusing one the
+// caller does not own or others can write.
+func readOwned(path string, shared bool) ([]byte, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		if errors.Is(err, syscall.ELOOP) {
+			return nil, fmt.Errorf("%w: %s is a symlink", ErrUnsafe, path)
+		}
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("%w: %s is not a regular file", ErrUnsafe, path)
+	}
+	if err := checkCaller(path, fi, shared); err != nil {
+		return nil, err
+	}
+	b := make([]byte, fi.Size())
+	n, err := f.ReadAt(b, 0)
+	if n == len(b) {
+		err = nil
+	}
+	return b[:n], err
+}
+
+// WriteFile writes a new file. Whatever is at path is removed first, never followed, and
+// the file is created exclusively, so neither a planted symlink nor a hard link can
+// redirect the write.
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY|syscall.O_NOFOLLOW, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(path)
+	}
+	return err
+}
+
+// ReplaceFile atomically replaces path with data: it writes a temporary file next to it
+// with WriteFile and renames it over path, which replaces a symlink instead of following it.
+func ReplaceFile(path string, data []byte, perm os.FileMode) error {
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err := WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// Share lets the root of a container in a user namespace, host gid gid, read the state of
+// id: its init runs as that root. The state root becomes searchable by all (no listing),
+// and the container dir gets the group, readable and setgid so the files written in it
+// later get the group too; state.json and the killed marker are group-readable already.
+// Nothing is made writable: init never writes the state.
+func Share(stateRoot, id string, gid int) error {
+	fi, err := os.Stat(stateRoot)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(stateRoot, fi.Mode().Perm()|0o011); err != nil {
+		return err
+	}
+	d := dirFor(stateRoot, id)
+	entries, err := os.ReadDir(d)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := os.Lchown(filepath.Join(d, e.Name()), -1, gid); err != nil {
+			return err
+		}
+	}
+	if err := os.Lchown(d, -1, gid); err != nil {
+		return err
+	}
+	return os.Chmod(d, 0o750|os.ModeSetgid)
+}
@@ -6,15 +6,54 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
+	"syscall"
 	"time"
+
+	"github.com/ktsakalozos/runproc/internal/oci"
+)
+
+// Errors about a container's existence and status. The messages keep runc's wording,
+// which containerd's shim matches on ("does not exist", "container not running"); they are
+// wrapped with the container id, so test for them with errors.Is.
+var (
+	ErrNotExist   = errors.New("container does not exist")
+	ErrExist      = errors.New("container with given ID already exists")
+	ErrNotRunning = errors.New("container not running")
+	ErrInvalidID  = errors.New("invalid container id")
 )
 
+// validID is runc's id alphabet. The first character is further restricted: a leading '.'
+// would collide with the state dir's own entries (.locks, .sandboxes), and a leading '-'
+// or '+' reads as a flag.
+var validID = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_+.-]*$`)
+
+// ValidateID rejects ids that could escape the state dir or need quoting in a shell:
+// path separators, whitespace and shell metacharacters, a leading '.', and names longer
+// than a path component can be.
+func ValidateID(id string) error {
+	if len(id) > 255 || !validID.MatchString(id) {
+		return fmt.Errorf("%w %q: use letters, digits, '_', '+', '-' and '.', starting with a letter, digit or '_'", ErrInvalidID, id)
+	}
+	return nil
+}
+
+// NotExist returns ErrNotExist for id.
+func NotExist(id string) error { return fmt.Errorf("%w: %s", ErrNotExist, id) }
+
+// NotRunning returns ErrNotRunning for id.
+func NotRunning(id string) error { return fmt.Errorf("%w: %s", ErrNotRunning, id) }
+
 type Status string
 
 const (
-	Created Status = "created"
-	Running Status = "running"
-	Stopped Status = "stopped"
+	// Creating is recorded before the init is forked and replaced by Created once the init
+	// has its config and the go-ahead. A container that stays creating was abandoned by a
+	// create that died midway.
+	Creating Status = "creating"
+	Created  Status = "created"
+	Running  Status = "running"
+	Stopped  Status = "stopped"
 )
 
 type ContainerState struct {
@@ -28,6 +67,34 @@ type ContainerState struct {
 	ExitCode    *int              `json:"exitCode,omitempty"`
 	Annotations map[string]string `json:"annotations,omitempty"`
 	PidFile     string            `json:"pidFile,omitempty"`
+	MonitorPid  int               `json:"monitorPid,omitempty"`
+	// ScratchImage is the image file backing disk-backed scratch space, removed on delete.
+	ScratchImage string `json:"scratchImage,omitempty"`
+	// Cpus is the CPU list the container is pinned to, set at start.
+	Cpus string `json:"cpus,omitempty"`
+	// Cgroup is the cgroup create made for the container, removed on delete.
+	Cgroup string `json:"cgroup,omitempty"`
+	// CgroupUnit is the systemd scope holding Cgroup with the systemd cgroup driver,
+	// stopped on delete.
+	CgroupUnit string `json:"cgroupUnit,omitempty"`
+	// IntelRdtGroup is the resctrl group create made for the container, removed on delete.
+	IntelRdtGroup string `json:"intelRdtGroup,omitempty"`
+	// Hooks are the poststart and poststop hooks of the config the container was created
+	// with, for start and delete to run whatever the bundle holds by then. They are nil
+	// for containers created before runproc recorded them.
+	Hooks *oci.Hooks `json:"hooks,omitempty"`
+	// OOMKilled is set once the OOM killer killed a process of Cgroup, at OOMKilledAt (when
+	// runproc noticed).
+	OOMKilled   bool       `json:"oomKilled,omitempty"`
+	OOMKilledAt *time.Time `json:"oomKilledAt,omitempty"`
+	// Format is the state format (FormatVersion) the state is in; 0 before formats were
+	// recorded.
+	Format int `json:"format,omitempty"`
+	// CreatedBy is the version of the runproc that created the container.
+	CreatedBy string `json:"createdBy,omitempty"`
+	// unknown are the fields of a state written by a newer runproc that this one does not
+	// know; saving writes them back as they were rather than dropping them.
+	unknown map[string]json.RawMessage
 }
 
 func dirFor(stateRoot, id string) string {
@@ -39,63 +106,139 @@ func pathFor(stateRoot, id string) string {
 }
 
 func Exists(stateRoot, id string) bool {
+	if ValidateID(id) != nil {
+		return false
+	}
 	_, err := os.Stat(pathFor(stateRoot, id))
 	return err == nil
 }
 
+// Create records a new container, in the Creating status; the caller saves it as Created
+// once the container is complete.
 func Create(stateRoot string, st *ContainerState) error {
-	d := dirFor(stateRoot, st.ID)
-	if err := os.MkdirAll(d, 0o700); err != nil {
+	if err := ValidateID(st.ID); err != nil {
 		return err
 	}
-	p := pathFor(stateRoot, st.ID)
-	if _, err := os.Stat(p); err == nil {
-		return fmt.Errorf("container %s already exists", st.ID)
+	d := dirFor(stateRoot, st.ID)
+	if err := os.Mkdir(d, 0o700); err != nil {
+		if !errors.Is(err, os.ErrExist) {
+			return err
+		}
+		// Left over (e.g. by a create that died before state.json): reuse it only if it
+		// is our own directory
+		if err := checkDir(d, false); err != nil {
+			return err
+		}
 	}
 	st.CreatedAt = time.Now()
-	st.Status = Created
-	f, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	st.Status = Creating
+	st.Format = FormatVersion
+	b, err := encode(st)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(pathFor(stateRoot, st.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY|syscall.O_NOFOLLOW, 0o640)
+	if err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("%w: %s", ErrExist, st.ID)
+		}
+		return err
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	enc := json.NewEncoder(f)
-	enc.SetIndent("", "  ")
-	return enc.Encode(st)
+	return writeStatusFile(stateRoot, st)
 }
 
+// Load reads the state of id, failing with ErrNotExist if there is none (or id is not a
+// valid id, so no container can have it). A state in an older format is brought up to
+// date on the fly; one this runproc must not operate on fails with a *FormatError.
 func Load(stateRoot, id string) (*ContainerState, error) {
-	b, err := os.ReadFile(pathFor(stateRoot, id))
+	return loadUpgraded(stateRoot, id, false)
+}
+
+// LoadShared is Load for the init of a container in a user namespace, which runs as the
+// container's root and so owns nothing in the state dir: it is only refused what group or
+// others can write. Only root can add entries to the dir Share opened to it.
+func LoadShared(stateRoot, id string) (*ContainerState, error) {
+	return loadUpgraded(stateRoot, id, true)
+}
+
+func loadUpgraded(stateRoot, id string, shared bool) (*ContainerState, error) {
+	st, err := load(stateRoot, id, shared)
 	if err != nil {
 		return nil, err
 	}
-	var st ContainerState
-	if err := json.Unmarshal(b, &st); err != nil {
+	if err := upgrade(st, false); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// load reads the state of id as it is.
+func load(stateRoot, id string, shared bool) (*ContainerState, error) {
+	if ValidateID(id) != nil {
+		return nil, NotExist(id)
+	}
+	if err := checkDir(dirFor(stateRoot, id), shared); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, NotExist(id)
+		}
+		return nil, err
+	}
+	b, err := readOwned(pathFor(stateRoot, id), shared)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, NotExist(id)
+		}
 		return nil, err
 	}
-	return &st, nil
+	return decode(b)
 }
 
 func Save(stateRoot string, st *ContainerState) error {
-	p := pathFor(stateRoot, st.ID)
-	tmp := p + ".tmp"
-	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	b, err := encode(st)
 	if err != nil {
 		return err
 	}
-	enc := json.NewEncoder(f)
-	enc.SetIndent("", "  ")
-	if err := enc.Encode(st); err != nil {
-		f.Close()
+	if err := ReplaceFile(pathFor(stateRoot, st.ID), b, 0o640); err != nil {
 		return err
 	}
-	if err := f.Close(); err != nil {
-		return err
+	return writeStatusFile(stateRoot, st)
+}
+
+// encode is the state.json form of st, with the fields it kept from a newer runproc.
+func encode(st *ContainerState) ([]byte, error) {
+	var v any = st
+	if len(st.unknown) > 0 {
+		b, err := json.Marshal(st)
+		if err != nil {
+			return nil, err
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(b, &fields); err != nil {
+			return nil, err
+		}
+		for k, raw := range st.unknown {
+			fields[k] = raw
+		}
+		v = fields
 	}
-	return os.Rename(tmp, p)
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
 }
 
 func Delete(stateRoot, id string) error {
+	if err := ValidateID(id); err != nil {
+		return err
+	}
 	d := dirFor(stateRoot, id)
 	if err := os.RemoveAll(d); err != nil {
 		return err
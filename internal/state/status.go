@@ -0,0 +1,48 @@
+package state
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+)
+
+// StatusFileName is the compact, stable status file written next to state.json.
+//
+// It holds one "key=value" line per key, currently these in this order, and is replaced
+// atomically on every state change so pollers never observe a partial write:
+//
+//	status=<creating|created|running|stopped>
+//	pid=<init pid, 0 if unknown>
+//	exitcode=<exit code, empty until known>
+//	health=<ok|failed|unknown>
+//	oomkilled=<true|false>
+//
+// Keys are appended as runproc learns more (oomkilled was), so consumers must look keys
+// up by name and ignore those they do not know rather than count lines; existing keys
+// keep their meaning, though a key may gain values (status gained creating).
+const StatusFileName = "status"
+
+// Health summarizes the container for lightweight pollers: "ok" while creating, created
+// or running and after a zero exit, "failed" after a non-zero exit, and "unknown" once
+// stopped without a recorded exit code.
+func (st *ContainerState) Health() string {
+	if st.Status != Stopped {
+		return "ok"
+	}
+	if st.ExitCode == nil {
+		return "unknown"
+	}
+	if *st.ExitCode != 0 {
+		return "failed"
+	}
+	return "ok"
+}
+
+func writeStatusFile(stateRoot string, st *ContainerState) error {
+	exitCode := ""
+	if st.ExitCode != nil {
+		exitCode = strconv.Itoa(*st.ExitCode)
+	}
+	content := fmt.Sprintf("status=%s\npid=%d\nexitcode=%s\nhealth=%s\noomkilled=%t\n", st.Status, st.Pid, exitCode, st.Health(), st.OOMKilled)
+	return ReplaceFile(filepath.Join(dirFor(stateRoot, st.ID), StatusFileName), []byte(content), 0o644)
+}
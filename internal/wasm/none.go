@@ -0,0 +1,11 @@
+//go:build !(cgo && wasmtime)
+
+package wasm
+
+// Embedded reports whether this build links the runtime.
+const Embedded = false
+
+// Run fails: see ErrNotEmbedded.
+func Run(Module) (int, error) {
+	return 0, ErrNotEmbedded
+}
@@ -0,0 +1,28 @@
+// Package wasm runs WebAssembly modules under WASI for runproc's experimental wasm
+// backend, with wasmtime embedded through wasmtime-go. The runtime is only linked into
+// builds with cgo and the wasmtime build tag; in every other build Embedded is false and
+// Run fails with ErrNotEmbedded.
+package wasm
+
+import "errors"
+
+// Runtime names the embedded WASI runtime.
+const Runtime = "wasmtime-go"
+
+// ErrNotEmbedded is what Run returns in builds without the runtime.
+var ErrNotEmbedded = errors.New("this runproc was built without wasmtime (build with cgo and -tags wasmtime)")
+
+// Dir is a host directory the module sees as a WASI preopened directory at Guest.
+type Dir struct {
+	Host  string `json:"host"`
+	Guest string `json:"guest"`
+}
+
+// Module is a module to run and the WASI world it gets: nothing but its args, env and
+// dirs, and runproc's stdio.
+type Module struct {
+	Path string   `json:"path"`
+	Args []string `json:"args"`
+	Env  []string `json:"env,omitempty"`
+	Dirs []Dir    `json:"dirs,omitempty"`
+}
@@ -0,0 +1,64 @@
+//go:build cgo && wasmtime
+
+package wasm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/bytecodealliance/wasmtime-go/v20"
+)
+
+// Embedded reports whether this build links the runtime.
+const Embedded = true
+
+// Run instantiates m as a WASI command and calls its _start. It returns the status the
+// module passed to proc_exit, or 0 when _start returned; a trap is an error.
+func Run(m Module) (int, error) {
+	engine := wasmtime.NewEngine()
+	module, err := wasmtime.NewModuleFromFile(engine, m.Path)
+	if err != nil {
+		return 0, fmt.Errorf("load %s: %w", m.Path, err)
+	}
+	wasi := wasmtime.NewWasiConfig()
+	wasi.SetArgv(m.Args)
+	keys, values := make([]string, 0, len(m.Env)), make([]string, 0, len(m.Env))
+	for _, e := range m.Env {
+		k, v, _ := strings.Cut(e, "=")
+		keys, values = append(keys, k), append(values, v)
+	}
+	wasi.SetEnv(keys, values)
+	wasi.InheritStdin()
+	wasi.InheritStdout()
+	wasi.InheritStderr()
+	for _, d := range m.Dirs {
+		if err := wasi.PreopenDir(d.Host, d.Guest); err != nil {
+			return 0, fmt.Errorf("preopen %s as %s: %w", d.Host, d.Guest, err)
+		}
+	}
+	store := wasmtime.NewStore(engine)
+	store.SetWasi(wasi)
+	linker := wasmtime.NewLinker(engine)
+	if err := linker.DefineWasi(); err != nil {
+		return 0, err
+	}
+	instance, err := linker.Instantiate(store, module)
+	if err != nil {
+		return 0, fmt.Errorf("instantiate %s: %w", m.Path, err)
+	}
+	start := instance.GetFunc(store, "_start")
+	if start == nil {
+		return 0, fmt.Errorf("%s exports no _start: not a WASI command", m.Path)
+	}
+	if _, err := start.Call(store); err != nil {
+		var exit *wasmtime.Error
+		if errors.As(err, &exit) {
+			if status, ok := exit.ExitStatus(); ok {
+				return int(status), nil
+			}
+		}
+		return 0, err
+	}
+	return 0, nil
+}
@@ -0,0 +1,141 @@
+// Package runproc is the Go API of runproc for programs that embed or drive it. It is
+// the only exported package of the module; everything else is internal and may change.
+//
+// Features reports what this build of runproc supports on the running node, so callers
+// can adapt without parsing `runproc features`, which prints the same information as an
+// OCI features document.
+package runproc
+
+import (
+	"os/exec"
+	"sort"
+
+	"github.com/ktsakalozos/runproc/internal/apparmor"
+	"github.com/ktsakalozos/runproc/internal/cgroups"
+	"github.com/ktsakalozos/runproc/internal/oci"
+	"github.com/ktsakalozos/runproc/internal/resctrl"
+	"github.com/ktsakalozos/runproc/internal/selinux"
+	"github.com/ktsakalozos/runproc/internal/wasm"
+)
+
+// FeatureSet describes a runproc build and the node it runs on. Fields only grow; a new
+// capability of runproc is reported by a new field, never by changing an existing one.
+type FeatureSet struct {
+	// OCIVersionMin and OCIVersionMax bound the config.json versions runproc accepts.
+	OCIVersionMin string `json:"ociVersionMin"`
+	OCIVersionMax string `json:"ociVersionMax"`
+	// Namespaces are the linux.namespaces types runproc creates or joins.
+	Namespaces []string `json:"namespaces"`
+	// Capabilities are the process.capabilities names runproc can set.
+	Capabilities []string `json:"capabilities"`
+	// Hooks are the config.json hooks runproc runs.
+	Hooks []string `json:"hooks"`
+	// MountOptions are the mount options runproc applies (flags and propagation).
+	MountOptions []string `json:"mountOptions"`
+	// Annotations are the runproc.* config annotations runproc interprets.
+	Annotations []string `json:"annotations"`
+	// Cgroup describes cgroup support.
+	Cgroup CgroupFeatures `json:"cgroup"`
+	// Seccomp, Landlock, AppArmor and SELinux report whether runproc applies that kind of
+	// confinement. Seccomp is always applied; AppArmor and SELinux are reported when the
+	// node enables them.
+	Seccomp  bool `json:"seccomp"`
+	Landlock bool `json:"landlock"`
+	AppArmor bool `json:"apparmor"`
+	SELinux  bool `json:"selinux"`
+	// IntelRdt reports whether runproc can honor linux.intelRdt: resctrl is mounted.
+	IntelRdt bool `json:"intelRdt"`
+	// IDMappedMounts reports that runproc idmaps bind mounts with uidMappings and
+	// gidMappings of their own (the kernel needs 5.12 or newer).
+	IDMappedMounts bool `json:"idmappedMounts"`
+	// Checkpoint reports whether `runproc checkpoint` can work: criu is in PATH.
+	Checkpoint bool `json:"checkpoint"`
+	// Wasm describes the experimental WASM backend.
+	Wasm WasmFeatures `json:"wasm"`
+}
+
+// CgroupFeatures describes cgroup support.
+type CgroupFeatures struct {
+	// Driver is how runproc places containers in cgroups: "cgroupfs" when it creates them
+	// (any node with a cgroup hierarchy mounted), otherwise "none" (containers stay in
+	// their caller's, e.g. the shim's).
+	Driver string `json:"driver"`
+	// V1 and V2 report the hierarchies mounted on the node (both on hybrid hosts), which
+	// `runproc stats` reads usage from.
+	V1 bool `json:"v1"`
+	V2 bool `json:"v2"`
+	// Systemd reports whether the systemd driver (--systemd-cgroup), which puts containers
+	// in transient scope units, can work: systemd runs the node and busctl is in PATH.
+	Systemd bool `json:"systemd"`
+}
+
+// WasmFeatures describes the WASM backend.
+type WasmFeatures struct {
+	// Enabled reports whether this build embeds the runtime (cgo and the wasmtime build
+	// tag).
+	Enabled bool `json:"enabled"`
+	// Runtime is the WASI runtime wasm workloads run under.
+	Runtime string `json:"runtime"`
+}
+
+// namespaces lists the namespace types of oci.NamespaceCloneFlags, sorted.
+func namespaces() []string {
+	var out []string
+	for t := range oci.NamespaceCloneFlags {
+		out = append(out, string(t))
+	}
+	sort.Strings(out)
+	return out
+}
+
+// capabilities lists the names of oci.CapabilityBits in bit order.
+func capabilities() []string {
+	var out []string
+	for c := range oci.CapabilityBits {
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool { return oci.CapabilityBits[out[i]] < oci.CapabilityBits[out[j]] })
+	return out
+}
+
+// WasmRuntime is the WASI runtime the WASM backend embeds.
+const WasmRuntime = wasm.Runtime
+
+// Features reports what runproc supports. The static part comes from this build; the
+// cgroup hierarchies, AppArmor, SELinux, resctrl and criu are detected on the node at
+// each call.
+func Features() FeatureSet {
+	f := FeatureSet{
+		OCIVersionMin: "1.0.0",
+		OCIVersionMax: oci.Version,
+		Namespaces:    namespaces(),
+		Capabilities:  capabilities(),
+		Hooks:         append([]string(nil), oci.HookStages...),
+		MountOptions:  oci.MountOptions(),
+		Annotations:   append([]string(nil), oci.Annotations...),
+		Cgroup:        CgroupFeatures{Driver: "none", Systemd: cgroups.SystemdAvailable()},
+		Seccomp:       true,
+		AppArmor:      apparmor.Enabled(),
+		SELinux:       selinux.Enabled(),
+		IntelRdt:      resctrl.Enabled(),
+		// The kernel's support shows when a mount is made
+		IDMappedMounts: true,
+		Wasm:           WasmFeatures{Enabled: wasm.Embedded, Runtime: WasmRuntime},
+	}
+	if cgroups.Manageable() {
+		f.Cgroup.Driver = "cgroupfs"
+	}
+	if hierarchies, err := cgroups.Hierarchies(); err == nil {
+		for _, h := range hierarchies {
+			if h.Type == "cgroup2" {
+				f.Cgroup.V2 = true
+			} else {
+				f.Cgroup.V1 = true
+			}
+		}
+	}
+	if _, err := exec.LookPath("criu"); err == nil {
+		f.Checkpoint = true
+	}
+	return f
+}